@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/diagnostics"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/admin"
+	"github.com/princetheprogrammer/synapse/pkg/backup"
+	"github.com/princetheprogrammer/synapse/pkg/node"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+)
+
+// runCommand executes an offline subcommand against a stopped node's data
+// directory
+func runCommand(cfg *config.Config, log *logger.Logger, storageMgr *storage.Manager, args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "backup" && args[1] == "now":
+		return backupNow(cfg, log, storageMgr)
+	case len(args) == 2 && args[0] == "restore":
+		return restore(cfg, args[1])
+	case len(args) == 1 && args[0] == "status":
+		return status(cfg)
+	case len(args) == 1 && args[0] == "peers":
+		return peers(cfg)
+	case len(args) >= 2 && args[0] == "peers" && args[1] == "export":
+		return exportPeers(cfg, args[2:])
+	case len(args) == 3 && args[0] == "peers" && args[1] == "import":
+		return importPeers(cfg, args[2])
+	case len(args) >= 1 && args[0] == "discover":
+		return discover(cfg, args[1:])
+	case len(args) == 2 && args[0] == "connect":
+		return connect(cfg, args[1])
+	case len(args) >= 2 && args[0] == "ping":
+		return ping(cfg, args[1:])
+	case len(args) >= 2 && args[0] == "trace":
+		return trace(cfg, args[1:])
+	case len(args) >= 2 && args[0] == "disconnect":
+		return disconnect(cfg, args[1:])
+	case len(args) == 2 && args[0] == "key" && args[1] == "rotate":
+		return rotateKey(cfg)
+	default:
+		return fmt.Errorf("unknown command %q; expected \"backup now\", \"restore <archive>\", \"status\", \"peers\", \"peers export\", \"peers import <file>\", \"discover\", \"connect <address>\", \"ping <peer>\", \"trace <peer>\", \"disconnect <peer>\", \"key rotate\" or \"doctor\"", args)
+	}
+}
+
+// backupNow writes a backup archive of the data directory
+func backupNow(cfg *config.Config, log *logger.Logger, storageMgr *storage.Manager) error {
+	dataDir := cfg.Storage.DataDir
+	if err := backup.CheckStopped(dataDir); err != nil {
+		return err
+	}
+
+	nodeID, err := node.LoadIdentity(dataDir)
+	if err != nil {
+		return err
+	}
+	if cfg.Node.ID != "" {
+		nodeID = cfg.Node.ID
+	}
+
+	backups, err := backup.NewManager(storageMgr, log, nodeID, cfg.Storage.BackupRetention, 0)
+	if err != nil {
+		return err
+	}
+
+	archive, err := backups.Create()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backup written to %s\n", archive)
+	return nil
+}
+
+// restore unpacks a verified archive into the data directory
+func restore(cfg *config.Config, archive string) error {
+	manifest, err := backup.Restore(archive, cfg.Storage.DataDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %d files from %s (node %s, taken %s)\n",
+		len(manifest.Files), archive, manifest.NodeID, manifest.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+	return nil
+}
+
+// status reports whether a node is running on the data directory and, if
+// it can be reached, how it is connected
+func status(cfg *config.Config) error {
+	info, err := node.ReadLock(cfg.Storage.DataDir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info == nil:
+		fmt.Println("not running")
+		return nil
+	case !info.Alive():
+		fmt.Printf("not running (stale lock left by pid %d)\n", info.PID)
+		return nil
+	case info.AdminAddr != "":
+		fmt.Printf("running (pid %d), admin API at http://%s\n", info.PID, info.AdminAddr)
+	default:
+		fmt.Printf("running (pid %d)\n", info.PID)
+	}
+
+	if admin.ControlSocketPath(cfg) == "" {
+		return nil
+	}
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	network, err := client.Status(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("node %s, up %s, %d peers connected of %d known, %d connections\n", network.NodeID,
+		network.Uptime.Round(time.Second).String(), network.ConnectedPeers, network.TotalPeers, network.ActiveConnections)
+	if network.OutboundOnly {
+		fmt.Println("  listening disabled, reachable only over outbound connections")
+	}
+	for _, listener := range network.Listeners {
+		state := "listening"
+		if !listener.Listening {
+			state = "failed: " + listener.Error
+		}
+		advertised := "not advertised"
+		if len(listener.Advertise) > 0 {
+			advertised = "advertised over " + strings.Join(listener.Advertise, ", ")
+		}
+		if listener.FallbackFrom > 0 {
+			state += fmt.Sprintf(" in place of port %d, which was in use", listener.FallbackFrom)
+		}
+		fmt.Printf("  listener %s (%s), %s, %s\n", listener.Address, listener.BoundAddress, state, advertised)
+	}
+	return nil
+}
+
+// peers lists the peers of the running node
+func peers(cfg *config.Config) error {
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	peers, err := client.Peers(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tVERSION\tCONNECTED\tFLAPS")
+	for _, peer := range peers {
+		flaps := fmt.Sprint(peer.Flaps.Flaps)
+		if peer.Flaps.Damped {
+			flaps += " (damped)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", peer.ID, peer.Address, peer.Version,
+			time.Since(peer.ConnectedAt).Round(time.Second), flaps)
+	}
+	return w.Flush()
+}
+
+// exportPeers writes the peers the running node remembers as a peer list,
+// to the -output file or else to stdout
+func exportPeers(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("peers export", flag.ContinueOnError)
+	output := flags.String("output", "", "file to write the peer list to; stdout if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: synapse peers export [-output file]")
+	}
+
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	list, err := client.ExportPeers(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode peer list: %w", err)
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		return fmt.Errorf("failed to write peer list: %w", err)
+	}
+	fmt.Printf("exported %d peers to %s\n", len(list.Peers), *output)
+	return nil
+}
+
+// importPeers has the running node merge the peer list in path into the
+// peers it remembers. The list is checked before it is sent, so problems
+// are reported with where in the file they are.
+func importPeers(cfg *config.Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read peer list: %w", err)
+	}
+	list, err := p2p.ParsePeerList(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	result, err := client.ImportPeers(ctx, list)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %s: %d added, %d updated, %d unchanged, %d skipped\n",
+		path, result.Added, result.Updated, result.Unchanged, len(result.Skipped))
+	for _, skipped := range result.Skipped {
+		fmt.Printf("  skipped %s: %s\n", skipped.NodeID, skipped.Reason)
+	}
+	return nil
+}
+
+// discover has the running node look for peers at once, waiting up to -W
+// seconds for the discovery cycle, and prints what it found
+func discover(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	timeout := flags.Float64("W", 30, "seconds to wait for the discovery cycle")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: synapse discover [-W timeout]")
+	}
+	if *timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	wait := time.Duration(*timeout * float64(time.Second))
+
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait+controlTimeout)
+	defer cancel()
+	result, err := client.Discover(ctx, wait)
+	if err != nil {
+		return err
+	}
+	if result.Skipped {
+		fmt.Println("already connected to the target number of peers, not looking for more")
+		return nil
+	}
+	fmt.Printf("found %d candidate peers, dialed %d, connected to %d\n", result.Candidates, result.Dialed, result.Connected)
+	return nil
+}
+
+// connect has the running node dial a peer
+func connect(cfg *config.Config, address string) error {
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	peer, err := client.Connect(ctx, address)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("connected to %s at %s\n", peer.ID, peer.Address)
+	return nil
+}
+
+// ping has the running node ping a peer the way ping(8) does: -c pings, or
+// until interrupted, one every -i seconds, each waiting up to -W seconds for
+// its answer, then a summary
+func ping(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("ping", flag.ContinueOnError)
+	count := flags.Int("c", 0, "stop after this many pings; 0 pings until interrupted")
+	interval := flags.Float64("i", 1, "seconds between pings")
+	timeout := flags.Float64("W", 5, "seconds to wait for each answer")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: synapse ping [-c count] [-i interval] [-W timeout] <peer>")
+	}
+	if *count < 0 || *interval <= 0 || *timeout <= 0 {
+		return fmt.Errorf("count must not be negative, and interval and timeout must be positive")
+	}
+	peerID := flags.Arg(0)
+	wait := time.Duration(*timeout * float64(time.Second))
+
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ticker := time.NewTicker(time.Duration(*interval * float64(time.Second)))
+	defer ticker.Stop()
+
+	fmt.Printf("PING %s\n", peerID)
+	var sent, answered int
+	var fastest, slowest, total time.Duration
+pings:
+	for seq := 1; *count == 0 || seq <= *count; seq++ {
+		if seq > 1 {
+			select {
+			case <-ctx.Done():
+				break pings
+			case <-ticker.C:
+			}
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, wait+controlTimeout)
+		result, err := client.Ping(pingCtx, peerID, wait)
+		cancel()
+		if ctx.Err() != nil {
+			break
+		}
+		sent++
+		if err != nil {
+			fmt.Printf("seq=%d: %v\n", seq, err)
+			continue
+		}
+		answered++
+		rtt := result.RTT
+		total += rtt
+		if answered == 1 || rtt < fastest {
+			fastest = rtt
+		}
+		if rtt > slowest {
+			slowest = rtt
+		}
+		fmt.Printf("answer from %s: seq=%d time=%.3f ms trace=%s\n", peerID, seq, milliseconds(rtt), result.TraceID)
+	}
+
+	fmt.Printf("--- %s ping statistics ---\n", peerID)
+	lost := 0.0
+	if sent > 0 {
+		lost = 100 * float64(sent-answered) / float64(sent)
+	}
+	fmt.Printf("%d pings sent, %d answered, %.0f%% lost\n", sent, answered, lost)
+	if answered == 0 {
+		return fmt.Errorf("no answer from %s", peerID)
+	}
+	fmt.Printf("rtt min/avg/max = %.3f/%.3f/%.3f ms\n",
+		milliseconds(fastest), milliseconds(total/time.Duration(answered)), milliseconds(slowest))
+	return nil
+}
+
+// trace has the running node trace the route to a peer and prints its hops
+// the way traceroute(8) does, waiting up to -W seconds for the trace
+func trace(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("trace", flag.ContinueOnError)
+	timeout := flags.Float64("W", 10, "seconds to wait for the trace")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: synapse trace [-W timeout] <peer>")
+	}
+	if *timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	peerID := flags.Arg(0)
+	wait := time.Duration(*timeout * float64(time.Second))
+
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait+controlTimeout)
+	defer cancel()
+
+	result, err := client.Trace(ctx, peerID, wait)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("trace to %s, %d hops max, trace ID %s\n", peerID, p2p.MaxTraceHops, result.TraceID)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, hop := range result.Hops {
+		fmt.Fprintf(w, "%2d\t%s\t%.3f ms\t%s\n", i+1, hop.NodeID, milliseconds(hop.Latency), hop.Address)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return fmt.Errorf("%s", result.Error)
+	}
+	return nil
+}
+
+// disconnect has the running node disconnect a peer: -drain first lets the
+// reliable sends to it finish, waiting up to -W seconds, and -hold keeps the
+// node from redialing it for that long
+func disconnect(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("disconnect", flag.ContinueOnError)
+	drain := flags.Bool("drain", false, "let reliable sends finish and say goodbye before closing")
+	timeout := flags.Float64("W", 5, "seconds to wait for reliable sends when draining")
+	hold := flags.Duration("hold", 0, "how long the node must not redial the peer")
+	reason := flags.String("reason", "", "why the peer is disconnected")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: synapse disconnect [-drain] [-W timeout] [-hold duration] [-reason text] <peer>")
+	}
+	if *timeout <= 0 || *hold < 0 {
+		return fmt.Errorf("timeout must be positive and hold must not be negative")
+	}
+	wait := time.Duration(*timeout * float64(time.Second))
+
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait+controlTimeout)
+	defer cancel()
+	result, err := client.Disconnect(ctx, flags.Arg(0), p2p.DisconnectOptions{
+		Reason:       *reason,
+		Drain:        *drain,
+		DrainTimeout: wait,
+		NoReconnect:  *hold,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("disconnected %s\n", result.PeerID)
+	if result.NoReconnect > 0 {
+		fmt.Printf("not redialing it for %v\n", result.NoReconnect)
+	}
+	return nil
+}
+
+// milliseconds converts d to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// rotateKey has the running node replace its identity key and announce the
+// new one to its peers
+func rotateKey(cfg *config.Config) error {
+	client, err := controlClient(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	rotation, err := client.RotateKey(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rotated identity key from %s to %s\n", rotation.OldFingerprint, rotation.NewFingerprint)
+	return nil
+}
+
+// runDoctor checks why the node configured by cfg might not connect, prints
+// the outcome of each check and exits, with status 1 if any failed.
+// loadErr is the error loading the configuration failed with, if it did.
+func runDoctor(cfg *config.Config, loadErr error, args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	ntpServer := flags.String("ntp-server", diagnostics.DefaultNTPServer, "SNTP server, as host:port, to compare the clock with")
+	timeout := flags.Float64("W", diagnostics.DefaultTimeout.Seconds(), "seconds to wait for each network probe")
+	flags.Parse(args)
+
+	report := diagnostics.Run(context.Background(), cfg, loadErr, diagnostics.Options{
+		NTPServer: *ntpServer,
+		Timeout:   time.Duration(*timeout * float64(time.Second)),
+	})
+	if *asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "doctor: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, result := range report.Results {
+			fmt.Printf("[%s] %s: %s\n", strings.ToUpper(string(result.Status)), result.Name, result.Detail)
+			if result.Hint != "" && result.Status != diagnostics.StatusPass {
+				fmt.Printf("       %s\n", result.Hint)
+			}
+		}
+	}
+
+	if report.Failed > 0 {
+		fmt.Fprintf(os.Stderr, "doctor: %d of %d checks failed\n", report.Failed, len(report.Results))
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// controlTimeout bounds a command sent to the running node
+const controlTimeout = 30 * time.Second
+
+// controlClient returns a client for the control endpoint of the node
+// running on the data directory
+func controlClient(cfg *config.Config) (*admin.Client, error) {
+	path := admin.ControlSocketPath(cfg)
+	if path == "" {
+		return nil, fmt.Errorf("the control socket is disabled in the config")
+	}
+	return admin.NewClient(admin.NewControlEndpoint(path)), nil
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
 
 	"github.com/princetheprogrammer/synapse/internal/config"
@@ -27,6 +28,8 @@ func main() {
 		logLevel    string
 		logFormat   string
 		port        int
+		noListen    bool
+		dataDir     string
 	)
 
 	flag.StringVar(&configPath, "config", "", "path to configuration file")
@@ -34,6 +37,8 @@ func main() {
 	flag.StringVar(&logLevel, "log-level", "", "log level (debug, info, warn, error)")
 	flag.StringVar(&logFormat, "log-format", "", "log format (json, console)")
 	flag.IntVar(&port, "port", 0, "P2P listen port (overrides config)")
+	flag.BoolVar(&noListen, "no-listen", false, "open no P2P listener, only dial out (overrides config)")
+	flag.StringVar(&dataDir, "data-dir", "", "data directory (overrides config)")
 	flag.Parse()
 
 	if showVersion {
@@ -43,8 +48,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	// doctor reports a configuration that does not load or is invalid
+	// along with everything else it checks
+	diagnose := flag.Arg(0) == "doctor"
 	cfg, err := loadConfig(configPath)
 	if err != nil {
+		if diagnose {
+			runDoctor(nil, err, flag.Args()[1:])
+		}
 		fmt.Fprintf(os.Stderr, "failed to load configuration: %v\n", err)
 		os.Exit(1)
 	}
@@ -58,24 +69,56 @@ func main() {
 	if port > 0 {
 		cfg.P2P.ListenPort = port
 	}
+	if noListen {
+		cfg.P2P.ListenEnabled = false
+	}
+	if dataDir != "" {
+		cfg.Storage.DataDir = dataDir
+	}
+
+	if diagnose {
+		runDoctor(cfg, nil, flag.Args()[1:])
+	}
 
 	if err := cfg.Validate(); err != nil {
 		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
 		os.Exit(1)
 	}
 
-	log, err := logger.New(cfg.Logging.Level, cfg.Logging.Format, cfg.Logging.OutputFile)
+	storageMgr, err := node.NewStorageManager(cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to initialize logger: %v\n", err)
+		fmt.Fprintf(os.Stderr, "failed to initialize storage: %v\n", err)
 		os.Exit(1)
 	}
 
+	// Log files inside the data directory count against the storage quota
+	var logOutput io.Writer = os.Stdout
+	if cfg.Logging.OutputFile != "" {
+		file, err := storageMgr.OpenAppend(cfg.Logging.OutputFile, 0666)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to initialize logger: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		logOutput = file
+	}
+	log := logger.NewWithWriter(cfg.Logging.Level, cfg.Logging.Format, logOutput)
+
+	if args := flag.Args(); len(args) > 0 {
+		if err := runCommand(cfg, log, storageMgr, args); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Infof("starting synapse version %s", version)
 
 	n, err := node.New(cfg, log)
 	if err != nil {
 		log.Fatalf("failed to create node: %v", err)
 	}
+	n.SetStorage(storageMgr)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -89,30 +132,47 @@ func main() {
 
 	log.Info("synapse is running, press Ctrl+C to stop")
 
-	sig := <-sigCh
-	log.Infof("received signal: %s, initiating shutdown", sig)
+	// The node may also stop on its own, e.g. when a subsystem fails
+	done := make(chan struct{})
+	go func() {
+		n.Wait()
+		close(done)
+	}()
+
+	failed := false
+	select {
+	case sig := <-sigCh:
+		log.Infof("received signal: %s, initiating shutdown", sig)
+	case <-done:
+		log.Errorf("node stopped with status %s, shutting down", n.Status())
+		failed = true
+	}
 
 	cancel()
 
-	if err := n.Stop(); err != nil {
+	if err := n.Stop(); err != nil && !errors.Is(err, node.ErrAlreadyStopped) {
 		log.Errorf("error during shutdown: %v", err)
 		os.Exit(1)
 	}
 
 	n.Wait()
+	if failed {
+		os.Exit(1)
+	}
 	log.Info("synapse stopped successfully")
 }
 
+// loadConfig loads the config file at configPath, or if that is empty the
+// one in the default directory. Where there is no default directory the
+// defaults are used, which name no data directory.
 func loadConfig(configPath string) (*config.Config, error) {
 	if configPath != "" {
 		return config.Load(configPath)
 	}
 
-	homeDir, err := os.UserHomeDir()
+	defaultPath, err := config.DefaultConfigPath()
 	if err != nil {
 		return config.Default(), nil
 	}
-
-	defaultPath := filepath.Join(homeDir, ".synapse", "config.json")
 	return config.Load(defaultPath)
 }
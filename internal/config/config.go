@@ -3,16 +3,30 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/princetheprogrammer/synapse/internal/fileperm"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
 )
 
 type Config struct {
-	Node    NodeConfig    `json:"node"`
-	P2P     P2PConfig     `json:"p2p"`
-	Storage StorageConfig `json:"storage"`
-	AI      AIConfig      `json:"ai"`
-	Logging LoggingConfig `json:"logging"`
+	Node     NodeConfig     `json:"node"`
+	P2P      P2PConfig      `json:"p2p"`
+	Topology TopologyConfig `json:"topology"`
+	Storage  StorageConfig  `json:"storage"`
+	AI       AIConfig       `json:"ai"`
+	Admin    AdminConfig    `json:"admin"`
+	Audit    AuditConfig    `json:"audit"`
+	Tasks    TaskConfig     `json:"tasks"`
+	Blobs    BlobConfig     `json:"blobs"`
+	Logging  LoggingConfig  `json:"logging"`
 }
 
 type NodeConfig struct {
@@ -25,12 +39,304 @@ type P2PConfig struct {
 	BootstrapPeers  []string `json:"bootstrap_peers"`
 	MaxPeers        int      `json:"max_peers"`
 	EnableDiscovery bool     `json:"enable_discovery"`
+	EnableRelay     bool     `json:"enable_relay"`
+
+	// Listeners, when set, replace ListenPort with one listener per entry,
+	// e.g. a LAN interface for mDNS peers and a WAN one for bootstrap peers
+	Listeners []ListenerConfig `json:"listeners,omitempty"`
+	// ListenEnabled false opens no listener at all, for clients behind
+	// firewalls that only let them dial out; peers reach the node over the
+	// connections it opens and through relays
+	ListenEnabled bool `json:"listen_enabled"`
+	// PortFallback has a listener whose port is in use take the next free
+	// one of the PortRange ports after it instead of failing to start
+	PortFallback bool `json:"port_fallback"`
+	PortRange    int  `json:"port_range"`
+
+	MinPeers           int `json:"min_peers"`
+	IsolationThreshold int `json:"isolation_threshold"`
+
+	// Discovery keeps dialing new peers every interval while below the target
+	TargetPeers       int `json:"target_peers"`
+	DiscoveryInterval int `json:"discovery_interval"`
+	// Losing a peer below DiscoveryFloor starts a discovery cycle at once;
+	// 0 waits for the interval
+	DiscoveryFloor int `json:"discovery_floor"`
+
+	// EnableQUIC upgrades connections to peers that also advertise QUIC
+	EnableQUIC bool `json:"enable_quic"`
+
+	// PreferredAddressFamily ("ipv4" or "ipv6") is dialed first when a peer
+	// has both; without DualStack it is the only family used
+	PreferredAddressFamily string `json:"preferred_address_family"`
+	DualStack              bool   `json:"dual_stack"`
+
+	// MaxClockSkew is how far, in seconds, a message timestamp may be from
+	// our clock before the message is rejected
+	MaxClockSkew int `json:"max_clock_skew"`
+
+	// WireCodec ("json" or "cbor") encodes messages to peers that also
+	// support it; JSON is always used with peers that do not
+	WireCodec string `json:"wire_codec"`
+
+	// Metadata labels this node to its peers in HELLO, e.g.
+	// {"datacenter": "a", "edge": ""}
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// StaticPeers ("nodeID@host:port") are kept connected at all times and
+	// must present the configured node ID
+	StaticPeers []string `json:"static_peers"`
+
+	// MDNS is the service local discovery advertises and browses for
+	MDNS MDNSConfig `json:"mdns"`
+
+	// AllowedCIDRs and DeniedCIDRs limit the addresses we accept
+	// connections from and dial. An empty allowlist allows every address
+	// not denied.
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+	DeniedCIDRs  []string `json:"denied_cidrs"`
+
+	// MaxConcurrentDials bounds the outbound connections being set up at
+	// once; further dials wait for a slot
+	MaxConcurrentDials int `json:"max_concurrent_dials"`
+	// DialCooldown is how long, in seconds, an address is not redialed
+	// after a failed dial; 0 disables the cooldown
+	DialCooldown int `json:"dial_cooldown"`
+	// DialAttemptDelayMS is how long, in milliseconds, a dial to one of a
+	// peer's addresses runs before its next address is dialed alongside it
+	DialAttemptDelayMS int `json:"dial_attempt_delay_ms"`
+
+	// TraceAddresses has the hop this node adds to a TRACE include the
+	// address the TRACE reached it at; by default hops name only the node
+	TraceAddresses bool `json:"trace_addresses"`
+
+	// WriteTimeout is how long, in seconds, a write to a peer may block
+	// before it fails
+	WriteTimeout int `json:"write_timeout"`
+	// A peer whose writes time out SlowPeerThreshold times in a row is slow:
+	// broadcasts reach it last and it loses reputation with every further
+	// timeout. At SlowPeerDisconnect timeouts in a row it is disconnected;
+	// 0 keeps slow peers connected.
+	SlowPeerThreshold  int `json:"slow_peer_threshold"`
+	SlowPeerDisconnect int `json:"slow_peer_disconnect"`
+
+	// Each peer may send PeerMessageRate messages per second, in bursts of
+	// up to PeerMessageBurst; we drop the rest unread. Heartbeats and pings
+	// have a small allowance of their own. A peer still flooding us after
+	// RateLimitDisconnect seconds in a row is disconnected; 0 keeps it
+	// connected.
+	PeerMessageRate     int `json:"peer_message_rate"`
+	PeerMessageBurst    int `json:"peer_message_burst"`
+	RateLimitDisconnect int `json:"rate_limit_disconnect"`
+
+	// Every CleanupInterval seconds, connections that carried nothing either
+	// way for a while are pinged, and closed unless the peer answers within
+	// CleanupGrace seconds
+	CleanupInterval int `json:"cleanup_interval"`
+	CleanupGrace    int `json:"cleanup_grace"`
+
+	// With LivenessRumors, heartbeats, pings and their answers name the
+	// peers the sender recently heard from, and idle connections to peers
+	// others vouch for are pinged less often
+	LivenessRumors bool `json:"liveness_rumors"`
+
+	// Dials and handshakes taking longer than SlowConnectMs milliseconds
+	// are logged as warnings; 0 logs none
+	SlowConnectMs int `json:"slow_connect_ms"`
+
+	// SessionCacheSize is how many peers' session tickets are kept, so a
+	// reconnect to one of them can skip the full handshake; 0 disables
+	// session resumption. Tickets expire after SessionTicketTTL seconds.
+	SessionCacheSize int `json:"session_cache_size"`
+	SessionTicketTTL int `json:"session_ticket_ttl"`
+
+	// KeyRotationGrace is how long, in seconds, peers still accept a key
+	// after its node rotated to a new one, and how long that node tells
+	// peers it reconnects to about the rotation
+	KeyRotationGrace int `json:"key_rotation_grace"`
+
+	// NetworkKey, if set, is a secret shared by the nodes of a private
+	// network; peers that do not know it are refused in the handshake
+	NetworkKey string `json:"network_key"`
+
+	// AcceptUnsignedPeers takes up peers listed in PEER_LIST or peer list
+	// files without a signed record of their own, as releases before signed
+	// records send them. It is meant for migrating a network; anyone can
+	// list any address for any node unsigned.
+	AcceptUnsignedPeers bool `json:"accept_unsigned_peers"`
+
+	// Queue bounds the application messages waiting for their handlers
+	Queue QueueConfig `json:"queue"`
+
+	// Batching coalesces small messages to peers that support it
+	Batching BatchingConfig `json:"batching"`
+
+	// Socket tunes the TCP connections peers talk over
+	Socket SocketConfig `json:"socket"`
+
+	// ReliableJournal keeps reliable messages until their peer acknowledges
+	// them, across restarts
+	ReliableJournal JournalConfig `json:"reliable_journal"`
+
+	// OrderedDelivery hands each peer's application messages to handlers
+	// in the order the peer sent them
+	OrderedDelivery OrderingConfig `json:"ordered_delivery"`
+
+	// FlapDamping holds back peers whose connections keep dropping
+	FlapDamping FlapDampingConfig `json:"flap_damping"`
+
+	// FaultInjection wraps every connection so resilience tests can drop,
+	// delay, duplicate and corrupt frames through Network.Faults. It is
+	// never meant for a production node.
+	FaultInjection FaultInjectionConfig `json:"fault_injection"`
+}
+
+// FaultInjectionConfig enables the fault injection layer. Seed seeds the
+// random choice of the frames faults hit, so a test sees the same ones each
+// run.
+type FaultInjectionConfig struct {
+	Enabled bool  `json:"enabled"`
+	Seed    int64 `json:"seed"`
+}
+
+// QueueConfig bounds the queue application messages wait in for their
+// handlers, and says what happens to messages arriving when it is full
+type QueueConfig struct {
+	// Size is how many messages may wait, in each type's queue if PerType
+	Size int `json:"size"`
+	// Overflow is "drop_newest" to drop the arriving message, "drop_oldest"
+	// to drop the longest waiting one instead, or "block" to hold up reads
+	// from the sending peer for up to BlockTimeoutMS milliseconds before
+	// dropping the arriving message
+	Overflow       string `json:"overflow"`
+	BlockTimeoutMS int    `json:"block_timeout_ms"`
+	// PerType gives every message type a queue of its own, taken from in
+	// turn, so a flood of one type cannot crowd out the others
+	PerType bool `json:"per_type"`
+}
+
+// BatchingConfig coalesces the small messages sent to a peer within a short
+// window into one frame, saving the framing and write of each. Heartbeats and
+// pings are never held back.
+type BatchingConfig struct {
+	Enabled bool `json:"enabled"`
+	// WindowMS is how many milliseconds a message waits for others to join
+	// it, and MaxBytes how many bytes of messages send a batch at once
+	WindowMS int `json:"window_ms"`
+	MaxBytes int `json:"max_bytes"`
+}
+
+// SocketConfig tunes accepted and dialed TCP connections before their
+// handshake. It does not apply to QUIC.
+type SocketConfig struct {
+	// KeepAlive probes idle connections so ones silently dropped, e.g. by a
+	// NAT gateway, are noticed. Probes start after KeepAlivePeriod seconds
+	// of idleness and repeat every KeepAlivePeriod seconds.
+	KeepAlive       bool `json:"keep_alive"`
+	KeepAlivePeriod int  `json:"keep_alive_period"`
+	// NoDelay disables Nagle's algorithm, sending small messages at once
+	NoDelay bool `json:"no_delay"`
+	// ReadBuffer and WriteBuffer size the socket buffers in bytes; 0 keeps
+	// the operating system's default
+	ReadBuffer  int `json:"read_buffer"`
+	WriteBuffer int `json:"write_buffer"`
+}
+
+// JournalConfig controls the journal that records each reliable message
+// before it is sent and until it is acknowledged, so one a crash cut short is
+// sent again once its peer reconnects
+type JournalConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxPending limits the messages waiting for an acknowledgement; reliable
+	// sends beyond it are refused
+	MaxPending int `json:"max_pending"`
+}
+
+// OrderingConfig controls ordered delivery. Messages a peer sent after one
+// that has not arrived yet are held back, up to Window of them, for at most
+// GapTimeoutMS milliseconds. Then OnGap says what happens: "skip" hands on
+// the held back messages without the missing one, "disconnect" closes the
+// connection to the peer.
+type OrderingConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Window       int    `json:"window"`
+	GapTimeoutMS int    `json:"gap_timeout_ms"`
+	OnGap        string `json:"on_gap"`
+}
+
+// FlapDampingConfig controls flap damping, which works like BGP route
+// damping. A peer that disconnects Threshold times within Window seconds is
+// damped for Penalty seconds: it is not redialed automatically, nor picked
+// for broadcasts and gossip. Each time it is damped again the penalty
+// doubles, up to MaxPenalty seconds, and for every Window seconds it goes
+// without being damped the penalty halves again.
+type FlapDampingConfig struct {
+	Enabled    bool `json:"enabled"`
+	Threshold  int  `json:"threshold"`
+	Window     int  `json:"window"`
+	Penalty    int  `json:"penalty"`
+	MaxPenalty int  `json:"max_penalty"`
+}
+
+// ListenerConfig is one address the node accepts connections on. Advertise
+// picks where the listener's port is announced: "hello" tells the peers we
+// connect to, "peer_list" lets them pass it on in PEER_LIST and "mdns"
+// announces it on the local network. Leaving Advertise unset announces it
+// everywhere; an empty list keeps it private.
+type ListenerConfig struct {
+	Address   string   `json:"address"`
+	Advertise []string `json:"advertise,omitempty"`
+}
+
+// Advertises reports whether the listener is announced over channel
+func (l ListenerConfig) Advertises(channel string) bool {
+	return l.Advertise == nil || slices.Contains(l.Advertise, channel)
+}
+
+// MDNSConfig names the mDNS service nodes find each other by. Only nodes
+// using the same service name and domain discover each other, which lets
+// private deployments keep to themselves.
+type MDNSConfig struct {
+	ServiceName string `json:"service_name"`
+	Domain      string `json:"domain"`
+}
+
+type TopologyConfig struct {
+	LatencyWeight    float64 `json:"latency_weight"`
+	BandwidthWeight  float64 `json:"bandwidth_weight"`
+	PacketLossWeight float64 `json:"packet_loss_weight"`
+	JitterWeight     float64 `json:"jitter_weight"`
+	ReputationWeight float64 `json:"reputation_weight"`
+	MeshThreshold    int     `json:"mesh_threshold"`
+
+	ReputationDecayInterval int     `json:"reputation_decay_interval"`
+	ReputationDecayRate     float64 `json:"reputation_decay_rate"`
+	ReputationInactiveAfter int     `json:"reputation_inactive_after"`
+}
+
+// Scoring returns the weights and mesh threshold peers are scored with
+func (t TopologyConfig) Scoring() topology.ScoringConfig {
+	return topology.ScoringConfig{
+		LatencyWeight:    t.LatencyWeight,
+		BandwidthWeight:  t.BandwidthWeight,
+		PacketLossWeight: t.PacketLossWeight,
+		JitterWeight:     t.JitterWeight,
+		ReputationWeight: t.ReputationWeight,
+		MeshThreshold:    t.MeshThreshold,
+	}
 }
 
 type StorageConfig struct {
 	DataDir       string `json:"data_dir"`
+	Backend       string `json:"backend"`
 	MaxSizeGB     int    `json:"max_size_gb"`
 	EnableBackups bool   `json:"enable_backups"`
+
+	SyncInterval  int     `json:"sync_interval"`
+	HighWaterMark float64 `json:"high_water_mark"`
+
+	BackupInterval  int `json:"backup_interval"`
+	BackupRetention int `json:"backup_retention"`
 }
 
 type AIConfig struct {
@@ -38,6 +344,88 @@ type AIConfig struct {
 	Timeout        int    `json:"timeout"`
 	MaxRetries     int    `json:"max_retries"`
 	EnableOffline  bool   `json:"enable_offline_queue"`
+
+	// Offline queue limits; the oldest requests are evicted first
+	QueueMaxItems int   `json:"offline_queue_max_items"`
+	QueueMaxBytes int64 `json:"offline_queue_max_bytes"`
+	DrainInterval int   `json:"offline_drain_interval"`
+
+	// MaxConcurrentPerPeer limits AI queries relayed for or to a single peer
+	MaxConcurrentPerPeer int `json:"max_concurrent_per_peer"`
+
+	// Answer cache limits; answers expire after CacheTTL seconds and the
+	// least recently used are evicted first. CachePersist saves the cache
+	// under the data directory so a restart keeps it.
+	EnableCache     bool  `json:"enable_cache"`
+	CacheMaxEntries int   `json:"cache_max_entries"`
+	CacheMaxBytes   int64 `json:"cache_max_bytes"`
+	CacheTTL        int   `json:"cache_ttl"`
+	CachePersist    bool  `json:"cache_persist"`
+
+	// APIKeyFile holds the key sent as a bearer token with every request.
+	// It is read at startup and must not be readable by other users.
+	APIKeyFile string `json:"api_key_file"`
+	// Headers are added to every request sent to the endpoint
+	Headers map[string]string `json:"headers"`
+	// ProxyURL sends requests through an HTTP(S) or SOCKS5 proxy instead of
+	// the one in the environment
+	ProxyURL string `json:"proxy_url"`
+}
+
+type AdminConfig struct {
+	Enabled    bool   `json:"enabled"`
+	ListenAddr string `json:"listen_addr"`
+	AuthToken  string `json:"auth_token"`
+	// ControlSocket is the unix socket local commands reach the node on,
+	// relative to the data directory unless absolute. Empty disables it.
+	ControlSocket string `json:"control_socket"`
+	// EnableProfiling serves pprof profiles under /debug/pprof/ and runtime
+	// stats at /debug/runtime. Over HTTP it needs an auth token.
+	EnableProfiling bool `json:"enable_profiling"`
+}
+
+// AuditConfig controls the peer lifecycle audit log, kept as JSON lines in
+// audit.log under the data directory
+type AuditConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxFileSizeMB is the size at which the log is rotated, keeping
+	// MaxFiles rotated files
+	MaxFileSizeMB int `json:"max_file_size_mb"`
+	MaxFiles      int `json:"max_files"`
+	// RateLimit is how many entries may be written per second; entries
+	// beyond it are dropped and counted
+	RateLimit int `json:"rate_limit"`
+	// ReputationThreshold is logged when a peer's reputation falls below it
+	// and when it recovers
+	ReputationThreshold float64 `json:"reputation_threshold"`
+}
+
+// TaskConfig controls the named tasks this node runs for its peers and
+// submits to them
+type TaskConfig struct {
+	// Timeout is how many seconds a task may run when its submitter sets no
+	// limit of its own
+	Timeout int `json:"timeout"`
+	// MaxRetries is how many more executors a task is tried on after the
+	// first one fails
+	MaxRetries int `json:"max_retries"`
+	// MaxConcurrent limits the tasks this node runs for peers at once
+	MaxConcurrent int `json:"max_concurrent"`
+}
+
+// BlobConfig controls the content-addressed blob store and how blobs are
+// fetched from peers
+type BlobConfig struct {
+	// ChunkSize is how many bytes of a blob a single BLOB_CHUNK carries
+	ChunkSize int `json:"chunk_size"`
+	// ChunkTimeout is how many seconds a peer has to send a requested chunk
+	ChunkTimeout int `json:"chunk_timeout"`
+	// GCInterval is how many seconds pass between collections of blobs
+	// nothing references
+	GCInterval int `json:"gc_interval"`
+	// GCGrace is how many seconds an unreferenced blob, or an abandoned
+	// download, is kept before it is collected
+	GCGrace int `json:"gc_grace"`
 }
 
 type LoggingConfig struct {
@@ -46,9 +434,24 @@ type LoggingConfig struct {
 	OutputFile string `json:"output_file"`
 }
 
+// MinNetworkKeyLength is the shortest network key accepted, to keep it from
+// being guessed
+const MinNetworkKeyLength = 16
+
+// MaxBlobChunkSize is the largest blob chunk that still fits, base64-encoded,
+// in a single message
+const MaxBlobChunkSize = 512 * 1024
+
+// mdnsServiceName matches DNS-SD service types such as "_synapse._tcp"
+var mdnsServiceName = regexp.MustCompile(`^_[A-Za-z0-9](?:[A-Za-z0-9-]{0,13}[A-Za-z0-9])?\._(?:tcp|udp)$`)
+
+// headerName matches an HTTP header field name (RFC 9110 token)
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
 func Default() *Config {
-	homeDir, _ := os.UserHomeDir()
-	dataDir := filepath.Join(homeDir, ".synapse", "data")
+	// Left empty where there is no default directory, which Validate
+	// reports unless a data directory is set
+	dataDir, _ := DefaultDataDir()
 
 	return &Config{
 		Node: NodeConfig{
@@ -60,17 +463,162 @@ func Default() *Config {
 			BootstrapPeers:  []string{},
 			MaxPeers:        50,
 			EnableDiscovery: false,
+			EnableRelay:     true,
+			ListenEnabled:   true,
+			PortRange:       10,
+
+			MinPeers:           1,
+			IsolationThreshold: 60,
+
+			TargetPeers:       8,
+			DiscoveryInterval: 30,
+			DiscoveryFloor:    4,
+
+			EnableQUIC: true,
+
+			PreferredAddressFamily: "ipv4",
+			DualStack:              true,
+
+			MaxClockSkew: 300,
+
+			WireCodec: "json",
+
+			StaticPeers: []string{},
+
+			MDNS: MDNSConfig{
+				ServiceName: "_synapse._tcp",
+				Domain:      "local.",
+			},
+
+			AllowedCIDRs: []string{},
+			DeniedCIDRs:  []string{},
+
+			MaxConcurrentDials: 16,
+			DialCooldown:       10,
+			DialAttemptDelayMS: 250,
+
+			TraceAddresses: false,
+
+			WriteTimeout:       10,
+			SlowPeerThreshold:  3,
+			SlowPeerDisconnect: 6,
+
+			PeerMessageRate:     200,
+			PeerMessageBurst:    400,
+			RateLimitDisconnect: 10,
+
+			CleanupInterval: 30,
+			CleanupGrace:    5,
+
+			LivenessRumors: true,
+
+			SlowConnectMs: 2000,
+
+			SessionCacheSize: 256,
+			SessionTicketTTL: 3600,
+
+			KeyRotationGrace: 7 * 24 * 3600,
+
+			Queue: QueueConfig{
+				Size:           100,
+				Overflow:       "drop_newest",
+				BlockTimeoutMS: 100,
+			},
+
+			Batching: BatchingConfig{
+				WindowMS: 5,
+				MaxBytes: 16 * 1024,
+			},
+
+			Socket: SocketConfig{
+				KeepAlive:       true,
+				KeepAlivePeriod: 15,
+				NoDelay:         true,
+				ReadBuffer:      0,
+				WriteBuffer:     0,
+			},
+
+			ReliableJournal: JournalConfig{
+				MaxPending: 1024,
+			},
+
+			OrderedDelivery: OrderingConfig{
+				Window:       256,
+				GapTimeoutMS: 2000,
+				OnGap:        "skip",
+			},
+			FlapDamping: FlapDampingConfig{
+				Threshold:  3,
+				Window:     60,
+				Penalty:    30,
+				MaxPenalty: 600,
+			},
+		},
+		Topology: TopologyConfig{
+			LatencyWeight:    0.21,
+			BandwidthWeight:  0.21,
+			PacketLossWeight: 0.14,
+			JitterWeight:     0.14,
+			ReputationWeight: 0.30,
+			MeshThreshold:    10,
+
+			ReputationDecayInterval: 300,
+			ReputationDecayRate:     0.1,
+			ReputationInactiveAfter: 600,
 		},
 		Storage: StorageConfig{
 			DataDir:       dataDir,
+			Backend:       "bolt",
 			MaxSizeGB:     10,
 			EnableBackups: true,
+			SyncInterval:  30,
+			HighWaterMark: 0.9,
+
+			BackupInterval:  86400,
+			BackupRetention: 7,
 		},
 		AI: AIConfig{
 			Endpoint:      "https://svceai.site/api/chat",
 			Timeout:       30,
 			MaxRetries:    3,
 			EnableOffline: true,
+
+			QueueMaxItems: 1000,
+			QueueMaxBytes: 16 * 1024 * 1024,
+			DrainInterval: 30,
+
+			MaxConcurrentPerPeer: 4,
+
+			EnableCache:     true,
+			CacheMaxEntries: 1000,
+			CacheMaxBytes:   8 * 1024 * 1024,
+			CacheTTL:        3600,
+		},
+		Admin: AdminConfig{
+			Enabled:         false,
+			ListenAddr:      "127.0.0.1:9090",
+			AuthToken:       "",
+			ControlSocket:   "synapse.sock",
+			EnableProfiling: false,
+		},
+		Audit: AuditConfig{
+			Enabled:       false,
+			MaxFileSizeMB: 10,
+			MaxFiles:      5,
+			RateLimit:     50,
+
+			ReputationThreshold: -0.5,
+		},
+		Tasks: TaskConfig{
+			Timeout:       60,
+			MaxRetries:    2,
+			MaxConcurrent: 4,
+		},
+		Blobs: BlobConfig{
+			ChunkSize:    256 * 1024,
+			ChunkTimeout: 10,
+			GCInterval:   3600,
+			GCGrace:      3600,
 		},
 		Logging: LoggingConfig{
 			Level:      "info",
@@ -128,13 +676,337 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("max peers must be at least 1")
 	}
 
+	if c.P2P.MinPeers < 0 || c.P2P.MinPeers > c.P2P.MaxPeers {
+		return fmt.Errorf("min peers must be between 0 and max peers")
+	}
+
+	if c.P2P.IsolationThreshold < 1 {
+		return fmt.Errorf("isolation threshold must be at least 1 second")
+	}
+
+	if c.P2P.TargetPeers < c.P2P.MinPeers || c.P2P.TargetPeers > c.P2P.MaxPeers {
+		return fmt.Errorf("target peers must be between min peers and max peers")
+	}
+
+	if c.P2P.DiscoveryInterval < 1 {
+		return fmt.Errorf("discovery interval must be at least 1 second")
+	}
+
+	if c.P2P.DiscoveryFloor < 0 || c.P2P.DiscoveryFloor > c.P2P.TargetPeers {
+		return fmt.Errorf("discovery floor must be between 0 and target peers")
+	}
+
+	if c.P2P.PreferredAddressFamily != "ipv4" && c.P2P.PreferredAddressFamily != "ipv6" {
+		return fmt.Errorf("preferred address family must be ipv4 or ipv6, got %q", c.P2P.PreferredAddressFamily)
+	}
+
+	if c.P2P.MaxClockSkew < 1 {
+		return fmt.Errorf("max clock skew must be at least 1 second")
+	}
+
+	if c.P2P.WireCodec != "json" && c.P2P.WireCodec != "cbor" {
+		return fmt.Errorf("wire codec must be json or cbor, got %q", c.P2P.WireCodec)
+	}
+
+	if c.P2P.PortFallback && (c.P2P.PortRange < 1 || c.P2P.PortRange > 1000) {
+		return fmt.Errorf("port range must be between 1 and 1000 with port fallback enabled")
+	}
+
+	if !c.P2P.ListenEnabled && len(c.P2P.Listeners) > 0 {
+		return fmt.Errorf("listeners cannot be configured with listening disabled")
+	}
+
+	seenListeners := make(map[string]bool)
+	for _, listener := range c.P2P.Listeners {
+		_, port, err := net.SplitHostPort(listener.Address)
+		if err != nil {
+			return fmt.Errorf("listener %q has an invalid address: %w", listener.Address, err)
+		}
+		if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+			return fmt.Errorf("listener %q has an invalid port", listener.Address)
+		}
+		if seenListeners[listener.Address] {
+			return fmt.Errorf("listener %q is configured twice", listener.Address)
+		}
+		seenListeners[listener.Address] = true
+		for _, channel := range listener.Advertise {
+			if channel != "hello" && channel != "peer_list" && channel != "mdns" {
+				return fmt.Errorf("listener %q advertises over %q, must be hello, peer_list or mdns", listener.Address, channel)
+			}
+		}
+		if listener.Advertises("peer_list") && !listener.Advertises("hello") {
+			return fmt.Errorf("listener %q must advertise over hello to be shared in peer_list", listener.Address)
+		}
+	}
+
+	for _, entry := range c.P2P.StaticPeers {
+		nodeID, address, found := strings.Cut(entry, "@")
+		if !found || nodeID == "" {
+			return fmt.Errorf("static peer %q must be of the form nodeID@host:port", entry)
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("static peer %q has an invalid address: %w", entry, err)
+		}
+	}
+
+	if !mdnsServiceName.MatchString(c.P2P.MDNS.ServiceName) {
+		return fmt.Errorf("mDNS service name must look like _name._tcp or _name._udp, got %q", c.P2P.MDNS.ServiceName)
+	}
+
+	if c.P2P.MDNS.Domain == "" {
+		return fmt.Errorf("mDNS domain cannot be empty")
+	}
+
+	for _, cidrs := range [][]string{c.P2P.AllowedCIDRs, c.P2P.DeniedCIDRs} {
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+		}
+	}
+
+	if c.P2P.MaxConcurrentDials < 1 {
+		return fmt.Errorf("max concurrent dials must be at least 1")
+	}
+	if c.P2P.DialCooldown < 0 {
+		return fmt.Errorf("dial cooldown cannot be negative")
+	}
+	if c.P2P.DialAttemptDelayMS < 1 {
+		return fmt.Errorf("dial attempt delay must be at least 1 millisecond")
+	}
+
+	if c.P2P.WriteTimeout < 1 {
+		return fmt.Errorf("write timeout must be at least 1 second")
+	}
+	if c.P2P.SlowPeerThreshold < 1 {
+		return fmt.Errorf("slow peer threshold must be at least 1")
+	}
+	if c.P2P.SlowPeerDisconnect != 0 && c.P2P.SlowPeerDisconnect < c.P2P.SlowPeerThreshold {
+		return fmt.Errorf("slow peer disconnect must be 0 or at least the slow peer threshold")
+	}
+
+	if c.P2P.PeerMessageRate < 1 {
+		return fmt.Errorf("peer message rate must be at least 1 per second")
+	}
+	if c.P2P.PeerMessageBurst < 1 {
+		return fmt.Errorf("peer message burst must be at least 1")
+	}
+	if c.P2P.RateLimitDisconnect < 0 {
+		return fmt.Errorf("rate limit disconnect cannot be negative")
+	}
+
+	if c.P2P.CleanupInterval < 1 {
+		return fmt.Errorf("cleanup interval must be at least 1 second")
+	}
+	if c.P2P.CleanupGrace < 1 {
+		return fmt.Errorf("cleanup grace must be at least 1 second")
+	}
+
+	if c.P2P.SlowConnectMs < 0 {
+		return fmt.Errorf("slow connect threshold cannot be negative")
+	}
+
+	if c.P2P.SessionCacheSize < 0 {
+		return fmt.Errorf("session cache size cannot be negative")
+	}
+	if c.P2P.SessionCacheSize > 0 && c.P2P.SessionTicketTTL < 1 {
+		return fmt.Errorf("session ticket TTL must be at least 1 second")
+	}
+	if c.P2P.KeyRotationGrace < 0 {
+		return fmt.Errorf("key rotation grace cannot be negative")
+	}
+	if c.P2P.NetworkKey != "" && len(c.P2P.NetworkKey) < MinNetworkKeyLength {
+		return fmt.Errorf("network key must be at least %d characters", MinNetworkKeyLength)
+	}
+
+	if c.P2P.Queue.Size < 1 {
+		return fmt.Errorf("message queue size must be at least 1")
+	}
+	switch c.P2P.Queue.Overflow {
+	case "drop_newest", "drop_oldest":
+	case "block":
+		if c.P2P.Queue.BlockTimeoutMS < 1 {
+			return fmt.Errorf("message queue block timeout must be at least 1 millisecond")
+		}
+	default:
+		return fmt.Errorf("message queue overflow must be drop_newest, drop_oldest or block, got %q", c.P2P.Queue.Overflow)
+	}
+
+	if c.P2P.Batching.Enabled {
+		if c.P2P.Batching.WindowMS < 1 {
+			return fmt.Errorf("batching window must be at least 1 millisecond")
+		}
+		if c.P2P.Batching.MaxBytes < 1 {
+			return fmt.Errorf("batch size must be at least 1 byte")
+		}
+	}
+
+	if c.P2P.ReliableJournal.Enabled && c.P2P.ReliableJournal.MaxPending < 1 {
+		return fmt.Errorf("reliable journal max pending must be at least 1")
+	}
+
+	if c.P2P.OrderedDelivery.Enabled {
+		if c.P2P.OrderedDelivery.Window < 1 {
+			return fmt.Errorf("ordered delivery window must be at least 1 message")
+		}
+		if c.P2P.OrderedDelivery.GapTimeoutMS < 1 {
+			return fmt.Errorf("ordered delivery gap timeout must be at least 1 millisecond")
+		}
+		switch c.P2P.OrderedDelivery.OnGap {
+		case "skip", "disconnect":
+		default:
+			return fmt.Errorf("ordered delivery on_gap must be skip or disconnect, got %q", c.P2P.OrderedDelivery.OnGap)
+		}
+	}
+
+	if c.P2P.FlapDamping.Enabled {
+		if c.P2P.FlapDamping.Threshold < 1 {
+			return fmt.Errorf("flap damping threshold must be at least 1 disconnect")
+		}
+		if c.P2P.FlapDamping.Window < 1 {
+			return fmt.Errorf("flap damping window must be at least 1 second")
+		}
+		if c.P2P.FlapDamping.Penalty < 1 || c.P2P.FlapDamping.MaxPenalty < c.P2P.FlapDamping.Penalty {
+			return fmt.Errorf("flap damping penalty must be at least 1 second and at most the maximum penalty")
+		}
+	}
+
+	if c.P2P.Socket.KeepAlive && c.P2P.Socket.KeepAlivePeriod < 1 {
+		return fmt.Errorf("keep-alive period must be at least 1 second")
+	}
+	if c.P2P.Socket.ReadBuffer < 0 || c.P2P.Socket.WriteBuffer < 0 {
+		return fmt.Errorf("socket buffer sizes cannot be negative")
+	}
+
+	if err := c.Topology.Scoring().Validate(); err != nil {
+		return fmt.Errorf("invalid topology scoring: %w", err)
+	}
+
+	if c.Topology.ReputationDecayInterval < 1 {
+		return fmt.Errorf("reputation decay interval must be at least 1 second")
+	}
+
+	if c.Topology.ReputationDecayRate < 0 || c.Topology.ReputationDecayRate > 1 {
+		return fmt.Errorf("reputation decay rate must be between 0 and 1")
+	}
+
+	if c.Topology.ReputationInactiveAfter < 0 {
+		return fmt.Errorf("reputation inactivity threshold cannot be negative")
+	}
+
+	if c.Storage.DataDir == "" {
+		return fmt.Errorf("storage data directory is not set and this system has no default for it; set storage.data_dir or pass -data-dir")
+	}
+
 	if c.Storage.MaxSizeGB < 1 {
 		return fmt.Errorf("max storage size must be at least 1 GB")
 	}
 
+	switch c.Storage.Backend {
+	case "bolt", "json", "memory":
+	default:
+		return fmt.Errorf("storage backend must be bolt, json or memory, got %q", c.Storage.Backend)
+	}
+
+	if c.Storage.SyncInterval < 1 {
+		return fmt.Errorf("sync interval must be at least 1 second")
+	}
+
+	if c.Storage.HighWaterMark <= 0 || c.Storage.HighWaterMark > 1 {
+		return fmt.Errorf("storage high-water mark must be between 0 and 1")
+	}
+
+	if c.Storage.EnableBackups {
+		if c.Storage.BackupInterval < 60 {
+			return fmt.Errorf("backup interval must be at least 60 seconds")
+		}
+		if c.Storage.BackupRetention < 1 {
+			return fmt.Errorf("backup retention must keep at least 1 archive")
+		}
+	}
+
+	if c.Admin.Enabled && c.Admin.ListenAddr == "" {
+		return fmt.Errorf("admin listen address is required when the admin API is enabled")
+	}
+	if c.Admin.Enabled && c.Admin.EnableProfiling && c.Admin.AuthToken == "" {
+		return fmt.Errorf("admin auth token is required to serve profiles over HTTP")
+	}
+	if c.Admin.Enabled && c.Admin.AuthToken == "" && !loopbackAddress(c.Admin.ListenAddr) {
+		return fmt.Errorf("admin auth token is required to serve the admin API on %s, which is not a loopback address", c.Admin.ListenAddr)
+	}
+
+	if c.Audit.Enabled {
+		if c.Audit.MaxFileSizeMB < 1 {
+			return fmt.Errorf("audit log file size must be at least 1 MB")
+		}
+		if c.Audit.MaxFiles < 1 {
+			return fmt.Errorf("audit log must keep at least 1 rotated file")
+		}
+		if c.Audit.RateLimit < 1 {
+			return fmt.Errorf("audit log rate limit must be at least 1 entry per second")
+		}
+		if c.Audit.ReputationThreshold < -1 || c.Audit.ReputationThreshold > 1 {
+			return fmt.Errorf("audit reputation threshold must be between -1 and 1")
+		}
+	}
+
+	if c.Tasks.Timeout < 1 {
+		return fmt.Errorf("task timeout must be at least 1 second")
+	}
+	if c.Tasks.MaxRetries < 0 {
+		return fmt.Errorf("task max retries cannot be negative")
+	}
+	if c.Tasks.MaxConcurrent < 1 {
+		return fmt.Errorf("task max concurrent must be at least 1")
+	}
+
+	if c.Blobs.ChunkSize < 1024 || c.Blobs.ChunkSize > MaxBlobChunkSize {
+		return fmt.Errorf("blob chunk size must be between 1024 and %d bytes", MaxBlobChunkSize)
+	}
+	if c.Blobs.ChunkTimeout < 1 {
+		return fmt.Errorf("blob chunk timeout must be at least 1 second")
+	}
+	if c.Blobs.GCInterval < 1 {
+		return fmt.Errorf("blob GC interval must be at least 1 second")
+	}
+	if c.Blobs.GCGrace < 0 {
+		return fmt.Errorf("blob GC grace cannot be negative")
+	}
+
 	if c.AI.Timeout < 1 {
 		return fmt.Errorf("AI timeout must be at least 1 second")
 	}
+	if c.AI.MaxRetries < 0 {
+		return fmt.Errorf("AI max retries cannot be negative")
+	}
+	if c.AI.MaxConcurrentPerPeer < 1 {
+		return fmt.Errorf("AI max concurrent requests per peer must be at least 1")
+	}
+	if err := c.AI.validateRequestOptions(); err != nil {
+		return err
+	}
+	if c.AI.EnableOffline {
+		if c.AI.QueueMaxItems < 1 {
+			return fmt.Errorf("offline queue must hold at least 1 request")
+		}
+		if c.AI.QueueMaxBytes < 1024 {
+			return fmt.Errorf("offline queue must allow at least 1024 bytes")
+		}
+		if c.AI.DrainInterval < 1 {
+			return fmt.Errorf("offline drain interval must be at least 1 second")
+		}
+	}
+	if c.AI.EnableCache {
+		if c.AI.CacheMaxEntries < 1 {
+			return fmt.Errorf("AI cache must hold at least 1 answer")
+		}
+		if c.AI.CacheMaxBytes < 1024 {
+			return fmt.Errorf("AI cache must allow at least 1024 bytes")
+		}
+		if c.AI.CacheTTL < 1 {
+			return fmt.Errorf("AI cache TTL must be at least 1 second")
+		}
+	}
 
 	validLogLevels := map[string]bool{
 		"debug": true, "info": true, "warn": true, "error": true,
@@ -145,3 +1017,56 @@ func (c *Config) Validate() error {
 
 	return nil
 }
+
+// loopbackAddress reports whether addr, a host:port, only accepts
+// connections from this machine
+func loopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validateRequestOptions checks the key file, headers and proxy the AI client
+// sends requests with
+func (c AIConfig) validateRequestOptions() error {
+	if c.APIKeyFile != "" {
+		exposure, err := fileperm.Check(c.APIKeyFile)
+		if err != nil {
+			return fmt.Errorf("invalid AI API key file: %w", err)
+		}
+		if exposure.World {
+			return fmt.Errorf("AI API key file %s must not be world-readable (%s)", c.APIKeyFile, exposure.Detail)
+		}
+	}
+
+	for name, value := range c.Headers {
+		if !headerName.MatchString(name) {
+			return fmt.Errorf("invalid AI request header name: %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("AI request header %s cannot span lines", name)
+		}
+	}
+
+	if c.ProxyURL != "" {
+		proxy, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid AI proxy URL: %w", err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("AI proxy URL must use http, https or socks5, not %q", proxy.Scheme)
+		}
+		if proxy.Host == "" {
+			return fmt.Errorf("AI proxy URL must name a host")
+		}
+	}
+	return nil
+}
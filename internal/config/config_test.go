@@ -1,8 +1,10 @@
 package config
 
 import (
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,6 +17,10 @@ func TestDefault(t *testing.T) {
 	assert.NotNil(t, cfg)
 	assert.Equal(t, "synapse-node", cfg.Node.Name)
 	assert.Equal(t, 8080, cfg.P2P.ListenPort)
+	assert.True(t, cfg.P2P.ListenEnabled)
+	assert.False(t, cfg.P2P.AcceptUnsignedPeers)
+	assert.False(t, cfg.P2P.FaultInjection.Enabled)
+	assert.True(t, cfg.P2P.LivenessRumors)
 	assert.Equal(t, "https://svceai.site/api/chat", cfg.AI.Endpoint)
 	assert.Equal(t, "info", cfg.Logging.Level)
 }
@@ -51,6 +57,742 @@ func TestValidate(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		{
+			name: "min peers above max peers",
+			modify: func(c *Config) {
+				c.P2P.MinPeers = c.P2P.MaxPeers + 1
+			},
+			expectErr: true,
+		},
+		{
+			name: "target peers above max peers",
+			modify: func(c *Config) {
+				c.P2P.TargetPeers = c.P2P.MaxPeers + 1
+			},
+			expectErr: true,
+		},
+		{
+			name: "zero discovery interval",
+			modify: func(c *Config) {
+				c.P2P.DiscoveryInterval = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "ipv6 only",
+			modify: func(c *Config) {
+				c.P2P.PreferredAddressFamily = "ipv6"
+				c.P2P.DualStack = false
+			},
+			expectErr: false,
+		},
+		{
+			name: "unknown address family",
+			modify: func(c *Config) {
+				c.P2P.PreferredAddressFamily = "ipx"
+			},
+			expectErr: true,
+		},
+		{
+			name: "no concurrent dials",
+			modify: func(c *Config) {
+				c.P2P.MaxConcurrentDials = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "dial cooldown disabled",
+			modify: func(c *Config) {
+				c.P2P.DialCooldown = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "negative dial cooldown",
+			modify: func(c *Config) {
+				c.P2P.DialCooldown = -1
+			},
+			expectErr: true,
+		},
+		{
+			name: "no write timeout",
+			modify: func(c *Config) {
+				c.P2P.WriteTimeout = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "no slow peer threshold",
+			modify: func(c *Config) {
+				c.P2P.SlowPeerThreshold = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "slow peers kept connected",
+			modify: func(c *Config) {
+				c.P2P.SlowPeerDisconnect = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "slow peer disconnect below threshold",
+			modify: func(c *Config) {
+				c.P2P.SlowPeerThreshold = 3
+				c.P2P.SlowPeerDisconnect = 2
+			},
+			expectErr: true,
+		},
+		{
+			name: "zero peer message rate",
+			modify: func(c *Config) {
+				c.P2P.PeerMessageRate = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "zero peer message burst",
+			modify: func(c *Config) {
+				c.P2P.PeerMessageBurst = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "zero message queue size",
+			modify: func(c *Config) {
+				c.P2P.Queue.Size = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "unknown message queue overflow",
+			modify: func(c *Config) {
+				c.P2P.Queue.Overflow = "drop_all"
+			},
+			expectErr: true,
+		},
+		{
+			name: "blocking message queue without timeout",
+			modify: func(c *Config) {
+				c.P2P.Queue.Overflow = "block"
+				c.P2P.Queue.BlockTimeoutMS = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "per type message queues dropping oldest",
+			modify: func(c *Config) {
+				c.P2P.Queue.Overflow = "drop_oldest"
+				c.P2P.Queue.PerType = true
+			},
+			expectErr: false,
+		},
+		{
+			name: "batching without window",
+			modify: func(c *Config) {
+				c.P2P.Batching.Enabled = true
+				c.P2P.Batching.WindowMS = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "batching",
+			modify: func(c *Config) {
+				c.P2P.Batching.Enabled = true
+			},
+			expectErr: false,
+		},
+		{
+			name: "no dial attempt delay",
+			modify: func(c *Config) {
+				c.P2P.DialAttemptDelayMS = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "discovery floor above target peers",
+			modify: func(c *Config) {
+				c.P2P.DiscoveryFloor = c.P2P.TargetPeers + 1
+			},
+			expectErr: true,
+		},
+		{
+			name: "no discovery floor",
+			modify: func(c *Config) {
+				c.P2P.DiscoveryFloor = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "AI cache without entries",
+			modify: func(c *Config) {
+				c.AI.CacheMaxEntries = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "AI cache without TTL",
+			modify: func(c *Config) {
+				c.AI.CacheTTL = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "disabled AI cache needs no limits",
+			modify: func(c *Config) {
+				c.AI.EnableCache = false
+				c.AI.CacheMaxEntries = 0
+				c.AI.CacheMaxBytes = 0
+				c.AI.CacheTTL = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "AI request headers",
+			modify: func(c *Config) {
+				c.AI.Headers = map[string]string{"X-Org": "acme"}
+				c.AI.ProxyURL = "socks5://127.0.0.1:1080"
+			},
+			expectErr: false,
+		},
+		{
+			name: "invalid AI request header name",
+			modify: func(c *Config) {
+				c.AI.Headers = map[string]string{"X Org": "acme"}
+			},
+			expectErr: true,
+		},
+		{
+			name: "AI request header value spanning lines",
+			modify: func(c *Config) {
+				c.AI.Headers = map[string]string{"X-Org": "acme\r\nX-Admin: 1"}
+			},
+			expectErr: true,
+		},
+		{
+			name: "invalid AI proxy scheme",
+			modify: func(c *Config) {
+				c.AI.ProxyURL = "ftp://proxy.example:21"
+			},
+			expectErr: true,
+		},
+		{
+			name: "missing AI API key file",
+			modify: func(c *Config) {
+				c.AI.APIKeyFile = "/nonexistent/ai.key"
+			},
+			expectErr: true,
+		},
+		{
+			name: "zero task timeout",
+			modify: func(c *Config) {
+				c.Tasks.Timeout = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "negative task retries",
+			modify: func(c *Config) {
+				c.Tasks.MaxRetries = -1
+			},
+			expectErr: true,
+		},
+		{
+			name: "no concurrent tasks",
+			modify: func(c *Config) {
+				c.Tasks.MaxConcurrent = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "json storage backend",
+			modify: func(c *Config) {
+				c.Storage.Backend = "json"
+			},
+			expectErr: false,
+		},
+		{
+			name: "unknown storage backend",
+			modify: func(c *Config) {
+				c.Storage.Backend = "badger"
+			},
+			expectErr: true,
+		},
+		{
+			name: "blob chunk too large for a message",
+			modify: func(c *Config) {
+				c.Blobs.ChunkSize = MaxBlobChunkSize + 1
+			},
+			expectErr: true,
+		},
+		{
+			name: "zero blob chunk timeout",
+			modify: func(c *Config) {
+				c.Blobs.ChunkTimeout = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "no blob GC grace",
+			modify: func(c *Config) {
+				c.Blobs.GCGrace = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "reliable journal without room",
+			modify: func(c *Config) {
+				c.P2P.ReliableJournal.Enabled = true
+				c.P2P.ReliableJournal.MaxPending = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "ordered delivery without a window",
+			modify: func(c *Config) {
+				c.P2P.OrderedDelivery.Enabled = true
+				c.P2P.OrderedDelivery.Window = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "unknown gap policy",
+			modify: func(c *Config) {
+				c.P2P.OrderedDelivery.Enabled = true
+				c.P2P.OrderedDelivery.OnGap = "wait"
+			},
+			expectErr: true,
+		},
+		{
+			name: "ordered delivery disconnecting on gaps",
+			modify: func(c *Config) {
+				c.P2P.OrderedDelivery.Enabled = true
+				c.P2P.OrderedDelivery.OnGap = "disconnect"
+			},
+			expectErr: false,
+		},
+		{
+			name: "flap damping without a threshold",
+			modify: func(c *Config) {
+				c.P2P.FlapDamping.Enabled = true
+				c.P2P.FlapDamping.Threshold = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "flap damping penalty above its maximum",
+			modify: func(c *Config) {
+				c.P2P.FlapDamping.Enabled = true
+				c.P2P.FlapDamping.MaxPenalty = 10
+			},
+			expectErr: true,
+		},
+		{
+			name: "flap damping",
+			modify: func(c *Config) {
+				c.P2P.FlapDamping.Enabled = true
+			},
+			expectErr: false,
+		},
+		{
+			name: "zero cleanup interval",
+			modify: func(c *Config) {
+				c.P2P.CleanupInterval = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "zero cleanup grace",
+			modify: func(c *Config) {
+				c.P2P.CleanupGrace = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "negative slow connect threshold",
+			modify: func(c *Config) {
+				c.P2P.SlowConnectMs = -1
+			},
+			expectErr: true,
+		},
+		{
+			name: "slow connections not logged",
+			modify: func(c *Config) {
+				c.P2P.SlowConnectMs = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "rate limited peers kept connected",
+			modify: func(c *Config) {
+				c.P2P.RateLimitDisconnect = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "negative session cache size",
+			modify: func(c *Config) {
+				c.P2P.SessionCacheSize = -1
+			},
+			expectErr: true,
+		},
+		{
+			name: "no session ticket TTL",
+			modify: func(c *Config) {
+				c.P2P.SessionTicketTTL = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "session resumption disabled",
+			modify: func(c *Config) {
+				c.P2P.SessionCacheSize = 0
+				c.P2P.SessionTicketTTL = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "negative key rotation grace",
+			modify: func(c *Config) {
+				c.P2P.KeyRotationGrace = -1
+			},
+			expectErr: true,
+		},
+		{
+			name: "short network key",
+			modify: func(c *Config) {
+				c.P2P.NetworkKey = "secret"
+			},
+			expectErr: true,
+		},
+		{
+			name: "network key",
+			modify: func(c *Config) {
+				c.P2P.NetworkKey = "correct horse battery staple"
+			},
+			expectErr: false,
+		},
+		{
+			name: "keep-alive without period",
+			modify: func(c *Config) {
+				c.P2P.Socket.KeepAlivePeriod = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "keep-alive disabled",
+			modify: func(c *Config) {
+				c.P2P.Socket.KeepAlive = false
+				c.P2P.Socket.KeepAlivePeriod = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "negative socket buffer",
+			modify: func(c *Config) {
+				c.P2P.Socket.ReadBuffer = -1
+			},
+			expectErr: true,
+		},
+		{
+			name: "zero clock skew",
+			modify: func(c *Config) {
+				c.P2P.MaxClockSkew = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "unknown wire codec",
+			modify: func(c *Config) {
+				c.P2P.WireCodec = "xml"
+			},
+			expectErr: true,
+		},
+		{
+			name: "static peers",
+			modify: func(c *Config) {
+				c.P2P.StaticPeers = []string{"node-a@10.0.0.1:8080", "node-b@[::1]:8080"}
+			},
+			expectErr: false,
+		},
+		{
+			name: "static peer without node ID",
+			modify: func(c *Config) {
+				c.P2P.StaticPeers = []string{"10.0.0.1:8080"}
+			},
+			expectErr: true,
+		},
+		{
+			name: "static peer without port",
+			modify: func(c *Config) {
+				c.P2P.StaticPeers = []string{"node-a@10.0.0.1"}
+			},
+			expectErr: true,
+		},
+		{
+			name: "listeners",
+			modify: func(c *Config) {
+				c.P2P.Listeners = []ListenerConfig{
+					{Address: "192.168.1.10:8080", Advertise: []string{"hello", "mdns"}},
+					{Address: ":9090"},
+				}
+			},
+			expectErr: false,
+		},
+		{
+			name: "listener without port",
+			modify: func(c *Config) {
+				c.P2P.Listeners = []ListenerConfig{{Address: "192.168.1.10"}}
+			},
+			expectErr: true,
+		},
+		{
+			name: "duplicate listener",
+			modify: func(c *Config) {
+				c.P2P.Listeners = []ListenerConfig{{Address: ":9090"}, {Address: ":9090"}}
+			},
+			expectErr: true,
+		},
+		{
+			name: "listener with unknown advertisement",
+			modify: func(c *Config) {
+				c.P2P.Listeners = []ListenerConfig{{Address: ":9090", Advertise: []string{"dht"}}}
+			},
+			expectErr: true,
+		},
+		{
+			name: "listener shared in peer list but not hello",
+			modify: func(c *Config) {
+				c.P2P.Listeners = []ListenerConfig{{Address: ":9090", Advertise: []string{"peer_list"}}}
+			},
+			expectErr: true,
+		},
+		{
+			name: "outbound only",
+			modify: func(c *Config) {
+				c.P2P.ListenEnabled = false
+			},
+			expectErr: false,
+		},
+		{
+			name: "port fallback",
+			modify: func(c *Config) {
+				c.P2P.PortFallback = true
+			},
+			expectErr: false,
+		},
+		{
+			name: "port fallback without a range",
+			modify: func(c *Config) {
+				c.P2P.PortFallback = true
+				c.P2P.PortRange = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "no port range without port fallback",
+			modify: func(c *Config) {
+				c.P2P.PortRange = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "listeners with listening disabled",
+			modify: func(c *Config) {
+				c.P2P.ListenEnabled = false
+				c.P2P.Listeners = []ListenerConfig{{Address: ":9090"}}
+			},
+			expectErr: true,
+		},
+		{
+			name: "invalid isolation threshold",
+			modify: func(c *Config) {
+				c.P2P.IsolationThreshold = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "invalid sync interval",
+			modify: func(c *Config) {
+				c.Storage.SyncInterval = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "invalid high-water mark",
+			modify: func(c *Config) {
+				c.Storage.HighWaterMark = 1.5
+			},
+			expectErr: true,
+		},
+		{
+			name: "backup interval too short",
+			modify: func(c *Config) {
+				c.Storage.BackupInterval = 10
+			},
+			expectErr: true,
+		},
+		{
+			name: "backup retention ignored when backups are disabled",
+			modify: func(c *Config) {
+				c.Storage.EnableBackups = false
+				c.Storage.BackupRetention = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "negative AI retries",
+			modify: func(c *Config) {
+				c.AI.MaxRetries = -1
+			},
+			expectErr: true,
+		},
+		{
+			name: "no concurrent AI requests per peer",
+			modify: func(c *Config) {
+				c.AI.MaxConcurrentPerPeer = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "offline queue without capacity",
+			modify: func(c *Config) {
+				c.AI.QueueMaxItems = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "offline queue limits ignored when the queue is disabled",
+			modify: func(c *Config) {
+				c.AI.EnableOffline = false
+				c.AI.QueueMaxBytes = 0
+				c.AI.DrainInterval = 0
+			},
+			expectErr: false,
+		},
+		{
+			name: "admin enabled without address",
+			modify: func(c *Config) {
+				c.Admin.Enabled = true
+				c.Admin.ListenAddr = ""
+			},
+			expectErr: true,
+		},
+		{
+			name: "admin profiling without token",
+			modify: func(c *Config) {
+				c.Admin.Enabled = true
+				c.Admin.EnableProfiling = true
+			},
+			expectErr: true,
+		},
+		{
+			name: "admin profiling with token",
+			modify: func(c *Config) {
+				c.Admin.Enabled = true
+				c.Admin.EnableProfiling = true
+				c.Admin.AuthToken = "secret"
+			},
+			expectErr: false,
+		},
+		{
+			name: "admin on all interfaces without token",
+			modify: func(c *Config) {
+				c.Admin.Enabled = true
+				c.Admin.ListenAddr = "0.0.0.0:9090"
+			},
+			expectErr: true,
+		},
+		{
+			name: "admin on all interfaces with token",
+			modify: func(c *Config) {
+				c.Admin.Enabled = true
+				c.Admin.ListenAddr = ":9090"
+				c.Admin.AuthToken = "secret"
+			},
+			expectErr: false,
+		},
+		{
+			name: "admin on loopback without token",
+			modify: func(c *Config) {
+				c.Admin.Enabled = true
+				c.Admin.ListenAddr = "[::1]:9090"
+			},
+			expectErr: false,
+		},
+		{
+			name: "profiling on control socket only",
+			modify: func(c *Config) {
+				c.Admin.EnableProfiling = true
+			},
+			expectErr: false,
+		},
+		{
+			name: "audit log enabled",
+			modify: func(c *Config) {
+				c.Audit.Enabled = true
+			},
+			expectErr: false,
+		},
+		{
+			name: "audit log without rate limit",
+			modify: func(c *Config) {
+				c.Audit.Enabled = true
+				c.Audit.RateLimit = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "audit reputation threshold out of range",
+			modify: func(c *Config) {
+				c.Audit.Enabled = true
+				c.Audit.ReputationThreshold = -2
+			},
+			expectErr: true,
+		},
+		{
+			name: "custom mDNS service",
+			modify: func(c *Config) {
+				c.P2P.MDNS = MDNSConfig{ServiceName: "_synapse-lab._udp", Domain: "lab.example."}
+			},
+			expectErr: false,
+		},
+		{
+			name: "invalid mDNS service name",
+			modify: func(c *Config) {
+				c.P2P.MDNS.ServiceName = "synapse"
+			},
+			expectErr: true,
+		},
+		{
+			name: "empty mDNS domain",
+			modify: func(c *Config) {
+				c.P2P.MDNS.Domain = ""
+			},
+			expectErr: true,
+		},
+		{
+			name: "CIDR lists",
+			modify: func(c *Config) {
+				c.P2P.AllowedCIDRs = []string{"10.0.0.0/8", "fd00::/8"}
+				c.P2P.DeniedCIDRs = []string{"10.66.0.0/16"}
+			},
+			expectErr: false,
+		},
+		{
+			name: "malformed allowed CIDR",
+			modify: func(c *Config) {
+				c.P2P.AllowedCIDRs = []string{"10.0.0.0"}
+			},
+			expectErr: true,
+		},
+		{
+			name: "malformed denied CIDR",
+			modify: func(c *Config) {
+				c.P2P.DeniedCIDRs = []string{"2001:db8::/129"}
+			},
+			expectErr: true,
+		},
 		{
 			name: "invalid storage size",
 			modify: func(c *Config) {
@@ -58,6 +800,41 @@ func TestValidate(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		{
+			name: "negative topology weight",
+			modify: func(c *Config) {
+				c.Topology.LatencyWeight = -0.1
+			},
+			expectErr: true,
+		},
+		{
+			name: "all topology weights zero",
+			modify: func(c *Config) {
+				c.Topology = TopologyConfig{MeshThreshold: 10}
+			},
+			expectErr: true,
+		},
+		{
+			name: "infinite topology weight",
+			modify: func(c *Config) {
+				c.Topology.JitterWeight = math.Inf(1)
+			},
+			expectErr: true,
+		},
+		{
+			name: "invalid mesh threshold",
+			modify: func(c *Config) {
+				c.Topology.MeshThreshold = 0
+			},
+			expectErr: true,
+		},
+		{
+			name: "invalid reputation decay rate",
+			modify: func(c *Config) {
+				c.Topology.ReputationDecayRate = 1.5
+			},
+			expectErr: true,
+		},
 		{
 			name: "invalid log level",
 			modify: func(c *Config) {
@@ -82,6 +859,26 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestValidateAPIKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "ai.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("secret"), 0o600))
+
+	cfg := Default()
+	cfg.AI.APIKeyFile = keyFile
+	assert.NoError(t, cfg.Validate())
+
+	// Chmod, as the umask may have kept WriteFile from setting the mode
+	require.NoError(t, os.Chmod(keyFile, 0o644))
+	err := cfg.Validate()
+	if runtime.GOOS == "windows" {
+		assert.NoError(t, err)
+		return
+	}
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "world-readable")
+	assert.NotContains(t, err.Error(), "secret")
+}
+
 func TestSaveAndLoad(t *testing.T) {
 	tmpDir := t.TempDir()
 	configPath := filepath.Join(tmpDir, "config.json")
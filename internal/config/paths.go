@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// ConfigFile is the name of the config file in the node's directory
+const ConfigFile = "config.json"
+
+// DataDirName is the name of the default data directory in the node's
+// directory
+const DataDirName = "data"
+
+// platformDirs finds the directories the node's default one derives from,
+// and can be stood in for to cover every platform in tests
+type platformDirs struct {
+	goos string
+	// home returns the user's home directory, as os.UserHomeDir does
+	home func() (string, error)
+	// config returns the user's config directory, as os.UserConfigDir does
+	config func() (string, error)
+	// exists reports whether a directory is there
+	exists func(path string) bool
+}
+
+// systemDirs finds the directories of the platform we run on
+var systemDirs = platformDirs{
+	goos:   runtime.GOOS,
+	home:   os.UserHomeDir,
+	config: os.UserConfigDir,
+	exists: func(path string) bool {
+		info, err := os.Stat(path)
+		return err == nil && info.IsDir()
+	},
+}
+
+// DefaultDir returns the directory holding the node's config file and data
+// directory by default. On Windows and macOS that is Synapse under the
+// user's config directory (%AppData%, ~/Library/Application Support);
+// elsewhere it is ~/.synapse. A ~/.synapse left by an earlier version is
+// kept wherever it exists, so upgrading does not lose a node's identity.
+func DefaultDir() (string, error) {
+	return systemDirs.defaultDir()
+}
+
+// DefaultConfigPath returns where the config file is read from when no path
+// is given
+func DefaultConfigPath() (string, error) {
+	dir, err := DefaultDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ConfigFile), nil
+}
+
+// DefaultDataDir returns the data directory used when the config sets none
+func DefaultDataDir() (string, error) {
+	dir, err := DefaultDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, DataDirName), nil
+}
+
+// defaultDir returns the node's default directory on p
+func (p platformDirs) defaultDir() (string, error) {
+	home, homeErr := p.home()
+	legacy := ""
+	if homeErr == nil && home != "" {
+		legacy = filepath.Join(home, ".synapse")
+		if p.exists(legacy) {
+			return legacy, nil
+		}
+	}
+
+	switch p.goos {
+	case "windows", "darwin", "ios":
+		if dir, err := p.config(); err == nil && dir != "" {
+			return filepath.Join(dir, "Synapse"), nil
+		}
+	}
+	if legacy != "" {
+		return legacy, nil
+	}
+
+	// Without a home directory, the config directory still gives a place
+	if dir, err := p.config(); err == nil && dir != "" {
+		return filepath.Join(dir, "synapse"), nil
+	}
+	if homeErr == nil {
+		homeErr = errors.New("home directory is empty")
+	}
+	return "", fmt.Errorf("failed to find a default directory for the node, set storage.data_dir or pass -data-dir: %w", homeErr)
+}
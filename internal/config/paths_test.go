@@ -0,0 +1,81 @@
+package config
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDirs returns the directories of a platform goos where the home and
+// config directories are as given, "" meaning there is none, and only the
+// directories in existing exist
+func fakeDirs(goos, home, config string, existing ...string) platformDirs {
+	found := func(dir string) func() (string, error) {
+		return func() (string, error) {
+			if dir == "" {
+				return "", errors.New("not defined")
+			}
+			return dir, nil
+		}
+	}
+	return platformDirs{
+		goos:   goos,
+		home:   found(home),
+		config: found(config),
+		exists: func(path string) bool {
+			for _, dir := range existing {
+				if dir == path {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+func TestDefaultDir(t *testing.T) {
+	home := filepath.Join("home", "user")
+	legacy := filepath.Join(home, ".synapse")
+	appData := filepath.Join("Users", "user", "AppData", "Roaming")
+
+	tests := []struct {
+		name string
+		dirs platformDirs
+		want string
+	}{
+		{"linux", fakeDirs("linux", home, filepath.Join(home, ".config")), legacy},
+		{"freebsd", fakeDirs("freebsd", home, filepath.Join(home, ".config")), legacy},
+		{"windows", fakeDirs("windows", home, appData), filepath.Join(appData, "Synapse")},
+		{"darwin", fakeDirs("darwin", home, filepath.Join(home, "Library", "Application Support")),
+			filepath.Join(home, "Library", "Application Support", "Synapse")},
+		{"windows upgraded", fakeDirs("windows", home, appData, legacy), legacy},
+		{"windows without a config directory", fakeDirs("windows", home, ""), legacy},
+		{"linux without a home", fakeDirs("linux", "", filepath.Join("etc", "xdg")), filepath.Join("etc", "xdg", "synapse")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := tt.dirs.defaultDir()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, dir)
+		})
+	}
+
+	// With neither, the data directory must be given
+	_, err := fakeDirs("linux", "", "").defaultDir()
+	assert.ErrorContains(t, err, "-data-dir")
+}
+
+func TestValidateDataDir(t *testing.T) {
+	cfg := Default()
+	cfg.Storage.DataDir = ""
+	assert.ErrorContains(t, cfg.Validate(), "storage.data_dir")
+
+	// Default leaves it empty only where there is no default directory
+	if dir, err := DefaultDataDir(); err == nil {
+		assert.Equal(t, dir, Default().Storage.DataDir)
+		assert.Equal(t, DataDirName, filepath.Base(dir))
+	}
+}
@@ -0,0 +1,413 @@
+// Package diagnostics checks the things a node needs to connect to its
+// peers: a valid configuration, a port it can listen on and be reached at,
+// local discovery, its bootstrap peers, a sane clock and its identity key.
+// Each check is a function of its own returning a Result; Run performs all
+// of them for a configuration.
+package diagnostics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/fileperm"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	// StatusPass means nothing is wrong
+	StatusPass Status = "pass"
+	// StatusWarn means something may keep some peers from connecting, or
+	// could not be checked
+	StatusWarn Status = "warn"
+	// StatusFail means the node cannot connect as configured
+	StatusFail Status = "fail"
+)
+
+// Result is the outcome of one check
+type Result struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	Detail string `json:"detail"`
+	// Hint says how to fix a check that did not pass
+	Hint string `json:"hint,omitempty"`
+}
+
+// Report is the outcome of every check Run performed
+type Report struct {
+	Results []Result `json:"results"`
+	// Failed counts the results with StatusFail
+	Failed int `json:"failed"`
+}
+
+// Defaults for Options left zero
+const (
+	DefaultNTPServer = "pool.ntp.org:123"
+	DefaultTimeout   = 5 * time.Second
+)
+
+// minClockTime is earlier than any clock set right can read
+var minClockTime = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Options tune Run
+type Options struct {
+	// NTPServer is the host:port of the SNTP server the clock is compared
+	// with
+	NTPServer string
+	// Timeout bounds each probe over the network
+	Timeout time.Duration
+}
+
+// Run checks the node configured by cfg. loadErr is the error loading the
+// configuration failed with, if it did; nothing else is checked then.
+func Run(ctx context.Context, cfg *config.Config, loadErr error, opts Options) Report {
+	if opts.NTPServer == "" {
+		opts.NTPServer = DefaultNTPServer
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	var report Report
+	add := func(results ...Result) {
+		for _, result := range results {
+			report.Results = append(report.Results, result)
+			if result.Status == StatusFail {
+				report.Failed++
+			}
+		}
+	}
+
+	add(CheckConfig(cfg, loadErr))
+	if loadErr != nil {
+		return report
+	}
+
+	if cfg.P2P.ListenEnabled {
+		// Link-local addresses cannot be dialed without naming the interface
+		var localIPs []string
+		ips, _ := discovery.GetLocalIPs(true)
+		for _, ip := range ips {
+			if !net.ParseIP(ip).IsLinkLocalUnicast() {
+				localIPs = append(localIPs, ip)
+			}
+		}
+		for _, address := range listenAddresses(cfg) {
+			add(CheckBindable(address), CheckReachable(address, localIPs, opts.Timeout))
+		}
+	} else {
+		add(Result{Name: "listen", Status: StatusPass, Detail: "listening is disabled; the node only dials out"})
+	}
+
+	switch {
+	case !cfg.P2P.EnableDiscovery:
+		add(Result{Name: "mdns", Status: StatusPass, Detail: "discovery is disabled"})
+	case !cfg.P2P.ListenEnabled:
+		add(Result{Name: "mdns", Status: StatusPass, Detail: "a node that does not listen advertises nothing"})
+	default:
+		add(CheckMDNS(func() (func(), error) { return registerMDNSProbe(cfg) }))
+	}
+
+	if len(cfg.P2P.BootstrapPeers) == 0 {
+		add(Result{Name: "bootstrap", Status: StatusPass, Detail: "no bootstrap peers are configured"})
+	}
+	var dialer net.Dialer
+	for _, address := range cfg.P2P.BootstrapPeers {
+		probeCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		add(CheckBootstrapPeer(probeCtx, address, lookupIP, dialer.DialContext))
+		cancel()
+	}
+
+	add(CheckClock(time.Now(), time.Duration(cfg.P2P.MaxClockSkew)*time.Second, func() (time.Duration, error) {
+		probeCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+		return QuerySNTP(probeCtx, opts.NTPServer)
+	}))
+
+	add(CheckKeyFile(filepath.Join(cfg.Storage.DataDir, p2p.KeyFile)))
+	return report
+}
+
+// listenAddresses returns the addresses cfg has the node listen on
+func listenAddresses(cfg *config.Config) []string {
+	if len(cfg.P2P.Listeners) == 0 {
+		return []string{fmt.Sprintf(":%d", cfg.P2P.ListenPort)}
+	}
+	var addresses []string
+	for _, listener := range cfg.P2P.Listeners {
+		addresses = append(addresses, listener.Address)
+	}
+	return addresses
+}
+
+// lookupIP resolves host with the system resolver
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// registerMDNSProbe advertises a throwaway instance of the service cfg has
+// nodes find each other by
+func registerMDNSProbe(cfg *config.Config) (func(), error) {
+	instance := fmt.Sprintf("synapse-doctor-%d", os.Getpid())
+	server, err := zeroconf.Register(instance, cfg.P2P.MDNS.ServiceName, cfg.P2P.MDNS.Domain, cfg.P2P.ListenPort, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return server.Shutdown, nil
+}
+
+// CheckConfig reports whether the configuration loaded and is valid
+func CheckConfig(cfg *config.Config, loadErr error) Result {
+	result := Result{Name: "config"}
+	if loadErr == nil {
+		loadErr = cfg.Validate()
+	}
+	if loadErr != nil {
+		result.Status = StatusFail
+		result.Detail = loadErr.Error()
+		result.Hint = "fix the configuration file; config.example.json lists every setting with its default"
+		return result
+	}
+	result.Status = StatusPass
+	result.Detail = "configuration is valid"
+	return result
+}
+
+// CheckBindable reports whether a listener can be opened on address
+func CheckBindable(address string) Result {
+	result := Result{Name: "listen " + address}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		result.Status = StatusFail
+		result.Detail = err.Error()
+		switch {
+		case errors.Is(err, syscall.EADDRINUSE):
+			result.Hint = "another process holds the port, possibly a node that is already running; stop it, pick another port or enable p2p.port_fallback"
+		case errors.Is(err, syscall.EACCES):
+			result.Hint = "ports below 1024 need elevated privileges; pick a higher port"
+		default:
+			result.Hint = "make sure the host is an address of this machine"
+		}
+		return result
+	}
+	listener.Close()
+	result.Status = StatusPass
+	result.Detail = "the address can be listened on"
+	return result
+}
+
+// CheckReachable reports whether a listener on address can be reached at
+// any of localIPs, the non-loopback addresses of this machine, as peers on
+// other machines would reach it. If the address cannot be listened on, for
+// one because a node already listens there, that listener is dialed.
+func CheckReachable(address string, localIPs []string, timeout time.Duration) Result {
+	result := Result{Name: "reachable " + address, Status: StatusWarn}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+	if listener, err := net.Listen("tcp", address); err == nil {
+		defer listener.Close()
+		_, port, _ = net.SplitHostPort(listener.Addr().String())
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+	} else if port == "0" {
+		result.Detail = "no port to check"
+		return result
+	}
+	if len(localIPs) == 0 {
+		result.Detail = "this machine has no address other than loopback"
+		result.Hint = "peers on other machines cannot reach the node until it joins a network"
+		return result
+	}
+
+	var errs []error
+	for _, ip := range localIPs {
+		target := net.JoinHostPort(ip, port)
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		if err == nil {
+			conn.Close()
+			result.Status = StatusPass
+			result.Detail = "reachable at " + target
+			return result
+		}
+		errs = append(errs, err)
+	}
+	result.Detail = errors.Join(errs...).Error()
+	result.Hint = "listen on an address other machines reach, such as \":" + port + "\", and let the port through the firewall"
+	return result
+}
+
+// CheckMDNS reports whether the service local discovery advertises can be
+// registered. register advertises it and returns a function withdrawing it.
+func CheckMDNS(register func() (func(), error)) Result {
+	result := Result{Name: "mdns"}
+	shutdown, err := register()
+	if err != nil {
+		result.Status = StatusWarn
+		result.Detail = err.Error()
+		result.Hint = "local discovery needs an interface with multicast and UDP port 5353 let through the firewall; bootstrap and static peers still work"
+		return result
+	}
+	shutdown()
+	result.Status = StatusPass
+	result.Detail = "the discovery service can be advertised"
+	return result
+}
+
+// CheckBootstrapPeer reports whether the bootstrap peer at address resolves
+// and accepts TCP connections. ctx bounds both.
+func CheckBootstrapPeer(ctx context.Context, address string, lookup discovery.LookupFunc, dial func(ctx context.Context, network, address string) (net.Conn, error)) Result {
+	result := Result{Name: "bootstrap " + address, Status: StatusFail}
+	normalized, err := discovery.NormalizeAddress(address, discovery.DefaultPort)
+	if err != nil {
+		result.Detail = err.Error()
+		result.Hint = "write bootstrap peers as host:port"
+		return result
+	}
+	host, port, err := net.SplitHostPort(normalized)
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+
+	targets := []string{normalized}
+	if net.ParseIP(host) == nil {
+		ips, err := lookup(ctx, host)
+		if err == nil && len(ips) == 0 {
+			err = fmt.Errorf("no addresses")
+		}
+		if err != nil {
+			result.Detail = fmt.Sprintf("failed to resolve %s: %v", host, err)
+			result.Hint = "check the hostname and that this machine's DNS resolver works"
+			return result
+		}
+		targets = targets[:0]
+		for _, ip := range ips {
+			targets = append(targets, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	var errs []error
+	for _, target := range targets {
+		conn, err := dial(ctx, "tcp", target)
+		if err == nil {
+			conn.Close()
+			result.Status = StatusPass
+			result.Detail = "accepts connections at " + target
+			return result
+		}
+		errs = append(errs, err)
+	}
+	result.Detail = errors.Join(errs...).Error()
+	result.Hint = "check that the peer is running and that firewalls on both ends let port " + port + " through"
+	return result
+}
+
+// CheckClock reports whether the clock, reading now, is sane and within
+// maxSkew of the time offset measures it against. Peers reject messages
+// dated further than that from their own clocks.
+func CheckClock(now time.Time, maxSkew time.Duration, offset func() (time.Duration, error)) Result {
+	result := Result{Name: "clock"}
+	if now.Before(minClockTime) {
+		result.Status = StatusFail
+		result.Detail = "the clock reads " + now.Format(time.RFC3339)
+		result.Hint = "set the system clock, ideally by enabling time synchronization"
+		return result
+	}
+
+	off, err := offset()
+	if err != nil {
+		result.Status = StatusWarn
+		result.Detail = "could not compare with a time server: " + err.Error()
+		result.Hint = "pass --ntp-server a time server this machine can reach over UDP"
+		return result
+	}
+	detail := fmt.Sprintf("%v off a time server", off.Round(time.Millisecond))
+	if off.Abs() > maxSkew {
+		result.Status = StatusFail
+		result.Detail = detail + ", more than the " + maxSkew.String() + " peers accept"
+		result.Hint = "enable time synchronization, for one with NTP"
+		return result
+	}
+	result.Status = StatusPass
+	result.Detail = detail
+	return result
+}
+
+// CheckKeyFile reports whether the identity key at path can be used and is
+// kept from other users. A node without one creates it when it first
+// starts.
+func CheckKeyFile(path string) Result {
+	result := Result{Name: "key " + path, Status: StatusFail}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		result.Status = StatusPass
+		result.Detail = "no identity key yet; the node creates one when it first starts"
+		return result
+	}
+	if err != nil {
+		result.Detail = err.Error()
+		result.Hint = "make sure the data directory is readable by the user the node runs as"
+		return result
+	}
+	if !info.Mode().IsRegular() {
+		result.Detail = "not a regular file"
+		result.Hint = "remove it so the node creates a new identity key, or restore it from a backup"
+		return result
+	}
+	exposure, err := fileperm.Check(path)
+	if err != nil {
+		result.Detail = err.Error()
+		result.Hint = "make sure the key is readable by the user the node runs as"
+		return result
+	}
+	if !exposure.Private() {
+		result.Detail = "readable by other users (" + exposure.Detail + ")"
+		result.Hint = fileperm.RestrictCommand(path)
+		return result
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		result.Detail = err.Error()
+		result.Hint = "make sure the key is readable by the user the node runs as"
+		return result
+	}
+	var key struct {
+		PrivateKey string `json:"private_key"`
+	}
+	err = json.Unmarshal(data, &key)
+	if err == nil {
+		_, err = crypto.UnmarshalPrivateKey([]byte(key.PrivateKey))
+	}
+	if err != nil {
+		result.Detail = "the key cannot be parsed: " + err.Error()
+		result.Hint = "restore the key from a backup, or remove it to have the node create a new identity"
+		return result
+	}
+	result.Status = StatusPass
+	result.Detail = "the identity key is present and private"
+	return result
+}
@@ -0,0 +1,208 @@
+package diagnostics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/fileperm"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConfig(t *testing.T) {
+	assert.Equal(t, StatusPass, CheckConfig(config.Default(), nil).Status)
+
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 1
+	result := CheckConfig(cfg, nil)
+	assert.Equal(t, StatusFail, result.Status)
+	assert.Contains(t, result.Detail, "port")
+	assert.NotEmpty(t, result.Hint)
+
+	result = CheckConfig(nil, errors.New("failed to parse config file"))
+	assert.Equal(t, StatusFail, result.Status)
+	assert.Equal(t, "failed to parse config file", result.Detail)
+}
+
+func TestCheckBindable(t *testing.T) {
+	assert.Equal(t, StatusPass, CheckBindable("127.0.0.1:0").Status)
+
+	// A port another process holds
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	result := CheckBindable(listener.Addr().String())
+	assert.Equal(t, StatusFail, result.Status)
+	assert.Contains(t, result.Hint, "already running")
+
+	result = CheckBindable("192.0.2.1:0")
+	assert.Equal(t, StatusFail, result.Status)
+	assert.NotEmpty(t, result.Hint)
+}
+
+func TestCheckReachable(t *testing.T) {
+	// Loopback stands in for another interface of the machine
+	result := CheckReachable("127.0.0.1:0", []string{"127.0.0.1"}, time.Second)
+	assert.Equal(t, StatusPass, result.Status)
+
+	// A listener bound to one address is not reached at another
+	result = CheckReachable("127.0.0.1:0", []string{"127.0.0.2"}, time.Second)
+	assert.Equal(t, StatusWarn, result.Status)
+	assert.NotEmpty(t, result.Hint)
+
+	result = CheckReachable(":0", nil, time.Second)
+	assert.Equal(t, StatusWarn, result.Status)
+	assert.Contains(t, result.Detail, "loopback")
+
+	// A port already listened on, as by a running node, is dialed as is
+	running, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer running.Close()
+	_, port, _ := net.SplitHostPort(running.Addr().String())
+	result = CheckReachable("127.0.0.1:"+port, []string{"127.0.0.1"}, time.Second)
+	assert.Equal(t, StatusPass, result.Status)
+}
+
+func TestCheckMDNS(t *testing.T) {
+	withdrawn := false
+	result := CheckMDNS(func() (func(), error) {
+		return func() { withdrawn = true }, nil
+	})
+	assert.Equal(t, StatusPass, result.Status)
+	assert.True(t, withdrawn)
+
+	result = CheckMDNS(func() (func(), error) {
+		return nil, errors.New("no multicast interface")
+	})
+	assert.Equal(t, StatusWarn, result.Status)
+	assert.Equal(t, "no multicast interface", result.Detail)
+	assert.NotEmpty(t, result.Hint)
+}
+
+func TestCheckBootstrapPeer(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	var dialer net.Dialer
+	lookup := func(ctx context.Context, host string) ([]net.IP, error) {
+		if host == "bootstrap.example" {
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	result := CheckBootstrapPeer(ctx, listener.Addr().String(), lookup, dialer.DialContext)
+	assert.Equal(t, StatusPass, result.Status)
+	result = CheckBootstrapPeer(ctx, "bootstrap.example:"+port, lookup, dialer.DialContext)
+	assert.Equal(t, StatusPass, result.Status)
+	assert.Contains(t, result.Detail, "127.0.0.1:"+port)
+
+	result = CheckBootstrapPeer(ctx, "missing.example:"+port, lookup, dialer.DialContext)
+	assert.Equal(t, StatusFail, result.Status)
+	assert.Contains(t, result.Hint, "DNS")
+
+	refused := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	result = CheckBootstrapPeer(ctx, listener.Addr().String(), lookup, refused)
+	assert.Equal(t, StatusFail, result.Status)
+	assert.Contains(t, result.Hint, "firewall")
+
+	result = CheckBootstrapPeer(ctx, "bootstrap.example:port", lookup, dialer.DialContext)
+	assert.Equal(t, StatusFail, result.Status)
+}
+
+func TestCheckClock(t *testing.T) {
+	now := time.Now()
+	offset := func(off time.Duration, err error) func() (time.Duration, error) {
+		return func() (time.Duration, error) { return off, err }
+	}
+
+	assert.Equal(t, StatusPass, CheckClock(now, time.Minute, offset(2*time.Second, nil)).Status)
+	assert.Equal(t, StatusFail, CheckClock(now, time.Minute, offset(-2*time.Minute, nil)).Status)
+	assert.Equal(t, StatusWarn, CheckClock(now, time.Minute, offset(0, errors.New("timeout"))).Status)
+
+	// A clock reset to the epoch fails without asking a time server
+	asked := false
+	result := CheckClock(time.Unix(0, 0), time.Minute, func() (time.Duration, error) {
+		asked = true
+		return 0, nil
+	})
+	assert.Equal(t, StatusFail, result.Status)
+	assert.False(t, asked)
+}
+
+func TestCheckKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "node_key.json")
+	assert.Equal(t, StatusPass, CheckKeyFile(path).Status)
+
+	privateKey, _, err := crypto.GenerateKeyPair()
+	require.NoError(t, err)
+	pem, err := crypto.MarshalPrivateKey(privateKey)
+	require.NoError(t, err)
+	key, err := json.Marshal(map[string]string{"private_key": string(pem)})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, key, 0600))
+	assert.Equal(t, StatusPass, CheckKeyFile(path).Status)
+
+	// The key must not be readable by others, by its mode bits or its ACL
+	if runtime.GOOS != "windows" {
+		require.NoError(t, os.Chmod(path, 0644))
+		result := CheckKeyFile(path)
+		assert.Equal(t, StatusFail, result.Status)
+		assert.Equal(t, "chmod 600 "+path, result.Hint)
+		require.NoError(t, fileperm.Restrict(path))
+		assert.Equal(t, StatusPass, CheckKeyFile(path).Status)
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0600))
+	require.NoError(t, os.Chmod(path, 0600))
+	assert.Equal(t, StatusFail, CheckKeyFile(path).Status)
+
+	assert.Equal(t, StatusFail, CheckKeyFile(dir).Status)
+}
+
+func TestRun(t *testing.T) {
+	ntp := startSNTPServer(t, 0)
+	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	cfg.P2P.Listeners = []config.ListenerConfig{{Address: address}}
+
+	report := Run(context.Background(), cfg, nil, Options{NTPServer: ntp, Timeout: time.Second})
+	assert.Zero(t, report.Failed)
+	var names []string
+	for _, result := range report.Results {
+		names = append(names, result.Name)
+	}
+	assert.Equal(t, []string{
+		"config", "listen " + address, "reachable " + address, "mdns", "bootstrap", "clock",
+		"key " + filepath.Join(cfg.Storage.DataDir, "node_key.json"),
+	}, names)
+
+	// An unreachable bootstrap peer fails the run
+	cfg.P2P.BootstrapPeers = []string{"127.0.0.1:1"}
+	report = Run(context.Background(), cfg, nil, Options{NTPServer: ntp, Timeout: time.Second})
+	assert.Equal(t, 1, report.Failed)
+
+	// A configuration that does not load is all that is reported
+	report = Run(context.Background(), nil, errors.New("failed to parse config file"), Options{})
+	require.Len(t, report.Results, 1)
+	assert.Equal(t, 1, report.Failed)
+}
@@ -0,0 +1,65 @@
+package diagnostics
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds from the NTP epoch, 1900, to the
+// Unix one
+const ntpEpochOffset = 2208988800
+
+// sntpPacketSize is the size of an SNTP packet without extensions
+const sntpPacketSize = 48
+
+// QuerySNTP asks the SNTP server at server, a host:port, for the time and
+// returns how far the local clock is behind it; a negative offset means
+// the local clock is ahead
+func QuerySNTP(ctx context.Context, server string) (time.Duration, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach time server %s: %w", server, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// No leap second warning, version 4, client mode
+	request := make([]byte, sntpPacketSize)
+	request[0] = 0<<6 | 4<<3 | 3
+	sent := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, fmt.Errorf("failed to query time server %s: %w", server, err)
+	}
+	response := make([]byte, sntpPacketSize)
+	n, err := conn.Read(response)
+	received := time.Now()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return 0, fmt.Errorf("no answer from time server %s: %w", server, err)
+	}
+	if n < sntpPacketSize || response[0]&0x7 != 4 {
+		return 0, fmt.Errorf("invalid answer from time server %s", server)
+	}
+	// Stratum 0 is a refusal
+	if response[1] == 0 {
+		return 0, fmt.Errorf("time server %s refused to answer", server)
+	}
+
+	serverReceived := ntpTime(response[32:40])
+	serverSent := ntpTime(response[40:48])
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// ntpTime decodes a 64-bit NTP timestamp
+func ntpTime(b []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	fraction := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(seconds, fraction*int64(time.Second)>>32)
+}
@@ -0,0 +1,76 @@
+package diagnostics
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putNTPTime encodes t as a 64-bit NTP timestamp
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[0:4], uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:8], uint32((int64(t.Nanosecond())<<32)/int64(time.Second)))
+}
+
+// startSNTPServer answers SNTP queries on loopback with a clock offset
+// ahead of ours and returns its address
+func startSNTPServer(t *testing.T, offset time.Duration) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		request := make([]byte, sntpPacketSize)
+		for {
+			_, addr, err := conn.ReadFrom(request)
+			if err != nil {
+				return
+			}
+			response := make([]byte, sntpPacketSize)
+			response[0] = 4<<3 | 4
+			response[1] = 2
+			now := time.Now().Add(offset)
+			putNTPTime(response[32:40], now)
+			putNTPTime(response[40:48], now)
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestQuerySNTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	offset, err := QuerySNTP(ctx, startSNTPServer(t, 0))
+	require.NoError(t, err)
+	assert.Less(t, offset.Abs(), 100*time.Millisecond)
+
+	offset, err = QuerySNTP(ctx, startSNTPServer(t, -3*time.Minute))
+	require.NoError(t, err)
+	assert.InDelta(t, float64(-3*time.Minute), float64(offset), float64(100*time.Millisecond))
+}
+
+func TestQuerySNTPTimeout(t *testing.T) {
+	// A server that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = QuerySNTP(ctx, conn.LocalAddr().String())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNTPTime(t *testing.T) {
+	want := time.Date(2026, time.March, 1, 12, 30, 15, 250_000_000, time.UTC)
+	b := make([]byte, 8)
+	putNTPTime(b, want)
+	assert.WithinDuration(t, want, ntpTime(b), time.Microsecond)
+}
@@ -0,0 +1,20 @@
+// Package fileperm keeps files holding secrets, such as the identity key,
+// private to the user the node runs as, and tells who else may read them.
+// Unix systems go by mode bits. Windows ignores those and goes by the file's
+// ACL, which a new file inherits from its directory.
+package fileperm
+
+// Exposure says who besides a file's owner may read it
+type Exposure struct {
+	// Others is set when some other users or groups may read the file, World
+	// when every user may
+	Others bool
+	World  bool
+	// Detail describes the access in the platform's terms
+	Detail string
+}
+
+// Private reports whether only the owner may read the file
+func (e Exposure) Private() bool {
+	return !e.Others && !e.World
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+
+package fileperm
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Restrict takes away every access to the file at path but its owner's
+func Restrict(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to restrict %s: %w", path, err)
+	}
+	if err := os.Chmod(path, info.Mode().Perm()&^0o077); err != nil {
+		return fmt.Errorf("failed to restrict %s: %w", path, err)
+	}
+	return nil
+}
+
+// RestrictCommand is the shell command a user runs to restrict the file at
+// path by hand
+func RestrictCommand(path string) string {
+	return "chmod 600 " + path
+}
+
+// Check returns who besides its owner may read the file at path
+func Check(path string) (Exposure, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Exposure{}, err
+	}
+	perm := info.Mode().Perm()
+	exposure := Exposure{
+		Others: perm&0o070 != 0,
+		World:  perm&0o007 != 0,
+	}
+	if !exposure.Private() {
+		exposure.Detail = "mode " + strconv.FormatUint(uint64(perm), 8)
+	}
+	return exposure, nil
+}
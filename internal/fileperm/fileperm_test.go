@@ -0,0 +1,34 @@
+package fileperm
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestrict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(path, []byte("secret"), 0644))
+	if runtime.GOOS != "windows" {
+		exposure, err := Check(path)
+		require.NoError(t, err)
+		assert.True(t, exposure.Others)
+		assert.True(t, exposure.World)
+		assert.Equal(t, "mode 644", exposure.Detail)
+	}
+
+	require.NoError(t, Restrict(path))
+	exposure, err := Check(path)
+	require.NoError(t, err)
+	assert.True(t, exposure.Private(), exposure.Detail)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), data)
+
+	_, err = Check(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,112 @@
+//go:build windows
+
+package fileperm
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// readAccess are the access rights that let a trustee read a file
+const readAccess = windows.FILE_READ_DATA | windows.GENERIC_READ | windows.GENERIC_ALL
+
+// Restrict takes away every access to the file at path but the current
+// user's: its ACL grants that user full control, and no longer inherits
+// entries from its directory
+func Restrict(path string) error {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return fmt.Errorf("failed to restrict %s: %w", path, err)
+	}
+	acl, err := windows.ACLFromEntries([]windows.EXPLICIT_ACCESS{{
+		AccessPermissions: windows.GENERIC_ALL,
+		AccessMode:        windows.SET_ACCESS,
+		Inheritance:       windows.NO_INHERITANCE,
+		Trustee: windows.TRUSTEE{
+			TrusteeForm:  windows.TRUSTEE_IS_SID,
+			TrusteeType:  windows.TRUSTEE_IS_USER,
+			TrusteeValue: windows.TrusteeValueFromSID(user.User.Sid),
+		},
+	}}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to restrict %s: %w", path, err)
+	}
+	err = windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, acl, nil)
+	if err != nil {
+		return fmt.Errorf("failed to restrict %s: %w", path, err)
+	}
+	return nil
+}
+
+// RestrictCommand is the shell command a user runs to restrict the file at
+// path by hand
+func RestrictCommand(path string) string {
+	return `icacls "` + path + `" /inheritance:r /grant:r "%USERNAME%:F"`
+}
+
+// Check returns who besides its owner may read the file at path. Entries
+// for SYSTEM and the Administrators group are not counted, as those can read
+// every file anyway; Everyone, Authenticated Users and Users count as the
+// world.
+func Check(path string) (Exposure, error) {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT,
+		windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return Exposure{}, fmt.Errorf("failed to read the ACL of %s: %w", path, err)
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return Exposure{}, fmt.Errorf("failed to read the owner of %s: %w", path, err)
+	}
+	dacl, _, err := sd.DACL()
+	if err == windows.ERROR_OBJECT_NOT_FOUND || (err == nil && dacl == nil) {
+		return Exposure{World: true, Detail: "no ACL, so everyone has access"}, nil
+	}
+	if err != nil {
+		return Exposure{}, fmt.Errorf("failed to read the ACL of %s: %w", path, err)
+	}
+
+	var exposure Exposure
+	var readers []string
+	for i := 0; i < int(dacl.AceCount); i++ {
+		var ace *windows.ACCESS_ALLOWED_ACE
+		if err := windows.GetAce(dacl, uint32(i), &ace); err != nil {
+			return Exposure{}, fmt.Errorf("failed to read the ACL of %s: %w", path, err)
+		}
+		if ace.Header.AceType != windows.ACCESS_ALLOWED_ACE_TYPE ||
+			ace.Header.AceFlags&windows.INHERIT_ONLY_ACE != 0 || ace.Mask&readAccess == 0 {
+			continue
+		}
+		sid := (*windows.SID)(unsafe.Pointer(&ace.SidStart))
+		switch {
+		case sid.Equals(owner), sid.IsWellKnown(windows.WinLocalSystemSid), sid.IsWellKnown(windows.WinBuiltinAdministratorsSid):
+			continue
+		case sid.IsWellKnown(windows.WinWorldSid), sid.IsWellKnown(windows.WinAuthenticatedUserSid), sid.IsWellKnown(windows.WinBuiltinUsersSid):
+			exposure.World = true
+		default:
+			exposure.Others = true
+		}
+		readers = append(readers, accountName(sid))
+	}
+	if len(readers) > 0 {
+		exposure.Detail = "readable by " + strings.Join(readers, ", ")
+	}
+	return exposure, nil
+}
+
+// accountName names the account with sid, or gives the SID itself if it
+// cannot be looked up
+func accountName(sid *windows.SID) string {
+	account, domain, _, err := sid.LookupAccount("")
+	if err != nil {
+		return sid.String()
+	}
+	if domain == "" {
+		return account
+	}
+	return domain + `\` + account
+}
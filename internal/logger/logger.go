@@ -23,6 +23,12 @@ func New(level, format, outputFile string) (*Logger, error) {
 		output = file
 	}
 
+	return NewWithWriter(level, format, output), nil
+}
+
+// NewWithWriter creates a logger that writes to output, e.g. a file opened
+// through the storage manager so log bytes count against the quota
+func NewWithWriter(level, format string, output io.Writer) *Logger {
 	if format == "console" {
 		output = zerolog.ConsoleWriter{
 			Out:        output,
@@ -33,7 +39,7 @@ func New(level, format, outputFile string) (*Logger, error) {
 	logLevel := parseLevel(level)
 	zlog := zerolog.New(output).Level(logLevel).With().Timestamp().Logger()
 
-	return &Logger{zlog: zlog}, nil
+	return &Logger{zlog: zlog}
 }
 
 func parseLevel(level string) zerolog.Level {
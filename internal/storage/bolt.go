@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOpenTimeout is how long opening waits for another process holding the
+// database to let go of it
+const boltOpenTimeout = time.Second
+
+// Bolt is a KV kept in a BoltDB database file. A commit reaches the disk
+// before Update returns, and only one process may have the file open.
+type Bolt struct {
+	db    *bolt.DB
+	path  string
+	files Files
+}
+
+// OpenBolt opens, or creates, the database at path. Its growth is charged
+// against the quota if files accounts for files changed in place.
+func OpenBolt(path string, files Files) (*Bolt, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+
+	b := &Bolt{path: path, files: files}
+	err := b.modify(func() error {
+		var err error
+		b.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// Get returns the value of key, or ErrNotFound
+func (b *Bolt) Get(bucket, key string) ([]byte, error) {
+	return get(b, bucket, key)
+}
+
+// Put sets the value of key
+func (b *Bolt) Put(bucket, key string, value []byte) error {
+	return put(b, bucket, key, value)
+}
+
+// Delete removes key
+func (b *Bolt) Delete(bucket, key string) error {
+	return remove(b, bucket, key)
+}
+
+// Iterate calls fn for every key of a bucket in order
+func (b *Bolt) Iterate(bucket string, fn func(key string, value []byte) error) error {
+	return iterate(b, bucket, fn)
+}
+
+// View runs fn in a read-only transaction
+func (b *Bolt) View(fn func(tx Tx) error) error {
+	return closedIf(b.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	}))
+}
+
+// Update runs fn in a read-write transaction. What it writes must fit in the
+// quota, and the database's growth on commit is charged against it.
+func (b *Bolt) Update(fn func(tx Tx) error) error {
+	return closedIf(b.modify(func() error {
+		return b.db.Update(func(tx *bolt.Tx) error {
+			boltTx := &boltTx{tx: tx, writable: true}
+			if err := fn(boltTx); err != nil {
+				return err
+			}
+			return b.files.Check(boltTx.written)
+		})
+	}))
+}
+
+// Check reports whether n more bytes may be stored
+func (b *Bolt) Check(n int64) error {
+	return b.files.Check(n)
+}
+
+// Close closes the database
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// modify runs fn, which changes the database file, through files if they
+// account for such changes
+func (b *Bolt) modify(fn func() error) error {
+	if files, ok := b.files.(modifier); ok {
+		return files.Modify(b.path, fn)
+	}
+	return fn()
+}
+
+// closedIf turns bbolt's error for a closed database into ErrClosed
+func closedIf(err error) error {
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		return ErrClosed
+	}
+	return err
+}
+
+// boltTx is a transaction on a Bolt store, counting the bytes it writes
+type boltTx struct {
+	tx       *bolt.Tx
+	writable bool
+	written  int64
+}
+
+// Get returns the value of key, or ErrNotFound
+func (tx *boltTx) Get(bucket, key string) ([]byte, error) {
+	if err := validate(bucket, key); err != nil {
+		return nil, err
+	}
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, ErrNotFound
+	}
+	value := b.Get([]byte(key))
+	if value == nil {
+		return nil, ErrNotFound
+	}
+	return clone(value), nil
+}
+
+// Put sets the value of key, creating the bucket if need be
+func (tx *boltTx) Put(bucket, key string, value []byte) error {
+	if err := validate(bucket, key); err != nil {
+		return err
+	}
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	b, err := tx.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+	}
+	if err := b.Put([]byte(key), value); err != nil {
+		return fmt.Errorf("failed to put %s in %s: %w", key, bucket, err)
+	}
+	tx.written += int64(len(key) + len(value))
+	return nil
+}
+
+// Delete removes key
+func (tx *boltTx) Delete(bucket, key string) error {
+	if err := validate(bucket, key); err != nil {
+		return err
+	}
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	if b := tx.tx.Bucket([]byte(bucket)); b != nil {
+		return b.Delete([]byte(key))
+	}
+	return nil
+}
+
+// DeleteBucket removes a bucket and all its keys
+func (tx *boltTx) DeleteBucket(bucket string) error {
+	if err := validate(bucket, "-"); err != nil {
+		return err
+	}
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	if err := tx.tx.DeleteBucket([]byte(bucket)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+		return fmt.Errorf("failed to delete bucket %s: %w", bucket, err)
+	}
+	return nil
+}
+
+// Iterate calls fn for every key of a bucket in order
+func (tx *boltTx) Iterate(bucket string, fn func(key string, value []byte) error) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(key, value []byte) error {
+		return fn(string(key), clone(value))
+	})
+}
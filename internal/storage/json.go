@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// JSON is a KV held in memory and written out whole to a JSON file on every
+// commit. It suits tiny stores, and one whose entries can be looked over or
+// removed by hand while the node is stopped.
+type JSON struct {
+	mapStore
+	path string
+}
+
+// OpenJSON opens the store kept in the JSON file at path, which is created
+// on the first commit. Values are saved base64-encoded.
+func OpenJSON(path string, files Files) (*JSON, error) {
+	s := &JSON{
+		mapStore: mapStore{buckets: make(buckets), files: files},
+		path:     path,
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	default:
+		if err := json.Unmarshal(data, &s.buckets); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+
+	s.persist = s.save
+	return s, nil
+}
+
+// save writes the buckets a transaction is about to commit
+func (s *JSON) save(next buckets) error {
+	data, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", s.path, err)
+	}
+	if err := s.files.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return nil
+}
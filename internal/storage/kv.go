@@ -0,0 +1,146 @@
+// Package storage defines the key-value interface the node keeps its state
+// behind, and its backends: a BoltDB database, a JSON file for tiny stores
+// and memory for tests. Keys and values live in named buckets and change in
+// transactions that commit whole or not at all.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Backends selectable with StorageConfig.Backend
+const (
+	BackendBolt   = "bolt"
+	BackendJSON   = "json"
+	BackendMemory = "memory"
+)
+
+// Names of the backends' files under the data directory
+const (
+	BoltFile = "state.db"
+	JSONFile = "state.json"
+)
+
+var (
+	// ErrNotFound is returned for a key that is not in its bucket
+	ErrNotFound = errors.New("key not found")
+
+	// ErrReadOnly is returned when a read-only transaction is asked to write
+	ErrReadOnly = errors.New("transaction is read-only")
+
+	// ErrClosed is returned when using a closed store
+	ErrClosed = errors.New("storage is closed")
+)
+
+// Tx reads and writes buckets within a transaction. Changes made in it are
+// seen by its own reads and committed together.
+type Tx interface {
+	// Get returns the value of key, or ErrNotFound
+	Get(bucket, key string) ([]byte, error)
+	// Put sets the value of key, creating the bucket if need be
+	Put(bucket, key string, value []byte) error
+	// Delete removes key; a missing key is not an error
+	Delete(bucket, key string) error
+	// DeleteBucket removes a bucket and all its keys
+	DeleteBucket(bucket string) error
+	// Iterate calls fn for every key of a bucket in order, stopping at the
+	// first error, which it returns. fn must not change the bucket.
+	Iterate(bucket string, fn func(key string, value []byte) error) error
+}
+
+// KV is a store of buckets of keys and values. Get, Put, Delete and
+// Iterate each run in a transaction of their own; View and Update group
+// several into one. Values handed out are copies the caller may keep.
+type KV interface {
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	Iterate(bucket string, fn func(key string, value []byte) error) error
+
+	// View runs fn in a read-only transaction
+	View(fn func(tx Tx) error) error
+	// Update runs fn in a read-write transaction, committed if fn returns
+	// nil and rolled back otherwise
+	Update(fn func(tx Tx) error) error
+
+	// Check reports whether n more bytes may be stored, so callers can
+	// refuse data up front rather than failing a later commit
+	Check(n int64) error
+	// Close releases the store; its data stays on disk
+	Close() error
+}
+
+// Files is where a backend keeps its files, such as the storage manager
+// that charges them against the quota. Check reports whether n more bytes
+// may be stored.
+type Files interface {
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	Check(n int64) error
+}
+
+// modifier is implemented by Files that account for a file changed in place
+// rather than replaced, as a database is on every commit
+type modifier interface {
+	Modify(path string, fn func() error) error
+}
+
+// Open opens the backend named by StorageConfig.Backend in dir, keeping its
+// files through files
+func Open(backend, dir string, files Files) (KV, error) {
+	switch backend {
+	case BackendBolt:
+		return OpenBolt(filepath.Join(dir, BoltFile), files)
+	case BackendJSON:
+		return OpenJSON(filepath.Join(dir, JSONFile), files)
+	case BackendMemory:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// validate refuses the empty bucket and key names no backend can store
+func validate(bucket, key string) error {
+	if bucket == "" {
+		return fmt.Errorf("bucket name cannot be empty")
+	}
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+	return nil
+}
+
+// get reads a key in a transaction of its own
+func get(kv KV, bucket, key string) ([]byte, error) {
+	var value []byte
+	err := kv.View(func(tx Tx) error {
+		var err error
+		value, err = tx.Get(bucket, key)
+		return err
+	})
+	return value, err
+}
+
+// put writes a key in a transaction of its own
+func put(kv KV, bucket, key string, value []byte) error {
+	return kv.Update(func(tx Tx) error {
+		return tx.Put(bucket, key, value)
+	})
+}
+
+// remove deletes a key in a transaction of its own
+func remove(kv KV, bucket, key string) error {
+	return kv.Update(func(tx Tx) error {
+		return tx.Delete(bucket, key)
+	})
+}
+
+// iterate walks a bucket in a transaction of its own
+func iterate(kv KV, bucket string, fn func(key string, value []byte) error) error {
+	return kv.View(func(tx Tx) error {
+		return tx.Iterate(bucket, fn)
+	})
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// quotaFiles writes files directly, allowing at most limit bytes per check
+type quotaFiles struct {
+	limit    int64
+	modified int
+}
+
+func (f *quotaFiles) WriteFile(path string, data []byte, perm os.FileMode) error {
+	if int64(len(data)) > f.limit {
+		return errQuota
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+func (f *quotaFiles) Check(n int64) error {
+	if n > f.limit {
+		return errQuota
+	}
+	return nil
+}
+
+func (f *quotaFiles) Modify(path string, fn func() error) error {
+	f.modified++
+	return fn()
+}
+
+var errQuota = errors.New("quota exceeded")
+
+// openBackends opens every backend in its own directory
+func openBackends(t *testing.T) map[string]KV {
+	backends := make(map[string]KV)
+	for _, backend := range []string{BackendMemory, BackendJSON, BackendBolt} {
+		kv, err := Open(backend, t.TempDir(), &quotaFiles{limit: 1 << 20})
+		require.NoError(t, err)
+		t.Cleanup(func() { kv.Close() })
+		backends[backend] = kv
+	}
+	return backends
+}
+
+// contents returns the keys of a bucket and their values
+func contents(t *testing.T, kv KV, bucket string) map[string]string {
+	values := make(map[string]string)
+	require.NoError(t, kv.Iterate(bucket, func(key string, value []byte) error {
+		values[key] = string(value)
+		return nil
+	}))
+	return values
+}
+
+func TestBackends(t *testing.T) {
+	for name, kv := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := kv.Get("peers", "a")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			require.NoError(t, kv.Put("peers", "b", []byte("2")))
+			require.NoError(t, kv.Put("peers", "a", []byte("1")))
+			require.NoError(t, kv.Put("keys", "a", []byte("key")))
+			value, err := kv.Get("peers", "a")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("1"), value)
+			value[0] = 'x'
+			value, _ = kv.Get("peers", "a")
+			assert.Equal(t, []byte("1"), value, "values handed out are copies")
+
+			var order []string
+			require.NoError(t, kv.Iterate("peers", func(key string, value []byte) error {
+				order = append(order, key)
+				return nil
+			}))
+			assert.Equal(t, []string{"a", "b"}, order)
+			assert.NoError(t, kv.Iterate("missing", func(string, []byte) error {
+				t.Fatal("a missing bucket is empty")
+				return nil
+			}))
+
+			require.NoError(t, kv.Delete("peers", "b"))
+			require.NoError(t, kv.Delete("peers", "b"))
+			require.NoError(t, kv.Delete("missing", "b"))
+			assert.Equal(t, map[string]string{"a": "1"}, contents(t, kv, "peers"))
+
+			assert.Error(t, kv.Put("", "a", nil))
+			assert.Error(t, kv.Put("peers", "", nil))
+
+			// A transaction sees its own changes and commits them together
+			require.NoError(t, kv.Update(func(tx Tx) error {
+				require.NoError(t, tx.DeleteBucket("peers"))
+				_, err := tx.Get("peers", "a")
+				assert.ErrorIs(t, err, ErrNotFound)
+				require.NoError(t, tx.Put("peers", "c", []byte("3")))
+				value, err := tx.Get("peers", "c")
+				assert.Equal(t, []byte("3"), value)
+				return err
+			}))
+			assert.Equal(t, map[string]string{"c": "3"}, contents(t, kv, "peers"))
+			assert.Equal(t, map[string]string{"a": "key"}, contents(t, kv, "keys"))
+
+			// ... or not at all
+			failed := errors.New("failed")
+			err = kv.Update(func(tx Tx) error {
+				require.NoError(t, tx.Put("peers", "d", []byte("4")))
+				require.NoError(t, tx.DeleteBucket("keys"))
+				return failed
+			})
+			assert.ErrorIs(t, err, failed)
+			assert.Equal(t, map[string]string{"c": "3"}, contents(t, kv, "peers"))
+			assert.Equal(t, map[string]string{"a": "key"}, contents(t, kv, "keys"))
+
+			err = kv.View(func(tx Tx) error {
+				return tx.Put("peers", "d", []byte("4"))
+			})
+			assert.ErrorIs(t, err, ErrReadOnly)
+
+			require.NoError(t, kv.Close())
+			_, err = kv.Get("peers", "c")
+			assert.ErrorIs(t, err, ErrClosed)
+		})
+	}
+
+	_, err := Open("badger", t.TempDir(), &quotaFiles{})
+	assert.Error(t, err)
+}
+
+func TestBackendsPersist(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			files := &quotaFiles{limit: 1 << 20}
+			kv, err := Open(backend, dir, files)
+			require.NoError(t, err)
+			for i := 0; i < 10; i++ {
+				require.NoError(t, kv.Put("store", fmt.Sprintf("key-%d", i), []byte{byte(i), 0}))
+			}
+			require.NoError(t, kv.Close())
+
+			reopened, err := Open(backend, dir, files)
+			require.NoError(t, err)
+			defer reopened.Close()
+			value, err := reopened.Get("store", "key-7")
+			require.NoError(t, err)
+			assert.Equal(t, []byte{7, 0}, value)
+			assert.Len(t, contents(t, reopened, "store"), 10)
+		})
+	}
+}
+
+func TestBackendsRespectQuota(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			files := &quotaFiles{limit: 1 << 20}
+			kv, err := Open(backend, t.TempDir(), files)
+			require.NoError(t, err)
+			defer kv.Close()
+
+			require.NoError(t, kv.Put("store", "small", []byte("value")))
+			files.limit = 1024
+			assert.ErrorIs(t, kv.Check(2048), errQuota)
+			assert.ErrorIs(t, kv.Put("store", "large", make([]byte, 2048)), errQuota)
+			_, err = kv.Get("store", "large")
+			assert.ErrorIs(t, err, ErrNotFound, "a write past the quota is rolled back")
+		})
+	}
+}
+
+func TestBoltChargesGrowth(t *testing.T) {
+	files := &quotaFiles{limit: 1 << 20}
+	kv, err := OpenBolt(filepath.Join(t.TempDir(), "nested", BoltFile), files)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	require.NoError(t, kv.Put("store", "a", []byte("1")))
+	require.NoError(t, kv.Update(func(tx Tx) error { return nil }))
+	assert.Equal(t, 3, files.modified, "opening and each commit go through the quota")
+
+	// Only one process may hold the database
+	_, err = OpenBolt(kv.path, files)
+	assert.Error(t, err)
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// buckets is the contents of a map store. Committed buckets are never
+// changed, only replaced, so a snapshot of them can be written out while
+// the next transaction runs.
+type buckets map[string]map[string][]byte
+
+// mapStore keeps buckets in memory, behind the Memory and JSON backends
+type mapStore struct {
+	mu      sync.RWMutex
+	buckets buckets
+	closed  bool
+
+	// persist, if set, saves what a transaction is about to commit; the
+	// transaction is rolled back if it fails
+	persist func(buckets) error
+	// files answers Check, if set
+	files Files
+}
+
+// Memory is a KV held in memory only, for tests and nodes that keep no state
+// across restarts
+type Memory struct {
+	mapStore
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{mapStore{buckets: make(buckets)}}
+}
+
+// Get returns the value of key, or ErrNotFound
+func (s *mapStore) Get(bucket, key string) ([]byte, error) {
+	return get(s, bucket, key)
+}
+
+// Put sets the value of key
+func (s *mapStore) Put(bucket, key string, value []byte) error {
+	return put(s, bucket, key, value)
+}
+
+// Delete removes key
+func (s *mapStore) Delete(bucket, key string) error {
+	return remove(s, bucket, key)
+}
+
+// Iterate calls fn for every key of a bucket in order
+func (s *mapStore) Iterate(bucket string, fn func(key string, value []byte) error) error {
+	return iterate(s, bucket, fn)
+}
+
+// View runs fn in a read-only transaction
+func (s *mapStore) View(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return fn(&mapTx{base: s.buckets})
+}
+
+// Update runs fn in a read-write transaction. Its changes are staged and
+// applied only once fn succeeds and, for a persisted store, they are saved.
+func (s *mapStore) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	tx := &mapTx{
+		base:     s.buckets,
+		writable: true,
+		changes:  make(map[string]map[string][]byte),
+		dropped:  make(map[string]bool),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	next := tx.commit()
+	if s.persist != nil {
+		if err := s.persist(next); err != nil {
+			return err
+		}
+	}
+	s.buckets = next
+	return nil
+}
+
+// Check reports whether n more bytes may be stored
+func (s *mapStore) Check(n int64) error {
+	if s.files == nil {
+		return nil
+	}
+	return s.files.Check(n)
+}
+
+// Close releases the store
+func (s *mapStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// mapTx is a transaction on a map store. A change to a key is staged as its
+// new value, or nil once deleted, and a deleted bucket reads as empty.
+type mapTx struct {
+	base     buckets
+	writable bool
+	changes  map[string]map[string][]byte
+	dropped  map[string]bool
+}
+
+// Get returns the value of key as staged, else as committed
+func (tx *mapTx) Get(bucket, key string) ([]byte, error) {
+	if value, staged := tx.changes[bucket][key]; staged {
+		if value == nil {
+			return nil, ErrNotFound
+		}
+		return clone(value), nil
+	}
+	if value, exists := tx.base[bucket][key]; exists && !tx.dropped[bucket] {
+		return clone(value), nil
+	}
+	return nil, ErrNotFound
+}
+
+// Put stages the value of key
+func (tx *mapTx) Put(bucket, key string, value []byte) error {
+	if err := tx.stage(bucket, key); err != nil {
+		return err
+	}
+	tx.changes[bucket][key] = append([]byte{}, value...)
+	return nil
+}
+
+// Delete stages the removal of key
+func (tx *mapTx) Delete(bucket, key string) error {
+	if err := tx.stage(bucket, key); err != nil {
+		return err
+	}
+	tx.changes[bucket][key] = nil
+	return nil
+}
+
+// DeleteBucket stages the removal of a bucket and everything in it
+func (tx *mapTx) DeleteBucket(bucket string) error {
+	if err := validate(bucket, "-"); err != nil {
+		return err
+	}
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	tx.dropped[bucket] = true
+	delete(tx.changes, bucket)
+	return nil
+}
+
+// Iterate calls fn for every key of a bucket in order, staged changes
+// included
+func (tx *mapTx) Iterate(bucket string, fn func(key string, value []byte) error) error {
+	values := make(map[string][]byte)
+	if !tx.dropped[bucket] {
+		for key, value := range tx.base[bucket] {
+			values[key] = value
+		}
+	}
+	for key, value := range tx.changes[bucket] {
+		if value == nil {
+			delete(values, key)
+		} else {
+			values[key] = value
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, clone(values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stage readies a bucket for a change to key
+func (tx *mapTx) stage(bucket, key string) error {
+	if err := validate(bucket, key); err != nil {
+		return err
+	}
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	if tx.changes[bucket] == nil {
+		tx.changes[bucket] = make(map[string][]byte)
+	}
+	return nil
+}
+
+// commit returns the buckets with the transaction's changes applied,
+// copying only the buckets it changed
+func (tx *mapTx) commit() buckets {
+	next := make(buckets, len(tx.base))
+	for name, bucket := range tx.base {
+		if !tx.dropped[name] {
+			next[name] = bucket
+		}
+	}
+	for name, changes := range tx.changes {
+		bucket := make(map[string][]byte, len(next[name])+len(changes))
+		for key, value := range next[name] {
+			bucket[key] = value
+		}
+		for key, value := range changes {
+			if value == nil {
+				delete(bucket, key)
+			} else {
+				bucket[key] = value
+			}
+		}
+		if len(bucket) == 0 {
+			delete(next, name)
+		} else {
+			next[name] = bucket
+		}
+	}
+	return next
+}
+
+// clone copies a value handed out of the store
+func clone(value []byte) []byte {
+	return append([]byte{}, value...)
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// MigratedSuffix is added to the name of a file once its contents have been
+// moved into a bucket
+const MigratedSuffix = ".migrated"
+
+// errStop ends an iteration early
+var errStop = errors.New("stop iterating")
+
+// Migrate moves a file that an earlier release kept its state in into
+// bucket, with decode turning the file's contents into keys and values. The
+// file is then renamed with MigratedSuffix, so it is kept for a downgrade
+// but only ever imported once. A missing file is not an error, and a file
+// whose bucket already holds data is set aside without being imported.
+func Migrate(kv KV, bucket, path string, decode func(data []byte) (map[string][]byte, error)) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	err = kv.Update(func(tx Tx) error {
+		empty := true
+		if err := tx.Iterate(bucket, func(string, []byte) error {
+			empty = false
+			return errStop
+		}); err != nil && !errors.Is(err, errStop) {
+			return err
+		}
+		if !empty {
+			return nil
+		}
+
+		values, err := decode(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		for key, value := range values {
+			if err := tx.Put(bucket, key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s: %w", path, err)
+	}
+
+	if err := os.Rename(path, path+MigratedSuffix); err != nil {
+		return fmt.Errorf("failed to set aside %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeRecords turns a legacy file of records into values by name
+func decodeRecords(data []byte) (map[string][]byte, error) {
+	var records []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte)
+	for _, record := range records {
+		values[record.Name] = []byte(record.Value)
+	}
+	return values, nil
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "peers.json")
+	kv := NewMemory()
+
+	// Nothing to migrate
+	require.NoError(t, Migrate(kv, "peers", path, decodeRecords))
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name":"a","value":"1"},{"name":"b","value":"2"}]`), 0644))
+	require.NoError(t, Migrate(kv, "peers", path, decodeRecords))
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, contents(t, kv, "peers"))
+	assert.NoFileExists(t, path)
+	assert.FileExists(t, path+MigratedSuffix)
+
+	// A file left behind next to a bucket holding data is set aside unread
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name":"c","value":"3"}]`), 0644))
+	require.NoError(t, Migrate(kv, "peers", path, decodeRecords))
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, contents(t, kv, "peers"))
+	assert.NoFileExists(t, path)
+
+	// A file that cannot be parsed stays where it is
+	corrupt := filepath.Join(dir, "store.json")
+	require.NoError(t, os.WriteFile(corrupt, []byte(`{`), 0644))
+	assert.Error(t, Migrate(kv, "store", corrupt, decodeRecords))
+	assert.FileExists(t, corrupt)
+	assert.Empty(t, contents(t, kv, "store"))
+}
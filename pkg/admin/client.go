@@ -0,0 +1,219 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+)
+
+// Client talks to the admin API of a node through its control endpoint
+type Client struct {
+	http     *http.Client
+	endpoint ControlEndpoint
+}
+
+// NewClient creates a client for the node listening on endpoint
+func NewClient(endpoint ControlEndpoint) *Client {
+	return &Client{
+		endpoint: endpoint,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return endpoint.Dial(ctx)
+				},
+			},
+		},
+	}
+}
+
+// Status returns the node's network status
+func (c *Client) Status(ctx context.Context) (*p2p.NetworkStatus, error) {
+	var status p2p.NetworkStatus
+	if err := c.do(ctx, http.MethodGet, "/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Peers returns the node's connected peers
+func (c *Client) Peers(ctx context.Context) ([]PeerSummary, error) {
+	var peers []PeerSummary
+	if err := c.do(ctx, http.MethodGet, "/peers", nil, &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// Flapping returns the peers that flapped recently, whether connected or
+// not
+func (c *Client) Flapping(ctx context.Context) ([]p2p.FlapState, error) {
+	var flapping []p2p.FlapState
+	if err := c.do(ctx, http.MethodGet, "/peers/flapping", nil, &flapping); err != nil {
+		return nil, err
+	}
+	return flapping, nil
+}
+
+// ExportPeers returns the node's remembered peers as a peer list
+func (c *Client) ExportPeers(ctx context.Context) (*p2p.PeerList, error) {
+	var list p2p.PeerList
+	if err := c.do(ctx, http.MethodGet, "/peers/export", nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// ImportPeers has the node merge a peer list into its peer store
+func (c *Client) ImportPeers(ctx context.Context, list *p2p.PeerList) (*p2p.PeerImportResult, error) {
+	var result p2p.PeerImportResult
+	if err := c.do(ctx, http.MethodPost, "/peers/import", list, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Discover has the node run a discovery cycle and returns what it found. A
+// timeout above zero bounds how long the node waits for the cycle.
+func (c *Client) Discover(ctx context.Context, timeout time.Duration) (*p2p.DiscoveryResult, error) {
+	path := "/discover"
+	if timeout > 0 {
+		path += "?timeout=" + timeout.String()
+	}
+	var result p2p.DiscoveryResult
+	if err := c.do(ctx, http.MethodPost, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Connect has the node dial a peer and returns the peer reached
+func (c *Client) Connect(ctx context.Context, address string) (*PeerSummary, error) {
+	var peer PeerSummary
+	if err := c.do(ctx, http.MethodPost, "/peers", connectRequest{Address: address}, &peer); err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+// Ping has the node ping a peer and returns the round trip time, with the
+// trace ID the ping was logged under. A timeout above zero bounds how long
+// the node waits for the answer.
+func (c *Client) Ping(ctx context.Context, peerID string, timeout time.Duration) (*PingResult, error) {
+	path := "/peers/" + url.PathEscape(peerID) + "/ping"
+	if timeout > 0 {
+		path += "?timeout=" + timeout.String()
+	}
+	var result PingResult
+	if err := c.do(ctx, http.MethodPost, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Trace has the node trace the route to a peer. A trace that stopped short
+// of the peer is returned with its Error set. A timeout above zero bounds
+// how long the node waits for the trace.
+func (c *Client) Trace(ctx context.Context, peerID string, timeout time.Duration) (*TraceResult, error) {
+	path := "/peers/" + url.PathEscape(peerID) + "/trace"
+	if timeout > 0 {
+		path += "?timeout=" + timeout.String()
+	}
+	var result TraceResult
+	if err := c.do(ctx, http.MethodPost, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Disconnect has the node disconnect a peer and forget it, draining it and
+// holding it off from reconnecting as opts say
+func (c *Client) Disconnect(ctx context.Context, peerID string, opts p2p.DisconnectOptions) (*DisconnectResult, error) {
+	query := url.Values{}
+	if opts.Reason != "" {
+		query.Set("reason", opts.Reason)
+	}
+	if opts.Drain {
+		query.Set("drain", "true")
+	}
+	if opts.DrainTimeout > 0 {
+		query.Set("timeout", opts.DrainTimeout.String())
+	}
+	if opts.NoReconnect > 0 {
+		query.Set("no_reconnect", opts.NoReconnect.String())
+	}
+	path := "/peers/" + url.PathEscape(peerID) + "/disconnect"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var result DisconnectResult
+	if err := c.do(ctx, http.MethodPost, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// RotateKey has the node replace its identity key
+func (c *Client) RotateKey(ctx context.Context) (*KeyRotationSummary, error) {
+	var rotation KeyRotationSummary
+	if err := c.do(ctx, http.MethodPost, "/key/rotate", nil, &rotation); err != nil {
+		return nil, err
+	}
+	return &rotation, nil
+}
+
+// do sends a request with body encoded as JSON and decodes the response
+// into out. Error responses are returned as errors.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// The host is ignored; every connection goes to the control endpoint
+	req, err := http.NewRequestWithContext(ctx, method, "http://synapse"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := c.endpoint.Token()
+	if err != nil {
+		return fmt.Errorf("failed to reach node: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach node: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s %s: %s", method, path, apiErr.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+)
+
+// ControlEndpoint is where the local control API listens. Local commands
+// reach the node through it without an HTTP port being opened.
+type ControlEndpoint interface {
+	// Listen opens the endpoint, cleaning up after a node that crashed
+	Listen() (net.Listener, error)
+	// Dial connects to the endpoint of a running node
+	Dial(ctx context.Context) (net.Conn, error)
+	// Remove deletes what Listen left on disk once the listener is closed
+	Remove() error
+	// Token returns the bearer token requests through the endpoint must
+	// carry, or "" if only its owner can connect to it in the first place
+	Token() (string, error)
+	// String describes the endpoint for logs
+	String() string
+}
+
+// ControlSocketPath returns where the control endpoint of a node with cfg
+// lives, or "" if it is disabled. Relative paths are under the data
+// directory.
+func ControlSocketPath(cfg *config.Config) string {
+	path := cfg.Admin.ControlSocket
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(cfg.Storage.DataDir, path)
+}
+
+// NewControlEndpoint returns the control endpoint at path: a unix socket, or
+// on Windows a localhost TCP port whose address is kept in a file at path
+func NewControlEndpoint(path string) ControlEndpoint {
+	if runtime.GOOS == "windows" {
+		return TCPEndpoint(path)
+	}
+	return UnixEndpoint(path)
+}
+
+// UnixEndpoint is a unix socket only its owner may connect to
+type UnixEndpoint string
+
+// Listen creates the socket, replacing one left by a node that is gone
+func (e UnixEndpoint) Listen() (net.Listener, error) {
+	path := string(e)
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use by another node", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+		}
+	}
+
+	// The socket is created in a directory only we can enter and restricted
+	// there, so it is never reachable with the permissions the umask gives
+	// it, then moved into place
+	private, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create control socket: %w", err)
+	}
+	defer os.RemoveAll(private)
+	created := filepath.Join(private, "sock")
+
+	listener, err := net.Listen("unix", created)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket %s: %w", path, err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(created, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+	if err := os.Rename(created, path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to create control socket %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// Dial connects to the socket
+func (e UnixEndpoint) Dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", string(e))
+}
+
+// Remove deletes the socket file
+func (e UnixEndpoint) Remove() error {
+	if err := os.Remove(string(e)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Token returns "": the socket's permissions keep everyone else out
+func (e UnixEndpoint) Token() (string, error) {
+	return "", nil
+}
+
+func (e UnixEndpoint) String() string {
+	return "unix:" + string(e)
+}
+
+// TCPEndpoint listens on a free localhost port and writes its address to a
+// file only its owner may read, for platforms without unix sockets. Any
+// local user can connect to the port, so the file also holds a token, new
+// each time the endpoint is opened, that requests must carry.
+type TCPEndpoint string
+
+// Listen opens the port and records its address and token, replacing those
+// of a node that is gone
+func (e TCPEndpoint) Listen() (net.Listener, error) {
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate control token: %w", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for control connections: %w", err)
+	}
+	record := listener.Addr().String() + "\n" + hex.EncodeToString(secret[:]) + "\n"
+	if err := storage.WriteFileAtomic(string(e), []byte(record), 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to record control address: %w", err)
+	}
+	return listener, nil
+}
+
+// Dial connects to the recorded address
+func (e TCPEndpoint) Dial(ctx context.Context) (net.Conn, error) {
+	address, _, err := e.read()
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// Token returns the recorded token
+func (e TCPEndpoint) Token() (string, error) {
+	_, token, err := e.read()
+	return token, err
+}
+
+// read returns the address and token recorded in the file
+func (e TCPEndpoint) read() (address, token string, err error) {
+	data, err := os.ReadFile(string(e))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read control address: %w", err)
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) != 2 {
+		return "", "", fmt.Errorf("malformed control address file %s", string(e))
+	}
+	return lines[0], lines[1], nil
+}
+
+// Remove deletes the address file
+func (e TCPEndpoint) Remove() error {
+	if err := os.Remove(string(e)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (e TCPEndpoint) String() string {
+	return "tcp address in " + string(e)
+}
+
+// StartControl begins serving the admin API on a control endpoint. Access
+// is guarded by the endpoint's file permissions, and the token it records
+// if it has one, instead of the configured auth token.
+func (s *Server) StartControl(endpoint ControlEndpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.control != nil {
+		return fmt.Errorf("control endpoint already started")
+	}
+
+	listener, err := endpoint.Listen()
+	if err != nil {
+		return err
+	}
+	token, err := endpoint.Token()
+	if err != nil {
+		listener.Close()
+		endpoint.Remove()
+		return err
+	}
+	control := &http.Server{
+		Handler:           requireToken(token, s.mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.control = control
+	s.controlEndpoint = endpoint
+	s.feed.start(s.network)
+
+	go func() {
+		if err := control.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Errorf("control endpoint stopped: %v", err)
+			select {
+			case s.errs <- fmt.Errorf("control endpoint stopped: %w", err):
+			default:
+			}
+		}
+	}()
+
+	s.logger.Infof("control API listening on %s", endpoint)
+	return nil
+}
+
+// stopControl shuts the control endpoint down and removes it
+func (s *Server) stopControl(ctx context.Context) error {
+	if s.control == nil {
+		return nil
+	}
+
+	err := s.control.Shutdown(ctx)
+	if removeErr := s.controlEndpoint.Remove(); removeErr != nil && err == nil {
+		err = removeErr
+	}
+	s.control = nil
+	s.controlEndpoint = nil
+	if err != nil {
+		return fmt.Errorf("failed to stop control endpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package admin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// controlEndpoints creates a control endpoint of each kind at a path
+var controlEndpoints = map[string]func(path string) ControlEndpoint{
+	"unix": func(path string) ControlEndpoint { return UnixEndpoint(path) },
+	"tcp":  func(path string) ControlEndpoint { return TCPEndpoint(path) },
+}
+
+// startNetwork starts a network listening on a free port
+func startNetwork(t *testing.T, nodeID string) *p2p.Network {
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.P2P.EnableDiscovery = false
+	cfg.Storage.DataDir = t.TempDir()
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+
+	network, err := p2p.New(cfg, log, nodeID)
+	require.NoError(t, err)
+	require.NoError(t, network.Start(context.Background()))
+	t.Cleanup(func() { network.Stop() })
+	return network
+}
+
+func TestControlEndpoint(t *testing.T) {
+	for name, newEndpoint := range controlEndpoints {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			path := filepath.Join(t.TempDir(), "synapse.sock")
+			endpoint := newEndpoint(path)
+			server := startTestServer(t, "secret-token")
+			require.NoError(t, server.StartControl(endpoint))
+			assert.Error(t, server.StartControl(endpoint))
+
+			// The control endpoint needs no configured token
+			client := NewClient(endpoint)
+			status, err := client.Status(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "admin-test-node", status.NodeID)
+			peers, err := client.Peers(ctx)
+			require.NoError(t, err)
+			assert.Empty(t, peers)
+
+			// Only the owner may use it, and nothing else is left beside it
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+			entries, err := os.ReadDir(filepath.Dir(path))
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+
+			// A port anyone on the host can reach also wants the token only
+			// its owner can read
+			token, err := endpoint.Token()
+			require.NoError(t, err)
+			if name == "tcp" {
+				assert.Len(t, token, 64)
+				anonymous := &http.Client{Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return endpoint.Dial(ctx)
+					},
+				}}
+				resp, err := anonymous.Get("http://synapse/status")
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+			} else {
+				assert.Empty(t, token)
+			}
+
+			require.NoError(t, server.Stop(ctx))
+			assert.NoFileExists(t, path)
+			_, err = client.Status(ctx)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestControlConnect(t *testing.T) {
+	ctx := context.Background()
+	local := startNetwork(t, "local-node")
+	remote := startNetwork(t, "remote-node")
+
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+	server, err := New(config.AdminConfig{}, log, local)
+	require.NoError(t, err)
+	endpoint := UnixEndpoint(filepath.Join(t.TempDir(), "synapse.sock"))
+	require.NoError(t, server.StartControl(endpoint))
+	defer server.Stop(ctx)
+
+	client := NewClient(endpoint)
+	peer, err := client.Connect(ctx, remote.ListenAddr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "remote-node", peer.ID)
+
+	peers, err := client.Peers(ctx)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	assert.Equal(t, "remote-node", peers[0].ID)
+	assert.NotEmpty(t, peers[0].Capabilities)
+
+	// The remote knows no one else to find
+	discovered, err := client.Discover(ctx, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, p2p.DiscoveryResult{}, *discovered)
+
+	ping, err := client.Ping(ctx, "remote-node", time.Second)
+	require.NoError(t, err)
+	assert.Positive(t, ping.RTT)
+	assert.Len(t, ping.TraceID, 32)
+	_, err = client.Ping(ctx, "missing-node", time.Second)
+	assert.ErrorContains(t, err, "not connected")
+
+	trace, err := client.Trace(ctx, "remote-node", time.Second)
+	require.NoError(t, err)
+	require.Len(t, trace.Hops, 1)
+	assert.Equal(t, "remote-node", trace.Hops[0].NodeID)
+	assert.Empty(t, trace.Error)
+	assert.NotEqual(t, ping.TraceID, trace.TraceID)
+
+	_, err = client.Connect(ctx, "")
+	assert.ErrorContains(t, err, "address")
+
+	// A drained peer is told goodbye, and forgets us too
+	result, err := client.Disconnect(ctx, "remote-node", p2p.DisconnectOptions{Drain: true, NoReconnect: time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, DisconnectResult{PeerID: "remote-node", Drained: true, NoReconnect: time.Minute}, *result)
+	peers, err = client.Peers(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, peers)
+	require.Eventually(t, func() bool {
+		return len(remote.Peers()) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+	_, err = client.Disconnect(ctx, "remote-node", p2p.DisconnectOptions{})
+	assert.ErrorContains(t, err, "not connected")
+}
+
+func TestStaleControlSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "synapse.sock")
+	endpoint := UnixEndpoint(path)
+
+	// A node that crashed leaves its socket behind
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	require.FileExists(t, path)
+
+	listener, err := endpoint.Listen()
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// A socket still being served is left alone
+	_, err = endpoint.Listen()
+	assert.ErrorContains(t, err, "in use")
+}
@@ -0,0 +1,68 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// recentGCPauses is how many of the latest GC pauses /debug/runtime lists
+const recentGCPauses = 16
+
+// RuntimeStats describes the node process for diagnosing leaks and hot spots
+type RuntimeStats struct {
+	Goroutines     int             `json:"goroutines"`
+	HeapAlloc      uint64          `json:"heap_alloc_bytes"`
+	HeapInuse      uint64          `json:"heap_inuse_bytes"`
+	HeapObjects    uint64          `json:"heap_objects"`
+	Sys            uint64          `json:"sys_bytes"`
+	NumGC          uint32          `json:"num_gc"`
+	GCPauseTotal   time.Duration   `json:"gc_pause_total_ns"`
+	RecentGCPauses []time.Duration `json:"recent_gc_pauses_ns"`
+	Connections    int             `json:"connections"`
+	Peers          int             `json:"peers"`
+}
+
+// debugRoutes registers the pprof profiles and runtime stats. They are only
+// registered when profiling is enabled, so a node that has not opted in
+// answers 404 for them.
+func (s *Server) debugRoutes() {
+	s.mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	s.mux.HandleFunc("GET /debug/runtime", s.handleRuntime)
+}
+
+// handleRuntime serves goroutine, heap and GC stats with the node's
+// connection and peer counts
+func (s *Server) handleRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	status := s.network.Status()
+
+	stats := RuntimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		GCPauseTotal: time.Duration(mem.PauseTotalNs),
+		Connections:  status.ActiveConnections,
+		Peers:        status.ConnectedPeers,
+	}
+
+	// PauseNs is a circular buffer whose latest entry is at (NumGC+255)%256
+	recent := min(int(mem.NumGC), recentGCPauses, len(mem.PauseNs))
+	stats.RecentGCPauses = make([]time.Duration, 0, recent)
+	for i := 0; i < recent; i++ {
+		index := (int(mem.NumGC) - 1 - i) % len(mem.PauseNs)
+		stats.RecentGCPauses = append(stats.RecentGCPauses, time.Duration(mem.PauseNs[index]))
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
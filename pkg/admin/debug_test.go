@@ -0,0 +1,52 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugEndpointsDisabled(t *testing.T) {
+	server := startTestServer(t, "secret")
+	base := "http://" + server.Addr()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline", "/debug/runtime"} {
+		assert.Equal(t, http.StatusNotFound, get(t, base+path, "secret").StatusCode, path)
+	}
+}
+
+func TestDebugEndpointsEnabled(t *testing.T) {
+	server := startServerWithConfig(t, config.AdminConfig{
+		Enabled:         true,
+		ListenAddr:      "127.0.0.1:0",
+		AuthToken:       "secret",
+		EnableProfiling: true,
+	})
+	base := "http://" + server.Addr()
+
+	// Profiles need the token like every other endpoint
+	assert.Equal(t, http.StatusUnauthorized, get(t, base+"/debug/pprof/", "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, get(t, base+"/debug/runtime", "").StatusCode)
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+		assert.Equal(t, http.StatusOK, get(t, base+path, "secret").StatusCode, path)
+	}
+
+	runtime.GC()
+	resp := get(t, base+"/debug/runtime", "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats RuntimeStats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Positive(t, stats.Goroutines)
+	assert.Positive(t, stats.HeapAlloc)
+	assert.Positive(t, stats.NumGC)
+	assert.NotEmpty(t, stats.RecentGCPauses)
+	assert.LessOrEqual(t, len(stats.RecentGCPauses), recentGCPauses)
+	assert.Zero(t, stats.Peers)
+	assert.Zero(t, stats.Connections)
+}
@@ -0,0 +1,241 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+)
+
+const (
+	// eventRingSize is how many of the latest events are kept for streams
+	// resuming with Last-Event-ID
+	eventRingSize = 256
+
+	// eventClientBuffer is how many events a stream may fall behind by
+	// before it is disconnected
+	eventClientBuffer = 64
+
+	// eventWriteTimeout bounds writing one event to a stream
+	eventWriteTimeout = 10 * time.Second
+
+	// eventKeepAlive is how often an idle stream is sent a comment, so
+	// proxies in between do not time it out
+	eventKeepAlive = 15 * time.Second
+)
+
+// feedEvent is a network event numbered for the stream
+type feedEvent struct {
+	id    uint64
+	event p2p.Event
+}
+
+// feedClient is one stream reading the feed. gone is closed once the stream
+// is dropped for falling behind or the feed stops.
+type feedClient struct {
+	events chan feedEvent
+	gone   chan struct{}
+}
+
+// eventFeed numbers the network's events, keeps the latest for streams that
+// resume, and fans them out to the streams. Publishing never blocks the
+// network's event bus: a stream that does not keep up is dropped instead.
+type eventFeed struct {
+	logger  *logger.Logger
+	ring    []feedEvent
+	lastID  uint64
+	clients map[*feedClient]struct{}
+	// cancel unsubscribes the feed from the network; nil while stopped
+	cancel func()
+	mu     sync.Mutex
+}
+
+// newEventFeed creates a feed that is not yet subscribed to the network
+func newEventFeed(log *logger.Logger) *eventFeed {
+	return &eventFeed{
+		logger:  log,
+		clients: make(map[*feedClient]struct{}),
+	}
+}
+
+// start subscribes the feed to the network's events unless it already is
+func (f *eventFeed) start(network *p2p.Network) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cancel != nil {
+		return
+	}
+	events, cancel := network.Subscribe(eventRingSize)
+	f.cancel = cancel
+	go func() {
+		for evt := range events {
+			f.publish(evt)
+		}
+	}()
+}
+
+// stop unsubscribes the feed from the network and ends every stream. The
+// events kept stay for streams resuming once the feed starts again.
+func (f *eventFeed) stop() {
+	f.mu.Lock()
+	cancel := f.cancel
+	f.cancel = nil
+	for client := range f.clients {
+		f.drop(client)
+	}
+	f.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// publish numbers an event, keeps it and hands it to every stream, dropping
+// the streams with no room left for it
+func (f *eventFeed) publish(evt p2p.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastID++
+	numbered := feedEvent{id: f.lastID, event: evt}
+	f.ring = append(f.ring, numbered)
+	if len(f.ring) > eventRingSize {
+		f.ring = f.ring[len(f.ring)-eventRingSize:]
+	}
+
+	for client := range f.clients {
+		select {
+		case client.events <- numbered:
+		default:
+			f.logger.Warnf("dropping event stream that fell %d events behind", eventClientBuffer)
+			f.drop(client)
+		}
+	}
+}
+
+// subscribe registers a stream and returns the kept events it missed: those
+// after the event numbered last if resuming, else none. A last the feed has
+// not reached yet was numbered before the node restarted, so every kept
+// event is missed. It returns nil while the feed is stopped.
+func (f *eventFeed) subscribe(last uint64, resume bool) (*feedClient, []feedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cancel == nil {
+		return nil, nil
+	}
+	client := &feedClient{
+		events: make(chan feedEvent, eventClientBuffer),
+		gone:   make(chan struct{}),
+	}
+	f.clients[client] = struct{}{}
+
+	var missed []feedEvent
+	if resume {
+		if last > f.lastID {
+			last = 0
+		}
+		for _, evt := range f.ring {
+			if evt.id > last {
+				missed = append(missed, evt)
+			}
+		}
+	}
+	return client, missed
+}
+
+// unsubscribe removes a stream that ended
+func (f *eventFeed) unsubscribe(client *feedClient) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drop(client)
+}
+
+// drop removes a stream and tells it it is gone. Callers hold f.mu.
+func (f *eventFeed) drop(client *feedClient) {
+	if _, ok := f.clients[client]; !ok {
+		return
+	}
+	delete(f.clients, client)
+	close(client.gone)
+}
+
+// handleEvents streams the network's events as server-sent events, each
+// with its number as ID, its type as event type and the event as JSON data.
+// A Last-Event-ID header resumes the stream after that event, as far as the
+// latest events kept reach back. A stream that falls behind is closed.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	var last uint64
+	param := r.Header.Get("Last-Event-ID")
+	if param != "" {
+		id, err := strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Last-Event-ID must be an event ID, not %q", param))
+			return
+		}
+		last = id
+	}
+
+	client, missed := s.feed.subscribe(last, param != "")
+	if client == nil {
+		writeError(w, http.StatusServiceUnavailable, "event feed is stopped")
+		return
+	}
+	defer s.feed.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	stream := http.NewResponseController(w)
+	if err := stream.Flush(); err != nil {
+		return
+	}
+
+	for _, evt := range missed {
+		if err := writeEvent(w, stream, evt); err != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.gone:
+			return
+		case evt := <-client.events:
+			err = writeEvent(w, stream, evt)
+		case <-keepAlive.C:
+			stream.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err == nil {
+				err = stream.Flush()
+			}
+		}
+		if err != nil {
+			s.logger.Debugf("event stream to %s ended: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+// writeEvent writes one event to a stream
+func writeEvent(w http.ResponseWriter, stream *http.ResponseController, evt feedEvent) error {
+	data, err := json.Marshal(evt.event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	stream.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", evt.id, evt.event.Type, data); err != nil {
+		return err
+	}
+	return stream.Flush()
+}
@@ -0,0 +1,201 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamedEvent is an event read from GET /events
+type streamedEvent struct {
+	id    uint64
+	kind  string
+	event p2p.Event
+}
+
+// streamEvents opens GET /events, resuming after lastID if not empty, and
+// returns the events read from it
+func streamEvents(t *testing.T, server *Server, lastID string) <-chan streamedEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+server.Addr()+"/events", nil)
+	require.NoError(t, err)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan streamedEvent, 64)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var evt streamedEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			field, value, _ := strings.Cut(scanner.Text(), ": ")
+			switch field {
+			case "id":
+				evt.id, _ = strconv.ParseUint(value, 10, 64)
+			case "event":
+				evt.kind = value
+			case "data":
+				json.Unmarshal([]byte(value), &evt.event)
+			case "":
+				if evt.kind != "" {
+					events <- evt
+				}
+				evt = streamedEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent returns the next event of the given type from events, skipping
+// others
+func nextEvent(t *testing.T, events <-chan streamedEvent, kind p2p.EventType) streamedEvent {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case evt, ok := <-events:
+			require.True(t, ok, "stream ended waiting for %s", kind)
+			if evt.kind == string(kind) {
+				assert.Equal(t, kind, evt.event.Type)
+				return evt
+			}
+		case <-timeout:
+			require.Fail(t, "no event", "waiting for %s", kind)
+		}
+	}
+}
+
+func TestEventsEndpoint(t *testing.T) {
+	cfg := config.Default()
+	cfg.Admin = config.AdminConfig{Enabled: true, ListenAddr: "127.0.0.1:0"}
+	cfg.P2P.ListenPort = 0
+	server := startNodeServer(t, cfg)
+	require.NoError(t, server.network.Start(context.Background()))
+	t.Cleanup(func() { server.network.Stop() })
+	events := streamEvents(t, server, "")
+
+	// A peer joins and is banned
+	peer := startNetwork(t, "admin-events-peer")
+	_, err := server.network.Connect(context.Background(), peer.ListenAddr().String())
+	require.NoError(t, err)
+	connected := nextEvent(t, events, p2p.EventPeerConnected)
+	assert.Equal(t, "admin-events-peer", connected.event.PeerID)
+
+	require.NoError(t, server.network.DisconnectPeer("admin-events-peer", p2p.DisconnectOptions{Reason: "misbehaving", NoReconnect: time.Minute}))
+	banned := nextEvent(t, events, p2p.EventPeerBanned)
+	assert.Equal(t, "admin-events-peer", banned.event.PeerID)
+	assert.Equal(t, "misbehaving", banned.event.Data["reason"])
+	disconnected := nextEvent(t, events, p2p.EventPeerDisconnected)
+	assert.Equal(t, "admin-events-peer", disconnected.event.PeerID)
+	assert.Greater(t, disconnected.id, connected.id)
+
+	// A connection that never completes its handshake
+	conn, err := net.Dial("tcp", server.network.ListenAddr().String())
+	require.NoError(t, err)
+	conn.Write([]byte("not a handshake\n"))
+	failed := nextEvent(t, events, p2p.EventHandshakeFailed)
+	assert.Equal(t, "inbound", failed.event.Data["direction"])
+	conn.Close()
+
+	// A stream resuming after the peer joined gets what followed
+	resumed := streamEvents(t, server, strconv.FormatUint(connected.id, 10))
+	assert.Equal(t, banned.id, (<-resumed).id)
+	assert.Equal(t, failed.id, nextEvent(t, resumed, p2p.EventHandshakeFailed).id)
+
+	// Last-Event-ID must be an ID the stream sent
+	req, err := http.NewRequest(http.MethodGet, "http://"+server.Addr()+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "latest")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Stopping the server ends the streams rather than waiting on them
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, server.Stop(ctx))
+	for range events {
+	}
+}
+
+func TestEventFeed(t *testing.T) {
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+	feed := newEventFeed(log)
+
+	// Nothing is streamed while the feed is stopped
+	client, _ := feed.subscribe(0, false)
+	assert.Nil(t, client)
+	feed.start(startNetwork(t, "admin-feed-node"))
+	defer feed.stop()
+
+	// Only the latest events are kept for resuming
+	for i := 0; i < eventRingSize+10; i++ {
+		feed.publish(p2p.Event{Type: p2p.EventPeerConnected})
+	}
+	_, missed := feed.subscribe(1, true)
+	require.Len(t, missed, eventRingSize)
+	assert.Equal(t, uint64(11), missed[0].id)
+	_, missed = feed.subscribe(eventRingSize+5, true)
+	assert.Len(t, missed, 5)
+	_, missed = feed.subscribe(0, false)
+	assert.Empty(t, missed)
+
+	// An ID from before a restart resumes from the oldest kept
+	_, missed = feed.subscribe(10000, true)
+	assert.Len(t, missed, eventRingSize)
+}
+
+func TestEventFeedDropsSlowStreams(t *testing.T) {
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+	feed := newEventFeed(log)
+	feed.start(startNetwork(t, "admin-slow-feed-node"))
+	defer feed.stop()
+
+	slow, _ := feed.subscribe(0, false)
+	fast, _ := feed.subscribe(0, false)
+	for i := 0; i <= eventClientBuffer; i++ {
+		feed.publish(p2p.Event{Type: p2p.EventPeerConnected})
+		<-fast.events
+	}
+
+	// The stream that did not read is dropped without holding up the one
+	// that did, or publishing
+	select {
+	case <-slow.gone:
+	default:
+		t.Fatal("slow stream was not dropped")
+	}
+	select {
+	case <-fast.gone:
+		t.Fatal("fast stream was dropped")
+	default:
+	}
+	feed.publish(p2p.Event{Type: p2p.EventPeerDisconnected})
+	assert.Equal(t, p2p.EventPeerDisconnected, (<-fast.events).event.Type)
+
+	// Stopping the feed ends the others
+	feed.stop()
+	<-fast.gone
+}
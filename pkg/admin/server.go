@@ -0,0 +1,661 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/audit"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// maxMetadataBody bounds the request body of PUT /peers/{id}/metadata,
+// comfortably above what the metadata limits allow
+const maxMetadataBody = 64 << 10
+
+// maxPeerListBody bounds the request body of POST /peers/import
+const maxPeerListBody = 8 << 20
+
+// Server serves the node's HTTP admin API
+type Server struct {
+	config   config.AdminConfig
+	logger   *logger.Logger
+	network  *p2p.Network
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+	errs     chan error
+	feed     *eventFeed
+	mu       sync.Mutex
+
+	// Local control endpoint serving the same API, if started
+	control         *http.Server
+	controlEndpoint ControlEndpoint
+}
+
+// New creates an admin server for the given network
+func New(cfg config.AdminConfig, log *logger.Logger, network *p2p.Network) (*Server, error) {
+	if log == nil {
+		return nil, fmt.Errorf("logger cannot be nil")
+	}
+	if network == nil {
+		return nil, fmt.Errorf("network cannot be nil")
+	}
+
+	s := &Server{
+		config:  cfg,
+		logger:  log.With("component", "admin"),
+		network: network,
+		mux:     http.NewServeMux(),
+		errs:    make(chan error, 1),
+	}
+	s.feed = newEventFeed(s.logger)
+	s.routes()
+
+	return s, nil
+}
+
+// routes registers the built-in endpoints
+func (s *Server) routes() {
+	s.mux.HandleFunc("GET /status", s.handleStatus)
+	s.mux.HandleFunc("GET /peers", s.handlePeers)
+	s.mux.HandleFunc("POST /peers", s.handleConnect)
+	s.mux.HandleFunc("GET /peers/flapping", s.handleFlapping)
+	s.mux.HandleFunc("GET /peers/export", s.handleExportPeers)
+	s.mux.HandleFunc("POST /peers/import", s.handleImportPeers)
+	s.mux.HandleFunc("GET /bootstrap", s.handleBootstrap)
+	s.mux.HandleFunc("POST /discover", s.handleDiscover)
+	s.mux.HandleFunc("GET /topology", s.handleTopology)
+	s.mux.HandleFunc("GET /storage", s.handleStorage)
+	s.mux.HandleFunc("GET /metrics", s.handleMetrics)
+	s.mux.HandleFunc("GET /audit", s.handleAudit)
+	s.mux.HandleFunc("GET /events", s.handleEvents)
+	s.mux.HandleFunc("GET /peers/{id}/metadata", s.handleGetPeerMetadata)
+	s.mux.HandleFunc("PUT /peers/{id}/metadata", s.handleSetPeerMetadata)
+	s.mux.HandleFunc("POST /peers/{id}/ping", s.handlePing)
+	s.mux.HandleFunc("POST /peers/{id}/trace", s.handleTrace)
+	s.mux.HandleFunc("POST /peers/{id}/disconnect", s.handleDisconnect)
+	s.mux.HandleFunc("POST /key/rotate", s.handleRotateKey)
+	if s.config.EnableProfiling {
+		s.debugRoutes()
+	}
+}
+
+// Handle registers an additional endpoint, e.g. one served by another node subsystem
+func (s *Server) Handle(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// Start begins serving on the configured listen address
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener != nil {
+		return fmt.Errorf("admin server already started")
+	}
+
+	listener, err := net.Listen("tcp", s.config.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start admin listener on %s: %w", s.config.ListenAddr, err)
+	}
+	server := &http.Server{
+		Handler:           s.authenticate(s.mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.listener = listener
+	s.server = server
+	s.feed.start(s.network)
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Errorf("admin server stopped: %v", err)
+			select {
+			case s.errs <- fmt.Errorf("admin server stopped: %w", err):
+			default:
+			}
+		}
+	}()
+
+	s.logger.Infof("admin API listening on %s", listener.Addr())
+	return nil
+}
+
+// Stop gracefully shuts the server and its control endpoint down
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Event streams never end by themselves, so shutting down would wait
+	// for them
+	s.feed.stop()
+	err := s.stopControl(ctx)
+	if s.server == nil {
+		return err
+	}
+
+	shutdownErr := s.server.Shutdown(ctx)
+	s.server = nil
+	s.listener = nil
+	if shutdownErr != nil {
+		return fmt.Errorf("failed to stop admin server: %w", shutdownErr)
+	}
+	return err
+}
+
+// Errors reports the server stopping on its own, e.g. because its listener
+// failed
+func (s *Server) Errors() <-chan error {
+	return s.errs
+}
+
+// Addr returns the address the server is listening on, or "" before Start
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// authenticate rejects requests without the configured bearer token. With
+// no token configured, which the config only allows on a loopback address,
+// requests from other machines may still only read.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if s.config.AuthToken == "" {
+		return readOnlyFromAfar(next)
+	}
+	return requireToken(s.config.AuthToken, next)
+}
+
+// readOnlyFromAfar rejects requests from other machines that would change
+// anything, such as rotating the key or disconnecting a peer
+func readOnlyFromAfar(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !fromLoopback(r) {
+			writeError(w, http.StatusForbidden, "an auth token is required to make changes from another machine")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fromLoopback reports whether r came from this machine
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireToken rejects requests without the bearer token expected, unless
+// expected is ""
+func requireToken(expected string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if expected != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+				writeError(w, http.StatusUnauthorized, "missing or invalid auth token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PeerSummary describes a connected peer
+type PeerSummary struct {
+	ID           string            `json:"id"`
+	Address      string            `json:"address"`
+	Version      string            `json:"version"`
+	ConnectedAt  time.Time         `json:"connected_at"`
+	Capabilities []string          `json:"capabilities"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Flaps        p2p.FlapState     `json:"flaps"`
+}
+
+// connectRequest is the body of POST /peers
+type connectRequest struct {
+	Address string `json:"address"`
+}
+
+// maxConnectBody bounds the request body of POST /peers
+const maxConnectBody = 4 << 10
+
+// handleStatus serves the network status
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.network.Status())
+}
+
+// handlePeers serves the connected peers
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers := s.network.ConnectedPeers()
+	summaries := make([]PeerSummary, 0, len(peers))
+	for _, peer := range peers {
+		summaries = append(summaries, summarizePeer(peer))
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// handleFlapping serves the peers that flapped recently, whether connected
+// or not
+func (s *Server) handleFlapping(w http.ResponseWriter, r *http.Request) {
+	flapping := s.network.FlappingPeers()
+	if flapping == nil {
+		flapping = []p2p.FlapState{}
+	}
+	writeJSON(w, http.StatusOK, flapping)
+}
+
+// handleExportPeers serves the remembered peers as a peer list another
+// node can import
+func (s *Server) handleExportPeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.network.ExportPeers())
+}
+
+// handleImportPeers merges the peer list in the request body into the peer
+// store and serves what became of each peer. A list that does not parse is
+// answered 400, saying where in it the problem is.
+func (s *Server) handleImportPeers(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPeerListBody))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("peer list is over %d bytes", maxPeerListBody))
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to read peer list: %v", err))
+		return
+	}
+	list, err := p2p.ParsePeerList(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid peer list: %v", err))
+		return
+	}
+
+	result, err := s.network.ImportPeers(list)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.logger.Infof("imported %d peers and updated %d on request", result.Added, result.Updated)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleBootstrap serves how connecting to each bootstrap node has gone
+func (s *Server) handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.network.BootstrapHealth())
+}
+
+// handleDiscover runs a discovery cycle, or joins the one under way, and
+// serves what it found. The timeout parameter, a duration such as "30s",
+// bounds the wait.
+func (s *Server) handleDiscover(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel, ok := requestTimeout(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	result, err := s.network.DiscoverNow(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.logger.Infof("discovery on request found %d candidates, dialed %d and connected to %d",
+			result.Candidates, result.Dialed, result.Connected)
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// handleConnect dials the address in the request body and serves the peer
+// reached
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	var req connectRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConnectBody)).Decode(&req); err != nil || req.Address == "" {
+		writeError(w, http.StatusBadRequest, "body must be {\"address\": \"host:port\"}")
+		return
+	}
+
+	peerID, err := s.network.Connect(r.Context(), req.Address)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	s.logger.Infof("connected to peer %s at %s on request", peerID, req.Address)
+
+	if peer, ok := s.network.Peer(peerID); ok {
+		writeJSON(w, http.StatusOK, summarizePeer(peer))
+		return
+	}
+	writeJSON(w, http.StatusOK, PeerSummary{ID: peerID, Address: req.Address})
+}
+
+// summarizePeer describes a peer for the API
+func summarizePeer(peer p2p.PeerSnapshot) PeerSummary {
+	return PeerSummary{
+		ID:           peer.ID,
+		Address:      peer.DialAddress,
+		Version:      peer.Version,
+		ConnectedAt:  peer.ConnectedAt,
+		Capabilities: peer.Capabilities,
+		Metadata:     peer.Metadata,
+		Flaps:        peer.Flaps,
+	}
+}
+
+// handleTopology serves the mesh graph as JSON (default) or Graphviz DOT
+func (s *Server) handleTopology(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = topology.GraphFormatJSON
+	}
+
+	data, err := s.network.ExportTopology(format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	contentType := "application/json"
+	if format == topology.GraphFormatDOT {
+		contentType = "text/vnd.graphviz"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// handleMetrics serves the connection timings for Prometheus to scrape
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := s.network.ConnectionTimings().WritePrometheus(w); err != nil {
+		s.logger.Debugf("failed to write metrics: %v", err)
+	}
+}
+
+// handleStorage serves data directory usage against the storage quota
+func (s *Server) handleStorage(w http.ResponseWriter, r *http.Request) {
+	manager := s.network.Storage()
+	if manager == nil {
+		writeError(w, http.StatusNotFound, "storage accounting is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, manager.Usage())
+}
+
+// handleAudit serves the peer lifecycle audit log, oldest first, from the
+// RFC 3339 time in the since parameter if given
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	log := s.network.AuditLog()
+	if log == nil {
+		writeError(w, http.StatusNotFound, "audit log is not enabled")
+		return
+	}
+
+	var since time.Time
+	if param := r.URL.Query().Get("since"); param != "" {
+		parsed, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("since must be an RFC 3339 time: %v", err))
+			return
+		}
+		since = parsed
+	}
+
+	entries, err := log.Since(since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []audit.Entry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// peerMetadata is the body of the peer metadata endpoints
+type peerMetadata struct {
+	PeerID   string            `json:"peer_id"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// KeyRotationSummary describes a rotation of the node's identity key
+type KeyRotationSummary struct {
+	OldFingerprint string    `json:"old_fingerprint"`
+	NewFingerprint string    `json:"new_fingerprint"`
+	RotatedAt      time.Time `json:"rotated_at"`
+}
+
+// handleRotateKey replaces the node's identity key and serves the rotation
+func (s *Server) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	rotation, err := s.network.RotateKey()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	summary := KeyRotationSummary{RotatedAt: time.Unix(rotation.RotatedAt, 0).UTC()}
+	if oldKey, newKey, err := rotation.Keys(); err == nil {
+		summary.OldFingerprint, _ = crypto.KeyFingerprint(oldKey)
+		summary.NewFingerprint, _ = crypto.KeyFingerprint(newKey)
+	}
+	s.logger.Infof("rotated identity key from %s to %s on request", summary.OldFingerprint, summary.NewFingerprint)
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// TraceIDHeader carries the trace ID of the messages a request to the ping
+// and trace endpoints has the node send. A request may set it to choose
+// the ID; the response always does.
+const TraceIDHeader = "X-Trace-Id"
+
+// traceRequest returns ctx carrying the trace ID for the messages a
+// request has the node send, the one the request asks for or a new one,
+// and sets the response's TraceIDHeader to it
+func traceRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, string) {
+	traceID := r.Header.Get(TraceIDHeader)
+	if traceID == "" || len(traceID) > p2p.MaxTraceIDLength {
+		traceID = p2p.NewTraceID()
+	}
+	w.Header().Set(TraceIDHeader, traceID)
+	return p2p.WithTraceID(ctx, traceID), traceID
+}
+
+// PingResult is the round trip time of a ping to a peer. TraceID is the
+// trace the PING and its PONG were logged under on both nodes.
+type PingResult struct {
+	PeerID  string        `json:"peer_id"`
+	RTT     time.Duration `json:"rtt"`
+	TraceID string        `json:"trace_id"`
+}
+
+// handlePing pings a peer and serves the round trip time. The timeout
+// parameter, a duration such as "2s", bounds the wait.
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue("id")
+	ctx, cancel, ok := requestTimeout(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	ctx, traceID := traceRequest(ctx, w, r)
+
+	rtt, err := s.network.Ping(ctx, peerID)
+	switch {
+	case errors.Is(err, p2p.ErrPeerNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, PingResult{PeerID: peerID, RTT: rtt, TraceID: traceID})
+	}
+}
+
+// TraceResult is the route a trace to a peer took. Error says why a trace
+// that did not reach the peer stopped after Hops. TraceID is the trace the
+// TRACE was logged under on every node it passed.
+type TraceResult struct {
+	PeerID  string        `json:"peer_id"`
+	Hops    []p2p.HopInfo `json:"hops"`
+	Error   string        `json:"error,omitempty"`
+	TraceID string        `json:"trace_id"`
+}
+
+// handleTrace traces the route to a peer and serves its hops. The timeout
+// parameter, a duration such as "5s", bounds the wait.
+func (s *Server) handleTrace(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue("id")
+	ctx, cancel, ok := requestTimeout(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	ctx, traceID := traceRequest(ctx, w, r)
+
+	hops, err := s.network.TraceRoute(ctx, peerID)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, TraceResult{PeerID: peerID, Hops: hops, TraceID: traceID})
+	case len(hops) > 0:
+		// The hops that answered are worth seeing even if the peer was not reached
+		writeJSON(w, http.StatusOK, TraceResult{PeerID: peerID, Hops: hops, Error: err.Error(), TraceID: traceID})
+	case errors.Is(err, p2p.ErrNoRoute):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, err.Error())
+	}
+}
+
+// DisconnectResult is a peer the node let go of. NoReconnect is how long the
+// node will not redial it by itself.
+type DisconnectResult struct {
+	PeerID      string        `json:"peer_id"`
+	Drained     bool          `json:"drained"`
+	NoReconnect time.Duration `json:"no_reconnect,omitempty"`
+}
+
+// handleDisconnect disconnects a peer and forgets it. With drain=true the
+// node waits up to the timeout parameter for the reliable sends to the peer
+// to be acknowledged and says GOODBYE, otherwise it closes the connection at
+// once; no_reconnect, a duration such as "10m", keeps the node from
+// redialing the peer for that long, and reason says why.
+func (s *Server) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue("id")
+	query := r.URL.Query()
+	opts := p2p.DisconnectOptions{Reason: query.Get("reason")}
+	if opts.Reason == "" {
+		opts.Reason = "disconnected by operator"
+	}
+	if param := query.Get("drain"); param != "" {
+		drain, err := strconv.ParseBool(param)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("drain must be true or false, not %q", param))
+			return
+		}
+		opts.Drain = drain
+	}
+	for name, value := range map[string]*time.Duration{"timeout": &opts.DrainTimeout, "no_reconnect": &opts.NoReconnect} {
+		param := query.Get(name)
+		if param == "" {
+			continue
+		}
+		d, err := time.ParseDuration(param)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s must be a positive duration, not %q", name, param))
+			return
+		}
+		*value = d
+	}
+
+	err := s.network.DisconnectPeer(peerID, opts)
+	switch {
+	case errors.Is(err, p2p.ErrPeerNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.logger.Infof("disconnected peer %s on request: %s", peerID, opts.Reason)
+		writeJSON(w, http.StatusOK, DisconnectResult{PeerID: peerID, Drained: opts.Drain, NoReconnect: opts.NoReconnect})
+	}
+}
+
+// requestTimeout bounds a request's context by its timeout parameter, a
+// duration such as "2s", answering 400 for one that is not
+func requestTimeout(w http.ResponseWriter, r *http.Request) (context.Context, context.CancelFunc, bool) {
+	param := r.URL.Query().Get("timeout")
+	if param == "" {
+		return r.Context(), func() {}, true
+	}
+	timeout, err := time.ParseDuration(param)
+	if err != nil || timeout <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("timeout must be a positive duration, not %q", param))
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, true
+}
+
+// handleGetPeerMetadata serves a peer's metadata, including what it advertised
+func (s *Server) handleGetPeerMetadata(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue("id")
+	metadata, exists := s.network.PeerMetadata(peerID)
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no metadata for peer %s", peerID))
+		return
+	}
+	writeJSON(w, http.StatusOK, peerMetadata{PeerID: peerID, Metadata: metadata})
+}
+
+// handleSetPeerMetadata replaces the labels we set on a peer with the JSON
+// object in the request body
+func (s *Server) handleSetPeerMetadata(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue("id")
+	var metadata map[string]string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetadataBody)).Decode(&metadata); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid metadata: %v", err))
+		return
+	}
+	if err := s.network.SetPeerMetadata(peerID, metadata); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.logger.Infof("set metadata of peer %s to %v", peerID, metadata)
+
+	metadata, _ = s.network.PeerMetadata(peerID)
+	writeJSON(w, http.StatusOK, peerMetadata{PeerID: peerID, Metadata: metadata})
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
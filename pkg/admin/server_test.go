@@ -0,0 +1,490 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/audit"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startTestServer(t *testing.T, token string) *Server {
+	return startServerWithConfig(t, config.AdminConfig{Enabled: true, ListenAddr: "127.0.0.1:0", AuthToken: token})
+}
+
+// startServerWithConfig starts an admin server with the given config
+func startServerWithConfig(t *testing.T, adminCfg config.AdminConfig) *Server {
+	cfg := config.Default()
+	cfg.Admin = adminCfg
+	return startNodeServer(t, cfg)
+}
+
+// startNodeServer starts the admin server of a node configured by cfg
+func startNodeServer(t *testing.T, cfg *config.Config) *Server {
+	cfg.Storage.DataDir = t.TempDir()
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+
+	network, err := p2p.New(cfg, log, "admin-test-node")
+	require.NoError(t, err)
+	manager, err := storage.NewManager(cfg.Storage.DataDir, 1<<20, 0.9)
+	require.NoError(t, err)
+	network.SetStorage(manager)
+
+	server, err := New(cfg.Admin, log, network)
+	require.NoError(t, err)
+	require.NoError(t, server.Start())
+	t.Cleanup(func() { server.Stop(context.Background()) })
+
+	return server
+}
+
+func get(t *testing.T, url, token string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func put(t *testing.T, url, body string) *http.Response {
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestTopologyEndpoint(t *testing.T) {
+	server := startTestServer(t, "")
+	base := "http://" + server.Addr()
+
+	resp := get(t, base+"/topology", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"local": "admin-test-node"`)
+
+	resp = get(t, base+"/topology?format=dot", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "digraph topology {")
+
+	resp = get(t, base+"/topology?format=svg", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestStorageEndpoint(t *testing.T) {
+	server := startTestServer(t, "")
+
+	resp := get(t, "http://"+server.Addr()+"/storage", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var usage storage.Usage
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&usage))
+	assert.Equal(t, int64(1<<20), usage.QuotaBytes)
+	assert.False(t, usage.HighWater)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := config.Default()
+	cfg.Admin = config.AdminConfig{Enabled: true, ListenAddr: "127.0.0.1:0"}
+	cfg.P2P.ListenPort = 0
+	server := startNodeServer(t, cfg)
+	require.NoError(t, server.network.Start(context.Background()))
+	t.Cleanup(func() { server.network.Stop() })
+	peer := startNetwork(t, "admin-metrics-peer")
+	_, err := server.network.Connect(context.Background(), peer.ListenAddr().String())
+	require.NoError(t, err)
+
+	resp := get(t, "http://"+server.Addr()+"/metrics", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "# TYPE synapse_connection_dial_seconds summary")
+	assert.Contains(t, string(body), "synapse_connection_dial_seconds_count 1\n")
+	assert.Contains(t, string(body), "synapse_connection_handshake_seconds_count 1\n")
+}
+
+func TestBootstrapEndpoint(t *testing.T) {
+	peer := startNetwork(t, "admin-bootstrap-peer")
+	cfg := config.Default()
+	cfg.Admin = config.AdminConfig{Enabled: true, ListenAddr: "127.0.0.1:0"}
+	cfg.P2P.ListenPort = 0
+	cfg.P2P.BootstrapPeers = []string{peer.ListenAddr().String()}
+	server := startNodeServer(t, cfg)
+	bootstrap := func() []discovery.BootstrapHealth {
+		resp := get(t, "http://"+server.Addr()+"/bootstrap", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var health []discovery.BootstrapHealth
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+		return health
+	}
+
+	health := bootstrap()
+	require.Len(t, health, 1)
+	assert.Equal(t, peer.ListenAddr().String(), health[0].Address)
+	assert.Zero(t, health[0].Attempts)
+
+	require.NoError(t, server.network.Start(context.Background()))
+	t.Cleanup(func() { server.network.Stop() })
+	require.Eventually(t, func() bool {
+		return bootstrap()[0].Successes == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	health = bootstrap()
+	assert.Equal(t, "admin-bootstrap-peer", health[0].PeerID)
+	assert.Positive(t, health[0].Latency)
+	assert.False(t, health[0].Sidelined)
+}
+
+func TestDiscoverEndpoint(t *testing.T) {
+	cfg := config.Default()
+	cfg.Admin = config.AdminConfig{Enabled: true, ListenAddr: "127.0.0.1:0"}
+	cfg.P2P.ListenPort = 0
+	server := startNodeServer(t, cfg)
+	discover := func(path string) (int, p2p.DiscoveryResult) {
+		resp, err := http.Post("http://"+server.Addr()+path, "application/json", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var result p2p.DiscoveryResult
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		}
+		return resp.StatusCode, result
+	}
+
+	status, _ := discover("/discover")
+	assert.Equal(t, http.StatusInternalServerError, status)
+
+	require.NoError(t, server.network.Start(context.Background()))
+	t.Cleanup(func() { server.network.Stop() })
+	status, _ = discover("/discover?timeout=soon")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// With no peers and no bootstrap nodes there is nothing to find
+	status, result := discover("/discover?timeout=10s")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, p2p.DiscoveryResult{}, result)
+	assert.Equal(t, 1, server.network.DiscoveryStats().Cycles)
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	cfg := config.Default()
+	cfg.Admin = config.AdminConfig{Enabled: true, ListenAddr: "127.0.0.1:0"}
+	cfg.P2P.ListenPort = 0
+	server := startNodeServer(t, cfg)
+	status := func() p2p.NetworkStatus {
+		resp := get(t, "http://"+server.Addr()+"/status", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var status p2p.NetworkStatus
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		return status
+	}
+
+	stopped := status()
+	assert.Equal(t, "admin-test-node", stopped.NodeID)
+	assert.False(t, stopped.Listening)
+	assert.Zero(t, stopped.Uptime)
+
+	require.NoError(t, server.network.Start(context.Background()))
+	t.Cleanup(func() { server.network.Stop() })
+	peer := startNetwork(t, "admin-status-peer")
+	_, err := peer.Connect(context.Background(), server.network.ListenAddr().String())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return status().ConnectedPeers == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// The uptime is a duration, not a count of seconds
+	time.Sleep(10 * time.Millisecond)
+	running := status()
+	assert.True(t, running.Listening)
+	assert.Equal(t, 1, running.TotalPeers)
+	assert.Equal(t, 1, running.ActiveConnections)
+	assert.Greater(t, running.Uptime, 10*time.Millisecond)
+	assert.Less(t, running.Uptime, time.Minute)
+	require.Len(t, running.Listeners, 1)
+	assert.Equal(t, server.network.ListenAddr().String(), running.Listeners[0].BoundAddress)
+	assert.Equal(t, server.network.ListenAddrs()[0].(*net.TCPAddr).Port, running.ListenPort)
+	assert.True(t, running.Listeners[0].Listening)
+}
+
+func TestFlappingEndpoint(t *testing.T) {
+	cfg := config.Default()
+	cfg.Admin = config.AdminConfig{Enabled: true, ListenAddr: "127.0.0.1:0"}
+	cfg.P2P.ListenPort = 0
+	server := startNodeServer(t, cfg)
+	base := "http://" + server.Addr()
+	flapping := func() []p2p.FlapState {
+		resp := get(t, base+"/peers/flapping", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var states []p2p.FlapState
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&states))
+		return states
+	}
+	assert.Empty(t, flapping())
+
+	require.NoError(t, server.network.Start(context.Background()))
+	t.Cleanup(func() { server.network.Stop() })
+	peer := startNetwork(t, "admin-flappy-peer")
+	_, err := peer.Connect(context.Background(), server.network.ListenAddr().String())
+	require.NoError(t, err)
+
+	var peers []PeerSummary
+	require.Eventually(t, func() bool {
+		resp := get(t, base+"/peers", "")
+		return json.NewDecoder(resp.Body).Decode(&peers) == nil && len(peers) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	require.Len(t, peers[0].Flaps.History, 1)
+	assert.True(t, peers[0].Flaps.History[0].Connected)
+
+	// A peer that went away stays listed while its disconnect is recent
+	require.NoError(t, peer.Stop())
+	require.Eventually(t, func() bool {
+		return len(flapping()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	state := flapping()[0]
+	assert.Equal(t, "admin-flappy-peer", state.PeerID)
+	assert.Equal(t, 1, state.Flaps)
+	assert.False(t, state.Damped, "damping is off by default")
+}
+
+func TestAuditEndpoint(t *testing.T) {
+	base := "http://" + startTestServer(t, "").Addr()
+	assert.Equal(t, http.StatusNotFound, get(t, base+"/audit", "").StatusCode)
+
+	cfg := config.Default()
+	cfg.Admin = config.AdminConfig{Enabled: true, ListenAddr: "127.0.0.1:0"}
+	cfg.Audit.Enabled = true
+	server := startNodeServer(t, cfg)
+	base = "http://" + server.Addr()
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	log := server.network.AuditLog()
+	require.NoError(t, log.Record(audit.Entry{Time: start, Event: audit.EventHandshakeSucceeded, PeerID: "peer-a"}))
+	require.NoError(t, log.Record(audit.Entry{Time: start.Add(time.Minute), Event: audit.EventPeerDisconnected, PeerID: "peer-a"}))
+
+	var entries []audit.Entry
+	resp := get(t, base+"/audit", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, audit.EventHandshakeSucceeded, entries[0].Event)
+
+	resp = get(t, base+"/audit?since="+start.Add(time.Second).Format(time.RFC3339), "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, audit.EventPeerDisconnected, entries[0].Event)
+
+	assert.Equal(t, http.StatusBadRequest, get(t, base+"/audit?since=yesterday", "").StatusCode)
+}
+
+func TestAuthToken(t *testing.T) {
+	server := startTestServer(t, "secret")
+	base := "http://" + server.Addr()
+
+	assert.Equal(t, http.StatusUnauthorized, get(t, base+"/topology", "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, get(t, base+"/topology", "wrong").StatusCode)
+	assert.Equal(t, http.StatusOK, get(t, base+"/topology", "secret").StatusCode)
+}
+
+func TestChangesFromAfarNeedToken(t *testing.T) {
+	server := &Server{}
+	handler := server.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(method, remoteAddr string) int {
+		req := httptest.NewRequest(method, "/key/rotate", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without a token, other machines may read but not change anything
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodGet, "192.0.2.1:4000"))
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, "192.0.2.1:4000"))
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPut, "[2001:db8::1]:4000"))
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodPost, "127.0.0.1:4000"))
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodPost, "[::1]:4000"))
+}
+
+func TestPeerMetadataEndpoint(t *testing.T) {
+	server := startTestServer(t, "")
+	url := "http://" + server.Addr() + "/peers/peer-a/metadata"
+
+	assert.Equal(t, http.StatusNotFound, get(t, url, "").StatusCode)
+
+	resp := put(t, url, `{"datacenter": "a", "edge": ""}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = get(t, url, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body peerMetadata
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "peer-a", body.PeerID)
+	assert.Equal(t, map[string]string{"datacenter": "a", "edge": ""}, body.Metadata)
+
+	assert.Equal(t, http.StatusBadRequest, put(t, url, `["edge"]`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, put(t, url, `{"a=b": ""}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, put(t, url, `{"k": "`+strings.Repeat("v", topology.MaxMetadataValueLength+1)+`"}`).StatusCode)
+}
+
+func TestRotateKeyEndpoint(t *testing.T) {
+	server := startTestServer(t, "")
+	rotate := func() KeyRotationSummary {
+		resp, err := http.Post("http://"+server.Addr()+"/key/rotate", "application/json", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rotation KeyRotationSummary
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rotation))
+		return rotation
+	}
+
+	first := rotate()
+	assert.NotEmpty(t, first.OldFingerprint)
+	assert.NotEqual(t, first.OldFingerprint, first.NewFingerprint)
+	assert.WithinDuration(t, time.Now(), first.RotatedAt, time.Minute)
+
+	// Each rotation replaces the key the last one introduced
+	second := rotate()
+	assert.Equal(t, first.NewFingerprint, second.OldFingerprint)
+}
+
+func TestPingEndpoint(t *testing.T) {
+	server := startTestServer(t, "")
+	ping := func(path string) int {
+		resp, err := http.Post("http://"+server.Addr()+path, "application/json", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNotFound, ping("/peers/peer-a/ping"))
+	assert.Equal(t, http.StatusBadRequest, ping("/peers/peer-a/ping?timeout=soon"))
+	assert.Equal(t, http.StatusBadRequest, ping("/peers/peer-a/ping?timeout=-1s"))
+
+	// A failed ping still names the trace to look for in the logs, which
+	// the caller may choose
+	req, err := http.NewRequest(http.MethodPost, "http://"+server.Addr()+"/peers/peer-a/ping", nil)
+	require.NoError(t, err)
+	req.Header.Set(TraceIDHeader, "op-1234")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "op-1234", resp.Header.Get(TraceIDHeader))
+}
+
+func TestTraceEndpoint(t *testing.T) {
+	server := startTestServer(t, "")
+	trace := func(path string) int {
+		resp, err := http.Post("http://"+server.Addr()+path, "application/json", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNotFound, trace("/peers/peer-a/trace"))
+	assert.Equal(t, http.StatusBadRequest, trace("/peers/peer-a/trace?timeout=soon"))
+}
+
+func TestDisconnectEndpoint(t *testing.T) {
+	server := startTestServer(t, "")
+	disconnect := func(path string) int {
+		resp, err := http.Post("http://"+server.Addr()+path, "application/json", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNotFound, disconnect("/peers/peer-a/disconnect"))
+	assert.Equal(t, http.StatusNotFound, disconnect("/peers/peer-a/disconnect?drain=true&timeout=1s&no_reconnect=10m"))
+	assert.Equal(t, http.StatusBadRequest, disconnect("/peers/peer-a/disconnect?drain=maybe"))
+	assert.Equal(t, http.StatusBadRequest, disconnect("/peers/peer-a/disconnect?no_reconnect=forever"))
+	assert.Equal(t, http.StatusBadRequest, disconnect("/peers/peer-a/disconnect?timeout=-1s"))
+}
+
+func TestPeerListEndpoints(t *testing.T) {
+	ctx := context.Background()
+	exporter := startNetwork(t, "exporting-node")
+	remote := startNetwork(t, "exported-peer")
+	_, err := exporter.Connect(ctx, remote.ListenAddr().String())
+	require.NoError(t, err)
+
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+	server, err := New(config.AdminConfig{}, log, exporter)
+	require.NoError(t, err)
+	endpoint := UnixEndpoint(filepath.Join(t.TempDir(), "synapse.sock"))
+	require.NoError(t, server.StartControl(endpoint))
+	defer server.Stop(ctx)
+	client := NewClient(endpoint)
+
+	// The peer's signed record arrives in its peer list after the handshake
+	var list *p2p.PeerList
+	require.Eventually(t, func() bool {
+		list, err = client.ExportPeers(ctx)
+		return err == nil && len(list.Peers) == 1 && list.Peers[0].Record != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "exporting-node", list.ExportedBy)
+	assert.Equal(t, "exported-peer", list.Peers[0].NodeID)
+	assert.NotEmpty(t, list.Peers[0].Addresses)
+	assert.NotEmpty(t, list.Peers[0].KeyFingerprint)
+
+	// Another node imports the list
+	importer := startTestServer(t, "")
+	importURL := "http://" + importer.Addr() + "/peers/import"
+	data, err := json.MarshalIndent(list, "", "  ")
+	require.NoError(t, err)
+	resp, err := http.Post(importURL, "application/json", bytes.NewReader(data))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result p2p.PeerImportResult
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, p2p.PeerImportResult{Added: 1}, result)
+
+	// and refuses one that is malformed, saying where
+	resp, err = http.Post(importURL, "application/json", strings.NewReader("{\"version\": 1,\n \"peers\": [{\"node_id\": \"\"}]}"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&apiErr))
+	assert.Contains(t, apiErr.Error, "line 2, column 12: peer 1: node_id is required")
+
+	// The exporting node already knows every peer it listed
+	imported, err := client.ImportPeers(ctx, list)
+	require.NoError(t, err)
+	assert.Equal(t, 1, imported.Unchanged)
+}
@@ -0,0 +1,294 @@
+package ai
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+)
+
+const (
+	// CacheBucket is the bucket of the node's state that holds the saved
+	// cache
+	CacheBucket = "ai_cache"
+
+	// CacheDir is the directory under the data directory that releases
+	// before the state storage saved the cache in. MigrateCache moves it
+	// into CacheBucket.
+	CacheDir = "ai-cache"
+
+	// cacheSnapshot is the key, and the legacy file, of the saved answers
+	cacheSnapshot = "cache.json"
+)
+
+// CacheStats describes the cache for the network report
+type CacheStats struct {
+	Entries   int     `json:"entries"`
+	Bytes     int64   `json:"bytes"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Bypassed  uint64  `json:"bypassed"`
+	Evictions uint64  `json:"evictions"`
+	Expired   uint64  `json:"expired"`
+	HitRate   float64 `json:"hit_rate"`
+}
+
+// cacheEntry is one cached answer
+type cacheEntry struct {
+	Key      string    `json:"key"`
+	Response Response  `json:"response"`
+	Expires  time.Time `json:"expires"`
+
+	size int64
+}
+
+// Cache keeps the answers to recent requests for a while, so identical
+// requests from different parts of the node, or from peers, are answered
+// without asking the endpoint again. It holds at most maxEntries answers of
+// maxBytes in all, evicting the least recently used first, and forgets each
+// after its TTL. A cache opened with state storage can be saved there and
+// starts warm after a restart.
+type Cache struct {
+	kv         kvstorage.KV
+	maxEntries int
+	maxBytes   int64
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the entries most recently used first
+	order *list.List
+	bytes int64
+
+	hits      uint64
+	misses    uint64
+	bypassed  uint64
+	evictions uint64
+	expired   uint64
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewCache creates a cache of answers. With state storage, the answers saved
+// by the last run that have not expired are loaded.
+func NewCache(kv kvstorage.KV, maxEntries int, maxBytes int64, ttl time.Duration) (*Cache, error) {
+	if maxEntries < 1 || maxBytes < 1 || ttl <= 0 {
+		return nil, fmt.Errorf("AI cache limits must be positive")
+	}
+
+	c := &Cache{
+		kv:         kv,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+	if kv != nil {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// cacheKey hashes what an answer depends on: the endpoint asked and the
+// conversation, with surrounding whitespace and the case of roles ignored
+func cacheKey(endpoint string, req Request) string {
+	normalized := struct {
+		Endpoint string    `json:"endpoint"`
+		Message  string    `json:"message"`
+		History  []Message `json:"history,omitempty"`
+	}{Endpoint: endpoint, Message: strings.TrimSpace(req.Message)}
+	for _, turn := range req.History {
+		normalized.History = append(normalized.History, Message{
+			Role:    strings.ToLower(strings.TrimSpace(turn.Role)),
+			Content: strings.TrimSpace(turn.Content),
+		})
+	}
+
+	data, _ := json.Marshal(normalized)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the answer cached under key, if it has not expired
+func (c *Cache) Get(key string) (*Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !c.now().Before(entry.Expires) {
+		c.removeLocked(element)
+		c.expired++
+		c.misses++
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	c.hits++
+	resp := entry.Response
+	return &resp, true
+}
+
+// Bypass counts a request that skipped the cache
+func (c *Cache) Bypass() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bypassed++
+}
+
+// Put caches an answer under key, replacing any there, and evicts the least
+// recently used answers past the limits. An answer larger than the whole
+// cache is not kept.
+func (c *Cache) Put(key string, resp *Response) {
+	entry := &cacheEntry{Key: key, Response: *resp, Expires: c.now().Add(c.ttl)}
+	entry.Response.Latency = 0
+	entry.Response.Cached = false
+	entry.size = entry.sizeOf()
+	if entry.size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(entry)
+}
+
+// addLocked inserts an entry as the most recently used and enforces the
+// limits
+func (c *Cache) addLocked(entry *cacheEntry) {
+	if element, ok := c.entries[entry.Key]; ok {
+		c.removeLocked(element)
+	}
+	c.entries[entry.Key] = c.order.PushFront(entry)
+	c.bytes += entry.size
+
+	for c.order.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.removeLocked(c.order.Back())
+		c.evictions++
+	}
+}
+
+// removeLocked drops an entry
+func (c *Cache) removeLocked(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.Key)
+	c.bytes -= entry.size
+}
+
+// sizeOf approximates the memory an entry takes by the length of its strings
+func (e *cacheEntry) sizeOf() int64 {
+	return int64(len(e.Key) + len(e.Response.Text) + len(e.Response.Model))
+}
+
+// Len returns the number of cached answers, expired ones included until
+// they are next looked up or saved
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Stats returns the cache's size and counters
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := CacheStats{
+		Entries:   c.order.Len(),
+		Bytes:     c.bytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Bypassed:  c.bypassed,
+		Evictions: c.evictions,
+		Expired:   c.expired,
+	}
+	if lookups := c.hits + c.misses; lookups > 0 {
+		stats.HitRate = float64(c.hits) / float64(lookups)
+	}
+	return stats
+}
+
+// Save writes the answers that have not expired to state storage, most
+// recently used first. A cache without state storage has nothing to save.
+func (c *Cache) Save() error {
+	if c.kv == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	now := c.now()
+	entries := make([]*cacheEntry, 0, c.order.Len())
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		if entry := element.Value.(*cacheEntry); now.Before(entry.Expires) {
+			entries = append(entries, entry)
+		}
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal AI cache: %w", err)
+	}
+	if err := c.kv.Put(CacheBucket, cacheSnapshot, data); err != nil {
+		return fmt.Errorf("failed to write AI cache: %w", err)
+	}
+	return nil
+}
+
+// load reads the answers saved by the last run, skipping expired ones. A
+// snapshot that cannot be decoded is ignored: the cache only starts cold.
+func (c *Cache) load() error {
+	data, err := c.kv.Get(CacheBucket, cacheSnapshot)
+	if errors.Is(err, kvstorage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read AI cache: %w", err)
+	}
+
+	var entries []*cacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Saved most recently used first, so added in reverse
+	now := c.now()
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry == nil || entry.Key == "" || !now.Before(entry.Expires) {
+			continue
+		}
+		entry.size = entry.sizeOf()
+		c.addLocked(entry)
+	}
+	return nil
+}
+
+// MigrateCache moves the cache saved under dataDir by an earlier release
+// into kv
+func MigrateCache(kv kvstorage.KV, dataDir string) error {
+	path := filepath.Join(dataDir, CacheDir, cacheSnapshot)
+	return kvstorage.Migrate(kv, CacheBucket, path, func(data []byte) (map[string][]byte, error) {
+		return map[string][]byte{cacheSnapshot: data}, nil
+	})
+}
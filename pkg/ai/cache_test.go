@@ -0,0 +1,184 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingEndpoint answers every request with its number
+func countingEndpoint(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"response":"answer %d"}`, n)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+// fakeClock is a settable time source for the cache
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestCache(t *testing.T, kv kvstorage.KV, maxEntries int, maxBytes int64, clock *fakeClock) *Cache {
+	cache, err := NewCache(kv, maxEntries, maxBytes, time.Minute)
+	require.NoError(t, err)
+	cache.now = clock.Now
+	return cache
+}
+
+func TestCacheHitsSkipTheEndpoint(t *testing.T) {
+	upstream, calls := countingEndpoint(t)
+	clock := &fakeClock{now: time.Now()}
+	client := newTestClient(t, upstream.URL, 0)
+	client.SetCache(newTestCache(t, nil, 10, 1<<16, clock))
+	ctx := context.Background()
+
+	first, err := client.Query(ctx, Request{Message: "hello", History: []Message{{Role: "user", Content: "hi"}}})
+	require.NoError(t, err)
+	assert.False(t, first.Cached)
+
+	// The same conversation, up to whitespace and the case of roles
+	again, err := client.Query(ctx, Request{Message: " hello\n", History: []Message{{Role: "User", Content: "hi "}}})
+	require.NoError(t, err)
+	assert.True(t, again.Cached)
+	assert.Equal(t, first.Text, again.Text)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Streamed requests are answered from the cache in one chunk
+	recorder := &chunkRecorder{}
+	streamed, err := client.QueryStream(ctx, Request{Message: "hello", History: []Message{{Role: "user", Content: "hi"}}}, recorder.record)
+	require.NoError(t, err)
+	assert.True(t, streamed.Cached)
+	assert.Equal(t, []string{first.Text}, recorder.chunks)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Another conversation, or a bypass, asks the endpoint
+	_, err = client.Query(ctx, Request{Message: "hello"})
+	require.NoError(t, err)
+	bypassed, err := client.Query(ctx, Request{Message: "hello", History: []Message{{Role: "user", Content: "hi"}}, NoCache: true})
+	require.NoError(t, err)
+	assert.False(t, bypassed.Cached)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// The bypass refreshed the cached answer
+	refreshed, err := client.Query(ctx, Request{Message: "hello", History: []Message{{Role: "user", Content: "hi"}}})
+	require.NoError(t, err)
+	assert.Equal(t, bypassed.Text, refreshed.Text)
+
+	stats := client.Cache().Stats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Bypassed)
+	assert.Equal(t, 2, stats.Entries)
+	assert.InDelta(t, 0.6, stats.HitRate, 0.001)
+}
+
+func TestCacheExpiryForcesRefresh(t *testing.T) {
+	upstream, calls := countingEndpoint(t)
+	clock := &fakeClock{now: time.Now()}
+	client := newTestClient(t, upstream.URL, 0)
+	client.SetCache(newTestCache(t, nil, 10, 1<<16, clock))
+	ctx := context.Background()
+
+	first, err := client.Query(ctx, Request{Message: "hello"})
+	require.NoError(t, err)
+	clock.now = clock.now.Add(59 * time.Second)
+	cached, err := client.Query(ctx, Request{Message: "hello"})
+	require.NoError(t, err)
+	assert.True(t, cached.Cached)
+
+	clock.now = clock.now.Add(time.Second)
+	refreshed, err := client.Query(ctx, Request{Message: "hello"})
+	require.NoError(t, err)
+	assert.False(t, refreshed.Cached)
+	assert.NotEqual(t, first.Text, refreshed.Text)
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, uint64(1), client.Cache().Stats().Expired)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	cache := newTestCache(t, nil, 2, 1<<16, clock)
+	cache.Put("a", &Response{Text: "A"})
+	cache.Put("b", &Response{Text: "B"})
+	_, ok := cache.Get("a")
+	require.True(t, ok)
+
+	cache.Put("c", &Response{Text: "C"})
+	_, ok = cache.Get("b")
+	assert.False(t, ok, "b was used least recently")
+	_, ok = cache.Get("a")
+	assert.True(t, ok)
+
+	// The byte limit evicts as well, and an answer too large is not kept
+	small := newTestCache(t, nil, 10, 6, clock)
+	small.Put("a", &Response{Text: "aaa"})
+	small.Put("b", &Response{Text: "bbb"})
+	assert.Equal(t, 1, small.Len())
+	small.Put("c", &Response{Text: "far too large"})
+	_, ok = small.Get("c")
+	assert.False(t, ok)
+	assert.Equal(t, uint64(2), cache.Stats().Evictions+small.Stats().Evictions)
+}
+
+func TestCachePersists(t *testing.T) {
+	dataDir := t.TempDir()
+	store, err := storage.NewManager(dataDir, 1<<20, 0.9)
+	require.NoError(t, err)
+	kv, err := kvstorage.Open(kvstorage.BackendBolt, dataDir, store)
+	require.NoError(t, err)
+	defer kv.Close()
+	clock := &fakeClock{now: time.Now()}
+
+	cache := newTestCache(t, kv, 10, 1<<16, clock)
+	cache.Put("old", &Response{Text: "expires"})
+	clock.now = clock.now.Add(30 * time.Second)
+	cache.Put("new", &Response{Text: "kept", Model: "m"})
+	require.NoError(t, cache.Save())
+
+	clock.now = clock.now.Add(31 * time.Second)
+	restarted := newTestCache(t, nil, 10, 1<<16, clock)
+	restarted.kv = kv
+	require.NoError(t, restarted.load())
+
+	assert.Equal(t, 1, restarted.Len())
+	resp, ok := restarted.Get("new")
+	require.True(t, ok)
+	assert.Equal(t, "kept", resp.Text)
+	assert.Equal(t, "m", resp.Model)
+	assert.Greater(t, store.Usage().UsedBytes, int64(0))
+
+	// Without state storage nothing is saved
+	assert.NoError(t, newTestCache(t, nil, 10, 1<<16, clock).Save())
+
+	// A cache saved by an earlier release is migrated
+	legacy := filepath.Join(dataDir, CacheDir, cacheSnapshot)
+	require.NoError(t, os.MkdirAll(filepath.Dir(legacy), 0755))
+	expires := clock.now.Add(time.Minute).UTC().Format(time.RFC3339Nano)
+	require.NoError(t, os.WriteFile(legacy, []byte(fmt.Sprintf(`[{"key":"legacy","response":{"response":"from a file"},"expires":%q}]`, expires)), 0600))
+	migrated := kvstorage.NewMemory()
+	require.NoError(t, MigrateCache(migrated, dataDir))
+	restarted = newTestCache(t, nil, 10, 1<<16, clock)
+	restarted.kv = migrated
+	require.NoError(t, restarted.load())
+	resp, ok = restarted.Get("legacy")
+	require.True(t, ok)
+	assert.Equal(t, "from a file", resp.Text)
+}
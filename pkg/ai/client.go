@@ -0,0 +1,463 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+)
+
+const (
+	// DefaultBackoff is the delay before the first retry; it doubles each time
+	DefaultBackoff = 500 * time.Millisecond
+
+	// maxBackoff caps the delay between retries
+	maxBackoff = 30 * time.Second
+
+	// maxResponseSize bounds how much of a response body is read
+	maxResponseSize = 4 * 1024 * 1024
+
+	// redacted stands in for secrets in errors and logs
+	redacted = "[REDACTED]"
+)
+
+// ErrEmptyResponse is returned when the endpoint answers without any text
+var ErrEmptyResponse = errors.New("AI endpoint returned an empty response")
+
+// ErrMalformedResponse is returned when a JSON response cannot be decoded
+var ErrMalformedResponse = errors.New("malformed AI response")
+
+// Message is one turn of a conversation
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Request is a chat request sent to the AI endpoint. Stream asks for the
+// answer to be sent as it is generated; QueryStream sets it. NoCache asks
+// the endpoint even if the answer is cached, and is not sent to it.
+type Request struct {
+	Message string    `json:"message"`
+	History []Message `json:"history,omitempty"`
+	Stream  bool      `json:"stream,omitempty"`
+	NoCache bool      `json:"no_cache,omitempty"`
+}
+
+// Response is the endpoint's answer to a Request. Cached is set on an
+// answer that came from the cache rather than the endpoint.
+type Response struct {
+	Text    string        `json:"response"`
+	Model   string        `json:"model,omitempty"`
+	Latency time.Duration `json:"latency"`
+	Cached  bool          `json:"cached,omitempty"`
+}
+
+// APIError is returned when the endpoint answers with a non-2xx status
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("AI endpoint returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("AI endpoint returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Temporary reports whether retrying the request may succeed
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Metrics receives the latency and outcome of every request
+type Metrics interface {
+	Observe(latency time.Duration, err error)
+}
+
+// Client sends chat requests to the configured AI endpoint, retrying
+// transient failures with exponential backoff. Requests carry the configured
+// headers and API key; the key, and the password of the proxy, never appear
+// in its errors or logs.
+type Client struct {
+	endpoint   string
+	httpClient *http.Client
+	headers    http.Header
+	secrets    []string
+	maxRetries int
+	backoff    time.Duration
+	metrics    Metrics
+	queue      *Queue
+	cache      *Cache
+	delegate   Delegate
+	logger     *logger.Logger
+
+	// streamClient has no overall timeout; streams time out when idle
+	streamClient *http.Client
+
+	// unreachable is set while the endpoint's last answer was a transient failure
+	unreachable atomic.Bool
+}
+
+// NewClient creates a client for the endpoint in cfg
+func NewClient(cfg config.AIConfig) (*Client, error) {
+	return NewClientWithTransport(cfg, nil)
+}
+
+// NewClientWithTransport creates a client that sends requests through
+// transport; nil uses http.DefaultTransport, or a copy of it using the
+// configured proxy. The API key file is read here, once.
+func NewClientWithTransport(cfg config.AIConfig, transport http.RoundTripper) (*Client, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("AI endpoint cannot be empty")
+	}
+
+	headers, secrets, err := requestHeaders(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+		if cfg.ProxyURL != "" {
+			proxy, err := url.Parse(cfg.ProxyURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid AI proxy URL: %w", err)
+			}
+			if password, ok := proxy.User.Password(); ok && password != "" {
+				secrets = append(secrets, password)
+			}
+			proxied := http.DefaultTransport.(*http.Transport).Clone()
+			proxied.Proxy = http.ProxyURL(proxy)
+			transport = proxied
+		}
+	}
+
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &Client{
+		endpoint: cfg.Endpoint,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+		streamClient: &http.Client{
+			Transport: transport,
+		},
+		headers:    headers,
+		secrets:    secrets,
+		maxRetries: cfg.MaxRetries,
+		backoff:    DefaultBackoff,
+	}, nil
+}
+
+// requestHeaders builds the headers sent with every request, the API key
+// as a bearer token last, and lists the secrets among them
+func requestHeaders(cfg config.AIConfig) (http.Header, []string, error) {
+	headers := make(http.Header, len(cfg.Headers)+1)
+	for name, value := range cfg.Headers {
+		headers.Set(name, value)
+	}
+	if cfg.APIKeyFile == "" {
+		return headers, nil, nil
+	}
+
+	data, err := os.ReadFile(cfg.APIKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read AI API key: %w", err)
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return nil, nil, fmt.Errorf("AI API key file %s is empty", cfg.APIKeyFile)
+	}
+	headers.Set("Authorization", "Bearer "+key)
+	return headers, []string{key}, nil
+}
+
+// SetLogger logs failed attempts, and why they failed, at debug level
+func (c *Client) SetLogger(log *logger.Logger) {
+	c.logger = log.With("component", "ai_client")
+}
+
+// SetCache answers repeated requests from cache
+func (c *Client) SetCache(cache *Cache) {
+	c.cache = cache
+}
+
+// Cache returns the answer cache, or nil if it is disabled
+func (c *Client) Cache() *Cache {
+	return c.cache
+}
+
+// SetMetrics reports every request's latency and outcome to m
+func (c *Client) SetMetrics(m Metrics) {
+	c.metrics = m
+}
+
+// Healthy reports whether the endpoint answered the most recent request, or
+// no request has failed yet
+func (c *Client) Healthy() bool {
+	return !c.unreachable.Load()
+}
+
+// Timeout returns the per-attempt timeout
+func (c *Client) Timeout() time.Duration {
+	return c.httpClient.Timeout
+}
+
+// MaxDuration bounds how long Query can take when every attempt times out
+// and the full backoff is spent between them
+func (c *Client) MaxDuration() time.Duration {
+	return maxQueryDuration(c.Timeout(), c.maxRetries, c.backoff)
+}
+
+// maxQueryDuration is the worst case of a query with the given per-attempt
+// timeout, retries and initial backoff
+func maxQueryDuration(timeout time.Duration, retries int, backoff time.Duration) time.Duration {
+	total := timeout * time.Duration(retries+1)
+	for i := 0; i < retries; i++ {
+		total += backoff
+		backoff = min(backoff*2, maxBackoff)
+	}
+	return total
+}
+
+// Query sends a request, retrying transient failures up to MaxRetries times
+func (c *Client) Query(ctx context.Context, req Request) (*Response, error) {
+	req.Stream = false
+	return c.query(ctx, req, nil)
+}
+
+// query sends a request, streaming the answer to onChunk unless it is nil.
+// A stream that failed after passing on a chunk is not retried. Cached
+// answers are returned, or streamed in one chunk, without asking the
+// endpoint, which refreshes the cache otherwise.
+func (c *Client) query(ctx context.Context, req Request, onChunk ChunkFunc) (*Response, error) {
+	if strings.TrimSpace(req.Message) == "" {
+		return nil, fmt.Errorf("message cannot be empty")
+	}
+
+	var key string
+	if c.cache != nil {
+		key = cacheKey(c.endpoint, req)
+		if req.NoCache {
+			c.cache.Bypass()
+		} else if resp, ok := c.cache.Get(key); ok {
+			resp.Cached = true
+			if onChunk != nil {
+				if err := onChunk(resp.Text); err != nil {
+					return nil, err
+				}
+			}
+			return resp, nil
+		}
+	}
+	req.NoCache = false
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal AI request: %w", err)
+	}
+
+	delay := c.backoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		var streamed *chunkTracker
+		if onChunk != nil {
+			streamed = &chunkTracker{onChunk: onChunk}
+		}
+		resp, err := c.send(ctx, body, streamed)
+		latency := time.Since(start)
+		if c.metrics != nil {
+			c.metrics.Observe(latency, err)
+		}
+
+		if err == nil {
+			c.unreachable.Store(false)
+			resp.Latency = latency
+			if c.cache != nil {
+				c.cache.Put(key, resp)
+			}
+			return resp, nil
+		}
+		if retryable(ctx, err) {
+			c.unreachable.Store(true)
+		}
+		if attempt >= c.maxRetries || !retryable(ctx, err) || streamed.passedOn() {
+			if attempt > 0 {
+				return nil, fmt.Errorf("AI request failed after %d attempts: %w", attempt+1, err)
+			}
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("AI request cancelled while retrying: %w", ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+// send performs a single attempt, streaming the answer to chunks unless it
+// is nil
+func (c *Client) send(ctx context.Context, body []byte, chunks *chunkTracker) (*Response, error) {
+	client, accept := c.httpClient, "application/json"
+	if chunks != nil {
+		// A stream may take longer than Timeout as long as it keeps going
+		client, accept = c.streamClient, streamAccept
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		idle := time.AfterFunc(c.Timeout(), func() { cancel(ErrStreamStalled) })
+		defer idle.Stop()
+		chunks.touch = func() { idle.Reset(c.Timeout()) }
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build AI request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", accept)
+	for name, values := range c.headers {
+		httpReq.Header[name] = values
+	}
+
+	resp, err := c.roundTrip(client, httpReq, chunks)
+	if err != nil && errors.Is(context.Cause(ctx), ErrStreamStalled) {
+		err = fmt.Errorf("%w for %s: %w", ErrStreamStalled, c.Timeout(), err)
+	}
+	if err != nil && c.logger != nil {
+		c.logger.Debugf("AI request to %s with headers %s failed: %v", httpReq.URL.Redacted(), c.headerNames(), err)
+	}
+	return resp, err
+}
+
+// roundTrip sends a built request and reads its response, keeping secrets
+// out of the error
+func (c *Client) roundTrip(client *http.Client, httpReq *http.Request, chunks *chunkTracker) (*Response, error) {
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, c.redactError(fmt.Errorf("AI request failed: %w", err))
+	}
+	defer httpResp.Body.Close()
+
+	if chunks != nil && httpResp.StatusCode >= 200 && httpResp.StatusCode <= 299 {
+		resp, err := readStream(httpResp, chunks)
+		if err != nil {
+			return nil, c.redactError(err)
+		}
+		return resp, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AI response: %w", err)
+	}
+
+	if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
+		return nil, &APIError{StatusCode: httpResp.StatusCode, Body: c.redact(strings.TrimSpace(string(data)))}
+	}
+
+	resp, err := parseResponse(httpResp.Header.Get("Content-Type"), data)
+	if err != nil {
+		return nil, c.redactError(err)
+	}
+	return resp, nil
+}
+
+// headerNames lists the names of the configured headers; their values may
+// be secret
+func (c *Client) headerNames() string {
+	names := make([]string, 0, len(c.headers))
+	for name := range c.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "[" + strings.Join(names, ", ") + "]"
+}
+
+// redact replaces each secret in s
+func (c *Client) redact(s string) string {
+	for _, secret := range c.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+// redactError keeps err unless its message gives a secret away
+func (c *Client) redactError(err error) error {
+	message := err.Error()
+	if clean := c.redact(message); clean != message {
+		return &redactedError{message: clean, err: err}
+	}
+	return err
+}
+
+// redactedError is an error whose message had secrets replaced; errors.Is
+// and errors.As still see the original
+type redactedError struct {
+	message string
+	err     error
+}
+
+// Error implements the error interface
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+// Unwrap returns the original error
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// parseResponse accepts a JSON {"response": ...} body or plain text
+func parseResponse(contentType string, data []byte) (*Response, error) {
+	var resp Response
+	if strings.HasPrefix(contentType, "application/json") {
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+		}
+	} else {
+		resp.Text = string(data)
+	}
+
+	if strings.TrimSpace(resp.Text) == "" {
+		return nil, ErrEmptyResponse
+	}
+	return &resp, nil
+}
+
+// retryable reports whether a failed attempt is worth repeating: network
+// errors and 429/5xx responses are; cancellation, client errors and
+// unusable bodies are not
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return !errors.Is(err, ErrEmptyResponse) && !errors.Is(err, ErrMalformedResponse)
+}
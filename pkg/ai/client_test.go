@@ -0,0 +1,234 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingMetrics struct {
+	observed []error
+}
+
+func (m *recordingMetrics) Observe(latency time.Duration, err error) {
+	m.observed = append(m.observed, err)
+}
+
+func newTestClient(t *testing.T, endpoint string, maxRetries int) *Client {
+	client, err := NewClient(config.AIConfig{Endpoint: endpoint, Timeout: 5, MaxRetries: maxRetries})
+	require.NoError(t, err)
+	client.backoff = time.Millisecond
+	return client
+}
+
+func TestQueryRetriesTransientFailures(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "hello", req.Message)
+
+		if calls.Add(1) < 3 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response":"hi there","model":"test"}`))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, 3)
+	metrics := &recordingMetrics{}
+	client.SetMetrics(metrics)
+
+	resp, err := client.Query(context.Background(), Request{Message: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "hi there", resp.Text)
+	assert.Equal(t, "test", resp.Model)
+	assert.Equal(t, int32(3), calls.Load())
+
+	require.Len(t, metrics.observed, 3)
+	assert.Error(t, metrics.observed[0])
+	assert.NoError(t, metrics.observed[2])
+}
+
+func TestQueryReturnsTypedErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "bad prompt", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	_, err := newTestClient(t, server.URL, 3).Query(context.Background(), Request{Message: "hello"})
+
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, "bad prompt", apiErr.Body)
+	assert.False(t, apiErr.Temporary())
+	assert.Equal(t, int32(1), calls.Load(), "client errors must not be retried")
+}
+
+func TestQueryGivesUpAfterMaxRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, err := newTestClient(t, server.URL, 2).Query(context.Background(), Request{Message: "hello"})
+
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.True(t, apiErr.Temporary())
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestQueryUsesTransport(t *testing.T) {
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("plain answer")),
+		}, nil
+	})
+
+	client, err := NewClientWithTransport(config.AIConfig{Endpoint: "http://ai.invalid/chat", Timeout: 1}, transport)
+	require.NoError(t, err)
+
+	resp, err := client.Query(context.Background(), Request{Message: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "plain answer", resp.Text)
+}
+
+func TestQueryStopsOnCancel(t *testing.T) {
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	client, err := NewClientWithTransport(config.AIConfig{Endpoint: "http://ai.invalid/chat", Timeout: 1, MaxRetries: 10}, transport)
+	require.NoError(t, err)
+	client.backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = client.Query(ctx, Request{Message: "hello"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestQueryHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response":"pong"}`))
+	}))
+	defer upstream.Close()
+
+	handler := QueryHandler(newTestClient(t, upstream.URL, 0))
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/ai/query", strings.NewReader(`{"message":"ping"}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp Response
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "pong", resp.Text)
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/ai/query", strings.NewReader(`{"message":""}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestQuerySendsConfiguredHeaders(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "ai.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("sk-test-secret\n"), 0o600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer sk-test-secret", r.Header.Get("Authorization"))
+		assert.Equal(t, "acme", r.Header.Get("X-Org"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		// An endpoint that echoes the key it refuses
+		http.Error(w, "invalid key "+r.Header.Get("Authorization"), http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(config.AIConfig{
+		Endpoint:   server.URL,
+		Timeout:    5,
+		APIKeyFile: keyFile,
+		Headers:    map[string]string{"X-Org": "acme"},
+	})
+	require.NoError(t, err)
+	var logs strings.Builder
+	client.SetLogger(logger.NewWithWriter("debug", "json", &logs))
+
+	_, err = client.Query(context.Background(), Request{Message: "hello"})
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	assert.NotContains(t, err.Error(), "sk-test-secret")
+	assert.Contains(t, err.Error(), "[REDACTED]")
+
+	assert.Contains(t, logs.String(), "Authorization")
+	assert.Contains(t, logs.String(), "X-Org")
+	assert.NotContains(t, logs.String(), "sk-test-secret")
+	assert.NotContains(t, logs.String(), "acme")
+}
+
+func TestQueryThroughProxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		assert.Equal(t, "ai.example", r.URL.Host)
+		assert.NotEmpty(t, r.Header.Get("Proxy-Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response":"via proxy"}`))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	proxyURL.User = url.UserPassword("synapse", "proxy-secret")
+	client, err := NewClient(config.AIConfig{Endpoint: "http://ai.example/chat", Timeout: 5, ProxyURL: proxyURL.String()})
+	require.NoError(t, err)
+
+	resp, err := client.Query(context.Background(), Request{Message: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "via proxy", resp.Text)
+	assert.Equal(t, int32(1), proxied.Load())
+}
+
+func TestNewClientRejectsEmptyKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "ai.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("\n"), 0o600))
+	_, err := NewClient(config.AIConfig{Endpoint: "http://ai.example/chat", APIKeyFile: keyFile})
+	assert.Error(t, err)
+
+	_, err = NewClient(config.AIConfig{Endpoint: "http://ai.example/chat", APIKeyFile: keyFile + ".missing"})
+	assert.Error(t, err)
+}
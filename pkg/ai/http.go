@@ -0,0 +1,115 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxQuerySize bounds the body accepted by QueryHandler
+const maxQuerySize = 1024 * 1024
+
+// QueryHandler serves POST requests carrying a Request as JSON and answers
+// with the endpoint's Response. A request queued while the endpoint is
+// unreachable is acknowledged with 202 and a Result carrying its ticket.
+// Upstream failures map to 502, timeouts to 504.
+//
+// A request with "stream": true, or accepting text/event-stream, is answered
+// with server-sent events as the answer is generated: a "chunk" event with
+// a {"response": ...} piece each, then a "done" event with the Response. A
+// failure once the first chunk is out ends the stream with an "error" event.
+func QueryHandler(client *Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQuerySize)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		if strings.TrimSpace(req.Message) == "" {
+			writeError(w, http.StatusBadRequest, "message cannot be empty")
+			return
+		}
+
+		if req.Stream || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			serveStream(w, r, client, req)
+			return
+		}
+
+		result, err := client.Submit(r.Context(), req)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if result.IsQueued() {
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+		json.NewEncoder(w).Encode(result.Response)
+	}
+}
+
+// serveStream answers a request with server-sent events. Until the first
+// chunk it can still answer like QueryHandler does otherwise.
+func serveStream(w http.ResponseWriter, r *http.Request, client *Client, req Request) {
+	flusher := http.NewResponseController(w)
+	started := false
+	start := func() {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		started = true
+	}
+	send := func(event string, data interface{}) error {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded); err != nil {
+			return err
+		}
+		return flusher.Flush()
+	}
+
+	result, err := client.SubmitStream(r.Context(), req, func(text string) error {
+		if !started {
+			start()
+		}
+		return send("chunk", streamPiece{Text: text})
+	})
+	switch {
+	case err != nil && started:
+		send("error", map[string]string{"error": err.Error()})
+	case err != nil:
+		writeError(w, errorStatus(err), err.Error())
+	case result.IsQueued():
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(result)
+	default:
+		if !started {
+			start()
+		}
+		send("done", result.Response)
+	}
+}
+
+// errorStatus maps a failed query to the status it is answered with
+func errorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrStreamStalled) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,512 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/monitor"
+)
+
+// relayMargin is added to the worst-case query time to cover the round trip
+// to the peer answering a relayed request
+const relayMargin = 5 * time.Second
+
+// maxRelayStream bounds a streamed relayed answer, however steadily its
+// chunks arrive
+const maxRelayStream = 30 * time.Minute
+
+// cancelTimeout bounds telling a peer to stop answering
+const cancelTimeout = 2 * time.Second
+
+// ErrNoCapablePeer is returned when no connected peer could answer a relayed
+// AI request
+var ErrNoCapablePeer = errors.New("no capable peer answered the AI request")
+
+// errPeerBusy marks a peer skipped because our requests to it are at the limit
+var errPeerBusy = errors.New("too many requests in flight")
+
+// errRelayStalled ends a relayed stream whose chunks stopped coming
+var errRelayStalled = errors.New("relayed AI stream stalled")
+
+// Mesh shares AI access across the network. Nodes with a working client
+// answer AI_REQUESTs from their peers; any node can delegate a query to the
+// best-reputation peer that advertises CapabilityAI, failing over to the
+// next one on error. Between peers advertising CapabilityAIStream, answers
+// can be streamed in AI_RESPONSE_CHUNKs.
+type Mesh struct {
+	client     *Client
+	network    *p2p.Network
+	logger     *logger.Logger
+	metrics    *monitor.ServiceMetrics
+	maxPerPeer int
+	timeout    time.Duration
+
+	mu       sync.Mutex
+	inbound  map[string]int
+	outbound map[string]int
+	// streams are the streamed answers we are waiting for, by request ID
+	streams map[string]*relayStream
+	// serving cancels the streamed answers we are generating, by requester
+	// and request ID
+	serving map[string]context.CancelFunc
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMesh creates the AI relay for a node. client may be nil on nodes that
+// cannot reach the endpoint themselves; they only delegate.
+func NewMesh(client *Client, network *p2p.Network, log *logger.Logger, cfg config.AIConfig) (*Mesh, error) {
+	if network == nil {
+		return nil, fmt.Errorf("network cannot be nil")
+	}
+	if log == nil {
+		return nil, fmt.Errorf("logger cannot be nil")
+	}
+
+	maxPerPeer := cfg.MaxConcurrentPerPeer
+	if maxPerPeer < 1 {
+		maxPerPeer = 1
+	}
+
+	return &Mesh{
+		client:     client,
+		network:    network,
+		logger:     log.With("component", "ai_mesh"),
+		metrics:    network.ServiceMetrics("ai_relay"),
+		maxPerPeer: maxPerPeer,
+		timeout:    maxQueryDuration(time.Duration(cfg.Timeout)*time.Second, cfg.MaxRetries, DefaultBackoff) + relayMargin,
+		inbound:    make(map[string]int),
+		outbound:   make(map[string]int),
+		streams:    make(map[string]*relayStream),
+		serving:    make(map[string]context.CancelFunc),
+	}, nil
+}
+
+// Start serves AI_REQUESTs if this node has a client, advertising
+// CapabilityAI while the endpoint is healthy, and takes streamed answers. It
+// must be called before the network starts so the capabilities are part of
+// our first HELLO.
+func (m *Mesh) Start(ctx context.Context) {
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	m.network.RegisterHandler(p2p.MessageTypeAIResponseChunk, m.handleChunk)
+	m.network.AdvertiseCapability(p2p.CapabilityAIStream, func() bool { return true })
+	if m.client == nil {
+		return
+	}
+
+	m.network.RegisterHandler(p2p.MessageTypeAIRequest, m.handleRequest)
+	m.network.RegisterHandler(p2p.MessageTypeAICancel, m.handleCancel)
+	m.network.AdvertiseCapability(p2p.CapabilityAI, m.client.Healthy)
+}
+
+// Stop cancels relayed requests being served and waits for them
+func (m *Mesh) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+}
+
+// Query delegates a request to capable peers, best reputation first
+func (m *Mesh) Query(ctx context.Context, req Request) (*Response, error) {
+	return m.query(ctx, req, nil)
+}
+
+// QueryStream delegates a request like Query, passing the answer to onChunk
+// as it arrives. Peers that cannot stream send it in one chunk. Once a chunk
+// is passed on the request no longer fails over to another peer.
+func (m *Mesh) QueryStream(ctx context.Context, req Request, onChunk ChunkFunc) (*Response, error) {
+	if onChunk == nil {
+		return nil, fmt.Errorf("chunk function cannot be nil")
+	}
+	return m.query(ctx, req, &chunkTracker{onChunk: onChunk})
+}
+
+// query delegates a request, streaming the answer to chunks unless it is nil
+func (m *Mesh) query(ctx context.Context, req Request, chunks *chunkTracker) (*Response, error) {
+	peers := m.candidates()
+	if len(peers) == 0 {
+		return nil, ErrNoCapablePeer
+	}
+
+	payload := p2p.AIRequestPayload{Message: req.Message, NoCache: req.NoCache}
+	for _, turn := range req.History {
+		payload.History = append(payload.History, p2p.AITurn{Role: turn.Role, Content: turn.Content})
+	}
+
+	var lastPeer string
+	var lastErr error
+	for _, peerID := range peers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		start := time.Now()
+		resp, err := m.queryPeer(ctx, peerID, payload, chunks)
+		if !errors.Is(err, errPeerBusy) {
+			m.metrics.Observe(time.Since(start), err)
+		}
+		if err == nil {
+			resp.Latency = time.Since(start)
+			return resp, nil
+		}
+		if chunks.passedOn() {
+			return nil, fmt.Errorf("AI stream via %s failed: %w", peerID, err)
+		}
+
+		m.logger.Debugf("AI request via %s failed, trying next peer: %v", peerID, err)
+		lastPeer, lastErr = peerID, err
+	}
+	return nil, fmt.Errorf("%w: last error from %s: %w", ErrNoCapablePeer, lastPeer, lastErr)
+}
+
+// candidates returns the peers advertising CapabilityAI, best reputation first
+func (m *Mesh) candidates() []string {
+	var peerIDs []string
+	for _, peer := range m.network.PeersWithCapability(p2p.CapabilityAI) {
+		peerIDs = append(peerIDs, peer.ID)
+	}
+
+	reputation := make(map[string]float64, len(peerIDs))
+	for _, peerID := range peerIDs {
+		reputation[peerID] = m.network.PeerReputation(peerID)
+	}
+	sort.SliceStable(peerIDs, func(i, j int) bool {
+		if reputation[peerIDs[i]] != reputation[peerIDs[j]] {
+			return reputation[peerIDs[i]] > reputation[peerIDs[j]]
+		}
+		return peerIDs[i] < peerIDs[j]
+	})
+	return peerIDs
+}
+
+// queryPeer sends one AI_REQUEST and waits for the answer, which it streams
+// to chunks if they are set and the peer can stream
+func (m *Mesh) queryPeer(ctx context.Context, peerID string, payload p2p.AIRequestPayload, chunks *chunkTracker) (*Response, error) {
+	if !m.acquire(m.outbound, peerID) {
+		return nil, errPeerBusy
+	}
+	defer m.release(m.outbound, peerID)
+
+	if chunks != nil {
+		if peer, ok := m.network.Peer(peerID); ok && peer.HasCapability(p2p.CapabilityAIStream) {
+			return m.streamFromPeer(ctx, peerID, payload, chunks)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	msg := p2p.NewMessage(p2p.MessageTypeAIRequest, m.network.NodeID(), payload)
+	reply, err := m.network.Request(ctx, peerID, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var answer p2p.AIResponsePayload
+	if err := reply.DecodePayload(&answer); err != nil {
+		return nil, err
+	}
+	if chunks != nil {
+		if err := chunks.send(answer.Text); err != nil {
+			return nil, err
+		}
+	}
+	return &Response{Text: answer.Text, Model: answer.Model}, nil
+}
+
+// handleRequest answers an AI_REQUEST from a peer using our own client. It
+// never delegates further, so requests cannot loop around the mesh.
+func (m *Mesh) handleRequest(msg p2p.Message) {
+	var payload p2p.AIRequestPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		m.replyError(msg, p2p.ErrorCodeInvalidMessage, err.Error())
+		return
+	}
+	if !m.acquire(m.inbound, msg.Sender) {
+		m.replyError(msg, p2p.ErrorCodeBusy, fmt.Sprintf("at most %d concurrent AI requests per peer", m.maxPerPeer))
+		return
+	}
+
+	req := Request{Message: payload.Message, NoCache: payload.NoCache}
+	for _, turn := range payload.History {
+		req.History = append(req.History, Message{Role: turn.Role, Content: turn.Content})
+	}
+
+	// Handlers run on the network's message loop, so the query must not block it
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer m.release(m.inbound, msg.Sender)
+
+		var resp *Response
+		var chunks int
+		var err error
+		if peer, ok := m.network.Peer(msg.Sender); ok && payload.Stream && peer.HasCapability(p2p.CapabilityAIStream) {
+			resp, chunks, err = m.streamAnswer(msg, req)
+		} else {
+			resp, err = m.client.Query(m.ctx, req)
+		}
+		if err != nil {
+			m.replyError(msg, p2p.ErrorCodeUpstreamFailed, err.Error())
+			return
+		}
+
+		answer := p2p.AIResponsePayload{Text: resp.Text, Model: resp.Model, LatencyMs: resp.Latency.Milliseconds(), Chunks: chunks}
+		if err := m.network.Reply(msg, p2p.MessageTypeAIResponse, answer); err != nil {
+			m.logger.Debugf("failed to answer AI request from %s: %v", msg.Sender, err)
+		}
+	}()
+}
+
+// streamAnswer queries the endpoint for a streamed AI_REQUEST, sending each
+// piece of the answer to the requester as it arrives, until the requester
+// cancels. It returns the answer and how many chunks were sent.
+func (m *Mesh) streamAnswer(msg p2p.Message, req Request) (*Response, int, error) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	key := servingKey(msg.Sender, msg.ID)
+	m.mu.Lock()
+	m.serving[key] = cancel
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.serving, key)
+		m.mu.Unlock()
+		cancel()
+	}()
+
+	index := 0
+	resp, err := m.client.QueryStream(ctx, req, func(text string) error {
+		chunk := p2p.NewMessage(p2p.MessageTypeAIResponseChunk, m.network.NodeID(), p2p.AIResponseChunkPayload{
+			RequestID: msg.ID,
+			Index:     index,
+			Text:      text,
+		})
+		if err := m.network.SendMessage(ctx, msg.Sender, chunk); err != nil {
+			return fmt.Errorf("failed to stream AI answer to %s: %w", msg.Sender, err)
+		}
+		index++
+		return nil
+	})
+	return resp, index, err
+}
+
+// handleCancel stops generating the answer to a streamed AI_REQUEST
+func (m *Mesh) handleCancel(msg p2p.Message) {
+	var payload p2p.AICancelPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	cancel, serving := m.serving[servingKey(msg.Sender, payload.RequestID)]
+	m.mu.Unlock()
+	if serving {
+		m.logger.Debugf("%s cancelled AI request %s", msg.Sender, payload.RequestID)
+		cancel()
+	}
+}
+
+// servingKey identifies a request being answered; request IDs are only
+// unique per sender
+func servingKey(peerID, requestID string) string {
+	return peerID + "/" + requestID
+}
+
+// replyError rejects an AI_REQUEST
+func (m *Mesh) replyError(msg p2p.Message, code, reason string) {
+	err := m.network.Reply(msg, p2p.MessageTypeError, p2p.ErrorPayload{
+		Code:      code,
+		Message:   reason,
+		MessageID: msg.ID,
+	})
+	if err != nil {
+		m.logger.Debugf("failed to reject AI request from %s: %v", msg.Sender, err)
+	}
+}
+
+// acquire takes one of a peer's concurrency slots in counts
+func (m *Mesh) acquire(counts map[string]int, peerID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if counts[peerID] >= m.maxPerPeer {
+		return false
+	}
+	counts[peerID]++
+	return true
+}
+
+// release returns a peer's concurrency slot
+func (m *Mesh) release(counts map[string]int, peerID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts[peerID]--
+	if counts[peerID] <= 0 {
+		delete(counts, peerID)
+	}
+}
+
+// relayStream collects the chunks of an answer streamed by a peer, which may
+// be handled out of order
+type relayStream struct {
+	peerID string
+
+	mu     sync.Mutex
+	pieces map[int]string
+	next   int
+	// ready is signalled when a chunk arrives
+	ready chan struct{}
+}
+
+// newRelayStream waits for the chunks peerID streams
+func newRelayStream(peerID string) *relayStream {
+	return &relayStream{
+		peerID: peerID,
+		pieces: make(map[int]string),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// add keeps a chunk until the ones before it have been taken
+func (s *relayStream) add(index int, text string) {
+	s.mu.Lock()
+	if index >= s.next {
+		s.pieces[index] = text
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take removes the next chunk in order, if it has arrived
+func (s *relayStream) take() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	text, ok := s.pieces[s.next]
+	if ok {
+		delete(s.pieces, s.next)
+		s.next++
+	}
+	return text, ok
+}
+
+// taken returns how many chunks have been taken
+func (s *relayStream) taken() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next
+}
+
+// streamFromPeer sends a streamed AI_REQUEST and passes the chunks of the
+// answer to chunks in order until the AI_RESPONSE and every chunk it counts
+// are in. Instead of the mesh's timeout the stream fails once the peer goes
+// that long without sending anything. A stream cut short is cancelled at
+// the peer.
+func (m *Mesh) streamFromPeer(ctx context.Context, peerID string, payload p2p.AIRequestPayload, chunks *chunkTracker) (*Response, error) {
+	payload.Stream = true
+	msg := p2p.NewMessage(p2p.MessageTypeAIRequest, m.network.NodeID(), payload)
+	stream := newRelayStream(peerID)
+	m.mu.Lock()
+	m.streams[msg.ID] = stream
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.streams, msg.ID)
+		m.mu.Unlock()
+	}()
+
+	ctx, stop := context.WithTimeout(ctx, maxRelayStream)
+	defer stop()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	idle := time.AfterFunc(m.timeout, func() { cancel(errRelayStalled) })
+	defer idle.Stop()
+
+	type reply struct {
+		msg p2p.Message
+		err error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		msg, err := m.network.Request(ctx, peerID, msg)
+		replies <- reply{msg, err}
+	}()
+
+	var answer *p2p.AIResponsePayload
+	for {
+		for text, ok := stream.take(); ok; text, ok = stream.take() {
+			idle.Reset(m.timeout)
+			if err := chunks.send(text); err != nil {
+				m.cancelRemote(peerID, msg.ID)
+				return nil, err
+			}
+		}
+		if answer != nil && stream.taken() >= answer.Chunks {
+			return &Response{Text: answer.Text, Model: answer.Model}, nil
+		}
+
+		select {
+		case <-stream.ready:
+		case r := <-replies:
+			if r.err != nil {
+				if ctx.Err() != nil {
+					m.cancelRemote(peerID, msg.ID)
+					return nil, context.Cause(ctx)
+				}
+				return nil, r.err
+			}
+			answer = &p2p.AIResponsePayload{}
+			if err := r.msg.DecodePayload(answer); err != nil {
+				return nil, err
+			}
+			idle.Reset(m.timeout)
+		case <-ctx.Done():
+			m.cancelRemote(peerID, msg.ID)
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// handleChunk passes a chunk of a streamed answer to the request waiting
+// for it
+func (m *Mesh) handleChunk(msg p2p.Message) {
+	var payload p2p.AIResponseChunkPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	stream, waiting := m.streams[payload.RequestID]
+	m.mu.Unlock()
+	if !waiting || stream.peerID != msg.Sender {
+		m.logger.Debugf("dropping AI response chunk for %s from %s", payload.RequestID, msg.Sender)
+		return
+	}
+	stream.add(payload.Index, payload.Text)
+}
+
+// cancelRemote asks a peer to stop streaming the answer to a request
+func (m *Mesh) cancelRemote(peerID, requestID string) {
+	ctx, cancel := context.WithTimeout(m.ctx, cancelTimeout)
+	defer cancel()
+
+	msg := p2p.NewMessage(p2p.MessageTypeAICancel, m.network.NodeID(), p2p.AICancelPayload{RequestID: requestID})
+	if err := m.network.SendMessage(ctx, peerID, msg); err != nil {
+		m.logger.Debugf("failed to cancel AI request %s at %s: %v", requestID, peerID, err)
+	}
+}
@@ -0,0 +1,228 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/p2ptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type meshNode struct {
+	network *p2p.Network
+	client  *Client
+	mesh    *Mesh
+}
+
+// startMeshNode starts a network with an AI mesh. With an empty endpoint the
+// node has no client of its own and can only delegate.
+func startMeshNode(t *testing.T, ctx context.Context, nodeID, endpoint string, maxPerPeer int) *meshNode {
+	node := &meshNode{}
+	if endpoint != "" {
+		node.client = newTestClient(t, endpoint, 0)
+	}
+	p2ptest.StartNode(t, ctx, nodeID,
+		p2ptest.WithConfig(func(cfg *config.Config) {
+			cfg.AI.Endpoint = endpoint
+			cfg.AI.MaxRetries = 0
+			cfg.AI.Timeout = 5
+			cfg.AI.MaxConcurrentPerPeer = maxPerPeer
+		}),
+		p2ptest.BeforeStart(func(started *p2ptest.Node) {
+			mesh, err := NewMesh(node.client, started.Network, started.Logger, started.Config.AI)
+			require.NoError(t, err)
+			mesh.Start(ctx)
+			t.Cleanup(mesh.Stop)
+			node.network, node.mesh = started.Network, mesh
+		}))
+	return node
+}
+
+// connect dials other and waits until the AI capability, if any, is known
+func (n *meshNode) connect(t *testing.T, other *meshNode) {
+	_, err := n.network.Connect(context.Background(), other.network.ListenAddr().String())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		peer, ok := n.network.Peer(other.network.NodeID())
+		return ok && peer.Capabilities != nil
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func stubEndpoint(t *testing.T, status int, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRelayThroughCapablePeer(t *testing.T) {
+	ctx := context.Background()
+	upstream := stubEndpoint(t, http.StatusOK, `{"response":"relayed answer","model":"stub"}`)
+
+	gateway := startMeshNode(t, ctx, "ai-gateway", upstream.URL, 2)
+	edge := startMeshNode(t, ctx, "ai-edge", "", 2)
+	edge.connect(t, gateway)
+
+	assert.Len(t, edge.network.PeersWithCapability(p2p.CapabilityAI), 1)
+	require.Eventually(t, func() bool {
+		return len(gateway.network.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Empty(t, gateway.network.PeersWithCapability(p2p.CapabilityAI), "a node without a client must not advertise AI")
+
+	resp, err := edge.mesh.Query(ctx, Request{Message: "hello", History: []Message{{Role: "user", Content: "hi"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "relayed answer", resp.Text)
+	assert.Equal(t, "stub", resp.Model)
+
+	// An air-gapped client falls back to the mesh instead of queueing
+	offline := httptest.NewServer(http.NotFoundHandler())
+	offline.Close()
+	client := newTestClient(t, offline.URL, 0)
+	client.SetQueue(newTestQueue(t, t.TempDir(), 10, 1<<16))
+	client.SetDelegate(edge.mesh)
+
+	result, err := client.Submit(ctx, Request{Message: "hello"})
+	require.NoError(t, err)
+	require.False(t, result.IsQueued())
+	assert.Equal(t, "relayed answer", result.Response.Text)
+	assert.Equal(t, 0, client.Queue().Len())
+}
+
+func TestRelayFailsOverToNextPeer(t *testing.T) {
+	ctx := context.Background()
+	broken := stubEndpoint(t, http.StatusBadRequest, `rejected`)
+	working := stubEndpoint(t, http.StatusOK, `{"response":"from the working peer"}`)
+
+	brokenPeer := startMeshNode(t, ctx, "ai-a-broken", broken.URL, 2)
+	workingPeer := startMeshNode(t, ctx, "ai-b-working", working.URL, 2)
+	edge := startMeshNode(t, ctx, "ai-edge", "", 2)
+
+	// With only the broken peer the caller learns why the relay failed
+	edge.connect(t, brokenPeer)
+	_, err := edge.mesh.Query(ctx, Request{Message: "hello"})
+	assert.ErrorIs(t, err, ErrNoCapablePeer)
+	var remote *p2p.ErrorPayload
+	require.ErrorAs(t, err, &remote)
+	assert.Equal(t, p2p.ErrorCodeUpstreamFailed, remote.Code)
+
+	edge.connect(t, workingPeer)
+	require.Len(t, edge.network.PeersWithCapability(p2p.CapabilityAI), 2)
+	for i := 0; i < 3; i++ {
+		resp, err := edge.mesh.Query(ctx, Request{Message: "hello"})
+		require.NoError(t, err)
+		assert.Equal(t, "from the working peer", resp.Text)
+	}
+}
+
+func TestRelayPerPeerConcurrencyLimit(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response":"done"}`))
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	gateway := startMeshNode(t, ctx, "ai-gateway", slow.URL, 1)
+	edge := startMeshNode(t, ctx, "ai-edge", "", 2)
+	edge.connect(t, gateway)
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := edge.mesh.Query(ctx, Request{Message: "first"})
+		first <- err
+	}()
+
+	// Wait until the gateway is serving the first request
+	require.Eventually(t, func() bool {
+		gateway.mesh.mu.Lock()
+		defer gateway.mesh.mu.Unlock()
+		return gateway.mesh.inbound["ai-edge"] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err := edge.mesh.Query(ctx, Request{Message: "second"})
+	var remote *p2p.ErrorPayload
+	require.True(t, errors.As(err, &remote), "expected a BUSY rejection, got %v", err)
+	assert.Equal(t, p2p.ErrorCodeBusy, remote.Code)
+
+	release <- struct{}{}
+	require.NoError(t, <-first)
+}
+
+func TestRelayStreamsChunks(t *testing.T) {
+	ctx := context.Background()
+	upstream := streamingEndpoint(t, []string{"Hel", "lo ", "there"}, 100*time.Millisecond)
+
+	gateway := startMeshNode(t, ctx, "ai-gateway", upstream.URL, 2)
+	edge := startMeshNode(t, ctx, "ai-edge", "", 2)
+	edge.connect(t, gateway)
+	require.Eventually(t, func() bool {
+		peer, ok := gateway.network.Peer("ai-edge")
+		return ok && peer.HasCapability(p2p.CapabilityAIStream)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	recorder := &chunkRecorder{}
+	resp, err := edge.mesh.QueryStream(ctx, Request{Message: "hello"}, recorder.record)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Hel", "lo ", "there"}, recorder.chunks)
+	assert.Equal(t, "Hello there", resp.Text)
+	assert.Equal(t, "stub", resp.Model)
+	assert.Greater(t, recorder.arrived[2].Sub(recorder.arrived[0]), 150*time.Millisecond)
+
+	// A client whose endpoint is down streams through the mesh
+	offline := httptest.NewServer(http.NotFoundHandler())
+	offline.Close()
+	client := newTestClient(t, offline.URL, 0)
+	client.SetDelegate(edge.mesh)
+	recorder = &chunkRecorder{}
+	result, err := client.SubmitStream(ctx, Request{Message: "hello"}, recorder.record)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello there", result.Response.Text)
+	assert.Equal(t, []string{"Hel", "lo ", "there"}, recorder.chunks)
+}
+
+func TestRelayStreamCancelReachesUpstream(t *testing.T) {
+	ctx := context.Background()
+	upstream, cancelled := hangingEndpoint(t)
+
+	gateway := startMeshNode(t, ctx, "ai-gateway", upstream.URL, 2)
+	edge := startMeshNode(t, ctx, "ai-edge", "", 2)
+	edge.connect(t, gateway)
+	require.Eventually(t, func() bool {
+		peer, ok := gateway.network.Peer("ai-edge")
+		return ok && peer.HasCapability(p2p.CapabilityAIStream)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Only the query is cancelled; the gateway learns of it from AI_CANCEL
+	queryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	_, err := edge.mesh.QueryStream(queryCtx, Request{Message: "hello"}, func(text string) error {
+		assert.Equal(t, "first", text)
+		cancel()
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the endpoint never saw the relayed request cancelled")
+	}
+	require.Eventually(t, func() bool {
+		gateway.mesh.mu.Lock()
+		defer gateway.mesh.mu.Unlock()
+		return len(gateway.mesh.serving) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
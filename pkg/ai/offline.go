@@ -0,0 +1,188 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/logger"
+)
+
+// Result is the outcome of Submit: either the endpoint's answer, or a ticket
+// for a request that was queued because the endpoint could not be reached
+type Result struct {
+	Response *Response     `json:"response,omitempty"`
+	Queued   *QueuedTicket `json:"queued,omitempty"`
+}
+
+// QueuedTicket acknowledges a request accepted into the offline queue
+type QueuedTicket struct {
+	ID     string `json:"id"`
+	Depth  int    `json:"depth"`
+	Reason string `json:"reason"`
+}
+
+// IsQueued reports whether the request was queued rather than answered
+func (r *Result) IsQueued() bool {
+	return r.Queued != nil
+}
+
+// SetQueue enables the offline queue for Submit
+func (c *Client) SetQueue(q *Queue) {
+	c.queue = q
+}
+
+// Queue returns the offline queue, or nil if it is disabled
+func (c *Client) Queue() *Queue {
+	return c.queue
+}
+
+// Delegate answers requests the endpoint could not, e.g. by relaying them to
+// a peer that can reach it
+type Delegate interface {
+	Query(ctx context.Context, req Request) (*Response, error)
+}
+
+// SetDelegate sets where requests go when the endpoint is unreachable
+func (c *Client) SetDelegate(d Delegate) {
+	c.delegate = d
+}
+
+// answer queries the endpoint and falls back to the delegate if it is
+// unreachable. The endpoint's error is returned if both fail.
+func (c *Client) answer(ctx context.Context, req Request) (*Response, error) {
+	resp, err := c.Query(ctx, req)
+	if err == nil || c.delegate == nil || !retryable(ctx, err) {
+		return resp, err
+	}
+
+	resp, derr := c.delegate.Query(ctx, req)
+	if derr != nil {
+		return nil, fmt.Errorf("%w (delegation failed: %v)", err, derr)
+	}
+	return resp, nil
+}
+
+// Submit queries the endpoint, then the delegate, and if neither can answer
+// and the offline queue is enabled, queues the request to be sent later
+func (c *Client) Submit(ctx context.Context, req Request) (*Result, error) {
+	resp, err := c.answer(ctx, req)
+	if err == nil {
+		return &Result{Response: resp}, nil
+	}
+	if c.queue == nil || !retryable(ctx, err) {
+		return nil, err
+	}
+
+	item, qerr := c.queue.Enqueue(req, err.Error())
+	if qerr != nil {
+		return nil, fmt.Errorf("%w (and could not be queued: %v)", err, qerr)
+	}
+	return &Result{Queued: &QueuedTicket{ID: item.ID, Depth: c.queue.Len(), Reason: item.Reason}}, nil
+}
+
+// Drainer replays queued requests once the endpoint is reachable again
+type Drainer struct {
+	client   *Client
+	queue    *Queue
+	logger   *logger.Logger
+	interval time.Duration
+
+	// onResult receives the outcome of every drained request
+	onResult func(item *QueuedRequest, resp *Response, err error)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDrainer creates a drainer that retries the client's queue every interval
+func NewDrainer(client *Client, log *logger.Logger, interval time.Duration) (*Drainer, error) {
+	if client == nil || client.queue == nil {
+		return nil, fmt.Errorf("client with an offline queue is required")
+	}
+	if log == nil {
+		return nil, fmt.Errorf("logger cannot be nil")
+	}
+
+	return &Drainer{
+		client:   client,
+		queue:    client.queue,
+		logger:   log.With("component", "ai_queue"),
+		interval: interval,
+	}, nil
+}
+
+// OnResult registers a callback for drained requests, e.g. to deliver the
+// answer. It must be called before Start.
+func (d *Drainer) OnResult(fn func(item *QueuedRequest, resp *Response, err error)) {
+	d.onResult = fn
+}
+
+// Start drains the queue every interval until Stop or ctx is done
+func (d *Drainer) Start(ctx context.Context) {
+	ctx, d.cancel = context.WithCancel(ctx)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if n := d.Drain(ctx); n > 0 {
+					d.logger.Infof("drained %d queued AI requests, %d remaining", n, d.queue.Len())
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends draining
+func (d *Drainer) Stop() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.wg.Wait()
+}
+
+// Drain sends queued requests oldest first until the queue is empty or the
+// endpoint is still unreachable, and returns how many were answered.
+// Requests the endpoint rejects outright are dropped.
+func (d *Drainer) Drain(ctx context.Context) int {
+	drained := 0
+	for ctx.Err() == nil {
+		item, ok := d.queue.Peek()
+		if !ok {
+			return drained
+		}
+
+		resp, err := d.client.answer(ctx, item.Request)
+		switch {
+		case err == nil:
+			if err := d.queue.Complete(item.ID); err != nil {
+				d.logger.Warnf("failed to record drained request %s: %v", item.ID, err)
+			}
+			drained++
+		case retryable(ctx, err):
+			d.logger.Debugf("AI endpoint still unreachable: %v", err)
+			return drained
+		case ctx.Err() != nil:
+			return drained
+		default:
+			d.logger.Warnf("dropping queued AI request %s: %v", item.ID, err)
+			if err := d.queue.Drop(item.ID); err != nil {
+				d.logger.Warnf("failed to record dropped request %s: %v", item.ID, err)
+			}
+		}
+
+		if d.onResult != nil {
+			d.onResult(item, resp, err)
+		}
+	}
+	return drained
+}
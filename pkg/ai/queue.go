@@ -0,0 +1,464 @@
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+)
+
+const (
+	// QueueDir is the directory under the data directory holding the queue
+	QueueDir = "ai-queue"
+
+	queueSnapshot = "queue.json"
+	queueJournal  = "queue.journal"
+
+	// checkpointEvery is how many journal records accumulate before the
+	// queue is compacted into a new snapshot
+	checkpointEvery = 256
+
+	// drainRateWindow is the period over which the drain rate is measured
+	drainRateWindow = time.Minute
+)
+
+// ErrRequestTooLarge is returned for a request that alone exceeds the queue's
+// byte limit
+var ErrRequestTooLarge = errors.New("request exceeds the offline queue size limit")
+
+// ErrQueueClosed is returned when enqueueing after Close
+var ErrQueueClosed = errors.New("offline queue is closed")
+
+// QueuedRequest is a request waiting for the endpoint to become reachable
+type QueuedRequest struct {
+	ID         string    `json:"id"`
+	Request    Request   `json:"request"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	Reason     string    `json:"reason,omitempty"`
+
+	size int64
+}
+
+// QueueStats describes the queue for the network report
+type QueueStats struct {
+	Depth     int       `json:"depth"`
+	Bytes     int64     `json:"bytes"`
+	Enqueued  uint64    `json:"enqueued"`
+	Drained   uint64    `json:"drained"`
+	Dropped   uint64    `json:"dropped"`
+	Evicted   uint64    `json:"evicted"`
+	Corrupt   uint64    `json:"corrupt_records"`
+	DrainRate float64   `json:"drain_rate_per_minute"`
+	Oldest    time.Time `json:"oldest,omitempty"`
+	LastDrain time.Time `json:"last_drain,omitempty"`
+}
+
+// journalRecord is one line of the journal: an enqueue or a removal
+type journalRecord struct {
+	Op   string         `json:"op"`
+	Item *QueuedRequest `json:"item,omitempty"`
+	ID   string         `json:"id,omitempty"`
+}
+
+const (
+	opEnqueue = "enqueue"
+	opRemove  = "remove"
+)
+
+// Queue is a persistent FIFO of AI requests. Every change is appended to a
+// checksummed journal, which is periodically compacted into an atomically
+// written snapshot; torn or corrupt journal lines are skipped on load.
+type Queue struct {
+	storage  *storage.Manager
+	dir      string
+	maxItems int
+	maxBytes int64
+
+	mu      sync.Mutex
+	items   []*QueuedRequest
+	bytes   int64
+	journal io.WriteCloser
+	records int
+	closed  bool
+
+	enqueued  uint64
+	drained   uint64
+	dropped   uint64
+	evicted   uint64
+	corrupt   uint64
+	drains    []time.Time
+	lastDrain time.Time
+}
+
+// NewQueue opens the queue under the storage manager's data directory,
+// recovering whatever survived the last run
+func NewQueue(store *storage.Manager, maxItems int, maxBytes int64) (*Queue, error) {
+	if store == nil {
+		return nil, fmt.Errorf("storage manager cannot be nil")
+	}
+	if maxItems < 1 || maxBytes < 1 {
+		return nil, fmt.Errorf("offline queue limits must be positive")
+	}
+
+	q := &Queue{
+		storage:  store,
+		dir:      filepath.Join(store.Dir(), QueueDir),
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+	}
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	q.enforceLimitsLocked()
+
+	// Start from a clean snapshot so corrupt lines are not replayed again
+	if err := q.checkpointLocked(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Enqueue appends a request, evicting the oldest ones if the queue is full
+func (q *Queue) Enqueue(req Request, reason string) (*QueuedRequest, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal AI request: %w", err)
+	}
+	if int64(len(data)) > q.maxBytes {
+		return nil, ErrRequestTooLarge
+	}
+
+	item := &QueuedRequest{
+		ID:         uuid.New().String(),
+		Request:    req,
+		EnqueuedAt: time.Now(),
+		Reason:     reason,
+		size:       int64(len(data)),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	// Add before journaling so a checkpoint triggered by the append includes it
+	q.items = append(q.items, item)
+	q.bytes += item.size
+	if err := q.appendLocked(journalRecord{Op: opEnqueue, Item: item}); err != nil {
+		q.removeItemLocked(item.ID)
+		return nil, err
+	}
+	q.enqueued++
+	q.enforceLimitsLocked()
+
+	return item, nil
+}
+
+// Peek returns the oldest request without removing it
+func (q *Queue) Peek() (*QueuedRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	return q.items[0], true
+}
+
+// Len returns the number of queued requests
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Complete removes a request that was answered
+func (q *Queue) Complete(id string) error {
+	return q.remove(id, func() {
+		q.drained++
+		q.lastDrain = time.Now()
+		q.drains = append(q.drains, q.lastDrain)
+	})
+}
+
+// Drop removes a request the endpoint rejected permanently
+func (q *Queue) Drop(id string) error {
+	return q.remove(id, func() { q.dropped++ })
+}
+
+// remove deletes a request and runs count if it was present
+func (q *Queue) remove(id string, count func()) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.removeItemLocked(id) {
+		return nil
+	}
+	count()
+	if q.closed {
+		return nil
+	}
+	return q.appendLocked(journalRecord{Op: opRemove, ID: id})
+}
+
+// Stats returns the queue's depth and throughput
+func (q *Queue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cutoff := time.Now().Add(-drainRateWindow)
+	recent := q.drains[:0]
+	for _, t := range q.drains {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	q.drains = recent
+
+	stats := QueueStats{
+		Depth:     len(q.items),
+		Bytes:     q.bytes,
+		Enqueued:  q.enqueued,
+		Drained:   q.drained,
+		Dropped:   q.dropped,
+		Evicted:   q.evicted,
+		Corrupt:   q.corrupt,
+		DrainRate: float64(len(recent)) / drainRateWindow.Minutes(),
+		LastDrain: q.lastDrain,
+	}
+	if len(q.items) > 0 {
+		stats.Oldest = q.items[0].EnqueuedAt
+	}
+	return stats
+}
+
+// Checkpoint compacts the journal into a fresh snapshot
+func (q *Queue) Checkpoint() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	return q.checkpointLocked()
+}
+
+// Close checkpoints the queue and closes the journal
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	err := q.checkpointLocked()
+	q.closed = true
+	if q.journal != nil {
+		q.journal.Close()
+		q.journal = nil
+	}
+	return err
+}
+
+// appendLocked writes one checksummed journal line; callers must hold q.mu
+func (q *Queue) appendLocked(record journalRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue record: %w", err)
+	}
+
+	if q.journal == nil {
+		// A previous checkpoint failed after closing the journal
+		journal, err := q.storage.OpenAppend(filepath.Join(q.dir, queueJournal), 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open queue journal: %w", err)
+		}
+		q.journal = journal
+	}
+
+	line := fmt.Appendf(nil, "%08x %s\n", crc32.ChecksumIEEE(data), data)
+	if _, err := q.journal.Write(line); err != nil {
+		return fmt.Errorf("failed to append to queue journal: %w", err)
+	}
+
+	// The record is durable in the journal; a failed compaction is retried
+	// on a later append
+	q.records++
+	if q.records >= checkpointEvery {
+		q.checkpointLocked()
+	}
+	return nil
+}
+
+// checkpointLocked writes the snapshot and starts an empty journal; callers
+// must hold q.mu. A crash between the two steps is harmless because
+// replaying the old journal over the new snapshot is idempotent.
+func (q *Queue) checkpointLocked() error {
+	data, err := json.Marshal(q.items)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue snapshot: %w", err)
+	}
+	if err := q.storage.WriteFile(filepath.Join(q.dir, queueSnapshot), data, 0600); err != nil {
+		return fmt.Errorf("failed to write queue snapshot: %w", err)
+	}
+
+	if q.journal != nil {
+		q.journal.Close()
+		q.journal = nil
+	}
+	journalPath := filepath.Join(q.dir, queueJournal)
+	if err := q.storage.Remove(journalPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to truncate queue journal: %w", err)
+	}
+	journal, err := q.storage.OpenAppend(journalPath, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open queue journal: %w", err)
+	}
+	q.journal = journal
+	q.records = 0
+	return nil
+}
+
+// load reads the snapshot and replays the journal over it
+func (q *Queue) load() error {
+	data, err := os.ReadFile(filepath.Join(q.dir, queueSnapshot))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("failed to read queue snapshot: %w", err)
+	default:
+		var items []*QueuedRequest
+		if err := json.Unmarshal(data, &items); err != nil {
+			q.corrupt++
+		}
+		for _, item := range items {
+			q.addItemLocked(item)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(q.dir, queueJournal))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open queue journal: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			q.replay(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read queue journal: %w", err)
+		}
+	}
+}
+
+// replay applies one journal line, counting it as corrupt if it is torn or
+// fails its checksum
+func (q *Queue) replay(line []byte) {
+	var record journalRecord
+	if !parseJournalLine(line, &record) {
+		q.corrupt++
+		return
+	}
+
+	switch record.Op {
+	case opEnqueue:
+		if record.Item != nil {
+			q.addItemLocked(record.Item)
+		}
+	case opRemove:
+		q.removeItemLocked(record.ID)
+	default:
+		q.corrupt++
+	}
+}
+
+// parseJournalLine verifies and decodes a "<crc32> <json>\n" line
+func parseJournalLine(line []byte, record *journalRecord) bool {
+	line, complete := bytes.CutSuffix(line, []byte("\n"))
+	if !complete {
+		return false
+	}
+	sum, payload, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return false
+	}
+
+	var expected uint32
+	if _, err := fmt.Sscanf(string(sum), "%08x", &expected); err != nil {
+		return false
+	}
+	if crc32.ChecksumIEEE(payload) != expected {
+		return false
+	}
+	return json.Unmarshal(payload, record) == nil
+}
+
+// addItemLocked appends a recovered request unless it is already present
+func (q *Queue) addItemLocked(item *QueuedRequest) {
+	if item == nil || item.ID == "" {
+		return
+	}
+	for _, existing := range q.items {
+		if existing.ID == item.ID {
+			return
+		}
+	}
+
+	data, err := json.Marshal(item.Request)
+	if err != nil {
+		return
+	}
+	item.size = int64(len(data))
+	q.items = append(q.items, item)
+	q.bytes += item.size
+}
+
+// removeItemLocked deletes a request by ID and reports whether it was present
+func (q *Queue) removeItemLocked(id string) bool {
+	for i, item := range q.items {
+		if item.ID == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.bytes -= item.size
+			return true
+		}
+	}
+	return false
+}
+
+// enforceLimitsLocked evicts the oldest requests until the queue fits
+func (q *Queue) enforceLimitsLocked() {
+	for len(q.items) > 0 && (len(q.items) > q.maxItems || q.bytes > q.maxBytes) {
+		oldest := q.items[0]
+		q.removeItemLocked(oldest.ID)
+		q.evicted++
+		if q.journal != nil {
+			// Best effort: if this fails the request is evicted again on load
+			q.appendLocked(journalRecord{Op: opRemove, ID: oldest.ID})
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package ai
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestQueue(t *testing.T, dataDir string, maxItems int, maxBytes int64) *Queue {
+	store, err := storage.NewManager(dataDir, 1<<20, 0.9)
+	require.NoError(t, err)
+	q, err := NewQueue(store, maxItems, maxBytes)
+	require.NoError(t, err)
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func TestQueueDuringOutageAndDrainOnRecovery(t *testing.T) {
+	var online atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !online.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response":"later answer"}`))
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, 1)
+	client.SetQueue(newTestQueue(t, t.TempDir(), 10, 1<<16))
+
+	for _, msg := range []string{"first", "second"} {
+		result, err := client.Submit(context.Background(), Request{Message: msg})
+		require.NoError(t, err)
+		require.True(t, result.IsQueued())
+		assert.Nil(t, result.Response)
+		assert.NotEmpty(t, result.Queued.ID)
+	}
+	assert.Equal(t, 2, client.Queue().Len())
+
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+	drainer, err := NewDrainer(client, log, 0)
+	require.NoError(t, err)
+
+	var answered []string
+	drainer.OnResult(func(item *QueuedRequest, resp *Response, err error) {
+		require.NoError(t, err)
+		answered = append(answered, item.Request.Message)
+	})
+
+	// Still down: nothing is drained and nothing is lost
+	assert.Equal(t, 0, drainer.Drain(context.Background()))
+	assert.Equal(t, 2, client.Queue().Len())
+
+	online.Store(true)
+	assert.Equal(t, 2, drainer.Drain(context.Background()))
+	assert.Equal(t, []string{"first", "second"}, answered)
+
+	stats := client.Queue().Stats()
+	assert.Equal(t, 0, stats.Depth)
+	assert.Equal(t, uint64(2), stats.Drained)
+	assert.Equal(t, 2.0, stats.DrainRate)
+
+	// A synchronous answer is not queued
+	result, err := client.Submit(context.Background(), Request{Message: "now"})
+	require.NoError(t, err)
+	assert.False(t, result.IsQueued())
+	assert.Equal(t, "later answer", result.Response.Text)
+}
+
+func TestQueueEvictsOldestFirst(t *testing.T) {
+	q := newTestQueue(t, t.TempDir(), 2, 1<<16)
+
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := q.Enqueue(Request{Message: msg}, "offline")
+		require.NoError(t, err)
+	}
+
+	head, ok := q.Peek()
+	require.True(t, ok)
+	assert.Equal(t, "b", head.Request.Message)
+	assert.Equal(t, uint64(1), q.Stats().Evicted)
+
+	_, err := q.Enqueue(Request{Message: string(make([]byte, 1<<17))}, "offline")
+	assert.ErrorIs(t, err, ErrRequestTooLarge)
+}
+
+func TestQueueSurvivesRestartWithCorruptJournal(t *testing.T) {
+	dataDir := t.TempDir()
+	q := newTestQueue(t, dataDir, 10, 1<<16)
+
+	first, err := q.Enqueue(Request{Message: "one"}, "offline")
+	require.NoError(t, err)
+	_, err = q.Enqueue(Request{Message: "two"}, "offline")
+	require.NoError(t, err)
+	require.NoError(t, q.Complete(first.ID))
+	_, err = q.Enqueue(Request{Message: "three"}, "offline")
+	require.NoError(t, err)
+
+	// Simulate a crash: the journal is left behind with a flipped byte in
+	// the last record and a torn write after it
+	journalPath := filepath.Join(dataDir, QueueDir, queueJournal)
+	data, err := os.ReadFile(journalPath)
+	require.NoError(t, err)
+	data[len(data)-10] ^= 0xff
+	data = append(data, []byte(`0badf00d {"op":"enq`)...)
+	require.NoError(t, os.WriteFile(journalPath, data, 0600))
+
+	restarted := newTestQueue(t, dataDir, 10, 1<<16)
+	assert.Equal(t, 1, restarted.Len())
+	head, ok := restarted.Peek()
+	require.True(t, ok)
+	assert.Equal(t, "two", head.Request.Message)
+	assert.Equal(t, uint64(2), restarted.Stats().Corrupt)
+
+	// The recovered queue keeps working and persists cleanly
+	_, err = restarted.Enqueue(Request{Message: "four"}, "offline")
+	require.NoError(t, err)
+	require.NoError(t, restarted.Close())
+
+	again := newTestQueue(t, dataDir, 10, 1<<16)
+	assert.Equal(t, 2, again.Len())
+	assert.Equal(t, uint64(0), again.Stats().Corrupt)
+}
@@ -0,0 +1,294 @@
+package ai
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// streamAccept lists the streamed formats the client reads, in order of
+// preference; a JSON or plain text answer in one piece is taken as well
+const streamAccept = "text/event-stream, application/x-ndjson, application/json;q=0.9, text/plain;q=0.8"
+
+// streamReadSize is how much of a plain text stream is read at once
+const streamReadSize = 4096
+
+// ErrStreamStalled is returned when a streamed answer went longer than the
+// client's timeout without sending anything
+var ErrStreamStalled = errors.New("AI stream stalled")
+
+// ChunkFunc receives the pieces of a streamed answer in order. An error
+// stops the stream and is returned by the query.
+type ChunkFunc func(text string) error
+
+// chunkTracker passes chunks on and remembers whether it did, since a query
+// that has passed some on cannot start over
+type chunkTracker struct {
+	onChunk ChunkFunc
+	sent    bool
+	// touch, if set, is called for every chunk received, even empty ones
+	touch func()
+}
+
+// send passes on a non-empty chunk
+func (t *chunkTracker) send(text string) error {
+	if t.touch != nil {
+		t.touch()
+	}
+	if text == "" {
+		return nil
+	}
+	t.sent = true
+	return t.onChunk(text)
+}
+
+// passedOn reports whether any chunk was passed on; a nil tracker never does
+func (t *chunkTracker) passedOn() bool {
+	return t != nil && t.sent
+}
+
+// StreamDelegate is a Delegate that can also stream its answers
+type StreamDelegate interface {
+	Delegate
+	QueryStream(ctx context.Context, req Request, onChunk ChunkFunc) (*Response, error)
+}
+
+// QueryStream sends a request asking for the answer to be streamed and passes
+// its pieces to onChunk as they arrive. The endpoint may stream server-sent
+// events or newline-delimited JSON, each event or line a {"response": ...}
+// object or plain text, or a plain text body; a JSON answer in one piece is
+// passed on whole. Instead of the overall Timeout, a stream times out with
+// ErrStreamStalled when nothing arrives for that long. Transient failures
+// are retried until the first chunk is passed on. The Response returned
+// holds the whole answer.
+func (c *Client) QueryStream(ctx context.Context, req Request, onChunk ChunkFunc) (*Response, error) {
+	if onChunk == nil {
+		return nil, fmt.Errorf("chunk function cannot be nil")
+	}
+	req.Stream = true
+	return c.query(ctx, req, onChunk)
+}
+
+// answerStream is answer for a streamed request: the endpoint first, then
+// the delegate, unless the endpoint's answer had already begun
+func (c *Client) answerStream(ctx context.Context, req Request, chunks *chunkTracker) (*Response, error) {
+	resp, err := c.QueryStream(ctx, req, chunks.send)
+	if err == nil || chunks.passedOn() || c.delegate == nil || !retryable(ctx, err) {
+		return resp, err
+	}
+
+	var derr error
+	if delegate, ok := c.delegate.(StreamDelegate); ok {
+		resp, derr = delegate.QueryStream(ctx, req, chunks.send)
+	} else if resp, derr = c.delegate.Query(ctx, req); derr == nil {
+		derr = chunks.send(resp.Text)
+	}
+	if derr != nil {
+		return nil, fmt.Errorf("%w (delegation failed: %v)", err, derr)
+	}
+	return resp, nil
+}
+
+// SubmitStream is Submit for a streamed answer: pieces of the answer go to
+// onChunk as they arrive, and a request nobody could start answering is
+// queued if the offline queue is enabled
+func (c *Client) SubmitStream(ctx context.Context, req Request, onChunk ChunkFunc) (*Result, error) {
+	chunks := &chunkTracker{onChunk: onChunk}
+	resp, err := c.answerStream(ctx, req, chunks)
+	if err == nil {
+		return &Result{Response: resp}, nil
+	}
+	if c.queue == nil || chunks.passedOn() || !retryable(ctx, err) {
+		return nil, err
+	}
+
+	req.Stream = false
+	item, qerr := c.queue.Enqueue(req, err.Error())
+	if qerr != nil {
+		return nil, fmt.Errorf("%w (and could not be queued: %v)", err, qerr)
+	}
+	return &Result{Queued: &QueuedTicket{ID: item.ID, Depth: c.queue.Len(), Reason: item.Reason}}, nil
+}
+
+// streamPiece is an event or line of a stream in JSON
+type streamPiece struct {
+	Text  string `json:"response"`
+	Model string `json:"model,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+}
+
+// readStream passes the pieces of a streamed answer to chunks and returns
+// the whole of it
+func readStream(httpResp *http.Response, chunks *chunkTracker) (*Response, error) {
+	body := io.LimitReader(httpResp.Body, maxResponseSize)
+	contentType := httpResp.Header.Get("Content-Type")
+
+	var resp Response
+	var text strings.Builder
+	piece := func(data string) (bool, error) {
+		p, err := decodePiece(data)
+		if err != nil {
+			return false, err
+		}
+		if p.Model != "" {
+			resp.Model = p.Model
+		}
+		text.WriteString(p.Text)
+		return p.Done, chunks.send(p.Text)
+	}
+
+	var err error
+	switch {
+	case strings.HasPrefix(contentType, "text/event-stream"):
+		err = readEvents(body, piece)
+	case strings.HasPrefix(contentType, "application/x-ndjson"):
+		err = readLines(body, piece)
+	case strings.HasPrefix(contentType, "application/json"):
+		// An endpoint that does not stream answers in one piece
+		var data []byte
+		if data, err = io.ReadAll(body); err != nil {
+			return nil, fmt.Errorf("failed to read AI response: %w", err)
+		}
+		whole, err := parseResponse(contentType, data)
+		if err != nil {
+			return nil, err
+		}
+		if err := chunks.send(whole.Text); err != nil {
+			return nil, err
+		}
+		return whole, nil
+	default:
+		buf := make([]byte, streamReadSize)
+		for {
+			n, rerr := body.Read(buf)
+			if n > 0 {
+				text.Write(buf[:n])
+				if err = chunks.send(string(buf[:n])); err != nil {
+					break
+				}
+			}
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				err = fmt.Errorf("failed to read AI stream: %w", rerr)
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Text = text.String()
+	if strings.TrimSpace(resp.Text) == "" {
+		return nil, ErrEmptyResponse
+	}
+	return &resp, nil
+}
+
+// decodePiece reads an event or line of a stream: a JSON object, the
+// "[DONE]" that some endpoints end with, or plain text
+func decodePiece(data string) (streamPiece, error) {
+	if data == "[DONE]" {
+		return streamPiece{Done: true}, nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(data), "{") {
+		return streamPiece{Text: data}, nil
+	}
+
+	var p streamPiece
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return p, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+	}
+	return p, nil
+}
+
+// readEvents passes the data of each server-sent event to piece until it
+// reports the stream done. Events named "done" end the stream and "error"
+// events fail it.
+func readEvents(body io.Reader, piece func(data string) (bool, error)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, streamReadSize), maxResponseSize)
+
+	var event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch {
+		case line == "":
+			if len(data) == 0 {
+				event = ""
+				continue
+			}
+			payload := strings.Join(data, "\n")
+			name := event
+			event, data = "", nil
+
+			switch name {
+			case "error":
+				return fmt.Errorf("AI endpoint failed mid-stream: %s", payload)
+			case "done":
+				if _, err := piece(doneModel(payload)); err != nil {
+					return err
+				}
+				return nil
+			}
+			done, err := piece(payload)
+			if done || err != nil {
+				return err
+			}
+		case field == "":
+			// A comment, sent to keep the connection open
+		case field == "event":
+			event = value
+		case field == "data":
+			data = append(data, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read AI stream: %w", err)
+	}
+	return nil
+}
+
+// doneModel keeps only the model of a "done" event, whose response, if any,
+// repeats the pieces already sent
+func doneModel(data string) string {
+	var p streamPiece
+	if json.Unmarshal([]byte(data), &p) != nil || p.Model == "" {
+		return ""
+	}
+	model, _ := json.Marshal(streamPiece{Model: p.Model})
+	return string(model)
+}
+
+// readLines passes each line of a newline-delimited stream to piece until it
+// reports the stream done
+func readLines(body io.Reader, piece func(data string) (bool, error)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, streamReadSize), maxResponseSize)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		done, err := piece(line)
+		if done || err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read AI stream: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package ai
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamingEndpoint serves each answer as server-sent events, one chunk
+// every delay, and the model in a closing "done" event
+func streamingEndpoint(t *testing.T, chunks []string, delay time.Duration) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.True(t, req.Stream)
+		assert.Contains(t, r.Header.Get("Accept"), "text/event-stream")
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			time.Sleep(delay)
+			data, _ := json.Marshal(streamPiece{Text: chunk})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "event: done\ndata: {\"model\":\"stub\"}\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// hangingEndpoint streams one chunk, then waits for the request to be
+// cancelled and reports it on the returned channel
+func hangingEndpoint(t *testing.T) (*httptest.Server, <-chan struct{}) {
+	cancelled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"response\":\"first\"}\n\n")
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, cancelled
+}
+
+// chunkRecorder collects streamed chunks and when each arrived
+type chunkRecorder struct {
+	chunks  []string
+	arrived []time.Time
+}
+
+func (r *chunkRecorder) record(text string) error {
+	r.chunks = append(r.chunks, text)
+	r.arrived = append(r.arrived, time.Now())
+	return nil
+}
+
+func TestQueryStreamEvents(t *testing.T) {
+	upstream := streamingEndpoint(t, []string{"Hel", "lo ", "there"}, 100*time.Millisecond)
+
+	recorder := &chunkRecorder{}
+	resp, err := newTestClient(t, upstream.URL, 0).QueryStream(context.Background(), Request{Message: "hello"}, recorder.record)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Hel", "lo ", "there"}, recorder.chunks)
+	assert.Equal(t, "Hello there", resp.Text)
+	assert.Equal(t, "stub", resp.Model)
+
+	// Chunks are passed on as they arrive, not once the answer is complete
+	assert.Greater(t, recorder.arrived[2].Sub(recorder.arrived[0]), 150*time.Millisecond)
+}
+
+func TestQueryStreamFormats(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		chunks      []string
+	}{
+		{
+			name:        "newline-delimited JSON",
+			contentType: "application/x-ndjson",
+			body:        "{\"response\":\"a\"}\n{\"response\":\"b\",\"model\":\"m\"}\n{\"done\":true}\n{\"response\":\"ignored\"}\n",
+			chunks:      []string{"a", "b"},
+		},
+		{
+			name:        "plain text events",
+			contentType: "text/event-stream",
+			body:        ": keep-alive\n\ndata: a\n\ndata: b\n\ndata: [DONE]\n\n",
+			chunks:      []string{"a", "b"},
+		},
+		{
+			name:        "JSON in one piece",
+			contentType: "application/json",
+			body:        `{"response":"ab"}`,
+			chunks:      []string{"ab"},
+		},
+		{
+			name:        "plain text",
+			contentType: "text/plain",
+			body:        "ab",
+			chunks:      []string{"ab"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+			}))
+			defer upstream.Close()
+
+			recorder := &chunkRecorder{}
+			resp, err := newTestClient(t, upstream.URL, 0).QueryStream(context.Background(), Request{Message: "hello"}, recorder.record)
+			require.NoError(t, err)
+			assert.Equal(t, tt.chunks, recorder.chunks)
+			assert.Equal(t, "ab", resp.Text)
+		})
+	}
+}
+
+func TestQueryStreamCancelReachesUpstream(t *testing.T) {
+	upstream, cancelled := hangingEndpoint(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := newTestClient(t, upstream.URL, 3).QueryStream(ctx, Request{Message: "hello"}, func(text string) error {
+		assert.Equal(t, "first", text)
+		cancel()
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the endpoint never saw the request cancelled")
+	}
+}
+
+func TestQueryStreamOutlastsTimeout(t *testing.T) {
+	// Four chunks 400ms apart take longer than the 1s timeout in all
+	upstream := streamingEndpoint(t, []string{"a", "b", "c", "d"}, 400*time.Millisecond)
+	client, err := NewClient(config.AIConfig{Endpoint: upstream.URL, Timeout: 1})
+	require.NoError(t, err)
+
+	recorder := &chunkRecorder{}
+	resp, err := client.QueryStream(context.Background(), Request{Message: "hello"}, recorder.record)
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", resp.Text)
+
+	// but a stream that goes quiet for that long fails
+	stalled, _ := hangingEndpoint(t)
+	client, err = NewClient(config.AIConfig{Endpoint: stalled.URL, Timeout: 1, MaxRetries: 3})
+	require.NoError(t, err)
+	_, err = client.QueryStream(context.Background(), Request{Message: "hello"}, func(string) error { return nil })
+	assert.ErrorIs(t, err, ErrStreamStalled)
+}
+
+func TestQueryHandlerStreams(t *testing.T) {
+	upstream := streamingEndpoint(t, []string{"Hel", "lo ", "there"}, 50*time.Millisecond)
+	server := httptest.NewServer(QueryHandler(newTestClient(t, upstream.URL, 0)))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(`{"message":"hello"}`))
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	var events, data []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, event)
+		}
+		if payload, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			data = append(data, payload)
+		}
+	}
+	assert.Equal(t, []string{"chunk", "chunk", "chunk", "done"}, events)
+	require.Len(t, data, 4)
+	assert.JSONEq(t, `{"response":"lo "}`, data[1])
+	var done Response
+	require.NoError(t, json.Unmarshal([]byte(data[3]), &done))
+	assert.Equal(t, "Hello there", done.Text)
+
+	// A failure before the first chunk is still answered with a status
+	broken := stubEndpoint(t, http.StatusBadRequest, "rejected")
+	rec := httptest.NewRecorder()
+	QueryHandler(newTestClient(t, broken.URL, 0))(rec, httptest.NewRequest(http.MethodPost, "/ai/query", strings.NewReader(`{"message":"hello","stream":true}`)))
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+}
@@ -0,0 +1,290 @@
+// Package audit keeps an append-only record of security relevant peer
+// events: who connected from where with which key, and why they left.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogFile is the name of the audit log under the data directory
+const LogFile = "audit.log"
+
+// Default limits of the audit log
+const (
+	DefaultMaxFileSize = 10 << 20
+	DefaultMaxFiles    = 5
+	DefaultRateLimit   = 50
+)
+
+// Audited peer lifecycle events
+const (
+	EventHandshakeSucceeded  = "handshake_succeeded"
+	EventHandshakeFailed     = "handshake_failed"
+	EventPeerDisconnected    = "peer_disconnected"
+	EventReputationLow       = "reputation_below_threshold"
+	EventReputationRecovered = "reputation_recovered"
+	EventKeyRotated          = "key_rotated"
+)
+
+// Entry is one line of the audit log
+type Entry struct {
+	// Seq numbers entries in the order they were written, across rotations
+	Seq            uint64    `json:"seq"`
+	Time           time.Time `json:"time"`
+	Event          string    `json:"event"`
+	PeerID         string    `json:"peer_id,omitempty"`
+	Address        string    `json:"address,omitempty"`
+	Direction      string    `json:"direction,omitempty"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	// TraceID is the trace of the message the event happened on account
+	// of, if one did
+	TraceID string `json:"trace_id,omitempty"`
+	// Reputation is set on reputation events, where zero is meaningful
+	Reputation *float64 `json:"reputation,omitempty"`
+	// Dropped counts the entries refused by the rate limit since the
+	// previous entry was written
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// Config bounds the size and write rate of an audit log
+type Config struct {
+	// MaxFileSize is the size in bytes at which the log is rotated
+	MaxFileSize int64
+	// MaxFiles is how many rotated files are kept besides the current one
+	MaxFiles int
+	// RateLimit is how many entries may be written per second, in bursts
+	// of up to as many
+	RateLimit int
+}
+
+// Log appends entries as JSON lines to a file, rotating it to file.1,
+// file.2 and so on once it grows past MaxFileSize. The file is opened on
+// the first write and closed by Close.
+type Log struct {
+	path   string
+	config Config
+	file   *os.File
+	size   int64
+	seq    uint64
+	loaded bool
+
+	// Token bucket bounding the write rate
+	tokens  float64
+	refill  time.Time
+	dropped uint64
+	now     func() time.Time
+
+	mu sync.Mutex
+}
+
+// New creates an audit log writing to path. Zero limits take their defaults.
+func New(path string, cfg Config) *Log {
+	if cfg.MaxFileSize <= 0 {
+		cfg.MaxFileSize = DefaultMaxFileSize
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = DefaultMaxFiles
+	}
+	if cfg.RateLimit <= 0 {
+		cfg.RateLimit = DefaultRateLimit
+	}
+	return &Log{
+		path:   path,
+		config: cfg,
+		tokens: float64(cfg.RateLimit),
+		now:    time.Now,
+	}
+}
+
+// Record appends an entry, stamping its sequence number and, if unset, its
+// time. Entries beyond the rate limit are dropped and counted on the next
+// entry written.
+func (l *Log) Record(entry Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.allow() {
+		l.dropped++
+		return nil
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	l.seq++
+	entry.Seq = l.seq
+	if entry.Time.IsZero() {
+		entry.Time = l.now()
+	}
+	entry.Dropped = l.dropped
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.config.MaxFileSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit entry: %w", err)
+	}
+	l.dropped = 0
+	return nil
+}
+
+// allow takes a token from the bucket if one is left
+func (l *Log) allow() bool {
+	now := l.now()
+	if !l.refill.IsZero() {
+		l.tokens += now.Sub(l.refill).Seconds() * float64(l.config.RateLimit)
+		if limit := float64(l.config.RateLimit); l.tokens > limit {
+			l.tokens = limit
+		}
+	}
+	l.refill = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// open opens the current file for appending and, the first time, picks up
+// the sequence where an earlier run left off
+func (l *Log) open() error {
+	if l.file != nil {
+		return nil
+	}
+	if !l.loaded {
+		for i := 0; i <= l.config.MaxFiles; i++ {
+			entries, err := readFile(l.rotatedPath(i))
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				l.seq = entries[len(entries)-1].Seq
+				break
+			}
+		}
+		l.loaded = true
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate shifts every file up one place, dropping the oldest, and starts a
+// new current file
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	l.file = nil
+
+	for i := l.config.MaxFiles; i > 0; i-- {
+		err := os.Rename(l.rotatedPath(i-1), l.rotatedPath(i))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	return l.open()
+}
+
+// rotatedPath returns the path of the i-th most recently rotated file; 0 is
+// the current file
+func (l *Log) rotatedPath(i int) string {
+	if i == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// Since returns the entries recorded at or after since, oldest first,
+// including those in rotated files
+func (l *Log) Since(since time.Time) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entries []Entry
+	for i := l.config.MaxFiles; i >= 0; i-- {
+		fileEntries, err := readFile(l.rotatedPath(i))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range fileEntries {
+			if !entry.Time.Before(since) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Close closes the current file; a later Record opens it again
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// readFile reads the entries of one log file. A missing file has none, and
+// a line cut short by a crash is skipped.
+func readFile(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry Entry
+			if json.Unmarshal(line, &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndSince(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LogFile)
+	log := New(path, Config{})
+	defer log.Close()
+
+	start := time.Now()
+	require.NoError(t, log.Record(Entry{Event: EventHandshakeSucceeded, PeerID: "peer-a", Address: "10.0.0.1:8080", KeyFingerprint: "ab:cd"}))
+	require.NoError(t, log.Record(Entry{Event: EventPeerDisconnected, PeerID: "peer-a", Reason: "goodbye"}))
+
+	entries, err := log.Since(time.Time{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint64(1), entries[0].Seq)
+	assert.Equal(t, EventHandshakeSucceeded, entries[0].Event)
+	assert.Equal(t, "ab:cd", entries[0].KeyFingerprint)
+	assert.False(t, entries[0].Time.Before(start))
+	assert.Equal(t, "goodbye", entries[1].Reason)
+
+	entries, err = log.Since(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Only the owner may read the log
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestRotationPreservesOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LogFile)
+	log := New(path, Config{MaxFileSize: 300, MaxFiles: 3, RateLimit: 1000})
+
+	for i := 0; i < 12; i++ {
+		require.NoError(t, log.Record(Entry{Event: EventPeerDisconnected, PeerID: "peer", Reason: "closed"}))
+	}
+	require.FileExists(t, path+".1")
+	require.FileExists(t, path+".3")
+	assert.NoFileExists(t, path+".4")
+
+	entries, err := log.Since(time.Time{})
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	assert.Less(t, len(entries), 12, "the oldest file should have been dropped")
+	for i := 1; i < len(entries); i++ {
+		assert.Equal(t, entries[i-1].Seq+1, entries[i].Seq)
+	}
+	assert.Equal(t, uint64(12), entries[len(entries)-1].Seq)
+
+	// A reopened log carries on numbering where it left off
+	require.NoError(t, log.Close())
+	reopened := New(path, Config{MaxFileSize: 300, MaxFiles: 3, RateLimit: 1000})
+	defer reopened.Close()
+	require.NoError(t, reopened.Record(Entry{Event: EventHandshakeFailed, Reason: "bad signature"}))
+	entries, err = reopened.Since(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(13), entries[len(entries)-1].Seq)
+}
+
+func TestRateLimit(t *testing.T) {
+	log := New(filepath.Join(t.TempDir(), LogFile), Config{RateLimit: 2})
+	defer log.Close()
+	now := time.Unix(1000, 0)
+	log.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, log.Record(Entry{Event: EventHandshakeFailed}))
+	}
+	entries, err := log.Since(time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// The next entry once the bucket refills reports what was dropped
+	now = now.Add(time.Second)
+	require.NoError(t, log.Record(Entry{Event: EventHandshakeFailed}))
+	entries, err = log.Since(time.Time{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, uint64(3), entries[2].Dropped)
+}
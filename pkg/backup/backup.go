@@ -0,0 +1,429 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+)
+
+const (
+	// Dir is the directory under the data directory that holds archives
+	Dir = "backups"
+
+	// ManifestFile is the name of the checksum manifest inside an archive
+	ManifestFile = "MANIFEST.json"
+
+	// LockFile marks a data directory that is in use by a running node
+	LockFile = "synapse.lock"
+
+	// BlobDir is the directory of blobs under the data directory, left out
+	// of archives as blobs can be fetched again from peers and may be far
+	// larger than the rest of the state
+	BlobDir = "blobs"
+
+	// DefaultRetention is how many archives are kept when none is configured
+	DefaultRetention = 7
+
+	archivePrefix = "backup-"
+	archiveSuffix = ".tar.gz"
+	timeFormat    = "20060102T150405.000000000Z"
+)
+
+// ErrNodeRunning is returned by offline operations on a data directory that
+// a running node holds
+var ErrNodeRunning = errors.New("node is running")
+
+// ErrCorruptArchive is returned when an archive does not match its manifest
+var ErrCorruptArchive = errors.New("backup archive is corrupt")
+
+// Manifest lists the SHA-256 checksum of every file in an archive
+type Manifest struct {
+	NodeID    string            `json:"node_id,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Files     map[string]string `json:"files"`
+}
+
+// Manager snapshots the node's persistent state into timestamped archives
+// under DataDir/backups and prunes all but the newest ones
+type Manager struct {
+	storage   *storage.Manager
+	logger    *logger.Logger
+	nodeID    string
+	retention int
+	interval  time.Duration
+
+	// flushers persist in-memory state before a snapshot is taken
+	flushers []func() error
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewManager creates a backup manager for the storage manager's data directory
+func NewManager(store *storage.Manager, log *logger.Logger, nodeID string, retention int, interval time.Duration) (*Manager, error) {
+	if store == nil {
+		return nil, fmt.Errorf("storage manager cannot be nil")
+	}
+	if log == nil {
+		return nil, fmt.Errorf("logger cannot be nil")
+	}
+	if retention < 1 {
+		retention = DefaultRetention
+	}
+
+	return &Manager{
+		storage:   store,
+		logger:    log.With("component", "backup"),
+		nodeID:    nodeID,
+		retention: retention,
+		interval:  interval,
+	}, nil
+}
+
+// AddFlusher registers a function that saves a component's state to disk.
+// Flushers run before every snapshot.
+func (m *Manager) AddFlusher(flush func() error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushers = append(m.flushers, flush)
+}
+
+// Start takes a backup every interval until Stop or ctx is done
+func (m *Manager) Start(ctx context.Context) {
+	if m.interval <= 0 {
+		return
+	}
+
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if archive, err := m.Create(); err != nil {
+					m.logger.Errorf("scheduled backup failed: %v", err)
+				} else {
+					m.logger.Infof("created backup %s", archive)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends scheduled backups
+func (m *Manager) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+}
+
+// Create flushes every registered component, snapshots the data directory
+// while writes are held back, and writes the archive. It returns the path of
+// the new archive.
+func (m *Manager) Create() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, flush := range m.flushers {
+		if err := flush(); err != nil {
+			return "", fmt.Errorf("failed to flush state before backup: %w", err)
+		}
+	}
+
+	now := time.Now().UTC()
+	var archive []byte
+	err := m.storage.Freeze(func() error {
+		var err error
+		archive, err = buildArchive(m.storage.Dir(), m.nodeID, now)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(m.storage.Dir(), Dir, archivePrefix+now.Format(timeFormat)+archiveSuffix)
+	if err := m.storage.WriteFile(name, archive, 0600); err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	if err := m.prune(); err != nil {
+		m.logger.Warnf("failed to prune old backups: %v", err)
+	}
+
+	return name, nil
+}
+
+// List returns the archives in the data directory, oldest first
+func (m *Manager) List() ([]string, error) {
+	return List(m.storage.Dir())
+}
+
+// prune deletes all but the newest retention archives
+func (m *Manager) prune() error {
+	archives, err := m.List()
+	if err != nil {
+		return err
+	}
+
+	for len(archives) > m.retention {
+		if err := m.storage.Remove(archives[0]); err != nil {
+			return err
+		}
+		archives = archives[1:]
+	}
+	return nil
+}
+
+// List returns the archives under dataDir, oldest first
+func List(dataDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dataDir, Dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var archives []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, archivePrefix) && strings.HasSuffix(name, archiveSuffix) {
+			archives = append(archives, filepath.Join(dataDir, Dir, name))
+		}
+	}
+	// Timestamps in the names sort chronologically
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// CheckStopped returns ErrNodeRunning if a node holds the data directory
+func CheckStopped(dataDir string) error {
+	if _, err := os.Stat(filepath.Join(dataDir, LockFile)); err == nil {
+		return fmt.Errorf("%s is locked by %s; stop the node or remove the lock if it crashed: %w",
+			dataDir, LockFile, ErrNodeRunning)
+	}
+	return nil
+}
+
+// included reports whether a data directory file belongs in a backup: state
+// files yes; archives, blobs, logs, locks and half-written temporaries no
+func included(rel string) bool {
+	if rel == LockFile || strings.HasPrefix(rel, Dir+"/") || strings.HasPrefix(rel, BlobDir+"/") {
+		return false
+	}
+	ext := path.Ext(rel)
+	return ext != ".tmp" && ext != ".log"
+}
+
+// buildArchive packs the state files under dataDir and their manifest into a
+// gzipped tarball
+func buildArchive(dataDir, nodeID string, createdAt time.Time) ([]byte, error) {
+	manifest := Manifest{
+		NodeID:    nodeID,
+		CreatedAt: createdAt,
+		Files:     make(map[string]string),
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(dataDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dataDir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !included(rel) {
+			return nil
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		manifest.Files[rel] = hex.EncodeToString(sum[:])
+		return writeTarFile(tw, rel, data, info.Mode().Perm(), info.ModTime())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot data directory: %w", err)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	if err := writeTarFile(tw, ManifestFile, manifestData, 0644, createdAt); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress archive: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTarFile adds a single file to the archive
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode fs.FileMode, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    int64(mode),
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to add %s to archive: %w", name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to add %s to archive: %w", name, err)
+	}
+	return nil
+}
+
+// Verify reads an archive and checks every file against its manifest
+func Verify(archive string) (*Manifest, error) {
+	manifest, _, err := readArchive(archive)
+	return manifest, err
+}
+
+// Restore verifies an archive and writes its files into dataDir. The node
+// using dataDir must be stopped.
+func Restore(archive, dataDir string) (*Manifest, error) {
+	if err := CheckStopped(dataDir); err != nil {
+		return nil, err
+	}
+
+	manifest, files, err := readArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		file := files[name]
+		target := filepath.Join(dataDir, filepath.FromSlash(name))
+		if err := storage.WriteFileAtomic(target, file.data, file.mode); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+
+	return manifest, nil
+}
+
+// archivedFile is a file read from an archive
+type archivedFile struct {
+	data []byte
+	mode fs.FileMode
+}
+
+// readArchive loads every file in an archive and verifies it against the
+// manifest. Nothing is returned unless the whole archive is intact.
+func readArchive(archive string) (*Manifest, map[string]archivedFile, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v: %w", archive, err, ErrCorruptArchive)
+	}
+	defer gz.Close()
+
+	var manifest *Manifest
+	files := make(map[string]archivedFile)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v: %w", archive, err, ErrCorruptArchive)
+		}
+
+		name := path.Clean(header.Name)
+		if header.Typeflag != tar.TypeReg || !fs.ValidPath(name) {
+			return nil, nil, fmt.Errorf("%s: unexpected entry %q: %w", archive, header.Name, ErrCorruptArchive)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v: %w", archive, err, ErrCorruptArchive)
+		}
+
+		if name == ManifestFile {
+			manifest = &Manifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, nil, fmt.Errorf("%s: invalid manifest: %w", archive, ErrCorruptArchive)
+			}
+			continue
+		}
+		files[name] = archivedFile{data: data, mode: fs.FileMode(header.Mode).Perm()}
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("%s: missing %s: %w", archive, ManifestFile, ErrCorruptArchive)
+	}
+	if len(files) != len(manifest.Files) {
+		return nil, nil, fmt.Errorf("%s: manifest lists %d files, archive has %d: %w",
+			archive, len(manifest.Files), len(files), ErrCorruptArchive)
+	}
+	for name, file := range files {
+		sum := sha256.Sum256(file.data)
+		if manifest.Files[name] != hex.EncodeToString(sum[:]) {
+			return nil, nil, fmt.Errorf("%s: checksum mismatch for %s: %w", archive, name, ErrCorruptArchive)
+		}
+	}
+
+	return manifest, files, nil
+}
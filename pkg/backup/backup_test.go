@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestManager(t *testing.T, dataDir string, retention int) *Manager {
+	store, err := storage.NewManager(dataDir, 1<<20, 0.9)
+	require.NoError(t, err)
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+
+	m, err := NewManager(store, log, "backup-node", retention, 0)
+	require.NoError(t, err)
+	return m
+}
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestCreateAndRestore(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFile(t, filepath.Join(dataDir, "identity.json"), `{"node_id":"backup-node"}`)
+	writeFile(t, filepath.Join(dataDir, "peers.json"), `[]`)
+	writeFile(t, filepath.Join(dataDir, "nested", "state.json"), `{}`)
+	writeFile(t, filepath.Join(dataDir, "synapse.log"), "log line\n")
+	writeFile(t, filepath.Join(dataDir, "store.json.tmp"), "partial")
+	writeFile(t, filepath.Join(dataDir, "blobs", "ab", "abcdef"), "blob")
+	writeFile(t, filepath.Join(dataDir, "blobs", "partial", "abcdef.part"), "bl")
+
+	m := newTestManager(t, dataDir, 3)
+
+	// Flushers run before the snapshot so their output is captured
+	m.AddFlusher(func() error {
+		return os.WriteFile(filepath.Join(dataDir, "store.json"), []byte(`[{"key":"k"}]`), 0644)
+	})
+
+	archive, err := m.Create()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dataDir, Dir), filepath.Dir(archive))
+
+	manifest, err := Verify(archive)
+	require.NoError(t, err)
+	assert.Equal(t, "backup-node", manifest.NodeID)
+	assert.ElementsMatch(t, []string{"identity.json", "peers.json", "nested/state.json", "store.json"}, keys(manifest.Files))
+
+	restoreDir := t.TempDir()
+	_, err = Restore(archive, restoreDir)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(restoreDir, "store.json"))
+	require.NoError(t, err)
+	assert.Equal(t, `[{"key":"k"}]`, string(data))
+	data, err = os.ReadFile(filepath.Join(restoreDir, "nested", "state.json"))
+	require.NoError(t, err)
+	assert.Equal(t, `{}`, string(data))
+	assert.NoFileExists(t, filepath.Join(restoreDir, "synapse.log"))
+}
+
+func TestRetention(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFile(t, filepath.Join(dataDir, "peers.json"), `[]`)
+	m := newTestManager(t, dataDir, 2)
+
+	var created []string
+	for i := 0; i < 4; i++ {
+		archive, err := m.Create()
+		require.NoError(t, err)
+		created = append(created, archive)
+	}
+
+	archives, err := m.List()
+	require.NoError(t, err)
+	assert.Equal(t, created[2:], archives)
+}
+
+func TestCorruptArchiveIsRejected(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFile(t, filepath.Join(dataDir, "peers.json"), `[{"node_id":"a"}]`)
+	m := newTestManager(t, dataDir, 1)
+
+	archive, err := m.Create()
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(archive)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(archive, data, 0600))
+
+	restoreDir := t.TempDir()
+	_, err = Restore(archive, restoreDir)
+	assert.ErrorIs(t, err, ErrCorruptArchive)
+	assert.NoFileExists(t, filepath.Join(restoreDir, "peers.json"))
+}
+
+func TestRestoreRefusesRunningNode(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFile(t, filepath.Join(dataDir, "peers.json"), `[]`)
+	archive, err := newTestManager(t, dataDir, 1).Create()
+	require.NoError(t, err)
+
+	target := t.TempDir()
+	writeFile(t, filepath.Join(target, LockFile), "1234")
+
+	_, err = Restore(archive, target)
+	assert.ErrorIs(t, err, ErrNodeRunning)
+}
+
+func keys(m map[string]string) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
@@ -0,0 +1,570 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+)
+
+// maxAnnounceHashes caps the hashes in a single BLOB_ANNOUNCE, keeping it
+// well below the frame limit
+const maxAnnounceHashes = 4096
+
+// ErrNoHolder is returned by Fetch when no connected peer could provide a
+// blob
+var ErrNoHolder = errors.New("no connected peer holds the blob")
+
+// Stats counts the blobs a node stored, fetched and served
+type Stats struct {
+	Held           int    `json:"held"`
+	Stored         uint64 `json:"stored"`
+	Fetched        uint64 `json:"fetched"`
+	Resumed        uint64 `json:"resumed"`
+	HashMismatches uint64 `json:"hash_mismatches"`
+	Collected      uint64 `json:"collected"`
+	BytesFetched   int64  `json:"bytes_fetched"`
+	BytesServed    int64  `json:"bytes_served"`
+}
+
+// Service shares a Store with the mesh: it tells peers which blobs the node
+// holds, serves them in chunks, and fetches blobs from the peers that
+// announced them. A download cut short is resumed from where it stopped,
+// from the same peer or another, and checked against its hash once
+// complete.
+type Service struct {
+	store        *Store
+	network      *p2p.Network
+	logger       *logger.Logger
+	chunkSize    int
+	chunkTimeout time.Duration
+	gcInterval   time.Duration
+	gcGrace      time.Duration
+
+	// holders holds, per blob, the peers that announced it
+	holders map[string]map[string]bool
+	// fetches holds the downloads in progress, which fetches of the same
+	// blob wait for instead of starting another
+	fetches map[string]*fetch
+	stats   Stats
+	mu      sync.Mutex
+
+	// onChunk, if set, is called after a fetch stores each chunk
+	onChunk func(hash string, offset int64)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// fetch is a download others can wait for
+type fetch struct {
+	done chan struct{}
+	info Info
+	err  error
+}
+
+// NewService creates the blob service for a node, sharing store over network
+func NewService(store *Store, network *p2p.Network, log *logger.Logger, cfg config.BlobConfig) (*Service, error) {
+	if store == nil {
+		return nil, fmt.Errorf("store cannot be nil")
+	}
+	if network == nil {
+		return nil, fmt.Errorf("network cannot be nil")
+	}
+	if log == nil {
+		return nil, fmt.Errorf("logger cannot be nil")
+	}
+
+	chunkSize := cfg.ChunkSize
+	if chunkSize < 1 || chunkSize > config.MaxBlobChunkSize {
+		chunkSize = config.MaxBlobChunkSize / 2
+	}
+	chunkTimeout := time.Duration(cfg.ChunkTimeout) * time.Second
+	if chunkTimeout <= 0 {
+		chunkTimeout = p2p.DefaultRequestTimeout
+	}
+	gcInterval := time.Duration(cfg.GCInterval) * time.Second
+	if gcInterval <= 0 {
+		gcInterval = time.Hour
+	}
+
+	return &Service{
+		store:        store,
+		network:      network,
+		logger:       log.With("component", "blobs"),
+		chunkSize:    chunkSize,
+		chunkTimeout: chunkTimeout,
+		gcInterval:   gcInterval,
+		gcGrace:      time.Duration(cfg.GCGrace) * time.Second,
+		holders:      make(map[string]map[string]bool),
+		fetches:      make(map[string]*fetch),
+	}, nil
+}
+
+// Start serves blobs to peers and collects unreferenced ones. It must be
+// called before the network starts so the blob capability is advertised in
+// our first HELLO.
+func (s *Service) Start(ctx context.Context) {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+
+	s.network.RegisterHandler(p2p.MessageTypeBlobAnnounce, s.handleAnnounce)
+	s.network.RegisterHandler(p2p.MessageTypeBlobRequest, s.handleRequest)
+	s.network.AdvertiseCapability(p2p.CapabilityBlob, func() bool { return true })
+	s.network.AddReportSection("blobs", func() interface{} { return s.Stats() })
+
+	events, unsubscribe := s.network.Subscribe(64)
+	s.wg.Add(1)
+	go s.run(events, unsubscribe)
+}
+
+// Stop ends collection and waits for it
+func (s *Service) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+// Store returns the blobs the node holds
+func (s *Service) Store() *Store {
+	return s.store
+}
+
+// Put stores a blob and announces it to the mesh
+func (s *Service) Put(r io.Reader) (Info, error) {
+	info, err := s.store.Put(r)
+	if err != nil {
+		return Info{}, err
+	}
+	s.count(func(stats *Stats) { stats.Stored++ })
+
+	if err := s.gossip([]string{info.Hash}); err != nil {
+		s.logger.Debugf("failed to announce blob %s: %v", info.Hash, err)
+	}
+	return info, nil
+}
+
+// Announce gossips the hashes of every blob the node holds, so peers beyond
+// its direct neighbours know where to fetch them
+func (s *Service) Announce() error {
+	hashes, err := s.hashes()
+	if err != nil {
+		return err
+	}
+	return s.gossip(hashes)
+}
+
+// Holders returns the connected peers known to hold a blob
+func (s *Service) Holders(hash string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var peers []string
+	for peerID := range s.holders[hash] {
+		if peer, ok := s.network.Peer(peerID); ok && peer.Connected {
+			peers = append(peers, peerID)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Fetch returns a blob, downloading it from a peer unless the node already
+// holds it. Peers that announced the blob are asked first, then every other
+// connected peer serving blobs. A download cut short is kept and resumed by
+// the next fetch of the blob.
+func (s *Service) Fetch(ctx context.Context, hash string) (Info, error) {
+	if !ValidHash(hash) {
+		return Info{}, fmt.Errorf("%q: %w", hash, ErrInvalidHash)
+	}
+	if info, err := s.store.Stat(hash); err == nil {
+		return info, nil
+	}
+
+	s.mu.Lock()
+	if f, running := s.fetches[hash]; running {
+		s.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.info, f.err
+		case <-ctx.Done():
+			return Info{}, ctx.Err()
+		}
+	}
+	f := &fetch{done: make(chan struct{})}
+	s.fetches[hash] = f
+	s.mu.Unlock()
+
+	f.info, f.err = s.download(ctx, hash)
+
+	s.mu.Lock()
+	delete(s.fetches, hash)
+	s.mu.Unlock()
+	close(f.done)
+
+	return f.info, f.err
+}
+
+// GC removes the blobs nothing references, once the grace period has passed
+func (s *Service) GC() (GCResult, error) {
+	result, err := s.store.GC(s.gcGrace)
+	s.count(func(stats *Stats) { stats.Collected += uint64(result.Removed) })
+	if result.Removed > 0 {
+		s.logger.Infof("collected %d unreferenced blobs, freeing %d bytes", result.Removed, result.Freed)
+	}
+	return result, err
+}
+
+// Stats returns the service's counters
+func (s *Service) Stats() Stats {
+	blobs, _ := s.store.List()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Held = len(blobs)
+	return stats
+}
+
+// download fetches a blob from each candidate peer in turn until one
+// provides all of it
+func (s *Service) download(ctx context.Context, hash string) (Info, error) {
+	candidates := s.candidates(hash)
+	if len(candidates) == 0 {
+		return Info{}, fmt.Errorf("%s: %w", hash, ErrNoHolder)
+	}
+
+	var lastErr error
+	for _, peerID := range candidates {
+		info, err := s.fetchFrom(ctx, peerID, hash)
+		if err == nil {
+			s.count(func(stats *Stats) { stats.Fetched++ })
+			if err := s.gossip([]string{hash}); err != nil {
+				s.logger.Debugf("failed to announce blob %s: %v", hash, err)
+			}
+			return info, nil
+		}
+		if ctx.Err() != nil {
+			return Info{}, err
+		}
+		s.logger.Debugf("failed to fetch blob %s from %s: %v", hash, peerID, err)
+		lastErr = err
+	}
+	return Info{}, fmt.Errorf("%w: %s tried on %d peers: %w", ErrNoHolder, hash, len(candidates), lastErr)
+}
+
+// candidates returns the connected peers to ask for a blob: those that
+// announced it first, then the rest of those serving blobs
+func (s *Service) candidates(hash string) []string {
+	holders := s.Holders(hash)
+	peers := append([]string(nil), holders...)
+	announced := make(map[string]bool)
+	for _, peerID := range holders {
+		announced[peerID] = true
+	}
+	for _, peer := range s.network.PeersWithCapability(p2p.CapabilityBlob) {
+		if !announced[peer.ID] {
+			peers = append(peers, peer.ID)
+		}
+	}
+	return peers
+}
+
+// fetchFrom downloads the rest of a blob from a peer chunk by chunk,
+// starting after what earlier downloads kept
+func (s *Service) fetchFrom(ctx context.Context, peerID, hash string) (Info, error) {
+	offset := s.store.partialSize(hash)
+	if offset > 0 {
+		s.count(func(stats *Stats) { stats.Resumed++ })
+		s.logger.Debugf("resuming blob %s from %s at offset %d", hash, peerID, offset)
+	}
+
+	file, err := s.store.appendPartial(hash)
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to open download of %s: %w", hash, err)
+	}
+	complete, err := s.fetchChunks(ctx, peerID, hash, offset, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !complete {
+		return Info{}, err
+	}
+
+	info, err := s.store.completePartial(hash)
+	if errors.Is(err, ErrHashMismatch) {
+		s.count(func(stats *Stats) { stats.HashMismatches++ })
+		s.forget(hash, peerID)
+	}
+	return info, err
+}
+
+// fetchChunks requests the chunks of a blob from offset on and appends them
+// to file, reporting whether it received the whole blob
+func (s *Service) fetchChunks(ctx context.Context, peerID, hash string, offset int64, file io.Writer) (bool, error) {
+	checked := false
+	for {
+		chunk, err := s.requestChunk(ctx, peerID, hash, offset)
+		if err != nil {
+			return false, err
+		}
+
+		if offset > chunk.Size {
+			// What we kept cannot be part of the blob
+			s.store.dropPartial(hash)
+			return false, fmt.Errorf("download of %s holds %d bytes of a %d byte blob: %w", hash, offset, chunk.Size, ErrHashMismatch)
+		}
+		if !checked {
+			if err := s.store.files.Check(chunk.Size - offset); err != nil {
+				return false, fmt.Errorf("no room for blob %s: %w", hash, err)
+			}
+			checked = true
+		}
+		if offset == chunk.Size {
+			return true, nil
+		}
+		if len(chunk.Data) == 0 || offset+int64(len(chunk.Data)) > chunk.Size {
+			return false, fmt.Errorf("%s sent %d bytes at offset %d of a %d byte blob", peerID, len(chunk.Data), offset, chunk.Size)
+		}
+
+		if _, err := file.Write(chunk.Data); err != nil {
+			return false, fmt.Errorf("failed to write download of %s: %w", hash, err)
+		}
+		offset += int64(len(chunk.Data))
+		s.count(func(stats *Stats) { stats.BytesFetched += int64(len(chunk.Data)) })
+		if s.onChunk != nil {
+			s.onChunk(hash, offset)
+		}
+	}
+}
+
+// requestChunk asks a peer for the chunk of a blob at offset
+func (s *Service) requestChunk(ctx context.Context, peerID, hash string, offset int64) (p2p.BlobChunkPayload, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.chunkTimeout)
+	defer cancel()
+
+	req := p2p.NewMessage(p2p.MessageTypeBlobRequest, s.network.NodeID(), p2p.BlobRequestPayload{
+		Hash:   hash,
+		Offset: offset,
+		Length: s.chunkSize,
+	})
+	reply, err := s.network.Request(ctx, peerID, req)
+	if err != nil {
+		var remote *p2p.ErrorPayload
+		if errors.As(err, &remote) && remote.Code == p2p.ErrorCodeNotFound {
+			s.forget(hash, peerID)
+		}
+		return p2p.BlobChunkPayload{}, fmt.Errorf("request for %s at offset %d failed: %w", hash, offset, err)
+	}
+
+	var chunk p2p.BlobChunkPayload
+	if err := reply.DecodePayload(&chunk); err != nil {
+		return chunk, fmt.Errorf("invalid chunk of %s from %s: %w", hash, peerID, err)
+	}
+	if chunk.Hash != hash || chunk.Offset != offset {
+		return chunk, fmt.Errorf("%s answered for %s at offset %d, not %s at %d", peerID, chunk.Hash, chunk.Offset, hash, offset)
+	}
+	return chunk, nil
+}
+
+// handleRequest answers a BLOB_REQUEST with the chunk it asked for
+func (s *Service) handleRequest(msg p2p.Message) {
+	var request p2p.BlobRequestPayload
+	if err := msg.DecodePayload(&request); err != nil {
+		s.replyError(msg, p2p.ErrorCodeInvalidMessage, err.Error())
+		return
+	}
+
+	file, err := s.store.Open(request.Hash)
+	if err != nil {
+		s.replyError(msg, p2p.ErrorCodeNotFound, err.Error())
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		s.replyError(msg, p2p.ErrorCodeNotFound, err.Error())
+		return
+	}
+	if request.Offset > info.Size() {
+		s.replyError(msg, p2p.ErrorCodeInvalidMessage, fmt.Sprintf("offset %d is past the end of %s", request.Offset, request.Hash))
+		return
+	}
+
+	length := int64(request.Length)
+	if length > int64(s.chunkSize) {
+		length = int64(s.chunkSize)
+	}
+	if remaining := info.Size() - request.Offset; length > remaining {
+		length = remaining
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, request.Offset); err != nil && !errors.Is(err, io.EOF) {
+		s.replyError(msg, p2p.ErrorCodeNotFound, fmt.Sprintf("failed to read %s: %v", request.Hash, err))
+		return
+	}
+
+	chunk := p2p.BlobChunkPayload{Hash: request.Hash, Offset: request.Offset, Size: info.Size(), Data: data}
+	if err := s.network.Reply(msg, p2p.MessageTypeBlobChunk, chunk); err != nil {
+		s.logger.Debugf("failed to send chunk of %s to %s: %v", request.Hash, msg.Sender, err)
+		return
+	}
+	s.count(func(stats *Stats) { stats.BytesServed += length })
+}
+
+// handleAnnounce remembers which blobs a peer holds. A gossiped announcement
+// speaks for its origin, which need not be the peer that passed it on.
+func (s *Service) handleAnnounce(msg p2p.Message) {
+	var payload p2p.BlobAnnouncePayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		s.logger.Warnf("dropping BLOB_ANNOUNCE from %s: %v", msg.Sender, err)
+		return
+	}
+	holder := msg.Origin
+	if holder == "" {
+		holder = msg.Sender
+	}
+	if holder == s.network.NodeID() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, hash := range payload.Hashes {
+		if !ValidHash(hash) {
+			continue
+		}
+		if s.holders[hash] == nil {
+			s.holders[hash] = make(map[string]bool)
+		}
+		s.holders[hash][holder] = true
+	}
+}
+
+// run tells peers that connect which blobs we hold, forgets what peers that
+// disconnect held, and collects unreferenced blobs
+func (s *Service) run(events <-chan p2p.Event, unsubscribe func()) {
+	defer s.wg.Done()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case evt := <-events:
+			switch evt.Type {
+			case p2p.EventPeerConnected:
+				s.announceTo(evt.PeerID)
+			case p2p.EventPeerDisconnected:
+				s.forgetPeer(evt.PeerID)
+			}
+		case <-ticker.C:
+			if _, err := s.GC(); err != nil {
+				s.logger.Errorf("failed to collect blobs: %v", err)
+			}
+		}
+	}
+}
+
+// announceTo sends a peer that serves blobs the hashes of those we hold
+func (s *Service) announceTo(peerID string) {
+	peer, ok := s.network.Peer(peerID)
+	if !ok || !peer.HasCapability(p2p.CapabilityBlob) {
+		return
+	}
+	hashes, err := s.hashes()
+	if err != nil {
+		s.logger.Errorf("failed to list blobs: %v", err)
+		return
+	}
+
+	for len(hashes) > 0 {
+		batch := hashes[:min(len(hashes), maxAnnounceHashes)]
+		hashes = hashes[len(batch):]
+		msg := p2p.NewMessage(p2p.MessageTypeBlobAnnounce, s.network.NodeID(), p2p.BlobAnnouncePayload{Hashes: batch})
+		if err := s.network.SendMessageBackground(peerID, msg); err != nil {
+			s.logger.Debugf("failed to announce blobs to %s: %v", peerID, err)
+			return
+		}
+	}
+}
+
+// gossip announces hashes to the mesh
+func (s *Service) gossip(hashes []string) error {
+	for len(hashes) > 0 {
+		batch := hashes[:min(len(hashes), maxAnnounceHashes)]
+		hashes = hashes[len(batch):]
+		msg := p2p.NewMessage(p2p.MessageTypeBlobAnnounce, s.network.NodeID(), p2p.BlobAnnouncePayload{Hashes: batch})
+		if err := s.network.Gossip(msg, 0); err != nil {
+			return fmt.Errorf("failed to announce blobs: %w", err)
+		}
+	}
+	return nil
+}
+
+// hashes returns the hashes of the blobs we hold
+func (s *Service) hashes() ([]string, error) {
+	blobs, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(blobs))
+	for i, blob := range blobs {
+		hashes[i] = blob.Hash
+	}
+	return hashes, nil
+}
+
+// forget drops a peer as a holder of a blob it turned out not to have
+func (s *Service) forget(hash, peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.holders[hash], peerID)
+	if len(s.holders[hash]) == 0 {
+		delete(s.holders, hash)
+	}
+}
+
+// forgetPeer drops a disconnected peer as a holder of every blob
+func (s *Service) forgetPeer(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, peers := range s.holders {
+		delete(peers, peerID)
+		if len(peers) == 0 {
+			delete(s.holders, hash)
+		}
+	}
+}
+
+// count updates the service's counters
+func (s *Service) count(update func(stats *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&s.stats)
+}
+
+// replyError answers a blob request with an ERROR
+func (s *Service) replyError(msg p2p.Message, code, reason string) {
+	err := s.network.Reply(msg, p2p.MessageTypeError, p2p.ErrorPayload{
+		Code:      code,
+		Message:   reason,
+		MessageID: msg.ID,
+	})
+	if err != nil {
+		s.logger.Debugf("failed to reject blob request from %s: %v", msg.Sender, err)
+	}
+}
@@ -0,0 +1,185 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/p2ptest"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type blobNode struct {
+	network *p2p.Network
+	service *Service
+}
+
+// startBlobNode starts a network with a blob service over a store in
+// dataDir, so a node restarted on the same directory keeps its blobs and key
+func startBlobNode(t *testing.T, ctx context.Context, nodeID, dataDir string) *blobNode {
+	node := &blobNode{}
+	p2ptest.StartNode(t, ctx, nodeID,
+		p2ptest.WithDataDir(dataDir),
+		p2ptest.WithConfig(func(cfg *config.Config) {
+			cfg.Blobs.ChunkSize = 64 * 1024
+			cfg.Blobs.ChunkTimeout = 1
+		}),
+		p2ptest.BeforeStart(func(started *p2ptest.Node) {
+			manager, err := storage.NewManager(dataDir, 1<<30, 0.9)
+			require.NoError(t, err)
+			started.Network.SetStorage(manager)
+			store, err := NewStore(manager, nil)
+			require.NoError(t, err)
+			service, err := NewService(store, started.Network, started.Logger, started.Config.Blobs)
+			require.NoError(t, err)
+			service.Start(ctx)
+			node.network, node.service = started.Network, service
+			t.Cleanup(node.stop)
+		}))
+	return node
+}
+
+// stop stops the node; stopping it again does nothing
+func (n *blobNode) stop() {
+	n.service.Stop()
+	n.network.Stop()
+}
+
+// connect dials other and waits until its capabilities are known
+func (n *blobNode) connect(t *testing.T, other *blobNode) {
+	_, err := n.network.Connect(context.Background(), other.network.ListenAddr().String())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		peer, ok := n.network.Peer(other.network.NodeID())
+		return ok && peer.Connected && peer.Capabilities != nil
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+// randomBlob returns size random bytes and their hash
+func randomBlob(t *testing.T, size int) ([]byte, string) {
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+	return content, hex.EncodeToString(sum[:])
+}
+
+// readBlob returns the content of a blob a node holds
+func readBlob(t *testing.T, store *Store, hash string) []byte {
+	file, err := store.Open(hash)
+	require.NoError(t, err)
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	require.NoError(t, err)
+	return content
+}
+
+func TestFetchFromPeer(t *testing.T) {
+	ctx := context.Background()
+	a := startBlobNode(t, ctx, "blob-node-a", t.TempDir())
+	b := startBlobNode(t, ctx, "blob-node-b", t.TempDir())
+	b.connect(t, a)
+
+	content, hash := randomBlob(t, 5*1024*1024)
+	info, err := a.service.Put(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, hash, info.Hash)
+
+	// The announcement tells b where the blob is
+	require.Eventually(t, func() bool {
+		return len(b.service.Holders(hash)) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []string{"blob-node-a"}, b.service.Holders(hash))
+
+	// Concurrent fetches share one download
+	var wg sync.WaitGroup
+	results := make([]Info, 3)
+	errs := make([]error, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = b.service.Fetch(ctx, hash)
+		}(i)
+	}
+	wg.Wait()
+	for i := range results {
+		require.NoError(t, errs[i])
+		assert.Equal(t, int64(len(content)), results[i].Size)
+	}
+	fetched := readBlob(t, b.service.Store(), hash)
+	sum := sha256.Sum256(fetched)
+	assert.Equal(t, hash, hex.EncodeToString(sum[:]))
+
+	stats := b.service.Stats()
+	assert.Equal(t, uint64(1), stats.Fetched)
+	assert.Equal(t, int64(len(content)), stats.BytesFetched)
+	assert.Equal(t, 1, stats.Held)
+	assert.Equal(t, int64(len(content)), a.service.Stats().BytesServed)
+
+	// Once b holds it, a is told so
+	require.Eventually(t, func() bool {
+		return len(a.service.Holders(hash)) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// A blob nobody holds cannot be fetched
+	_, missing := randomBlob(t, 16)
+	_, err = b.service.Fetch(ctx, missing)
+	assert.ErrorIs(t, err, ErrNoHolder)
+	_, err = b.service.Fetch(ctx, "not-a-hash")
+	assert.ErrorIs(t, err, ErrInvalidHash)
+}
+
+func TestFetchResumesAfterDisconnect(t *testing.T) {
+	ctx := context.Background()
+	dirA := t.TempDir()
+	a := startBlobNode(t, ctx, "blob-node-a", dirA)
+	b := startBlobNode(t, ctx, "blob-node-b", t.TempDir())
+	b.connect(t, a)
+
+	content, hash := randomBlob(t, 5*1024*1024)
+	_, err := a.service.Put(bytes.NewReader(content))
+	require.NoError(t, err)
+
+	// a goes away once b has part of the blob
+	var once sync.Once
+	b.service.onChunk = func(_ string, offset int64) {
+		if offset >= 2*1024*1024 {
+			once.Do(a.stop)
+		}
+	}
+	_, err = b.service.Fetch(ctx, hash)
+	require.Error(t, err)
+	assert.False(t, b.service.Store().Has(hash))
+	kept := b.service.Store().partialSize(hash)
+	assert.GreaterOrEqual(t, kept, int64(2*1024*1024))
+	assert.Less(t, kept, int64(len(content)))
+
+	// b picks up where it stopped once a is back
+	b.service.onChunk = nil
+	require.Eventually(t, func() bool {
+		return len(b.network.ConnectedPeers()) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+	a = startBlobNode(t, ctx, "blob-node-a", dirA)
+	b.connect(t, a)
+
+	info, err := b.service.Fetch(ctx, hash)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.Equal(t, content, readBlob(t, b.service.Store(), hash))
+
+	stats := b.service.Stats()
+	assert.Equal(t, uint64(1), stats.Resumed)
+	assert.Equal(t, int64(len(content)), stats.BytesFetched, "no byte is fetched twice")
+	assert.Equal(t, int64(len(content))-kept, a.service.Stats().BytesServed)
+}
@@ -0,0 +1,411 @@
+// Package blob keeps content-addressed blobs, such as AI model shards and
+// sync snapshots, under the data directory and fetches them from peers
+package blob
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+)
+
+const (
+	// Dir is the directory under the data directory that holds blobs
+	Dir = "blobs"
+
+	// RefBucket is the bucket of the node's state that holds the references
+	// keeping blobs from being collected
+	RefBucket = "blob_refs"
+
+	// partialDir holds blobs being written or downloaded
+	partialDir = "partial"
+
+	// partialSuffix marks a download of a blob that has not completed
+	partialSuffix = ".part"
+)
+
+var (
+	// ErrNotFound is returned for a blob this node does not hold
+	ErrNotFound = errors.New("blob not found")
+
+	// ErrInvalidHash is returned for a hash that is not a hex SHA-256
+	ErrInvalidHash = errors.New("invalid blob hash")
+
+	// ErrHashMismatch is returned when the bytes received for a blob do not
+	// hash to the blob's address
+	ErrHashMismatch = errors.New("blob does not match its hash")
+)
+
+// Info describes a blob held by this node
+type Info struct {
+	Hash     string    `json:"hash"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// GCResult reports what a collection removed
+type GCResult struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+// Store keeps blobs under the data directory, each in a file named by the
+// hex SHA-256 of its content. Every byte is charged against the storage
+// quota. Blobs without a reference are removed by GC once they are older
+// than its grace period.
+type Store struct {
+	dir   string
+	files *storage.Manager
+	refs  kvstorage.KV
+	now   func() time.Time
+
+	// mu keeps a collection from removing a blob being stored or referenced
+	mu sync.Mutex
+}
+
+// NewStore creates a store in the data directory of files, keeping
+// references in refs. A nil refs keeps references in memory only.
+func NewStore(files *storage.Manager, refs kvstorage.KV) (*Store, error) {
+	if files == nil {
+		return nil, fmt.Errorf("storage manager cannot be nil")
+	}
+	if refs == nil {
+		refs = kvstorage.NewMemory()
+	}
+
+	dir := filepath.Join(files.Dir(), Dir)
+	if err := os.MkdirAll(filepath.Join(dir, partialDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	return &Store{
+		dir:   dir,
+		files: files,
+		refs:  refs,
+		now:   time.Now,
+	}, nil
+}
+
+// ValidHash reports whether hash is a lowercase hex SHA-256
+func ValidHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Put stores the content r yields and returns the blob it became. Storing
+// content already held changes nothing.
+func (s *Store) Put(r io.Reader) (Info, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return Info{}, fmt.Errorf("failed to name blob: %w", err)
+	}
+	temp := filepath.Join(s.dir, partialDir, "put-"+hex.EncodeToString(suffix))
+
+	file, err := s.files.OpenAppend(temp, 0600)
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to create blob: %w", err)
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hasher), r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.files.Remove(temp)
+		return Info{}, fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	return s.place(temp, hex.EncodeToString(hasher.Sum(nil)))
+}
+
+// place moves the finished file temp to the address of hash
+func (s *Store) place(temp, hash string) (Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		s.files.Remove(temp)
+		return s.touch(hash)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		s.files.Remove(temp)
+		return Info{}, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	if err := s.files.Rename(temp, path); err != nil {
+		s.files.Remove(temp)
+		return Info{}, fmt.Errorf("failed to store blob %s: %w", hash, err)
+	}
+	return s.Stat(hash)
+}
+
+// touch restarts the grace period of a blob stored again
+func (s *Store) touch(hash string) (Info, error) {
+	now := s.now()
+	if err := os.Chtimes(s.path(hash), now, now); err != nil {
+		return Info{}, fmt.Errorf("failed to touch blob %s: %w", hash, err)
+	}
+	return s.Stat(hash)
+}
+
+// Has reports whether the store holds a blob
+func (s *Store) Has(hash string) bool {
+	_, err := s.Stat(hash)
+	return err == nil
+}
+
+// Stat describes a blob
+func (s *Store) Stat(hash string) (Info, error) {
+	if !ValidHash(hash) {
+		return Info{}, fmt.Errorf("%q: %w", hash, ErrInvalidHash)
+	}
+	info, err := os.Stat(s.path(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, fmt.Errorf("%s: %w", hash, ErrNotFound)
+	}
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to stat blob %s: %w", hash, err)
+	}
+	return Info{Hash: hash, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+// Open opens a blob for reading
+func (s *Store) Open(hash string) (*os.File, error) {
+	if !ValidHash(hash) {
+		return nil, fmt.Errorf("%q: %w", hash, ErrInvalidHash)
+	}
+	file, err := os.Open(s.path(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", hash, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob %s: %w", hash, err)
+	}
+	return file, nil
+}
+
+// List returns every blob the store holds, by hash
+func (s *Store) List() ([]Info, error) {
+	var blobs []Info
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == partialDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !ValidHash(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, Info{Hash: d.Name(), Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Hash < blobs[j].Hash })
+	return blobs, nil
+}
+
+// Delete removes a blob, whether or not anything references it
+func (s *Store) Delete(hash string) error {
+	if !ValidHash(hash) {
+		return fmt.Errorf("%q: %w", hash, ErrInvalidHash)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.files.Remove(s.path(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: %w", hash, ErrNotFound)
+	}
+	return err
+}
+
+// Ref marks a blob as used by name, keeping it from being collected until
+// name lets go of it with Unref. A blob may be referenced before it is
+// fetched.
+func (s *Store) Ref(hash, name string) error {
+	if !ValidHash(hash) {
+		return fmt.Errorf("%q: %w", hash, ErrInvalidHash)
+	}
+	if name == "" {
+		return fmt.Errorf("blob reference name cannot be empty")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at, err := s.now().UTC().MarshalText()
+	if err != nil {
+		return err
+	}
+	if err := s.refs.Put(RefBucket, refKey(hash, name), at); err != nil {
+		return fmt.Errorf("failed to reference blob %s: %w", hash, err)
+	}
+	return nil
+}
+
+// Unref drops the reference name holds on a blob. Once a blob has no
+// references left it is collected after the grace period.
+func (s *Store) Unref(hash, name string) error {
+	if !ValidHash(hash) {
+		return fmt.Errorf("%q: %w", hash, ErrInvalidHash)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refs.Delete(RefBucket, refKey(hash, name)); err != nil {
+		return fmt.Errorf("failed to drop reference to blob %s: %w", hash, err)
+	}
+	// Restart the grace period, so the blob outlives its last reference by it
+	if _, err := os.Stat(s.path(hash)); err == nil {
+		if _, err := s.touch(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refs returns the names referencing a blob
+func (s *Store) Refs(hash string) ([]string, error) {
+	var names []string
+	prefix := hash + "/"
+	err := s.refs.Iterate(RefBucket, func(key string, value []byte) error {
+		if strings.HasPrefix(key, prefix) {
+			names = append(names, strings.TrimPrefix(key, prefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob references: %w", err)
+	}
+	return names, nil
+}
+
+// GC removes the blobs nothing references and the downloads nothing added
+// to, once they have been left alone for grace
+func (s *Store) GC(grace time.Duration) (GCResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	referenced := make(map[string]bool)
+	err := s.refs.Iterate(RefBucket, func(key string, value []byte) error {
+		hash, _, _ := strings.Cut(key, "/")
+		referenced[hash] = true
+		return nil
+	})
+	if err != nil {
+		return GCResult{}, fmt.Errorf("failed to read blob references: %w", err)
+	}
+
+	cutoff := s.now().Add(-grace)
+	var result GCResult
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if filepath.Base(filepath.Dir(path)) != partialDir && (!ValidHash(d.Name()) || referenced[d.Name()]) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := s.files.Remove(path); err != nil {
+			return err
+		}
+		result.Removed++
+		result.Freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to collect blobs: %w", err)
+	}
+	return result, nil
+}
+
+// partialSize returns how much of a blob has been downloaded so far
+func (s *Store) partialSize(hash string) int64 {
+	info, err := os.Stat(s.partialPath(hash))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// appendPartial opens the download of a blob to add the next bytes to it
+func (s *Store) appendPartial(hash string) (io.WriteCloser, error) {
+	return s.files.OpenAppend(s.partialPath(hash), 0600)
+}
+
+// dropPartial throws away the download of a blob
+func (s *Store) dropPartial(hash string) {
+	s.files.Remove(s.partialPath(hash))
+}
+
+// completePartial checks a finished download against its hash and stores
+// it. A download that does not match is thrown away.
+func (s *Store) completePartial(hash string) (Info, error) {
+	path := s.partialPath(hash)
+	file, err := os.Open(path)
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to open download of %s: %w", hash, err)
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	file.Close()
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to read download of %s: %w", hash, err)
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != hash {
+		s.dropPartial(hash)
+		return Info{}, fmt.Errorf("download of %s hashes to %s: %w", hash, sum, ErrHashMismatch)
+	}
+	return s.place(path, hash)
+}
+
+// path returns where a blob is kept, fanned out by the first byte of its hash
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// partialPath returns where the download of a blob is kept
+func (s *Store) partialPath(hash string) string {
+	return filepath.Join(s.dir, partialDir, hash+partialSuffix)
+}
+
+// refKey is the key under which name's reference to a blob is kept
+func refKey(hash, name string) string {
+	return hash + "/" + name
+}
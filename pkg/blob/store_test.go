@@ -0,0 +1,170 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStore creates a store in a fresh data directory with a quota in bytes
+func newTestStore(t *testing.T, quota int64) (*Store, *storage.Manager) {
+	manager, err := storage.NewManager(t.TempDir(), quota, 0.9)
+	require.NoError(t, err)
+	store, err := NewStore(manager, kvstorage.NewMemory())
+	require.NoError(t, err)
+	return store, manager
+}
+
+// hashOf returns the address of content
+func hashOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestStorePut(t *testing.T) {
+	store, manager := newTestStore(t, 1<<20)
+	content := []byte("model shard")
+
+	info, err := store.Put(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, hashOf(content), info.Hash)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.True(t, store.Has(info.Hash))
+	assert.Equal(t, int64(len(content)), manager.Usage().UsedBytes)
+
+	file, err := store.Open(info.Hash)
+	require.NoError(t, err)
+	stored, err := io.ReadAll(file)
+	file.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, stored)
+
+	// Storing the same content again keeps one copy
+	_, err = store.Put(bytes.NewReader(content))
+	require.NoError(t, err)
+	blobs, err := store.List()
+	require.NoError(t, err)
+	assert.Len(t, blobs, 1)
+	assert.Equal(t, int64(len(content)), manager.Usage().UsedBytes)
+
+	_, err = store.Open(hashOf([]byte("other")))
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Stat("../../etc/passwd")
+	assert.ErrorIs(t, err, ErrInvalidHash)
+
+	require.NoError(t, store.Delete(info.Hash))
+	assert.False(t, store.Has(info.Hash))
+	assert.ErrorIs(t, store.Delete(info.Hash), ErrNotFound)
+	assert.Equal(t, int64(0), manager.Usage().UsedBytes)
+}
+
+func TestStoreRespectsQuota(t *testing.T) {
+	store, manager := newTestStore(t, 1024)
+
+	_, err := store.Put(bytes.NewReader(make([]byte, 2048)))
+	assert.ErrorIs(t, err, storage.ErrQuotaExceeded)
+	assert.Equal(t, int64(0), manager.Usage().UsedBytes, "a blob past the quota leaves nothing behind")
+	entries, err := os.ReadDir(filepath.Join(manager.Dir(), Dir, partialDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStorePartialMismatch(t *testing.T) {
+	store, _ := newTestStore(t, 1<<20)
+	hash := hashOf([]byte("expected"))
+
+	file, err := store.appendPartial(hash)
+	require.NoError(t, err)
+	_, err = file.Write([]byte("tampered"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	assert.Equal(t, int64(8), store.partialSize(hash))
+
+	_, err = store.completePartial(hash)
+	assert.ErrorIs(t, err, ErrHashMismatch)
+	assert.False(t, store.Has(hash))
+	assert.Zero(t, store.partialSize(hash), "a download that does not match is thrown away")
+}
+
+func TestStoreGC(t *testing.T) {
+	store, manager := newTestStore(t, 1<<20)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	kept, err := store.Put(strings.NewReader("referenced"))
+	require.NoError(t, err)
+	dropped, err := store.Put(strings.NewReader("unreferenced"))
+	require.NoError(t, err)
+	require.NoError(t, store.Ref(kept.Hash, "snapshot"))
+	require.NoError(t, store.Ref(kept.Hash, "model"))
+	refs, err := store.Refs(kept.Hash)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"snapshot", "model"}, refs)
+	assert.Error(t, store.Ref("not-a-hash", "model"))
+
+	// An abandoned download is collected with unreferenced blobs
+	partial, err := store.appendPartial(hashOf([]byte("abandoned")))
+	require.NoError(t, err)
+	partial.Write([]byte("aban"))
+	partial.Close()
+
+	// Nothing is collected within the grace period
+	result, err := store.GC(time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, result.Removed)
+
+	now = now.Add(2 * time.Hour)
+	result, err = store.GC(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Removed)
+	assert.Equal(t, dropped.Size+4, result.Freed)
+	assert.True(t, store.Has(kept.Hash))
+	assert.False(t, store.Has(dropped.Hash))
+	assert.Equal(t, kept.Size, manager.Usage().UsedBytes)
+
+	// A blob outlives its last reference by the grace period
+	require.NoError(t, store.Unref(kept.Hash, "snapshot"))
+	require.NoError(t, store.Unref(kept.Hash, "model"))
+	result, err = store.GC(time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, result.Removed)
+	now = now.Add(2 * time.Hour)
+	result, err = store.GC(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Removed)
+	assert.False(t, store.Has(kept.Hash))
+}
+
+func TestStoreKeepsReferences(t *testing.T) {
+	manager, err := storage.NewManager(t.TempDir(), 1<<20, 0.9)
+	require.NoError(t, err)
+	state, err := kvstorage.Open(kvstorage.BackendBolt, manager.Dir(), manager)
+	require.NoError(t, err)
+
+	store, err := NewStore(manager, state)
+	require.NoError(t, err)
+	info, err := store.Put(strings.NewReader("snapshot"))
+	require.NoError(t, err)
+	require.NoError(t, store.Ref(info.Hash, "sync"))
+	require.NoError(t, state.Close())
+
+	state, err = kvstorage.Open(kvstorage.BackendBolt, manager.Dir(), manager)
+	require.NoError(t, err)
+	defer state.Close()
+	reopened, err := NewStore(manager, state)
+	require.NoError(t, err)
+	refs, err := reopened.Refs(info.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sync"}, refs)
+}
@@ -0,0 +1,51 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// IdentityFile is the name of the file under the data directory that keeps
+// the node ID stable across restarts when none is configured
+const IdentityFile = "identity.json"
+
+// identity is the persisted form of the node's identity
+type identity struct {
+	NodeID string `json:"node_id"`
+}
+
+// LoadIdentity returns the node ID saved in dataDir, or "" if there is none
+func LoadIdentity(dataDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, IdentityFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	var id identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return "", fmt.Errorf("failed to parse identity: %w", err)
+	}
+	return id.NodeID, nil
+}
+
+// saveIdentity records the node ID in the data directory if it changed
+func (n *Node) saveIdentity() error {
+	saved, err := LoadIdentity(n.config.Storage.DataDir)
+	if err == nil && saved == n.id {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(identity{NodeID: n.id}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal identity: %w", err)
+	}
+	if err := n.storage.WriteFile(filepath.Join(n.config.Storage.DataDir, IdentityFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to save identity: %w", err)
+	}
+	return nil
+}
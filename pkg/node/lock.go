@@ -0,0 +1,153 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/princetheprogrammer/synapse/pkg/backup"
+)
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("lock held by another process")
+
+// InstanceRunningError is returned by Start when another node holds the data
+// directory
+type InstanceRunningError struct {
+	DataDir string
+	PID     int
+}
+
+func (e *InstanceRunningError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("another instance is running on data directory %s", e.DataDir)
+	}
+	return fmt.Sprintf("another instance is running (pid %d) on data directory %s", e.PID, e.DataDir)
+}
+
+// LockInfo is what the data directory lock records about the node holding it
+type LockInfo struct {
+	PID int
+	// AdminAddr is the address of the node's admin API, if it serves one
+	AdminAddr string
+}
+
+// Alive reports whether the process that wrote the lock is still running.
+// A lock whose process is gone was left by a node that crashed.
+func (l *LockInfo) Alive() bool {
+	return processAlive(l.PID)
+}
+
+// ReadLock returns what the lock in dataDir records, or nil if the data
+// directory is not locked. The lock holds the PID on its first line and the
+// admin API address, if any, on the second.
+func ReadLock(dataDir string) (*LockInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, backup.LockFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read data directory lock: %w", err)
+	}
+	return parseLock(data)
+}
+
+// parseLock parses the contents of a lock file
+func parseLock(data []byte) (*LockInfo, error) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data directory lock: %w", err)
+	}
+	info := &LockInfo{PID: pid}
+	if len(lines) > 1 {
+		info.AdminAddr = strings.TrimSpace(lines[1])
+	}
+	return info, nil
+}
+
+// lockDataDir takes the data directory for this process. It fails with an
+// InstanceRunningError while another node runs on it, and takes over the
+// lock of a node that crashed.
+func (n *Node) lockDataDir() error {
+	dataDir := n.config.Storage.DataDir
+	path := filepath.Join(dataDir, backup.LockFile)
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open data directory lock: %w", err)
+		}
+		if err := lockFile(file); err != nil {
+			file.Close()
+			if errors.Is(err, errLocked) {
+				running := &InstanceRunningError{DataDir: dataDir}
+				if info, err := ReadLock(dataDir); err == nil && info != nil {
+					running.PID = info.PID
+				}
+				return running
+			}
+			return fmt.Errorf("failed to lock data directory: %w", err)
+		}
+
+		// The node we raced with may have removed the file between our
+		// open and lock, leaving us a lock nobody else can see
+		if current, err := os.Stat(path); err != nil || !sameFile(file, current) {
+			file.Close()
+			continue
+		}
+
+		if info, err := ReadLock(dataDir); err == nil && info != nil {
+			n.logger.Warnf("taking over the data directory lock of pid %d, which was not stopped cleanly", info.PID)
+		}
+		n.lock = file
+		if err := n.writeLock(LockInfo{PID: os.Getpid()}); err != nil {
+			n.unlockDataDir()
+			return err
+		}
+		return nil
+	}
+}
+
+// writeLock replaces what the lock records
+func (n *Node) writeLock(info LockInfo) error {
+	data := strconv.Itoa(info.PID) + "\n"
+	if info.AdminAddr != "" {
+		data += info.AdminAddr + "\n"
+	}
+	if err := n.lock.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write data directory lock: %w", err)
+	}
+	if _, err := n.lock.WriteAt([]byte(data), 0); err != nil {
+		return fmt.Errorf("failed to write data directory lock: %w", err)
+	}
+	return nil
+}
+
+// unlockDataDir releases the data directory lock
+func (n *Node) unlockDataDir() {
+	if n.lock == nil {
+		return
+	}
+	// Remove the file before letting go of it, so nobody takes a lock on a
+	// file that is about to disappear. Platforms that cannot remove open
+	// files get a second try once it is closed.
+	path := n.lock.Name()
+	err := os.Remove(path)
+	n.lock.Close()
+	n.lock = nil
+	if err != nil && !os.IsNotExist(err) {
+		err = os.Remove(path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		n.logger.Errorf("failed to unlock data directory: %v", err)
+	}
+}
+
+// sameFile reports whether an open file is the one described by info
+func sameFile(file *os.File, info os.FileInfo) bool {
+	opened, err := file.Stat()
+	return err == nil && os.SameFile(opened, info)
+}
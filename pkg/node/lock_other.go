@@ -0,0 +1,31 @@
+//go:build !unix && !windows
+
+package node
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockFile stands in for an advisory lock where there is none: the lock is
+// held while the process recorded in it is alive
+func lockFile(file *os.File) error {
+	info, err := ReadLock(filepath.Dir(file.Name()))
+	if err == nil && info != nil && info.Alive() {
+		return errLocked
+	}
+	return nil
+}
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
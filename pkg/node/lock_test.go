@@ -0,0 +1,100 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/admin"
+	"github.com/princetheprogrammer/synapse/pkg/backup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecondInstance(t *testing.T) {
+	first := createTestNode(t)
+	require.NoError(t, first.Start(context.Background()))
+
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.Storage.DataDir = first.config.Storage.DataDir
+	second, err := New(cfg, mustCreateLogger(t))
+	require.NoError(t, err)
+
+	err = second.Start(context.Background())
+	var running *InstanceRunningError
+	require.True(t, errors.As(err, &running), "got %v", err)
+	assert.Equal(t, os.Getpid(), running.PID)
+	assert.Contains(t, err.Error(), "another instance is running (pid "+strconv.Itoa(os.Getpid())+")")
+	assert.Equal(t, StatusStopped, second.Status())
+
+	// The first node keeps its lock
+	info, err := ReadLock(cfg.Storage.DataDir)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	assert.True(t, info.Alive())
+
+	require.NoError(t, first.Stop())
+	require.NoError(t, second.Start(context.Background()))
+	require.NoError(t, second.Stop())
+}
+
+func TestStaleLock(t *testing.T) {
+	// A process that has exited leaves a PID nobody runs under
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	require.NoError(t, exited.Run())
+	stalePID := exited.ProcessState.Pid()
+
+	node := createTestNode(t)
+	dataDir := node.config.Storage.DataDir
+	lock := filepath.Join(dataDir, backup.LockFile)
+	require.NoError(t, os.WriteFile(lock, []byte(strconv.Itoa(stalePID)), 0644))
+
+	info, err := ReadLock(dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, stalePID, info.PID)
+	assert.False(t, info.Alive())
+
+	require.NoError(t, node.Start(context.Background()))
+	info, err = ReadLock(dataDir)
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), info.PID)
+
+	require.NoError(t, node.Stop())
+	assert.NoFileExists(t, lock)
+	info, err = ReadLock(dataDir)
+	require.NoError(t, err)
+	assert.Nil(t, info)
+}
+
+func TestLockRecordsAdminAddr(t *testing.T) {
+	node := createTestNode(t)
+	node.config.Admin.Enabled = true
+	node.config.Admin.ListenAddr = "127.0.0.1:0"
+	require.NoError(t, node.Start(context.Background()))
+	defer node.Stop()
+
+	info, err := ReadLock(node.config.Storage.DataDir)
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), info.PID)
+	assert.Equal(t, node.admin.Addr(), info.AdminAddr)
+}
+
+func TestControlSocket(t *testing.T) {
+	node := createTestNode(t)
+	require.NoError(t, node.Start(context.Background()))
+
+	path := admin.ControlSocketPath(node.config)
+	assert.Equal(t, filepath.Join(node.config.Storage.DataDir, "synapse.sock"), path)
+	status, err := admin.NewClient(admin.NewControlEndpoint(path)).Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, node.ID(), status.NodeID)
+
+	require.NoError(t, node.Stop())
+	assert.NoFileExists(t, path)
+}
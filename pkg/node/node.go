@@ -2,15 +2,30 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/princetheprogrammer/synapse/internal/config"
 	"github.com/princetheprogrammer/synapse/internal/logger"
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/admin"
+	"github.com/princetheprogrammer/synapse/pkg/ai"
+	"github.com/princetheprogrammer/synapse/pkg/backup"
+	"github.com/princetheprogrammer/synapse/pkg/blob"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/princetheprogrammer/synapse/pkg/store"
+	"github.com/princetheprogrammer/synapse/pkg/task"
 )
 
+// ErrAlreadyStopped is returned by Stop for a node that has been stopped
+var ErrAlreadyStopped = errors.New("node already stopped")
+
 type Status int
 
 const (
@@ -18,6 +33,7 @@ const (
 	StatusStarting
 	StatusRunning
 	StatusStopping
+	StatusFailed
 )
 
 func (s Status) String() string {
@@ -30,6 +46,8 @@ func (s Status) String() string {
 		return "running"
 	case StatusStopping:
 		return "stopping"
+	case StatusFailed:
+		return "failed"
 	default:
 		return "unknown"
 	}
@@ -42,8 +60,29 @@ type Node struct {
 	status Status
 	mu     sync.RWMutex
 
-	stopCh chan struct{}
-	doneCh chan struct{}
+	storage    *storage.Manager
+	state      kvstorage.KV
+	network    *p2p.Network
+	replicator *store.Replicator
+	backups    *backup.Manager
+	ai         *ai.Client
+	aiMesh     *ai.Mesh
+	aiDrainer  *ai.Drainer
+	admin      *admin.Server
+
+	// tasks outlives restarts, so tasks registered once are run by every
+	// scheduler
+	tasks     *task.Registry
+	scheduler *task.Scheduler
+
+	blobs *blob.Service
+
+	// Lock on the data directory, held while the node runs
+	lock *os.File
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	failures chan error
 }
 
 func New(cfg *config.Config, log *logger.Logger) (*Node, error) {
@@ -55,25 +94,51 @@ func New(cfg *config.Config, log *logger.Logger) (*Node, error) {
 	}
 
 	nodeID := cfg.Node.ID
+	if nodeID == "" {
+		saved, err := LoadIdentity(cfg.Storage.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		nodeID = saved
+	}
 	if nodeID == "" {
 		nodeID = uuid.New().String()
-		cfg.Node.ID = nodeID
 	}
+	cfg.Node.ID = nodeID
 
 	if _, err := uuid.Parse(nodeID); err != nil {
 		return nil, fmt.Errorf("invalid node ID format: %w", err)
 	}
 
 	return &Node{
-		id:     nodeID,
-		config: cfg,
-		logger: log.With("node_id", nodeID),
-		status: StatusStopped,
-		stopCh: make(chan struct{}),
-		doneCh: make(chan struct{}),
+		id:       nodeID,
+		config:   cfg,
+		logger:   log.With("node_id", nodeID),
+		status:   StatusStopped,
+		tasks:    task.NewRegistry(),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+		failures: make(chan error, 1),
 	}, nil
 }
 
+// NewStorageManager creates the quota-enforcing storage manager for the
+// configured data directory
+func NewStorageManager(cfg *config.Config) (*storage.Manager, error) {
+	quota := int64(cfg.Storage.MaxSizeGB) << 30
+	manager, err := storage.NewManager(cfg.Storage.DataDir, quota, cfg.Storage.HighWaterMark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage manager: %w", err)
+	}
+	return manager, nil
+}
+
+// SetStorage shares a storage manager created before the node, e.g. one that
+// also accounts for the log file. It must be called before Start.
+func (n *Node) SetStorage(manager *storage.Manager) {
+	n.storage = manager
+}
+
 func (n *Node) ID() string {
 	return n.id
 }
@@ -92,33 +157,399 @@ func (n *Node) setStatus(status Status) {
 }
 
 func (n *Node) Start(ctx context.Context) error {
-	if n.Status() != StatusStopped {
-		return fmt.Errorf("node already running or starting")
+	if err := n.beginStart(); err != nil {
+		return err
 	}
-
-	n.setStatus(StatusStarting)
 	n.logger.Info("starting synapse node")
+	stopCh, doneCh := n.resetRun()
 
-	if err := n.initialize(); err != nil {
+	if err := n.initialize(ctx); err != nil {
 		n.setStatus(StatusStopped)
 		return fmt.Errorf("failed to initialize node: %w", err)
 	}
 
-	go n.run(ctx)
+	go n.run(ctx, stopCh, doneCh)
 
 	n.setStatus(StatusRunning)
-	n.logger.Infof("synapse node started successfully on port %d", n.config.P2P.ListenPort)
+	n.logger.Infof("synapse node started successfully, listening on %v", n.network.ListenAddrs())
 
 	return nil
 }
 
-func (n *Node) initialize() error {
+// beginStart moves a stopped node to StatusStarting, so that only one of
+// several concurrent callers starts it
+func (n *Node) beginStart() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.status != StatusStopped {
+		return fmt.Errorf("node already running or starting")
+	}
+	n.status = StatusStarting
+	n.logger.Infof("node status changed to: %s", n.status)
+	return nil
+}
+
+// Restart stops the node, also after it failed, and starts it again with
+// its current config
+func (n *Node) Restart(ctx context.Context) error {
+	if err := n.Stop(); err != nil {
+		return fmt.Errorf("failed to restart node: %w", err)
+	}
+	return n.Start(ctx)
+}
+
+// resetRun gives a node whose last run has finished fresh channels to stop
+// and wait for the next one, and forgets failures of the last run
+func (n *Node) resetRun() (chan struct{}, chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	select {
+	case <-n.doneCh:
+		n.stopCh = make(chan struct{})
+		n.doneCh = make(chan struct{})
+	default:
+	}
+	select {
+	case <-n.failures:
+	default:
+	}
+	return n.stopCh, n.doneCh
+}
+
+func (n *Node) initialize(ctx context.Context) (err error) {
 	n.logger.Debug("initializing node components")
+
+	// Components of a previous run have been shut down
+	n.state, n.network, n.replicator, n.backups, n.admin = nil, nil, nil, nil, nil
+	n.ai, n.aiMesh, n.aiDrainer = nil, nil, nil
+	n.scheduler, n.blobs = nil, nil
+
+	if n.storage == nil {
+		manager, err := NewStorageManager(n.config)
+		if err != nil {
+			return err
+		}
+		n.storage = manager
+	}
+	if err := n.lockDataDir(); err != nil {
+		return err
+	}
+	if err := n.saveIdentity(); err != nil {
+		n.unlockDataDir()
+		return err
+	}
+
+	// Tear down whatever was started if a later component fails
+	defer func() {
+		if err != nil {
+			n.shutdownComponents(ctx)
+		}
+	}()
+
+	if err := n.openState(); err != nil {
+		return err
+	}
+
+	network, err := p2p.New(n.config, n.logger, n.id)
+	if err != nil {
+		return fmt.Errorf("failed to create network: %w", err)
+	}
+	network.SetStorage(n.storage)
+	network.SetKV(n.state)
+
+	// The replicator registers its handlers before the network starts so the
+	// sync capability is part of the first HELLO we send
+	kv, err := store.New(n.state)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	replicator, err := store.NewReplicator(kv, network, n.logger, time.Duration(n.config.Storage.SyncInterval)*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to create replicator: %w", err)
+	}
+	if err := replicator.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start replicator: %w", err)
+	}
+	n.replicator = replicator
+
+	// The AI mesh registers before the network starts as well, so peers learn
+	// from our first HELLO whether we can answer AI queries for them
+	if n.config.AI.Endpoint != "" {
+		client, err := ai.NewClient(n.config.AI)
+		if err != nil {
+			return fmt.Errorf("failed to create AI client: %w", err)
+		}
+		client.SetMetrics(network.ServiceMetrics("ai"))
+		client.SetLogger(n.logger)
+		if n.config.AI.EnableCache {
+			if err := n.startAICache(network, client); err != nil {
+				return err
+			}
+		}
+		n.ai = client
+	}
+	mesh, err := ai.NewMesh(n.ai, network, n.logger, n.config.AI)
+	if err != nil {
+		return fmt.Errorf("failed to create AI mesh: %w", err)
+	}
+	mesh.Start(ctx)
+	n.aiMesh = mesh
+	if n.ai != nil {
+		n.ai.SetDelegate(mesh)
+	}
+
+	// So does the task scheduler, to advertise the registered tasks
+	scheduler, err := task.NewScheduler(n.tasks, network, n.logger, n.config.Tasks)
+	if err != nil {
+		return fmt.Errorf("failed to create task scheduler: %w", err)
+	}
+	scheduler.Start(ctx)
+	n.scheduler = scheduler
+
+	// And the blob service, to serve blobs from the first HELLO on
+	blobStore, err := blob.NewStore(n.storage, n.state)
+	if err != nil {
+		return fmt.Errorf("failed to open blob store: %w", err)
+	}
+	blobs, err := blob.NewService(blobStore, network, n.logger, n.config.Blobs)
+	if err != nil {
+		return fmt.Errorf("failed to create blob service: %w", err)
+	}
+	blobs.Start(ctx)
+	n.blobs = blobs
+
+	if err := network.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start network: %w", err)
+	}
+	n.network = network
+	n.watch("network", network.Errors())
+
+	if n.config.Storage.EnableBackups {
+		backups, err := backup.NewManager(n.storage, n.logger, n.id, n.config.Storage.BackupRetention,
+			time.Duration(n.config.Storage.BackupInterval)*time.Second)
+		if err != nil {
+			return fmt.Errorf("failed to create backup manager: %w", err)
+		}
+		backups.AddFlusher(kv.Save)
+		backups.AddFlusher(network.SavePeerStore)
+		if n.ai != nil && n.ai.Cache() != nil {
+			backups.AddFlusher(n.ai.Cache().Save)
+		}
+		backups.Start(ctx)
+		n.backups = backups
+	}
+
+	if n.ai != nil && n.config.AI.EnableOffline {
+		if err := n.startAIQueue(ctx, n.ai); err != nil {
+			return err
+		}
+	}
+
+	controlSocket := admin.ControlSocketPath(n.config)
+	if n.config.Admin.Enabled || controlSocket != "" {
+		server, err := admin.New(n.config.Admin, n.logger, network)
+		if err != nil {
+			return fmt.Errorf("failed to create admin server: %w", err)
+		}
+		if n.ai != nil {
+			server.Handle("POST /ai/query", ai.QueryHandler(n.ai))
+		}
+		n.admin = server
+		n.watch("admin server", server.Errors())
+
+		if controlSocket != "" {
+			if err := server.StartControl(admin.NewControlEndpoint(controlSocket)); err != nil {
+				return fmt.Errorf("failed to start control endpoint: %w", err)
+			}
+		}
+		if n.config.Admin.Enabled {
+			if err := server.Start(); err != nil {
+				return fmt.Errorf("failed to start admin server: %w", err)
+			}
+			if err := n.writeLock(LockInfo{PID: os.Getpid(), AdminAddr: server.Addr()}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// openState opens the storage the node keeps its state in, the backend
+// chosen in the configuration, and moves in the files earlier releases kept
+// the replicated store and AI cache in. The network migrates its own.
+func (n *Node) openState() error {
+	state, err := kvstorage.Open(n.config.Storage.Backend, n.config.Storage.DataDir, n.storage)
+	if err != nil {
+		return fmt.Errorf("failed to open state storage: %w", err)
+	}
+	n.state = state
+
+	if err := store.MigrateFile(state, filepath.Join(n.config.Storage.DataDir, store.StoreFile)); err != nil {
+		n.logger.Warnf("failed to migrate store: %v", err)
+	}
+	if err := ai.MigrateCache(state, n.config.Storage.DataDir); err != nil {
+		n.logger.Warnf("failed to migrate AI cache: %v", err)
+	}
+	return nil
+}
+
+// startAIQueue opens the offline queue for AI requests and starts draining
+// it in the background
+func (n *Node) startAIQueue(ctx context.Context, client *ai.Client) error {
+	queue, err := ai.NewQueue(n.storage, n.config.AI.QueueMaxItems, n.config.AI.QueueMaxBytes)
+	if err != nil {
+		return fmt.Errorf("failed to open AI queue: %w", err)
+	}
+	client.SetQueue(queue)
+	n.network.AddReportSection("ai_queue", func() interface{} { return queue.Stats() })
+	if n.backups != nil {
+		n.backups.AddFlusher(queue.Checkpoint)
+	}
+
+	drainer, err := ai.NewDrainer(client, n.logger, time.Duration(n.config.AI.DrainInterval)*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to create AI queue drainer: %w", err)
+	}
+	drainer.OnResult(func(item *ai.QueuedRequest, resp *ai.Response, err error) {
+		if err == nil {
+			n.logger.Infof("queued AI request %s answered after %s", item.ID, time.Since(item.EnqueuedAt).Round(time.Second))
+		}
+	})
+	drainer.Start(ctx)
+	n.aiDrainer = drainer
+	return nil
+}
+
+// startAICache answers repeated AI requests from a cache, which is saved
+// with backups and on shutdown if it persists
+func (n *Node) startAICache(network *p2p.Network, client *ai.Client) error {
+	var state kvstorage.KV
+	if n.config.AI.CachePersist {
+		state = n.state
+	}
+	cache, err := ai.NewCache(state, n.config.AI.CacheMaxEntries, n.config.AI.CacheMaxBytes,
+		time.Duration(n.config.AI.CacheTTL)*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to open AI cache: %w", err)
+	}
+	client.SetCache(cache)
+	network.AddReportSection("ai_cache", func() interface{} { return cache.Stats() })
 	return nil
 }
 
-func (n *Node) run(ctx context.Context) {
-	defer close(n.doneCh)
+// shutdownComponents stops the admin server, backups, the AI queue, cache
+// and mesh, the task scheduler, the blob service, the replicator and the
+// network, then closes the state storage and releases the data directory
+func (n *Node) shutdownComponents(ctx context.Context) {
+	if n.admin != nil {
+		if err := n.admin.Stop(ctx); err != nil {
+			n.logger.Errorf("failed to stop admin server: %v", err)
+		}
+	}
+	if n.backups != nil {
+		n.backups.Stop()
+	}
+	if n.aiDrainer != nil {
+		n.aiDrainer.Stop()
+	}
+	if n.ai != nil && n.ai.Queue() != nil {
+		if err := n.ai.Queue().Close(); err != nil {
+			n.logger.Errorf("failed to close AI queue: %v", err)
+		}
+	}
+	if n.ai != nil && n.ai.Cache() != nil {
+		if err := n.ai.Cache().Save(); err != nil {
+			n.logger.Errorf("failed to save AI cache: %v", err)
+		}
+	}
+	if n.aiMesh != nil {
+		n.aiMesh.Stop()
+	}
+	if n.scheduler != nil {
+		n.scheduler.Stop()
+	}
+	if n.blobs != nil {
+		n.blobs.Stop()
+	}
+	if n.replicator != nil {
+		if err := n.replicator.Stop(); err != nil {
+			n.logger.Errorf("failed to stop replicator: %v", err)
+		}
+	}
+	if n.network != nil {
+		if err := n.network.Stop(); err != nil {
+			n.logger.Errorf("failed to stop network: %v", err)
+		}
+	}
+	if n.state != nil {
+		if err := n.state.Close(); err != nil {
+			n.logger.Errorf("failed to close state storage: %v", err)
+		}
+	}
+	n.unlockDataDir()
+}
+
+// Backups returns the node's backup manager, or nil if backups are disabled
+func (n *Node) Backups() *backup.Manager {
+	return n.backups
+}
+
+// AI returns the node's AI client, or nil if no endpoint is configured
+func (n *Node) AI() *ai.Client {
+	return n.ai
+}
+
+// Network returns the node's P2P network, or nil before Start
+func (n *Node) Network() *p2p.Network {
+	return n.network
+}
+
+// Replicator returns the node's replicated key-value store, or nil before Start
+func (n *Node) Replicator() *store.Replicator {
+	return n.replicator
+}
+
+// Tasks returns the registry of tasks the node runs for its peers. Tasks
+// registered before Start are advertised to every peer.
+func (n *Node) Tasks() *task.Registry {
+	return n.tasks
+}
+
+// Scheduler returns the scheduler that submits tasks to peers, or nil before
+// Start
+func (n *Node) Scheduler() *task.Scheduler {
+	return n.scheduler
+}
+
+// Blobs returns the service that stores blobs and fetches them from peers,
+// or nil before Start
+func (n *Node) Blobs() *blob.Service {
+	return n.blobs
+}
+
+// watch fails the node once a subsystem reports that it died
+func (n *Node) watch(name string, errs <-chan error) {
+	n.mu.RLock()
+	stopCh := n.stopCh
+	n.mu.RUnlock()
+
+	go func() {
+		select {
+		case err := <-errs:
+			select {
+			case n.failures <- fmt.Errorf("%s: %w", name, err):
+			default:
+			}
+		case <-stopCh:
+		}
+	}()
+}
+
+func (n *Node) run(ctx context.Context, stopCh <-chan struct{}, doneCh chan struct{}) {
+	defer close(doneCh)
 
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -129,40 +560,78 @@ func (n *Node) run(ctx context.Context) {
 			n.logger.Info("context cancelled, shutting down")
 			return
 
-		case <-n.stopCh:
+		case <-stopCh:
 			n.logger.Info("stop signal received, shutting down")
 			return
 
+		case err := <-n.failures:
+			n.logger.Errorf("node failed, restart it to recover: %v", err)
+			n.setStatus(StatusFailed)
+			return
+
 		case <-ticker.C:
 			n.logger.Debug("node heartbeat")
 		}
 	}
 }
 
+// Stop shuts the node down. A failed node is stopped the same way. Once
+// the node is stopped, or while another caller is stopping it, Stop
+// returns ErrAlreadyStopped.
 func (n *Node) Stop() error {
-	if n.Status() != StatusRunning {
-		return fmt.Errorf("node is not running")
+	stopCh, doneCh, err := n.beginStop()
+	if err != nil {
+		return err
 	}
-
-	n.setStatus(StatusStopping)
 	n.logger.Info("stopping synapse node")
-
-	close(n.stopCh)
+	close(stopCh)
 
 	shutdownTimeout := time.NewTimer(10 * time.Second)
 	defer shutdownTimeout.Stop()
 
 	select {
-	case <-n.doneCh:
+	case <-doneCh:
 		n.logger.Info("node stopped gracefully")
 	case <-shutdownTimeout.C:
 		n.logger.Warn("node shutdown timeout, forcing stop")
 	}
 
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n.shutdownComponents(shutdownCtx)
+
 	n.setStatus(StatusStopped)
 	return nil
 }
 
+// beginStop moves a running or failed node to StatusStopping, so that only
+// one caller shuts it down, and returns the channels of its run
+func (n *Node) beginStop() (chan struct{}, <-chan struct{}, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch n.status {
+	case StatusRunning, StatusFailed:
+	case StatusStopping:
+		return nil, nil, ErrAlreadyStopped
+	default:
+		// A run that has finished was stopped; a node that never ran is not
+		select {
+		case <-n.doneCh:
+			return nil, nil, ErrAlreadyStopped
+		default:
+			return nil, nil, fmt.Errorf("node is not running")
+		}
+	}
+
+	n.status = StatusStopping
+	n.logger.Infof("node status changed to: %s", n.status)
+	return n.stopCh, n.doneCh, nil
+}
+
 func (n *Node) Wait() {
-	<-n.doneCh
+	n.mu.RLock()
+	doneCh := n.doneCh
+	n.mu.RUnlock()
+	<-doneCh
 }
@@ -2,17 +2,28 @@ package node
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/princetheprogrammer/synapse/internal/config"
 	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/backup"
+	"github.com/princetheprogrammer/synapse/pkg/blob"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func createTestNode(t *testing.T) *Node {
 	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.Storage.DataDir = t.TempDir()
 	log, err := logger.New("debug", "json", "")
 	require.NoError(t, err)
 
@@ -88,6 +99,7 @@ func TestStatusString(t *testing.T) {
 		{StatusStarting, "starting"},
 		{StatusRunning, "running"},
 		{StatusStopping, "stopping"},
+		{StatusFailed, "failed"},
 		{Status(999), "unknown"},
 	}
 
@@ -135,6 +147,150 @@ func TestNodeStopNotRunning(t *testing.T) {
 	assert.Contains(t, err.Error(), "not running")
 }
 
+func TestNodeConcurrentStop(t *testing.T) {
+	node := createTestNode(t)
+	require.NoError(t, node.Start(context.Background()))
+
+	const callers = 8
+	errs := make(chan error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- node.Stop()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	stopped := 0
+	for err := range errs {
+		if err == nil {
+			stopped++
+		} else {
+			assert.ErrorIs(t, err, ErrAlreadyStopped)
+		}
+	}
+	assert.Equal(t, 1, stopped)
+	assert.Equal(t, StatusStopped, node.Status())
+	assert.ErrorIs(t, node.Stop(), ErrAlreadyStopped)
+}
+
+func TestNodeConcurrentStart(t *testing.T) {
+	node := createTestNode(t)
+
+	const callers = 8
+	errs := make(chan error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- node.Start(context.Background())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	started := 0
+	for err := range errs {
+		if err == nil {
+			started++
+		} else {
+			assert.Contains(t, err.Error(), "already running or starting")
+		}
+	}
+	assert.Equal(t, 1, started)
+	assert.Equal(t, StatusRunning, node.Status())
+	require.NoError(t, node.Stop())
+}
+
+func TestNodeStopAfterCancellation(t *testing.T) {
+	node := createTestNode(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, node.Start(ctx))
+
+	// The run loop exits on its own first, as it does on a signal
+	cancel()
+	node.Wait()
+	require.NoError(t, node.Stop())
+	assert.ErrorIs(t, node.Stop(), ErrAlreadyStopped)
+}
+
+func TestNodeFailure(t *testing.T) {
+	node := createTestNode(t)
+	ctx := context.Background()
+	require.NoError(t, node.Start(ctx))
+
+	// A subsystem dying at runtime fails the node
+	broken := make(chan error, 1)
+	node.watch("test subsystem", broken)
+	broken <- errors.New("listener closed")
+
+	require.Eventually(t, func() bool {
+		return node.Status() == StatusFailed
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "failed", node.Status().String())
+	node.Wait()
+	assert.Error(t, node.Start(ctx))
+
+	// Restarting brings it back with fresh components
+	failed := node.Network()
+	require.NoError(t, node.Restart(ctx))
+	assert.Equal(t, StatusRunning, node.Status())
+	assert.NotSame(t, failed, node.Network())
+	assert.True(t, node.Network().Status().Listening)
+	assert.False(t, failed.Status().Listening)
+
+	require.NoError(t, node.Stop())
+	assert.Equal(t, StatusStopped, node.Status())
+}
+
+func TestNodeRestart(t *testing.T) {
+	node := createTestNode(t)
+	ctx := context.Background()
+
+	err := node.Restart(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not running")
+
+	require.NoError(t, node.Start(ctx))
+	require.NoError(t, node.Replicator().Put("note", "kept"))
+	shard, err := node.Blobs().Put(strings.NewReader("shard"))
+	require.NoError(t, err)
+	require.NoError(t, node.Blobs().Store().Ref(shard.Hash, "model"))
+	require.NoError(t, node.Restart(ctx))
+	assert.Equal(t, StatusRunning, node.Status())
+
+	// Wait blocks until the restarted run stops
+	stopped := make(chan struct{})
+	go func() {
+		node.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Wait() returned for the run before the restart")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	value, err := node.Replicator().Get("note")
+	require.NoError(t, err)
+	assert.JSONEq(t, `"kept"`, string(value))
+	assert.True(t, node.Blobs().Store().Has(shard.Hash))
+	refs, err := node.Blobs().Store().Refs(shard.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"model"}, refs)
+
+	require.NoError(t, node.Stop())
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait() did not return after Stop()")
+	}
+}
+
 func TestNodeContextCancellation(t *testing.T) {
 	node := createTestNode(t)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -204,6 +360,44 @@ func TestNodeIDPersistence(t *testing.T) {
 	assert.Equal(t, id1, id2)
 }
 
+func TestRestoreKeepsIdentity(t *testing.T) {
+	node := createTestNode(t)
+	dataDir := node.config.Storage.DataDir
+	require.NoError(t, node.Start(context.Background()))
+
+	require.NoError(t, node.Replicator().Put("note", "remember me"))
+	archive, err := node.Backups().Create()
+	require.NoError(t, err)
+	manifest, err := backup.Verify(archive)
+	require.NoError(t, err)
+
+	// Blobs are left out, wherever the blob store keeps them
+	assert.Equal(t, blob.Dir, backup.BlobDir)
+	for file := range manifest.Files {
+		assert.NotContains(t, file, blob.Dir+"/")
+	}
+	require.NoError(t, node.Stop())
+	assert.NoFileExists(t, filepath.Join(dataDir, backup.LockFile))
+
+	// A fresh data directory restored from the archive brings the node back
+	// with the same identity and state
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.Storage.DataDir = t.TempDir()
+	_, err = backup.Restore(archive, cfg.Storage.DataDir)
+	require.NoError(t, err)
+
+	restored, err := New(cfg, mustCreateLogger(t))
+	require.NoError(t, err)
+	assert.Equal(t, node.ID(), restored.ID())
+
+	require.NoError(t, restored.Start(context.Background()))
+	defer restored.Stop()
+	value, err := restored.Replicator().Get("note")
+	require.NoError(t, err)
+	assert.JSONEq(t, `"remember me"`, string(value))
+}
+
 func TestNodeInvalidID(t *testing.T) {
 	cfg := config.Default()
 	cfg.Node.ID = "invalid-uuid"
@@ -219,3 +413,33 @@ func mustCreateLogger(t *testing.T) *logger.Logger {
 	require.NoError(t, err)
 	return log
 }
+
+func TestAIQueryThroughAdmin(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response":"42"}`))
+	}))
+	defer upstream.Close()
+
+	node := createTestNode(t)
+	node.config.AI.Endpoint = upstream.URL
+	node.config.Admin.Enabled = true
+	node.config.Admin.ListenAddr = "127.0.0.1:0"
+	require.NoError(t, node.Start(context.Background()))
+	defer node.Stop()
+
+	resp, err := http.Post("http://"+node.admin.Addr()+"/ai/query", "application/json",
+		strings.NewReader(`{"message":"what is the answer?"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "42", body["response"])
+
+	stats := node.Network().ServiceMetrics("ai").Snapshot()
+	assert.Equal(t, uint64(1), stats.Requests)
+	assert.Equal(t, uint64(0), stats.Failures)
+	assert.Contains(t, node.Network().GetNetworkReport().Sections, "ai_queue")
+}
@@ -0,0 +1,118 @@
+package p2p
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/audit"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// Directions of an audited connection
+const (
+	directionInbound  = "inbound"
+	directionOutbound = "outbound"
+)
+
+// newAuditLog creates the audit log configured for the node, or nil if it is
+// disabled
+func newAuditLog(cfg *config.Config) *audit.Log {
+	if !cfg.Audit.Enabled {
+		return nil
+	}
+	return audit.New(filepath.Join(cfg.Storage.DataDir, audit.LogFile), audit.Config{
+		MaxFileSize: int64(cfg.Audit.MaxFileSizeMB) << 20,
+		MaxFiles:    cfg.Audit.MaxFiles,
+		RateLimit:   cfg.Audit.RateLimit,
+	})
+}
+
+// AuditLog returns the peer lifecycle audit log, or nil if it is disabled
+func (n *Network) AuditLog() *audit.Log {
+	return n.audit
+}
+
+// recordAudit appends an entry to the audit log, if there is one
+func (n *Network) recordAudit(entry audit.Entry) {
+	if n.audit == nil {
+		return
+	}
+	if err := n.audit.Record(entry); err != nil {
+		n.logger.Warnf("failed to write audit log: %v", err)
+	}
+}
+
+// auditHandshake records a peer that completed the handshake, along with
+// the key it proved
+func (n *Network) auditHandshake(connection *Connection) {
+	if n.audit == nil {
+		return
+	}
+	entry := audit.Entry{
+		Event:     audit.EventHandshakeSucceeded,
+		PeerID:    connection.PeerID,
+		Address:   connection.Address,
+		Direction: connectionDirection(connection),
+	}
+	if identity := connection.Identity(); identity != nil {
+		if fingerprint, err := crypto.KeyFingerprint(identity); err == nil {
+			entry.KeyFingerprint = fingerprint
+		}
+	}
+	n.recordAudit(entry)
+}
+
+// auditHandshakeFailure records a handshake that failed, with the peer it
+// is attributed to if known
+func (n *Network) auditHandshakeFailure(connection *Connection, err error) {
+	entry := audit.Entry{
+		Event:     audit.EventHandshakeFailed,
+		Address:   connection.Address,
+		Direction: connectionDirection(connection),
+		Reason:    err.Error(),
+	}
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		entry.PeerID = hsErr.peerID
+	}
+	n.recordAudit(entry)
+}
+
+// auditDisconnect records a peer's connection closing and why
+func (n *Network) auditDisconnect(connection *Connection) {
+	reason := connection.CloseReason()
+	if reason == "" {
+		reason = "connection closed"
+	}
+	n.recordAudit(audit.Entry{
+		Event:     audit.EventPeerDisconnected,
+		PeerID:    connection.PeerID,
+		Address:   connection.Address,
+		Direction: connectionDirection(connection),
+		Reason:    reason,
+		TraceID:   connection.closeTrace(),
+	})
+}
+
+// auditReputation records a peer's reputation crossing the audit threshold
+func (n *Network) auditReputation(crossing topology.ReputationCrossing) {
+	event := audit.EventReputationRecovered
+	if crossing.Below {
+		event = audit.EventReputationLow
+	}
+	n.recordAudit(audit.Entry{
+		Event:      event,
+		PeerID:     crossing.PeerID,
+		Reputation: &crossing.Reputation,
+	})
+}
+
+// connectionDirection says whether we dialed a connection or accepted it
+func connectionDirection(connection *Connection) string {
+	if connection.Outbound {
+		return directionOutbound
+	}
+	return directionInbound
+}
@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// enableAudit makes a network keep an audit log
+func enableAudit(cfg *config.Config) {
+	cfg.Audit.Enabled = true
+}
+
+// waitForAudit waits for an entry of the given event about peerID and
+// returns it
+func waitForAudit(t *testing.T, network *Network, event, peerID string) audit.Entry {
+	t.Helper()
+	var found audit.Entry
+	require.Eventually(t, func() bool {
+		entries, err := network.AuditLog().Since(time.Time{})
+		require.NoError(t, err)
+		for _, entry := range entries {
+			if entry.Event == event && entry.PeerID == peerID {
+				found = entry
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 20*time.Millisecond)
+	return found
+}
+
+func TestAuditLogsConnectAndDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := startLocalNetworkWith(t, ctx, "audit-a", enableAudit)
+	b := startLocalNetworkWith(t, ctx, "audit-b", enableAudit)
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+
+	dialed := waitForAudit(t, a, audit.EventHandshakeSucceeded, "audit-b")
+	accepted := waitForAudit(t, b, audit.EventHandshakeSucceeded, "audit-a")
+	assert.Equal(t, "outbound", dialed.Direction)
+	assert.Equal(t, "inbound", accepted.Direction)
+	assert.True(t, strings.HasPrefix(dialed.KeyFingerprint, "sha256:"))
+	assert.True(t, strings.HasPrefix(accepted.KeyFingerprint, "sha256:"))
+	assert.NotEqual(t, dialed.KeyFingerprint, accepted.KeyFingerprint)
+
+	require.NoError(t, a.DisconnectPeer("audit-b", DisconnectOptions{Reason: "shutting down for maintenance", Drain: true}))
+	left := waitForAudit(t, a, audit.EventPeerDisconnected, "audit-b")
+	assert.Equal(t, "shutting down for maintenance", left.Reason)
+	told := waitForAudit(t, b, audit.EventPeerDisconnected, "audit-a")
+	assert.Equal(t, "peer said goodbye: shutting down for maintenance", told.Reason)
+	assert.Greater(t, left.Seq, dialed.Seq)
+}
+
+func TestAuditLogsFailedHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetworkWith(t, ctx, "audit-target", enableAudit)
+	conn, err := dialLocal(network)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("not a handshake\n"))
+	require.NoError(t, err)
+
+	failed := waitForAudit(t, network, audit.EventHandshakeFailed, "")
+	assert.Equal(t, "inbound", failed.Direction)
+	assert.NotEmpty(t, failed.Reason)
+}
+
+func TestAuditLogsReputationThreshold(t *testing.T) {
+	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Audit.Enabled = true
+	network := newLocalNetwork(t, cfg, "audit-node")
+	addPeers(network, 1)
+	peerID := network.peers.IDs()[0]
+
+	network.topologyMgr.UpdatePeerReputation(peerID, -0.9)
+	low := waitForAudit(t, network, audit.EventReputationLow, peerID)
+	require.NotNil(t, low.Reputation)
+	assert.InDelta(t, -0.9, *low.Reputation, 1e-9)
+
+	network.topologyMgr.UpdatePeerReputation(peerID, 0)
+	recovered := waitForAudit(t, network, audit.EventReputationRecovered, peerID)
+	require.NotNil(t, recovered.Reputation)
+	assert.Zero(t, *recovered.Reputation)
+}
+
+func TestAuditLogDisabledByDefault(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+	assert.Nil(t, network.AuditLog())
+}
@@ -0,0 +1,197 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// batchedMessage is a message waiting in a batcher, with its encoding and
+// the channel its sender waits on for the outcome of the write
+type batchedMessage struct {
+	msg  Message
+	data []byte
+	done chan error
+}
+
+// batcher coalesces the messages sent to one peer within a window, or up to
+// a byte budget, into a single write
+type batcher struct {
+	window   time.Duration
+	maxBytes int
+	codec    Codec
+	write    func([]batchedMessage) error
+
+	pending []batchedMessage
+	size    int
+	timer   *time.Timer
+	// mu is held across writes, so batches go out in the order they filled
+	mu sync.Mutex
+}
+
+// newBatcher creates a batcher for messages encoded in codec, handing each
+// batch to write
+func newBatcher(window time.Duration, maxBytes int, codec Codec, write func([]batchedMessage) error) *batcher {
+	return &batcher{
+		window:   window,
+		maxBytes: maxBytes,
+		codec:    codec,
+		write:    write,
+	}
+}
+
+// add queues an encoded message and returns the channel its write error, or
+// nil, is delivered on. A message that would overfill the pending batch
+// sends that batch first.
+func (b *batcher) add(msg Message, data []byte) <-chan error {
+	done := make(chan error, 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.pending) > 0 && b.size+len(data) > b.maxBytes {
+		b.flushLocked()
+	}
+	b.pending = append(b.pending, batchedMessage{msg: msg, data: data, done: done})
+	b.size += len(data)
+	if len(b.pending) == 1 {
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	if b.size >= b.maxBytes {
+		b.flushLocked()
+	}
+	return done
+}
+
+// flush sends the pending batch, if any
+func (b *batcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+// flushLocked sends the pending batch and tells its senders how it went.
+// b.mu must be held.
+func (b *batcher) flushLocked() {
+	if len(b.pending) == 0 {
+		return
+	}
+	b.timer.Stop()
+	batch := b.pending
+	b.pending = nil
+	b.size = 0
+
+	err := b.write(batch)
+	for _, message := range batch {
+		message.done <- err
+	}
+}
+
+// Batcher returns the connection's batcher, or nil if messages to the peer
+// are not batched
+func (c *Connection) Batcher() *batcher {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.batcher
+}
+
+// startBatching batches the messages to a peer that unpacks BATCH frames,
+// once its HELLO is in and the codec settled, if we batch at all
+func (n *Network) startBatching(connection *Connection, peer *Peer) {
+	if n.batchWindow <= 0 || !peer.HasCapability(CapabilityBatch) {
+		return
+	}
+	connection.mu.Lock()
+	defer connection.mu.Unlock()
+	if connection.batcher == nil {
+		codec := connection.codec
+		if codec == nil {
+			codec = CodecJSON
+		}
+		connection.batcher = newBatcher(n.batchWindow, n.batchBytes, codec, func(batch []batchedMessage) error {
+			return n.writeBatch(connection, codec, batch)
+		})
+	}
+}
+
+// sendBatched hands a message to the connection's batcher and waits for the
+// batch to be written. It reports false for messages that must not wait:
+// heartbeats and pings skip ahead of the batch, while bulk transfers and
+// messages that fit no batch go out alone after it.
+func (n *Network) sendBatched(b *batcher, msg Message) (bool, error) {
+	switch streamKind(msg.Type) {
+	case streamKindControl:
+		return false, nil
+	case streamKindBulk:
+		b.flush()
+		return false, nil
+	}
+	if frameCodec(b.codec, msg) != b.codec {
+		b.flush()
+		return false, nil
+	}
+
+	data, err := msg.SerializeWith(b.codec)
+	if err != nil || len(data) > b.maxBytes {
+		// Sent alone, where a failure to encode is reported as usual
+		b.flush()
+		return false, nil
+	}
+	return true, <-b.add(msg, data)
+}
+
+// writeBatch writes a batch as one BATCH frame, or a batch of one as the
+// message itself
+func (n *Network) writeBatch(connection *Connection, codec Codec, batch []batchedMessage) error {
+	var err error
+	if len(batch) == 1 {
+		err = n.sendFrame(connection, batch[0].msg)
+	} else {
+		messages := make([][]byte, len(batch))
+		for i, message := range batch {
+			messages[i] = message.data
+		}
+		err = n.sendFrame(connection, NewMessage(MessageTypeBatch, n.nodeID, BatchPayload{
+			Codec:    codec.Name(),
+			Messages: messages,
+		}))
+		if err == nil {
+			n.monitor.Stats.AddBatchSent(len(batch))
+		}
+	}
+	n.recordWrite(connection, err)
+	if err == nil {
+		connection.markWritten()
+	}
+	return err
+}
+
+// handleBatchMessage unpacks a BATCH frame and processes its messages as if
+// each had arrived in a frame of its own, rate limit included
+func (n *Network) handleBatchMessage(msg *Message, conn *Connection) error {
+	var batch BatchPayload
+	if err := msg.DecodePayload(&batch); err != nil {
+		return err
+	}
+	codec, _ := CodecByName(batch.Codec)
+
+	for _, data := range batch.Messages {
+		if !n.allowFrame(codec, data, conn) {
+			continue
+		}
+		inner, err := DeserializeMessageWith(codec, data)
+		if err != nil {
+			n.monitor.Stats.IncrementDecodeFailures()
+			n.rejectMessage(conn, messageID(codec, data), ErrorCodeInvalidMessage, "batched message could not be decoded", topology.EventDeserializeFailure)
+			continue
+		}
+		if inner.Type == MessageTypeBatch {
+			n.rejectMessage(conn, inner.ID, ErrorCodeInvalidMessage, fmt.Sprintf("%s messages cannot be batched", MessageTypeBatch), topology.EventInvalidMessage)
+			continue
+		}
+		n.processDecoded(inner, conn)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startBatchPair starts two networks connected over TCP, where the writes
+// batching saves are syscalls, that batch messages to each other if batching
+func startBatchPair(tb testing.TB, ctx context.Context, batching bool) (*Network, *Network) {
+	start := func(nodeID string) *Network {
+		cfg := config.Default()
+		cfg.P2P.ListenPort = 0
+		cfg.P2P.Batching.Enabled = batching
+		cfg.Storage.DataDir = tb.TempDir()
+		log, err := logger.New("error", "json", "")
+		require.NoError(tb, err)
+
+		network, err := New(cfg, log, nodeID)
+		require.NoError(tb, err)
+		require.NoError(tb, network.Start(ctx))
+		tb.Cleanup(func() { network.Stop() })
+		return network
+	}
+	a, b := start("batch-a"), start("batch-b")
+
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(tb, err)
+	require.Eventually(tb, func() bool {
+		connection := a.peerConnection(b.nodeID)
+		return connection != nil && (connection.Batcher() != nil) == batching
+	}, 5*time.Second, 10*time.Millisecond)
+	return a, b
+}
+
+func TestBatching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, b := startBatchPair(t, ctx, true)
+
+	var received atomic.Int64
+	b.RegisterHandler("NOTE", func(msg Message) { received.Add(1) })
+
+	// Messages sent at once share frames
+	const count = 50
+	framesBefore := a.monitor.Stats.GetStats().TotalMessagesSent
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, a.SendMessage(ctx, b.nodeID, NewMessage("NOTE", a.nodeID, fmt.Sprintf("note %d", i))))
+		}(i)
+	}
+	wg.Wait()
+
+	require.Eventually(t, func() bool {
+		return received.Load() == count
+	}, 5*time.Second, 10*time.Millisecond)
+	stats := a.monitor.Stats.GetStats()
+	assert.NotZero(t, stats.BatchesSent)
+	assert.GreaterOrEqual(t, stats.MessagesBatched, 2*stats.BatchesSent)
+	assert.Less(t, stats.TotalMessagesSent-framesBefore, uint64(count))
+
+	// while heartbeats and pings never wait for a batch
+	batcher := a.peerConnection(b.nodeID).Batcher()
+	for _, msgType := range []string{MessageTypeHeartbeat, MessageTypePing, MessageTypePong} {
+		batched, _ := a.sendBatched(batcher, NewMessage(msgType, a.nodeID, nil))
+		assert.False(t, batched, msgType)
+	}
+}
+
+func TestBatchingNegotiated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, _ := startBatchPair(t, ctx, true)
+
+	// Peers that do not unpack batches are sent every message on its own
+	peer := NewPeer("old-node", "pipe", ProtocolVersion)
+	peer.SetCapabilities([]string{CapabilityEncryption})
+	connection := &Connection{PeerID: peer.ID}
+	a.startBatching(connection, peer)
+	assert.Nil(t, connection.Batcher())
+
+	peer.SetCapabilities([]string{CapabilityEncryption, CapabilityBatch})
+	a.startBatching(connection, peer)
+	assert.NotNil(t, connection.Batcher())
+}
+
+func TestNestedBatchRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "batch-node")
+	peer, remote, codes := attachPipePeer(t, network, "batch-peer")
+
+	delivered := make(chan Message, 1)
+	network.RegisterHandler("NOTE", func(msg Message) { delivered <- msg })
+
+	encode := func(msg Message) []byte {
+		data, err := msg.Serialize()
+		require.NoError(t, err)
+		return data
+	}
+	inner := NewMessage(MessageTypeBatch, peer.ID, BatchPayload{Codec: CodecJSON.Name(), Messages: [][]byte{encode(NewMessage("NOTE", peer.ID, nil))}})
+	writeFrame(t, remote, NewMessage(MessageTypeBatch, peer.ID, BatchPayload{
+		Codec:    CodecJSON.Name(),
+		Messages: [][]byte{encode(inner), encode(NewMessage("NOTE", peer.ID, "kept"))},
+	}))
+
+	select {
+	case code := <-codes:
+		assert.Equal(t, ErrorCodeInvalidMessage, code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("nested batch not rejected")
+	}
+	select {
+	case msg := <-delivered:
+		assert.Equal(t, "kept", decodeString(t, msg))
+	case <-time.After(2 * time.Second):
+		t.Fatal("message batched next to the nested batch not delivered")
+	}
+}
+
+// decodeString decodes a message's string payload
+func decodeString(t *testing.T, msg Message) string {
+	var text string
+	require.NoError(t, msg.DecodePayload(&text))
+	return text
+}
+
+func BenchmarkBatching(b *testing.B) {
+	for _, batching := range []bool{false, true} {
+		name := "unbatched"
+		if batching {
+			name = "batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sender, receiver := startBatchPair(b, ctx, batching)
+			msg := NewMessage("NOTE", sender.nodeID, "a small note")
+			framesBefore := sender.monitor.Stats.GetStats().TotalMessagesSent
+
+			b.SetParallelism(256)
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := sender.SendMessage(ctx, receiver.nodeID, msg); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			elapsed := time.Since(start)
+			b.StopTimer()
+
+			// Every frame is a write, and so a syscall, on the connection
+			frames := sender.monitor.Stats.GetStats().TotalMessagesSent - framesBefore
+			b.ReportMetric(float64(frames)/float64(b.N), "writes/msg")
+			b.ReportMetric(float64(b.N)/elapsed.Seconds(), "msgs/s")
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// BroadcastResult reports how a broadcast went for each peer
+type BroadcastResult struct {
+	// Succeeded lists the peers the message was written to
+	Succeeded []string
+	// Failed maps each peer the message could not be sent to to the reason.
+	// Peers still being written to when the caller's context ended fail
+	// with the context's error.
+	Failed map[string]error
+	// Skipped lists the peers that lack a capability the message needs
+	Skipped []string
+	// Damped lists the peers left out for flapping
+	Damped []string
+}
+
+// Err joins the errors of the failed peers, or returns nil if none failed
+func (r *BroadcastResult) Err() error {
+	var errs []error
+	for peerID, err := range r.Failed {
+		errs = append(errs, fmt.Errorf("peer %s: %w", peerID, err))
+	}
+	return errors.Join(errs...)
+}
+
+// Broadcast sends a message to all connected peers, writing to at most
+// DefaultBroadcastConcurrency of them at once so one slow peer does not hold
+// up the rest. With tags, only peers whose metadata carries all of them are
+// sent to (see PeersWithTag). Slow peers, whose writes keep timing out, are
+// written to after the rest, and peers damped for flapping not at all. It returns once every peer was tried or ctx
+// ends, and the returned error joins the per-peer failures.
+func (n *Network) Broadcast(ctx context.Context, msg Message, tags ...string) (*BroadcastResult, error) {
+	result := &BroadcastResult{Failed: make(map[string]error)}
+	traceMessage(ctx, &msg)
+
+	type target struct {
+		peerID string
+		conn   *Connection
+		slow   bool
+	}
+	var targets []target
+	for _, peer := range n.peers.Connected() {
+		conn := peer.GetConnection()
+		if conn == nil || !topology.MatchesTags(peer.Metadata(), tags) {
+			continue
+		}
+		if n.flaps.Damped(peer.ID) {
+			result.Damped = append(result.Damped, peer.ID)
+			continue
+		}
+		if err := checkCapability(peer, msg.Type); err != nil {
+			n.logger.Debugf("skipping broadcast to %s: %v", peer.ID, err)
+			result.Skipped = append(result.Skipped, peer.ID)
+			continue
+		}
+		targets = append(targets, target{peerID: peer.ID, conn: conn, slow: conn.Slow()})
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return !targets[i].slow && targets[j].slow })
+
+	type outcome struct {
+		peerID string
+		err    error
+	}
+	// Buffered so workers finishing after we gave up never block
+	outcomes := make(chan outcome, len(targets))
+	queue := make(chan target)
+	for i := 0; i < DefaultBroadcastConcurrency && i < len(targets); i++ {
+		n.background(func() {
+			for t := range queue {
+				outcomes <- outcome{peerID: t.peerID, err: n.send(t.conn, msg)}
+			}
+		})
+	}
+
+	pending := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		pending[t.peerID] = true
+	}
+	n.background(func() {
+		defer close(queue)
+		for _, t := range targets {
+			select {
+			case queue <- t:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	for len(pending) > 0 {
+		select {
+		case o := <-outcomes:
+			delete(pending, o.peerID)
+			if o.err != nil {
+				n.logger.Errorf("failed to broadcast message to peer %s: %v", o.peerID, o.err)
+				result.Failed[o.peerID] = o.err
+			} else {
+				result.Succeeded = append(result.Succeeded, o.peerID)
+			}
+		case <-ctx.Done():
+			for peerID := range pending {
+				result.Failed[peerID] = ctx.Err()
+			}
+			pending = nil
+		}
+	}
+
+	return result, result.Err()
+}
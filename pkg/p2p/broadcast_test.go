@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// attachStalledPeer registers a connected peer that never reads, so writes
+// to it block until their deadline
+func attachStalledPeer(t *testing.T, network *Network, peerID string) *Peer {
+	peer := NewPeer(peerID, "pipe", ProtocolVersion)
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	peer.SetConnection(&Connection{ID: "stalled", PeerID: peerID, Conn: local, CreatedAt: time.Now(), LastSeen: time.Now()})
+
+	require.NoError(t, network.peers.Add(peer, nil))
+	return peer
+}
+
+func TestBroadcastReportsPerPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "broadcast-node")
+
+	attachPipePeer(t, network, "fast-1")
+	attachPipePeer(t, network, "fast-2")
+	attachStalledPeer(t, network, "slow")
+	_, closed, _ := attachPipePeer(t, network, "gone")
+	closed.Close()
+
+	broadcastCtx, cancelBroadcast := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancelBroadcast()
+	start := time.Now()
+	result, err := network.Broadcast(broadcastCtx, NewMessage("NOTE", network.nodeID, nil))
+
+	// The slow peer costs the caller its context timeout, not the write deadline
+	assert.Less(t, time.Since(start), 2*time.Second)
+	require.Error(t, err)
+	assert.ElementsMatch(t, []string{"fast-1", "fast-2"}, result.Succeeded)
+	require.Len(t, result.Failed, 2)
+	assert.ErrorIs(t, result.Failed["slow"], context.DeadlineExceeded)
+	assert.NotErrorIs(t, result.Failed["gone"], context.DeadlineExceeded)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "peer gone")
+}
+
+func TestBroadcastWithoutFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "broadcast-node")
+
+	result, err := network.Broadcast(ctx, NewMessage("NOTE", network.nodeID, nil))
+	require.NoError(t, err)
+	assert.Empty(t, result.Succeeded)
+
+	for _, id := range []string{"a", "b", "c"} {
+		attachPipePeer(t, network, id)
+	}
+	result, err = network.Broadcast(ctx, NewMessage("NOTE", network.nodeID, nil))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, result.Succeeded)
+	assert.Empty(t, result.Failed)
+	assert.NoError(t, result.Err())
+}
+
+func TestBroadcastSkipsUnconnectedPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "broadcast-node")
+
+	attachPipePeer(t, network, "connected")
+	// Known from a peer list, never dialed
+	require.NoError(t, network.peers.Add(NewPeer("listed", "192.0.2.1:8080", ProtocolVersion), nil))
+	// Connected once, since closed
+	closed, _, _ := attachPipePeer(t, network, "closed")
+	network.closeConnection(closed.GetConnection())
+
+	result, err := network.Broadcast(ctx, NewMessage("NOTE", network.nodeID, nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"connected"}, result.Succeeded)
+	assert.Empty(t, result.Failed)
+
+	status := network.Status()
+	assert.Equal(t, 3, status.TotalPeers)
+	assert.Equal(t, 1, status.ConnectedPeers)
+	assert.Len(t, network.KnownPeers(), 3)
+	require.Len(t, network.ConnectedPeers(), 1)
+	assert.Equal(t, "connected", network.ConnectedPeers()[0].ID)
+	assert.False(t, network.heartbeatPayload().Full)
+}
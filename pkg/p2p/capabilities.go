@@ -0,0 +1,130 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCapabilityNotSupported is returned when a message needs a capability the
+// receiving peer did not advertise
+var ErrCapabilityNotSupported = errors.New("peer does not support required capability")
+
+// requiredCapabilities maps message types to the capability a peer must
+// advertise before we send it that type
+var requiredCapabilities = map[string]string{
+	MessageTypeSyncRequest:  CapabilitySync,
+	MessageTypeSyncResponse: CapabilitySync,
+	MessageTypeDataSync:     CapabilitySync,
+	MessageTypeAIRequest:    CapabilityAI,
+
+	MessageTypePeerListRequest: CapabilityPeerListPaging,
+	MessageTypeTrace:           CapabilityTrace,
+	MessageTypeTraceReply:      CapabilityTrace,
+	MessageTypeAIResponseChunk: CapabilityAIStream,
+	MessageTypeAICancel:        CapabilityAIStream,
+	MessageTypeTaskSubmit:      CapabilityTask,
+	MessageTypeBlobRequest:     CapabilityBlob,
+}
+
+// localCapabilities returns the capabilities this node advertises, derived
+// from config and from what is running
+func (n *Network) localCapabilities() []string {
+	capabilities := []string{CapabilityEncryption, CapabilityPeerListPaging, CapabilityBatch, CapabilityTrace}
+
+	if n.config.P2P.EnableDiscovery {
+		capabilities = append(capabilities, CapabilityDiscovery)
+	}
+	if n.config.P2P.EnableRelay {
+		capabilities = append(capabilities, CapabilityRelay)
+	}
+	if n.quicListener != nil {
+		capabilities = append(capabilities, CapabilityQUIC)
+	}
+	if n.codec != CodecJSON {
+		capabilities = append(capabilities, n.codec.Name())
+	}
+
+	n.handlersMu.RLock()
+	if len(n.handlers[MessageTypeSyncRequest]) > 0 || len(n.handlers[MessageTypeDataSync]) > 0 {
+		capabilities = append(capabilities, CapabilitySync)
+	}
+	n.handlersMu.RUnlock()
+
+	n.advertisedMu.RLock()
+	for name, available := range n.advertised {
+		if available() {
+			capabilities = append(capabilities, name)
+		}
+	}
+	n.advertisedMu.RUnlock()
+
+	return capabilities
+}
+
+// AdvertiseCapability adds a capability to our HELLO whenever available
+// reports true, e.g. for a service that is only offered while it is healthy.
+// The check runs each time a HELLO is sent.
+func (n *Network) AdvertiseCapability(name string, available func() bool) {
+	n.advertisedMu.Lock()
+	defer n.advertisedMu.Unlock()
+
+	if n.advertised == nil {
+		n.advertised = make(map[string]func() bool)
+	}
+	n.advertised[name] = available
+}
+
+// PeersWithCapability returns the connected peers that advertised a capability
+func (n *Network) PeersWithCapability(name string) []PeerSnapshot {
+	var peers []PeerSnapshot
+	for _, peer := range n.ConnectedPeers() {
+		if peer.HasCapability(name) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// PeerReputation returns a connected peer's reputation on the -1.0 to 1.0
+// scale, or 0 if the peer is unknown
+func (n *Network) PeerReputation(peerID string) float64 {
+	info, exists := n.topologyMgr.GetPeerInfo(peerID)
+	if !exists {
+		return 0
+	}
+	return info.Reputation
+}
+
+// checkCapability returns ErrCapabilityNotSupported if msgType needs a
+// capability the peer has not advertised
+func checkCapability(peer *Peer, msgType string) error {
+	capability, required := requiredCapabilities[msgType]
+	if !required || peer.HasCapability(capability) {
+		return nil
+	}
+	return fmt.Errorf("peer %s cannot receive %s without %q: %w", peer.ID, msgType, capability, ErrCapabilityNotSupported)
+}
+
+// sendHello tells a newly connected peer who we are and what we support
+func (n *Network) sendHello(connection *Connection) error {
+	hello := NewMessage(MessageTypeHello, n.nodeID, HelloPayload{
+		NodeID:       n.nodeID,
+		Version:      n.protocolVersion,
+		MinVersion:   n.minProtocolVersion,
+		ListenPort:   n.sharedListenPort(),
+		Capabilities: n.localCapabilities(),
+		QUICPort:     n.quicPort(),
+		Metadata:     n.config.P2P.Metadata,
+		Listeners:    n.helloListeners(),
+		ObservedHost: observedHost(connection.Conn),
+	})
+	return n.sendMessageToConn(connection.Conn, hello)
+}
+
+// listenPort returns the port of the first listener, which QUIC shares
+func (n *Network) listenPort() int {
+	if len(n.listeners) > 0 {
+		return n.listeners[0].port()
+	}
+	return n.config.P2P.ListenPort
+}
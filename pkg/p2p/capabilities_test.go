@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerHasCapability(t *testing.T) {
+	peer := NewPeer("peer-1", "127.0.0.1:8080", ProtocolVersion)
+	assert.False(t, peer.HasCapability(CapabilityRelay))
+
+	peer.SetCapabilities([]string{CapabilityEncryption, CapabilityRelay})
+	assert.True(t, peer.HasCapability(CapabilityRelay))
+	assert.False(t, peer.HasCapability(CapabilitySync))
+	assert.Equal(t, []string{CapabilityEncryption, CapabilityRelay}, peer.GetCapabilities())
+}
+
+func TestCapabilityNegotiation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The rich node relays and serves sync requests
+	rich := startLocalNetwork(t, ctx, "rich-node")
+	syncRequests := make(chan Message, 1)
+	rich.RegisterHandler(MessageTypeSyncRequest, func(msg Message) {
+		syncRequests <- msg
+	})
+
+	// The bare node does neither
+	bare := startLocalNetworkWith(t, ctx, "bare-node", func(cfg *config.Config) {
+		cfg.P2P.EnableRelay = false
+	})
+
+	_, err := bare.Connect(ctx, localAddr(rich))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(rich.PeersWithCapability(CapabilityEncryption)) == 1 &&
+			len(bare.PeersWithCapability(CapabilityEncryption)) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Empty(t, rich.PeersWithCapability(CapabilityRelay))
+	assert.Empty(t, rich.PeersWithCapability(CapabilitySync))
+	require.Len(t, bare.PeersWithCapability(CapabilityRelay), 1)
+	require.Len(t, bare.PeersWithCapability(CapabilitySync), 1)
+	assert.Equal(t, "rich-node", bare.PeersWithCapability(CapabilitySync)[0].ID)
+
+	// Sync towards the bare node is refused locally instead of being sent
+	err = rich.SendMessage(ctx, "bare-node", NewMessage(MessageTypeSyncRequest, rich.nodeID, nil))
+	assert.ErrorIs(t, err, ErrCapabilityNotSupported)
+	result, err := rich.Broadcast(context.Background(), NewMessage(MessageTypeSyncRequest, rich.nodeID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bare-node"}, result.Skipped)
+
+	// The other direction works
+	require.NoError(t, bare.SendMessage(ctx, "rich-node", NewMessage(MessageTypeSyncRequest, bare.nodeID, SyncRequestPayload{Keys: []string{"k"}})))
+	select {
+	case msg := <-syncRequests:
+		assert.Equal(t, "bare-node", msg.Sender)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync request not delivered")
+	}
+
+	// Gossip from the rich node still reaches the bare node, which just doesn't relay it
+	delivered := make(chan struct{}, 1)
+	bare.RegisterHandler("RUMOR", func(msg Message) { delivered <- struct{}{} })
+	require.NoError(t, rich.Gossip(NewMessage("RUMOR", rich.nodeID, nil), 1))
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gossip not delivered to bare node")
+	}
+}
+
+func TestAdvertiseCapability(t *testing.T) {
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	network, err := New(cfg, log, "advertising-node")
+	require.NoError(t, err)
+
+	healthy := true
+	network.AdvertiseCapability(CapabilityAI, func() bool { return healthy })
+	assert.Contains(t, network.localCapabilities(), CapabilityAI)
+
+	healthy = false
+	assert.NotContains(t, network.localCapabilities(), CapabilityAI)
+}
@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrAddressNotAllowed is returned by Connect when the peer's address is
+// outside the configured allowlist or inside the denylist
+var ErrAddressNotAllowed = errors.New("address not allowed by policy")
+
+// addressFilter decides which addresses we talk to. Denied ranges win over
+// allowed ones, and an empty allowlist allows everything not denied.
+type addressFilter struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// newAddressFilter parses the allowed and denied CIDR ranges
+func newAddressFilter(allowed, denied []string) (*addressFilter, error) {
+	filter := &addressFilter{}
+	var err error
+	if filter.allowed, err = parseCIDRs(allowed); err != nil {
+		return nil, fmt.Errorf("invalid allowed CIDR: %w", err)
+	}
+	if filter.denied, err = parseCIDRs(denied); err != nil {
+		return nil, fmt.Errorf("invalid denied CIDR: %w", err)
+	}
+	return filter, nil
+}
+
+// parseCIDRs parses a list of CIDR ranges
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	ranges := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// check returns an error wrapping ErrAddressNotAllowed unless we may talk to
+// the host of address, a host:port or bare host. Hosts that are not IP
+// addresses are only allowed when there is no allowlist.
+func (f *addressFilter) check(address string) error {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	// Link-local IPv6 addresses carry the interface as a zone
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+
+	for _, ipNet := range f.denied {
+		if ip != nil && ipNet.Contains(ip) {
+			return fmt.Errorf("%s is in denied range %s: %w", host, ipNet, ErrAddressNotAllowed)
+		}
+	}
+	if len(f.allowed) == 0 {
+		return nil
+	}
+	for _, ipNet := range f.allowed {
+		if ip != nil && ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in an allowed range: %w", host, ErrAddressNotAllowed)
+}
+
+// isIPLiteral reports whether address, a host:port, names its host by IP
+func isIPLiteral(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return err == nil && net.ParseIP(host) != nil
+}
@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		address string
+		allow   bool
+	}{
+		{"empty allowlist allows all", nil, nil, "203.0.113.7:8080", true},
+		{"empty allowlist allows names", nil, nil, "peer.example:8080", true},
+		{"inside allowlist", []string{"10.0.0.0/8"}, nil, "10.1.2.3:8080", true},
+		{"outside allowlist", []string{"10.0.0.0/8"}, nil, "192.168.1.1:8080", false},
+		{"names outside any allowlist", []string{"10.0.0.0/8"}, nil, "peer.example:8080", false},
+		{"denied", nil, []string{"198.51.100.0/24"}, "198.51.100.9:8080", false},
+		{"deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.66.0.0/16"}, "10.66.1.1:8080", false},
+		{"bare host", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"IPv6 inside allowlist", []string{"fd00::/8"}, nil, "[fd00::2]:8080", true},
+		{"IPv6 outside allowlist", []string{"fd00::/8"}, nil, "[2001:db8::1]:8080", false},
+		{"IPv6 denied", nil, []string{"2001:db8::/32"}, "[2001:db8::1]:8080", false},
+		{"IPv6 with zone", []string{"fe80::/10"}, nil, "[fe80::1%eth0]:8080", true},
+		{"IPv4-mapped IPv6", []string{"10.0.0.0/8"}, nil, "[::ffff:10.1.2.3]:8080", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := newAddressFilter(tt.allowed, tt.denied)
+			require.NoError(t, err)
+			err = filter.check(tt.address)
+			if tt.allow {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrAddressNotAllowed)
+			}
+		})
+	}
+
+	_, err := newAddressFilter([]string{"10.0.0.0"}, nil)
+	assert.Error(t, err)
+}
+
+// filterCIDRs gives a network the given CIDR lists
+func filterCIDRs(allowed, denied []string) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.P2P.AllowedCIDRs = allowed
+		cfg.P2P.DeniedCIDRs = denied
+	}
+}
+
+func TestDeniedInboundConnections(t *testing.T) {
+	requireTCP(t)
+	ctx := context.Background()
+	guarded := startLocalNetworkWith(t, ctx, "guarded-node", filterCIDRs(nil, []string{"127.0.0.0/8"}))
+	dialer := startLocalNetwork(t, ctx, "dialer-node")
+
+	// The connection is closed before any handshake
+	_, err := dialer.Connect(ctx, "127.0.0.1:"+strconv.Itoa(guarded.listenPort()))
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return guarded.monitor.Stats.GetStats().ConnectionsDenied == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	stats := guarded.monitor.Stats.GetStats()
+	assert.Zero(t, stats.ConnectionsAccepted)
+	assert.Zero(t, stats.HandshakeFailures)
+	assert.Empty(t, guarded.Peers())
+}
+
+func TestDialsOutsideAllowlist(t *testing.T) {
+	requireTCP(t)
+	ctx := context.Background()
+	remote := startLocalNetwork(t, ctx, "remote-node")
+	port := strconv.Itoa(remote.listenPort())
+
+	local := startLocalNetworkWith(t, ctx, "local-node", filterCIDRs([]string{"10.0.0.0/8"}, nil))
+	_, err := local.Connect(ctx, "127.0.0.1:"+port)
+	assert.ErrorIs(t, err, ErrAddressNotAllowed)
+
+	// Names are checked once resolved
+	_, err = local.Connect(ctx, "localhost:"+port)
+	assert.ErrorIs(t, err, ErrAddressNotAllowed)
+	assert.Equal(t, uint64(2), local.monitor.Stats.GetStats().DialsDenied)
+	assert.Zero(t, remote.monitor.Stats.GetStats().ConnectionsAccepted)
+
+	// Addresses inside the allowlist are dialed as usual
+	allowing := startLocalNetworkWith(t, ctx, "allowing-node", filterCIDRs([]string{"127.0.0.0/8", "::1/128"}, nil))
+	peerID, err := allowing.Connect(ctx, "127.0.0.1:"+port)
+	require.NoError(t, err)
+	assert.Equal(t, "remote-node", peerID)
+}
+
+func TestDeniedIPv6Dials(t *testing.T) {
+	requireIPv6Loopback(t)
+	ctx := context.Background()
+	remote := startLocalNetwork(t, ctx, "remote-node")
+	local := startLocalNetworkWith(t, ctx, "local-node", filterCIDRs(nil, []string{"::1/128"}))
+
+	_, err := local.Connect(ctx, net.JoinHostPort("::1", strconv.Itoa(remote.listenPort())))
+	assert.ErrorIs(t, err, ErrAddressNotAllowed)
+	require.Never(t, func() bool { return len(remote.Peers()) > 0 }, 200*time.Millisecond, 20*time.Millisecond)
+}
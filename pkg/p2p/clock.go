@@ -0,0 +1,71 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// clockSkewSmoothing is the weight of each new heartbeat sample in a peer's
+// clock skew estimate
+const clockSkewSmoothing = 0.25
+
+// withinClockSkew reports whether a message dated timestamp is at most
+// maxSkew away from now in either direction. A missing timestamp never is.
+func withinClockSkew(timestamp, now time.Time, maxSkew time.Duration) bool {
+	if timestamp.IsZero() {
+		return false
+	}
+	offset := timestamp.Sub(now)
+	return offset >= -maxSkew && offset <= maxSkew
+}
+
+// checkClockSkew rejects a message dated too far from our clock so it cannot
+// skew LastSeen or time-ordered processing. The sender gets an ERROR; peers
+// that keep doing it after DefaultClockSkewStrikes also lose reputation.
+func (n *Network) checkClockSkew(msg *Message, connection *Connection) bool {
+	if withinClockSkew(msg.Timestamp, time.Now(), n.maxClockSkew) {
+		return true
+	}
+
+	n.messageLogger(msg).Warnf("message %s from %s is dated %s, more than %s from our clock",
+		msg.ID, connection.Address, msg.Timestamp.Format(time.RFC3339), n.maxClockSkew)
+
+	peer, exists := n.peers.Get(connection.PeerID)
+	if exists {
+		peer.IncrementErrorCount()
+		if peer.RecordSkewViolation() > DefaultClockSkewStrikes {
+			n.reputation.RecordEvent(connection.PeerID, topology.EventClockSkew)
+		}
+	}
+
+	// Never answer an ERROR with an ERROR
+	if msg.Type != MessageTypeError {
+		n.sendError(connection, msg.ID, ErrorCodeClockSkew,
+			fmt.Sprintf("timestamp %s is more than %s from receiver clock", msg.Timestamp.Format(time.RFC3339), n.maxClockSkew))
+	}
+	return false
+}
+
+// sampleClockSkew updates the sender's clock skew estimate from a heartbeat.
+// The sample includes the one-way delay, which is small next to the skews
+// worth diagnosing.
+func (n *Network) sampleClockSkew(msg *Message, connection *Connection) {
+	peer, exists := n.peers.Get(connection.PeerID)
+	if exists {
+		peer.AddClockSample(msg.Timestamp.Sub(time.Now()))
+	}
+}
+
+// clockSkewReport lists the estimated clock offset in seconds of every
+// connected peer we have heartbeat samples from
+func (n *Network) clockSkewReport() map[string]float64 {
+	report := make(map[string]float64)
+	for _, peer := range n.peers.Connected() {
+		if skew, ok := peer.ClockSkew(); ok {
+			report[peer.ID] = skew.Seconds()
+		}
+	}
+	return report
+}
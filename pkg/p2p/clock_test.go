@@ -0,0 +1,215 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// attachPipePeer registers peerID as a connected peer whose end of the
+// connection is the returned pipe. Codes of ERRORs sent to it are delivered on
+// the channel; other replies are discarded.
+func attachPipePeer(t *testing.T, network *Network, peerID string) (*Peer, net.Conn, <-chan string) {
+	peer := NewPeer(peerID, "pipe", ProtocolVersion)
+	require.NoError(t, network.peers.Add(peer, nil))
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	connection := &Connection{ID: "pipe", PeerID: peer.ID, Conn: local, CreatedAt: time.Now(), LastSeen: time.Now()}
+	peer.SetConnection(connection)
+	go network.readMessages(local, connection)
+
+	codes := make(chan string, 8)
+	go func() {
+		reader := bufio.NewReader(remote)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			if msg, err := DeserializeMessage(line); err == nil && msg.Type == MessageTypeError {
+				var payload ErrorPayload
+				if msg.DecodePayload(&payload) == nil {
+					codes <- payload.Code
+				}
+			}
+		}
+	}()
+	return peer, remote, codes
+}
+
+// writeFrame sends msg as one frame on conn
+func writeFrame(t *testing.T, conn net.Conn, msg Message) {
+	data, err := msg.Serialize()
+	require.NoError(t, err)
+	_, err = conn.Write(append(data, '\n'))
+	require.NoError(t, err)
+}
+
+func TestWithinClockSkew(t *testing.T) {
+	now := time.Now()
+	const maxSkew = 5 * time.Minute
+
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		expected  bool
+	}{
+		{name: "now", timestamp: now, expected: true},
+		{name: "at future bound", timestamp: now.Add(maxSkew), expected: true},
+		{name: "at past bound", timestamp: now.Add(-maxSkew), expected: true},
+		{name: "past future bound", timestamp: now.Add(maxSkew + time.Nanosecond), expected: false},
+		{name: "past past bound", timestamp: now.Add(-maxSkew - time.Nanosecond), expected: false},
+		{name: "years ahead", timestamp: now.AddDate(5, 0, 0), expected: false},
+		{name: "missing", timestamp: time.Time{}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, withinClockSkew(tt.timestamp, now, maxSkew))
+		})
+	}
+}
+
+func TestSkewedMessagesRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "clock-node")
+
+	peer, remote, codes := attachPipePeer(t, network, "skewed-peer")
+
+	delivered := make(chan Message, 1)
+	network.RegisterHandler("NOTE", func(msg Message) { delivered <- msg })
+
+	send := func(offset time.Duration) {
+		msg := NewMessage("NOTE", peer.ID, nil)
+		msg.Timestamp = time.Now().Add(offset)
+		writeFrame(t, remote, msg)
+	}
+	expectRejections := func(count int) {
+		for i := 0; i < count; i++ {
+			select {
+			case code := <-codes:
+				assert.Equal(t, ErrorCodeClockSkew, code)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("skewed message %d not rejected", i+1)
+			}
+		}
+	}
+
+	// A clock a minute off is tolerated
+	send(time.Minute)
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message within the skew bound not delivered")
+	}
+
+	// The first strikes are refused without a reputation penalty
+	initial := network.PeerReputation(peer.ID)
+	for i := 0; i < DefaultClockSkewStrikes; i++ {
+		if i%2 == 0 {
+			send(10 * time.Minute)
+		} else {
+			send(-10 * time.Minute)
+		}
+	}
+	expectRejections(DefaultClockSkewStrikes)
+	assert.Equal(t, initial, network.PeerReputation(peer.ID))
+
+	// Repeat offenders lose reputation
+	send(365 * 24 * time.Hour)
+	expectRejections(1)
+	assert.Less(t, network.PeerReputation(peer.ID), initial)
+	assert.Equal(t, uint64(DefaultClockSkewStrikes+1), peer.ErrorCount())
+	assert.Empty(t, delivered)
+}
+
+func TestPeerClockSkewEstimate(t *testing.T) {
+	peer := NewPeer("peer", "127.0.0.1:8080", ProtocolVersion)
+	_, ok := peer.ClockSkew()
+	assert.False(t, ok)
+
+	peer.AddClockSample(2 * time.Second)
+	skew, ok := peer.ClockSkew()
+	require.True(t, ok)
+	assert.Equal(t, 2*time.Second, skew)
+
+	// Later samples are smoothed in rather than replacing the estimate
+	peer.AddClockSample(6 * time.Second)
+	skew, _ = peer.ClockSkew()
+	assert.Equal(t, 3*time.Second, skew)
+
+	for i := 0; i < 50; i++ {
+		peer.AddClockSample(-time.Second)
+	}
+	skew, _ = peer.ClockSkew()
+	assert.InDelta(t, float64(-time.Second), float64(skew), float64(time.Millisecond))
+}
+
+func TestHeartbeatsSampleClockSkew(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "clock-node")
+	peer, remote, _ := attachPipePeer(t, network, "fast-clock-node")
+
+	// The peer's clock runs 30 seconds ahead
+	heartbeat := NewMessage(MessageTypeHeartbeat, peer.ID, HeartbeatPayload{NodeID: peer.ID, TS: time.Now().Unix()})
+	heartbeat.Timestamp = time.Now().Add(30 * time.Second)
+	writeFrame(t, remote, heartbeat)
+
+	require.Eventually(t, func() bool {
+		_, ok := peer.ClockSkew()
+		return ok
+	}, 5*time.Second, 20*time.Millisecond)
+
+	skews := network.clockSkewReport()
+	assert.InDelta(t, 30, skews["fast-clock-node"], 1)
+}
+
+func TestLivenessUsesReceiveTime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Clocks an hour off are accepted, so only liveness is under test
+	network := startLocalNetworkWith(t, ctx, "clock-node", func(cfg *config.Config) {
+		cfg.P2P.MaxClockSkew = int((2 * time.Hour).Seconds())
+	})
+
+	for _, offset := range []time.Duration{-time.Hour, time.Hour} {
+		peer, remote, _ := attachPipePeer(t, network, fmt.Sprintf("skewed-%v", offset))
+		connection := peer.GetConnection()
+		peer.mu.Lock()
+		peer.LastSeen = time.Now().Add(-time.Minute)
+		peer.mu.Unlock()
+		connection.mu.Lock()
+		connection.LastSeen = time.Now().Add(-time.Minute)
+		connection.mu.Unlock()
+		require.False(t, peer.IsAlive(30*time.Second))
+
+		sent := time.Now()
+		heartbeat := NewMessage(MessageTypeHeartbeat, peer.ID, HeartbeatPayload{NodeID: peer.ID, TS: sent.Add(offset).Unix()})
+		heartbeat.Timestamp = sent.Add(offset)
+		writeFrame(t, remote, heartbeat)
+
+		// The heartbeat makes the peer alive as of its arrival, whatever
+		// the peer's clock says
+		require.Eventually(t, func() bool {
+			return peer.IsAlive(30 * time.Second)
+		}, 5*time.Second, 20*time.Millisecond)
+		seen := peer.lastSeen()
+		assert.False(t, seen.Before(sent), "peer clock %v", offset)
+		assert.False(t, seen.After(time.Now()), "peer clock %v", offset)
+
+		snapshot, ok := network.Peer(peer.ID)
+		require.True(t, ok)
+		assert.Equal(t, seen, snapshot.LastSeen)
+	}
+}
@@ -0,0 +1,318 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Codec encodes messages for the wire. JSON frames are newline-delimited;
+// frames in any other codec start with the codec's ID byte followed by a
+// 4-byte big-endian length, so a receiver can tell every frame's codec
+// without having negotiated it.
+type Codec interface {
+	// Name identifies the codec in config and in capabilities
+	Name() string
+	// ID is the first byte of every frame in this codec
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// CodecJSON is the default codec every peer understands
+	CodecJSON Codec = jsonCodec{}
+	// CodecCBOR is a compact binary codec used with peers advertising
+	// CapabilityCBOR
+	CodecCBOR Codec = newCBORCodec()
+)
+
+// codecs lists the codecs a frame may be encoded in
+var codecs = []Codec{CodecJSON, CodecCBOR}
+
+// CodecByName returns the codec called name
+func CodecByName(name string) (Codec, bool) {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// negotiateCodec returns the codec to encode messages to peer in: ours if
+// the peer advertised it too, JSON otherwise
+func (n *Network) negotiateCodec(peer *Peer) Codec {
+	if n.codec != CodecJSON && peer.HasCapability(n.codec.Name()) {
+		return n.codec
+	}
+	return CodecJSON
+}
+
+// codecByID returns the codec whose frames start with id
+func codecByID(id byte) (Codec, bool) {
+	for _, codec := range codecs {
+		if codec.ID() == id {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// jsonCodec encodes messages as JSON
+type jsonCodec struct{}
+
+// Name returns "json"
+func (jsonCodec) Name() string { return "json" }
+
+// ID returns the opening brace every JSON message starts with
+func (jsonCodec) ID() byte { return '{' }
+
+// Marshal encodes v as JSON
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal decodes JSON data into v
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// NewEncoder returns an encoder writing newline-terminated JSON to w
+func (jsonCodec) NewEncoder(w io.Writer) valueEncoder { return json.NewEncoder(w) }
+
+// cborTagEmbeddedJSON is the registered CBOR tag for a byte string holding
+// JSON. json.RawMessage values, such as replicated store values, travel
+// under it so they decode back to json.RawMessage rather than to bytes.
+const cborTagEmbeddedJSON = 262
+
+// cborCodec encodes messages as CBOR (RFC 8949), honouring the json struct
+// tags of message and payload types
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+// newCBORCodec builds the CBOR codec. Times keep nanosecond precision, maps
+// decoded into interfaces have string keys and invalid UTF-8 in strings is
+// tolerated, as it would be in JSON.
+func newCBORCodec() cborCodec {
+	tags := cbor.NewTagSet()
+	err := tags.Add(cbor.TagOptions{EncTag: cbor.EncTagRequired, DecTag: cbor.DecTagRequired},
+		reflect.TypeOf(json.RawMessage(nil)), cborTagEmbeddedJSON)
+	if err != nil {
+		panic(fmt.Sprintf("failed to register CBOR tag: %v", err))
+	}
+
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncModeWithTags(tags)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create CBOR encoder: %v", err))
+	}
+	dec, err := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+		UTF8:           cbor.UTF8DecodeInvalid,
+	}.DecModeWithTags(tags)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create CBOR decoder: %v", err))
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+// Name returns "cbor"
+func (cborCodec) Name() string { return CapabilityCBOR }
+
+// ID returns the byte that starts CBOR frames
+func (cborCodec) ID() byte { return 0x01 }
+
+// Marshal encodes v as CBOR
+func (c cborCodec) Marshal(v interface{}) ([]byte, error) { return c.enc.Marshal(v) }
+
+// Unmarshal decodes CBOR data into v
+func (c cborCodec) Unmarshal(data []byte, v interface{}) error { return c.dec.Unmarshal(data, v) }
+
+// NewEncoder returns an encoder writing CBOR to w
+func (c cborCodec) NewEncoder(w io.Writer) valueEncoder { return c.enc.NewEncoder(w) }
+
+// valueEncoder encodes values onto a writer
+type valueEncoder interface {
+	Encode(v interface{}) error
+}
+
+// streamCodec is a codec that can encode straight into a writer, sparing
+// the copy Marshal returns
+type streamCodec interface {
+	NewEncoder(w io.Writer) valueEncoder
+}
+
+// rawPayload captures a message payload undecoded, in whichever codec the
+// message arrived in. A null payload leaves it empty. It shares the bytes of
+// the frame being decoded, so it must be decoded or copied before the frame
+// is.
+type rawPayload []byte
+
+// UnmarshalJSON keeps the JSON payload as is
+func (r *rawPayload) UnmarshalJSON(data []byte) error {
+	if string(data) != "null" {
+		*r = data
+	}
+	return nil
+}
+
+// UnmarshalCBOR keeps the CBOR payload as is
+func (r *rawPayload) UnmarshalCBOR(data []byte) error {
+	// 0xf6 and 0xf7 are CBOR null and undefined
+	if len(data) != 1 || (data[0] != 0xf6 && data[0] != 0xf7) {
+		*r = data
+	}
+	return nil
+}
+
+// toJSON returns a payload received in codec as JSON, so handlers decoding
+// unregistered payloads themselves see the same bytes whatever the codec
+func (r rawPayload) toJSON(codec Codec) (json.RawMessage, error) {
+	if codec == CodecJSON {
+		return append(json.RawMessage(nil), r...), nil
+	}
+	var value interface{}
+	if err := codec.Unmarshal(r, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// frameBuffer is a reusable buffer frames are encoded into, together with
+// the encoders writing to it
+type frameBuffer struct {
+	bytes.Buffer
+	encoders map[Codec]valueEncoder
+	// msg holds the message being encoded, which would otherwise escape to
+	// the heap on its way into the encoder
+	msg Message
+}
+
+// maxPooledFrame is the largest buffer kept for reuse, so a burst of large
+// transfers does not pin its memory
+const maxPooledFrame = 64 << 10
+
+// frameBuffers holds the buffers of frames already written
+var frameBuffers = sync.Pool{
+	New: func() interface{} {
+		return &frameBuffer{encoders: make(map[Codec]valueEncoder, len(codecs))}
+	},
+}
+
+// encode appends v encoded in codec to the buffer
+func (b *frameBuffer) encode(codec Codec, v interface{}) error {
+	streaming, ok := codec.(streamCodec)
+	if !ok {
+		data, err := codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(data)
+		return nil
+	}
+	encoder := b.encoders[codec]
+	if encoder == nil {
+		encoder = streaming.NewEncoder(&b.Buffer)
+		b.encoders[codec] = encoder
+	}
+	return encoder.Encode(v)
+}
+
+// encodePooledFrame serializes msg in codec and frames it for the wire in a
+// pooled buffer, which the caller hands back to releaseFrame once the frame
+// is written. Messages above MaxMessageSize are refused with
+// ErrMessageTooLarge.
+func encodePooledFrame(codec Codec, msg Message) (*frameBuffer, error) {
+	buf := frameBuffers.Get().(*frameBuffer)
+	buf.Reset()
+	buf.msg = msg
+
+	var err error
+	size := 0
+	if codec == CodecJSON {
+		// The JSON encoder ends the message with the newline ending the frame
+		err = buf.encode(codec, &buf.msg)
+		size = buf.Len() - 1
+	} else {
+		header := [5]byte{codec.ID()}
+		buf.Write(header[:])
+		err = buf.encode(codec, &buf.msg)
+		size = buf.Len() - len(header)
+		binary.BigEndian.PutUint32(buf.Bytes()[1:], uint32(size))
+	}
+	buf.msg = Message{}
+	if err == nil && size > MaxMessageSize {
+		err = fmt.Errorf("%s message of %d bytes: %w", msg.Type, size, ErrMessageTooLarge)
+	}
+	if err != nil {
+		releaseFrame(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// releaseFrame returns a frame buffer for reuse
+func releaseFrame(buf *frameBuffer) {
+	if buf.Cap() <= maxPooledFrame {
+		frameBuffers.Put(buf)
+	}
+}
+
+// encodeFrame serializes msg in codec and frames it for the wire. Messages
+// above MaxMessageSize are refused with ErrMessageTooLarge.
+func encodeFrame(codec Codec, msg Message) ([]byte, error) {
+	buf, err := encodePooledFrame(codec, msg)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseFrame(buf)
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// frameCodec picks the codec to send msg in over a connection that
+// negotiated codec. Raw JSON payloads, e.g. of forwarded messages of types
+// we do not know, are sent as JSON so their structure survives.
+func frameCodec(codec Codec, msg Message) Codec {
+	if _, raw := msg.Payload.(json.RawMessage); raw {
+		return CodecJSON
+	}
+	return codec
+}
+
+// readBinaryFrame reads the length-prefixed body of a binary frame whose ID
+// byte was already consumed. A body that fits the reader's buffer is
+// returned in place, valid until the next read. Oversized bodies are skipped
+// so the stream stays aligned.
+func readBinaryFrame(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	header, err := reader.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	reader.Discard(len(header))
+	if uint64(size) > uint64(maxSize) {
+		if _, err := io.CopyN(io.Discard, reader, int64(size)); err != nil {
+			return nil, err
+		}
+		return nil, errFrameTooLarge
+	}
+
+	if int(size) <= reader.Size() {
+		data, err := reader.Peek(int(size))
+		if err != nil {
+			return nil, err
+		}
+		reader.Discard(len(data))
+		return data, nil
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
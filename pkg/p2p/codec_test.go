@@ -0,0 +1,374 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip frames msg in codec and reads it back as a receiver would
+func roundTrip(t testing.TB, codec Codec, msg Message) *Message {
+	frame, err := encodeFrame(codec, msg)
+	require.NoError(t, err)
+
+	got, data, err := readCodecFrame(bufio.NewReader(bytes.NewReader(frame)), MaxMessageSize)
+	require.NoError(t, err)
+	require.Equal(t, codec, got)
+
+	decoded, err := DeserializeMessageWith(codec, data)
+	require.NoError(t, err)
+	return decoded
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	gossip := NewMessage("RUMOR", "sender-id", map[string]interface{}{"text": "hi", "count": 2})
+	gossip.Origin = "origin-id"
+	gossip.HopLimit = 3
+
+	messages := map[string]Message{
+		"hello": NewMessage(MessageTypeHello, "sender-id", HelloPayload{
+			NodeID:       "sender-id",
+			Version:      ProtocolVersion,
+			ListenPort:   9000,
+			Capabilities: []string{CapabilityCBOR},
+		}),
+		"raw store value": NewMessage(MessageTypeDataSync, "sender-id", DataSyncPayload{
+			DataID:  "key",
+			Content: json.RawMessage(`{"nested":[1,2,3]}`),
+			Version: 7,
+		}),
+		"unregistered": gossip,
+		"no payload":   NewMessage(MessageTypeAck, "sender-id", nil),
+	}
+
+	for _, codec := range codecs {
+		for name, msg := range messages {
+			t.Run(codec.Name()+"/"+name, func(t *testing.T) {
+				got := roundTrip(t, codec, msg)
+				assert.Equal(t, msg.Type, got.Type)
+				assert.Equal(t, msg.ID, got.ID)
+				assert.Equal(t, msg.Origin, got.Origin)
+				assert.Equal(t, msg.HopLimit, got.HopLimit)
+				assert.True(t, msg.Timestamp.Equal(got.Timestamp), "timestamp %v became %v", msg.Timestamp, got.Timestamp)
+
+				switch payload := msg.Payload.(type) {
+				case nil:
+					assert.Nil(t, got.Payload)
+				case HelloPayload:
+					assert.Equal(t, &payload, got.Payload)
+				case DataSyncPayload:
+					var decoded DataSyncPayload
+					require.NoError(t, got.DecodePayload(&decoded))
+					// Stores re-encode the content they receive as JSON
+					content, err := json.Marshal(decoded.Content)
+					require.NoError(t, err)
+					assert.JSONEq(t, `{"nested":[1,2,3]}`, string(content))
+				default:
+					// Handlers of unregistered types get JSON whatever the codec
+					raw, ok := got.Payload.(json.RawMessage)
+					require.True(t, ok, "payload is %T", got.Payload)
+					assert.JSONEq(t, `{"text":"hi","count":2}`, string(raw))
+				}
+			})
+		}
+	}
+}
+
+func TestCBORFramesAreSmaller(t *testing.T) {
+	heartbeat := NewMessage(MessageTypeHeartbeat, "sender-id", HeartbeatPayload{NodeID: "sender-id", TS: time.Now().Unix()})
+
+	jsonFrame, err := encodeFrame(CodecJSON, heartbeat)
+	require.NoError(t, err)
+	cborFrame, err := encodeFrame(CodecCBOR, heartbeat)
+	require.NoError(t, err)
+	assert.Less(t, len(cborFrame), len(jsonFrame))
+}
+
+func TestRawPayloadsSentAsJSON(t *testing.T) {
+	forwarded := NewMessage("RUMOR", "sender-id", json.RawMessage(`{"text":"hi"}`))
+	assert.Equal(t, CodecJSON, frameCodec(CodecCBOR, forwarded))
+
+	typed := NewMessage(MessageTypeGoodbye, "sender-id", GoodbyePayload{Reason: "bye"})
+	assert.Equal(t, CodecCBOR, frameCodec(CodecCBOR, typed))
+}
+
+func TestReadCodecFrame(t *testing.T) {
+	small, err := encodeFrame(CodecCBOR, NewMessage(MessageTypeAck, "a", nil))
+	require.NoError(t, err)
+	large, err := encodeFrame(CodecCBOR, NewMessage("NOTE", "a", strings.Repeat("x", 256)))
+	require.NoError(t, err)
+	text, err := encodeFrame(CodecJSON, NewMessage(MessageTypeAck, "a", nil))
+	require.NoError(t, err)
+
+	// Codecs can be mixed on one stream, and oversize binary frames are skipped
+	var stream bytes.Buffer
+	stream.Write(small)
+	stream.Write(large)
+	stream.Write(text)
+	reader := bufio.NewReaderSize(&stream, 16)
+
+	codec, _, err := readCodecFrame(reader, 200)
+	require.NoError(t, err)
+	assert.Equal(t, CodecCBOR, codec)
+
+	_, _, err = readCodecFrame(reader, 200)
+	assert.ErrorIs(t, err, errFrameTooLarge)
+
+	codec, data, err := readCodecFrame(reader, 200)
+	require.NoError(t, err)
+	assert.Equal(t, CodecJSON, codec)
+	assert.Equal(t, text, data)
+}
+
+// preferCodec makes a network prefer codec
+func preferCodec(codec string) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.P2P.WireCodec = codec
+	}
+}
+
+// codecProbe is a payload registered by the codec tests
+type codecProbe struct {
+	Seq  int      `json:"seq"`
+	Tags []string `json:"tags"`
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	RegisterPayloadType("PROBE_REPLY", func() interface{} { return &codecProbe{} })
+
+	tests := []struct {
+		name     string
+		dialer   string
+		listener string
+		expected Codec
+	}{
+		{name: "both cbor", dialer: "cbor", listener: "cbor", expected: CodecCBOR},
+		{name: "cbor dials json", dialer: "cbor", listener: "json", expected: CodecJSON},
+		{name: "json dials cbor", dialer: "json", listener: "cbor", expected: CodecJSON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			a := startLocalNetworkWith(t, ctx, "codec-a", preferCodec(tt.dialer))
+			b := startLocalNetworkWith(t, ctx, "codec-b", preferCodec(tt.listener))
+			_, err := a.Connect(ctx, localAddr(b))
+			require.NoError(t, err)
+
+			codecTo := func(from *Network, peerID string) Codec {
+				if conn := from.peerConnection(peerID); conn != nil {
+					return conn.Codec()
+				}
+				return nil
+			}
+			require.Eventually(t, func() bool {
+				return codecTo(a, "codec-b") == tt.expected && codecTo(b, "codec-a") == tt.expected
+			}, 5*time.Second, 20*time.Millisecond)
+
+			// Registered and application payloads arrive intact either way
+			b.RegisterHandler("PROBE", func(msg Message) {
+				b.Reply(msg, "PROBE_REPLY", codecProbe{Seq: 42, Tags: []string{"a", "b"}})
+			})
+			reply, err := a.Request(ctx, "codec-b", NewMessage("PROBE", a.nodeID, nil))
+			require.NoError(t, err)
+			assert.Equal(t, &codecProbe{Seq: 42, Tags: []string{"a", "b"}}, reply.Payload)
+
+			b.RegisterHandler("ECHO", func(msg Message) {
+				b.Reply(msg, "ECHO_REPLY", msg.Payload)
+			})
+			reply, err = a.Request(ctx, "codec-b", NewMessage("ECHO", a.nodeID, map[string]int{"n": 1}))
+			require.NoError(t, err)
+			var echoed map[string]int
+			require.NoError(t, reply.DecodePayload(&echoed))
+			assert.Equal(t, map[string]int{"n": 1}, echoed)
+		})
+	}
+}
+
+func FuzzCodecRoundTrip(f *testing.F) {
+	f.Add("DATA_SYNC", "key", "value", int64(1), 0)
+	f.Add("RUMOR", "", "\n{\"x\":1}\n", int64(-5), 3)
+	f.Add("HELLO", "\x00\xff", "", int64(1<<62), 1)
+
+	f.Fuzz(func(t *testing.T, msgType, dataID, content string, version int64, hops int) {
+		if msgType == "" {
+			return
+		}
+		msg := NewMessage(msgType, "fuzz-sender", DataSyncPayload{DataID: dataID, Content: content, Version: version})
+		msg.HopLimit = hops
+
+		for _, codec := range codecs {
+			frame, err := encodeFrame(codec, msg)
+			require.NoError(t, err, codec.Name())
+			_, data, err := readCodecFrame(bufio.NewReader(bytes.NewReader(frame)), len(frame))
+			require.NoError(t, err, codec.Name())
+			got, err := DeserializeMessageWith(codec, data)
+			require.NoError(t, err, codec.Name())
+
+			assert.Equal(t, msg.ID, got.ID, codec.Name())
+			assert.Equal(t, msg.HopLimit, got.HopLimit, codec.Name())
+			var payload DataSyncPayload
+			if got.DecodePayload(&payload) == nil {
+				assert.Equal(t, version, payload.Version, codec.Name())
+			}
+		}
+	})
+}
+
+func FuzzDeserializeMessage(f *testing.F) {
+	for _, codec := range codecs {
+		msg := NewMessage(MessageTypeGoodbye, "sender-id", GoodbyePayload{Reason: "bye"})
+		data, err := msg.SerializeWith(codec)
+		require.NoError(f, err)
+		f.Add(data)
+	}
+	f.Add([]byte{0xd9, 0x01, 0x06, 0x41, '{'})
+	for _, msg := range wireMessages(f) {
+		for _, codec := range codecs {
+			data, err := msg.SerializeWith(codec)
+			require.NoError(f, err)
+			f.Add(data)
+		}
+	}
+	f.Add([]byte(`{"type":"HELLO","payload":null}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Arbitrary input must be rejected, never crash the reader
+		for _, codec := range codecs {
+			messageID(codec, data)
+			messageType(codec, data)
+			msg, err := DeserializeMessageWith(codec, data)
+			if err != nil || msg.Validate() != nil || msg.ValidatePayload() != nil {
+				continue
+			}
+			// Whatever is accepted can be sent on
+			if _, err := msg.SerializeWith(CodecJSON); err != nil {
+				t.Fatalf("accepted %s message does not encode: %v", codec.Name(), err)
+			}
+		}
+	})
+}
+
+// BenchmarkCodecs reports the wire size and encode+decode time of common
+// messages in each codec
+func BenchmarkCodecs(b *testing.B) {
+	peers := make([]PeerInfo, 50)
+	for i := range peers {
+		peers[i] = PeerInfo{ID: fmt.Sprintf("peer-%d", i), Address: fmt.Sprintf("10.0.0.%d:8080", i), Version: ProtocolVersion, LastSeen: time.Now().Unix()}
+	}
+	messages := []struct {
+		name string
+		msg  Message
+	}{
+		{"heartbeat", NewMessage(MessageTypeHeartbeat, "sender-id", HeartbeatPayload{NodeID: "sender-id", TS: time.Now().Unix()})},
+		{"peer-list", NewMessage(MessageTypePeerList, "sender-id", PeerListPayload{Peers: peers})},
+	}
+
+	for _, codec := range codecs {
+		for _, m := range messages {
+			b.Run(codec.Name()+"/"+m.name, func(b *testing.B) {
+				frame, err := encodeFrame(codec, m.msg)
+				require.NoError(b, err)
+
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					data, err := m.msg.SerializeWith(codec)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := DeserializeMessageWith(codec, data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(frame)), "wire-bytes")
+			})
+		}
+	}
+}
+
+// discardConn is a connection that accepts every write
+type discardConn struct{}
+
+func (discardConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (discardConn) SetWriteDeadline(time.Time) error { return nil }
+
+// repeatReader endlessly repeats a frame
+type repeatReader struct {
+	frame []byte
+	off   int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		copied := copy(p[n:], r.frame[r.off:])
+		n += copied
+		r.off = (r.off + copied) % len(r.frame)
+	}
+	return n, nil
+}
+
+// BenchmarkSendMessage measures encoding and framing a heartbeat for the
+// wire, as every send does
+func BenchmarkSendMessage(b *testing.B) {
+	network := newBenchNetwork(b, "bench-sender")
+	msg := NewMessage(MessageTypeHeartbeat, "bench-sender", HeartbeatPayload{NodeID: "bench-sender", TS: time.Now().Unix(), QueueDepth: 3})
+
+	for _, codec := range codecs {
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := network.writeMessage(discardConn{}, codec, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadMessage measures reading, decoding and validating a
+// heartbeat frame and handing its payload to a handler
+func BenchmarkReadMessage(b *testing.B) {
+	msg := NewMessage(MessageTypeHeartbeat, "bench-sender", HeartbeatPayload{NodeID: "bench-sender", TS: time.Now().Unix(), QueueDepth: 3})
+
+	for _, codec := range codecs {
+		b.Run(codec.Name(), func(b *testing.B) {
+			frame, err := encodeFrame(codec, msg)
+			require.NoError(b, err)
+			reader := bufio.NewReader(&repeatReader{frame: frame})
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				codec, data, err := readCodecFrame(reader, MaxMessageSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+				decoded, err := DeserializeMessageWith(codec, data)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := decoded.Validate(); err != nil {
+					b.Fatal(err)
+				}
+				if err := decoded.ValidatePayload(); err != nil {
+					b.Fatal(err)
+				}
+				var heartbeat HeartbeatPayload
+				if err := decoded.DecodePayload(&heartbeat); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenFake accepts connections and answers each with reply, or stays
+// silent if reply is empty, so a dialer's handshake fails or waits until it
+// gives up
+func listenFake(t *testing.T, reply string) string {
+	var listener net.Listener
+	var err error
+	if *transportFlag == "memory" {
+		listener, err = testHost().Listen(":0")
+	} else {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var accepted []net.Conn
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range accepted {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted = append(accepted, conn)
+			mu.Unlock()
+			if reply != "" {
+				go conn.Write([]byte(reply))
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestConnectReturnsPeerID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := startLocalNetwork(t, ctx, "node-a")
+	b := startLocalNetwork(t, ctx, "node-b")
+
+	peerID, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	assert.Equal(t, "node-b", peerID)
+
+	// Both sides have registered the other by the time Connect returns
+	assert.NotNil(t, a.peerConnection("node-b"))
+	assert.NotNil(t, b.peerConnection("node-a"))
+}
+
+func TestConnectErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := startLocalNetwork(t, ctx, "node-a")
+
+	t.Run("refused", func(t *testing.T) {
+		closed := startLocalNetwork(t, ctx, "closed-node")
+		address := localAddr(closed)
+		closed.Stop()
+
+		_, err := a.Connect(ctx, address)
+		assert.ErrorIs(t, err, ErrConnectionRefused)
+	})
+
+	t.Run("handshake rejected", func(t *testing.T) {
+		_, err := a.Connect(ctx, listenFake(t, "not a handshake\n"))
+		assert.ErrorIs(t, err, ErrHandshakeRejected)
+		assert.NotErrorIs(t, err, ErrConnectionRefused)
+	})
+
+	t.Run("duplicate peer", func(t *testing.T) {
+		b := startLocalNetwork(t, ctx, "node-b")
+		_, err := a.Connect(ctx, localAddr(b))
+		require.NoError(t, err)
+		original := a.peerConnection("node-b")
+
+		// Dialing again is refused by the peer, dialing back by us
+		peerID, err := a.Connect(ctx, localAddr(b))
+		assert.ErrorIs(t, err, ErrDuplicatePeer)
+		assert.Equal(t, "node-b", peerID)
+		peerID, err = b.Connect(ctx, localAddr(a))
+		assert.ErrorIs(t, err, ErrDuplicatePeer)
+		assert.Equal(t, "node-a", peerID)
+
+		// The original connection is untouched
+		assert.Same(t, original, a.peerConnection("node-b"))
+		assert.Contains(t, a.topologyMgr.GetConnectedPeers(), "node-b")
+		assert.NoError(t, a.SendMessage(ctx, "node-b", NewMessage("NOTE", a.nodeID, nil)))
+	})
+}
+
+func TestConnectDeduplicatesAddressForms(t *testing.T) {
+	requireTCP(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := startLocalNetwork(t, ctx, "node-a")
+	b := startLocalNetwork(t, ctx, "node-b")
+	port := strconv.Itoa(b.listenPort())
+
+	// Dials to one node named in different ways share a dial, or are
+	// refused by node ID once one has connected
+	forms := []string{"localhost:" + port, "127.0.0.1:" + port, " LOCALHOST.:" + port, "[::ffff:127.0.0.1]:0" + port}
+	var wg sync.WaitGroup
+	for _, address := range forms {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			peerID, err := a.Connect(ctx, address)
+			if err != nil {
+				assert.ErrorIs(t, err, ErrDuplicatePeer, address)
+			}
+			assert.Equal(t, "node-b", peerID, address)
+		}(address)
+	}
+	wg.Wait()
+
+	t.Run("ipv6 loopback", func(t *testing.T) {
+		requireIPv6Loopback(t)
+		peerID, err := a.Connect(ctx, "[::1]:"+port)
+		assert.ErrorIs(t, err, ErrDuplicatePeer)
+		assert.Equal(t, "node-b", peerID)
+	})
+	assert.Len(t, a.Peers(), 1)
+	assert.Len(t, b.Peers(), 1)
+	assert.Equal(t, 1, a.pool.ConnectionCount())
+
+	// A failed dial cools down the address under all of its names
+	b.Stop()
+	_, err := a.Connect(ctx, "localhost:"+port)
+	assert.ErrorIs(t, err, ErrConnectionRefused)
+	_, err = a.connect(ctx, "127.0.0.1:"+port, "", false)
+	assert.ErrorIs(t, err, ErrDialCooldown)
+}
+
+func TestConnectUnresolvableHost(t *testing.T) {
+	requireTCP(t)
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+	network.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	_, err := network.Connect(context.Background(), "missing.example.com:8080")
+	assert.ErrorIs(t, err, ErrConnectionRefused)
+	var dnsErr *net.DNSError
+	assert.ErrorAs(t, err, &dnsErr)
+	assert.Zero(t, network.monitor.Stats.GetStats().DialsInFlight)
+}
+
+func TestSimultaneousConnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := startLocalNetwork(t, ctx, "node-a")
+	b := startLocalNetwork(t, ctx, "node-b")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() { defer wg.Done(); _, errs[0] = a.Connect(ctx, localAddr(b)) }()
+	go func() { defer wg.Done(); _, errs[1] = b.Connect(ctx, localAddr(a)) }()
+	wg.Wait()
+
+	// Whatever the interleaving, both sides settle on the connection node-a
+	// dialed and keep it
+	for _, err := range errs {
+		if err != nil {
+			assert.ErrorIs(t, err, ErrDuplicatePeer)
+		}
+	}
+	require.Eventually(t, func() bool {
+		toB, toA := a.peerConnection("node-b"), b.peerConnection("node-a")
+		return toB != nil && toA != nil && toB.Outbound && !toA.Outbound
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Contains(t, a.topologyMgr.GetConnectedPeers(), "node-b")
+	assert.Contains(t, b.topologyMgr.GetConnectedPeers(), "node-a")
+	assert.NoError(t, b.SendMessage(ctx, "node-a", NewMessage("NOTE", b.nodeID, nil)))
+}
+
+func TestConnectHonoursContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "dialer-node")
+	address := listenFake(t, "")
+
+	t.Run("deadline during handshake", func(t *testing.T) {
+		dialCtx, cancelDial := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancelDial()
+		start := time.Now()
+		_, err := network.Connect(dialCtx, address)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+
+	t.Run("already cancelled", func(t *testing.T) {
+		dialCtx, cancelDial := context.WithCancel(ctx)
+		cancelDial()
+		_, err := network.Connect(dialCtx, address)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	assert.Empty(t, network.Peers())
+}
+
+func TestConnectAnyAddress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := startLocalNetwork(t, ctx, "node-a")
+	b := startLocalNetwork(t, ctx, "node-b")
+
+	// The first address accepts but never answers the handshake
+	dead := listenFake(t, "")
+	start := time.Now()
+	peerID, err := a.connectAny(ctx, []PeerAddress{{Address: dead}, {Address: localAddr(b)}}, "node-b")
+	require.NoError(t, err)
+	assert.Equal(t, "node-b", peerID)
+	assert.Less(t, time.Since(start), DefaultConnectTimeout/2, "the live address should not wait on the dead one")
+
+	// The address that answered is the one remembered for next time
+	record, ok := a.peerStore.Get("node-b")
+	require.True(t, ok)
+	_, livePort, _ := net.SplitHostPort(localAddr(b))
+	_, port, _ := net.SplitHostPort(record.Address)
+	assert.Equal(t, livePort, port)
+	assert.NotEqual(t, dead, record.Address)
+}
+
+func TestSendMessageHonoursContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "sender-node")
+	attachStalledPeer(t, network, "slow")
+
+	sendCtx, cancelSend := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelSend()
+	start := time.Now()
+	err := network.SendMessage(sendCtx, "slow", NewMessage("NOTE", network.nodeID, nil))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	// The caller is released long before the write deadline
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	err = network.SendMessage(sendCtx, "slow", NewMessage("NOTE", network.nodeID, nil))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestIdleConnectionFlood(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetworkWith(t, ctx, "flooded-node", func(cfg *config.Config) {
+		cfg.P2P.MaxPeers = 4
+	}, func(n *Network) {
+		n.handshakeTimeout = time.Second
+	})
+	capacity := cap(network.admission)
+	baseline := runtime.NumGoroutine()
+
+	// Open sockets that never say anything
+	const flood = 500
+	var conns []net.Conn
+	for i := 0; i < flood; i++ {
+		conn, err := dialLocal(network)
+		require.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	require.Eventually(t, func() bool {
+		stats := network.monitor.Stats.GetStats()
+		return stats.ConnectionsAccepted+stats.ConnectionsRejected == flood
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Only the admitted connections cost a goroutine, and none reached the pool
+	stats := network.monitor.Stats.GetStats()
+	assert.LessOrEqual(t, stats.ConnectionsAccepted, uint64(capacity))
+	assert.GreaterOrEqual(t, stats.ConnectionsRejected, uint64(flood-capacity))
+	assert.Less(t, runtime.NumGoroutine()-baseline, 2*capacity)
+	assert.Zero(t, network.pool.ConnectionCount())
+
+	// Idle sockets time out of the handshake and free their slots
+	require.Eventually(t, func() bool {
+		return network.monitor.Stats.GetStats().HandshakeFailures == stats.ConnectionsAccepted
+	}, 5*time.Second, 20*time.Millisecond)
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	peer := startLocalNetwork(t, ctx, "real-peer")
+	_, err := peer.Connect(ctx, localAddr(network))
+	require.NoError(t, err)
+}
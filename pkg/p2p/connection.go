@@ -0,0 +1,223 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/session"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// handleConnectionWithEncryption sets up an accepted connection and serves
+// it until it closes. A panic on the way closes the connection, not the node.
+func (n *Network) handleConnectionWithEncryption(conn net.Conn, incoming bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			n.recoverConnectionPanic(conn, r)
+		}
+	}()
+
+	connection, err := n.setupConnection(conn, incoming, "", time.Time{})
+	if err != nil {
+		n.logger.Errorf("failed to set up connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	n.serveConnection(connection)
+}
+
+// setupConnection adds a connection to the pool, performs the secure
+// handshake and sends our HELLO. The connection is closed if any step fails,
+// including an outgoing handshake with a peer other than expectedPeerID.
+// dialStarted is when we started dialing an outgoing connection.
+func (n *Network) setupConnection(conn net.Conn, incoming bool, expectedPeerID string, dialStarted time.Time) (*Connection, error) {
+	connID := fmt.Sprintf("conn_%s_%d", conn.RemoteAddr().String(), time.Now().UnixNano())
+
+	connection := &Connection{
+		ID:             connID,
+		Address:        conn.RemoteAddr().String(),
+		Conn:           conn,
+		CreatedAt:      time.Now(),
+		LastSeen:       time.Now(),
+		Outbound:       !incoming,
+		expectedPeerID: expectedPeerID,
+		dialStarted:    dialStarted,
+		session: session.New(conn, session.Config{
+			WriteTimeout:     n.writeTimeout,
+			HandshakeTimeout: n.handshakeTimeout,
+			Decode:           parseHandshakeMessage,
+		}),
+	}
+	if !dialStarted.IsZero() {
+		n.observeDial(connection)
+	}
+	if n.orderWindow > 0 {
+		connection.order = n.newReorderBuffer(connection)
+	}
+
+	n.logger.Debugf("handling connection %s (incoming: %t) from %s", connID, incoming, conn.RemoteAddr())
+
+	if err := tuneSocket(conn, n.config.P2P.Socket); err != nil {
+		n.logger.Warnf("connection %s: %v", connID, err)
+	}
+
+	if n.ctx != nil {
+		// Until it joins the pool, Stop only reaches the connection this way
+		stop := context.AfterFunc(n.ctx, func() { conn.Close() })
+		defer stop()
+	}
+
+	// Perform handshake with encryption. The connection joins the pool once
+	// the peer is verified.
+	if err := n.guardedHandshake(conn, incoming, connection); err != nil {
+		n.monitor.Stats.IncrementHandshakeFailures()
+		n.recordHandshakeFailure(err)
+		n.auditHandshakeFailure(connection, err)
+		n.publishHandshakeFailure(connection, err)
+		n.closeConnection(connection)
+		if errors.Is(err, ErrDuplicatePeer) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w on connection %s: %w", ErrHandshakeRejected, connID, err)
+	}
+	n.observeHandshake(connection, connection.markHandshakeDone())
+	n.auditHandshake(connection)
+
+	if err := n.sendHello(connection); err != nil {
+		n.closeConnection(connection)
+		if n.superseded(connection) {
+			return nil, &duplicatePeerError{peerID: connection.PeerID}
+		}
+		return nil, fmt.Errorf("failed to send hello on connection %s: %w", connID, err)
+	}
+	return connection, nil
+}
+
+// guardedHandshake performs the secure handshake, failing it if handling
+// the peer's handshake messages panics
+func (n *Network) guardedHandshake(conn net.Conn, incoming bool, connection *Connection) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = n.recoverReadPanic(connection, r)
+		}
+	}()
+	return n.performSecureHandshake(conn, incoming, connection)
+}
+
+// recoverReadPanic counts and logs, with its stack, a panic recovered while
+// handling data a peer sent, closes the connection it came on and returns
+// the panic as an error
+func (n *Network) recoverReadPanic(connection *Connection, r interface{}) error {
+	n.monitor.Stats.IncrementReadPanics()
+	n.logger.Errorf("panic handling data from %s on connection %s: %v\n%s", connection.Address, connection.ID, r, debug.Stack())
+	connection.closeWith(fmt.Sprintf("%v: %v", errReadPanic, r))
+	return fmt.Errorf("%w: %v", errReadPanic, r)
+}
+
+// recoverConnectionPanic counts and logs, with its stack, a panic recovered
+// while serving conn, and closes and deregisters it
+func (n *Network) recoverConnectionPanic(conn net.Conn, r interface{}) {
+	n.monitor.Stats.IncrementReadPanics()
+	n.logger.Errorf("panic serving connection from %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+	for _, connection := range n.pool.GetConnections() {
+		if connection.Conn == conn {
+			connection.setCloseReason(fmt.Sprintf("%v: %v", errReadPanic, r))
+			n.closeConnection(connection)
+			return
+		}
+	}
+	conn.Close()
+}
+
+// serveConnection reads messages from a set up connection until it closes
+func (n *Network) serveConnection(connection *Connection) {
+	defer n.closeConnection(connection)
+
+	// Start reading messages from the connection
+	if err := n.readMessages(connection.Conn, connection); err != nil {
+		n.logger.Errorf("error reading messages from connection %s: %v", connection.ID, err)
+	}
+}
+
+// closeConnection closes a connection and tells the rest of the network
+// its peer is gone, unless the peer has been registered on another
+// connection since
+func (n *Network) closeConnection(connection *Connection) {
+	n.observeLifetime(connection)
+	connection.markClosed()
+	n.pool.RemoveConnection(connection.ID)
+	if connection.order != nil {
+		connection.order.close()
+	}
+	if session := connection.QUIC(); session != nil {
+		session.close("connection closed")
+	}
+	connection.Conn.Close()
+
+	if n.superseded(connection) {
+		return
+	}
+	if connection.PeerID != "" {
+		// The peer stays known, but is no longer connected
+		if peer, exists := n.peers.Get(connection.PeerID); exists {
+			peer.clearConnection(connection)
+		}
+		n.bootstrapMgr.MarkDisconnected(connection.PeerID)
+		n.topologyMgr.SetPeerConnected(connection.PeerID, false)
+		n.monitor.Quality.RemovePeer(connection.PeerID)
+		n.peerStore.Touch(connection.PeerID)
+		n.auditDisconnect(connection)
+		// Shutting down is no fault of the peer's
+		if n.ctx == nil || n.ctx.Err() == nil {
+			n.recordDisconnect(connection.PeerID)
+		}
+		n.events.Publish(Event{Type: EventPeerDisconnected, PeerID: connection.PeerID})
+	}
+}
+
+// readMessages reads and processes messages from a connection. A panic
+// while handling what the peer sent closes the connection rather than the
+// node.
+func (n *Network) readMessages(conn net.Conn, connection *Connection) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = n.recoverReadPanic(connection, r)
+		}
+	}()
+
+	err = connection.Session().Serve(n.ctx, 30*time.Second, func(reader *bufio.Reader) error {
+		codec, data, err := readCodecFrame(reader, MaxMessageSize)
+		if err == errFrameTooLarge {
+			n.logger.Warnf("dropping oversize frame from %s", conn.RemoteAddr())
+			n.rejectMessage(connection, "", ErrorCodeMessageTooLarge, fmt.Sprintf("frame exceeds %d bytes", MaxMessageSize), topology.EventOversizeFrame)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n.processFrame(codec, data, connection)
+		return nil
+	}, func(err error) bool {
+		// Upgraded peers may leave the TCP connection idle; QUIC
+		// keep-alives tell us they are still there
+		var netErr net.Error
+		return errors.As(err, &netErr) && netErr.Timeout() && connection.QUIC() != nil
+	})
+	if err != nil && err == n.ctx.Err() {
+		n.logger.Info("network context cancelled, closing connection")
+		connection.setCloseReason("network stopped")
+		return nil
+	}
+	if err != nil {
+		if !strings.Contains(err.Error(), "use of closed network connection") {
+			n.logger.Errorf("error reading from connection: %v", err)
+		}
+		connection.setCloseReason(fmt.Sprintf("read failed: %v", err))
+	}
+	return err
+}
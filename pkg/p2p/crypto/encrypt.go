@@ -8,15 +8,18 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io"
+	"sync"
 )
 
 // Encryptor handles message encryption and decryption
 type Encryptor struct {
 	privateKey *rsa.PrivateKey
 	publicKey  *rsa.PublicKey
+	mu         sync.RWMutex
 }
 
 // NewEncryptor creates a new encryptor with generated keys
@@ -32,6 +35,41 @@ func NewEncryptor() (*Encryptor, error) {
 	}, nil
 }
 
+// NewEncryptorWithKey creates an encryptor for an existing key
+func NewEncryptorWithKey(privateKey *rsa.PrivateKey) *Encryptor {
+	return &Encryptor{
+		privateKey: privateKey,
+		publicKey:  &privateKey.PublicKey,
+	}
+}
+
+// PublicKey returns the public half of the encryptor's key
+func (e *Encryptor) PublicKey() *rsa.PublicKey {
+	_, publicKey := e.keys()
+	return publicKey
+}
+
+// PrivateKey returns the encryptor's key
+func (e *Encryptor) PrivateKey() *rsa.PrivateKey {
+	privateKey, _ := e.keys()
+	return privateKey
+}
+
+// SetKey replaces the encryptor's key, e.g. after a key rotation
+func (e *Encryptor) SetKey(privateKey *rsa.PrivateKey) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.privateKey = privateKey
+	e.publicKey = &privateKey.PublicKey
+}
+
+// keys returns the encryptor's key pair as of one moment
+func (e *Encryptor) keys() (*rsa.PrivateKey, *rsa.PublicKey) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.privateKey, e.publicKey
+}
+
 // GenerateKeyPair generates a new RSA key pair
 func GenerateKeyPair() (*rsa.PrivateKey, *rsa.PublicKey, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -84,7 +122,8 @@ func (e *Encryptor) EncryptMessage(plaintext []byte, recipientPubKey *rsa.Public
 
 // DecryptMessage decrypts a message using RSA to decrypt AES key and AES-GCM to decrypt message
 func (e *Encryptor) DecryptMessage(encryptedData []byte, senderPubKey *rsa.PublicKey) ([]byte, error) {
-	keySize := e.privateKey.Size()
+	privateKey := e.PrivateKey()
+	keySize := privateKey.Size()
 	if len(encryptedData) < keySize {
 		return nil, fmt.Errorf("encrypted data too short")
 	}
@@ -94,7 +133,7 @@ func (e *Encryptor) DecryptMessage(encryptedData []byte, senderPubKey *rsa.Publi
 	ciphertext := encryptedData[keySize:]
 
 	// Decrypt the AES key with our private key
-	aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, e.privateKey, encryptedAESKey, nil)
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedAESKey, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt AES key: %w", err)
 	}
@@ -126,8 +165,13 @@ func (e *Encryptor) DecryptMessage(encryptedData []byte, senderPubKey *rsa.Publi
 
 // SignMessage signs a message with the private key
 func (e *Encryptor) SignMessage(message []byte) ([]byte, error) {
+	return signMessage(e.PrivateKey(), message)
+}
+
+// signMessage signs a message with privateKey
+func signMessage(privateKey *rsa.PrivateKey, message []byte) ([]byte, error) {
 	hash := sha256.Sum256(message)
-	signature, err := rsa.SignPSS(rand.Reader, e.privateKey, crypto.SHA256, hash[:], nil)
+	signature, err := rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, hash[:], nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign message: %w", err)
 	}
@@ -137,6 +181,11 @@ func (e *Encryptor) SignMessage(message []byte) ([]byte, error) {
 
 // VerifySignature verifies a signature against a message and public key
 func (e *Encryptor) VerifySignature(message, signature []byte, pubKey *rsa.PublicKey) error {
+	return verifySignature(message, signature, pubKey)
+}
+
+// verifySignature verifies a signature against a message and public key
+func verifySignature(message, signature []byte, pubKey *rsa.PublicKey) error {
 	hash := sha256.Sum256(message)
 	err := rsa.VerifyPSS(pubKey, crypto.SHA256, hash[:], signature, nil)
 	if err != nil {
@@ -181,6 +230,17 @@ func UnmarshalPublicKey(pubKeyPEM []byte) (*rsa.PublicKey, error) {
 	return rsaPubKey, nil
 }
 
+// KeyFingerprint identifies a public key by the SHA-256 hash of its DER
+// encoding, as "sha256:" followed by the hex digest
+func KeyFingerprint(pubKey *rsa.PublicKey) (string, error) {
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	hash := sha256.Sum256(pubKeyBytes)
+	return "sha256:" + hex.EncodeToString(hash[:]), nil
+}
+
 // MarshalPrivateKey converts a private key to PEM format
 func MarshalPrivateKey(privKey *rsa.PrivateKey) ([]byte, error) {
 	privKeyBytes := x509.MarshalPKCS1PrivateKey(privKey)
@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"crypto"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -17,12 +18,38 @@ type HandshakeMessage struct {
 	Timestamp   int64  `json:"timestamp"`
 	Signature   []byte `json:"signature"`
 	SessionKey  []byte `json:"session_key,omitempty"`
+
+	// Protocol versions are covered by Signature, so they cannot be altered
+	// to talk a peer down to an older version. Nodes that predate version
+	// negotiation cannot verify messages carrying them, so they do not
+	// interoperate with newer nodes.
+	ProtocolVersion    string `json:"protocol_version,omitempty"`
+	MinProtocolVersion string `json:"min_protocol_version,omitempty"`
+
+	// ExchangeKey is an ephemeral X25519 public key. Peers that both send
+	// one derive a secret to resume the session with; see SessionSecret.
+	ExchangeKey []byte `json:"exchange_key,omitempty"`
+	// Resume, if set, resumes an earlier session instead of proving the
+	// sender's key; such messages carry no public key or signature
+	Resume *ResumeMessage `json:"resume,omitempty"`
+	// Rotation, if set, announces that the sender replaced the key it
+	// proved before with the one in this message. It carries signatures of
+	// its own and is not covered by Signature.
+	Rotation *KeyRotation `json:"rotation,omitempty"`
+	// NetworkMAC proves the sender knows the key of the private network it
+	// belongs to; see NetworkMAC. It is attached last, after Rotation.
+	NetworkMAC []byte `json:"network_mac,omitempty"`
+
+	// exchange is the private half of ExchangeKey on messages we create
+	exchange *ecdh.PrivateKey
 }
 
 // HandshakeManager handles secure handshake protocol
 type HandshakeManager struct {
-	encryptor *Encryptor
-	nodeID    string
+	encryptor  *Encryptor
+	nodeID     string
+	version    string
+	minVersion string
 }
 
 // NewHandshakeManager creates a new handshake manager
@@ -33,9 +60,18 @@ func NewHandshakeManager(encryptor *Encryptor, nodeID string) *HandshakeManager
 	}
 }
 
+// SetProtocolVersions sets the protocol version and minimum supported version
+// advertised in handshake messages
+func (h *HandshakeManager) SetProtocolVersions(version, minVersion string) {
+	h.version = version
+	h.minVersion = minVersion
+}
+
 // CreateHandshakeMessage creates a signed handshake message
 func (h *HandshakeManager) CreateHandshakeMessage() (*HandshakeMessage, error) {
-	pubKeyPEM, err := MarshalPublicKey(h.encryptor.publicKey)
+	// A rotation between marshalling the key and signing must not mix keys
+	privateKey, publicKey := h.encryptor.keys()
+	pubKeyPEM, err := MarshalPublicKey(publicKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal public key: %w", err)
 	}
@@ -46,11 +82,22 @@ func (h *HandshakeManager) CreateHandshakeMessage() (*HandshakeMessage, error) {
 		return nil, fmt.Errorf("failed to generate session key: %w", err)
 	}
 
+	exchange, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate exchange key: %w", err)
+	}
+
 	msg := &HandshakeMessage{
 		NodeID:     h.nodeID,
 		PublicKey:  pubKeyPEM,
 		Timestamp:  time.Now().Unix(),
 		SessionKey: sessionKey,
+
+		ProtocolVersion:    h.version,
+		MinProtocolVersion: h.minVersion,
+
+		ExchangeKey: exchange.PublicKey().Bytes(),
+		exchange:    exchange,
 	}
 
 	// Sign the message
@@ -59,7 +106,7 @@ func (h *HandshakeManager) CreateHandshakeMessage() (*HandshakeMessage, error) {
 		return nil, fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	signature, err := h.encryptor.SignMessage(msgBytes)
+	signature, err := signMessage(privateKey, msgBytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign message: %w", err)
 	}
@@ -86,6 +133,11 @@ func (h *HandshakeManager) VerifyHandshakeMessage(msg *HandshakeMessage) error {
 		PublicKey:  msg.PublicKey,
 		Timestamp:  msg.Timestamp,
 		SessionKey: msg.SessionKey,
+
+		ProtocolVersion:    msg.ProtocolVersion,
+		MinProtocolVersion: msg.MinProtocolVersion,
+
+		ExchangeKey: msg.ExchangeKey,
 	}
 
 	// Marshal the message copy
@@ -99,12 +151,15 @@ func (h *HandshakeManager) VerifyHandshakeMessage(msg *HandshakeMessage) error {
 		return fmt.Errorf("signature verification failed: %w", err)
 	}
 
-	// Check timestamp (within 5 minutes)
+	return checkTimestamp(msg.Timestamp)
+}
+
+// checkTimestamp accepts handshake timestamps within 5 minutes of our clock
+func checkTimestamp(timestamp int64) error {
 	currentTime := time.Now().Unix()
-	if currentTime-msg.Timestamp > 300 || msg.Timestamp-currentTime > 300 {
+	if currentTime-timestamp > 300 || timestamp-currentTime > 300 {
 		return fmt.Errorf("timestamp is too old or too far in the future")
 	}
-
 	return nil
 }
 
@@ -146,7 +201,7 @@ func (h *HandshakeManager) CreateChallenge() ([]byte, error) {
 // SignChallenge signs a challenge with the private key
 func (h *HandshakeManager) SignChallenge(challenge []byte) ([]byte, error) {
 	hash := sha256.Sum256(challenge)
-	signature, err := rsa.SignPSS(rand.Reader, h.encryptor.privateKey, crypto.SHA256, hash[:], nil)
+	signature, err := rsa.SignPSS(rand.Reader, h.encryptor.PrivateKey(), crypto.SHA256, hash[:], nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign challenge: %w", err)
 	}
@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrNetworkMAC is returned when a handshake was not made with our network key
+var ErrNetworkMAC = errors.New("handshake is not authenticated with the network key")
+
+// networkIDLabel separates the network ID from other uses of the key
+const networkIDLabel = "synapse network id\x00"
+
+// NetworkMAC authenticates a handshake transcript, the messages exchanged so
+// far including the one it is attached to, with the key of a private network
+func NetworkMAC(key []byte, transcript ...*HandshakeMessage) ([]byte, error) {
+	mac := hmac.New(sha256.New, key)
+	for _, msg := range transcript {
+		unsealed := *msg
+		unsealed.NetworkMAC = nil
+		data, err := json.Marshal(&unsealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal handshake transcript: %w", err)
+		}
+		binary.Write(mac, binary.BigEndian, uint32(len(data)))
+		mac.Write(data)
+	}
+	return mac.Sum(nil), nil
+}
+
+// VerifyNetworkMAC checks the MAC attached to the last message of a
+// transcript. Without a network key the message must carry none, so nodes
+// of a private network and of the open one refuse each other alike.
+func VerifyNetworkMAC(key []byte, transcript ...*HandshakeMessage) error {
+	if len(transcript) == 0 {
+		return fmt.Errorf("empty handshake transcript")
+	}
+	got := transcript[len(transcript)-1].NetworkMAC
+	if len(key) == 0 {
+		if len(got) > 0 {
+			return fmt.Errorf("%w: peer belongs to a private network", ErrNetworkMAC)
+		}
+		return nil
+	}
+
+	want, err := NetworkMAC(key, transcript...)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(got, want) {
+		return ErrNetworkMAC
+	}
+	return nil
+}
+
+// NetworkID names the network a key belongs to without giving the key away,
+// so nodes can tell their own network's advertisements from others'
+func NetworkID(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(networkIDLabel), key...))
+	return hex.EncodeToString(sum[:8])
+}
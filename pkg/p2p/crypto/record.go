@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SignedPeerRecord is a node's own word on where it can be reached. The
+// node signs it with its identity key, so peers passing it along cannot
+// change the addresses, and raises Seq with every new record so an old
+// one cannot be replayed over it.
+type SignedPeerRecord struct {
+	NodeID    string   `json:"node_id"`
+	Addresses []string `json:"addresses"`
+	Timestamp int64    `json:"timestamp"`
+	Seq       uint64   `json:"seq"`
+	PublicKey []byte   `json:"public_key"`
+
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// NewSignedPeerRecord creates the record of nodeID at addresses, signed
+// with key
+func NewSignedPeerRecord(nodeID string, addresses []string, seq uint64, key *rsa.PrivateKey) (*SignedPeerRecord, error) {
+	publicPEM, err := MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &SignedPeerRecord{
+		NodeID:    nodeID,
+		Addresses: append([]string(nil), addresses...),
+		Timestamp: time.Now().Unix(),
+		Seq:       seq,
+		PublicKey: publicPEM,
+	}
+	signed, err := r.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if r.Signature, err = signMessage(key, signed); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Verify checks that the key the record carries signed it and returns that
+// key. It does not say whether the key is the node's; that is for whoever
+// pinned it.
+func (r *SignedPeerRecord) Verify() (*rsa.PublicKey, error) {
+	if r.NodeID == "" {
+		return nil, fmt.Errorf("peer record has no node ID")
+	}
+	key, err := UnmarshalPublicKey(r.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	signed, err := r.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(signed, r.Signature, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// signedBytes returns what the key signs: the record without its signature
+func (r *SignedPeerRecord) signedBytes() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal peer record: %w", err)
+	}
+	return data, nil
+}
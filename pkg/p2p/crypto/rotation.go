@@ -0,0 +1,99 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// KeyRotation announces that a node replaced its identity key. The old key
+// signs it to vouch for the new one, and the new key signs it to show its
+// holder has it, so peers that pinned the old key can move to the new one.
+type KeyRotation struct {
+	NodeID    string `json:"node_id"`
+	OldKey    []byte `json:"old_key"`
+	NewKey    []byte `json:"new_key"`
+	RotatedAt int64  `json:"rotated_at"`
+
+	OldSignature []byte `json:"old_signature,omitempty"`
+	NewSignature []byte `json:"new_signature,omitempty"`
+}
+
+// NewKeyRotation creates the announcement that nodeID replaced oldKey with
+// newKey
+func NewKeyRotation(nodeID string, oldKey, newKey *rsa.PrivateKey) (*KeyRotation, error) {
+	oldPEM, err := MarshalPublicKey(&oldKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	newPEM, err := MarshalPublicKey(&newKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &KeyRotation{
+		NodeID:    nodeID,
+		OldKey:    oldPEM,
+		NewKey:    newPEM,
+		RotatedAt: time.Now().Unix(),
+	}
+	signed, err := r.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if r.OldSignature, err = signMessage(oldKey, signed); err != nil {
+		return nil, err
+	}
+	if r.NewSignature, err = signMessage(newKey, signed); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Verify checks that both keys signed the rotation. It does not say whether
+// the old key is the one the node had; that is for whoever pinned it.
+func (r *KeyRotation) Verify() error {
+	oldKey, newKey, err := r.Keys()
+	if err != nil {
+		return err
+	}
+	if oldKey.Equal(newKey) {
+		return fmt.Errorf("key rotation keeps the same key")
+	}
+
+	signed, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(signed, r.OldSignature, oldKey); err != nil {
+		return fmt.Errorf("old key: %w", err)
+	}
+	if err := verifySignature(signed, r.NewSignature, newKey); err != nil {
+		return fmt.Errorf("new key: %w", err)
+	}
+	return nil
+}
+
+// Keys returns the key the rotation replaces and the one that replaces it
+func (r *KeyRotation) Keys() (oldKey, newKey *rsa.PublicKey, err error) {
+	if oldKey, err = UnmarshalPublicKey(r.OldKey); err != nil {
+		return nil, nil, fmt.Errorf("invalid old key: %w", err)
+	}
+	if newKey, err = UnmarshalPublicKey(r.NewKey); err != nil {
+		return nil, nil, fmt.Errorf("invalid new key: %w", err)
+	}
+	return oldKey, newKey, nil
+}
+
+// signedBytes returns what both keys sign: the rotation without signatures
+func (r *KeyRotation) signedBytes() ([]byte, error) {
+	unsigned := *r
+	unsigned.OldSignature = nil
+	unsigned.NewSignature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key rotation: %w", err)
+	}
+	return data, nil
+}
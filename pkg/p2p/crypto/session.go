@@ -0,0 +1,190 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Session resumption lets peers that completed a full handshake skip the RSA
+// signatures when they reconnect. Both ends of a full handshake derive a
+// shared secret from the X25519 keys in their handshake messages and keep it
+// as a ticket. To reconnect, the dialing side sends the ticket's ID and a
+// fresh nonce, authenticated with the secret; the other side answers with a
+// nonce of its own, and both replace the ticket with one derived from the
+// secret and both nonces, so every ticket is used once.
+
+const (
+	// SecretSize is the size of session secrets
+	SecretSize = 32
+
+	ticketIDSize = 16
+	nonceSize    = 32
+)
+
+// ResumeMessage carries a request to resume a session, or the answer to one
+type ResumeMessage struct {
+	TicketID []byte `json:"ticket_id"`
+	Nonce    []byte `json:"nonce,omitempty"`
+	// Accepted is set on answers that resume the session. The dialing side
+	// goes on with a full handshake after any other answer.
+	Accepted bool   `json:"accepted,omitempty"`
+	MAC      []byte `json:"mac,omitempty"`
+}
+
+// SessionSecret derives the secret two peers share after a full handshake
+// from our handshake message and theirs. initiator says whether we sent the
+// first message. It returns nil if either message lacks an exchange key, as
+// those of peers that predate session resumption do.
+func SessionSecret(ours, theirs *HandshakeMessage, initiator bool) ([]byte, error) {
+	if ours.exchange == nil || len(theirs.ExchangeKey) == 0 {
+		return nil, nil
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(theirs.ExchangeKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exchange key: %w", err)
+	}
+	shared, err := ours.exchange.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+
+	first, second := ours, theirs
+	if !initiator {
+		first, second = theirs, ours
+	}
+	salt := append(append([]byte{}, first.ExchangeKey...), second.ExchangeKey...)
+	return hkdf.Key(sha256.New, shared, salt, "synapse session "+first.NodeID+" "+second.NodeID, SecretSize)
+}
+
+// TicketID returns the ID both peers know the ticket for secret by
+func TicketID(secret []byte) []byte {
+	return derive(secret, nil, "synapse ticket id", ticketIDSize)
+}
+
+// ResumedSecret derives the secret of a session resumed from secret, which
+// replaces the ticket the session was resumed with
+func ResumedSecret(secret []byte, request, response *HandshakeMessage) []byte {
+	salt := append(append([]byte{}, request.Resume.Nonce...), response.Resume.Nonce...)
+	return derive(secret, salt, "synapse resumed session", SecretSize)
+}
+
+// CreateResumeRequest creates a request to resume the session of secret
+func (h *HandshakeManager) CreateResumeRequest(secret []byte) (*HandshakeMessage, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := h.resumeMessage(&ResumeMessage{TicketID: TicketID(secret), Nonce: nonce})
+	msg.Resume.MAC = resumeMAC(secret, "request", msg, nil)
+	return msg, nil
+}
+
+// CreateResumeResponse answers a resume request. Given the secret of the
+// ticket the request presents, it accepts the request; given nil, it
+// refuses it.
+func (h *HandshakeManager) CreateResumeResponse(request *HandshakeMessage, secret []byte) (*HandshakeMessage, error) {
+	msg := h.resumeMessage(&ResumeMessage{TicketID: request.Resume.TicketID})
+	if secret == nil {
+		return msg, nil
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	msg.Resume.Nonce = nonce
+	msg.Resume.Accepted = true
+	msg.Resume.MAC = resumeMAC(secret, "response", msg, request.Resume.Nonce)
+	return msg, nil
+}
+
+// VerifyResumeRequest checks that a resume request is recent and was made
+// with secret
+func VerifyResumeRequest(msg *HandshakeMessage, secret []byte) error {
+	return verifyResume(msg, secret, "request", nil)
+}
+
+// VerifyResumeResponse checks that an answer accepting request is recent
+// and was made with secret
+func VerifyResumeResponse(msg, request *HandshakeMessage, secret []byte) error {
+	if !msg.Resume.Accepted {
+		return fmt.Errorf("session resumption refused")
+	}
+	return verifyResume(msg, secret, "response", request.Resume.Nonce)
+}
+
+// resumeMessage wraps a resume request or answer in a handshake message
+func (h *HandshakeManager) resumeMessage(resume *ResumeMessage) *HandshakeMessage {
+	return &HandshakeMessage{
+		NodeID:    h.nodeID,
+		Timestamp: time.Now().Unix(),
+
+		ProtocolVersion:    h.version,
+		MinProtocolVersion: h.minVersion,
+
+		Resume: resume,
+	}
+}
+
+func verifyResume(msg *HandshakeMessage, secret []byte, label string, requestNonce []byte) error {
+	if msg.Resume == nil || len(msg.Resume.Nonce) != nonceSize {
+		return fmt.Errorf("malformed resume message")
+	}
+	if !hmac.Equal(msg.Resume.MAC, resumeMAC(secret, label, msg, requestNonce)) {
+		return fmt.Errorf("resume message authentication failed")
+	}
+	return checkTimestamp(msg.Timestamp)
+}
+
+// resumeMAC authenticates the fields of a resume message, and for answers
+// the nonce of the request answered
+func resumeMAC(secret []byte, label string, msg *HandshakeMessage, requestNonce []byte) []byte {
+	var buf bytes.Buffer
+	for _, field := range [][]byte{
+		[]byte(label),
+		[]byte(msg.NodeID),
+		binary.BigEndian.AppendUint64(nil, uint64(msg.Timestamp)),
+		[]byte(msg.ProtocolVersion),
+		[]byte(msg.MinProtocolVersion),
+		msg.Resume.TicketID,
+		msg.Resume.Nonce,
+		requestNonce,
+	} {
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(field))))
+		buf.Write(field)
+	}
+	if msg.Resume.Accepted {
+		buf.WriteByte(1)
+	}
+
+	mac := hmac.New(sha256.New, derive(secret, nil, "synapse resume mac", sha256.Size))
+	mac.Write(buf.Bytes())
+	return mac.Sum(nil)
+}
+
+// derive expands secret into a key of size bytes for the purpose info
+func derive(secret, salt []byte, info string, size int) []byte {
+	key, err := hkdf.Key(sha256.New, secret, salt, info, size)
+	if err != nil {
+		// Only keys longer than 255 hashes cannot be derived
+		panic(err)
+	}
+	return key
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return nonce, nil
+}
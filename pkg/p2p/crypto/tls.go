@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// certificateLifetime is how long a node's self-signed certificate is valid.
+// Certificates are created anew on every start and key rotation, so this
+// only has to outlive a run.
+const certificateLifetime = 365 * 24 * time.Hour
+
+// ErrIdentityMismatch is returned when a TLS peer presents a certificate for
+// a different key than the one it proved in the handshake
+var ErrIdentityMismatch = errors.New("certificate does not match peer identity")
+
+// TLSCertificate returns a self-signed certificate for nodeID over the
+// encryptor's identity key, so transports secured with TLS authenticate with
+// the same key the handshake signs with
+func (e *Encryptor) TLSCertificate(nodeID string) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: nodeID},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certificateLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	privateKey, publicKey := e.keys()
+	der, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, privateKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  privateKey,
+	}, nil
+}
+
+// CertificateIdentity returns the node ID and key a peer certificate was
+// issued for, after checking that it is validly self-signed
+func CertificateIdentity(rawCerts [][]byte) (string, *rsa.PublicKey, error) {
+	if len(rawCerts) == 0 {
+		return "", nil, fmt.Errorf("no certificate presented")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return "", nil, fmt.Errorf("certificate is not self-signed: %w", err)
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return "", nil, fmt.Errorf("certificate is not valid at %s", now.Format(time.RFC3339))
+	}
+
+	pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return "", nil, fmt.Errorf("certificate key is not an RSA key")
+	}
+	return cert.Subject.CommonName, pubKey, nil
+}
+
+// VerifyIdentity checks that a peer certificate was issued to nodeID for the
+// key it proved in the handshake
+func VerifyIdentity(rawCerts [][]byte, nodeID string, expected *rsa.PublicKey) error {
+	certNodeID, pubKey, err := CertificateIdentity(rawCerts)
+	if err != nil {
+		return err
+	}
+	if certNodeID != nodeID || expected == nil || !pubKey.Equal(expected) {
+		return fmt.Errorf("%w: expected %s", ErrIdentityMismatch, nodeID)
+	}
+	return nil
+}
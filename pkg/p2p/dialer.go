@@ -0,0 +1,329 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/monitor"
+)
+
+// DialFunc sets up a connection to address and returns the ID of the peer
+// reached
+type DialFunc func(ctx context.Context, address string) (string, error)
+
+// Dialer funnels the outbound connections of every subsystem, so bootstrap,
+// discovery, peer exchange, isolation recovery and static peers together
+// never set up more than a fixed number of connections at once. A dial to
+// an address that is already being dialed joins that dial instead of
+// opening a second connection, and an address whose dial failed is not
+// dialed again until its cooldown ends. Peers with several addresses are
+// dialed at all of them in turn, see DialAny.
+type Dialer struct {
+	slots    chan struct{}
+	cooldown time.Duration
+	stats    *monitor.Stats
+	now      func() time.Time
+	// attemptDelay is how long DialAny waits on one address before trying
+	// the next alongside it
+	attemptDelay time.Duration
+
+	// Dials in flight and when the cooldown of failed addresses ends, by
+	// address
+	inflight map[string]*dialCall
+	failed   map[string]time.Time
+	// latency is the smoothed time successful dials took, by IP version
+	latency map[discovery.IPFamily]time.Duration
+	mu      sync.Mutex
+}
+
+// dialCall is a dial in flight that later dials to the address wait for
+type dialCall struct {
+	done   chan struct{}
+	dialed bool
+	peerID string
+	err    error
+}
+
+// NewDialer creates a dialer that runs at most maxInFlight dials at once and
+// refuses to redial a failed address for cooldown. Dials are counted in
+// stats.
+func NewDialer(maxInFlight int, cooldown time.Duration, stats *monitor.Stats) *Dialer {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	return &Dialer{
+		slots:        make(chan struct{}, maxInFlight),
+		cooldown:     cooldown,
+		stats:        stats,
+		now:          time.Now,
+		attemptDelay: DefaultDialAttemptDelay,
+		inflight:     make(map[string]*dialCall),
+		failed:       make(map[string]time.Time),
+		latency:      make(map[discovery.IPFamily]time.Duration),
+	}
+}
+
+// Dial runs dial for address once fewer than the maximum number of dials
+// are in flight. If address is being dialed already, Dial waits for that
+// dial and returns its result instead. An address that failed within the
+// cooldown is refused with ErrDialCooldown. ctx bounds the wait as well as
+// the dial.
+func (d *Dialer) Dial(ctx context.Context, address string, dial DialFunc) (string, error) {
+	return d.dial(ctx, address, dial, true)
+}
+
+// DialNow is Dial for an address that may be in its cooldown, for dials
+// asked for explicitly rather than retried automatically
+func (d *Dialer) DialNow(ctx context.Context, address string, dial DialFunc) (string, error) {
+	return d.dial(ctx, address, dial, false)
+}
+
+func (d *Dialer) dial(ctx context.Context, address string, dial DialFunc, honourCooldown bool) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("failed to connect to peer %s: %w", address, err)
+	}
+
+	for {
+		d.mu.Lock()
+		call, joined := d.inflight[address]
+		if !joined {
+			break
+		}
+		d.mu.Unlock()
+
+		d.stats.IncrementDialsDeduplicated()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return "", fmt.Errorf("failed to connect to peer %s: %w", address, ctx.Err())
+		}
+		// A dial given up by its caller is no answer for us; try again
+		abandoned := !call.dialed || errors.Is(call.err, context.Canceled)
+		if !abandoned || ctx.Err() != nil {
+			return call.peerID, call.err
+		}
+	}
+
+	// d.mu is held and no dial to address is in flight
+	if until, cooling := d.failed[address]; cooling {
+		if wait := until.Sub(d.now()); wait > 0 && honourCooldown {
+			d.mu.Unlock()
+			d.stats.IncrementDialsCooledDown()
+			return "", fmt.Errorf("failed to connect to peer %s: %w, retry in %v", address, ErrDialCooldown, wait.Round(time.Second))
+		}
+		delete(d.failed, address)
+	}
+	call := &dialCall{done: make(chan struct{})}
+	d.inflight[address] = call
+	d.mu.Unlock()
+
+	if err := d.acquire(ctx); err != nil {
+		call.err = fmt.Errorf("failed to connect to peer %s: %w", address, err)
+	} else {
+		call.dialed = true
+		start := d.now()
+		call.peerID, call.err = dial(ctx, address)
+		if call.err == nil {
+			d.recordLatency(address, d.now().Sub(start))
+		}
+		d.release()
+	}
+
+	// Only an address that was actually dialed can have failed
+	d.mu.Lock()
+	delete(d.inflight, address)
+	if call.dialed && d.cooldown > 0 && dialFailed(call.err) {
+		d.startCooldown(address)
+	} else if call.err == nil {
+		delete(d.failed, address)
+	}
+	d.mu.Unlock()
+	close(call.done)
+
+	return call.peerID, call.err
+}
+
+// DialAny dials a peer that may be reached at several addresses, Happy
+// Eyeballs style (RFC 8305): the addresses are tried one after another, each
+// getting the attempt delay, or until it fails, before the next is dialed
+// alongside it. The first to connect wins and the other attempts are
+// cancelled. Addresses the peer was connected at come first, most recent
+// first, then the rest alternate between IP versions starting with the one
+// dials have completed fastest over. DialAny returns the peer reached and
+// the address it answered at, or the errors of every address. Each address
+// is dialed as Dial does, cooldown included.
+func (d *Dialer) DialAny(ctx context.Context, addresses []PeerAddress, dial DialFunc) (string, string, error) {
+	ordered := d.orderAddresses(addresses)
+	if len(ordered) == 0 {
+		return "", "", fmt.Errorf("failed to connect to peer: no address to dial")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		address string
+		peerID  string
+		err     error
+	}
+	results := make(chan attempt, len(ordered))
+	next, running := 0, 0
+	var errs []error
+	start := time.NewTimer(0)
+	defer start.Stop()
+
+	for next < len(ordered) || running > 0 {
+		var started <-chan time.Time
+		if next < len(ordered) {
+			started = start.C
+		}
+
+		select {
+		case <-started:
+			address := ordered[next]
+			next++
+			running++
+			go func() {
+				peerID, err := d.Dial(ctx, address, dial)
+				results <- attempt{address: address, peerID: peerID, err: err}
+			}()
+			start.Reset(d.attemptDelay)
+		case result := <-results:
+			running--
+			// Reaching a peer we already have is as good as connecting
+			if result.err == nil || errors.Is(result.err, ErrDuplicatePeer) {
+				cancel()
+				for ; running > 0; running-- {
+					<-results
+				}
+				return result.peerID, result.address, result.err
+			}
+			errs = append(errs, result.err)
+			start.Reset(0)
+		}
+	}
+	return "", "", errors.Join(errs...)
+}
+
+// orderAddresses lists the addresses in the order DialAny tries them
+func (d *Dialer) orderAddresses(addresses []PeerAddress) []string {
+	seen := make(map[string]bool, len(addresses))
+	var connected []PeerAddress
+	var families []discovery.IPFamily
+	byFamily := make(map[discovery.IPFamily][]string)
+	for _, address := range addresses {
+		if seen[address.Address] {
+			continue
+		}
+		seen[address.Address] = true
+		if !address.LastConnected.IsZero() {
+			connected = append(connected, address)
+			continue
+		}
+		// Hostnames make a family of their own
+		family, _ := discovery.AddressFamily(address.Address)
+		if _, known := byFamily[family]; !known {
+			families = append(families, family)
+		}
+		byFamily[family] = append(byFamily[family], address.Address)
+	}
+
+	sort.SliceStable(connected, func(i, j int) bool {
+		return connected[i].LastConnected.After(connected[j].LastConnected)
+	})
+	ordered := make([]string, 0, len(seen))
+	for _, address := range connected {
+		ordered = append(ordered, address.Address)
+	}
+
+	// Families we have timed go first, fastest first; the rest keep the
+	// order they were given in
+	d.mu.Lock()
+	latency := make(map[discovery.IPFamily]time.Duration, len(d.latency))
+	for family, took := range d.latency {
+		latency[family] = took
+	}
+	d.mu.Unlock()
+	sort.SliceStable(families, func(i, j int) bool {
+		a, aTimed := latency[families[i]]
+		b, bTimed := latency[families[j]]
+		if aTimed != bTimed {
+			return aTimed
+		}
+		return a < b
+	})
+
+	for len(ordered) < len(seen) {
+		for _, family := range families {
+			if queue := byFamily[family]; len(queue) > 0 {
+				ordered = append(ordered, queue[0])
+				byFamily[family] = queue[1:]
+			}
+		}
+	}
+	return ordered
+}
+
+// recordLatency folds how long a successful dial to address took into the
+// smoothed latency of its IP version
+func (d *Dialer) recordLatency(address string, took time.Duration) {
+	family, ok := discovery.AddressFamily(address)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if smoothed, timed := d.latency[family]; timed {
+		took = (3*smoothed + took) / 4
+	}
+	d.latency[family] = took
+}
+
+// acquire waits for a dial slot
+func (d *Dialer) acquire(ctx context.Context) error {
+	d.stats.AddDialsQueued(1)
+	defer d.stats.AddDialsQueued(-1)
+
+	select {
+	case d.slots <- struct{}{}:
+		d.stats.AddDialsInFlight(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the dial slot taken by acquire
+func (d *Dialer) release() {
+	<-d.slots
+	d.stats.AddDialsInFlight(-1)
+}
+
+// startCooldown keeps address from being dialed for the cooldown, and
+// forgets addresses whose cooldown has ended. Must be called with d.mu held.
+func (d *Dialer) startCooldown(address string) {
+	now := d.now()
+	for failed, until := range d.failed {
+		if !now.Before(until) {
+			delete(d.failed, failed)
+		}
+	}
+	d.failed[address] = now.Add(d.cooldown)
+}
+
+// dialFailed reports whether err means the address could not be connected
+// to, as opposed to the dial being refused by us, abandoned by its caller
+// or reaching a peer we already have
+func dialFailed(err error) bool {
+	return err != nil &&
+		!errors.Is(err, ErrDuplicatePeer) &&
+		!errors.Is(err, ErrAddressNotAllowed) &&
+		!errors.Is(err, ErrDialCooldown) &&
+		!errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,248 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/monitor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialerLimitsConcurrency(t *testing.T) {
+	stats := monitor.NewStats()
+	dialer := NewDialer(5, time.Minute, stats)
+
+	var inFlight, peak, maxQueued atomic.Int64
+	dial := func(ctx context.Context, address string) (string, error) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := peak.Load()
+			if current <= seen || peak.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		if queued := int64(stats.GetStats().DialsQueued); queued > maxQueued.Load() {
+			maxQueued.Store(queued)
+		}
+		time.Sleep(time.Millisecond)
+		return "peer-" + address, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			peerID, err := dialer.Dial(context.Background(), address, dial)
+			assert.NoError(t, err)
+			assert.Equal(t, "peer-"+address, peerID)
+		}(fmt.Sprintf("10.0.%d.%d:8080", i/250, i%250+1))
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, peak.Load(), int64(5))
+	assert.Equal(t, int64(5), peak.Load(), "the limit should be used in full")
+	assert.Positive(t, maxQueued.Load(), "waiting dials should show in the stats")
+
+	snapshot := stats.GetStats()
+	assert.Zero(t, snapshot.DialsQueued)
+	assert.Zero(t, snapshot.DialsInFlight)
+}
+
+func TestDialerDeduplicates(t *testing.T) {
+	stats := monitor.NewStats()
+	dialer := NewDialer(5, time.Minute, stats)
+
+	var dials atomic.Int32
+	release := make(chan struct{})
+	dial := func(ctx context.Context, address string) (string, error) {
+		dials.Add(1)
+		<-release
+		return "peer-a", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peerID, err := dialer.Dial(context.Background(), "10.0.0.1:8080", dial)
+			assert.NoError(t, err)
+			assert.Equal(t, "peer-a", peerID)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return stats.GetStats().DialsDeduplicated == 9
+	}, 5*time.Second, 5*time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), dials.Load())
+
+	// Once the dial is done the address may be dialed again
+	_, err := dialer.Dial(context.Background(), "10.0.0.1:8080", dial)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), dials.Load())
+}
+
+func TestDialerCooldown(t *testing.T) {
+	stats := monitor.NewStats()
+	dialer := NewDialer(5, 10*time.Second, stats)
+	now := time.Unix(1000, 0)
+	dialer.now = func() time.Time { return now }
+
+	var dials atomic.Int32
+	refuse := func(ctx context.Context, address string) (string, error) {
+		dials.Add(1)
+		return "", ErrConnectionRefused
+	}
+
+	_, err := dialer.Dial(context.Background(), "10.0.0.1:8080", refuse)
+	assert.ErrorIs(t, err, ErrConnectionRefused)
+	_, err = dialer.Dial(context.Background(), "10.0.0.1:8080", refuse)
+	assert.ErrorIs(t, err, ErrDialCooldown)
+	assert.Equal(t, int32(1), dials.Load())
+	assert.Equal(t, uint64(1), stats.GetStats().DialsCooledDown)
+
+	// An explicit dial goes ahead anyway
+	_, err = dialer.DialNow(context.Background(), "10.0.0.1:8080", refuse)
+	assert.ErrorIs(t, err, ErrConnectionRefused)
+	assert.Equal(t, int32(2), dials.Load())
+
+	// Other addresses are unaffected, and the cooldown ends
+	_, err = dialer.Dial(context.Background(), "10.0.0.2:8080", refuse)
+	assert.ErrorIs(t, err, ErrConnectionRefused)
+	now = now.Add(10 * time.Second)
+	_, err = dialer.Dial(context.Background(), "10.0.0.1:8080", refuse)
+	assert.ErrorIs(t, err, ErrConnectionRefused)
+	assert.Equal(t, int32(4), dials.Load())
+
+	// Reaching a peer we already have is no failure
+	duplicate := func(ctx context.Context, address string) (string, error) {
+		return "peer-c", &duplicatePeerError{peerID: "peer-c"}
+	}
+	_, err = dialer.Dial(context.Background(), "10.0.0.3:8080", duplicate)
+	assert.ErrorIs(t, err, ErrDuplicatePeer)
+	_, err = dialer.Dial(context.Background(), "10.0.0.3:8080", duplicate)
+	assert.ErrorIs(t, err, ErrDuplicatePeer)
+}
+
+func TestDialerQueueHonoursContext(t *testing.T) {
+	dialer := NewDialer(1, 0, monitor.NewStats())
+
+	release := make(chan struct{})
+	defer close(release)
+	go dialer.Dial(context.Background(), "10.0.0.1:8080", func(ctx context.Context, address string) (string, error) {
+		<-release
+		return "peer-a", nil
+	})
+	require.Eventually(t, func() bool {
+		return dialer.stats.GetStats().DialsInFlight == 1
+	}, 5*time.Second, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := dialer.Dial(ctx, "10.0.0.2:8080", func(ctx context.Context, address string) (string, error) {
+		return "", errors.New("should not be dialed")
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Zero(t, dialer.stats.GetStats().DialsQueued)
+}
+
+func TestDialerDialAnyRacesAddresses(t *testing.T) {
+	dialer := NewDialer(5, time.Minute, monitor.NewStats())
+	dialer.attemptDelay = 20 * time.Millisecond
+
+	// The first address swallows the dial until it is cancelled
+	var cancelled atomic.Bool
+	dial := func(ctx context.Context, address string) (string, error) {
+		if address == "10.0.0.1:8080" {
+			<-ctx.Done()
+			cancelled.Store(true)
+			return "", ctx.Err()
+		}
+		return "peer-a", nil
+	}
+
+	begin := time.Now()
+	peerID, address, err := dialer.DialAny(context.Background(), []PeerAddress{
+		{Address: "10.0.0.1:8080"},
+		{Address: "10.0.0.2:8080"},
+	}, dial)
+	require.NoError(t, err)
+	assert.Equal(t, "peer-a", peerID)
+	assert.Equal(t, "10.0.0.2:8080", address)
+	assert.Less(t, time.Since(begin), time.Second, "the live address should not wait on the dead one")
+	assert.True(t, cancelled.Load(), "the losing attempt should be cancelled")
+
+	// An address that fails outright hands over without waiting out the delay
+	dialer.attemptDelay = time.Hour
+	refused := func(ctx context.Context, address string) (string, error) {
+		if address == "10.0.0.3:8080" {
+			return "", errors.New("connection refused")
+		}
+		return "peer-b", nil
+	}
+	peerID, address, err = dialer.DialAny(context.Background(), []PeerAddress{
+		{Address: "10.0.0.3:8080"},
+		{Address: "10.0.0.4:8080"},
+	}, refused)
+	require.NoError(t, err)
+	assert.Equal(t, "peer-b", peerID)
+	assert.Equal(t, "10.0.0.4:8080", address)
+
+	// Every address failing reports each of them
+	_, _, err = dialer.DialAny(context.Background(), []PeerAddress{
+		{Address: "10.0.0.5:8080"},
+		{Address: "10.0.0.6:8080"},
+	}, func(ctx context.Context, address string) (string, error) {
+		return "", errors.New("connection refused to " + address)
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "10.0.0.5:8080")
+	assert.Contains(t, err.Error(), "10.0.0.6:8080")
+
+	_, _, err = dialer.DialAny(context.Background(), nil, dial)
+	assert.Error(t, err)
+}
+
+func TestDialerOrdersAddresses(t *testing.T) {
+	dialer := NewDialer(5, time.Minute, monitor.NewStats())
+	now := time.Now()
+
+	// Addresses we were connected at come first, most recent first, and the
+	// rest alternate between IP versions in the order given
+	addresses := []PeerAddress{
+		{Address: "10.0.0.1:8080"},
+		{Address: "10.0.0.2:8080"},
+		{Address: "[2001:db8::1]:8080"},
+		{Address: "10.0.0.3:8080", LastConnected: now.Add(-time.Hour)},
+		{Address: "[2001:db8::2]:8080", LastConnected: now},
+		{Address: "10.0.0.1:8080"},
+	}
+	assert.Equal(t, []string{
+		"[2001:db8::2]:8080",
+		"10.0.0.3:8080",
+		"10.0.0.1:8080",
+		"[2001:db8::1]:8080",
+		"10.0.0.2:8080",
+	}, dialer.orderAddresses(addresses))
+
+	// Once dials have been timed the faster version leads
+	dialer.recordLatency("10.0.0.9:8080", 80*time.Millisecond)
+	dialer.recordLatency("[2001:db8::9]:8080", 10*time.Millisecond)
+	assert.Equal(t, []string{
+		"[2001:db8::2]:8080",
+		"10.0.0.3:8080",
+		"[2001:db8::1]:8080",
+		"10.0.0.1:8080",
+		"10.0.0.2:8080",
+	}, dialer.orderAddresses(addresses))
+}
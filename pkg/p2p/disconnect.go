@@ -0,0 +1,190 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNoReconnect is returned for an automatic dial of a peer we disconnected
+// and asked not to be redialed for a while
+var ErrNoReconnect = errors.New("peer is held off from reconnecting")
+
+// DisconnectOptions says how DisconnectPeer lets go of a peer
+type DisconnectOptions struct {
+	// Reason says why the peer is disconnected; it is logged, audited and,
+	// when draining, sent in the GOODBYE
+	Reason string
+	// Drain waits up to DrainTimeout, or DefaultDrainTimeout if that is 0,
+	// for the reliable sends to the peer to be acknowledged, then says
+	// GOODBYE so the peer forgets us too. Otherwise the connection is closed
+	// at once, leaving the reliable sends still waiting to time out.
+	Drain        bool
+	DrainTimeout time.Duration
+	// NoReconnect keeps discovery and static peer dialing from dialing the
+	// peer again for that long. The peer may still dial us, and Connect
+	// still dials it.
+	NoReconnect time.Duration
+}
+
+// DisconnectPeer closes the connection to peerID and forgets the peer, so it
+// is gone from the registry, the connection pool and the topology when it
+// returns. It returns ErrPeerNotFound for a peer that is not known.
+func (n *Network) DisconnectPeer(peerID string, opts DisconnectOptions) error {
+	peer, exists := n.peers.Get(peerID)
+	if !exists {
+		return fmt.Errorf("%w %s", ErrPeerNotFound, peerID)
+	}
+	if opts.Reason == "" {
+		opts.Reason = "disconnected"
+	}
+	if opts.NoReconnect > 0 {
+		n.holds.hold(peerID, opts.NoReconnect)
+		n.events.Publish(Event{
+			Type:   EventPeerBanned,
+			PeerID: peerID,
+			Data: map[string]interface{}{
+				"reason":               opts.Reason,
+				"no_reconnect_seconds": opts.NoReconnect.Seconds(),
+			},
+		})
+	}
+
+	if conn := peer.GetConnection(); conn != nil {
+		if opts.Drain {
+			timeout := opts.DrainTimeout
+			if timeout <= 0 {
+				timeout = DefaultDrainTimeout
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := conn.inflight.wait(ctx); err != nil {
+				n.logger.Warnf("closing connection to %s with %d reliable sends unacknowledged", peerID, conn.inflight.pending())
+			}
+			cancel()
+
+			// Both ends audit the disconnect under the goodbye's trace
+			goodbye := NewMessage(MessageTypeGoodbye, n.nodeID, GoodbyePayload{Reason: opts.Reason})
+			traceMessage(context.Background(), &goodbye)
+			if err := n.sendMessageToConn(conn.Conn, goodbye); err != nil {
+				n.messageLogger(&goodbye).Debugf("failed to send goodbye to %s: %v", peerID, err)
+			}
+			conn.closeFor(&goodbye, opts.Reason)
+		} else {
+			conn.closeWith(opts.Reason)
+		}
+		n.pool.RemoveConnection(conn.ID)
+	}
+
+	n.removePeer(peerID)
+	return nil
+}
+
+// inflightSends counts the reliable sends waiting for acknowledgement, so a
+// drain can wait for them
+type inflightSends struct {
+	count int
+	idle  chan struct{}
+	mu    sync.Mutex
+}
+
+// add counts a send starting
+func (f *inflightSends) add() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.count == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.count++
+}
+
+// done counts a send ending, acknowledged or not
+func (f *inflightSends) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.count--
+	if f.count == 0 {
+		close(f.idle)
+	}
+}
+
+// pending returns how many sends are waiting
+func (f *inflightSends) pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.count
+}
+
+// wait blocks until no sends are waiting or ctx ends
+func (f *inflightSends) wait(ctx context.Context) error {
+	f.mu.Lock()
+	if f.count == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reconnectHolds remembers the peers that must not be redialed until a
+// given time
+type reconnectHolds struct {
+	until map[string]time.Time
+	now   func() time.Time
+	mu    sync.Mutex
+}
+
+// newReconnectHolds creates an empty set of holds
+func newReconnectHolds() *reconnectHolds {
+	return &reconnectHolds{
+		until: make(map[string]time.Time),
+		now:   time.Now,
+	}
+}
+
+// hold keeps peerID from being redialed for d
+func (h *reconnectHolds) hold(peerID string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	for id, until := range h.until {
+		if !now.Before(until) {
+			delete(h.until, id)
+		}
+	}
+	h.until[peerID] = now.Add(d)
+}
+
+// remaining returns how much longer peerID is held, or 0 if it is not
+func (h *reconnectHolds) remaining(peerID string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return max(h.until[peerID].Sub(h.now()), 0)
+}
+
+// redialDelay returns how long until peerID may be dialed automatically
+// again, for flapping or for being held off, or 0 if it may be now
+func (n *Network) redialDelay(peerID string) time.Duration {
+	return max(n.flaps.DampedFor(peerID), n.holds.remaining(peerID))
+}
+
+// checkRedial refuses an automatic dial of a peer that is damped for
+// flapping or held off from reconnecting
+func (n *Network) checkRedial(peerID string) error {
+	if wait := n.flaps.DampedFor(peerID); wait > 0 {
+		return fmt.Errorf("not dialing %s for %v: %w", peerID, wait.Round(time.Second), ErrPeerDamped)
+	}
+	if wait := n.holds.remaining(peerID); wait > 0 {
+		return fmt.Errorf("not dialing %s for %v: %w", peerID, wait.Round(time.Second), ErrNoReconnect)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// drainPair connects two networks on the in-memory network that dial
+// nothing by themselves, so the sender's acknowledgements can be held back;
+// the receiver acknowledges the NOTE messages sendUnacknowledged sends
+func drainPair(t *testing.T, ctx context.Context, prefix string) (sender, receiver *Network) {
+	quiet := func() *config.Config {
+		cfg := config.Default()
+		cfg.P2P.MinPeers = 0
+		cfg.P2P.TargetPeers = 0
+		cfg.P2P.DiscoveryFloor = 0
+		return cfg
+	}
+	receiver = startMemoryNetwork(t, ctx, quiet(), prefix+"-receiver", prefix+"-receiver-host")
+	sender = startMemoryNetwork(t, ctx, quiet(), prefix+"-sender", prefix+"-sender-host")
+
+	_, err := sender.Connect(ctx, localAddr(receiver))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(sender.Peers()) == 1 && len(receiver.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	return sender, receiver
+}
+
+// sendUnacknowledged sends a reliable NOTE while the receiver's
+// acknowledgement is held back, and returns where the send's result arrives
+func sendUnacknowledged(t *testing.T, ctx context.Context, sender, receiver *Network, receiverHost, senderHost string) <-chan error {
+	delivered := make(chan struct{}, 1)
+	receiver.RegisterHandler("NOTE", func(msg Message) { delivered <- struct{}{} })
+	memoryNetwork.Hold(receiverHost, senderHost)
+	result := make(chan error, 1)
+	go func() {
+		result <- sender.SendMessageReliable(ctx, receiver.nodeID, NewMessage("NOTE", sender.nodeID, "in flight"))
+	}()
+
+	// The receiver has the message, but its acknowledgement is held back
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reliable message not delivered")
+	}
+	require.Equal(t, 1, sender.liveConnection(receiver.nodeID).inflight.pending())
+	return result
+}
+
+func TestDisconnectPeerDrains(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sender, receiver := drainPair(t, ctx, "drain")
+	sent := sendUnacknowledged(t, ctx, sender, receiver, "drain-receiver-host", "drain-sender-host")
+
+	disconnected := make(chan error, 1)
+	go func() {
+		disconnected <- sender.DisconnectPeer("drain-receiver", DisconnectOptions{Reason: "maintenance", Drain: true})
+	}()
+
+	// The drain waits for the acknowledgement
+	select {
+	case err := <-disconnected:
+		t.Fatalf("disconnected before the reliable send was acknowledged: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	memoryNetwork.Release("drain-receiver-host", "drain-sender-host", nil)
+	require.NoError(t, <-sent)
+	require.NoError(t, <-disconnected)
+
+	// The peer is gone at once, and the GOODBYE makes it forget us too
+	_, known := sender.peers.Get("drain-receiver")
+	assert.False(t, known)
+	assert.Zero(t, sender.Status().ActiveConnections)
+	assert.Empty(t, sender.topologyMgr.GetConnectedPeers())
+	require.Eventually(t, func() bool {
+		_, known := receiver.peers.Get("drain-sender")
+		return !known
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.ErrorIs(t, sender.DisconnectPeer("drain-receiver", DisconnectOptions{}), ErrPeerNotFound)
+}
+
+func TestDisconnectPeerHardClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sender, receiver := drainPair(t, ctx, "hard")
+	sendCtx, sendCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer sendCancel()
+	sent := sendUnacknowledged(t, sendCtx, sender, receiver, "hard-receiver-host", "hard-sender-host")
+
+	// Closing does not wait, and the send is never acknowledged
+	connection := sender.liveConnection("hard-receiver")
+	start := time.Now()
+	require.NoError(t, sender.DisconnectPeer("hard-receiver", DisconnectOptions{Reason: "misbehaving"}))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, "misbehaving", connection.CloseReason())
+	assert.ErrorIs(t, <-sent, context.DeadlineExceeded)
+
+	_, known := sender.peers.Get("hard-receiver")
+	assert.False(t, known)
+	assert.Zero(t, sender.Status().ActiveConnections)
+
+	// Without a GOODBYE the peer sees the connection drop, but remembers us
+	require.Eventually(t, func() bool {
+		return receiver.liveConnection("hard-sender") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, known = receiver.peers.Get("hard-sender")
+	assert.True(t, known)
+}
+
+func TestDisconnectPeerNoReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	spoke := startDampingNetwork(t, ctx, "held-spoke", "held-spoke-host")
+	hub := startDampingNetwork(t, ctx, "held-hub", "held-hub-host", "held-spoke@"+localAddr(spoke))
+	require.Eventually(t, func() bool {
+		return hub.liveConnection("held-spoke") != nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// The static peer is not redialed until the hold runs out
+	hold := 400 * time.Millisecond
+	start := time.Now()
+	require.NoError(t, hub.DisconnectPeer("held-spoke", DisconnectOptions{Reason: "operator", NoReconnect: hold}))
+	assert.ErrorIs(t, hub.checkRedial("held-spoke"), ErrNoReconnect)
+	assert.Greater(t, hub.redialDelay("held-spoke"), 300*time.Millisecond)
+	require.Never(t, func() bool {
+		return hub.liveConnection("held-spoke") != nil
+	}, 300*time.Millisecond, 20*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		return hub.liveConnection("held-spoke") != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), hold)
+	assert.NoError(t, hub.checkRedial("held-spoke"))
+}
@@ -0,0 +1,388 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+)
+
+// DiscoveryStats summarises the periodic discovery cycles run so far
+type DiscoveryStats struct {
+	Cycles     int       `json:"cycles"`
+	Skipped    int       `json:"skipped"`
+	Candidates int       `json:"candidates"`
+	Attempts   int       `json:"attempts"`
+	Successes  int       `json:"successes"`
+	Triggered  int       `json:"triggered"`
+	LastCycle  time.Time `json:"last_cycle,omitempty"`
+}
+
+// BootstrapHealth describes how connecting to each configured bootstrap node
+// has gone
+func (n *Network) BootstrapHealth() []discovery.BootstrapHealth {
+	return n.bootstrapMgr.Health()
+}
+
+// addressPolicy returns the IP versions config allows us to listen and dial on
+func (n *Network) addressPolicy() discovery.AddressPolicy {
+	return discovery.AddressPolicy{
+		Prefer:    discovery.IPFamily(n.config.P2P.PreferredAddressFamily),
+		DualStack: n.config.P2P.DualStack,
+	}
+}
+
+// mdnsService returns the mDNS service config has us advertise and browse for
+func (n *Network) mdnsService() discovery.Service {
+	return discovery.Service{
+		Name:   n.config.P2P.MDNS.ServiceName,
+		Domain: n.config.P2P.MDNS.Domain,
+	}
+}
+
+// checkAdvertisedPeer tells whether a peer found over mDNS is worth
+// dialing, going by the network and protocol versions it advertises
+func (n *Network) checkAdvertisedPeer(peer discovery.Peer) error {
+	if err := n.checkAdvertisedNetwork(peer); err != nil {
+		return err
+	}
+	return n.checkAdvertisedVersion(peer)
+}
+
+// checkAdvertisedVersion tells whether we could speak with a peer found over
+// mDNS from the protocol versions it advertises, so incompatible peers are
+// never dialed. Peers advertising no version are given the benefit of the
+// doubt.
+func (n *Network) checkAdvertisedVersion(peer discovery.Peer) error {
+	if peer.Version == "" {
+		return nil
+	}
+	_, err := negotiateVersion(n.protocolVersion, n.minProtocolVersion, peer.Version, peer.MinVersion)
+	return err
+}
+
+// DiscoveryStats returns the totals of all discovery cycles
+func (n *Network) DiscoveryStats() DiscoveryStats {
+	n.discoveryMu.Lock()
+	defer n.discoveryMu.Unlock()
+	return n.discoveryStats
+}
+
+// periodicPeerDiscovery runs a discovery cycle every discovery interval,
+// and early when losing a peer leaves us below the discovery floor
+func (n *Network) periodicPeerDiscovery() {
+	events, unsubscribe := n.events.Subscribe(16)
+	defer unsubscribe()
+	ticker := time.NewTicker(n.discoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			n.logger.Info("stopping periodic peer discovery")
+			return
+		case <-ticker.C:
+			n.RequestTopologyReports()
+			n.discoverPeers()
+		case evt := <-events:
+			// A flapping peer is not worth a discovery cycle each time, nor
+			// one we were told not to redial
+			if evt.Type != EventPeerDisconnected || n.redialDelay(evt.PeerID) > 0 || !n.triggerDiscovery() {
+				continue
+			}
+			n.discoverPeers()
+			// The early cycle stands in for the next tick's
+			ticker.Reset(n.discoveryInterval)
+		}
+	}
+}
+
+// DiscoveryResult is the outcome of one discovery cycle: how many candidate
+// peers it found, dialed and connected to. Skipped means it did not look,
+// the node being connected to its target peer count already.
+type DiscoveryResult struct {
+	Candidates int  `json:"candidates"`
+	Dialed     int  `json:"dialed"`
+	Connected  int  `json:"connected"`
+	Skipped    bool `json:"skipped,omitempty"`
+}
+
+// discoveryCycle is a discovery cycle under way, which anyone wanting one
+// waits for instead of starting another
+type discoveryCycle struct {
+	done   chan struct{}
+	result DiscoveryResult
+}
+
+// DiscoverNow runs a discovery cycle at once, without waiting for the next
+// interval, and returns what it found. A cycle already under way, periodic
+// or asked for, is waited for instead of starting another, so concurrent
+// callers share its result. ctx bounds the wait, not the cycle.
+func (n *Network) DiscoverNow(ctx context.Context) (DiscoveryResult, error) {
+	n.mu.Lock()
+	running := n.running
+	n.mu.Unlock()
+	if !running {
+		return DiscoveryResult{}, fmt.Errorf("network not started")
+	}
+
+	cycle := n.startDiscovery()
+	select {
+	case <-cycle.done:
+		return cycle.result, nil
+	case <-ctx.Done():
+		return DiscoveryResult{}, ctx.Err()
+	}
+}
+
+// discoverPeers runs a discovery cycle, or waits for the one under way
+func (n *Network) discoverPeers() DiscoveryResult {
+	cycle := n.startDiscovery()
+	<-cycle.done
+	return cycle.result
+}
+
+// startDiscovery returns the discovery cycle under way, starting one if
+// there is none
+func (n *Network) startDiscovery() *discoveryCycle {
+	n.discoveryMu.Lock()
+	defer n.discoveryMu.Unlock()
+	if n.discovering != nil {
+		return n.discovering
+	}
+
+	cycle := &discoveryCycle{done: make(chan struct{})}
+	n.discovering = cycle
+	n.background(func() {
+		cycle.result = n.runDiscovery()
+		n.discoveryMu.Lock()
+		n.discovering = nil
+		n.discoveryMu.Unlock()
+		close(cycle.done)
+	})
+	return cycle
+}
+
+// runDiscovery runs one discovery cycle. Below the target peer count it
+// gathers candidates from our peers' peer lists, an mDNS browse and the
+// bootstrap nodes, then dials a bounded number of them.
+func (n *Network) runDiscovery() DiscoveryResult {
+	connected := n.peers.ConnectedCount()
+	target := n.config.P2P.TargetPeers
+	if target > n.config.P2P.MaxPeers {
+		target = n.config.P2P.MaxPeers
+	}
+
+	if connected >= target {
+		n.recordDiscovery(nil)
+		return DiscoveryResult{Skipped: true}
+	}
+
+	limit := target - connected
+	if limit > DefaultDiscoveryDialLimit {
+		limit = DefaultDiscoveryDialLimit
+	}
+
+	result, err := n.peerExchange.Exchange(n.ctx, limit)
+	if err != nil {
+		n.logger.Debugf("peer discovery cycle failed: %v", err)
+	}
+	n.logger.Debugf("peer discovery cycle: %d of %d target peers, %d candidates, %d dialed, %d connected",
+		connected, target, result.Candidates, result.Attempts, result.Connected)
+	n.recordDiscovery(&result)
+	return DiscoveryResult{
+		Candidates: result.Candidates,
+		Dialed:     result.Attempts,
+		Connected:  result.Connected,
+	}
+}
+
+// triggerDiscovery tells whether losing a peer should start a discovery
+// cycle at once, instead of at the next tick: it should when we are
+// connected to fewer peers than the discovery floor, at most once per
+// discovery cooldown, and not while isolation recovery is already dialing
+// every peer we know
+func (n *Network) triggerDiscovery() bool {
+	floor := n.config.P2P.DiscoveryFloor
+	connected := len(n.topologyMgr.GetConnectedPeers())
+	if floor <= 0 || connected >= floor {
+		return false
+	}
+	if n.isolation.IsIsolated() || atomic.LoadInt32(&n.recovering) == 1 {
+		return false
+	}
+
+	n.discoveryMu.Lock()
+	defer n.discoveryMu.Unlock()
+	now := time.Now()
+	if now.Sub(n.discoveryTriggered) < n.discoveryCooldown {
+		return false
+	}
+	n.discoveryTriggered = now
+	n.discoveryStats.Triggered++
+	n.logger.Infof("down to %d peers, below the discovery floor of %d; discovering peers now", connected, floor)
+	return true
+}
+
+// recordDiscovery adds a cycle's outcome to the stats; nil means the cycle
+// was skipped because the node already had enough peers
+func (n *Network) recordDiscovery(result *discovery.ExchangeResult) {
+	n.discoveryMu.Lock()
+	defer n.discoveryMu.Unlock()
+
+	n.discoveryStats.Cycles++
+	n.discoveryStats.LastCycle = time.Now()
+	if result == nil {
+		n.discoveryStats.Skipped++
+		return
+	}
+	n.discoveryStats.Candidates += result.Candidates
+	n.discoveryStats.Attempts += result.Attempts
+	n.discoveryStats.Successes += result.Connected
+}
+
+// discoveryCandidates lists peers we could dial that we are not connected
+// to, most trustworthy sources first: peers our peers are talking to, then
+// mDNS answers, then bootstrap nodes
+func (n *Network) discoveryCandidates() ([]discovery.Peer, error) {
+	known := map[string]bool{n.nodeID: true}
+	for _, addr := range n.ListenAddrs() {
+		known[addr.String()] = true
+	}
+	for _, peer := range n.ConnectedPeers() {
+		known[peer.ID] = true
+		known[peer.Address] = true
+		known[peer.DialAddress] = true
+	}
+
+	var candidates []discovery.Peer
+	listed := make(map[string]int)
+	add := func(id, address, source string) {
+		address, err := discovery.NormalizeAddress(address, DefaultListenPort)
+		if err != nil || known[address] {
+			return
+		}
+		if i, ok := listed[id]; ok && id != "" {
+			// Another address of a peer already listed, dialed alongside
+			// the first and remembered if we know the peer
+			known[address] = true
+			candidates[i].Addresses = append(candidates[i].DialAddresses(), address)
+			if _, remembered := n.peerStore.Get(id); remembered {
+				n.peerStore.Learn(id, address, source)
+			}
+			return
+		}
+		if id != "" && known[id] {
+			return
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return
+		}
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			return
+		}
+		known[address] = true
+		if id != "" {
+			known[id] = true
+			listed[id] = len(candidates)
+			if _, remembered := n.peerStore.Get(id); remembered {
+				n.peerStore.Learn(id, address, source)
+			}
+		}
+		candidates = append(candidates, discovery.Peer{ID: id, Address: host, Port: portNum})
+	}
+
+	for _, info := range n.collectPeerLists() {
+		add(info.ID, info.Address, AddressSourcePeerExchange)
+		for _, address := range info.Addresses {
+			add(info.ID, address, AddressSourcePeerExchange)
+		}
+	}
+
+	if n.config.P2P.EnableDiscovery {
+		peers, err := discovery.DiscoverLocalPeers(n.ctx, DefaultMDNSScanTimeout, n.mdnsService(), n.addressPolicy())
+		if err != nil {
+			n.logger.Debugf("mDNS browse failed: %v", err)
+		}
+		for _, peer := range peers {
+			if err := n.checkAdvertisedPeer(peer); err != nil {
+				n.logger.Debugf("not dialing mDNS peer %s: %v", peer.ID, err)
+				continue
+			}
+			for _, address := range peer.DialAddresses() {
+				add(peer.ID, address, AddressSourceMDNS)
+			}
+		}
+	}
+
+	for _, node := range n.bootstrapMgr.GetNodes() {
+		add("", node, "")
+	}
+
+	return candidates, nil
+}
+
+// collectPeerLists asks every connected peer for its peer list concurrently
+// and returns the peers whose signed records it accepted. Peers that do not
+// answer in time are left out.
+func (n *Network) collectPeerLists() []PeerInfo {
+	peers := n.ConnectedPeers()
+
+	var infos []PeerInfo
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peerID string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(n.ctx, DefaultPeerListTimeout)
+			defer cancel()
+
+			msg := NewMessage(MessageTypePeerList, n.nodeID, n.peerListPayload())
+			reply, err := n.Request(ctx, peerID, msg)
+			if err != nil {
+				n.logger.Debugf("peer list request to %s failed: %v", peerID, err)
+				return
+			}
+
+			var payload PeerListPayload
+			if err := reply.DecodePayload(&payload); err != nil {
+				n.logger.Debugf("invalid peer list from %s: %v", peerID, err)
+				return
+			}
+
+			accepted := n.acceptPeerList(payload, peerID)
+			mu.Lock()
+			infos = append(infos, accepted...)
+			mu.Unlock()
+		}(peer.ID)
+	}
+	wg.Wait()
+
+	return infos
+}
+
+// dialCandidate connects to a peer found by discovery at whichever of its
+// addresses, or those we remember for it, answers first
+func (n *Network) dialCandidate(peer discovery.Peer) error {
+	if err := n.checkRedial(peer.ID); err != nil {
+		return err
+	}
+	var addresses []PeerAddress
+	if record, remembered := n.peerStore.Get(peer.ID); remembered && peer.ID != "" {
+		addresses = record.Addresses
+	}
+	for _, address := range peer.DialAddresses() {
+		addresses = append(addresses, PeerAddress{Address: address})
+	}
+	_, err := n.connectAny(n.ctx, addresses, "")
+	return err
+}
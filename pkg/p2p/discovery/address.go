@@ -0,0 +1,220 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// IPFamily is an IP protocol version
+type IPFamily string
+
+const (
+	// IPv4 selects IPv4 addresses
+	IPv4 IPFamily = "ipv4"
+	// IPv6 selects IPv6 addresses
+	IPv6 IPFamily = "ipv6"
+)
+
+// AddressPolicy says which IP versions a node uses and which one it prefers
+// when a peer is reachable over both
+type AddressPolicy struct {
+	Prefer    IPFamily
+	DualStack bool
+}
+
+// DefaultAddressPolicy uses both IP versions and prefers IPv4
+var DefaultAddressPolicy = AddressPolicy{Prefer: IPv4, DualStack: true}
+
+// Allows reports whether addresses of family may be used
+func (p AddressPolicy) Allows(family IPFamily) bool {
+	return p.DualStack || p.preferred() == family
+}
+
+// Network returns the Go network name, e.g. "tcp" or "tcp6", for listening
+// on the allowed IP versions of base ("tcp" or "udp")
+func (p AddressPolicy) Network(base string) string {
+	if p.DualStack {
+		return base
+	}
+	if p.preferred() == IPv6 {
+		return base + "6"
+	}
+	return base + "4"
+}
+
+// SelectAddress picks the address to dial from those a peer announced,
+// preferring the preferred family. IPv6 link-local addresses are skipped as
+// they cannot be dialed without a zone.
+func (p AddressPolicy) SelectAddress(v4, v6 []net.IP) string {
+	if addresses := p.SelectAddresses(v4, v6); len(addresses) > 0 {
+		return addresses[0]
+	}
+	return ""
+}
+
+// SelectAddresses lists the addresses a peer announced that may be dialed,
+// those of the preferred family first, skipping link-local IPv6 addresses
+// as SelectAddress does
+func (p AddressPolicy) SelectAddresses(v4, v6 []net.IP) []string {
+	var first, second []net.IP
+	if p.preferred() == IPv6 {
+		first, second = usable(v6), v4
+	} else {
+		first, second = v4, usable(v6)
+	}
+	if !p.DualStack {
+		second = nil
+	}
+
+	var addresses []string
+	for _, ip := range append(first, second...) {
+		addresses = append(addresses, ip.String())
+	}
+	return addresses
+}
+
+// AddressFamily returns the IP version of an ip:port address, or false for
+// hostnames
+func AddressFamily(address string) (IPFamily, bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", false
+	}
+	if ip.Unmap().Is4() {
+		return IPv4, true
+	}
+	return IPv6, true
+}
+
+// ipType returns the mDNS traffic to listen for
+func (p AddressPolicy) ipType() zeroconf.IPType {
+	if p.DualStack {
+		return zeroconf.IPv4AndIPv6
+	}
+	if p.preferred() == IPv6 {
+		return zeroconf.IPv6
+	}
+	return zeroconf.IPv4
+}
+
+// preferred returns the preferred family, IPv4 unless IPv6 is asked for
+func (p AddressPolicy) preferred() IPFamily {
+	if p.Prefer == IPv6 {
+		return IPv6
+	}
+	return IPv4
+}
+
+// usable drops IPv6 addresses that cannot be dialed without a zone
+func usable(ips []net.IP) []net.IP {
+	var result []net.IP
+	for _, ip := range ips {
+		if !ip.IsLinkLocalUnicast() {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+// HostPort returns the peer's dialable address, bracketing IPv6 literals
+func (p Peer) HostPort() string {
+	return net.JoinHostPort(p.Address, strconv.Itoa(p.Port))
+}
+
+// DialAddresses returns every address the peer may be dialed at, preferred
+// first
+func (p Peer) DialAddresses() []string {
+	if len(p.Addresses) > 0 {
+		return p.Addresses
+	}
+	return []string{p.HostPort()}
+}
+
+// DefaultPort is assumed for addresses given without a port, matching the
+// default P2P listen port
+const DefaultPort = 8080
+
+// NormalizeAddress returns address as a canonical host:port, so that the
+// forms an address may be written in compare equal: surrounding whitespace
+// is trimmed, IP addresses are written the short way with IPv6 literals
+// bracketed and IPv4-mapped ones unmapped, hostnames are lowercased without
+// a trailing dot, and ports lose leading zeros. A bare IP address gets
+// defaultPort. Hostnames are not resolved; see ResolveAddress.
+func NormalizeAddress(address string, defaultPort int) (string, error) {
+	address = strings.TrimSpace(address)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// A bare address, possibly an IPv6 literal with or without brackets
+		bare := address
+		if len(bare) > 1 && bare[0] == '[' && bare[len(bare)-1] == ']' {
+			bare = bare[1 : len(bare)-1]
+		}
+		if _, ipErr := netip.ParseAddr(bare); ipErr != nil {
+			return "", fmt.Errorf("invalid address %q: %w", address, err)
+		}
+		host, port = bare, strconv.Itoa(defaultPort)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		host = ip.Unmap().String()
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid address %q: missing host", address)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: bad port %q", address, port)
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(portNum, 10)), nil
+}
+
+// LookupFunc resolves a hostname to its IP addresses
+type LookupFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+// ResolveAddress normalizes address and replaces a hostname in it with one
+// of its IP addresses, chosen as SelectAddress does, so every name a node
+// is reached by maps to the same ip:port. A hostname that does not resolve
+// to an address the policy allows is an error.
+func (p AddressPolicy) ResolveAddress(ctx context.Context, address string, defaultPort int, lookup LookupFunc) (string, error) {
+	address, err := NormalizeAddress(address, defaultPort)
+	if err != nil {
+		return "", err
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return address, nil
+	}
+
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	selected := p.SelectAddress(v4, v6)
+	if selected == "" {
+		return "", fmt.Errorf("failed to resolve %s: no usable address among %v", host, ips)
+	}
+	return NormalizeAddress(net.JoinHostPort(selected, port), defaultPort)
+}
@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{"127.0.0.1:8080", "127.0.0.1:8080"},
+		{"[::1]:8080", "[::1]:8080"},
+		{"[0:0:0:0:0:0:0:1]:9000", "[::1]:9000"},
+		{"::1", "[::1]:8080"},
+		{"[::1]", "[::1]:8080"},
+		{"10.0.0.5", "10.0.0.5:8080"},
+		{"[fe80::1%eth0]:8080", "[fe80::1%eth0]:8080"},
+		{"node.example.com:9000", "node.example.com:9000"},
+		{"  127.0.0.1:8080\n", "127.0.0.1:8080"},
+		{"127.0.0.1:08080", "127.0.0.1:8080"},
+		{"[::ffff:127.0.0.1]:8080", "127.0.0.1:8080"},
+		{"[2001:DB8::1]", "[2001:db8::1]:8080"},
+		{"2001:db8:0:0:0:0:0:1", "[2001:db8::1]:8080"},
+		{"[FE80::1%eth0]:8080", "[fe80::1%eth0]:8080"},
+		{"Node.Example.COM:9000", "node.example.com:9000"},
+		{"node.example.com.:9000", "node.example.com:9000"},
+		{"LOCALHOST:8080", "localhost:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			normalized, err := NormalizeAddress(tt.address, 8080)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, normalized)
+		})
+	}
+
+	for _, invalid := range []string{"", "  ", "::1:8080:x", ":8080", ".:8080", "node.example.com", "127.0.0.1:99999", "127.0.0.1:", "127.0.0.1:-1", "[::1]:http"} {
+		_, err := NormalizeAddress(invalid, 8080)
+		assert.Error(t, err, "address %q", invalid)
+	}
+}
+
+func TestResolveAddress(t *testing.T) {
+	hosts := map[string][]net.IP{
+		"localhost":        {net.ParseIP("::1"), net.ParseIP("127.0.0.1")},
+		"v6.example.com":   {net.ParseIP("2001:db8::10")},
+		"node.example.com": {net.ParseIP("192.0.2.7")},
+	}
+	var lookups []string
+	lookup := func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups = append(lookups, host)
+		if ips, ok := hosts[host]; ok {
+			return ips, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	resolve := func(policy AddressPolicy, address string) (string, error) {
+		return policy.ResolveAddress(context.Background(), address, 8080, lookup)
+	}
+
+	// Every way of naming the local node ends up at one address
+	for _, address := range []string{"localhost:8080", "LocalHost.:8080", " localhost:8080\t", "127.0.0.1:8080", "[::ffff:127.0.0.1]:08080"} {
+		resolved, err := resolve(DefaultAddressPolicy, address)
+		require.NoError(t, err, address)
+		assert.Equal(t, "127.0.0.1:8080", resolved, address)
+	}
+	resolved, err := resolve(AddressPolicy{Prefer: IPv6, DualStack: true}, "localhost:9000")
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:9000", resolved)
+
+	resolved, err = resolve(DefaultAddressPolicy, "Node.Example.com:9000")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.7:9000", resolved)
+
+	// IP addresses are not looked up
+	lookups = nil
+	resolved, err = resolve(DefaultAddressPolicy, "[2001:DB8::1]:8080")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:8080", resolved)
+	assert.Empty(t, lookups)
+
+	// Unresolvable names, and names only reachable over a disallowed
+	// family, are errors
+	_, err = resolve(DefaultAddressPolicy, "missing.example.com:8080")
+	var dnsErr *net.DNSError
+	assert.ErrorAs(t, err, &dnsErr)
+	_, err = resolve(AddressPolicy{Prefer: IPv4}, "v6.example.com:8080")
+	assert.Error(t, err)
+	_, err = resolve(DefaultAddressPolicy, "node.example.com")
+	assert.Error(t, err, "a hostname needs a port")
+}
+
+func TestAddressPolicySelectAddress(t *testing.T) {
+	v4 := []net.IP{net.ParseIP("192.168.1.10")}
+	v6 := []net.IP{net.ParseIP("fe80::1"), net.ParseIP("2001:db8::10")}
+
+	assert.Equal(t, "192.168.1.10", DefaultAddressPolicy.SelectAddress(v4, v6))
+	assert.Equal(t, "2001:db8::10", AddressPolicy{Prefer: IPv6, DualStack: true}.SelectAddress(v4, v6))
+
+	// Dual-stack falls back to the other family; single-stack does not
+	assert.Equal(t, "2001:db8::10", DefaultAddressPolicy.SelectAddress(nil, v6))
+	assert.Equal(t, "", AddressPolicy{Prefer: IPv4}.SelectAddress(nil, v6))
+	assert.Equal(t, "", AddressPolicy{Prefer: IPv6}.SelectAddress(v4, nil))
+
+	// Link-local IPv6 cannot be dialed without a zone
+	assert.Equal(t, "", AddressPolicy{Prefer: IPv6}.SelectAddress(nil, v6[:1]))
+
+	// Every usable address can be listed, the preferred family first
+	assert.Equal(t, []string{"192.168.1.10", "2001:db8::10"}, DefaultAddressPolicy.SelectAddresses(v4, v6))
+	assert.Equal(t, []string{"2001:db8::10", "192.168.1.10"}, AddressPolicy{Prefer: IPv6, DualStack: true}.SelectAddresses(v4, v6))
+	assert.Equal(t, []string{"192.168.1.10"}, AddressPolicy{Prefer: IPv4}.SelectAddresses(v4, v6))
+}
+
+func TestAddressFamily(t *testing.T) {
+	for address, want := range map[string]IPFamily{
+		"192.168.1.10:8080":      IPv4,
+		"[::ffff:10.0.0.1]:8080": IPv4,
+		"[2001:db8::10]:8080":    IPv6,
+		"2001:db8::10":           IPv6,
+		"node.example.com:8080":  "",
+	} {
+		family, ok := AddressFamily(address)
+		assert.Equal(t, want, family, address)
+		assert.Equal(t, want != "", ok, address)
+	}
+}
+
+func TestAddressPolicyNetwork(t *testing.T) {
+	assert.Equal(t, "tcp", DefaultAddressPolicy.Network("tcp"))
+	assert.Equal(t, "tcp4", AddressPolicy{Prefer: IPv4}.Network("tcp"))
+	assert.Equal(t, "udp6", AddressPolicy{Prefer: IPv6}.Network("udp"))
+	assert.True(t, AddressPolicy{Prefer: IPv6}.Allows(IPv6))
+	assert.False(t, AddressPolicy{Prefer: IPv6}.Allows(IPv4))
+}
+
+func TestGetLocalIPs(t *testing.T) {
+	ipv4Only, err := GetLocalIPs(false)
+	require.NoError(t, err)
+	for _, ip := range ipv4Only {
+		assert.NotNil(t, net.ParseIP(ip).To4(), "%s is not IPv4", ip)
+	}
+
+	all, err := GetLocalIPs(true)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, len(all), len(ipv4Only))
+}
@@ -1,35 +1,118 @@
 package discovery
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"math"
+	"net"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
 )
 
-// BootstrapManager handles connections to bootstrap nodes
+// Defaults for sidelining bootstrap nodes that keep failing
+const (
+	// DefaultBootstrapSidelineAfter is how many attempts in a row to
+	// connect to a bootstrap node may fail before it is sidelined
+	DefaultBootstrapSidelineAfter = 3
+	// DefaultBootstrapSideline is how long a bootstrap node is first
+	// sidelined for. It is probed once when that ends, and each failed
+	// probe doubles the time, up to DefaultBootstrapMaxSideline.
+	DefaultBootstrapSideline    = time.Minute
+	DefaultBootstrapMaxSideline = 30 * time.Minute
+)
+
+// bootstrapLatencySmoothing is the weight of each new connect latency in a
+// bootstrap node's estimate
+const bootstrapLatencySmoothing = 0.25
+
+// BootstrapHealth describes how connecting to a bootstrap node has gone
+type BootstrapHealth struct {
+	Address   string `json:"address"`
+	Attempts  int    `json:"attempts"`
+	Successes int    `json:"successes"`
+	// ConsecutiveFailures counts the attempts that failed since the last
+	// success
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	// Latency is a moving average of how long successful connects took
+	Latency time.Duration `json:"latency"`
+	// Score rates the node from 0 to 1; healthier nodes are tried first
+	Score          float64   `json:"score"`
+	SidelinedUntil time.Time `json:"sidelined_until,omitempty"`
+	Sidelined      bool      `json:"sidelined"`
+	PeerID         string    `json:"peer_id,omitempty"`
+}
+
+// bootstrapHealth tracks how connecting to one bootstrap node has gone
+type bootstrapHealth struct {
+	attempts       int
+	successes      int
+	failures       int // in a row
+	lastSuccess    time.Time
+	lastError      string
+	latency        time.Duration
+	sideline       time.Duration // how long the node was last sidelined for
+	sidelinedUntil time.Time
+}
+
+// score rates the node from 0 to 1 by its success rate, counting one
+// success and one failure up front so that an untried node rates 0.5, and
+// lowers it the slower the node connects
+func (h *bootstrapHealth) score() float64 {
+	rate := float64(h.successes+1) / float64(h.attempts+2)
+	return rate / (1 + h.latency.Seconds())
+}
+
+// BootstrapManager handles connections to bootstrap nodes. It tries the
+// healthiest ones first and sidelines those that keep failing for a while.
 type BootstrapManager struct {
 	nodes      []string
-	connected  map[string]bool
+	connected  map[string]string // bootstrap node -> peer ID reached there
+	health     map[string]*bootstrapHealth
+	rotation   int // where in nodes the next round starts
 	mu         sync.RWMutex
 	maxRetries int
 	retryDelay time.Duration
+
+	sidelineAfter int
+	sidelineFor   time.Duration
+	maxSideline   time.Duration
+	now           func() time.Time
 }
 
-// NewBootstrapManager creates a new bootstrap manager
+// NewBootstrapManager creates a new bootstrap manager. Nodes are kept
+// normalized, and listed once however often they are given.
 func NewBootstrapManager(nodes []string) *BootstrapManager {
-	return &BootstrapManager{
-		nodes:      nodes,
-		connected:  make(map[string]bool),
-		maxRetries: 3,
-		retryDelay: 5 * time.Second,
+	b := &BootstrapManager{
+		connected:     make(map[string]string),
+		health:        make(map[string]*bootstrapHealth),
+		maxRetries:    3,
+		retryDelay:    5 * time.Second,
+		sidelineAfter: DefaultBootstrapSidelineAfter,
+		sidelineFor:   DefaultBootstrapSideline,
+		maxSideline:   DefaultBootstrapMaxSideline,
+		now:           time.Now,
+	}
+	for _, node := range nodes {
+		b.AddNode(node)
 	}
+	return b
 }
 
-// AddNode adds a bootstrap node to the list
+// AddNode adds a bootstrap node to the list unless it is listed already,
+// possibly written another way
 func (b *BootstrapManager) AddNode(node string) {
+	// An address that cannot be normalized is kept for the dial to report
+	if normalized, err := NormalizeAddress(node, DefaultPort); err == nil {
+		node = normalized
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	
@@ -51,12 +134,16 @@ func (b *BootstrapManager) GetNodes() []string {
 	return nodes
 }
 
-// ConnectToBootstrapNodes attempts to connect to all bootstrap nodes
-func (b *BootstrapManager) ConnectToBootstrapNodes(ctx context.Context, connectFunc func(string) error) error {
-	b.mu.RLock()
-	nodes := make([]string, len(b.nodes))
-	copy(nodes, b.nodes)
-	b.mu.RUnlock()
+// ConnectFunc connects to a node and returns the ID of the peer reached
+type ConnectFunc func(ctx context.Context, address string) (string, error)
+
+// ConnectToBootstrapNodes attempts to connect to every bootstrap node that
+// is not sidelined, in the order attemptOrder gives
+func (b *BootstrapManager) ConnectToBootstrapNodes(ctx context.Context, connectFunc ConnectFunc) error {
+	nodes, sidelined := b.attemptOrder()
+	if len(nodes) == 0 && sidelined > 0 {
+		return fmt.Errorf("all %d bootstrap nodes are sidelined", sidelined)
+	}
 
 	var lastErr error
 	for _, node := range nodes {
@@ -69,30 +156,152 @@ func (b *BootstrapManager) ConnectToBootstrapNodes(ctx context.Context, connectF
 	return lastErr
 }
 
-// connectWithRetry attempts to connect to a node with retry logic
-func (b *BootstrapManager) connectWithRetry(ctx context.Context, node string, connectFunc func(string) error) error {
+// attemptOrder returns the bootstrap nodes to try now, healthiest first,
+// and how many are sidelined. Nodes about as healthy, with scores in the
+// same tenth, take turns going first: each round starts one node further
+// along the list.
+func (b *BootstrapManager) attemptOrder() (nodes []string, sidelined int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.nodes) == 0 {
+		return nil, 0
+	}
+
+	now := b.now()
+	start := b.rotation % len(b.nodes)
+	b.rotation++
+	tiers := make(map[string]float64)
+	for i := range b.nodes {
+		node := b.nodes[(start+i)%len(b.nodes)]
+		health := b.nodeHealth(node)
+		if now.Before(health.sidelinedUntil) {
+			sidelined++
+			continue
+		}
+		nodes = append(nodes, node)
+		tiers[node] = math.Floor(health.score() * 10)
+	}
+	slices.SortStableFunc(nodes, func(a, c string) int {
+		return cmp.Compare(tiers[c], tiers[a])
+	})
+	return nodes, sidelined
+}
+
+// nodeHealth returns the health of node, tracking it from now on if it was
+// not. b.mu must be held.
+func (b *BootstrapManager) nodeHealth(node string) *bootstrapHealth {
+	health, ok := b.health[node]
+	if !ok {
+		health = &bootstrapHealth{}
+		b.health[node] = health
+	}
+	return health
+}
+
+// recordSuccess records that connecting to node reached peerID and took
+// latency, which ends any sidelining
+func (b *BootstrapManager) recordSuccess(node, peerID string, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health := b.nodeHealth(node)
+	health.attempts++
+	health.successes++
+	health.failures = 0
+	health.lastSuccess = b.now()
+	if health.latency == 0 {
+		health.latency = latency
+	} else {
+		health.latency += time.Duration(bootstrapLatencySmoothing * float64(latency-health.latency))
+	}
+	health.sideline = 0
+	health.sidelinedUntil = time.Time{}
+	b.connected[node] = peerID
+}
+
+// recordFailure records a failed attempt to connect to node and reports
+// whether the node is sidelined for it
+func (b *BootstrapManager) recordFailure(node string, err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health := b.nodeHealth(node)
+	health.attempts++
+	health.failures++
+	health.lastError = err.Error()
+	if health.failures < b.sidelineAfter {
+		return false
+	}
+	if health.sideline == 0 {
+		health.sideline = b.sidelineFor
+	} else {
+		health.sideline = min(2*health.sideline, b.maxSideline)
+	}
+	health.sidelinedUntil = b.now().Add(health.sideline)
+	return true
+}
+
+// Health describes how connecting to each bootstrap node has gone, in the
+// order the nodes were given
+func (b *BootstrapManager) Health() []BootstrapHealth {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := b.now()
+	report := make([]BootstrapHealth, 0, len(b.nodes))
+	for _, node := range b.nodes {
+		health, ok := b.health[node]
+		if !ok {
+			health = &bootstrapHealth{}
+		}
+		report = append(report, BootstrapHealth{
+			Address:             node,
+			Attempts:            health.attempts,
+			Successes:           health.successes,
+			ConsecutiveFailures: health.failures,
+			LastSuccess:         health.lastSuccess,
+			LastError:           health.lastError,
+			Latency:             health.latency,
+			Score:               health.score(),
+			SidelinedUntil:      health.sidelinedUntil,
+			Sidelined:           now.Before(health.sidelinedUntil),
+			PeerID:              b.connected[node],
+		})
+	}
+	return report
+}
+
+// connectWithRetry attempts to connect to a node with retry logic, giving
+// up early once the node is sidelined. Attempts cut short by ctx do not
+// count against the node.
+func (b *BootstrapManager) connectWithRetry(ctx context.Context, node string, connectFunc ConnectFunc) error {
 	var lastErr error
 	
 	for i := 0; i < b.maxRetries; i++ {
-		select {
-		case <-ctx.Done():
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(b.retryDelay):
+			}
+		} else if ctx.Err() != nil {
 			return ctx.Err()
-		default:
 		}
 
-		if err := connectFunc(node); err != nil {
-			lastErr = err
-			if i < b.maxRetries-1 {
-				time.Sleep(b.retryDelay)
-				continue
-			}
-		} else {
-			// Mark as connected
-			b.mu.Lock()
-			b.connected[node] = true
-			b.mu.Unlock()
+		started := b.now()
+		peerID, err := connectFunc(ctx, node)
+		if err == nil {
+			// Mark as connected to the peer the handshake reached
+			b.recordSuccess(node, peerID, b.now().Sub(started))
 			return nil
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		lastErr = err
+		if b.recordFailure(node, err) {
+			return fmt.Errorf("bootstrap node %s sidelined after failing repeatedly: %w", node, lastErr)
+		}
 	}
 
 	return fmt.Errorf("failed to connect to bootstrap node %s after %d attempts: %w", node, b.maxRetries, lastErr)
@@ -100,21 +309,41 @@ func (b *BootstrapManager) connectWithRetry(ctx context.Context, node string, co
 
 // IsConnected returns whether we're connected to a specific bootstrap node
 func (b *BootstrapManager) IsConnected(node string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, connected := b.connected[node]
+	return connected
+}
+
+// PeerID returns the ID of the peer reached at a bootstrap node, or "" if we
+// are not connected to it
+func (b *BootstrapManager) PeerID(node string) string {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	return b.connected[node]
 }
 
+// MarkDisconnected forgets the bootstrap nodes at which peerID was reached,
+// so they are no longer reported as connected
+func (b *BootstrapManager) MarkDisconnected(peerID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for node, connectedPeer := range b.connected {
+		if connectedPeer == peerID {
+			delete(b.connected, node)
+		}
+	}
+}
+
 // GetConnectedNodes returns all currently connected bootstrap nodes
 func (b *BootstrapManager) GetConnectedNodes() []string {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	
 	var connectedNodes []string
-	for node, isConnected := range b.connected {
-		if isConnected {
-			connectedNodes = append(connectedNodes, node)
-		}
+	for node := range b.connected {
+		connectedNodes = append(connectedNodes, node)
 	}
 	return connectedNodes
 }
@@ -143,130 +372,100 @@ func (p *PeerExchange) SetConnectFunc(connectFunc func(Peer) error) {
 	p.peerConnect = connectFunc
 }
 
+// ExchangeResult summarises one round of peer exchange
+type ExchangeResult struct {
+	Candidates int
+	Attempts   int
+	Connected  int
+}
+
 // ExchangePeers exchanges peer information with connected nodes
 func (p *PeerExchange) ExchangePeers(ctx context.Context) error {
+	_, err := p.Exchange(ctx, p.maxPeers)
+	return err
+}
+
+// Exchange discovers candidate peers and connects to at most limit of them,
+// reporting how many were found, tried and connected
+func (p *PeerExchange) Exchange(ctx context.Context, limit int) (ExchangeResult, error) {
+	var result ExchangeResult
 	if p.peerDiscovery == nil || p.peerConnect == nil {
-		return fmt.Errorf("discovery and connect functions must be set")
+		return result, fmt.Errorf("discovery and connect functions must be set")
 	}
 
 	peers, err := p.peerDiscovery()
 	if err != nil {
-		return fmt.Errorf("failed to discover peers: %w", err)
+		return result, fmt.Errorf("failed to discover peers: %w", err)
 	}
+	result.Candidates = len(peers)
 
-	connectedCount := 0
 	for _, peer := range peers {
-		if connectedCount >= p.maxPeers {
+		if result.Connected >= limit {
 			break
 		}
 
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return result, ctx.Err()
 		default:
 		}
 
+		result.Attempts++
 		if err := p.peerConnect(peer); err != nil {
 			// Log error but continue with other peers
 			continue
 		}
-		connectedCount++
+		result.Connected++
 	}
 
-	return nil
+	return result, nil
 }
 
-// DiscoverLocalPeers uses mDNS to discover local peers
-func DiscoverLocalPeers(ctx context.Context, timeout time.Duration) ([]Peer, error) {
-	resolver, err := zeroconf.NewResolver(nil)
+// DiscoverLocalPeers uses mDNS to discover local peers advertising service,
+// choosing each peer's address according to policy
+func DiscoverLocalPeers(ctx context.Context, timeout time.Duration, service Service, policy AddressPolicy) ([]Peer, error) {
+	resolver, err := zeroconf.NewResolver(zeroconf.SelectIPTraffic(policy.ipType()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create resolver: %w", err)
 	}
 
-	entries := make(chan *zeroconf.ServiceEntry)
-	var peers []Peer
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-
-	// Start browsing
+	// Browsing runs in the background and closes entries once ctx ends
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, service.Name, service.Domain, entries); err != nil {
+		return nil, fmt.Errorf("failed to browse for mDNS services: %w", err)
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := resolver.Browse(ctx, ServiceName, "local.", entries)
-		if err != nil {
-			return
-		}
-	}()
-
-	// Process discovered entries
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case entry := <-entries:
-				peer := processServiceEntry(entry)
-				if peer != nil {
-					mu.Lock()
-					peers = append(peers, *peer)
-					mu.Unlock()
-				}
-			}
+	var peers []Peer
+	for entry := range entries {
+		if peer := processServiceEntry(entry, policy); peer != nil {
+			peers = append(peers, *peer)
 		}
-	}()
-
-	// Wait for timeout or context cancellation
-	<-ctx.Done()
-	wg.Wait()
-
+	}
 	return peers, nil
 }
 
 // processServiceEntry converts a service entry to a Peer
-func processServiceEntry(entry *zeroconf.ServiceEntry) *Peer {
-	if len(entry.AddrIPv4) == 0 && len(entry.AddrIPv6) == 0 {
+func processServiceEntry(entry *zeroconf.ServiceEntry, policy AddressPolicy) *Peer {
+	addresses := policy.SelectAddresses(entry.AddrIPv4, entry.AddrIPv6)
+	if len(addresses) == 0 {
 		return nil
 	}
 
-	var address string
-	if len(entry.AddrIPv4) > 0 {
-		address = entry.AddrIPv4[0].String()
-	} else {
-		address = entry.AddrIPv6[0].String()
-	}
-
-	// Extract node ID from TXT records if available
-	var nodeID string
-	for _, txt := range entry.Text {
-		if txtParts := splitNodeID(txt); len(txtParts) == 2 && txtParts[0] == "node_id" {
-			nodeID = txtParts[1]
-			break
-		}
-	}
-
-	return &Peer{
-		ID:       nodeID,
-		Address:  address,
+	// The port in TXT records, if any, is where the node listens; the SRV
+	// port is the fallback for nodes that predate it
+	peer := &Peer{
+		Address:  addresses[0],
 		Port:     entry.Port,
 		Hostname: entry.HostName,
 		TTL:      time.Duration(entry.TTL) * time.Second,
 	}
-}
-
-// splitNodeID splits a "key=value" string
-func splitNodeID(s string) []string {
-	parts := make([]string, 2)
-	for i, c := range s {
-		if c == '=' {
-			parts[0] = s[:i]
-			parts[1] = s[i+1:]
-			return parts
+	parseTXT(entry.Text, peer)
+	if len(addresses) > 1 {
+		for _, address := range addresses {
+			peer.Addresses = append(peer.Addresses, net.JoinHostPort(address, strconv.Itoa(peer.Port)))
 		}
 	}
-	return []string{}
-}
\ No newline at end of file
+	return peer
+}
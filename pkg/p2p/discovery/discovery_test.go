@@ -2,9 +2,12 @@ package discovery
 
 import (
 	"context"
+	"errors"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/grandcat/zeroconf"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -23,6 +26,194 @@ func TestBootstrapManager(t *testing.T) {
 	assert.Contains(t, updatedNodes, "192.168.1.3:8080")
 }
 
+func TestBootstrapManagerDeduplicates(t *testing.T) {
+	manager := NewBootstrapManager([]string{"10.0.0.1:8080", " 10.0.0.1", "Node.Example.com:9000", "not an address"})
+	manager.AddNode("node.example.com.:9000")
+	manager.AddNode("[::ffff:10.0.0.1]:8080")
+	manager.AddNode("[2001:DB8::1]:8080")
+	manager.AddNode("[2001:db8:0::1]:8080")
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "node.example.com:9000", "not an address", "[2001:db8::1]:8080"}, manager.GetNodes())
+}
+
+func TestBootstrapManagerTracksPeers(t *testing.T) {
+	manager := NewBootstrapManager([]string{"10.0.0.1:8080", "10.0.0.2:8080"})
+	manager.retryDelay = time.Millisecond
+
+	attempts := make(map[string]int)
+	err := manager.ConnectToBootstrapNodes(context.Background(), func(ctx context.Context, address string) (string, error) {
+		attempts[address]++
+		if address == "10.0.0.2:8080" {
+			return "", errors.New("handshake rejected")
+		}
+		return "peer-a", nil
+	})
+
+	// Only a completed connection counts, and failures are retried
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts["10.0.0.1:8080"])
+	assert.Equal(t, manager.maxRetries, attempts["10.0.0.2:8080"])
+	assert.Equal(t, []string{"10.0.0.1:8080"}, manager.GetConnectedNodes())
+	assert.Equal(t, "peer-a", manager.PeerID("10.0.0.1:8080"))
+	assert.False(t, manager.IsConnected("10.0.0.2:8080"))
+
+	manager.MarkDisconnected("peer-a")
+	assert.False(t, manager.IsConnected("10.0.0.1:8080"))
+	assert.Empty(t, manager.GetConnectedNodes())
+}
+
+// fakeBootstrapClock is a clock for a BootstrapManager that only moves when
+// told to
+type fakeBootstrapClock struct {
+	now time.Time
+}
+
+func (c *fakeBootstrapClock) Now() time.Time { return c.now }
+
+// newTestBootstrapManager returns a manager of nodes that retries at once
+// and reads its time from the returned clock
+func newTestBootstrapManager(nodes ...string) (*BootstrapManager, *fakeBootstrapClock) {
+	clock := &fakeBootstrapClock{now: time.Unix(1_700_000_000, 0)}
+	manager := NewBootstrapManager(nodes)
+	manager.retryDelay = time.Millisecond
+	manager.now = clock.Now
+	return manager, clock
+}
+
+// bootstrapRound connects to the manager's nodes once, failing at the
+// nodes in failing, and returns the order they were tried in
+func bootstrapRound(manager *BootstrapManager, failing ...string) []string {
+	var tried []string
+	manager.ConnectToBootstrapNodes(context.Background(), func(ctx context.Context, address string) (string, error) {
+		tried = append(tried, address)
+		for _, node := range failing {
+			if node == address {
+				return "", errors.New("connection refused")
+			}
+		}
+		return "peer-" + address, nil
+	})
+	return tried
+}
+
+func TestBootstrapManagerRotatesHealthyNodes(t *testing.T) {
+	manager, _ := newTestBootstrapManager("10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080")
+
+	// Nodes equally healthy take turns going first
+	var first []string
+	for range 3 {
+		tried := bootstrapRound(manager)
+		require.Len(t, tried, 3)
+		first = append(first, tried[0])
+	}
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}, first)
+}
+
+func TestBootstrapManagerOrdersByHealth(t *testing.T) {
+	manager, clock := newTestBootstrapManager("10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080")
+	manager.sidelineAfter = 100
+	manager.maxRetries = 1
+
+	// The first node always fails and the third connects slowly
+	round := func() []string {
+		var tried []string
+		manager.ConnectToBootstrapNodes(context.Background(), func(ctx context.Context, address string) (string, error) {
+			tried = append(tried, address)
+			switch address {
+			case "10.0.0.1:8080":
+				return "", errors.New("connection refused")
+			case "10.0.0.3:8080":
+				clock.now = clock.now.Add(500 * time.Millisecond)
+			}
+			return "peer", nil
+		})
+		return tried
+	}
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}, round())
+
+	// Whichever node a round starts at, the fast reliable one goes first
+	// and the failing one last
+	for range 4 {
+		assert.Equal(t, []string{"10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.1:8080"}, round())
+	}
+
+	health := manager.Health()
+	require.Len(t, health, 3)
+	assert.Equal(t, "10.0.0.1:8080", health[0].Address)
+	assert.Equal(t, 5, health[0].Attempts)
+	assert.Zero(t, health[0].Successes)
+	assert.Equal(t, 5, health[0].ConsecutiveFailures)
+	assert.Equal(t, "connection refused", health[0].LastError)
+	assert.False(t, health[0].Sidelined)
+	assert.Equal(t, 5, health[2].Successes)
+	assert.Equal(t, 500*time.Millisecond, health[2].Latency)
+	assert.Greater(t, health[1].Score, health[2].Score)
+	assert.Greater(t, health[2].Score, health[0].Score)
+}
+
+func TestBootstrapManagerSidelinesFailingNodes(t *testing.T) {
+	manager, clock := newTestBootstrapManager("10.0.0.1:8080", "10.0.0.2:8080")
+	dead := "10.0.0.1:8080"
+
+	// A node failing every retry is sidelined
+	tried := bootstrapRound(manager, dead)
+	assert.Equal(t, []string{dead, dead, dead, "10.0.0.2:8080"}, tried)
+	health := manager.Health()[0]
+	assert.True(t, health.Sidelined)
+	assert.Equal(t, 3, health.ConsecutiveFailures)
+	assert.Equal(t, clock.now.Add(DefaultBootstrapSideline), health.SidelinedUntil)
+
+	// and left out until its sidelining ends
+	assert.Equal(t, []string{"10.0.0.2:8080"}, bootstrapRound(manager, dead))
+	clock.now = clock.now.Add(DefaultBootstrapSideline)
+
+	// A failed re-probe sidelines it again for twice as long, without
+	// retries
+	tried = bootstrapRound(manager, dead)
+	assert.Equal(t, 1, countOf(tried, dead))
+	assert.Equal(t, clock.now.Add(2*DefaultBootstrapSideline), manager.Health()[0].SidelinedUntil)
+	clock.now = clock.now.Add(2 * DefaultBootstrapSideline)
+
+	// A successful one ends the sidelining
+	tried = bootstrapRound(manager)
+	assert.Equal(t, 1, countOf(tried, dead))
+	health = manager.Health()[0]
+	assert.False(t, health.Sidelined)
+	assert.Zero(t, health.ConsecutiveFailures)
+	assert.Equal(t, clock.now, health.LastSuccess)
+	assert.Equal(t, "peer-"+dead, health.PeerID)
+
+	// With every node sidelined there is nothing to try
+	bootstrapRound(manager, "10.0.0.1:8080", "10.0.0.2:8080")
+	err := manager.ConnectToBootstrapNodes(context.Background(), func(ctx context.Context, address string) (string, error) {
+		t.Fatalf("sidelined node %s dialed", address)
+		return "", nil
+	})
+	assert.ErrorContains(t, err, "sidelined")
+}
+
+func TestBootstrapManagerIgnoresCancelledAttempts(t *testing.T) {
+	manager, _ := newTestBootstrapManager("10.0.0.1:8080")
+	ctx, cancel := context.WithCancel(context.Background())
+	err := manager.ConnectToBootstrapNodes(ctx, func(ctx context.Context, address string) (string, error) {
+		cancel()
+		return "", ctx.Err()
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Zero(t, manager.Health()[0].Attempts)
+}
+
+// countOf counts the times s occurs in list
+func countOf(list []string, s string) int {
+	count := 0
+	for _, item := range list {
+		if item == s {
+			count++
+		}
+	}
+	return count
+}
+
 func TestPeerExchange(t *testing.T) {
 	pe := NewPeerExchange(10)
 
@@ -39,12 +230,42 @@ func TestDiscoverLocalPeers(t *testing.T) {
 	defer cancel()
 
 	// This test will likely return no peers in a test environment
-	peers, err := DiscoverLocalPeers(ctx, 1*time.Second)
+	peers, err := DiscoverLocalPeers(ctx, 1*time.Second, DefaultService, DefaultAddressPolicy)
 	assert.NoError(t, err)
 	// In a test environment, we may not discover any peers
 	_ = peers
 }
 
+func TestInstanceName(t *testing.T) {
+	assert.Equal(t, "synapse-node-3f9a0c21", InstanceName("synapse-node", "3f9a0c21d4e5b6a7"))
+	assert.Equal(t, "synapse-node-abc", InstanceName("synapse-node", "abc"))
+	assert.Equal(t, "synapse-node", InstanceName("synapse-node", ""))
+}
+
+func TestMDNSDefaultNamesDoNotCollide(t *testing.T) {
+	ctx := context.Background()
+	service := Service{Name: "_synapse-test._tcp", Domain: DefaultDomain}
+
+	// Two nodes left with the default name on one host
+	first := NewMDNSDiscoverer(InstanceName("synapse-node", "1111aaaa2222"), 18081, []string{"node_id=1111aaaa2222"})
+	first.SetService(service)
+	require.NoError(t, first.Start(ctx))
+	defer first.Stop()
+
+	second := NewMDNSDiscoverer(InstanceName("synapse-node", "3333bbbb4444"), 18082, []string{"node_id=3333bbbb4444"})
+	second.SetService(service)
+	require.NoError(t, second.Start(ctx))
+	defer second.Stop()
+
+	// An instance name already advertised is refused rather than shared
+	clash := NewMDNSDiscoverer(InstanceName("synapse-node", "1111aaaa2222"), 18083, nil)
+	clash.SetService(service)
+	clash.probe = time.Second
+	err := clash.Start(ctx)
+	assert.ErrorIs(t, err, ErrNameConflict)
+	clash.Stop()
+}
+
 func TestPeerExchangeExchangePeers(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -68,4 +289,60 @@ func TestPeerExchangeExchangePeers(t *testing.T) {
 	err := pe.ExchangePeers(ctx)
 	assert.NoError(t, err)
 	assert.Greater(t, connectCount, 0)
-}
\ No newline at end of file
+}
+func TestTXTRecords(t *testing.T) {
+	advertised := Peer{
+		ID:           "node-a",
+		Port:         9000,
+		Version:      "1.2.0",
+		MinVersion:   "1.0.0",
+		Capabilities: []string{"encryption", "relay", "quic"},
+		NetworkID:    "0123456789abcdef",
+	}
+	records := TXTRecords(advertised)
+	assert.Contains(t, records, "caps=encryption,relay,quic")
+
+	var parsed Peer
+	parseTXT(records, &parsed)
+	assert.Equal(t, advertised, parsed)
+
+	// Capabilities that do not fit in a record are dropped whole
+	long := make([]string, 100)
+	for i := range long {
+		long[i] = "capability"
+	}
+	for _, record := range TXTRecords(Peer{ID: "node-a", Capabilities: long}) {
+		assert.LessOrEqual(t, len(record), maxTXTRecord)
+	}
+}
+
+func TestProcessServiceEntry(t *testing.T) {
+	entry := zeroconf.NewServiceEntry("synapse-node-a", ServiceName, DefaultDomain)
+	entry.AddrIPv4 = []net.IP{net.ParseIP("192.168.1.20")}
+	entry.Port = 8080
+
+	// Older nodes only advertise their ID, and the SRV port is used
+	entry.Text = []string{"node_id=node-a"}
+	peer := processServiceEntry(entry, DefaultAddressPolicy)
+	require.NotNil(t, peer)
+	assert.Equal(t, "node-a", peer.ID)
+	assert.Equal(t, 8080, peer.Port)
+	assert.Empty(t, peer.Version)
+	assert.Empty(t, peer.Capabilities)
+
+	// Unknown keys and malformed values are ignored
+	entry.Text = []string{"node_id=node-a", "port=9000", "version=1.1.0", "colour=blue", "garbage", "port=none"}
+	peer = processServiceEntry(entry, DefaultAddressPolicy)
+	require.NotNil(t, peer)
+	assert.Equal(t, 9000, peer.Port)
+	assert.Equal(t, "1.1.0", peer.Version)
+	assert.Equal(t, "192.168.1.20:9000", peer.HostPort())
+	assert.Equal(t, []string{"192.168.1.20:9000"}, peer.DialAddresses())
+
+	// A node reachable over both IP versions can be dialed at either
+	entry.AddrIPv6 = []net.IP{net.ParseIP("2001:db8::20")}
+	peer = processServiceEntry(entry, DefaultAddressPolicy)
+	require.NotNil(t, peer)
+	assert.Equal(t, "192.168.1.20", peer.Address)
+	assert.Equal(t, []string{"192.168.1.20:9000", "[2001:db8::20]:9000"}, peer.DialAddresses())
+}
@@ -2,17 +2,57 @@ package discovery
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
 )
 
-// ServiceName is the mDNS service name for Synapse nodes
-const ServiceName = "_synapse._tcp"
+const (
+	// ServiceName is the default mDNS service name for Synapse nodes
+	ServiceName = "_synapse._tcp"
+	// DefaultDomain is the default mDNS domain
+	DefaultDomain = "local."
+
+	// instanceSuffixLen is how much of the node ID instance names carry
+	instanceSuffixLen = 8
+	// defaultProbeTimeout is how long Start listens for another node
+	// advertising our instance name before taking it
+	defaultProbeTimeout = 250 * time.Millisecond
+)
+
+// ErrNameConflict is returned by Start when another node already
+// advertises our instance name
+var ErrNameConflict = errors.New("mDNS instance name already in use")
+
+// Service is the mDNS service nodes advertise and browse for. Nodes only
+// find each other when they use the same one.
+type Service struct {
+	Name   string
+	Domain string
+}
+
+// DefaultService is the service nodes use unless configured otherwise
+var DefaultService = Service{Name: ServiceName, Domain: DefaultDomain}
+
+// InstanceName returns the mDNS instance name of a node: its name followed
+// by the start of its ID, so nodes sharing a name do not collide
+func InstanceName(name, nodeID string) string {
+	if len(nodeID) > instanceSuffixLen {
+		nodeID = nodeID[:instanceSuffixLen]
+	}
+	if nodeID == "" {
+		return name
+	}
+	return name + "-" + nodeID
+}
 
 // Peer represents a discovered peer
 type Peer struct {
@@ -21,6 +61,95 @@ type Peer struct {
 	Port     int
 	Hostname string
 	TTL      time.Duration
+	// Addresses lists every host:port the peer may be dialed at, preferred
+	// first, when it has more than Address; it starts with HostPort
+	Addresses []string
+
+	// Advertised over mDNS; empty for peers found otherwise and for nodes
+	// that predate them
+	Version      string
+	MinVersion   string
+	Capabilities []string
+	// NetworkID identifies the private network the peer belongs to, if any
+	NetworkID string
+}
+
+// TXT record keys nodes advertise themselves with
+const (
+	txtNodeID       = "node_id"
+	txtPort         = "port"
+	txtVersion      = "version"
+	txtMinVersion   = "min_version"
+	txtCapabilities = "caps"
+	txtNetwork      = "network"
+
+	// maxTXTRecord is the longest string a TXT record may hold
+	maxTXTRecord = 255
+)
+
+// TXTRecords returns the TXT records advertising peer. Capabilities that do
+// not fit in one record are left out; peers learn them from HELLO.
+func TXTRecords(peer Peer) []string {
+	records := []string{txtNodeID + "=" + peer.ID}
+	if peer.Port > 0 {
+		records = append(records, txtPort+"="+strconv.Itoa(peer.Port))
+	}
+	if peer.Version != "" {
+		records = append(records, txtVersion+"="+peer.Version)
+	}
+	if peer.MinVersion != "" {
+		records = append(records, txtMinVersion+"="+peer.MinVersion)
+	}
+	if len(peer.Capabilities) > 0 {
+		caps := txtCapabilities + "="
+		for i, capability := range peer.Capabilities {
+			entry := capability
+			if i > 0 {
+				entry = "," + capability
+			}
+			if len(caps)+len(entry) > maxTXTRecord {
+				break
+			}
+			caps += entry
+		}
+		records = append(records, caps)
+	}
+	if peer.NetworkID != "" {
+		records = append(records, txtNetwork+"="+peer.NetworkID)
+	}
+	return records
+}
+
+// parseTXT fills in what TXT records advertise about peer. Keys it does not
+// know and malformed values are ignored.
+func parseTXT(records []string, peer *Peer) {
+	for _, record := range records {
+		key, value, found := strings.Cut(record, "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case txtNodeID:
+			peer.ID = value
+		case txtPort:
+			if port, err := strconv.Atoi(value); err == nil && port > 0 && port <= 65535 {
+				peer.Port = port
+			}
+		case txtVersion:
+			peer.Version = value
+		case txtMinVersion:
+			peer.MinVersion = value
+		case txtCapabilities:
+			peer.Capabilities = nil
+			for _, capability := range strings.Split(value, ",") {
+				if capability != "" {
+					peer.Capabilities = append(peer.Capabilities, capability)
+				}
+			}
+		case txtNetwork:
+			peer.NetworkID = value
+		}
+	}
 }
 
 // MDNSDiscoverer handles mDNS-based peer discovery
@@ -30,115 +159,170 @@ type MDNSDiscoverer struct {
 	instance    string
 	port        int
 	txtRecords  []string
+	policy      AddressPolicy
+	probe       time.Duration
 	server      *zeroconf.Server
-	stopCh      chan struct{}
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	stopOnce    sync.Once
 }
 
-// NewMDNSDiscoverer creates a new mDNS discoverer
+// NewMDNSDiscoverer creates a new mDNS discoverer advertising instance,
+// which should come from InstanceName
 func NewMDNSDiscoverer(instance string, port int, txtRecords []string) *MDNSDiscoverer {
 	return &MDNSDiscoverer{
-		serviceName: ServiceName,
-		domain:      "local.",
+		serviceName: DefaultService.Name,
+		domain:      DefaultService.Domain,
 		instance:    instance,
 		port:        port,
 		txtRecords:  txtRecords,
-		stopCh:      make(chan struct{}),
+		policy:      DefaultAddressPolicy,
+		probe:       defaultProbeTimeout,
 	}
 }
 
-// Start begins advertising the service and discovering peers
+// SetService sets the service advertised and browsed for. It must be
+// called before Start.
+func (m *MDNSDiscoverer) SetService(service Service) {
+	m.serviceName = service.Name
+	m.domain = service.Domain
+}
+
+// SetAddressPolicy sets the IP versions advertised and browsed for. It must
+// be called before Start.
+func (m *MDNSDiscoverer) SetAddressPolicy(policy AddressPolicy) {
+	m.policy = policy
+}
+
+// Start begins advertising the service and discovering peers. It fails
+// with ErrNameConflict if another node already advertises our instance.
 func (m *MDNSDiscoverer) Start(ctx context.Context) error {
-	// Start the mDNS server to advertise our service
-	server, err := zeroconf.Register(m.instance, m.serviceName, m.domain, m.port, m.txtRecords, nil)
+	if err := m.checkConflict(ctx); err != nil {
+		return err
+	}
+
+	// Start the mDNS server to advertise our service with A and AAAA records
+	// for every allowed IP version
+	server, err := m.register()
 	if err != nil {
 		return fmt.Errorf("failed to register mDNS service: %w", err)
 	}
+	resolver, err := zeroconf.NewResolver(zeroconf.SelectIPTraffic(m.policy.ipType()))
+	if err != nil {
+		server.Shutdown()
+		return fmt.Errorf("failed to create mDNS resolver: %w", err)
+	}
+
+	// Browsing runs in the background and closes entries once ctx ends
+	ctx, cancel := context.WithCancel(ctx)
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, m.serviceName, m.domain, entries); err != nil {
+		cancel()
+		server.Shutdown()
+		return fmt.Errorf("failed to browse for mDNS services: %w", err)
+	}
 	m.server = server
+	m.cancel = cancel
 
-	// Start discovery in a separate goroutine
-	go m.discover(ctx)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.discover(entries)
+	}()
 
 	return nil
 }
 
-// Stop stops the mDNS discovery and advertising
-func (m *MDNSDiscoverer) Stop() {
-	if m.server != nil {
-		m.server.Shutdown()
-	}
-	close(m.stopCh)
-}
-
-// discover continuously looks for other Synapse nodes on the network
-func (m *MDNSDiscoverer) discover(ctx context.Context) {
-	resolver, err := zeroconf.NewResolver(nil)
+// checkConflict looks up our instance name before we claim it
+func (m *MDNSDiscoverer) checkConflict(ctx context.Context) error {
+	// A resolver answers a single lookup and closes when it ends
+	resolver, err := zeroconf.NewResolver(zeroconf.SelectIPTraffic(m.policy.ipType()))
 	if err != nil {
-		log.Printf("Failed to create mDNS resolver: %v", err)
-		return
+		return fmt.Errorf("failed to create mDNS resolver: %w", err)
 	}
+	ctx, cancel := context.WithTimeout(ctx, m.probe)
+	defer cancel()
 
 	entries := make(chan *zeroconf.ServiceEntry)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case entry := <-entries:
-				// Process discovered peer
-				peer := m.processEntry(entry)
-				if peer != nil {
-					// TODO: Handle discovered peer (send to main network)
-					log.Printf("Discovered peer: %+v", peer)
-				}
-			}
+	if err := resolver.Lookup(ctx, m.instance, m.serviceName, m.domain, entries); err != nil {
+		return fmt.Errorf("failed to look up mDNS instance: %w", err)
+	}
+	// The resolver closes entries once ctx ends. It also passes on records
+	// of other instances it hears meanwhile.
+	var conflict error
+	for entry := range entries {
+		if conflict == nil && entry.Instance == m.instance {
+			conflict = fmt.Errorf("%w: %s", ErrNameConflict, entry.Instance)
+			cancel()
 		}
-	}()
-
-	ctx2, cancel := context.WithCancel(ctx)
-	go func() {
-		<-m.stopCh
-		cancel()
-	}()
-
-	err = resolver.Browse(ctx2, m.serviceName, m.domain, entries)
-	if err != nil {
-		log.Printf("Failed to browse for mDNS services: %v", err)
 	}
+	return conflict
 }
 
-// processEntry converts a service entry to a Peer
-func (m *MDNSDiscoverer) processEntry(entry *zeroconf.ServiceEntry) *Peer {
-	if len(entry.AddrIPv4) == 0 && len(entry.AddrIPv6) == 0 {
-		return nil
+// register advertises our service. Registering normally announces all
+// interface addresses; a single-stack node announces only its own family.
+func (m *MDNSDiscoverer) register() (*zeroconf.Server, error) {
+	if m.policy.DualStack {
+		return zeroconf.Register(m.instance, m.serviceName, m.domain, m.port, m.txtRecords, nil)
 	}
 
-	var address string
-	if len(entry.AddrIPv4) > 0 {
-		address = entry.AddrIPv4[0].String()
-	} else {
-		address = entry.AddrIPv6[0].String()
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("could not determine host: %w", err)
+	}
+	ips, err := GetLocalIPs(m.policy.Allows(IPv6))
+	if err != nil {
+		return nil, fmt.Errorf("could not list local addresses: %w", err)
 	}
 
-	// Extract node ID from TXT records if available
-	var nodeID string
-	for _, txt := range entry.Text {
-		if strings.HasPrefix(txt, "node_id=") {
-			nodeID = strings.TrimPrefix(txt, "node_id=")
-			break
+	var allowed []string
+	for _, ip := range ips {
+		isIPv4 := net.ParseIP(ip).To4() != nil
+		if (isIPv4 && m.policy.Allows(IPv4)) || (!isIPv4 && m.policy.Allows(IPv6)) {
+			allowed = append(allowed, ip)
 		}
 	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no local %s addresses to advertise", m.policy.Prefer)
+	}
+	return zeroconf.RegisterProxy(m.instance, m.serviceName, m.domain, m.port, host, allowed, m.txtRecords, nil)
+}
 
-	return &Peer{
-		ID:       nodeID,
-		Address:  address,
-		Port:     entry.Port,
-		Hostname: entry.HostName,
-		TTL:      time.Duration(entry.TTL) * time.Second,
+// Stop stops the mDNS discovery and advertising and waits for discovery
+// to finish. It is safe to call more than once.
+func (m *MDNSDiscoverer) Stop() {
+	m.stopOnce.Do(func() {
+		if m.server != nil {
+			m.server.Shutdown()
+		}
+		if m.cancel != nil {
+			m.cancel()
+		}
+	})
+	m.wg.Wait()
+}
+
+// discover handles other Synapse nodes found on the network until the
+// resolver closes entries, which it does once browsing is cancelled
+func (m *MDNSDiscoverer) discover(entries <-chan *zeroconf.ServiceEntry) {
+	for entry := range entries {
+		// Process discovered peer
+		peer := m.processEntry(entry)
+		if peer != nil {
+			// TODO: Handle discovered peer (send to main network)
+			log.Printf("Discovered peer: %+v", peer)
+		}
 	}
 }
 
-// GetLocalIPs returns all local IP addresses
-func GetLocalIPs() ([]string, error) {
+// processEntry converts a service entry to a Peer
+func (m *MDNSDiscoverer) processEntry(entry *zeroconf.ServiceEntry) *Peer {
+	return processServiceEntry(entry, m.policy)
+}
+
+// GetLocalIPs returns all non-loopback local IPv4 addresses, and IPv6
+// addresses too if includeIPv6 is set
+func GetLocalIPs(includeIPv6 bool) ([]string, error) {
 	var ips []string
 	interfaces, err := net.Interfaces()
 	if err != nil {
@@ -152,7 +336,7 @@ func GetLocalIPs() ([]string, error) {
 		}
 		for _, b := range byt {
 			if ipnet, ok := b.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
+				if ipnet.IP.To4() != nil || includeIPv6 {
 					ips = append(ips, ipnet.IP.String())
 				}
 			}
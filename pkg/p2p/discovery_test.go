@@ -0,0 +1,262 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bootstrapFrom makes a network find peers through the given nodes alone,
+// without mDNS
+func bootstrapFrom(bootstrap ...string) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.P2P.EnableDiscovery = false
+		cfg.P2P.BootstrapPeers = bootstrap
+	}
+}
+
+// discoverEvery makes a network run a discovery cycle every interval
+func discoverEvery(interval time.Duration) func(n *Network) {
+	return func(n *Network) {
+		n.discoveryInterval = interval
+	}
+}
+
+// loopbackAddr returns an address a started network is dialed at that,
+// unlike the wildcard one TCP listeners have, is the same once dialed, so
+// discovery knows it for a connected peer's
+func loopbackAddr(n *Network) string {
+	if *transportFlag == "memory" {
+		return localAddr(n)
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(n.listenPort()))
+}
+
+func TestDiscoveryMeshesNodesSharingABootstrapNode(t *testing.T) {
+	ctx := context.Background()
+	interval := 400 * time.Millisecond
+
+	hub := startLocalNetworkWith(t, ctx, "discovery-hub", bootstrapFrom(), discoverEvery(interval))
+	nodes := []*Network{hub}
+	for _, id := range []string{"discovery-a", "discovery-b", "discovery-c"} {
+		nodes = append(nodes, startLocalNetworkWith(t, ctx, id, bootstrapFrom(localAddr(hub)), discoverEvery(interval)))
+	}
+
+	// Bootstrapping only connects each node to the hub; two discovery cycles
+	// must be enough to learn about and dial the others
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			if len(node.Peers()) != len(nodes)-1 {
+				return false
+			}
+		}
+		return true
+	}, 2*interval+time.Second, 20*time.Millisecond)
+
+	// A dial is counted once Connect returns, just after both sides have
+	// registered each other
+	successes := func() int {
+		var total int
+		for _, node := range nodes {
+			total += node.DiscoveryStats().Successes
+		}
+		return total
+	}
+	assert.Eventually(t, func() bool { return successes() >= 3 }, time.Second, 20*time.Millisecond,
+		"the three spokes must have connected to each other")
+}
+
+func TestDiscoverySkippedAtTargetPeers(t *testing.T) {
+	ctx := context.Background()
+	hub := startLocalNetwork(t, ctx, "discovery-hub")
+	node := startLocalNetwork(t, ctx, "discovery-node")
+	node.config.P2P.TargetPeers = 1
+
+	_, err := node.Connect(ctx, localAddr(hub))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(node.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	node.discoverPeers()
+	stats := node.DiscoveryStats()
+	assert.Equal(t, 1, stats.Cycles)
+	assert.Equal(t, 1, stats.Skipped)
+	assert.Zero(t, stats.Attempts)
+	assert.Equal(t, stats, node.GetNetworkReport().Discovery)
+}
+
+func TestDiscoverNow(t *testing.T) {
+	ctx := context.Background()
+	node := startLocalNetworkWith(t, ctx, "discover-now-node", bootstrapFrom(), discoverEvery(time.Hour))
+
+	// Nothing to find yet
+	result, err := node.DiscoverNow(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, DiscoveryResult{}, result)
+
+	// A hub, once known, is found, dialed and connected at once. It is made
+	// known after the node started so only discovery dials it.
+	hub := startLocalNetworkWith(t, ctx, "discover-now-hub", bootstrapFrom(), discoverEvery(time.Hour))
+	node.bootstrapMgr.AddNode(loopbackAddr(hub))
+	result, err = node.DiscoverNow(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, DiscoveryResult{Candidates: 1, Dialed: 1, Connected: 1}, result)
+	assert.Len(t, node.Peers(), 1)
+
+	// After which there is nothing new, and at the target nothing to look for
+	result, err = node.DiscoverNow(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, DiscoveryResult{}, result)
+	node.config.P2P.TargetPeers = 1
+	result, err = node.DiscoverNow(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, DiscoveryResult{Skipped: true}, result)
+
+	stats := node.DiscoveryStats()
+	assert.Equal(t, 4, stats.Cycles)
+	assert.Equal(t, 1, stats.Skipped)
+	assert.Equal(t, 1, stats.Successes)
+
+	stopped := newLocalNetwork(t, config.Default(), "discover-now-stopped")
+	_, err = stopped.DiscoverNow(ctx)
+	assert.ErrorContains(t, err, "not started")
+}
+
+func TestDiscoverNowCoalesces(t *testing.T) {
+	ctx := context.Background()
+	node := startLocalNetworkWith(t, ctx, "coalesce-node", bootstrapFrom(), discoverEvery(time.Hour))
+	hub := startLocalNetworkWith(t, ctx, "coalesce-hub", bootstrapFrom(), discoverEvery(time.Hour))
+	node.bootstrapMgr.AddNode(loopbackAddr(hub))
+
+	// Hold the cycle up until every caller is waiting for it
+	release := make(chan struct{})
+	node.peerExchange.SetDiscoveryFunc(func() ([]discovery.Peer, error) {
+		<-release
+		return node.discoveryCandidates()
+	})
+
+	const callers = 5
+	results := make(chan DiscoveryResult, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			result, err := node.DiscoverNow(ctx)
+			assert.NoError(t, err)
+			results <- result
+		}()
+	}
+
+	// A caller giving up leaves the cycle running for the others
+	impatient, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err := node.DiscoverNow(impatient)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	close(release)
+
+	for i := 0; i < callers; i++ {
+		assert.Equal(t, DiscoveryResult{Candidates: 1, Dialed: 1, Connected: 1}, <-results)
+	}
+	assert.Equal(t, 1, node.DiscoveryStats().Cycles)
+	assert.Len(t, node.Peers(), 1)
+}
+
+func TestDiscoveryTriggeredBelowFloor(t *testing.T) {
+	ctx := context.Background()
+	node := startLocalNetworkWith(t, ctx, "floor-node", bootstrapFrom(), discoverEvery(time.Hour))
+	var peers []*Network
+	for _, id := range []string{"floor-a", "floor-b", "floor-c"} {
+		peer := startLocalNetwork(t, ctx, id)
+		_, err := node.Connect(ctx, localAddr(peer))
+		require.NoError(t, err)
+		peers = append(peers, peer)
+	}
+	require.Eventually(t, func() bool {
+		return len(node.Peers()) == 3
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Zero(t, node.DiscoveryStats().Cycles)
+
+	// Already below the default floor of 4, losing another peer starts a
+	// cycle long before the hourly tick
+	peers[0].Stop()
+	require.Eventually(t, func() bool {
+		return node.DiscoveryStats().Cycles == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, node.DiscoveryStats().Triggered)
+
+	// Within the cooldown the next loss waits for the tick
+	peers[1].Stop()
+	require.Eventually(t, func() bool {
+		return len(node.topologyMgr.GetConnectedPeers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, 1, node.DiscoveryStats().Triggered)
+
+	// Nor is a cycle started while isolation recovery is dialing
+	node.discoveryMu.Lock()
+	node.discoveryTriggered = time.Time{}
+	node.discoveryMu.Unlock()
+	atomic.StoreInt32(&node.recovering, 1)
+	assert.False(t, node.triggerDiscovery())
+	atomic.StoreInt32(&node.recovering, 0)
+	assert.True(t, node.triggerDiscovery())
+	assert.Equal(t, 2, node.DiscoveryStats().Triggered)
+}
+
+func TestMDNSAdvertisesNodesSharingAName(t *testing.T) {
+	requireTCP(t)
+	ctx := context.Background()
+	start := func(nodeID string) (*Network, error) {
+		cfg := config.Default()
+		cfg.P2P.ListenPort = 0
+		cfg.P2P.EnableDiscovery = true
+		cfg.P2P.MDNS.ServiceName = "_synapse-p2p-test._tcp"
+		cfg.Storage.DataDir = t.TempDir()
+		network := newLocalNetwork(t, cfg, nodeID)
+		t.Cleanup(func() { network.Stop() })
+		return network, network.Start(ctx)
+	}
+
+	// Both keep the default node name
+	first, err := start("0a1b2c3d-mdns-node")
+	require.NoError(t, err)
+	second, err := start("4e5f6a7b-mdns-node")
+	require.NoError(t, err)
+
+	peers, err := discovery.DiscoverLocalPeers(ctx, time.Second, first.mdnsService(), first.addressPolicy())
+	require.NoError(t, err)
+	ports := make(map[string]int)
+	for _, peer := range peers {
+		ports[peer.ID] = peer.Port
+		if peer.ID == "0a1b2c3d-mdns-node" {
+			// What a discovering node needs to decide whether to dial
+			assert.Equal(t, ProtocolVersion, peer.Version)
+			assert.Contains(t, peer.Capabilities, CapabilityDiscovery)
+			assert.NoError(t, second.checkAdvertisedVersion(peer))
+		}
+	}
+	assert.Equal(t, first.listenPort(), ports["0a1b2c3d-mdns-node"])
+	assert.Equal(t, second.listenPort(), ports["4e5f6a7b-mdns-node"])
+
+	// A second process running as the same node is refused
+	_, err = start("0a1b2c3d-mdns-node")
+	assert.ErrorIs(t, err, discovery.ErrNameConflict)
+}
+
+func TestCheckAdvertisedVersion(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+
+	assert.NoError(t, network.checkAdvertisedVersion(discovery.Peer{ID: "current", Version: ProtocolVersion}))
+	// Nodes that predate version advertisement are dialed to find out
+	assert.NoError(t, network.checkAdvertisedVersion(discovery.Peer{ID: "older"}))
+
+	err := network.checkAdvertisedVersion(discovery.Peer{ID: "future", Version: "9.0.0", MinVersion: "9.0.0"})
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+}
@@ -0,0 +1,25 @@
+// Package p2p connects SynapseX nodes to each other and carries their
+// messages.
+//
+// A Network is used through Interface. Besides connecting and messaging, it
+// reports on its own health:
+//
+//	quality, ok := network.GetConnectionQuality(peerID)
+//	if !ok {
+//		// No live connection to peerID
+//	} else if quality.Measured {
+//		log.Printf("%s: %v latency over %s", peerID, quality.Latency, quality.Transport)
+//	}
+//
+//	metrics := network.GetTopologyMetrics()
+//	log.Printf("%d/%d peers, %v average latency", metrics.ConnectedPeers, metrics.MaxPeers, metrics.AvgLatency)
+//
+//	report := network.GetNetworkReport()
+//	json.NewEncoder(w).Encode(report)
+//
+// GetConnectionQuality returns false for peers without a live connection,
+// never a zero quality. A connection that has not been measured yet has
+// Measured false and zero metrics. GetTopologyMetrics averages only over
+// measured peers, and GetNetworkReport is a snapshot that is safe to keep
+// and encode.
+package p2p
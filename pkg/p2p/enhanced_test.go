@@ -3,10 +3,12 @@ package p2p
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/princetheprogrammer/synapse/internal/config"
 	"github.com/princetheprogrammer/synapse/internal/logger"
 	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -28,34 +30,23 @@ func TestEnhancedNetworkInitialization(t *testing.T) {
 }
 
 func TestNetworkReport(t *testing.T) {
-	cfg := config.Default()
-	log, err := logger.New("debug", "json", "")
-	require.NoError(t, err)
-
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	network, err := New(cfg, log, "test-node-id")
-	require.NoError(t, err)
-
-	// Start the network
-	err = network.Start(ctx)
-	require.NoError(t, err)
+	var network Interface = startLocalNetwork(t, ctx, "test-node-id")
 
 	// Get network report
 	report := network.GetNetworkReport()
-	assert.NotNil(t, report)
-
-	// Check that report contains expected keys
-	assert.Contains(t, report, "stats")
-	assert.Contains(t, report, "peer_qualities")
-	assert.Contains(t, report, "unhealthy_peers")
-	assert.Contains(t, report, "bandwidth")
-	assert.Contains(t, report, "topology_metrics")
-
-	// Stop the network
-	err = network.Stop()
-	assert.NoError(t, err)
+	assert.False(t, report.Stats.StartTime.IsZero())
+	assert.Empty(t, report.PeerQualities)
+	assert.Empty(t, report.UnhealthyPeers)
+	assert.Equal(t, network.GetTopologyMetrics(), report.Topology)
+	assert.False(t, report.Isolation.Isolated)
+	assert.Nil(t, report.Storage)
+
+	// Sections added by other subsystems appear in every report
+	network.(*Network).AddReportSection("extra", func() interface{} { return 42 })
+	assert.Equal(t, 42, network.GetNetworkReport().Sections["extra"])
 }
 
 func TestTopologyMetrics(t *testing.T) {
@@ -67,10 +58,10 @@ func TestTopologyMetrics(t *testing.T) {
 	require.NoError(t, err)
 
 	metrics := network.GetTopologyMetrics()
-	assert.NotNil(t, metrics)
-	assert.Contains(t, metrics, "total_peers")
-	assert.Contains(t, metrics, "connected_peers")
-	assert.Contains(t, metrics, "topology_type")
+	assert.Zero(t, metrics.TotalPeers)
+	assert.Zero(t, metrics.ConnectedPeers)
+	assert.Equal(t, cfg.P2P.MaxPeers, metrics.MaxPeers)
+	assert.NotEmpty(t, metrics.TopologyType)
 }
 
 func TestBootstrapManager(t *testing.T) {
@@ -88,14 +79,44 @@ func TestBootstrapManager(t *testing.T) {
 }
 
 func TestConnectionQuality(t *testing.T) {
-	cfg := config.Default()
-	log, err := logger.New("debug", "json", "")
-	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	network, err := New(cfg, log, "test-node-id")
-	require.NoError(t, err)
+	var a, b Interface = startLocalNetwork(t, ctx, "node-a"), startLocalNetwork(t, ctx, "node-b")
 
 	// Initially should not have quality metrics for any peer
-	_, exists := network.GetConnectionQuality("nonexistent-peer")
+	_, exists := a.GetConnectionQuality("nonexistent-peer")
 	assert.False(t, exists)
-}
\ No newline at end of file
+
+	_, err := a.Connect(ctx, b.(*Network).ListenAddr().String())
+	require.NoError(t, err)
+
+	// A new connection is reported live but unmeasured
+	quality, exists := a.GetConnectionQuality("node-b")
+	require.True(t, exists)
+	assert.Equal(t, "node-b", quality.PeerID)
+	assert.True(t, quality.Outbound)
+	assert.False(t, quality.ConnectedSince.IsZero())
+	assert.False(t, quality.Measured)
+	assert.Zero(t, quality.Latency)
+	assert.Contains(t, a.GetNetworkReport().PeerQualities, "node-b")
+	metrics := a.GetTopologyMetrics()
+	assert.Equal(t, 1, metrics.ConnectedPeers)
+	assert.Zero(t, metrics.MeasuredPeers)
+
+	// Measurements show up as soon as they are taken
+	a.(*Network).topologyMgr.UpdatePeerQuality("node-b", topology.ConnectionQuality{Latency: 30 * time.Millisecond, Bandwidth: 5})
+	quality, exists = a.GetConnectionQuality("node-b")
+	require.True(t, exists)
+	assert.True(t, quality.Measured)
+	assert.Equal(t, 30*time.Millisecond, quality.Latency)
+	assert.Equal(t, 30*time.Millisecond, a.GetTopologyMetrics().AvgLatency)
+
+	// A peer we lost has no quality, not a zero one
+	require.NoError(t, b.Stop())
+	require.Eventually(t, func() bool {
+		_, exists := a.GetConnectionQuality("node-b")
+		return !exists
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Empty(t, a.GetNetworkReport().PeerQualities)
+}
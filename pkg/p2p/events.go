@@ -0,0 +1,113 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies a network lifecycle event
+type EventType string
+
+const (
+	// EventNetworkIsolated is emitted when the node has stayed below its
+	// minimum peer count for longer than the isolation threshold
+	EventNetworkIsolated EventType = "network_isolated"
+
+	// EventNetworkRecovered is emitted when an isolated node is back at or
+	// above its minimum peer count
+	EventNetworkRecovered EventType = "network_recovered"
+
+	// EventPeerConnected is emitted once a peer has sent its HELLO, so its
+	// capabilities are known to subscribers
+	EventPeerConnected EventType = "peer_connected"
+
+	// EventPeerDisconnected is emitted when the connection to a peer closes
+	EventPeerDisconnected EventType = "peer_disconnected"
+
+	// EventHandshakeFailed is emitted when a connection fails its
+	// handshake, with the peer if the failure is attributed to one
+	EventHandshakeFailed EventType = "handshake_failed"
+
+	// EventPeerBanned is emitted when a peer is disconnected and held off
+	// from being redialed for a while
+	EventPeerBanned EventType = "peer_banned"
+
+	// EventStorageHighWater is emitted when data directory usage rises past
+	// the configured high-water mark
+	EventStorageHighWater EventType = "storage_high_water"
+)
+
+// Event is a notification published on the network event bus
+type Event struct {
+	Type   EventType              `json:"type"`
+	Time   time.Time              `json:"time"`
+	PeerID string                 `json:"peer_id,omitempty"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+// eventBus fans events out to subscribers. Publishing never blocks; events
+// are dropped for subscribers whose buffer is full.
+type eventBus struct {
+	subscribers map[int]chan Event
+	nextID      int
+	mu          sync.RWMutex
+}
+
+// newEventBus creates an empty event bus
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[int]chan Event),
+	}
+}
+
+// Subscribe registers a subscriber with the given buffer size and returns
+// its channel together with a function that unsubscribes it
+func (b *eventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	ch := make(chan Event, buffer)
+	b.subscribers[id] = ch
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subscribers, id)
+			close(ch)
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+// Publish delivers an event to every subscriber that has room for it
+func (b *eventBus) Publish(evt Event) {
+	if evt.Time.IsZero() {
+		evt.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of network lifecycle events and a function
+// that cancels the subscription. Slow subscribers miss events rather than
+// blocking the network.
+func (n *Network) Subscribe(buffer int) (<-chan Event, func()) {
+	return n.events.Subscribe(buffer)
+}
@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMessageExpired is returned for a send of a message that outlived its
+// TTL before it was written
+var ErrMessageExpired = errors.New("message expired before it was sent")
+
+// MaxAge has a handler skip messages sent more than maxAge ago, for handlers
+// that would rather miss a message than act on a stale one. Messages whose
+// TTL is shorter expire sooner regardless.
+func MaxAge(maxAge time.Duration) HandlerOption {
+	return func(h *registeredHandler) {
+		h.maxAge = maxAge
+	}
+}
+
+// messageAge returns how long before now a received message was sent, by
+// our clock: its timestamp is corrected by the sender's clock skew where we
+// have an estimate of it
+func (n *Network) messageAge(msg Message, now time.Time) time.Duration {
+	sent := msg.Timestamp
+	if peer, exists := n.peers.Get(msg.Sender); exists {
+		if skew, ok := peer.ClockSkew(); ok {
+			sent = sent.Add(-skew)
+		}
+	}
+	return now.Sub(sent)
+}
+
+// dropExpired counts a received message dropped for its age instead of
+// being handled
+func (n *Network) dropExpired(msg Message, age time.Duration) {
+	n.monitor.Stats.IncrementMessagesExpired(msg.Type)
+	n.messageLogger(&msg).Debugf("dropping message %s of type %s from %s sent %v ago: expired", msg.ID, msg.Type, msg.Sender, age.Round(time.Millisecond))
+}
+
+// refreshTTL dates a message kept for sending now, shortening its TTL by the
+// time it waited. It reports false if the message expired meanwhile.
+func refreshTTL(msg *Message, now time.Time) bool {
+	if msg.expiredAt(now) {
+		return false
+	}
+	if msg.TTLMs > 0 {
+		msg.SetTTL(msg.Timestamp.Add(msg.TTL()).Sub(now))
+	}
+	msg.Timestamp = now
+	return true
+}
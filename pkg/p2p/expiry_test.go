@@ -0,0 +1,211 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageTTL(t *testing.T) {
+	msg := NewMessage("TICK", "peer", nil)
+	assert.False(t, msg.expiredAt(msg.Timestamp.Add(time.Hour)), "no TTL never expires")
+
+	// TTLs are rounded up to the millisecond
+	msg.SetTTL(1500 * time.Microsecond)
+	assert.Equal(t, int64(2), msg.TTLMs)
+	msg.SetTTL(time.Second)
+	assert.Equal(t, time.Second, msg.TTL())
+	assert.False(t, msg.expiredAt(msg.Timestamp.Add(time.Second)))
+	assert.True(t, msg.expiredAt(msg.Timestamp.Add(time.Second+time.Millisecond)))
+
+	// Redating a message shortens its TTL by the time it waited
+	sent := msg.Timestamp
+	require.True(t, refreshTTL(&msg, sent.Add(400*time.Millisecond)))
+	assert.Equal(t, 600*time.Millisecond, msg.TTL())
+	assert.Equal(t, sent.Add(400*time.Millisecond), msg.Timestamp)
+	assert.False(t, refreshTTL(&msg, sent.Add(2*time.Second)))
+
+	msg.TTLMs = -1
+	assert.Error(t, msg.Validate())
+}
+
+// startStalledNetwork starts a network whose processor is held up handling
+// the first HOLD message a pipe peer sends, until the returned function is
+// called
+func startStalledNetwork(t *testing.T, ctx context.Context, nodeID string) (*Network, *Peer, func(Message), func()) {
+	network := startLocalNetwork(t, ctx, nodeID)
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	network.RegisterHandler("HOLD", func(msg Message) {
+		close(handling)
+		<-release
+	})
+	peer, remote, _ := attachPipePeer(t, network, nodeID+"-peer")
+	send := func(msg Message) { writeFrame(t, remote, msg) }
+	send(NewMessage("HOLD", peer.ID, nil))
+	select {
+	case <-handling:
+	case <-time.After(2 * time.Second):
+		t.Fatal("processor not held up")
+	}
+	var once sync.Once
+	return network, peer, send, func() { once.Do(func() { close(release) }) }
+}
+
+func TestExpiredMessagesNotHandled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network, peer, send, release := startStalledNetwork(t, ctx, "expiry-node")
+	defer release()
+
+	var handled []string
+	var mu sync.Mutex
+	network.RegisterHandler("TICK", func(msg Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg.ID)
+	})
+
+	// Ticks that live 100ms wait behind the held up processor for longer
+	for i := 0; i < 3; i++ {
+		tick := NewMessage("TICK", peer.ID, nil)
+		tick.SetTTL(100 * time.Millisecond)
+		send(tick)
+	}
+	fresh := NewMessage("TICK", peer.ID, nil)
+	fresh.SetTTL(time.Minute)
+	send(fresh)
+	lasting := NewMessage("TICK", peer.ID, nil)
+	send(lasting)
+	require.Eventually(t, func() bool {
+		return network.queue.Len() == 5
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	release()
+
+	// so they are dropped and counted instead of handled
+	require.Eventually(t, func() bool {
+		return network.queue.Len() == 0 && network.monitor.Stats.GetStats().MessagesExpired["TICK"] == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{fresh.ID, lasting.ID}, handled)
+}
+
+func TestHandlerMaxAge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network, peer, send, release := startStalledNetwork(t, ctx, "max-age-node")
+	defer release()
+
+	// One handler of quotes wants them fresh, the other any age; only a
+	// handler wanting them fresh takes prices
+	handled := make(map[string]int)
+	var mu sync.Mutex
+	handler := func(name string) MessageHandler {
+		return func(msg Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			handled[name]++
+		}
+	}
+	network.RegisterHandler("QUOTE", handler("fresh quotes"), MaxAge(100*time.Millisecond))
+	network.RegisterHandler("QUOTE", handler("any quotes"))
+	network.RegisterHandler("PRICE", handler("fresh prices"), MaxAge(100*time.Millisecond))
+
+	send(NewMessage("QUOTE", peer.ID, nil))
+	send(NewMessage("PRICE", peer.ID, nil))
+	require.Eventually(t, func() bool {
+		return network.queue.Len() == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	release()
+
+	require.Eventually(t, func() bool {
+		return network.queue.Len() == 0 && network.monitor.Stats.GetStats().MessagesExpired["PRICE"] == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"any quotes": 1}, handled)
+	assert.NotContains(t, network.monitor.Stats.GetStats().MessagesExpired, "QUOTE")
+}
+
+func TestMessageAgeCorrectsClockSkew(t *testing.T) {
+	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	network := newLocalNetwork(t, cfg, "skew-age-node")
+	peer := NewPeer("fast-clock", "pipe", ProtocolVersion)
+	require.NoError(t, network.peers.Add(peer, nil))
+
+	// The peer's clock runs a minute ahead, so a message it dates a minute
+	// from now was sent just now
+	now := time.Now()
+	msg := NewMessage("TICK", peer.ID, nil)
+	msg.Timestamp = now.Add(time.Minute)
+	assert.Equal(t, -time.Minute, network.messageAge(msg, now))
+	peer.AddClockSample(time.Minute)
+	assert.InDelta(t, 0, network.messageAge(msg, now), float64(time.Millisecond))
+}
+
+func TestExpiredMessagesNotSent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetworkWith(t, ctx, "expired-sender", journalIn(t.TempDir()))
+	peer, _, _ := attachPipePeer(t, network, "expired-receiver")
+
+	stale := NewMessage("TICK", network.nodeID, nil)
+	stale.Timestamp = time.Now().Add(-time.Minute)
+	stale.SetTTL(time.Second)
+	assert.ErrorIs(t, network.SendMessage(ctx, peer.ID, stale), ErrMessageExpired)
+
+	// An expired reliable send is not kept for redelivery either
+	assert.ErrorIs(t, network.SendMessageReliable(ctx, peer.ID, stale), ErrMessageExpired)
+	assert.Zero(t, network.outbox.Stats().Pending)
+	stats := network.monitor.Stats.GetStats()
+	assert.Equal(t, uint64(2), stats.SendsExpired)
+	assert.Zero(t, stats.TotalMessagesSent)
+}
+
+func TestExpiredMessagesNotRedelivered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := startLocalNetworkWith(t, ctx, "expiry-journal-a", journalIn(t.TempDir()))
+	b := startLocalNetwork(t, ctx, "expiry-journal-b")
+
+	delivered := make(chan string, 4)
+	b.RegisterHandler("NOTE", func(msg Message) {
+		delivered <- msg.ID
+	})
+
+	// Of two messages journaled for the peer while it is offline, the one
+	// that lives 100ms expires before it connects
+	brief := NewMessage("NOTE", a.nodeID, "brief")
+	brief.SetTTL(100 * time.Millisecond)
+	require.ErrorIs(t, a.SendMessageReliable(ctx, b.nodeID, brief), ErrDeliveryPending)
+	lasting := NewMessage("NOTE", a.nodeID, "lasting")
+	lasting.SetTTL(time.Minute)
+	require.ErrorIs(t, a.SendMessageReliable(ctx, b.nodeID, lasting), ErrDeliveryPending)
+	time.Sleep(150 * time.Millisecond)
+
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	select {
+	case id := <-delivered:
+		assert.Equal(t, lasting.ID, id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lasting message not redelivered")
+	}
+	require.Eventually(t, func() bool {
+		return a.outbox.Stats().Pending == 0
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, uint64(1), a.monitor.Stats.GetStats().SendsExpired)
+	assert.Empty(t, delivered)
+}
@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/faults"
+)
+
+// ErrFaultInjectionDisabled is returned when faults are injected into a
+// network not configured for it
+var ErrFaultInjectionDisabled = errors.New("fault injection is not enabled")
+
+// Faults returns the injector wrapping the network's connections, nil unless
+// fault injection is enabled in the config. It is meant for tests only: the
+// faults it sets apply to every connection the network listens for or dials
+// afterwards, and to the ones already open. A network injecting faults
+// does not upgrade connections to QUIC.
+func (n *Network) Faults() *faults.Injector {
+	return n.faults
+}
+
+// InjectFaults applies f to the frames we write to a connected peer, until
+// faults are injected again or cleared with ClearFaults
+func (n *Network) InjectFaults(peerID string, f faults.Faults) error {
+	target, err := n.faultTarget(peerID)
+	if err != nil {
+		return err
+	}
+	n.faults.Set(target, f)
+	return nil
+}
+
+// ClearFaults stops injecting faults into what we write to a peer
+func (n *Network) ClearFaults(peerID string) error {
+	target, err := n.faultTarget(peerID)
+	if err != nil {
+		return err
+	}
+	n.faults.Clear(target)
+	return nil
+}
+
+// faultTarget returns the remote address our connection to a peer has,
+// which is what its faults are set for
+func (n *Network) faultTarget(peerID string) (string, error) {
+	if n.faults == nil {
+		return "", ErrFaultInjectionDisabled
+	}
+	peer, exists := n.peers.Get(peerID)
+	if !exists {
+		return "", fmt.Errorf("%w %s", ErrPeerNotFound, peerID)
+	}
+	conn := peer.GetConnection()
+	if conn == nil {
+		return "", fmt.Errorf("%w %s", ErrPeerNotFound, peerID)
+	}
+	return conn.Conn.RemoteAddr().String(), nil
+}
@@ -0,0 +1,201 @@
+package faults
+
+import (
+	"container/heap"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// delayedFrame is a frame waiting out its delay
+type delayedFrame struct {
+	data  []byte
+	ready time.Time
+	seq   uint64
+}
+
+// frameQueue orders delayed frames by when they are due, and frames due at
+// once by when they were written
+type frameQueue []delayedFrame
+
+func (q frameQueue) Len() int { return len(q) }
+func (q frameQueue) Less(i, j int) bool {
+	if !q[i].ready.Equal(q[j].ready) {
+		return q[i].ready.Before(q[j].ready)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q frameQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *frameQueue) Push(x interface{}) { *q = append(*q, x.(delayedFrame)) }
+func (q *frameQueue) Pop() interface{} {
+	old := *q
+	frame := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return frame
+}
+
+// Conn is a connection whose writes an injector applies faults to. Reads
+// pass through untouched; faults on what a peer sends us are injected at
+// the peer.
+type Conn struct {
+	net.Conn
+	injector *Injector
+	// dialed is the address the connection was dialed at, if it was
+	dialed string
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	queue   frameQueue
+	written uint64
+	// delivering is set while delayed frames are being written, which later
+	// frames queue behind
+	delivering bool
+	closed     bool
+	// err is the error a delayed frame failed with, returned by the next
+	// write
+	err  error
+	wake chan struct{}
+
+	writeMu sync.Mutex
+}
+
+// Write applies the connection's faults to p as one frame. A dropped frame
+// reports success, as a frame lost on the way would.
+func (c *Conn) Write(p []byte) (int, error) {
+	f := c.injector.faultsFor(c.RemoteAddr().String(), c.dialed)
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return 0, err
+	}
+	if !f.active() && !c.delivering {
+		c.mu.Unlock()
+		c.injector.count(func(s *Stats) { s.Frames++ })
+		return c.write(p)
+	}
+
+	var dropped, duplicated, corrupted bool
+	dropped = c.rng.Float64() < f.Drop
+	if dropped {
+		c.mu.Unlock()
+		c.injector.count(func(s *Stats) { s.Frames++; s.Dropped++ })
+		return len(p), nil
+	}
+	data := append([]byte(nil), p...)
+	if len(data) > 0 && c.rng.Float64() < f.Corrupt {
+		data[c.rng.IntN(len(data))] ^= 0xff
+		corrupted = true
+	}
+	copies := 1
+	if c.rng.Float64() < f.Duplicate {
+		copies, duplicated = 2, true
+	}
+	delays := make([]time.Duration, copies)
+	if f.Delay != nil {
+		for i := range delays {
+			delays[i] = f.Delay.Sample(c.rng)
+		}
+	}
+
+	// Frames go out at once unless delayed, or queued behind delayed ones
+	delayed := f.Delay != nil || c.delivering
+	if delayed {
+		now := time.Now()
+		for _, delay := range delays {
+			c.written++
+			heap.Push(&c.queue, delayedFrame{data: data, ready: now.Add(delay), seq: c.written})
+		}
+		if !c.delivering {
+			c.delivering = true
+			go c.deliver()
+		}
+		c.signal()
+	}
+	c.mu.Unlock()
+
+	c.injector.count(func(s *Stats) {
+		s.Frames++
+		if duplicated {
+			s.Duplicated++
+		}
+		if corrupted {
+			s.Corrupted++
+		}
+		if f.Delay != nil {
+			s.Delayed++
+		}
+	})
+	if delayed {
+		return len(p), nil
+	}
+	for i := 0; i < copies; i++ {
+		if _, err := c.write(data); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// write writes data to the wrapped connection whole
+func (c *Conn) write(data []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.Write(data)
+}
+
+// signal wakes the delivery of delayed frames. c.mu must be held.
+func (c *Conn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver writes delayed frames as they come due, until none are left or
+// the connection closes. A failed write drops the frames still waiting.
+func (c *Conn) deliver() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		c.mu.Lock()
+		if c.closed || len(c.queue) == 0 {
+			c.delivering = false
+			c.mu.Unlock()
+			return
+		}
+		wait := time.Until(c.queue[0].ready)
+		if wait <= 0 {
+			frame := heap.Pop(&c.queue).(delayedFrame)
+			c.mu.Unlock()
+			if _, err := c.write(frame.data); err != nil {
+				c.mu.Lock()
+				c.err, c.queue, c.delivering = err, nil, false
+				c.mu.Unlock()
+				return
+			}
+			continue
+		}
+		c.mu.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-c.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// Close closes the connection. Frames still delayed are lost.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.queue = nil
+	c.signal()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
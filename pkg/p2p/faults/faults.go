@@ -0,0 +1,241 @@
+// Package faults wraps stream connections to drop, delay, duplicate and
+// corrupt what is written on them, for tests of how the network copes with
+// a bad link. Each write is taken as one frame, as the p2p package writes
+// every frame whole.
+package faults
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults says what happens to the frames written on a connection. Rates are
+// the chance, from 0 to 1, that each frame is affected.
+type Faults struct {
+	// Drop loses frames without the writer noticing
+	Drop float64
+	// Duplicate delivers frames twice
+	Duplicate float64
+	// Corrupt inverts one byte of frames
+	Corrupt float64
+	// Delay, if set, holds each frame back for a sampled time. Frames are
+	// delivered in the order their delays end, so a delay that varies
+	// reorders them.
+	Delay Distribution
+}
+
+// active reports whether f does anything to frames
+func (f Faults) active() bool {
+	return f.Drop > 0 || f.Duplicate > 0 || f.Corrupt > 0 || f.Delay != nil
+}
+
+// Distribution is how long frames are delayed
+type Distribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+// Fixed delays every frame by d
+func Fixed(d time.Duration) Distribution {
+	return fixed(d)
+}
+
+type fixed time.Duration
+
+func (d fixed) Sample(*rand.Rand) time.Duration {
+	return time.Duration(d)
+}
+
+// Uniform delays frames by between min and max, evenly spread
+func Uniform(min, max time.Duration) Distribution {
+	return uniform{min: min, max: max}
+}
+
+type uniform struct {
+	min, max time.Duration
+}
+
+func (d uniform) Sample(r *rand.Rand) time.Duration {
+	if d.max <= d.min {
+		return d.min
+	}
+	return d.min + time.Duration(r.Int64N(int64(d.max-d.min)+1))
+}
+
+// Normal delays frames by a normally distributed time around mean, never
+// less than zero
+func Normal(mean, stddev time.Duration) Distribution {
+	return normal{mean: mean, stddev: stddev}
+}
+
+type normal struct {
+	mean, stddev time.Duration
+}
+
+func (d normal) Sample(r *rand.Rand) time.Duration {
+	delay := float64(d.mean) + r.NormFloat64()*float64(d.stddev)
+	return time.Duration(math.Max(delay, 0))
+}
+
+// Stats counts what an injector did to the frames written through it
+type Stats struct {
+	Frames     uint64 `json:"frames"`
+	Dropped    uint64 `json:"dropped"`
+	Duplicated uint64 `json:"duplicated"`
+	Corrupted  uint64 `json:"corrupted"`
+	Delayed    uint64 `json:"delayed"`
+}
+
+// Transport is the shape of the transports an injector wraps, as defined
+// by the p2p package
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(ctx context.Context, address string) (net.Conn, error)
+}
+
+// Injector applies faults to the connections it wraps. Faults are set for
+// a target, the remote address of a connection or the address it was
+// dialed at, as host:port or the host alone, and can be changed at any
+// time; a connection with no target set gets the default faults. Each connection draws from a random source
+// seeded from the injector's seed and the order it was wrapped in, so a
+// test run the same way sees the same faults.
+type Injector struct {
+	mu       sync.Mutex
+	seed     int64
+	wrapped  uint64
+	fallback Faults
+	targets  map[string]Faults
+	stats    Stats
+}
+
+// New creates an injector that does nothing until faults are set
+func New(seed int64) *Injector {
+	return &Injector{seed: seed, targets: make(map[string]Faults)}
+}
+
+// SetDefault sets the faults of connections with no target set
+func (i *Injector) SetDefault(f Faults) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.fallback = f
+}
+
+// Set sets the faults of the connections to target, a host:port address
+// or a host. An address takes precedence over a host.
+func (i *Injector) Set(target string, f Faults) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.targets[target] = f
+}
+
+// Clear removes the faults set for target
+func (i *Injector) Clear(target string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.targets, target)
+}
+
+// Reset removes every fault, the default ones included
+func (i *Injector) Reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.fallback = Faults{}
+	i.targets = make(map[string]Faults)
+}
+
+// Stats returns what the injector did so far
+func (i *Injector) Stats() Stats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.stats
+}
+
+// faultsFor returns the faults of a connection to the addresses given, its
+// remote address and the one it was dialed at
+func (i *Injector) faultsFor(addresses ...string) Faults {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, address := range addresses {
+		if f, ok := i.targets[address]; ok {
+			return f
+		}
+	}
+	for _, address := range addresses {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			if f, ok := i.targets[host]; ok {
+				return f
+			}
+		}
+	}
+	return i.fallback
+}
+
+// count adds to the injector's stats
+func (i *Injector) count(fn func(s *Stats)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	fn(&i.stats)
+}
+
+// Wrap returns conn with the injector's faults applied to its writes
+func (i *Injector) Wrap(conn net.Conn) net.Conn {
+	return i.wrap(conn, "")
+}
+
+// wrap wraps conn, dialed at address if it was dialed
+func (i *Injector) wrap(conn net.Conn, address string) *Conn {
+	i.mu.Lock()
+	i.wrapped++
+	source := rand.NewPCG(uint64(i.seed), i.wrapped)
+	i.mu.Unlock()
+
+	return &Conn{Conn: conn, injector: i, dialed: address, rng: rand.New(source), wake: make(chan struct{}, 1)}
+}
+
+// Transport returns t with every connection it listens for or dials
+// wrapped by the injector
+func (i *Injector) Transport(t Transport) Transport {
+	return transport{Transport: t, injector: i}
+}
+
+// transport wraps the connections of another transport
+type transport struct {
+	Transport
+	injector *Injector
+}
+
+// Listen accepts connections wrapped by the injector
+func (t transport) Listen(address string) (net.Listener, error) {
+	l, err := t.Transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return listener{Listener: l, injector: t.injector}, nil
+}
+
+// Dial returns a connection wrapped by the injector
+func (t transport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return t.injector.wrap(conn, address), nil
+}
+
+// listener wraps the connections it accepts
+type listener struct {
+	net.Listener
+	injector *Injector
+}
+
+// Accept waits for the next connection and wraps it
+func (l listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.injector.Wrap(conn), nil
+}
@@ -0,0 +1,170 @@
+package faults
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a connection keeping what is written to it
+type recorder struct {
+	net.Conn
+	remote net.Addr
+
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func newRecorder(remote string) *recorder {
+	addr, _ := net.ResolveTCPAddr("tcp", remote)
+	return &recorder{remote: addr}
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (r *recorder) RemoteAddr() net.Addr { return r.remote }
+func (r *recorder) Close() error         { return nil }
+
+// written returns the frames written so far
+func (r *recorder) written() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.frames...)
+}
+
+// writeFrames writes n numbered frames to conn
+func writeFrames(t *testing.T, conn net.Conn, n int) {
+	for i := 0; i < n; i++ {
+		written, err := conn.Write([]byte(fmt.Sprintf("frame-%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, 9, written)
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	injector := New(1)
+	rec := newRecorder("10.0.0.1:9000")
+	writeFrames(t, injector.Wrap(rec), 10)
+
+	frames := rec.written()
+	require.Len(t, frames, 10)
+	assert.Equal(t, "frame-009", string(frames[9]))
+	assert.Equal(t, Stats{Frames: 10}, injector.Stats())
+}
+
+func TestDropDuplicateCorrupt(t *testing.T) {
+	injector := New(1)
+	injector.SetDefault(Faults{Drop: 0.2})
+	rec := newRecorder("10.0.0.1:9000")
+	writeFrames(t, injector.Wrap(rec), 1000)
+
+	stats := injector.Stats()
+	assert.InDelta(t, 200, stats.Dropped, 50)
+	assert.Len(t, rec.written(), 1000-int(stats.Dropped))
+
+	injector.SetDefault(Faults{Duplicate: 1})
+	rec = newRecorder("10.0.0.1:9000")
+	writeFrames(t, injector.Wrap(rec), 3)
+	frames := rec.written()
+	require.Len(t, frames, 6)
+	assert.Equal(t, frames[0], frames[1])
+
+	injector.SetDefault(Faults{Corrupt: 1})
+	rec = newRecorder("10.0.0.1:9000")
+	writeFrames(t, injector.Wrap(rec), 50)
+	for i, frame := range rec.written() {
+		assert.NotEqual(t, fmt.Sprintf("frame-%03d", i), string(frame))
+	}
+	assert.Equal(t, uint64(50), injector.Stats().Corrupted)
+}
+
+func TestDelayReorders(t *testing.T) {
+	injector := New(1)
+	injector.SetDefault(Faults{Delay: Uniform(0, 20*time.Millisecond)})
+	rec := newRecorder("10.0.0.1:9000")
+	conn := injector.Wrap(rec)
+	writeFrames(t, conn, 100)
+
+	require.Eventually(t, func() bool {
+		return len(rec.written()) == 100
+	}, 2*time.Second, 10*time.Millisecond)
+	reordered := false
+	for i, frame := range rec.written() {
+		if string(frame) != fmt.Sprintf("frame-%03d", i) {
+			reordered = true
+		}
+	}
+	assert.True(t, reordered)
+	assert.Equal(t, uint64(100), injector.Stats().Delayed)
+
+	// Frames written once faults are lifted wait for the delayed ones
+	injector.Reset()
+	writeFrames(t, conn, 1)
+	require.Eventually(t, func() bool {
+		return len(rec.written()) == 101
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "frame-000", string(rec.written()[100]))
+}
+
+func TestTargets(t *testing.T) {
+	injector := New(1)
+	injector.Set("10.0.0.1", Faults{Drop: 1})
+	injector.Set("10.0.0.1:9001", Faults{})
+
+	dropped, spared, other := newRecorder("10.0.0.1:9000"), newRecorder("10.0.0.1:9001"), newRecorder("10.0.0.2:9000")
+	for _, rec := range []*recorder{dropped, spared, other} {
+		writeFrames(t, injector.Wrap(rec), 5)
+	}
+	assert.Empty(t, dropped.written())
+	assert.Len(t, spared.written(), 5)
+	assert.Len(t, other.written(), 5)
+
+	injector.Clear("10.0.0.1")
+	writeFrames(t, injector.Wrap(dropped), 5)
+	assert.Len(t, dropped.written(), 5)
+
+	// A dialed connection is also targeted by the address it was dialed at
+	injector.Set("seed.example:9000", Faults{Drop: 1})
+	dialed := newRecorder("10.0.0.3:9000")
+	writeFrames(t, injector.wrap(dialed, "seed.example:9000"), 5)
+	assert.Empty(t, dialed.written())
+}
+
+func TestSameSeedSameFaults(t *testing.T) {
+	run := func() []int {
+		injector := New(42)
+		injector.SetDefault(Faults{Drop: 0.5})
+		rec := newRecorder("10.0.0.1:9000")
+		writeFrames(t, injector.Wrap(rec), 50)
+		var kept []int
+		for _, frame := range rec.written() {
+			var i int
+			fmt.Sscanf(string(frame), "frame-%d", &i)
+			kept = append(kept, i)
+		}
+		return kept
+	}
+	assert.Equal(t, run(), run())
+}
+
+func TestDistributions(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	assert.Equal(t, 5*time.Millisecond, Fixed(5*time.Millisecond).Sample(r))
+	for i := 0; i < 100; i++ {
+		delay := Uniform(time.Millisecond, 3*time.Millisecond).Sample(r)
+		assert.GreaterOrEqual(t, delay, time.Millisecond)
+		assert.LessOrEqual(t, delay, 3*time.Millisecond)
+		assert.GreaterOrEqual(t, Normal(time.Millisecond, 10*time.Millisecond).Sample(r), time.Duration(0))
+	}
+}
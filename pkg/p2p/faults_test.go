@@ -0,0 +1,177 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/faults"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// injectFaults enables fault injection on a network, with a fixed seed
+func injectFaults(cfg *config.Config) {
+	cfg.P2P.FaultInjection.Enabled = true
+	cfg.P2P.FaultInjection.Seed = 1663
+}
+
+func TestFaultInjectionDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, _ := connectPair(t, ctx, "plain-a", "plain-b")
+	assert.Nil(t, a.Faults())
+	assert.ErrorIs(t, a.InjectFaults("plain-b", faults.Faults{Drop: 1}), ErrFaultInjectionDisabled)
+
+	faulty := startLocalNetworkWith(t, ctx, "faulty-node", injectFaults)
+	assert.ErrorIs(t, faulty.InjectFaults("plain-b", faults.Faults{Drop: 1}), ErrPeerNotFound)
+}
+
+func TestHeartbeatsSurviveFrameLoss(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const interval = 50 * time.Millisecond
+	start := func(nodeID string) *Network {
+		return startLocalNetworkWith(t, ctx, nodeID, func(cfg *config.Config) {
+			injectFaults(cfg)
+			dialNothing(cfg)
+			cfg.P2P.EnableDiscovery = true
+		}, func(n *Network) {
+			n.heartbeatInterval = interval
+			n.pool.timeout = 10 * interval
+			n.pool.interval = interval
+			n.pool.grace = 4 * interval
+		})
+	}
+	a, b := start("lossy-a"), start("lossy-b")
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(a.ConnectedPeers()) == 1 && len(b.ConnectedPeers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	time.Sleep(2 * interval)
+
+	// A fifth of the frames each way are lost
+	require.NoError(t, a.InjectFaults("lossy-b", faults.Faults{Drop: 0.2}))
+	require.NoError(t, b.InjectFaults("lossy-a", faults.Faults{Drop: 0.2}))
+
+	received := func() uint64 {
+		return b.monitor.Stats.GetStats().TotalMessagesReceived
+	}
+	const intervals = 40
+	before := received()
+	time.Sleep(intervals * interval)
+	heard := received() - before
+
+	// The peers stay connected on the heartbeats that get through
+	assert.Len(t, a.ConnectedPeers(), 1)
+	assert.Len(t, b.ConnectedPeers(), 1)
+	assert.InDelta(t, intervals*0.8, heard, intervals*0.25)
+	assert.Less(t, heard, uint64(intervals))
+	assert.NotZero(t, a.Faults().Stats().Dropped)
+	assert.NotZero(t, b.Faults().Stats().Dropped)
+}
+
+func TestReliableDeliveryUnderReordering(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	receiver := startLocalNetworkWith(t, ctx, "reorder-receiver", func(cfg *config.Config) {
+		injectFaults(cfg)
+		cfg.P2P.OrderedDelivery.Enabled = true
+		cfg.P2P.OrderedDelivery.GapTimeoutMS = 2000
+	})
+	sender := startLocalNetworkWith(t, ctx, "reorder-sender", func(cfg *config.Config) {
+		injectFaults(cfg)
+		cfg.P2P.ReliableJournal.Enabled = true
+	})
+	_, err := sender.Connect(ctx, localAddr(receiver))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(receiver.ConnectedPeers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	var mu sync.Mutex
+	var seqs []uint64
+	delivered := make(map[int]int)
+	receiver.RegisterHandler("NOTE", func(msg Message) {
+		var note int
+		if msg.DecodePayload(&note) != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		seqs = append(seqs, msg.Seq)
+		delivered[note]++
+	})
+
+	// Frames to the receiver are held back by up to 40ms each, so later
+	// ones often overtake earlier ones, and some arrive twice
+	require.NoError(t, sender.InjectFaults("reorder-receiver", faults.Faults{
+		Delay:     faults.Uniform(0, 40*time.Millisecond),
+		Duplicate: 0.1,
+	}))
+
+	const count = 50
+	var wg sync.WaitGroup
+	for i := 1; i <= count; i++ {
+		wg.Add(1)
+		go func(note int) {
+			defer wg.Done()
+			assert.NoError(t, sender.SendMessageReliable(ctx, "reorder-receiver", NewMessage("NOTE", sender.nodeID, note)))
+		}(i)
+	}
+	wg.Wait()
+
+	// Every message was acknowledged, and each is handled exactly once, in
+	// the order it was sent
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(seqs) >= count
+	}, 5*time.Second, 20*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, delivered, count)
+	for note, times := range delivered {
+		assert.Equal(t, 1, times, "note %d", note)
+	}
+	for i := 1; i < len(seqs); i++ {
+		assert.Less(t, seqs[i-1], seqs[i])
+	}
+	assert.Zero(t, sender.outbox.Stats().Pending)
+	assert.NotZero(t, receiver.monitor.Stats.GetStats().MessagesReordered)
+	assert.NotZero(t, sender.Faults().Stats().Duplicated)
+}
+
+func TestHandshakeUnderCorruption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := startLocalNetworkWith(t, ctx, "corrupt-a", injectFaults)
+	b := startLocalNetworkWith(t, ctx, "corrupt-b", injectFaults)
+
+	// Every frame a writes to b has a byte flipped, the handshake included
+	a.Faults().Set(localAddr(b), faults.Faults{Corrupt: 1})
+	dialCtx, dialCancel := context.WithTimeout(ctx, 2*time.Second)
+	_, err := a.Connect(dialCtx, localAddr(b))
+	dialCancel()
+	require.Error(t, err)
+	assert.NotZero(t, a.Faults().Stats().Corrupted)
+
+	// Neither side took up a peer it could not verify
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, a.ConnectedPeers())
+	assert.Empty(t, b.ConnectedPeers())
+
+	// Once the link is clean the same peers connect
+	a.Faults().Clear(localAddr(b))
+	peerID, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	assert.Equal(t, "corrupt-b", peerID)
+}
@@ -0,0 +1,228 @@
+package p2p
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+)
+
+const (
+	// DefaultFlapHistory is how many connects and disconnects are kept for
+	// each peer
+	DefaultFlapHistory = 32
+)
+
+// ErrPeerDamped is returned for an automatic dial of a peer that is damped
+// for flapping
+var ErrPeerDamped = errors.New("peer is damped for flapping")
+
+// FlapEvent is a connection to a peer opening or closing
+type FlapEvent struct {
+	Time      time.Time `json:"time"`
+	Connected bool      `json:"connected"`
+}
+
+// FlapState describes how a peer's connections came and went recently and
+// whether it is damped for it
+type FlapState struct {
+	PeerID string `json:"peer_id"`
+	// History lists the peer's latest connects and disconnects, oldest
+	// first
+	History []FlapEvent `json:"history,omitempty"`
+	// Flaps counts the disconnects within the damping window
+	Flaps int `json:"flaps"`
+	// Penalty is how long the peer was last damped for, and DampedUntil
+	// when that ends; Damped is set until then
+	Damped      bool          `json:"damped"`
+	DampedUntil time.Time     `json:"damped_until,omitempty"`
+	Penalty     time.Duration `json:"penalty,omitempty"`
+}
+
+// flapHistory is what a flapTracker remembers of one peer
+type flapHistory struct {
+	events      []FlapEvent
+	penalty     time.Duration
+	dampedUntil time.Time
+}
+
+// flapTracker records when peers connect and disconnect and, if enabled,
+// damps those that disconnect threshold times within window. The first
+// damping lasts penalty; each one after doubles the last, up to maxPenalty,
+// after the last was halved for every window that passed since it ended.
+type flapTracker struct {
+	enabled    bool
+	threshold  int
+	window     time.Duration
+	penalty    time.Duration
+	maxPenalty time.Duration
+	now        func() time.Time
+
+	peers map[string]*flapHistory
+	mu    sync.Mutex
+}
+
+// newFlapTracker creates a tracker configured by cfg
+func newFlapTracker(cfg config.FlapDampingConfig) *flapTracker {
+	return &flapTracker{
+		enabled:    cfg.Enabled,
+		threshold:  cfg.Threshold,
+		window:     time.Duration(cfg.Window) * time.Second,
+		penalty:    time.Duration(cfg.Penalty) * time.Second,
+		maxPenalty: time.Duration(cfg.MaxPenalty) * time.Second,
+		now:        time.Now,
+		peers:      make(map[string]*flapHistory),
+	}
+}
+
+// Connected records that a connection to peerID opened
+func (t *flapTracker) Connected(peerID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.recordLocked(peerID, true)
+}
+
+// Disconnected records that the connection to peerID closed. If that damps
+// the peer it returns the penalty, otherwise 0.
+func (t *flapTracker) Disconnected(peerID string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history, now := t.recordLocked(peerID, false), t.now()
+	if !t.enabled || t.flapsLocked(history, now) < t.threshold {
+		return 0
+	}
+
+	// The last penalty halves for every window the peer went undamped
+	penalty := history.penalty
+	if quiet := now.Sub(history.dampedUntil); quiet > 0 && t.window > 0 {
+		for halvings := quiet / t.window; halvings > 0 && penalty > 0; halvings-- {
+			penalty /= 2
+		}
+	}
+	if penalty < t.penalty {
+		penalty = t.penalty
+	} else {
+		penalty = min(2*penalty, t.maxPenalty)
+	}
+	history.penalty = penalty
+	history.dampedUntil = now.Add(penalty)
+	return penalty
+}
+
+// DampedFor returns how much longer peerID is damped, or 0 if it is not
+func (t *flapTracker) DampedFor(peerID string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history, exists := t.peers[peerID]
+	if !exists || !t.enabled {
+		return 0
+	}
+	return max(history.dampedUntil.Sub(t.now()), 0)
+}
+
+// Damped reports whether peerID is damped
+func (t *flapTracker) Damped(peerID string) bool {
+	return t.DampedFor(peerID) > 0
+}
+
+// State describes peerID's recent connections
+func (t *flapTracker) State(peerID string) FlapState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history, exists := t.peers[peerID]
+	if !exists {
+		return FlapState{PeerID: peerID}
+	}
+	return t.stateLocked(peerID, history, t.now())
+}
+
+// Flapping describes the peers that disconnected within the damping window
+// or are damped, by ID
+func (t *flapTracker) Flapping() []FlapState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var states []FlapState
+	for peerID, history := range t.peers {
+		if state := t.stateLocked(peerID, history, now); state.Flaps > 0 || state.Damped {
+			states = append(states, state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].PeerID < states[j].PeerID })
+	return states
+}
+
+// stateLocked describes a peer's history; callers must hold t.mu
+func (t *flapTracker) stateLocked(peerID string, history *flapHistory, now time.Time) FlapState {
+	state := FlapState{
+		PeerID:  peerID,
+		History: append([]FlapEvent(nil), history.events...),
+		Flaps:   t.flapsLocked(history, now),
+		Penalty: history.penalty,
+	}
+	if t.enabled && now.Before(history.dampedUntil) {
+		state.Damped = true
+		state.DampedUntil = history.dampedUntil
+	}
+	return state
+}
+
+// recordLocked adds an event to a peer's history, forgetting the peers that
+// were quiet long enough for any penalty to have run out; callers must hold
+// t.mu
+func (t *flapTracker) recordLocked(peerID string, connected bool) *flapHistory {
+	now := t.now()
+	for id, history := range t.peers {
+		last := history.events[len(history.events)-1].Time
+		if id != peerID && now.Sub(last) > t.window+t.maxPenalty && now.After(history.dampedUntil) {
+			delete(t.peers, id)
+		}
+	}
+
+	history, exists := t.peers[peerID]
+	if !exists {
+		history = &flapHistory{}
+		t.peers[peerID] = history
+	}
+	history.events = append(history.events, FlapEvent{Time: now, Connected: connected})
+	if len(history.events) > DefaultFlapHistory {
+		history.events = history.events[len(history.events)-DefaultFlapHistory:]
+	}
+	return history
+}
+
+// flapsLocked counts a peer's disconnects within the window; callers must
+// hold t.mu
+func (t *flapTracker) flapsLocked(history *flapHistory, now time.Time) int {
+	flaps := 0
+	for _, event := range history.events {
+		if !event.Connected && now.Sub(event.Time) < t.window {
+			flaps++
+		}
+	}
+	return flaps
+}
+
+// FlappingPeers describes the peers that disconnected within the flap
+// damping window or are damped, connected or not
+func (n *Network) FlappingPeers() []FlapState {
+	return n.flaps.Flapping()
+}
+
+// recordDisconnect adds a closed connection to its peer's history, damping
+// the peer if it flaps
+func (n *Network) recordDisconnect(peerID string) {
+	penalty := n.flaps.Disconnected(peerID)
+	if penalty == 0 {
+		return
+	}
+	n.monitor.Stats.IncrementPeersDamped()
+	n.logger.Warnf("peer %s disconnected %d times within %v, damping it for %v",
+		peerID, n.flaps.State(peerID).Flaps, n.flaps.window, penalty)
+}
@@ -0,0 +1,179 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlapDampingSchedule(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tracker := newFlapTracker(config.FlapDampingConfig{Enabled: true, Threshold: 3, Window: 60, Penalty: 30, MaxPenalty: 120})
+	tracker.now = func() time.Time { return now }
+	flap := func() time.Duration {
+		tracker.Connected("peer")
+		now = now.Add(time.Second)
+		return tracker.Disconnected("peer")
+	}
+
+	assert.Zero(t, flap())
+	assert.Zero(t, flap())
+	assert.False(t, tracker.Damped("peer"))
+
+	// The third disconnect within the window damps the peer
+	assert.Equal(t, 30*time.Second, flap())
+	assert.True(t, tracker.Damped("peer"))
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, 20*time.Second, tracker.DampedFor("peer"))
+
+	// Flapping on doubles the penalty each time, up to the maximum
+	var schedule []time.Duration
+	for i := 0; i < 4; i++ {
+		schedule = append(schedule, flap())
+	}
+	assert.Equal(t, []time.Duration{60 * time.Second, 120 * time.Second, 120 * time.Second, 120 * time.Second}, schedule)
+
+	state := tracker.State("peer")
+	assert.True(t, state.Damped)
+	assert.Equal(t, now.Add(120*time.Second), state.DampedUntil)
+	assert.Equal(t, 7, state.Flaps)
+	require.Len(t, state.History, 14)
+	assert.True(t, state.History[0].Connected)
+	assert.False(t, state.History[13].Connected)
+
+	// The penalty halves for each window the peer stays undamped: two
+	// windows after the damping ends, 120 seconds are down to 30, which the
+	// next damping doubles
+	now = state.DampedUntil.Add(2 * time.Minute)
+	assert.False(t, tracker.Damped("peer"))
+	assert.Zero(t, tracker.State("peer").Flaps)
+	assert.Zero(t, flap())
+	assert.Zero(t, flap())
+	assert.Equal(t, 60*time.Second, flap())
+
+	// After long enough the peer is forgotten
+	now = now.Add(time.Hour)
+	tracker.Connected("other")
+	assert.Empty(t, tracker.State("peer").History)
+	assert.Empty(t, tracker.Flapping())
+}
+
+func TestFlapHistoryWithoutDamping(t *testing.T) {
+	tracker := newFlapTracker(config.Default().P2P.FlapDamping)
+	for i := 0; i < DefaultFlapHistory; i++ {
+		tracker.Connected("peer-b")
+		assert.Zero(t, tracker.Disconnected("peer-b"))
+	}
+	tracker.Connected("peer-a")
+
+	assert.False(t, tracker.Damped("peer-b"))
+	flapping := tracker.Flapping()
+	require.Len(t, flapping, 1)
+	assert.Equal(t, "peer-b", flapping[0].PeerID)
+	assert.Equal(t, DefaultFlapHistory/2, flapping[0].Flaps)
+	assert.Len(t, flapping[0].History, DefaultFlapHistory, "the history is bounded")
+	assert.False(t, flapping[0].Damped)
+}
+
+// startDampingNetwork starts a network on the in-memory network as host that
+// damps peers disconnecting twice within a minute, for 200ms at first and
+// 800ms at most, and dials nothing but its static peers
+func startDampingNetwork(t *testing.T, ctx context.Context, nodeID, host string, staticPeers ...string) *Network {
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.P2P.MinPeers = 0
+	cfg.P2P.TargetPeers = 0
+	cfg.P2P.DiscoveryFloor = 0
+	cfg.P2P.StaticPeers = staticPeers
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+
+	network, err := New(cfg, log, nodeID)
+	require.NoError(t, err)
+	network.SetTransport(memoryNetwork.Host(host))
+	network.staticRetryDelay = 20 * time.Millisecond
+	network.flaps = newFlapTracker(config.FlapDampingConfig{Enabled: true, Threshold: 2, Window: 60})
+	network.flaps.penalty = 200 * time.Millisecond
+	network.flaps.maxPenalty = 800 * time.Millisecond
+	require.NoError(t, network.Start(ctx))
+	t.Cleanup(func() { network.Stop() })
+	return network
+}
+
+func TestFlappingPeerIsDamped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	flappy := startDampingNetwork(t, ctx, "flappy-peer", "flappy-peer-host")
+	hub := startDampingNetwork(t, ctx, "flap-hub", "flap-hub-host", "flappy-peer@"+localAddr(flappy))
+	require.Eventually(t, func() bool {
+		return hub.liveConnection("flappy-peer") != nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// flappy drops every connection the hub's static peer dialing sets up
+	drop := func() {
+		dropped := hub.liveConnection("flappy-peer")
+		require.NotNil(t, dropped)
+		require.Eventually(t, func() bool {
+			connection := flappy.liveConnection("flap-hub")
+			return connection != nil && connection.active()
+		}, 5*time.Second, 20*time.Millisecond)
+		flappy.liveConnection("flap-hub").closeWith("flapping")
+		require.Eventually(t, func() bool {
+			connection := hub.liveConnection("flappy-peer")
+			return connection != nil && connection != dropped
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		drop()
+	}
+
+	// The first disconnect is redialed at once, then each redial waits out
+	// a penalty twice the last, up to the maximum
+	state := hub.flaps.State("flappy-peer")
+	require.Len(t, state.History, 11)
+	expected := []time.Duration{0, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, 800 * time.Millisecond}
+	for i, penalty := range expected {
+		disconnected, reconnected := state.History[2*i+1], state.History[2*i+2]
+		require.False(t, disconnected.Connected)
+		require.True(t, reconnected.Connected)
+		gap := reconnected.Time.Sub(disconnected.Time)
+		assert.GreaterOrEqual(t, gap, penalty, "redial %d", i+1)
+		if penalty == 0 {
+			assert.Less(t, gap, 200*time.Millisecond, "redial %d", i+1)
+		}
+	}
+	assert.Equal(t, 800*time.Millisecond, state.Penalty)
+	assert.Equal(t, uint64(4), hub.monitor.Stats.GetStats().PeersDamped)
+
+	// A damped peer that dials in is connected, but left out of broadcasts
+	flappy.liveConnection("flap-hub").closeWith("flapping")
+	require.Eventually(t, func() bool {
+		return hub.liveConnection("flappy-peer") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, hub.flaps.Damped("flappy-peer"))
+	_, err := flappy.Connect(ctx, localAddr(hub))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return hub.liveConnection("flappy-peer") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	result, err := hub.Broadcast(ctx, NewMessage("NOTE", hub.nodeID, "to all"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"flappy-peer"}, result.Damped)
+	assert.Empty(t, result.Succeeded)
+
+	peer, ok := hub.Peer("flappy-peer")
+	require.True(t, ok)
+	assert.True(t, peer.Flaps.Damped)
+	assert.Equal(t, 6, peer.Flaps.Flaps)
+	flapping := hub.FlappingPeers()
+	require.Len(t, flapping, 1)
+	assert.Equal(t, "flappy-peer", flapping[0].PeerID)
+}
@@ -0,0 +1,247 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+var (
+	// ErrMessageTooLarge is returned when a message does not fit in one frame
+	ErrMessageTooLarge = errors.New("message exceeds maximum message size")
+
+	// errFragmentInvalid is returned for a fragment that contradicts itself
+	// or the rest of its group
+	errFragmentInvalid = errors.New("invalid fragment")
+	// errFragmentMemory is returned when buffering a fragment would exceed
+	// the reassembly memory cap
+	errFragmentMemory = errors.New("fragment reassembly memory exhausted")
+	// errFragmentChecksum is returned when a reassembled message does not
+	// match its checksum
+	errFragmentChecksum = errors.New("fragment checksum mismatch")
+)
+
+// fragmentGroup is a message whose fragments are still arriving
+type fragmentGroup struct {
+	total    int
+	checksum string
+	codec    string
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// reassembler buffers fragments per peer and group until their message is
+// complete, within a memory cap and a per-group timeout
+type reassembler struct {
+	groups    map[string]*fragmentGroup
+	buffered  int
+	maxMemory int
+	timeout   time.Duration
+	mu        sync.Mutex
+}
+
+// newReassembler creates a reassembler buffering at most maxMemory bytes
+// and dropping groups older than timeout
+func newReassembler(maxMemory int, timeout time.Duration) *reassembler {
+	return &reassembler{
+		groups:    make(map[string]*fragmentGroup),
+		maxMemory: maxMemory,
+		timeout:   timeout,
+	}
+}
+
+// add buffers a fragment from peerID. It returns the message bytes and
+// their codec once the group is complete. On error the whole group is
+// dropped.
+func (r *reassembler) add(peerID string, frag *FragmentPayload, now time.Time) ([]byte, Codec, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := peerID + "/" + frag.GroupID
+	group, exists := r.groups[key]
+	if !exists {
+		if frag.Total < 1 || frag.Total > MaxFragments {
+			return nil, nil, fmt.Errorf("%w: %d fragments", errFragmentInvalid, frag.Total)
+		}
+		group = &fragmentGroup{
+			total:    frag.Total,
+			checksum: frag.Checksum,
+			codec:    frag.Codec,
+			parts:    make([][]byte, frag.Total),
+			started:  now,
+		}
+		r.groups[key] = group
+	}
+
+	switch {
+	case frag.Total != group.total || frag.Checksum != group.checksum || frag.Codec != group.codec:
+		r.drop(key)
+		return nil, nil, fmt.Errorf("%w: fragment %d disagrees with its group", errFragmentInvalid, frag.Index)
+	case frag.Index < 0 || frag.Index >= group.total:
+		r.drop(key)
+		return nil, nil, fmt.Errorf("%w: index %d of %d", errFragmentInvalid, frag.Index, group.total)
+	case group.parts[frag.Index] != nil:
+		// A retransmitted fragment adds nothing
+		return nil, nil, nil
+	case r.buffered+len(frag.Data) > r.maxMemory:
+		r.drop(key)
+		return nil, nil, errFragmentMemory
+	}
+
+	group.parts[frag.Index] = frag.Data
+	group.received++
+	group.size += len(frag.Data)
+	r.buffered += len(frag.Data)
+	if group.received < group.total {
+		return nil, nil, nil
+	}
+
+	r.drop(key)
+	data := make([]byte, 0, group.size)
+	for _, part := range group.parts {
+		data = append(data, part...)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != group.checksum {
+		return nil, nil, errFragmentChecksum
+	}
+	codec, known := CodecByName(group.codec)
+	if !known {
+		return nil, nil, fmt.Errorf("%w: unknown codec %q", errFragmentInvalid, group.codec)
+	}
+	return data, codec, nil
+}
+
+// expire drops the groups that have waited longer than the timeout and
+// returns how many it dropped
+func (r *reassembler) expire(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expired := 0
+	for key, group := range r.groups {
+		if now.Sub(group.started) > r.timeout {
+			r.drop(key)
+			expired++
+		}
+	}
+	return expired
+}
+
+// pending returns the number of groups waiting for fragments
+func (r *reassembler) pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.groups)
+}
+
+// drop forgets a group and releases its memory. r.mu must be held.
+func (r *reassembler) drop(key string) {
+	if group, exists := r.groups[key]; exists {
+		r.buffered -= group.size
+		delete(r.groups, key)
+	}
+}
+
+// sendFragments splits a message too large for one frame into FRAGMENTs
+func (n *Network) sendFragments(connection *Connection, msg Message) error {
+	codec := frameCodec(connection.Codec(), msg)
+	data, err := msg.SerializeWith(codec)
+	if err != nil {
+		return fmt.Errorf("failed to serialize message: %w", err)
+	}
+
+	total := (len(data) + DefaultFragmentSize - 1) / DefaultFragmentSize
+	if total > MaxFragments {
+		return fmt.Errorf("%s message of %d bytes needs more than %d fragments: %w", msg.Type, len(data), MaxFragments, ErrMessageTooLarge)
+	}
+	sum := sha256.Sum256(data)
+	groupID := uuid.NewString()
+
+	for i := 0; i < total; i++ {
+		end := (i + 1) * DefaultFragmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		fragment := NewMessage(MessageTypeFragment, n.nodeID, FragmentPayload{
+			GroupID:   groupID,
+			MessageID: msg.ID,
+			Index:     i,
+			Total:     total,
+			Checksum:  hex.EncodeToString(sum[:]),
+			Codec:     codec.Name(),
+			Data:      data[i*DefaultFragmentSize : end],
+		})
+		if err := n.send(connection, fragment); err != nil {
+			return fmt.Errorf("failed to send fragment %d of %d: %w", i+1, total, err)
+		}
+	}
+
+	n.monitor.Stats.IncrementMessagesFragmented()
+	n.messageLogger(&msg).Debugf("sent %s message %s to %s in %d fragments", msg.Type, msg.ID, connection.PeerID, total)
+	return nil
+}
+
+// handleFragmentMessage buffers a fragment and, once its message is
+// complete, processes the message as if it had arrived in one frame
+func (n *Network) handleFragmentMessage(msg *Message, conn *Connection) error {
+	var frag FragmentPayload
+	if err := msg.DecodePayload(&frag); err != nil {
+		return err
+	}
+
+	data, codec, err := n.fragments.add(conn.PeerID, &frag, time.Now())
+	switch {
+	case errors.Is(err, errFragmentMemory):
+		// Not the sender's fault; it may retry once we have room
+		n.monitor.Stats.IncrementFragmentFailures()
+		n.sendError(conn, frag.MessageID, ErrorCodeFragmentFailed, err.Error())
+		return err
+	case err != nil:
+		n.monitor.Stats.IncrementFragmentFailures()
+		n.rejectMessage(conn, frag.MessageID, ErrorCodeFragmentFailed, err.Error(), topology.EventInvalidMessage)
+		return err
+	case data == nil:
+		return nil
+	}
+
+	original, err := DeserializeMessageWith(codec, data)
+	if err != nil {
+		n.monitor.Stats.IncrementFragmentFailures()
+		n.rejectMessage(conn, frag.MessageID, ErrorCodeInvalidMessage, "reassembled message could not be decoded", topology.EventDeserializeFailure)
+		return fmt.Errorf("failed to decode reassembled message: %w", err)
+	}
+	n.monitor.Stats.IncrementMessagesReassembled()
+	n.processDecoded(original, conn)
+	return nil
+}
+
+// expireFragments periodically drops partly received messages whose
+// remaining fragments did not arrive in time
+func (n *Network) expireFragments() {
+	interval := n.fragments.timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for expired := n.fragments.expire(now); expired > 0; expired-- {
+				n.monitor.Stats.IncrementFragmentFailures()
+			}
+		}
+	}
+}
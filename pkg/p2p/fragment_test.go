@@ -0,0 +1,176 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fragmentsOf splits data into the payloads of a fragment group
+func fragmentsOf(data []byte, size int) []*FragmentPayload {
+	sum := sha256.Sum256(data)
+	total := (len(data) + size - 1) / size
+
+	var frags []*FragmentPayload
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		frags = append(frags, &FragmentPayload{
+			GroupID:   "group",
+			MessageID: "message",
+			Index:     i,
+			Total:     total,
+			Checksum:  hex.EncodeToString(sum[:]),
+			Codec:     CodecJSON.Name(),
+			Data:      data[i*size : end],
+		})
+	}
+	return frags
+}
+
+func TestReassembler(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	now := time.Now()
+
+	t.Run("out of order", func(t *testing.T) {
+		r := newReassembler(1024, time.Minute)
+		frags := fragmentsOf(data, 10)
+		for i := len(frags) - 1; i > 0; i-- {
+			got, _, err := r.add("peer", frags[i], now)
+			require.NoError(t, err)
+			assert.Nil(t, got)
+		}
+
+		// Retransmitted fragments are ignored
+		got, _, err := r.add("peer", frags[1], now)
+		require.NoError(t, err)
+		assert.Nil(t, got)
+
+		got, codec, err := r.add("peer", frags[0], now)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+		assert.Equal(t, CodecJSON, codec)
+		assert.Zero(t, r.pending())
+		assert.Zero(t, r.buffered)
+	})
+
+	t.Run("groups are per peer", func(t *testing.T) {
+		r := newReassembler(1024, time.Minute)
+		frags := fragmentsOf(data, 30)
+		_, _, err := r.add("peer-a", frags[0], now)
+		require.NoError(t, err)
+		got, _, err := r.add("peer-b", frags[1], now)
+		require.NoError(t, err)
+		assert.Nil(t, got)
+		assert.Equal(t, 2, r.pending())
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		r := newReassembler(1024, time.Minute)
+		frags := fragmentsOf(data, 30)
+		frags[1].Data = []byte("tampered")
+		_, _, err := r.add("peer", frags[0], now)
+		require.NoError(t, err)
+		_, _, err = r.add("peer", frags[1], now)
+		assert.ErrorIs(t, err, errFragmentChecksum)
+		assert.Zero(t, r.pending())
+	})
+
+	t.Run("inconsistent group", func(t *testing.T) {
+		r := newReassembler(1024, time.Minute)
+		frags := fragmentsOf(data, 10)
+		_, _, err := r.add("peer", frags[0], now)
+		require.NoError(t, err)
+		frags[1].Total = 2
+		_, _, err = r.add("peer", frags[1], now)
+		assert.ErrorIs(t, err, errFragmentInvalid)
+		assert.Zero(t, r.pending())
+		assert.Zero(t, r.buffered)
+
+		_, _, err = r.add("peer", &FragmentPayload{GroupID: "g", Index: 3, Total: 2}, now)
+		assert.ErrorIs(t, err, errFragmentInvalid)
+		_, _, err = r.add("peer", &FragmentPayload{GroupID: "g", Total: MaxFragments + 1}, now)
+		assert.ErrorIs(t, err, errFragmentInvalid)
+	})
+
+	t.Run("memory cap", func(t *testing.T) {
+		r := newReassembler(25, time.Minute)
+		frags := fragmentsOf(data, 10)
+		for _, frag := range frags[:2] {
+			_, _, err := r.add("peer", frag, now)
+			require.NoError(t, err)
+		}
+		_, _, err := r.add("peer", frags[2], now)
+		assert.ErrorIs(t, err, errFragmentMemory)
+		assert.Zero(t, r.buffered)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		r := newReassembler(1024, time.Minute)
+		frags := fragmentsOf(data, 10)
+		_, _, err := r.add("peer", frags[0], now)
+		require.NoError(t, err)
+
+		assert.Zero(t, r.expire(now.Add(30*time.Second)))
+		assert.Equal(t, 1, r.expire(now.Add(2*time.Minute)))
+		assert.Zero(t, r.pending())
+		assert.Zero(t, r.buffered)
+	})
+}
+
+func TestLargeMessageFragmented(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sender, receiver := connectPair(t, ctx, "sender-node", "receiver-node")
+
+	blob := make([]byte, 10*1024*1024)
+	_, err := rand.Read(blob)
+	require.NoError(t, err)
+	want := sha256.Sum256(blob)
+
+	delivered := make(chan [32]byte, 1)
+	receiver.RegisterHandler("BLOB", func(msg Message) {
+		var got []byte
+		if msg.DecodePayload(&got) == nil {
+			delivered <- sha256.Sum256(got)
+		}
+	})
+
+	require.NoError(t, sender.SendMessage(ctx, "receiver-node", NewMessage("BLOB", "sender-node", blob)))
+	select {
+	case got := <-delivered:
+		assert.Equal(t, want, got)
+	case <-time.After(30 * time.Second):
+		t.Fatal("fragmented message not delivered")
+	}
+
+	assert.Equal(t, uint64(1), sender.monitor.Stats.GetStats().MessagesFragmented)
+	assert.Equal(t, uint64(1), receiver.monitor.Stats.GetStats().MessagesReassembled)
+	assert.Zero(t, receiver.fragments.pending())
+}
+
+func TestPartialFragmentGroupExpires(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetworkWith(t, ctx, "fragment-node", nil, func(n *Network) {
+		n.fragments = newReassembler(DefaultFragmentMemory, 50*time.Millisecond)
+	})
+
+	peer, remote, _ := attachPipePeer(t, network, "flaky-peer")
+	frags := fragmentsOf([]byte("only half of this ever arrives"), 16)
+	writeFrame(t, remote, NewMessage(MessageTypeFragment, peer.ID, frags[0]))
+
+	require.Eventually(t, func() bool {
+		return network.monitor.Stats.GetStats().FragmentFailures == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, network.fragments.pending())
+}
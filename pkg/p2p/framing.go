@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+)
+
+// errFrameTooLarge is returned when a frame exceeds MaxMessageSize
+var errFrameTooLarge = errors.New("frame exceeds maximum message size")
+
+// readCodecFrame reads one frame in any codec, returning the codec it is in.
+// The frame may share the reader's buffer, so it must be processed before
+// the next read.
+func readCodecFrame(reader *bufio.Reader, maxSize int) (Codec, []byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if codec, binary := codecByID(first[0]); binary && codec != CodecJSON {
+		reader.Discard(1)
+		data, err := readBinaryFrame(reader, maxSize)
+		return codec, data, err
+	}
+
+	data, err := readFrame(reader, maxSize)
+	return CodecJSON, data, err
+}
+
+// readFrame reads one newline-delimited frame of at most maxSize bytes. A
+// frame that fits the reader's buffer is returned in place, valid until the
+// next read; longer ones are copied together. Oversized frames are consumed
+// up to their terminating newline and reported with errFrameTooLarge so the
+// stream stays aligned.
+func readFrame(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	var frame bytes.Buffer
+	oversize := false
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if err == nil && frame.Len() == 0 && !oversize {
+			// The whole frame is in the reader's buffer
+			if len(chunk) > maxSize+1 {
+				return nil, errFrameTooLarge
+			}
+			return chunk, nil
+		}
+		if !oversize {
+			if frame.Len()+len(chunk) > maxSize+1 {
+				oversize = true
+				frame.Reset()
+			} else {
+				frame.Write(chunk)
+			}
+		}
+
+		switch {
+		case err == nil:
+			if oversize {
+				return nil, errFrameTooLarge
+			}
+			return frame.Bytes(), nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		default:
+			return nil, err
+		}
+	}
+}
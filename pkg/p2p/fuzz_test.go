@@ -0,0 +1,218 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// wireMessages returns messages of every payload type as nodes send them,
+// to seed the fuzz targets with what peers actually put on the wire
+func wireMessages(tb testing.TB) []Message {
+	batched := NewMessage(MessageTypeHeartbeat, "fuzz-node", HeartbeatPayload{NodeID: "fuzz-node", TS: time.Now().Unix(), Connections: 3})
+	inner, err := batched.Serialize()
+	require.NoError(tb, err)
+	request := NewMessage(MessageTypeAIRequest, "fuzz-node", AIRequestPayload{Message: "summarise the mesh"})
+	large, err := request.Serialize()
+	require.NoError(tb, err)
+
+	gossip := NewMessage(MessageTypeDataSync, "fuzz-node", DataSyncPayload{DataID: "model", Type: "config", Content: map[string]interface{}{"layers": 12}, Version: 4, Timestamp: time.Now().Unix()})
+	gossip.Origin = "fuzz-origin"
+	gossip.HopLimit = 3
+	reliable := NewMessage("NOTE", "fuzz-node", "remember")
+	reliable.RequireAck = true
+
+	return []Message{
+		NewMessage(MessageTypeHello, "fuzz-node", HelloPayload{NodeID: "fuzz-node", Version: ProtocolVersion, MinVersion: MinProtocolVersion, ListenPort: 8080, Capabilities: []string{CapabilitySync, CapabilityCBOR, CapabilityBatch}, QUICPort: 8080, Metadata: map[string]string{"region": "eu"}}),
+		NewMessage(MessageTypePeerList, "fuzz-node", PeerListPayload{Peers: []PeerInfo{{ID: "peer-a", Address: "10.0.0.1:8080", Version: ProtocolVersion}}, HasMore: true, NextCursor: "peer-a"}),
+		NewMessage(MessageTypePeerListRequest, "fuzz-node", PeerListRequestPayload{Cursor: "peer-a", Limit: 50}),
+		gossip,
+		batched,
+		NewMessage(MessageTypeError, "fuzz-node", ErrorPayload{Code: ErrorCodeInvalidMessage, Message: "bad", MessageID: "m1"}),
+		NewMessage(MessageTypeGoodbye, "fuzz-node", GoodbyePayload{Reason: "shutting down"}),
+		NewMessage(MessageTypeTopologyReport, "fuzz-node", TopologyReportPayload{Peers: []string{"peer-a", "peer-b"}}),
+		NewMessage(MessageTypeSyncRequest, "fuzz-node", SyncRequestPayload{Keys: []string{"model"}, Since: 3}),
+		NewMessage(MessageTypeSyncResponse, "fuzz-node", SyncResponsePayload{Entries: []DataSyncPayload{{DataID: "model", Version: 4}}, Watermark: 9, More: true}),
+		NewMessage(MessageTypeAIRequest, "fuzz-node", AIRequestPayload{Message: "hello", History: []AITurn{{Role: "user", Content: "hi"}}, Stream: true}),
+		NewMessage(MessageTypeAIResponse, "fuzz-node", AIResponsePayload{Text: "hello", Model: "llama", LatencyMs: 120, Chunks: 2}),
+		NewMessage(MessageTypeAIResponseChunk, "fuzz-node", AIResponseChunkPayload{RequestID: "m1", Index: 1, Text: "lo"}),
+		NewMessage(MessageTypeAICancel, "fuzz-node", AICancelPayload{RequestID: "m1"}),
+		NewMessage(MessageTypeFragment, "fuzz-node", FragmentPayload{GroupID: "g1", MessageID: "m1", Index: 0, Total: 2, Checksum: "00", Codec: CodecJSON.Name(), Data: large[:len(large)/2]}),
+		NewMessage(MessageTypeBatch, "fuzz-node", BatchPayload{Codec: CodecJSON.Name(), Messages: [][]byte{inner, inner}}),
+		NewMessage(MessageTypeTrace, "fuzz-node", TracePayload{Origin: "fuzz-node", Destination: "peer-b", Hops: []HopInfo{{NodeID: "peer-a", Latency: time.Millisecond}}}),
+		NewMessage(MessageTypeTaskSubmit, "fuzz-node", TaskSubmitPayload{TaskID: "t1", Name: "resize", Input: []byte("image"), TimeoutMs: 1000}),
+		NewMessage(MessageTypeTaskResult, "fuzz-node", TaskResultPayload{TaskID: "t1", Output: []byte("done"), DurationMs: 5, Running: 1, Capacity: 4}),
+		NewMessage(MessageTypeTaskStatus, "fuzz-node", TaskStatusPayload{TaskID: "t1", State: "running", Running: 1, Capacity: 4}),
+		NewMessage(MessageTypeBlobAnnounce, "fuzz-node", BlobAnnouncePayload{Hashes: []string{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}}),
+		NewMessage(MessageTypeBlobRequest, "fuzz-node", BlobRequestPayload{Hash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", Offset: 0, Length: 4096}),
+		NewMessage(MessageTypeBlobChunk, "fuzz-node", BlobChunkPayload{Hash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", Size: 4, Data: []byte("test")}),
+		reliable,
+	}
+}
+
+func FuzzPayloadDecode(f *testing.F) {
+	for _, msg := range wireMessages(f) {
+		payload, err := json.Marshal(msg.Payload)
+		require.NoError(f, err)
+		f.Add(msg.Type, payload)
+	}
+	f.Add(MessageTypeKeyRotation, []byte(`{"rotation":{"node_id":"n","old_key":"","new_key":""}}`))
+
+	f.Fuzz(func(t *testing.T, msgType string, payload []byte) {
+		msg := Message{Type: msgType, Payload: json.RawMessage(payload)}
+		if msg.ValidatePayload() != nil {
+			return
+		}
+
+		// What handlers do with payloads that pass validation
+		switch msgType {
+		case MessageTypeBatch:
+			var batch BatchPayload
+			require.NoError(t, msg.DecodePayload(&batch))
+			codec, _ := CodecByName(batch.Codec)
+			for _, data := range batch.Messages {
+				messageID(codec, data)
+				DeserializeMessageWith(codec, data)
+			}
+		case MessageTypeFragment:
+			var frag FragmentPayload
+			require.NoError(t, msg.DecodePayload(&frag))
+			fragments := newReassembler(DefaultFragmentMemory, time.Minute)
+			fragments.add("fuzz-peer", &frag, time.Now())
+			fragments.add("fuzz-peer", &frag, time.Now())
+		case MessageTypeKeyRotation:
+			var rotation KeyRotationPayload
+			require.NoError(t, msg.DecodePayload(&rotation))
+			rotation.Rotation.Verify()
+		}
+	})
+}
+
+// FuzzHandshakeUnmarshal starts from the handshake messages of a real
+// exchange between two nodes, kept in testdata/fuzz, as generating keys
+// here would slow every fuzzing worker down
+func FuzzHandshakeUnmarshal(f *testing.F) {
+	// Verifying a peer's handshake needs no key of our own
+	handshakes := crypto.NewHandshakeManager(&crypto.Encryptor{}, "fuzz-node")
+	handshakes.SetProtocolVersions(ProtocolVersion, MinProtocolVersion)
+	networkKey := []byte("correct horse battery staple")
+	secret := make([]byte, crypto.SecretSize)
+	request := &crypto.HandshakeMessage{NodeID: "fuzz-node", Resume: &crypto.ResumeMessage{TicketID: crypto.TicketID(secret)}}
+
+	for _, code := range []string{ErrorCodeDuplicatePeer, ErrorCodeNetworkKeyMismatch, ErrorCodeNotImplemented} {
+		rejection := NewMessage(MessageTypeError, "fuzz-peer", ErrorPayload{Code: code, Message: "refused"})
+		data, err := rejection.Serialize()
+		require.NoError(f, err)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := parseHandshakeMessage(data)
+		if err != nil {
+			return
+		}
+
+		// The checks either side makes of a peer's handshake message
+		crypto.VerifyNetworkMAC(networkKey, msg)
+		crypto.VerifyNetworkMAC(networkKey, request, msg)
+		handshakes.VerifyHandshakeMessage(msg)
+		identityKey(msg)
+		negotiateVersion(ProtocolVersion, MinProtocolVersion, msg.ProtocolVersion, msg.MinProtocolVersion)
+		if msg.Resume != nil {
+			crypto.VerifyResumeRequest(msg, secret)
+			handshakes.CreateResumeResponse(msg, nil)
+			if msg.Resume.Accepted {
+				crypto.VerifyResumeResponse(msg, request, secret)
+				crypto.ResumedSecret(secret, request, msg)
+			}
+		}
+		if msg.Rotation != nil {
+			msg.Rotation.Verify()
+		}
+	})
+}
+
+// panickingPayload stands in for a payload whose checks have a bug that
+// input from a peer can reach
+type panickingPayload struct {
+	Boom bool `json:"boom"`
+}
+
+func (p *panickingPayload) validate() error {
+	if p.Boom {
+		panic("payload check bug")
+	}
+	return nil
+}
+
+func TestReadPanicClosesConnection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	RegisterPayloadType("PANIC_TEST", func() interface{} { return &panickingPayload{} })
+	sender, receiver := connectPair(t, ctx, "panic-sender", "panic-receiver")
+
+	require.NoError(t, sender.SendMessage(ctx, "panic-receiver", NewMessage("PANIC_TEST", sender.nodeID, panickingPayload{Boom: true})))
+	require.Eventually(t, func() bool {
+		return len(sender.ConnectedPeers()) == 0 && len(receiver.ConnectedPeers()) == 0
+	}, 5*time.Second, 20*time.Millisecond, "the connection the panic came on is closed")
+	assert.Equal(t, uint64(1), receiver.monitor.Stats.GetStats().ReadPanics)
+
+	// The node survives and accepts the peer again
+	receiver.RegisterHandler("ECHO", func(msg Message) {
+		receiver.Reply(msg, "ECHO_REPLY", msg.Payload)
+	})
+	_, err := sender.Connect(ctx, localAddr(receiver))
+	require.NoError(t, err)
+	_, err = sender.Request(ctx, "panic-receiver", NewMessage("ECHO", sender.nodeID, "still here"))
+	require.NoError(t, err)
+}
+
+func TestHandlerPanicIsolated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	receiver := startLocalNetwork(t, ctx, "handler-receiver")
+	faulty := startLocalNetwork(t, ctx, "handler-faulty")
+	healthy := startLocalNetwork(t, ctx, "handler-healthy")
+	for _, sender := range []*Network{faulty, healthy} {
+		_, err := sender.Connect(ctx, localAddr(receiver))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return len(receiver.ConnectedPeers()) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// An application handler with a bad type assertion, and another for the
+	// same type that must still see every message
+	var handled atomic.Int32
+	receiver.RegisterHandler("NOTE", func(msg Message) {
+		_ = msg.Payload.(map[string]interface{})
+	})
+	receiver.RegisterHandler("NOTE", func(msg Message) {
+		handled.Add(1)
+	})
+	receiver.RegisterHandler("ECHO", func(msg Message) {
+		receiver.Reply(msg, "ECHO_REPLY", msg.Payload)
+	})
+
+	require.NoError(t, faulty.SendMessage(ctx, "handler-receiver", NewMessage("NOTE", faulty.nodeID, "not a map")))
+	require.Eventually(t, func() bool {
+		return len(faulty.ConnectedPeers()) == 0
+	}, 5*time.Second, 20*time.Millisecond, "the connection the message came on is closed")
+	assert.Equal(t, int32(1), handled.Load())
+	assert.Equal(t, uint64(1), receiver.monitor.Stats.GetStats().HandlerPanics)
+
+	// The other peer is unaffected
+	connected := receiver.ConnectedPeers()
+	require.Len(t, connected, 1)
+	assert.Equal(t, "handler-healthy", connected[0].ID)
+	_, err := healthy.Request(ctx, "handler-receiver", NewMessage("ECHO", healthy.nodeID, "still here"))
+	require.NoError(t, err)
+}
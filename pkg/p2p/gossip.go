@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Gossip originates a message that is propagated through the mesh.
+// The message is sent to at most fanout peers chosen by the topology
+// manager, and every receiving node forwards it again until the hop
+// limit is exhausted. Nodes that have already seen the message ID drop it.
+func (n *Network) Gossip(msg Message, fanout int) error {
+	if fanout <= 0 {
+		fanout = DefaultGossipFanout
+	}
+	if msg.Origin == "" {
+		msg.Origin = n.nodeID
+	}
+	if msg.HopLimit <= 0 {
+		msg.HopLimit = DefaultGossipHopLimit
+	}
+	msg.Sender = n.nodeID
+	traceMessage(context.Background(), &msg)
+
+	if err := msg.Validate(); err != nil {
+		return fmt.Errorf("invalid gossip message: %w", err)
+	}
+
+	// Remember our own message so echoes from peers are suppressed
+	n.seen.Add(msg.ID)
+
+	return n.forwardGossip(msg, fanout, "")
+}
+
+// handleGossipMessage applies duplicate suppression and forwarding to a
+// received gossip message. It reports whether the message should be
+// delivered locally.
+func (n *Network) handleGossipMessage(msg *Message) bool {
+	if !n.seen.Add(msg.ID) {
+		atomic.AddUint64(&n.gossipDuplicates, 1)
+		n.messageLogger(msg).Debugf("suppressed duplicate gossip %s from %s", msg.ID, msg.Sender)
+		return false
+	}
+
+	if msg.HopLimit > 1 && n.config.P2P.EnableRelay {
+		forward := *msg
+		forward.HopLimit--
+		forward.Sender = n.nodeID
+		if err := n.forwardGossip(forward, DefaultGossipFanout, msg.Sender); err != nil {
+			n.messageLogger(msg).Debugf("failed to forward gossip %s: %v", msg.ID, err)
+		}
+	}
+
+	return true
+}
+
+// forwardGossip sends a gossip message to up to fanout peers, skipping the
+// peer we received it from and the node that originated it. A TOPIC message
+// goes to the peers subscribing to its topic first.
+func (n *Network) forwardGossip(msg Message, fanout int, fromPeerID string) error {
+	candidates := n.preferRelays(n.topologyMgr.GetOptimalPeersForBroadcast(fromPeerID, fanout+1))
+	if msg.Type == MessageTypeTopic {
+		candidates = n.preferSubscribers(&msg, fromPeerID, candidates)
+	}
+
+	var lastErr error
+	sent := 0
+	for _, peerID := range candidates {
+		if sent >= fanout {
+			break
+		}
+		if peerID == msg.Origin || peerID == n.nodeID || n.flaps.Damped(peerID) {
+			continue
+		}
+
+		if err := n.SendMessage(context.Background(), peerID, msg); err != nil {
+			lastErr = err
+			n.messageLogger(&msg).Debugf("failed to gossip %s to %s: %v", msg.ID, peerID, err)
+			continue
+		}
+		sent++
+	}
+
+	return lastErr
+}
+
+// preferRelays moves peers that advertised the relay capability to the front
+// so gossip keeps spreading; non-relay peers still receive it if there is room
+func (n *Network) preferRelays(peerIDs []string) []string {
+	relays := make([]string, 0, len(peerIDs))
+	var others []string
+	for _, peerID := range peerIDs {
+		if peer, exists := n.peers.Get(peerID); exists && peer.HasCapability(CapabilityRelay) {
+			relays = append(relays, peerID)
+		} else {
+			others = append(others, peerID)
+		}
+	}
+	return append(relays, others...)
+}
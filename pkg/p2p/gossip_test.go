@@ -0,0 +1,220 @@
+package p2p
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/p2ptest/memnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// transportFlag selects the transport tests connect networks over. Run
+// go test ./pkg/p2p -p2p.transport=memory to use the in-memory one.
+var transportFlag = flag.String("p2p.transport", "tcp", "transport for multi-node tests: tcp or memory")
+
+// memoryNetwork links the networks of tests run over the memory transport
+var memoryNetwork = memnet.New()
+
+// memoryHosts numbers memory hosts so every network gets its own name
+var memoryHosts uint64
+
+// testHost returns a fresh host on the in-memory network
+func testHost() *memnet.Host {
+	return memoryNetwork.Host(fmt.Sprintf("host-%d", atomic.AddUint64(&memoryHosts, 1)))
+}
+
+// requireTCP skips tests that need real sockets unless running over TCP
+func requireTCP(t *testing.T) {
+	if *transportFlag != "tcp" {
+		t.Skipf("needs TCP sockets, running over %s", *transportFlag)
+	}
+}
+
+// newLocalNetwork creates a network on the transport selected by
+// -p2p.transport
+func newLocalNetwork(t *testing.T, cfg *config.Config, nodeID string) *Network {
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+
+	network, err := New(cfg, log, nodeID)
+	require.NoError(t, err)
+
+	switch *transportFlag {
+	case "tcp":
+	case "memory":
+		network.SetTransport(testHost())
+	default:
+		t.Fatalf("unknown transport %q", *transportFlag)
+	}
+	return network
+}
+
+// dialLocal opens a raw connection to a started network over the test
+// transport, bypassing the handshake
+func dialLocal(n *Network) (net.Conn, error) {
+	if *transportFlag == "memory" {
+		return testHost().Dial(context.Background(), localAddr(n))
+	}
+	return net.Dial("tcp", localAddr(n))
+}
+
+// startLocalNetwork starts a network listening on an ephemeral loopback port,
+// or an in-memory one when running over the memory transport
+func startLocalNetwork(t *testing.T, ctx context.Context, nodeID string) *Network {
+	return startLocalNetworkWith(t, ctx, nodeID, nil)
+}
+
+// startLocalNetworkWith starts a network as startLocalNetwork does, letting
+// configure adjust its config before the network is created, and prepare the
+// network before it starts. configure may be nil.
+func startLocalNetworkWith(t *testing.T, ctx context.Context, nodeID string, configure func(cfg *config.Config), prepare ...func(n *Network)) *Network {
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.Storage.DataDir = t.TempDir()
+	if configure != nil {
+		configure(cfg)
+	}
+
+	network := newLocalNetwork(t, cfg, nodeID)
+	for _, fn := range prepare {
+		fn(network)
+	}
+	require.NoError(t, network.Start(ctx))
+	t.Cleanup(func() { network.Stop() })
+
+	return network
+}
+
+// dialNothing keeps a network from dialing peers by itself, so its peers
+// change only as a test connects and disconnects them
+func dialNothing(cfg *config.Config) {
+	cfg.P2P.MinPeers = 0
+	cfg.P2P.TargetPeers = 0
+	cfg.P2P.DiscoveryFloor = 0
+}
+
+// localAddr returns the dialable address of a started network
+func localAddr(n *Network) string {
+	return n.ListenAddr().String()
+}
+
+func TestSeenCache(t *testing.T) {
+	cache := newSeenCache(50 * time.Millisecond)
+
+	assert.True(t, cache.Add("msg-1"))
+	assert.False(t, cache.Add("msg-1"))
+	assert.True(t, cache.Contains("msg-1"))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, cache.Contains("msg-1"))
+	assert.True(t, cache.Add("msg-1"))
+
+	// Expired entries are swept as new IDs arrive
+	time.Sleep(60 * time.Millisecond)
+	cache.Add("msg-2")
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestIDLRU(t *testing.T) {
+	lru := newIDLRU(2)
+
+	assert.True(t, lru.Add("msg-1"))
+	assert.True(t, lru.Add("msg-2"))
+	assert.False(t, lru.Add("msg-1"))
+
+	// msg-1 was used more recently, so msg-2 is evicted
+	assert.True(t, lru.Add("msg-3"))
+	assert.Equal(t, 2, lru.Len())
+	assert.False(t, lru.Add("msg-1"))
+	assert.True(t, lru.Add("msg-2"))
+}
+
+func TestGossipPropagation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const nodeCount = 6
+	const fanout = 2
+
+	nodes := make([]*Network, nodeCount)
+	for i := range nodes {
+		nodes[i] = startLocalNetwork(t, ctx, fmt.Sprintf("gossip-node-%d", i))
+	}
+
+	// Wire the nodes into a ring so propagation needs multiple hops
+	for i := range nodes {
+		next := nodes[(i+1)%nodeCount]
+		_, err := nodes[i].Connect(ctx, localAddr(next))
+		require.NoError(t, err)
+	}
+	for i := range nodes {
+		node := nodes[i]
+		require.Eventually(t, func() bool {
+			return node.topologyMgr.GetPeerCount() == 2
+		}, 5*time.Second, 20*time.Millisecond, "node %d did not register both ring neighbours", i)
+	}
+
+	var mu sync.Mutex
+	deliveries := make(map[string]int)
+	for _, node := range nodes {
+		id := node.nodeID
+		node.RegisterHandler("RUMOR", func(msg Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			deliveries[id]++
+		})
+	}
+
+	msg := NewMessage("RUMOR", nodes[0].nodeID, map[string]interface{}{"text": "hello mesh"})
+	require.NoError(t, nodes[0].Gossip(msg, fanout))
+
+	// Every node except the origin receives the message exactly once
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(deliveries) == nodeCount-1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Allow any in-flight duplicates to arrive before counting
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotContains(t, deliveries, nodes[0].nodeID)
+	for id, count := range deliveries {
+		assert.Equal(t, 1, count, "node %s received duplicate deliveries", id)
+	}
+
+	var duplicates uint64
+	for _, node := range nodes {
+		duplicates += atomic.LoadUint64(&node.gossipDuplicates)
+	}
+	assert.LessOrEqual(t, duplicates, uint64(nodeCount*fanout))
+}
+
+func TestGossipHopLimit(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+
+	msg := NewMessage("RUMOR", "remote", nil)
+	msg.Origin = "remote"
+	msg.HopLimit = 1
+
+	// First receipt is delivered, the second is suppressed
+	assert.True(t, network.handleGossipMessage(&msg))
+	assert.False(t, network.handleGossipMessage(&msg))
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&network.gossipDuplicates))
+
+	invalid := NewMessage("RUMOR", "remote", nil)
+	invalid.HopLimit = -1
+	assert.Error(t, invalid.Validate())
+}
@@ -0,0 +1,222 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/session"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// performSecureHandshake runs the handshake on conn, the connection's, as
+// the side that dialed it unless incoming
+func (n *Network) performSecureHandshake(conn net.Conn, incoming bool, connection *Connection) error {
+	policy := &handshakePolicy{n: n, connection: connection}
+	if incoming {
+		return connection.Session().Answer(policy)
+	}
+	return connection.Session().Open(policy)
+}
+
+// handshakePolicy is what the network accepts in the handshake on one
+// connection
+type handshakePolicy struct {
+	n          *Network
+	connection *Connection
+}
+
+// Hello creates our handshake message, announcing a recent key rotation
+// and sealed for our private network if we belong to one
+func (p *handshakePolicy) Hello(theirs *crypto.HandshakeMessage) (*crypto.HandshakeMessage, error) {
+	what := "handshake"
+	transcript := []*crypto.HandshakeMessage{}
+	if theirs != nil {
+		what = "response handshake"
+		transcript = append(transcript, theirs)
+	}
+
+	msg, err := p.n.handshakeMgr.CreateHandshakeMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", what, err)
+	}
+	p.n.announceKeyRotation(msg)
+	if err := p.n.sealHandshake(append(transcript, msg)...); err != nil {
+		return nil, fmt.Errorf("failed to seal %s: %w", what, err)
+	}
+	return msg, nil
+}
+
+// Verify checks the peer is in our private network, signed its message
+// with the key it claims, speaks a protocol version we do and is the peer
+// we dialed, if we expected one, then registers it
+func (p *handshakePolicy) Verify(ours, theirs *crypto.HandshakeMessage) error {
+	n, connection := p.n, p.connection
+	answering := ours == nil
+
+	// Strangers to our private network are turned away before their
+	// signature is even checked
+	if answering {
+		if err := n.checkNetworkKey(theirs); err != nil {
+			n.rejectForeignPeer(connection, err)
+			return err
+		}
+	} else if err := n.checkNetworkKey(ours, theirs); err != nil {
+		return err
+	}
+
+	if err := n.handshakeMgr.VerifyHandshakeMessage(theirs); err != nil {
+		what := "handshake"
+		if !answering {
+			what = "response handshake"
+		}
+		return &handshakeError{peerID: theirs.NodeID, err: fmt.Errorf("%s verification failed: %w", what, err)}
+	}
+
+	// Each side checks the versions the other advertises against its own
+	version, err := negotiateVersion(n.protocolVersion, n.minProtocolVersion, theirs.ProtocolVersion, theirs.MinProtocolVersion)
+	if err != nil {
+		n.rejectIncompatiblePeer(connection, err)
+		return fmt.Errorf("rejected peer %s: %w", theirs.NodeID, err)
+	}
+
+	if !answering && connection.expectedPeerID != "" && theirs.NodeID != connection.expectedPeerID {
+		return &handshakeError{peerID: theirs.NodeID, err: fmt.Errorf("%w: expected %s, got %s", ErrPeerIDMismatch, connection.expectedPeerID, theirs.NodeID)}
+	}
+	if err := n.checkPeerKey(theirs); err != nil {
+		return &handshakeError{peerID: theirs.NodeID, err: err}
+	}
+
+	connection.identity = identityKey(theirs)
+	if err := n.registerPeer(theirs.NodeID, connection, version); err != nil {
+		if answering {
+			n.rejectDuplicatePeer(connection, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Resume resumes our last session with the peer at the connection's
+// address, if we still have its ticket
+func (p *handshakePolicy) Resume(s *session.Session) (bool, error) {
+	peerID := p.connection.expectedPeerID
+	if peerID == "" {
+		peerID, _ = p.n.peerStore.NodeAt(p.connection.Address)
+	}
+	t := p.n.sessions.forPeer(peerID, p.n.localKey())
+	if t == nil {
+		return false, nil
+	}
+	return p.n.resumeSession(s, p.connection, t)
+}
+
+// AcceptResumption resumes the session the peer has a ticket for, if we
+// still have it too
+func (p *handshakePolicy) AcceptResumption(s *session.Session, request *crypto.HandshakeMessage) (bool, error) {
+	return p.n.acceptResumption(s, p.connection, request)
+}
+
+// Established keeps a ticket to resume the session later
+func (p *handshakePolicy) Established(ours, theirs *crypto.HandshakeMessage) {
+	p.n.rememberSession(theirs.NodeID, p.connection, ours, theirs)
+}
+
+type handshakeError struct {
+	peerID string
+	err    error
+}
+
+func (e *handshakeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+// duplicatePeerError refuses a connection to a peer we are already
+// connected to
+type duplicatePeerError struct {
+	peerID string
+}
+
+func (e *duplicatePeerError) Error() string {
+	return fmt.Sprintf("%v %s", ErrDuplicatePeer, e.peerID)
+}
+
+func (e *duplicatePeerError) Is(target error) bool {
+	return target == ErrDuplicatePeer
+}
+
+// rejectDuplicatePeer tells a peer dialing us that it is already connected,
+// in place of our handshake response
+func (n *Network) rejectDuplicatePeer(connection *Connection, err error) {
+	reject := NewMessage(MessageTypeError, n.nodeID, ErrorPayload{
+		Code:    ErrorCodeDuplicatePeer,
+		Message: err.Error(),
+	})
+	if sendErr := n.sendMessageToConn(connection.Conn, reject); sendErr != nil {
+		n.logger.Debugf("failed to send duplicate peer rejection: %v", sendErr)
+	}
+}
+
+// recordHandshakeFailure penalizes the peer a failed handshake is attributed to
+func (n *Network) recordHandshakeFailure(err error) {
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		n.reputation.RecordEvent(hsErr.peerID, topology.EventHandshakeFailure)
+	}
+}
+
+// publishHandshakeFailure tells subscribers about a failed handshake, with
+// the peer it is attributed to if known
+func (n *Network) publishHandshakeFailure(connection *Connection, err error) {
+	evt := Event{
+		Type: EventHandshakeFailed,
+		Data: map[string]interface{}{
+			"address":   connection.Address,
+			"direction": connectionDirection(connection),
+			"error":     err.Error(),
+		},
+	}
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		evt.PeerID = hsErr.peerID
+	}
+	n.events.Publish(evt)
+}
+
+// parseHandshakeMessage decodes a handshake message frame, or the ERROR a
+// peer refusing us sends in its place
+func parseHandshakeMessage(data []byte) (*crypto.HandshakeMessage, error) {
+	// Remove newline
+	if len(data) > 0 && data[len(data)-1] == '\n' {
+		data = data[:len(data)-1]
+	}
+
+	// A peer that refuses us answers with an ERROR message instead
+	var rejection struct {
+		Type    string       `json:"type"`
+		Sender  string       `json:"sender"`
+		Payload ErrorPayload `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &rejection); err == nil && rejection.Type == MessageTypeError {
+		switch rejection.Payload.Code {
+		case ErrorCodeDuplicatePeer:
+			return nil, &duplicatePeerError{peerID: rejection.Sender}
+		case ErrorCodeNetworkKeyMismatch:
+			return nil, fmt.Errorf("%w: %w", ErrNetworkKeyMismatch, &rejection.Payload)
+		}
+		return nil, fmt.Errorf("handshake rejected: %w", &rejection.Payload)
+	}
+
+	var msg crypto.HandshakeMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal handshake message: %w", err)
+	}
+
+	return &msg, nil
+}
@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatCarriesLoad(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+
+	payload := network.heartbeatPayload()
+	assert.Equal(t, "test-node-id", payload.NodeID)
+	assert.Zero(t, payload.QueueDepth)
+	assert.False(t, payload.Overloaded)
+	assert.False(t, payload.Full)
+
+	// A backed up queue is reported as overload
+	overloaded := DefaultMessageQueueSize * OverloadedQueuePercent / 100
+	for i := 0; i < overloaded; i++ {
+		network.queue.Push(context.Background(), NewMessage("TEST", "peer", nil))
+	}
+	payload = network.heartbeatPayload()
+	assert.Equal(t, overloaded, payload.QueueDepth)
+	assert.True(t, payload.Overloaded)
+}
+
+func TestOverloadedPeerBroadcastLast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "load-node")
+	busy, remote, _ := attachPipePeer(t, network, "busy-node")
+	attachPipePeer(t, network, "idle-node")
+
+	heartbeat := NewMessage(MessageTypeHeartbeat, busy.ID, HeartbeatPayload{
+		NodeID:      busy.ID,
+		TS:          time.Now().Unix(),
+		Connections: 12,
+		QueueDepth:  90,
+		Overloaded:  true,
+	})
+	writeFrame(t, remote, heartbeat)
+
+	require.Eventually(t, func() bool {
+		_, ok := network.monitor.Quality.GetPeerLoad(busy.ID)
+		return ok
+	}, 5*time.Second, 20*time.Millisecond)
+	load, _ := network.monitor.Quality.GetPeerLoad(busy.ID)
+	assert.Equal(t, 12, load.Connections)
+	assert.Equal(t, 90, load.QueueDepth)
+	assert.True(t, load.Overloaded)
+
+	assert.Equal(t, []string{"idle-node"}, network.topologyMgr.GetOptimalPeersForBroadcast("", 1))
+	assert.Equal(t, []string{"idle-node", "busy-node"}, network.topologyMgr.GetOptimalPeersForBroadcast("", 2))
+}
+
+func TestIdleHeartbeatRate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const interval = 50 * time.Millisecond
+	start := func(nodeID string) *Network {
+		return startLocalNetworkWith(t, ctx, nodeID, func(cfg *config.Config) {
+			cfg.P2P.EnableDiscovery = true
+		}, func(n *Network) {
+			n.heartbeatInterval = interval
+		})
+	}
+	a := start("idle-a")
+	b := start("idle-b")
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	time.Sleep(2 * interval)
+
+	// Heartbeats are not answered, so each side hears only the other's
+	received := func() (uint64, uint64) {
+		return a.monitor.Stats.GetStats().TotalMessagesReceived, b.monitor.Stats.GetStats().TotalMessagesReceived
+	}
+	const intervals = 20
+	beforeA, beforeB := received()
+	time.Sleep(intervals * interval)
+	afterA, afterB := received()
+	assert.InDelta(t, intervals, afterA-beforeA, 2)
+	assert.InDelta(t, intervals, afterB-beforeB, 2)
+}
@@ -1,30 +1,61 @@
 package p2p
 
+import (
+	"context"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
 // Interface defines the core P2P networking interface
 type Interface interface {
-	Start() error
+	Start(ctx context.Context) error
 	Stop() error
-	Connect(address string) error
-	SendMessage(peerID string, message Message) error
-	Broadcast(message Message) error
-	Peers() []Peer
-	Status() Status
-}
+	Connect(ctx context.Context, address string) (string, error)
+	SendMessage(ctx context.Context, peerID string, message Message) error
+	Broadcast(ctx context.Context, message Message, tags ...string) (*BroadcastResult, error)
+	Peers() []PeerSnapshot
+	ConnectedPeers() []PeerSnapshot
+	Status() NetworkStatus
 
-// Status represents the status of the P2P network
-type Status struct {
-	ActiveConnections int
-	TotalPeers      int
-	Listening       bool
-	NodeID          string
-	Uptime          int64
+	// GetConnectionQuality returns the live quality of the connection to a
+	// peer, or false if there is none
+	GetConnectionQuality(peerID string) (ConnectionQuality, bool)
+	// GetTopologyMetrics summarizes the peers the topology manager knows about
+	GetTopologyMetrics() topology.Metrics
+	// GetNetworkReport returns a snapshot of the network's health
+	GetNetworkReport() NetworkReport
 }
 
+// Network implements Interface
+var _ Interface = (*Network)(nil)
+
+// MessageHandler processes an application message delivered by the network
+type MessageHandler func(msg Message)
+
 // NetworkStatus represents the status of the P2P network
 type NetworkStatus struct {
+	// ActiveConnections counts the connections whose handshake completed
+	// and that were not closed since
 	ActiveConnections int
-	TotalPeers      int
-	Listening       bool
-	NodeID          string
-	Uptime          float64
-}
\ No newline at end of file
+	// TotalPeers counts every peer in the registry, ConnectedPeers only
+	// those with an open connection
+	TotalPeers     int
+	ConnectedPeers int
+	Listening      bool
+	// OutboundOnly is set while the network runs with listening disabled,
+	// reachable only over the connections it opens
+	OutboundOnly bool
+	NodeID       string
+	// Uptime is how long the network has been running, 0 while stopped
+	Uptime time.Duration
+	// StaticPeers lists the configured static peers and whether each is
+	// connected
+	StaticPeers []StaticPeerStatus
+	// Listeners lists each address the network accepts connections on
+	// while it is running
+	Listeners []ListenerStatus
+	// ListenPort is the port the first listener got, 0 while not listening.
+	// With port fallback it may not be the configured one.
+	ListenPort int
+}
@@ -0,0 +1,235 @@
+package p2p
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+)
+
+// maxIsolationEpisodes is the number of past isolation episodes kept for reporting
+const maxIsolationEpisodes = 10
+
+// isolationAction is what the detector wants the network to do after an observation
+type isolationAction int
+
+const (
+	isolationNone isolationAction = iota
+	// isolationEntered means the node just became isolated
+	isolationEntered
+	// isolationRetry means the node is still isolated and should try again
+	isolationRetry
+	// isolationRecovered means an isolated node regained enough peers
+	isolationRecovered
+)
+
+// IsolationEpisode records one period during which the node was isolated
+type IsolationEpisode struct {
+	BelowSince  time.Time `json:"below_since"`
+	DetectedAt  time.Time `json:"detected_at"`
+	RecoveredAt time.Time `json:"recovered_at,omitempty"`
+	Attempts    int       `json:"attempts"`
+}
+
+// IsolationReport is the isolation detector's state in the network report
+type IsolationReport struct {
+	Isolated  bool               `json:"isolated"`
+	MinPeers  int                `json:"min_peers"`
+	Threshold time.Duration      `json:"threshold"`
+	Episodes  []IsolationEpisode `json:"episodes"`
+}
+
+// isolationDetector tracks how long the connected peer count has been below
+// a floor and decides when to declare the node isolated
+type isolationDetector struct {
+	floor      int
+	threshold  time.Duration
+	belowSince time.Time
+	isolated   bool
+	lastTry    time.Time
+	episodes   []IsolationEpisode
+	mu         sync.Mutex
+}
+
+// newIsolationDetector creates a detector for the given peer floor and threshold
+func newIsolationDetector(floor int, threshold time.Duration) *isolationDetector {
+	if threshold <= 0 {
+		threshold = DefaultIsolationThreshold
+	}
+
+	return &isolationDetector{
+		floor:     floor,
+		threshold: threshold,
+	}
+}
+
+// observe feeds the current connected peer count into the detector
+func (d *isolationDetector) observe(now time.Time, connected int) isolationAction {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if connected >= d.floor {
+		d.belowSince = time.Time{}
+		if !d.isolated {
+			return isolationNone
+		}
+		d.isolated = false
+		d.episodes[len(d.episodes)-1].RecoveredAt = now
+		return isolationRecovered
+	}
+
+	if d.belowSince.IsZero() {
+		d.belowSince = now
+		return isolationNone
+	}
+
+	if !d.isolated {
+		if now.Sub(d.belowSince) < d.threshold {
+			return isolationNone
+		}
+		d.isolated = true
+		d.lastTry = now
+		d.episodes = append(d.episodes, IsolationEpisode{BelowSince: d.belowSince, DetectedAt: now, Attempts: 1})
+		if len(d.episodes) > maxIsolationEpisodes {
+			d.episodes = d.episodes[len(d.episodes)-maxIsolationEpisodes:]
+		}
+		return isolationEntered
+	}
+
+	if now.Sub(d.lastTry) >= d.threshold {
+		d.lastTry = now
+		d.episodes[len(d.episodes)-1].Attempts++
+		return isolationRetry
+	}
+
+	return isolationNone
+}
+
+// IsIsolated reports whether the node is currently isolated
+func (d *isolationDetector) IsIsolated() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.isolated
+}
+
+// Episodes returns the most recent isolation episodes, oldest first
+func (d *isolationDetector) Episodes() []IsolationEpisode {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	episodes := make([]IsolationEpisode, len(d.episodes))
+	copy(episodes, d.episodes)
+	return episodes
+}
+
+// report summarizes the detector state for the network report
+func (d *isolationDetector) report() IsolationReport {
+	return IsolationReport{
+		Isolated:  d.IsIsolated(),
+		MinPeers:  d.floor,
+		Threshold: d.threshold,
+		Episodes:  d.Episodes(),
+	}
+}
+
+// monitorIsolation periodically checks whether the node has lost its peers
+func (n *Network) monitorIsolation() {
+	interval := n.isolation.threshold / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case now := <-ticker.C:
+			n.checkIsolation(now)
+		}
+	}
+}
+
+// checkIsolation acts on a single isolation observation
+func (n *Network) checkIsolation(now time.Time) {
+	connected := len(n.topologyMgr.GetConnectedPeers())
+
+	switch n.isolation.observe(now, connected) {
+	case isolationEntered:
+		n.logger.Warnf("network isolated: %d connected peers, minimum is %d", connected, n.isolation.floor)
+		n.events.Publish(Event{
+			Type: EventNetworkIsolated,
+			Time: now,
+			Data: map[string]interface{}{
+				"connected_peers": connected,
+				"min_peers":       n.isolation.floor,
+			},
+		})
+		n.background(n.recoverFromIsolation)
+	case isolationRetry:
+		n.logger.Infof("still isolated with %d connected peers, retrying discovery", connected)
+		n.background(n.recoverFromIsolation)
+	case isolationRecovered:
+		episodes := n.isolation.Episodes()
+		last := episodes[len(episodes)-1]
+		n.logger.Infof("network recovered: %d connected peers", connected)
+		n.events.Publish(Event{
+			Type: EventNetworkRecovered,
+			Time: now,
+			Data: map[string]interface{}{
+				"connected_peers":  connected,
+				"isolated_seconds": last.RecoveredAt.Sub(last.DetectedAt).Seconds(),
+			},
+		})
+	}
+}
+
+// recoverFromIsolation dials every source of peers we know about: recently
+// seen peers from the peer store, the bootstrap nodes and, when discovery is
+// enabled, peers found by a fresh mDNS scan. Overlapping rounds are skipped.
+func (n *Network) recoverFromIsolation() {
+	if !atomic.CompareAndSwapInt32(&n.recovering, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&n.recovering, 0)
+
+	connected := make(map[string]bool)
+	for _, peerID := range n.topologyMgr.GetConnectedPeers() {
+		connected[peerID] = true
+	}
+
+	for _, record := range n.peerStore.Recent(DefaultRecentPeerWindow) {
+		if connected[record.NodeID] || record.NodeID == n.nodeID {
+			continue
+		}
+		if err := n.dial(record.Address); err != nil {
+			n.logger.Debugf("failed to redial %s at %s: %v", record.NodeID, record.Address, err)
+		}
+	}
+
+	if err := n.bootstrapMgr.ConnectToBootstrapNodes(n.ctx, n.connectBootstrapNode); err != nil {
+		n.logger.Debugf("re-bootstrap incomplete: %v", err)
+	}
+
+	if n.config.P2P.EnableDiscovery {
+		peers, err := discovery.DiscoverLocalPeers(n.ctx, DefaultMDNSScanTimeout, n.mdnsService(), n.addressPolicy())
+		if err != nil {
+			n.logger.Debugf("mDNS re-scan failed: %v", err)
+			return
+		}
+		for _, peer := range peers {
+			if peer.ID == n.nodeID || connected[peer.ID] {
+				continue
+			}
+			if err := n.checkAdvertisedPeer(peer); err != nil {
+				n.logger.Debugf("not dialing mDNS peer %s: %v", peer.ID, err)
+				continue
+			}
+			if err := n.dialCandidate(peer); err != nil {
+				n.logger.Debugf("failed to dial mDNS peer %s: %v", peer.HostPort(), err)
+			}
+		}
+	}
+}
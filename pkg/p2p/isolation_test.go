@@ -0,0 +1,297 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsolationDetector(t *testing.T) {
+	detector := newIsolationDetector(2, time.Minute)
+	start := time.Now()
+
+	assert.Equal(t, isolationNone, detector.observe(start, 3))
+	assert.Equal(t, isolationNone, detector.observe(start.Add(time.Second), 1))
+	assert.Equal(t, isolationNone, detector.observe(start.Add(30*time.Second), 1))
+	assert.False(t, detector.IsIsolated())
+
+	assert.Equal(t, isolationEntered, detector.observe(start.Add(61*time.Second), 0))
+	assert.True(t, detector.IsIsolated())
+	assert.Equal(t, isolationNone, detector.observe(start.Add(90*time.Second), 0))
+	assert.Equal(t, isolationRetry, detector.observe(start.Add(121*time.Second), 1))
+
+	assert.Equal(t, isolationRecovered, detector.observe(start.Add(130*time.Second), 2))
+	assert.False(t, detector.IsIsolated())
+
+	episodes := detector.Episodes()
+	require.Len(t, episodes, 1)
+	assert.Equal(t, start.Add(time.Second), episodes[0].BelowSince)
+	assert.Equal(t, start.Add(130*time.Second), episodes[0].RecoveredAt)
+	assert.Equal(t, 2, episodes[0].Attempts)
+
+	// Briefly dipping below the floor does not count
+	assert.Equal(t, isolationNone, detector.observe(start.Add(200*time.Second), 0))
+	assert.Equal(t, isolationNone, detector.observe(start.Add(210*time.Second), 2))
+	assert.Equal(t, isolationNone, detector.observe(start.Add(300*time.Second), 0))
+	assert.Len(t, detector.Episodes(), 1)
+}
+
+// loadLegacyPeerStore loads a peer store from a file saved by a release
+// before the state storage
+func loadLegacyPeerStore(t *testing.T, data string) *PeerStore {
+	path := filepath.Join(t.TempDir(), PeerStoreFile)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+
+	kv := kvstorage.NewMemory()
+	require.NoError(t, migratePeerStore(kv, path))
+	assert.NoFileExists(t, path)
+	store := NewPeerStore(kv)
+	require.NoError(t, store.Load())
+	return store
+}
+
+func TestPeerStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+	kv, err := kvstorage.OpenJSON(filepath.Join(dir, kvstorage.JSONFile), storage.Direct)
+	require.NoError(t, err)
+
+	store := NewPeerStore(kv)
+	store.Record("peer-a", "10.0.0.1:8080")
+	time.Sleep(time.Millisecond)
+	store.Record("peer-b", "10.0.0.2:8080")
+	store.Record("", "10.0.0.3:8080")
+	require.NoError(t, store.Save())
+
+	kv, err = kvstorage.OpenJSON(filepath.Join(dir, kvstorage.JSONFile), storage.Direct)
+	require.NoError(t, err)
+	loaded := NewPeerStore(kv)
+	require.NoError(t, loaded.Load())
+	assert.Equal(t, 2, loaded.Len())
+
+	recent := loaded.Recent(time.Hour)
+	require.Len(t, recent, 2)
+	assert.Equal(t, "peer-b", recent[0].NodeID)
+	assert.Equal(t, "10.0.0.1:8080", recent[1].Address)
+
+	assert.Empty(t, loaded.Recent(0))
+
+	// Peers forgotten since the last save are dropped from storage
+	loaded.Record("peer-c", "10.0.0.2:8080")
+	require.NoError(t, loaded.Save())
+	reloaded := NewPeerStore(kv)
+	require.NoError(t, reloaded.Load())
+	_, ok := reloaded.Get("peer-b")
+	assert.False(t, ok)
+	assert.Equal(t, 2, reloaded.Len())
+
+	// Empty storage is an empty store
+	empty := NewPeerStore(kvstorage.NewMemory())
+	assert.NoError(t, empty.Load())
+	assert.Zero(t, empty.Len())
+}
+
+func TestPeerStoreDeduplicatesAddresses(t *testing.T) {
+	store := NewPeerStore(nil)
+	store.Record("peer-a", " 10.0.0.1:08080 ")
+	record, ok := store.Get("peer-a")
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.1:8080", record.Address)
+
+	// A node that comes back under a new ID replaces its old record
+	store.Record("peer-a2", "[::ffff:10.0.0.1]:8080")
+	_, ok = store.Get("peer-a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, store.Len())
+
+	store.Record("peer-b", "Node.Example.com.:9000")
+	store.Record("peer-c", "not an address")
+	record, _ = store.Get("peer-b")
+	assert.Equal(t, "node.example.com:9000", record.Address)
+	assert.Equal(t, 2, store.Len())
+
+	// Files written before addresses were normalized keep the newest
+	// record at each address
+	data := `[
+  {"node_id": "old", "address": "10.0.0.9:8080", "last_seen": "2026-01-01T00:00:00Z"},
+  {"node_id": "new", "address": "10.0.0.9", "last_seen": "2026-01-02T00:00:00Z"},
+  {"node_id": "bad", "address": "", "last_seen": "2026-01-03T00:00:00Z"}
+]`
+	loaded := loadLegacyPeerStore(t, data)
+	assert.Equal(t, 1, loaded.Len())
+	record, ok = loaded.Get("new")
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.9:8080", record.Address)
+}
+
+func TestPeerStoreCapsFutureTimes(t *testing.T) {
+	// Saved an hour ahead of the clock, as after the clock is set back
+	ahead := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	data := fmt.Sprintf(`[{"node_id": "peer-a", "address": "10.0.0.1:8080", "last_seen": %q,
+  "addresses": [{"address": "10.0.0.1:8080", "source": "dialed", "last_seen": %q, "last_connected": %q}]}]`, ahead, ahead, ahead)
+	store := loadLegacyPeerStore(t, data)
+	record, ok := store.Get("peer-a")
+	require.True(t, ok)
+	now := time.Now()
+	assert.False(t, record.LastSeen.After(now))
+	assert.False(t, record.Addresses[0].LastSeen.After(now))
+	assert.False(t, record.Addresses[0].LastConnected.After(now))
+
+	// So the peer ages from now on rather than an hour from now
+	assert.Empty(t, store.Recent(0))
+}
+
+func TestPeerStoreKeepsSeveralAddresses(t *testing.T) {
+	store := NewPeerStore(nil)
+	store.Record("peer-a", "10.0.0.1:8080")
+	store.Learn("peer-a", "[2001:db8::1]:8080", AddressSourceHello)
+	store.Learn("peer-a", "10.0.0.2:8080", AddressSourcePeerExchange)
+	store.Learn("", "10.0.0.3:8080", AddressSourceMDNS)
+
+	// The address the peer was reached at stays first, and any of them
+	// leads back to the peer
+	record, ok := store.Get("peer-a")
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.1:8080", record.Address)
+	require.Len(t, record.Addresses, 3)
+	assert.Equal(t, AddressSourceDialed, record.Addresses[0].Source)
+	assert.False(t, record.Addresses[0].LastConnected.IsZero())
+	nodeID, addresses := store.AddressesOf("[2001:DB8::1]:8080")
+	assert.Equal(t, "peer-a", nodeID)
+	assert.Len(t, addresses, 3)
+	_, ok = store.NodeAt("10.0.0.2:8080")
+	assert.False(t, ok, "an address only heard of is not the peer's yet")
+
+	nodeID, addresses = store.AddressesOf("10.0.0.9")
+	assert.Empty(t, nodeID)
+	assert.Equal(t, []PeerAddress{{Address: "10.0.0.9:8080"}}, addresses)
+
+	// Connecting at another address makes it the preferred one
+	store.Record("peer-a", "[2001:db8::1]:8080")
+	record, _ = store.Get("peer-a")
+	assert.Equal(t, "[2001:db8::1]:8080", record.Address)
+
+	// Another node taking over an address only takes that one
+	store.Record("peer-b", "10.0.0.1:8080")
+	record, _ = store.Get("peer-a")
+	assert.Len(t, record.Addresses, 2)
+	assert.Equal(t, "[2001:db8::1]:8080", record.Address)
+
+	// Addresses are capped, the least recently used going first
+	for i := 0; i < 2*MaxPeerAddresses; i++ {
+		store.Learn("peer-c", fmt.Sprintf("10.0.1.%d:8080", i+1), AddressSourcePeerExchange)
+	}
+	record, _ = store.Get("peer-c")
+	assert.Len(t, record.Addresses, MaxPeerAddresses)
+
+	// Files from before peers had several addresses still load
+	data := `[{"node_id": "old", "address": "10.0.0.9:8080", "last_seen": "2026-01-01T00:00:00Z"}]`
+	loaded := loadLegacyPeerStore(t, data)
+	record, ok = loaded.Get("old")
+	require.True(t, ok)
+	require.Len(t, record.Addresses, 1)
+	assert.Equal(t, "10.0.0.9:8080", record.Addresses[0].Address)
+	nodeID, _ = loaded.AddressesOf("10.0.0.9:8080")
+	assert.Equal(t, "old", nodeID)
+}
+
+func TestIsolationTriggersReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const threshold = 300 * time.Millisecond
+
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.Storage.DataDir = t.TempDir()
+
+	node := newLocalNetwork(t, cfg, "isolated-node")
+	node.isolation = newIsolationDetector(1, threshold)
+
+	attempts := make(chan string, 64)
+	node.dial = func(address string) error {
+		select {
+		case attempts <- address:
+		default:
+		}
+		_, err := node.Connect(ctx, address)
+		return err
+	}
+
+	require.NoError(t, node.Start(ctx))
+	defer node.Stop()
+
+	remote := startLocalNetwork(t, ctx, "remote-node")
+	_, port, err := net.SplitHostPort(localAddr(remote))
+	require.NoError(t, err)
+
+	_, err = node.Connect(ctx, localAddr(remote))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(node.topologyMgr.GetConnectedPeers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	events, unsubscribe := node.Subscribe(16)
+	defer unsubscribe()
+
+	// Losing the only peer isolates the node and starts redialing it
+	remote.Stop()
+	stopped := time.Now()
+
+	require.Eventually(t, func() bool {
+		select {
+		case evt := <-events:
+			return evt.Type == EventNetworkIsolated
+		default:
+			return false
+		}
+	}, 5*time.Second, 20*time.Millisecond, "no isolation event")
+
+	select {
+	case address := <-attempts:
+		_, attemptPort, err := net.SplitHostPort(address)
+		require.NoError(t, err)
+		assert.Equal(t, port, attemptPort)
+		assert.Less(t, time.Since(stopped), 2*threshold+200*time.Millisecond)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnection attempt")
+	}
+
+	// Bring the peer back on the same port and data directory; a retry
+	// round finds it
+	restartCfg := config.Default()
+	restartCfg.P2P.ListenPort, err = strconv.Atoi(port)
+	require.NoError(t, err)
+	restartCfg.Storage.DataDir = remote.config.Storage.DataDir
+	restarted := newLocalNetwork(t, restartCfg, "remote-node")
+	if remote.transport != nil {
+		// Over the memory transport the address includes the host name
+		restarted.SetTransport(remote.transport)
+	}
+	require.NoError(t, restarted.Start(ctx))
+	defer restarted.Stop()
+
+	require.Eventually(t, func() bool {
+		select {
+		case evt := <-events:
+			return evt.Type == EventNetworkRecovered
+		default:
+			return false
+		}
+	}, 5*time.Second, 20*time.Millisecond)
+
+	isolation := node.GetNetworkReport().Isolation
+	assert.False(t, isolation.Isolated)
+	require.Len(t, isolation.Episodes, 1)
+	assert.False(t, isolation.Episodes[0].RecoveredAt.IsZero())
+}
@@ -0,0 +1,235 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/audit"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+)
+
+// KeyFile is the name of the file under the data directory that keeps the
+// node's identity key across restarts
+const KeyFile = "node_key.json"
+
+// nodeKey is the persisted form of the node's identity key, along with the
+// rotation that introduced it
+type nodeKey struct {
+	PrivateKey string              `json:"private_key"`
+	Rotation   *crypto.KeyRotation `json:"rotation,omitempty"`
+}
+
+// KeyRotationPayload is the payload of KEY_ROTATION messages
+type KeyRotationPayload struct {
+	Rotation *crypto.KeyRotation `json:"rotation"`
+}
+
+func (p *KeyRotationPayload) validate() error {
+	if p.Rotation == nil {
+		return fmt.Errorf("key rotation is required")
+	}
+	return nil
+}
+
+// loadNodeKey returns the identity key saved at path and the rotation that
+// introduced it, if any. Without a saved key it returns a new one, which
+// the network saves when it starts.
+func loadNodeKey(path string) (encryptor *crypto.Encryptor, rotation *crypto.KeyRotation, saved bool, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		encryptor, err = crypto.NewEncryptor()
+		return encryptor, nil, false, err
+	}
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to read node key: %w", err)
+	}
+
+	var key nodeKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, nil, false, fmt.Errorf("failed to parse node key: %w", err)
+	}
+	privateKey, err := crypto.UnmarshalPrivateKey([]byte(key.PrivateKey))
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to parse node key: %w", err)
+	}
+	return crypto.NewEncryptorWithKey(privateKey), key.Rotation, true, nil
+}
+
+// saveNodeKey writes the identity key to the data directory, unless it is
+// there already
+func (n *Network) saveNodeKey() error {
+	n.keyMu.Lock()
+	defer n.keyMu.Unlock()
+
+	if n.keySaved {
+		return nil
+	}
+	if err := n.writeNodeKey(nodeKey{Rotation: n.rotation.Load()}, n.encryptor); err != nil {
+		return err
+	}
+	n.keySaved = true
+	return nil
+}
+
+// writeNodeKey writes key, with the private key of encryptor, to the data
+// directory
+func (n *Network) writeNodeKey(key nodeKey, encryptor *crypto.Encryptor) error {
+	privateKey, err := crypto.MarshalPrivateKey(encryptor.PrivateKey())
+	if err != nil {
+		return err
+	}
+	key.PrivateKey = string(privateKey)
+
+	data, err := json.MarshalIndent(key, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal node key: %w", err)
+	}
+
+	var writer storage.Writer = storage.Direct
+	if n.storage != nil {
+		writer = n.storage
+	}
+	if err := writer.WriteFile(n.keyPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to save node key: %w", err)
+	}
+	return nil
+}
+
+// RotateKey replaces the node's identity key with a new one, which is saved
+// before it is used. The rotation, signed with both keys, is gossiped to
+// peers, which move their pin for us to the new key; peers that miss it
+// learn of it from our handshakes until the grace period ends. Peers that
+// missed more than one rotation have to be told to forget our key.
+func (n *Network) RotateKey() (*crypto.KeyRotation, error) {
+	n.keyMu.Lock()
+	defer n.keyMu.Unlock()
+
+	newKey, _, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	rotation, err := crypto.NewKeyRotation(n.nodeID, n.encryptor.PrivateKey(), newKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign key rotation: %w", err)
+	}
+	if err := n.writeNodeKey(nodeKey{Rotation: rotation}, crypto.NewEncryptorWithKey(newKey)); err != nil {
+		return nil, err
+	}
+	n.keySaved = true
+
+	// Session tickets are bound to the old key and lapse with it
+	n.encryptor.SetKey(newKey)
+	n.rotation.Store(rotation)
+	if n.quicCert.Load() != nil {
+		if cert, err := n.encryptor.TLSCertificate(n.nodeID); err != nil {
+			n.logger.Warnf("QUIC keeps the certificate of the old key: %v", err)
+		} else {
+			n.quicCert.Store(&cert)
+		}
+	}
+	n.refreshPeerRecord(true)
+
+	fingerprint, _ := crypto.KeyFingerprint(&newKey.PublicKey)
+	n.logger.Infof("rotated identity key to %s", fingerprint)
+	n.recordAudit(audit.Entry{
+		Event:          audit.EventKeyRotated,
+		PeerID:         n.nodeID,
+		KeyFingerprint: fingerprint,
+	})
+
+	if peers := n.peers.ConnectedCount(); peers > 0 {
+		announcement := NewMessage(MessageTypeKeyRotation, n.nodeID, KeyRotationPayload{Rotation: rotation})
+		if err := n.Gossip(announcement, peers); err != nil {
+			n.logger.Warnf("failed to announce key rotation to every peer: %v", err)
+		}
+	}
+	return rotation, nil
+}
+
+// announceKeyRotation adds our last key rotation to a handshake message
+// while peers may not have heard of it yet
+func (n *Network) announceKeyRotation(msg *crypto.HandshakeMessage) {
+	rotation := n.rotation.Load()
+	if rotation != nil && time.Since(time.Unix(rotation.RotatedAt, 0)) < n.keyGrace {
+		msg.Rotation = rotation
+	}
+}
+
+// checkPeerKey holds the key a peer proved in its handshake to the key
+// pinned for it, once a rotation the peer announced with it is applied
+func (n *Network) checkPeerKey(msg *crypto.HandshakeMessage) error {
+	if msg.Rotation != nil {
+		if msg.Rotation.NodeID != msg.NodeID {
+			return fmt.Errorf("%w: %s announced a key rotation of %s", ErrKeyMismatch, msg.NodeID, msg.Rotation.NodeID)
+		}
+		if _, err := n.applyKeyRotation(msg.Rotation); err != nil {
+			n.logger.Warnf("ignoring key rotation announced by %s: %v", msg.NodeID, err)
+		}
+	}
+	return n.keys.Check(msg.NodeID, identityKey(msg))
+}
+
+// applyKeyRotation moves the pin of a peer that rotated its key, if the
+// rotation is signed by the pinned key, and reports whether it moved. From
+// then on the peer is known by its new key, and its session ticket, bound
+// to the old one, is dropped.
+func (n *Network) applyKeyRotation(rotation *crypto.KeyRotation) (bool, error) {
+	if rotation.NodeID == n.nodeID {
+		return false, nil
+	}
+
+	rotated, err := n.keys.Rotate(rotation, n.keyGrace)
+	if err != nil || !rotated {
+		return false, err
+	}
+	if err := n.keys.Save(); err != nil {
+		n.logger.Warnf("failed to save key store: %v", err)
+	}
+
+	_, newKey, _ := rotation.Keys()
+	n.sessions.remove(rotation.NodeID)
+	if connection := n.peerConnection(rotation.NodeID); connection != nil {
+		connection.setIdentity(newKey)
+	}
+
+	fingerprint, _ := crypto.KeyFingerprint(newKey)
+	n.logger.Infof("peer %s rotated its key to %s", rotation.NodeID, fingerprint)
+	n.recordAudit(audit.Entry{
+		Event:          audit.EventKeyRotated,
+		PeerID:         rotation.NodeID,
+		KeyFingerprint: fingerprint,
+	})
+	return true, nil
+}
+
+// handleKeyRotationMessage applies a key rotation and gossips it on.
+// Rotations whose signatures fail, or that contradict the key we pinned,
+// go no further.
+func (n *Network) handleKeyRotationMessage(msg *Message, conn *Connection) error {
+	if n.seen.Contains(msg.ID) {
+		return nil
+	}
+
+	var payload KeyRotationPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		return err
+	}
+	// Peers verify rotations before passing them on, so a bad signature is
+	// the sender's doing
+	if err := payload.Rotation.Verify(); err != nil {
+		if conn.PeerID != "" {
+			n.reputation.RecordEvent(conn.PeerID, topology.EventInvalidMessage)
+		}
+		return fmt.Errorf("invalid key rotation of %s from %s: %w", payload.Rotation.NodeID, msg.Sender, err)
+	}
+	if _, err := n.applyKeyRotation(payload.Rotation); err != nil {
+		return fmt.Errorf("rejected key rotation of %s from %s: %w", payload.Rotation.NodeID, msg.Sender, err)
+	}
+
+	n.handleGossipMessage(msg)
+	return nil
+}
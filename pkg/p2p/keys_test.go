@@ -0,0 +1,227 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fingerprint returns the fingerprint of a key, failing the test if it has none
+func fingerprint(t *testing.T, key *rsa.PublicKey) string {
+	fp, err := crypto.KeyFingerprint(key)
+	require.NoError(t, err)
+	return fp
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := connectPair(t, ctx, "rotate-a", "rotate-b")
+	originalKey := a.encryptor.PublicKey()
+	require.Eventually(t, func() bool {
+		pinned, exists := b.keys.Get("rotate-a")
+		return exists && pinned.Fingerprint == fingerprint(t, originalKey)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// b follows a rotation announced while connected
+	rotation, err := a.RotateKey()
+	require.NoError(t, err)
+	rotatedKey := a.encryptor.PublicKey()
+	assert.False(t, rotatedKey.Equal(originalKey))
+	require.Eventually(t, func() bool {
+		pinned, _ := b.keys.Get("rotate-a")
+		return pinned.Fingerprint == fingerprint(t, rotatedKey)
+	}, 5*time.Second, 20*time.Millisecond)
+	toA := b.peerConnection("rotate-a")
+	require.NotNil(t, toA)
+	assert.True(t, rotatedKey.Equal(toA.Identity()))
+
+	// and reconnects to a with the new key
+	reconnect(t, ctx, a, b)
+	toA = b.peerConnection("rotate-a")
+	require.NotNil(t, toA)
+	assert.True(t, rotatedKey.Equal(toA.Identity()))
+
+	// A rotation b missed while disconnected comes with a's next handshake
+	disconnectPair(t, a, b)
+	next, err := a.RotateKey()
+	require.NoError(t, err)
+	assert.NotEqual(t, rotation.NewKey, next.NewKey)
+
+	_, err = a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(b.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	pinned, _ := b.keys.Get("rotate-a")
+	assert.Equal(t, fingerprint(t, a.encryptor.PublicKey()), pinned.Fingerprint)
+	assert.Equal(t, fingerprint(t, rotatedKey), pinned.Previous)
+	toA = b.peerConnection("rotate-a")
+	require.NotNil(t, toA)
+	assert.True(t, a.encryptor.PublicKey().Equal(toA.Identity()))
+}
+
+func TestForgedKeyRotationRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := connectPair(t, ctx, "forged-a", "forged-b")
+	require.Eventually(t, func() bool {
+		_, exists := b.keys.Get("forged-a")
+		return exists
+	}, 5*time.Second, 20*time.Millisecond)
+	pinned, _ := b.keys.Get("forged-a")
+	toA := b.peerConnection("forged-a")
+	require.NotNil(t, toA)
+
+	attackerKey, _, err := crypto.GenerateKeyPair()
+	require.NoError(t, err)
+	newKey, _, err := crypto.GenerateKeyPair()
+	require.NoError(t, err)
+
+	// A rotation signed by a key other than the pinned one is refused and
+	// not passed on
+	forged, err := crypto.NewKeyRotation("forged-a", attackerKey, newKey)
+	require.NoError(t, err)
+	msg := NewMessage(MessageTypeKeyRotation, "forged-a", KeyRotationPayload{Rotation: forged})
+	msg.Origin = "forged-a"
+	msg.HopLimit = DefaultGossipHopLimit
+	err = b.processMessage(&msg, toA)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+	assert.False(t, b.seen.Contains(msg.ID))
+
+	// as is one whose signatures do not hold
+	tampered, err := crypto.NewKeyRotation("forged-a", a.encryptor.PrivateKey(), newKey)
+	require.NoError(t, err)
+	tampered.RotatedAt++
+	msg = NewMessage(MessageTypeKeyRotation, "forged-a", KeyRotationPayload{Rotation: tampered})
+	assert.Error(t, b.processMessage(&msg, toA))
+
+	after, _ := b.keys.Get("forged-a")
+	assert.Equal(t, pinned, after)
+	assert.True(t, a.encryptor.PublicKey().Equal(toA.Identity()))
+
+	// A node claiming a's ID with the attacker's key cannot connect
+	disconnectPair(t, a, b)
+
+	impostor := startLocalNetworkWith(t, ctx, "forged-a", nil, func(n *Network) {
+		n.encryptor.SetKey(attackerKey)
+	})
+
+	_, err = impostor.Connect(ctx, localAddr(b))
+	assert.Error(t, err)
+	assert.Empty(t, b.Peers())
+}
+
+func TestNodeKeyPersists(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.Storage.DataDir = t.TempDir()
+
+	first := newLocalNetwork(t, cfg, "persist-node")
+	require.NoError(t, first.Start(ctx))
+	require.NoError(t, first.Stop())
+	assert.FileExists(t, filepath.Join(cfg.Storage.DataDir, KeyFile))
+
+	second := newLocalNetwork(t, cfg, "persist-node")
+	assert.True(t, first.encryptor.PublicKey().Equal(second.encryptor.PublicKey()))
+	assert.Nil(t, second.rotation.Load())
+
+	// A rotation is saved along with the key it introduced
+	rotation, err := second.RotateKey()
+	require.NoError(t, err)
+
+	third := newLocalNetwork(t, cfg, "persist-node")
+	assert.True(t, second.encryptor.PublicKey().Equal(third.encryptor.PublicKey()))
+	require.NotNil(t, third.rotation.Load())
+	assert.Equal(t, rotation.NewSignature, third.rotation.Load().NewSignature)
+}
+
+func TestKeyStore(t *testing.T) {
+	dir := t.TempDir()
+	kv, err := kvstorage.OpenBolt(filepath.Join(dir, kvstorage.BoltFile), storage.Direct)
+	require.NoError(t, err)
+	store := NewKeyStore(kv)
+	now := time.Unix(1000, 0)
+	store.now = func() time.Time { return now }
+
+	oldKey, _, err := crypto.GenerateKeyPair()
+	require.NoError(t, err)
+	newKey, _, err := crypto.GenerateKeyPair()
+	require.NoError(t, err)
+	otherKey, _, err := crypto.GenerateKeyPair()
+	require.NoError(t, err)
+
+	// The first key a peer proves is pinned
+	require.NoError(t, store.Check("peer-a", &oldKey.PublicKey))
+	assert.ErrorIs(t, store.Check("peer-a", &otherKey.PublicKey), ErrKeyMismatch)
+
+	// A rotation of an unknown peer changes nothing
+	rotation, err := crypto.NewKeyRotation("peer-b", oldKey, newKey)
+	require.NoError(t, err)
+	rotated, err := store.Rotate(rotation, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, rotated)
+
+	// One signed by the pinned key moves the pin, once
+	rotation, err = crypto.NewKeyRotation("peer-a", oldKey, newKey)
+	require.NoError(t, err)
+	rotated, err = store.Rotate(rotation, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, rotated)
+	rotated, err = store.Rotate(rotation, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, rotated)
+
+	// while one signed by another key does not
+	forged, err := crypto.NewKeyRotation("peer-a", otherKey, oldKey)
+	require.NoError(t, err)
+	_, err = store.Rotate(forged, time.Hour)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+
+	// The replaced key is accepted until the grace period ends
+	assert.NoError(t, store.Check("peer-a", &newKey.PublicKey))
+	assert.NoError(t, store.Check("peer-a", &oldKey.PublicKey))
+	now = now.Add(time.Hour)
+	assert.ErrorIs(t, store.Check("peer-a", &oldKey.PublicKey), ErrKeyMismatch)
+
+	// Pins survive a restart
+	require.NoError(t, store.Save())
+	require.NoError(t, kv.Close())
+	kv, err = kvstorage.OpenBolt(filepath.Join(dir, kvstorage.BoltFile), storage.Direct)
+	require.NoError(t, err)
+	defer kv.Close()
+	reloaded := NewKeyStore(kv)
+	require.NoError(t, reloaded.Load())
+	pinned, exists := reloaded.Get("peer-a")
+	require.True(t, exists)
+	assert.Equal(t, fingerprint(t, &newKey.PublicKey), pinned.Fingerprint)
+	assert.Equal(t, fingerprint(t, &oldKey.PublicKey), pinned.Previous)
+
+	// Pins saved to a file by earlier releases are migrated
+	legacy := filepath.Join(dir, KeyStoreFile)
+	data := `[{"node_id": "peer-c", "fingerprint": "abc", "pinned_at": "2026-01-01T00:00:00Z"}, {"node_id": "", "fingerprint": "def"}]`
+	require.NoError(t, os.WriteFile(legacy, []byte(data), 0600))
+	migrated := kvstorage.NewMemory()
+	require.NoError(t, migrateKeyStore(migrated, legacy))
+	reloaded = NewKeyStore(migrated)
+	require.NoError(t, reloaded.Load())
+	pinned, exists = reloaded.Get("peer-c")
+	require.True(t, exists)
+	assert.Equal(t, "abc", pinned.Fingerprint)
+	assert.NoFileExists(t, legacy)
+}
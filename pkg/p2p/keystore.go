@@ -0,0 +1,254 @@
+package p2p
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+)
+
+// KeyStoreBucket is the bucket of the node's state that holds the keys
+// pinned for peers, by node ID
+const KeyStoreBucket = "peer_keys"
+
+// KeyStoreFile is the file under the data directory that releases before
+// the state storage kept pinned keys in. It is migrated into KeyStoreBucket
+// when the network starts.
+const KeyStoreFile = "peer_keys.json"
+
+// ErrKeyMismatch is returned when a peer proves a key other than the one
+// pinned for it
+var ErrKeyMismatch = errors.New("peer key does not match the pinned key")
+
+// PinnedKey is the key a peer is held to, by fingerprint
+type PinnedKey struct {
+	NodeID      string    `json:"node_id"`
+	Fingerprint string    `json:"fingerprint"`
+	PinnedAt    time.Time `json:"pinned_at"`
+
+	// Previous is the key the peer's last rotation replaced, which is still
+	// accepted until PreviousUntil
+	Previous      string    `json:"previous,omitempty"`
+	PreviousUntil time.Time `json:"previous_until,omitempty"`
+}
+
+// KeyStore pins the key each peer first proved to us, so a node claiming a
+// known peer's ID with another key is refused. Peers move to a new key by
+// announcing a rotation signed with the pinned one.
+type KeyStore struct {
+	kv    kvstorage.KV
+	keys  map[string]PinnedKey
+	now   func() time.Time
+	dirty bool
+	mu    sync.Mutex
+}
+
+// NewKeyStore creates a key store kept in kv. A nil kv keeps the store in
+// memory only.
+func NewKeyStore(kv kvstorage.KV) *KeyStore {
+	return &KeyStore{
+		kv:   kv,
+		keys: make(map[string]PinnedKey),
+		now:  time.Now,
+	}
+}
+
+// SetKV moves the store to kv, which Load then reads and Save writes
+func (s *KeyStore) SetKV(kv kvstorage.KV) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv = kv
+}
+
+// Load reads previously saved pins. A pin that cannot be parsed is skipped.
+func (s *KeyStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.kv == nil {
+		return nil
+	}
+	err := s.kv.Iterate(KeyStoreBucket, func(nodeID string, value []byte) error {
+		var key PinnedKey
+		if err := json.Unmarshal(value, &key); err == nil && key.NodeID == nodeID && key.Fingerprint != "" {
+			s.keys[nodeID] = key
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read key store: %w", err)
+	}
+	return nil
+}
+
+// Save writes the pins to storage if they changed since the last save,
+// replacing those saved before
+func (s *KeyStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.kv == nil || !s.dirty {
+		return nil
+	}
+
+	err := s.kv.Update(func(tx kvstorage.Tx) error {
+		if err := tx.DeleteBucket(KeyStoreBucket); err != nil {
+			return err
+		}
+		for nodeID, key := range s.keys {
+			data, err := json.Marshal(key)
+			if err != nil {
+				return fmt.Errorf("failed to marshal key of %s: %w", nodeID, err)
+			}
+			if err := tx.Put(KeyStoreBucket, nodeID, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write key store: %w", err)
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// migrateKeyStore moves the pins saved in path by an earlier release into kv
+func migrateKeyStore(kv kvstorage.KV, path string) error {
+	return kvstorage.Migrate(kv, KeyStoreBucket, path, func(data []byte) (map[string][]byte, error) {
+		var keys []PinnedKey
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, err
+		}
+		values := make(map[string][]byte)
+		for _, key := range keys {
+			if key.NodeID == "" {
+				continue
+			}
+			value, err := json.Marshal(key)
+			if err != nil {
+				return nil, err
+			}
+			values[key.NodeID] = value
+		}
+		return values, nil
+	})
+}
+
+// Check pins key for a peer seen for the first time. For a known peer it
+// accepts the pinned key, and the key its last rotation replaced until
+// the grace period of that rotation ends.
+func (s *KeyStore) Check(nodeID string, key *rsa.PublicKey) error {
+	if key == nil {
+		return fmt.Errorf("%w: no key", ErrKeyMismatch)
+	}
+	fingerprint, err := crypto.KeyFingerprint(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pinned, exists := s.keys[nodeID]
+	switch {
+	case !exists:
+		s.keys[nodeID] = PinnedKey{NodeID: nodeID, Fingerprint: fingerprint, PinnedAt: s.now()}
+		s.dirty = true
+		return nil
+	case pinned.Fingerprint == fingerprint:
+		return nil
+	case pinned.Previous == fingerprint && s.now().Before(pinned.PreviousUntil):
+		return nil
+	default:
+		return fmt.Errorf("%w: %s proved %s, pinned %s", ErrKeyMismatch, nodeID, fingerprint, pinned.Fingerprint)
+	}
+}
+
+// Rotate moves the pin of a peer to the key its rotation announces, if the
+// rotation is signed by the pinned key. The replaced key stays accepted
+// for grace. It reports whether the pin moved; a rotation already applied,
+// or one for a peer nothing is pinned for, changes nothing.
+func (s *KeyStore) Rotate(rotation *crypto.KeyRotation, grace time.Duration) (bool, error) {
+	if err := rotation.Verify(); err != nil {
+		return false, fmt.Errorf("invalid key rotation: %w", err)
+	}
+	oldKey, newKey, err := rotation.Keys()
+	if err != nil {
+		return false, err
+	}
+	oldFingerprint, err := crypto.KeyFingerprint(oldKey)
+	if err != nil {
+		return false, err
+	}
+	newFingerprint, err := crypto.KeyFingerprint(newKey)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pinned, exists := s.keys[rotation.NodeID]
+	switch {
+	case !exists, pinned.Fingerprint == newFingerprint:
+		return false, nil
+	case pinned.Fingerprint != oldFingerprint:
+		return false, fmt.Errorf("%w: rotation of %s is signed by %s, pinned %s", ErrKeyMismatch, rotation.NodeID, oldFingerprint, pinned.Fingerprint)
+	}
+
+	now := s.now()
+	s.keys[rotation.NodeID] = PinnedKey{
+		NodeID:        rotation.NodeID,
+		Fingerprint:   newFingerprint,
+		PinnedAt:      now,
+		Previous:      oldFingerprint,
+		PreviousUntil: now.Add(grace),
+	}
+	s.dirty = true
+	return true, nil
+}
+
+// Pin pins the key with fingerprint for a peer nothing is pinned for yet,
+// e.g. one read from another node's peer list, and reports whether it did
+func (s *KeyStore) Pin(nodeID, fingerprint string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.keys[nodeID]; exists {
+		return false
+	}
+	s.keys[nodeID] = PinnedKey{NodeID: nodeID, Fingerprint: fingerprint, PinnedAt: s.now()}
+	s.dirty = true
+	return true
+}
+
+// Get returns the key pinned for a peer
+func (s *KeyStore) Get(nodeID string) (PinnedKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, exists := s.keys[nodeID]
+	return key, exists
+}
+
+// Matches reports whether a key is pinned for a peer and, if so, whether
+// fingerprint is that key, or the key its last rotation replaced while the
+// grace period of that rotation lasts
+func (s *KeyStore) Matches(nodeID, fingerprint string) (pinned, matches bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, exists := s.keys[nodeID]
+	if !exists {
+		return false, false
+	}
+	return true, key.Fingerprint == fingerprint ||
+		key.Previous == fingerprint && s.now().Before(key.PreviousUntil)
+}
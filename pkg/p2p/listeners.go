@@ -0,0 +1,261 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+)
+
+// Channels a listener's port is advertised over, as named in
+// config.ListenerConfig.Advertise
+const (
+	// AdvertiseHello tells the peers we connect to the port in HELLO
+	AdvertiseHello = "hello"
+	// AdvertisePeerList lets those peers pass the port on in PEER_LIST
+	AdvertisePeerList = "peer_list"
+	// AdvertiseMDNS announces the port on the local network
+	AdvertiseMDNS = "mdns"
+)
+
+// ListenerStatus is the state of one address the network accepts
+// connections on
+type ListenerStatus struct {
+	// Address is the configured address and BoundAddress the one the
+	// listener got, with the port picked for port 0
+	Address      string   `json:"address"`
+	BoundAddress string   `json:"bound_address,omitempty"`
+	Advertise    []string `json:"advertise"`
+	Listening    bool     `json:"listening"`
+	// FallbackFrom is the configured port when it was in use and port
+	// fallback had the listener take the one in BoundAddress instead
+	FallbackFrom int `json:"fallback_from,omitempty"`
+	// Error says why a listener stopped while the network was running
+	Error string `json:"error,omitempty"`
+}
+
+// networkListener is one address the network accepts connections on
+type networkListener struct {
+	config       config.ListenerConfig
+	listener     net.Listener
+	fallbackFrom int
+	err          error
+	mu           sync.Mutex
+}
+
+// port returns the port the listener is bound to
+func (l *networkListener) port() int {
+	_, port, err := net.SplitHostPort(l.listener.Addr().String())
+	if err != nil {
+		return 0
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return 0
+	}
+	return portNum
+}
+
+// fail records why the listener stopped
+func (l *networkListener) fail(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = err
+}
+
+// status reports the listener's state
+func (l *networkListener) status() ListenerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := ListenerStatus{
+		Address:      l.config.Address,
+		BoundAddress: l.listener.Addr().String(),
+		Advertise:    []string{},
+		Listening:    l.err == nil,
+		FallbackFrom: l.fallbackFrom,
+	}
+	for _, channel := range []string{AdvertiseHello, AdvertisePeerList, AdvertiseMDNS} {
+		if l.config.Advertises(channel) {
+			status.Advertise = append(status.Advertise, channel)
+		}
+	}
+	if l.err != nil {
+		status.Error = l.err.Error()
+	}
+	return status
+}
+
+// listenerConfigs returns the configured listeners, or one on ListenPort
+// when none are
+func (n *Network) listenerConfigs() []config.ListenerConfig {
+	if len(n.config.P2P.Listeners) > 0 {
+		return n.config.P2P.Listeners
+	}
+	return []config.ListenerConfig{{Address: fmt.Sprintf(":%d", n.config.P2P.ListenPort)}}
+}
+
+// openListeners listens on every configured address, or on none if any of
+// them fails
+func (n *Network) openListeners() ([]*networkListener, error) {
+	var listeners []*networkListener
+	for _, cfg := range n.listenerConfigs() {
+		listener, fallbackFrom, err := n.listen(cfg.Address)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("failed to start TCP listener on %s: %w", cfg.Address, err)
+		}
+		listeners = append(listeners, &networkListener{config: cfg, listener: listener, fallbackFrom: fallbackFrom})
+	}
+	return listeners, nil
+}
+
+// errWSAAddrInUse is the error Windows fails to bind a port in use with,
+// which does not match syscall.EADDRINUSE there
+const errWSAAddrInUse = syscall.Errno(10048)
+
+// portInUse reports whether listening failed because the port is taken
+func portInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, errWSAAddrInUse)
+}
+
+// listen opens a listener on address. If its port is in use and port
+// fallback is enabled, the next free one of the PortRange ports after it is
+// taken instead and returned as fallbackFrom.
+func (n *Network) listen(address string) (listener net.Listener, fallbackFrom int, err error) {
+	listener, err = n.streamTransport().Listen(address)
+	if err == nil || !portInUse(err) {
+		return listener, 0, err
+	}
+	host, port, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return nil, 0, err
+	}
+	portNum, convErr := strconv.Atoi(port)
+	if convErr != nil || portNum == 0 {
+		return nil, 0, err
+	}
+
+	if !n.config.P2P.PortFallback {
+		setting := "p2p.listen_port or --port"
+		if len(n.config.P2P.Listeners) > 0 {
+			setting = "p2p.listeners"
+		}
+		return nil, 0, fmt.Errorf("port %d is already in use, possibly by a node already running; stop it, choose another port with %s, or enable p2p.port_fallback to take the next free one: %w",
+			portNum, setting, err)
+	}
+
+	last := min(portNum+n.config.P2P.PortRange, 65535)
+	for next := portNum + 1; next <= last; next++ {
+		listener, nextErr := n.streamTransport().Listen(net.JoinHostPort(host, strconv.Itoa(next)))
+		if nextErr == nil {
+			n.logger.Warnf("port %d is already in use, listening on port %d instead", portNum, next)
+			return listener, portNum, nil
+		}
+		if !portInUse(nextErr) {
+			return nil, 0, nextErr
+		}
+	}
+	return nil, 0, fmt.Errorf("ports %d to %d are all in use: %w", portNum, last, err)
+}
+
+// closeListeners closes each of listeners. One that failed while running is
+// already closed.
+func closeListeners(listeners []*networkListener) error {
+	var errs []error
+	for _, l := range listeners {
+		if err := l.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, fmt.Errorf("failed to close listener on %s: %w", l.config.Address, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ListenAddrs returns every address the network accepts connections on, or
+// nil while it is not started
+func (n *Network) ListenAddrs() []net.Addr {
+	var addrs []net.Addr
+	for _, l := range n.listeners {
+		addrs = append(addrs, l.listener.Addr())
+	}
+	return addrs
+}
+
+// listenerStatus reports the state of each listener
+func (n *Network) listenerStatus() []ListenerStatus {
+	statuses := make([]ListenerStatus, 0, len(n.listeners))
+	for _, l := range n.listeners {
+		statuses = append(statuses, l.status())
+	}
+	return statuses
+}
+
+// helloListeners lists the ports to tell peers about in HELLO
+func (n *Network) helloListeners() []HelloListener {
+	var ports []HelloListener
+	for _, l := range n.listeners {
+		if l.config.Advertises(AdvertiseHello) {
+			ports = append(ports, HelloListener{
+				Port:    l.port(),
+				Private: !l.config.Advertises(AdvertisePeerList),
+			})
+		}
+	}
+	return ports
+}
+
+// sharedListenPort returns the port that peers knowing only ListenPort in
+// HELLO may learn and pass on, or 0 if there is none
+func (n *Network) sharedListenPort() int {
+	for _, listener := range n.helloListeners() {
+		if !listener.Private {
+			return listener.Port
+		}
+	}
+	return 0
+}
+
+// mdnsPort returns the port to announce over mDNS, or 0 if no listener is
+// announced there
+func (n *Network) mdnsPort() int {
+	for _, l := range n.listeners {
+		if l.config.Advertises(AdvertiseMDNS) {
+			return l.port()
+		}
+	}
+	return 0
+}
+
+// learnListeners remembers where a peer that connected to us from host said
+// it accepts connections. Ports it asked to keep private are learnt to dial
+// it on but are not passed on to other peers.
+func (n *Network) learnListeners(peer *Peer, host string, hello HelloPayload) {
+	listeners := hello.Listeners
+	if len(listeners) == 0 && hello.ListenPort > 0 {
+		listeners = []HelloListener{{Port: hello.ListenPort}}
+	}
+
+	shared := false
+	for _, listener := range listeners {
+		if listener.Port <= 0 || listener.Port > 65535 {
+			continue
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(listener.Port))
+		if listener.Private {
+			n.peerStore.Learn(peer.ID, address, AddressSourcePrivate)
+			continue
+		}
+		if !shared {
+			peer.SetListenAddress(address)
+			shared = true
+		}
+		n.peerStore.Learn(peer.ID, address, AddressSourceHello)
+	}
+	if len(listeners) > 0 {
+		n.peerStore.Touch(peer.ID)
+	}
+}
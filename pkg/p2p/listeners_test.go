@@ -0,0 +1,316 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenOn makes a network accept connections on each of listeners, all on
+// loopback, and dial nothing by itself
+func listenOn(listeners ...config.ListenerConfig) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		dialNothing(cfg)
+		cfg.P2P.Listeners = listeners
+	}
+}
+
+// portOf returns the port of addr
+func portOf(t *testing.T, addr net.Addr) int {
+	_, port, err := net.SplitHostPort(addr.String())
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return portNum
+}
+
+func TestListenersAcceptOnEach(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetworkWith(t, ctx, "multi-listener", listenOn(
+		config.ListenerConfig{Address: "127.0.0.1:0"},
+		config.ListenerConfig{Address: "127.0.0.1:0", Advertise: []string{AdvertiseHello}},
+	))
+	addrs := network.ListenAddrs()
+	require.Len(t, addrs, 2)
+	assert.NotEqual(t, addrs[0].String(), addrs[1].String())
+	assert.Equal(t, addrs[0], network.ListenAddr())
+
+	// A peer connects to each listener
+	lan := startLocalNetwork(t, ctx, "lan-peer")
+	wan := startLocalNetwork(t, ctx, "wan-peer")
+	_, err := lan.Connect(ctx, addrs[0].String())
+	require.NoError(t, err)
+	_, err = wan.Connect(ctx, addrs[1].String())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return network.liveConnection("lan-peer") != nil && network.liveConnection("wan-peer") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	status := network.Status()
+	require.Len(t, status.Listeners, 2)
+	assert.Equal(t, ListenerStatus{
+		Address:      "127.0.0.1:0",
+		BoundAddress: addrs[0].String(),
+		Advertise:    []string{AdvertiseHello, AdvertisePeerList, AdvertiseMDNS},
+		Listening:    true,
+	}, status.Listeners[0])
+	assert.Equal(t, ListenerStatus{
+		Address:      "127.0.0.1:0",
+		BoundAddress: addrs[1].String(),
+		Advertise:    []string{AdvertiseHello},
+		Listening:    true,
+	}, status.Listeners[1])
+
+	// Stop closes them all
+	require.NoError(t, network.Stop())
+	assert.Nil(t, network.ListenAddrs())
+	assert.Empty(t, network.Status().Listeners)
+	for _, addr := range addrs {
+		_, err := lan.Connect(ctx, addr.String())
+		assert.Error(t, err)
+	}
+}
+
+func TestListenerFailureReported(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetworkWith(t, ctx, "failing-listener", listenOn(
+		config.ListenerConfig{Address: "127.0.0.1:0"},
+		config.ListenerConfig{Address: "127.0.0.1:0"},
+	))
+	require.NoError(t, network.listeners[1].listener.Close())
+
+	select {
+	case err := <-network.Errors():
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener failure not reported")
+	}
+	status := network.Status()
+	require.Len(t, status.Listeners, 2)
+	assert.True(t, status.Listeners[0].Listening)
+	assert.False(t, status.Listeners[1].Listening)
+	assert.NotEmpty(t, status.Listeners[1].Error)
+
+	// The other listener still accepts connections
+	peer := startLocalNetwork(t, ctx, "surviving-peer")
+	_, err := peer.Connect(ctx, network.ListenAddrs()[0].String())
+	require.NoError(t, err)
+}
+
+func TestListenersAdvertisedPerConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetworkWith(t, ctx, "advertising-node", listenOn(
+		config.ListenerConfig{Address: "127.0.0.1:0", Advertise: []string{AdvertiseMDNS}},
+		config.ListenerConfig{Address: "127.0.0.1:0", Advertise: []string{AdvertiseHello}},
+		config.ListenerConfig{Address: "127.0.0.1:0"},
+	))
+	addrs := network.ListenAddrs()
+	require.Len(t, addrs, 3)
+
+	// HELLO leaves out the first listener, marks the second private and
+	// repeats the third for peers that only know ListenPort
+	assert.Equal(t, []HelloListener{
+		{Port: portOf(t, addrs[1]), Private: true},
+		{Port: portOf(t, addrs[2])},
+	}, network.helloListeners())
+	assert.Equal(t, portOf(t, addrs[2]), network.sharedListenPort())
+	assert.Equal(t, portOf(t, addrs[0]), network.mdnsPort())
+
+	// A peer the node dials learns both ports from the HELLO
+	peer := startLocalNetwork(t, ctx, "learning-peer")
+	_, err := network.Connect(ctx, localAddr(peer))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		record, ok := peer.peerStore.Get("advertising-node")
+		return ok && len(record.Addresses) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	record, _ := peer.peerStore.Get("advertising-node")
+	host, _, err := net.SplitHostPort(peer.liveConnection("advertising-node").Address)
+	require.NoError(t, err)
+	private := net.JoinHostPort(host, strconv.Itoa(portOf(t, addrs[1])))
+	shared := net.JoinHostPort(host, strconv.Itoa(portOf(t, addrs[2])))
+	sources := make(map[string]string)
+	for _, entry := range record.Addresses {
+		sources[entry.Address] = entry.Source
+	}
+	assert.Equal(t, map[string]string{private: AddressSourcePrivate, shared: AddressSourceHello}, sources)
+
+	// Only the shared port is passed on in PEER_LIST
+	var listed *PeerInfo
+	for _, info := range peer.peerInfos() {
+		if info.ID == "advertising-node" {
+			listed = &info
+		}
+	}
+	require.NotNil(t, listed)
+	assert.Equal(t, shared, listed.Address)
+	assert.Empty(t, listed.Addresses)
+}
+
+func TestPeerStoreKeepsPrivateAddresses(t *testing.T) {
+	store := NewPeerStore(nil)
+	store.Learn("node-a", "10.0.0.1:9000", AddressSourcePrivate)
+
+	// Dialing the address does not make it shareable
+	store.Record("node-a", "10.0.0.1:9000")
+	record, ok := store.Get("node-a")
+	require.True(t, ok)
+	require.Len(t, record.Addresses, 1)
+	assert.Equal(t, AddressSourcePrivate, record.Addresses[0].Source)
+	assert.True(t, record.Addresses[0].trusted())
+
+	// The peer sharing it again does
+	store.Learn("node-a", "10.0.0.1:9000", AddressSourceHello)
+	record, _ = store.Get("node-a")
+	assert.Equal(t, AddressSourceHello, record.Addresses[0].Source)
+}
+
+func TestOutboundOnlyNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const interval = 200 * time.Millisecond
+	hub := startLocalNetworkWith(t, ctx, "outbound-hub", bootstrapFrom(), discoverEvery(interval))
+	other := startLocalNetworkWith(t, ctx, "outbound-other", bootstrapFrom(localAddr(hub)), discoverEvery(interval))
+
+	cfg := config.Default()
+	cfg.P2P.ListenEnabled = false
+	cfg.P2P.EnableDiscovery = false
+	cfg.P2P.StaticPeers = []string{"outbound-hub@" + localAddr(hub)}
+	cfg.Storage.DataDir = t.TempDir()
+	client := newLocalNetwork(t, cfg, "outbound-client")
+	client.heartbeatInterval = 50 * time.Millisecond
+	client.discoveryInterval = interval
+	client.staticRetryDelay = 20 * time.Millisecond
+	require.NoError(t, client.Start(ctx))
+	t.Cleanup(func() { client.Stop() })
+	// Heartbeats come with discovery, whose mDNS browse would slow the
+	// discovery cycles down
+	client.background(client.heartbeatService)
+
+	// Not listening is not a failure
+	status := client.Status()
+	assert.False(t, status.Listening)
+	assert.True(t, status.OutboundOnly)
+	assert.Empty(t, status.Listeners)
+	assert.Nil(t, client.ListenAddrs())
+	assert.Nil(t, client.ListenAddr())
+	assert.Empty(t, client.Errors())
+
+	// The static hub is dialed and the other node found through it
+	require.Eventually(t, func() bool {
+		return client.liveConnection("outbound-hub") != nil && client.liveConnection("outbound-other") != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	for _, connection := range client.pool.GetConnections() {
+		assert.True(t, connection.Outbound)
+	}
+	assert.False(t, hub.Status().OutboundOnly)
+
+	// Messages flow both ways over the connection the client opened
+	fromClient := make(chan Message, 1)
+	fromHub := make(chan Message, 1)
+	hub.RegisterHandler("NOTE", func(msg Message) { fromClient <- msg })
+	client.RegisterHandler("NOTE", func(msg Message) { fromHub <- msg })
+	require.NoError(t, client.SendMessage(ctx, "outbound-hub", NewMessage("NOTE", client.nodeID, "up")))
+	require.NoError(t, hub.SendMessage(ctx, "outbound-client", NewMessage("NOTE", hub.nodeID, "down")))
+	for _, received := range []chan Message{fromClient, fromHub} {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not delivered")
+		}
+	}
+
+	// Heartbeats keep arriving at the hub
+	before := hub.monitor.Stats.GetStats().TotalMessagesReceived
+	require.Eventually(t, func() bool {
+		return hub.monitor.Stats.GetStats().TotalMessagesReceived >= before+3
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Nobody passes on an address for the client, which has none
+	for _, node := range []*Network{hub, other} {
+		for _, info := range node.peerInfos() {
+			assert.NotEqual(t, "outbound-client", info.ID)
+		}
+	}
+
+	// The client dials the hub again after losing it
+	require.NoError(t, hub.DisconnectPeer("outbound-client", DisconnectOptions{Reason: "test"}))
+	require.Eventually(t, func() bool {
+		return hub.liveConnection("outbound-client") != nil
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestPortFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The nodes share one host, where the first holds the port the others
+	// are configured for
+	host := testHost()
+	start := func(nodeID string, port int, fallback bool, portRange int) (*Network, error) {
+		cfg := config.Default()
+		cfg.P2P.ListenPort = port
+		cfg.P2P.PortFallback = fallback
+		cfg.P2P.PortRange = portRange
+		cfg.Storage.DataDir = t.TempDir()
+		network := newLocalNetwork(t, cfg, nodeID)
+		if *transportFlag == "memory" {
+			network.SetTransport(host)
+		}
+		if err := network.Start(ctx); err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { network.Stop() })
+		return network, nil
+	}
+	holder, err := start("port-holder", 0, false, 0)
+	require.NoError(t, err)
+	taken := portOf(t, holder.ListenAddr())
+
+	// Without fallback the error says what to do
+	_, err = start("port-blocked", taken, false, 0)
+	require.Error(t, err)
+	assert.True(t, portInUse(err))
+	assert.ErrorContains(t, err, fmt.Sprintf("port %d is already in use", taken))
+	assert.ErrorContains(t, err, "p2p.port_fallback")
+
+	// With it the node listens on a port after the taken one, and
+	// advertises that
+	fallback, err := start("port-fallback", taken, true, 10)
+	require.NoError(t, err)
+	status := fallback.Status()
+	assert.Greater(t, status.ListenPort, taken)
+	assert.LessOrEqual(t, status.ListenPort, taken+10)
+	require.Len(t, status.Listeners, 1)
+	assert.Equal(t, taken, status.Listeners[0].FallbackFrom)
+	assert.Equal(t, status.ListenPort, portOf(t, fallback.ListenAddr()))
+	assert.Equal(t, []HelloListener{{Port: status.ListenPort}}, fallback.helloListeners())
+	assert.Equal(t, status.ListenPort, fallback.mdnsPort())
+	assert.Zero(t, holder.Status().Listeners[0].FallbackFrom)
+
+	// Peers reach it there
+	peer := startLocalNetwork(t, ctx, "fallback-peer")
+	_, err = peer.Connect(ctx, localAddr(fallback))
+	require.NoError(t, err)
+
+	// A range with no free port left fails
+	if status.ListenPort == taken+1 {
+		_, err = start("port-exhausted", taken, true, 1)
+		assert.ErrorContains(t, err, fmt.Sprintf("ports %d to %d are all in use", taken, taken+1))
+	}
+}
@@ -0,0 +1,193 @@
+package p2p
+
+import (
+	"cmp"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRumorDigestSize is how many peers a heartbeat, ping or ping
+	// answer vouches for at most; receivers ignore any beyond
+	DefaultRumorDigestSize = 32
+	// rumorSilenceTimeouts is how many idle timeouts rumors may vouch for
+	// a peer we did not hear from ourselves. Past that it is pinged
+	// whatever others say, so lying peers cannot keep a dead one around.
+	rumorSilenceTimeouts = 3
+	// rumorTrustedReputation is the reputation from which a peer's rumors
+	// are taken at face value. Below it, down to 0, they count as older
+	// than they say; peers at or below 0 are not listened to.
+	rumorTrustedReputation = 0.1
+)
+
+// LivenessRumor says the reporting peer heard from PeerID at ObservedAt,
+// in Unix milliseconds by the reporter's clock
+type LivenessRumor struct {
+	PeerID     string `json:"peer_id"`
+	ObservedAt int64  `json:"observed_at"`
+}
+
+// livenessPayload carries a liveness digest on PING messages and their PONG
+// answers
+type livenessPayload struct {
+	Alive []LivenessRumor `json:"alive,omitempty"`
+}
+
+// LivenessStats counts how liveness rumors spared pinging idle connections
+type LivenessStats struct {
+	// RumorsHeard counts rumors that moved a peer's last seen time later,
+	// RumorsIgnored those from peers not trusted enough
+	RumorsHeard   uint64 `json:"rumors_heard"`
+	RumorsIgnored uint64 `json:"rumors_ignored"`
+	// Probes counts pings sent to idle connections, Deferred the times an
+	// idle connection was kept without one because other peers vouched
+	// for its peer
+	Probes   uint64 `json:"probes"`
+	Deferred uint64 `json:"deferred"`
+}
+
+// livenessCounters backs LivenessStats
+type livenessCounters struct {
+	heard    atomic.Uint64
+	ignored  atomic.Uint64
+	probes   atomic.Uint64
+	deferred atomic.Uint64
+}
+
+// LivenessStats reports how liveness rumors spared pinging idle connections
+func (n *Network) LivenessStats() LivenessStats {
+	return LivenessStats{
+		RumorsHeard:   n.liveness.heard.Load(),
+		RumorsIgnored: n.liveness.ignored.Load(),
+		Probes:        n.liveness.probes.Load(),
+		Deferred:      n.liveness.deferred.Load(),
+	}
+}
+
+// rumorMaxSilence returns how long rumors may vouch for a peer we did not
+// hear from ourselves
+func (n *Network) rumorMaxSilence() time.Duration {
+	return rumorSilenceTimeouts * n.pool.timeout
+}
+
+// livenessDigest lists the peers we heard from ourselves within the idle
+// timeout, latest first, for heartbeats, pings and their answers to vouch
+// for. It is nil with liveness rumors disabled.
+func (n *Network) livenessDigest() []LivenessRumor {
+	if !n.config.P2P.LivenessRumors {
+		return nil
+	}
+	var digest []LivenessRumor
+	for _, connection := range n.pool.GetConnections() {
+		seen := connection.lastSeen()
+		if connection.PeerID == "" || time.Since(seen) >= n.pool.timeout {
+			continue
+		}
+		digest = append(digest, LivenessRumor{PeerID: connection.PeerID, ObservedAt: seen.UnixMilli()})
+	}
+	slices.SortFunc(digest, func(a, b LivenessRumor) int {
+		return cmp.Compare(b.ObservedAt, a.ObservedAt)
+	})
+	if len(digest) > DefaultRumorDigestSize {
+		digest = digest[:DefaultRumorDigestSize]
+	}
+	return digest
+}
+
+// pingPayload returns the payload of a PING: the liveness digest, or nil
+// when there is nothing to vouch for
+func (n *Network) pingPayload() interface{} {
+	digest := n.livenessDigest()
+	if len(digest) == 0 {
+		return nil
+	}
+	return livenessPayload{Alive: digest}
+}
+
+// rumorWeight returns how far the rumors of reporter are believed, from 0
+// for none to 1 for fully, going by its reputation
+func (n *Network) rumorWeight(reporter string) float64 {
+	info, known := n.topologyMgr.GetPeerInfo(reporter)
+	if !known {
+		return 0
+	}
+	return min(max(info.Reputation/rumorTrustedReputation, 0), 1)
+}
+
+// hearRumors extends the last seen time of the peers reporter vouches for
+// that we know. A rumor counts as older the less reporter is trusted.
+func (n *Network) hearRumors(reporter string, rumors []LivenessRumor) {
+	if !n.config.P2P.LivenessRumors || len(rumors) == 0 {
+		return
+	}
+	if len(rumors) > DefaultRumorDigestSize {
+		rumors = rumors[:DefaultRumorDigestSize]
+	}
+	weight := n.rumorWeight(reporter)
+	if weight <= 0 {
+		n.liveness.ignored.Add(uint64(len(rumors)))
+		return
+	}
+
+	now := time.Now()
+	discount := time.Duration((1 - weight) * float64(n.pool.timeout))
+	for _, rumor := range rumors {
+		if rumor.PeerID == n.nodeID || rumor.PeerID == reporter {
+			continue
+		}
+		peer, known := n.peers.Get(rumor.PeerID)
+		if !known {
+			continue
+		}
+		observed := time.UnixMilli(rumor.ObservedAt)
+		if observed.After(now) {
+			observed = now
+		}
+		if peer.hearRumor(observed.Add(-discount), n.rumorMaxSilence()) {
+			n.liveness.heard.Add(1)
+		}
+	}
+}
+
+// vouchedFor reports whether other peers recently heard from the peer of an
+// idle connection, so it can be kept without pinging the peer
+func (n *Network) vouchedFor(connection *Connection) bool {
+	if !n.config.P2P.LivenessRumors || connection.PeerID == "" {
+		return false
+	}
+	peer, known := n.peers.Get(connection.PeerID)
+	if !known || peer.GetConnection() != connection {
+		return false
+	}
+	if !peer.vouchedFor(n.pool.timeout, n.rumorMaxSilence()) {
+		return false
+	}
+	n.liveness.deferred.Add(1)
+	return true
+}
+
+// hearRumor records that other peers heard from the peer at observed,
+// though never later than maxSilence after we last heard from it
+// ourselves. It reports whether that moved its last seen time later.
+func (p *Peer) hearRumor(observed time.Time, maxSilence time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if limit := p.heardLocked().Add(maxSilence); observed.After(limit) {
+		observed = limit
+	}
+	if !observed.After(p.lastSeenLocked()) {
+		return false
+	}
+	p.rumoredAt = observed
+	return true
+}
+
+// vouchedFor reports whether rumors put the peer within timeout though we
+// have not heard from it ourselves for up to maxSilence
+func (p *Peer) vouchedFor(timeout, maxSilence time.Duration) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return time.Since(p.rumoredAt) < timeout && time.Since(p.heardLocked()) < maxSilence
+}
@@ -0,0 +1,250 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startProbingMesh starts size networks on the in-memory network, each
+// connected to all others, whose pools ping connections idle for 150ms
+// every 50ms. Their hosts are named after the node IDs, prefix-1 on.
+func startProbingMesh(t *testing.T, ctx context.Context, prefix string, size int, rumors bool) []*Network {
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+
+	var mesh []*Network
+	for i := 1; i <= size; i++ {
+		cfg := config.Default()
+		cfg.P2P.ListenPort = 0
+		cfg.Storage.DataDir = t.TempDir()
+		cfg.P2P.MinPeers = 0
+		cfg.P2P.TargetPeers = 0
+		cfg.P2P.DiscoveryFloor = 0
+		cfg.P2P.LivenessRumors = rumors
+
+		nodeID := fmt.Sprintf("%s-%d", prefix, i)
+		network, err := New(cfg, log, nodeID)
+		require.NoError(t, err)
+		network.SetTransport(memoryNetwork.Host(nodeID))
+		network.pool.timeout = 150 * time.Millisecond
+		network.pool.interval = 50 * time.Millisecond
+		network.pool.grace = 200 * time.Millisecond
+		require.NoError(t, network.Start(ctx))
+		t.Cleanup(func() { network.Stop() })
+		mesh = append(mesh, network)
+	}
+
+	for i, dialer := range mesh {
+		for _, listener := range mesh[i+1:] {
+			_, err := dialer.Connect(ctx, localAddr(listener))
+			require.NoError(t, err)
+		}
+	}
+	require.Eventually(t, func() bool {
+		for _, network := range mesh {
+			if network.peers.ConnectedCount() != size-1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	return mesh
+}
+
+// meshProbes counts the pings the mesh sent to idle connections
+func meshProbes(mesh []*Network) uint64 {
+	var probes uint64
+	for _, network := range mesh {
+		probes += network.LivenessStats().Probes
+	}
+	return probes
+}
+
+func TestRumorsReduceProbing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The same mesh with and without rumors, where one pair at a time talks
+	// every 20ms so peers hear from each other at different times
+	const size = 5
+	probes := make(map[bool]uint64)
+	for _, rumors := range []bool{false, true} {
+		mesh := startProbingMesh(t, ctx, fmt.Sprintf("probing-rumors-%t", rumors), size, rumors)
+		var pairs [][2]*Network
+		for i, network := range mesh {
+			for _, other := range mesh[i+1:] {
+				pairs = append(pairs, [2]*Network{network, other})
+			}
+		}
+
+		before := meshProbes(mesh)
+		deadline := time.Now().Add(2 * time.Second)
+		for i := 0; time.Now().Before(deadline); i++ {
+			pair := pairs[i*3%len(pairs)]
+			_, err := pair[0].Ping(ctx, pair[1].nodeID)
+			require.NoError(t, err)
+			time.Sleep(20 * time.Millisecond)
+		}
+		probes[rumors] = meshProbes(mesh) - before
+
+		// Either way no live connection is lost
+		for _, network := range mesh {
+			assert.Equal(t, size-1, network.peers.ConnectedCount())
+		}
+	}
+
+	t.Logf("probes in 2s: %d without rumors, %d with", probes[false], probes[true])
+	assert.Positive(t, probes[true], "peers are still probed now and then")
+	assert.Less(t, float64(probes[true]), 0.8*float64(probes[false]))
+}
+
+func TestRumorsCannotKeepDeadPeerAlive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The dead peer never gives up on its connections itself
+	mesh := startProbingMesh(t, ctx, "liar", 2, true)
+	node, liar := mesh[0], mesh[1]
+	dead := startCleaningNetwork(t, ctx, "liar-dead", "liar-dead", time.Hour)
+	for _, network := range mesh {
+		_, err := network.Connect(ctx, localAddr(dead))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return dead.peers.ConnectedCount() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	node.topologyMgr.UpdatePeerReputation(liar.nodeID, 1)
+	connection := node.liveConnection(dead.nodeID)
+	require.NotNil(t, connection)
+
+	// It stops answering the node while the trusted liar keeps vouching
+	// for it
+	memoryNetwork.Hold(dead.nodeID, node.nodeID)
+	memoryNetwork.Hold(node.nodeID, dead.nodeID)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				node.hearRumors(liar.nodeID, []LivenessRumor{{PeerID: dead.nodeID, ObservedAt: time.Now().UnixMilli()}})
+			}
+		}
+	}()
+
+	// Past the longest silence rumors cover, the node pings it anyway and
+	// gives up on it
+	require.Eventually(t, func() bool {
+		return node.liveConnection(dead.nodeID) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "inactive", connection.CloseReason())
+	assert.Positive(t, node.LivenessStats().Deferred)
+	assert.Positive(t, node.LivenessStats().RumorsHeard)
+}
+
+// startQuietMesh starts networks that do not ping idle connections, the
+// first connected to the others
+func startQuietMesh(t *testing.T, ctx context.Context, nodeIDs ...string) []*Network {
+	var mesh []*Network
+	for _, nodeID := range nodeIDs {
+		mesh = append(mesh, startCleaningNetwork(t, ctx, nodeID, nodeID, time.Minute))
+	}
+	for _, network := range mesh[1:] {
+		_, err := mesh[0].Connect(ctx, localAddr(network))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return mesh[0].peers.ConnectedCount() == len(mesh)-1
+	}, 5*time.Second, 10*time.Millisecond)
+	return mesh
+}
+
+func TestRumorsWeighedByReputation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mesh := startQuietMesh(t, ctx, "weighing-node", "weighing-reporter", "weighing-subject")
+	node, reporter, subject := mesh[0], mesh[1], mesh[2]
+	peer, ok := node.peers.Get(subject.nodeID)
+	require.True(t, ok)
+	heard := peer.lastSeen()
+	observed := heard.Add(10 * time.Second).Truncate(time.Millisecond)
+	rumor := []LivenessRumor{{PeerID: subject.nodeID, ObservedAt: observed.UnixMilli()}}
+
+	// An untrusted reporter is not listened to
+	node.topologyMgr.UpdatePeerReputation(reporter.nodeID, 0)
+	node.hearRumors(reporter.nodeID, rumor)
+	assert.Equal(t, uint64(1), node.LivenessStats().RumorsIgnored)
+	assert.Equal(t, heard, peer.lastSeen())
+
+	// A half trusted one's rumor counts as half an idle timeout older,
+	// which is no news here
+	node.topologyMgr.UpdatePeerReputation(reporter.nodeID, rumorTrustedReputation/2)
+	node.hearRumors(reporter.nodeID, rumor)
+	assert.Equal(t, heard, peer.lastSeen())
+
+	// A trusted one's is taken as it comes, even from the future
+	node.topologyMgr.UpdatePeerReputation(reporter.nodeID, 1)
+	node.hearRumors(reporter.nodeID, rumor)
+	assert.WithinDuration(t, time.Now(), peer.lastSeen(), time.Second)
+	assert.Equal(t, uint64(1), node.LivenessStats().RumorsHeard)
+
+	// Rumors about ourselves, the reporter or strangers change nothing
+	later := time.Now().Add(time.Hour).UnixMilli()
+	node.hearRumors(reporter.nodeID, []LivenessRumor{
+		{PeerID: node.nodeID, ObservedAt: later},
+		{PeerID: reporter.nodeID, ObservedAt: later},
+		{PeerID: "stranger", ObservedAt: later},
+	})
+	assert.Equal(t, uint64(1), node.LivenessStats().RumorsHeard)
+}
+
+func TestPeerHearRumorCapped(t *testing.T) {
+	peer := NewPeer("rumored", "10.0.0.1:8080", "1.0.0")
+	heard := time.Now().Add(-10 * time.Second)
+	peer.LastSeen = heard
+
+	// Rumors cannot put the peer more than maxSilence past when we last
+	// heard from it ourselves
+	assert.True(t, peer.hearRumor(time.Now(), 3*time.Second))
+	assert.Equal(t, heard.Add(3*time.Second), peer.lastSeen())
+	assert.False(t, peer.hearRumor(time.Now(), 3*time.Second))
+	assert.False(t, peer.vouchedFor(time.Second, 3*time.Second))
+
+	// Within it they vouch for the peer
+	peer.LastSeen = time.Now().Add(-2 * time.Second)
+	assert.True(t, peer.hearRumor(time.Now(), 3*time.Second))
+	assert.True(t, peer.vouchedFor(time.Second, 3*time.Second))
+
+	// An older rumor does not move last seen back
+	assert.False(t, peer.hearRumor(time.Now().Add(-time.Minute), 3*time.Second))
+}
+
+func TestLivenessDigest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mesh := startQuietMesh(t, ctx, "digest-node", "digest-talker", "digest-quiet")
+	node := mesh[0]
+	quiet := node.liveConnection(mesh[2].nodeID)
+	quiet.mu.Lock()
+	quiet.LastSeen = time.Now().Add(-2 * time.Minute)
+	quiet.mu.Unlock()
+
+	// Only peers heard from within the idle timeout are vouched for
+	digest := node.livenessDigest()
+	require.Len(t, digest, 1)
+	assert.Equal(t, mesh[1].nodeID, digest[0].PeerID)
+
+	// Heartbeats carry the digest
+	assert.NotEmpty(t, node.heartbeatPayload().Alive)
+}
@@ -3,7 +3,12 @@ package p2p
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sync"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
 )
 
 const (
@@ -12,6 +17,11 @@ const (
 	MessageTypeDataSync  = "DATA_SYNC"
 	MessageTypeHeartbeat = "HEARTBEAT"
 	MessageTypeError     = "ERROR"
+	MessageTypeGoodbye   = "GOODBYE"
+
+	MessageTypeTopologyReport  = "TOPOLOGY_REPORT"
+	MessageTypeAck             = "ACK"
+	MessageTypePeerListRequest = "PEER_LIST_REQUEST"
 )
 
 // Message represents a P2P network message
@@ -21,27 +31,118 @@ type Message struct {
 	Sender    string      `json:"sender"`
 	Timestamp time.Time   `json:"timestamp"`
 	Payload   interface{} `json:"payload"`
+
+	// Origin and HopLimit are set on gossiped messages only
+	Origin   string `json:"origin,omitempty"`
+	HopLimit int    `json:"hop_limit,omitempty"`
+
+	// ReplyTo correlates a reply, ACK or ERROR with the message it answers.
+	// ExpectReply marks requests; RequireAck asks the receiver to ACK.
+	ReplyTo     string `json:"reply_to,omitempty"`
+	ExpectReply bool   `json:"expect_reply,omitempty"`
+	RequireAck  bool   `json:"require_ack,omitempty"`
+
+	// Seq numbers the application messages sent on a connection, from 1, so
+	// the receiver can hand them on in the order they were sent. Replies and
+	// the network's own messages are not numbered.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// TTLMs is how long, in milliseconds from Timestamp, the message is
+	// worth delivering, or 0 for as long as it takes. Once expired it is
+	// neither sent nor handed to handlers. SetTTL sets it.
+	TTLMs int64 `json:"ttl_ms,omitempty"`
+
+	// TraceID ties together every message sent on account of one request,
+	// across the nodes it passes: it is set where the message originates,
+	// kept as the message is relayed or retransmitted, and copied to the
+	// replies. Nodes log it with each line about the message.
+	TraceID string `json:"trace_id,omitempty"`
+
+	// delivery says which handlers of its type a queued message is for
+	delivery handlerDelivery
 }
 
 // HelloPayload contains data for HELLO messages
 type HelloPayload struct {
 	NodeID      string `json:"node_id"`
 	Version     string `json:"version"`
+	MinVersion  string `json:"min_version,omitempty"`
 	ListenPort  int    `json:"listen_port"`
 	Capabilities []string `json:"capabilities"`
+	// QUICPort is the UDP port of a peer advertising CapabilityQUIC
+	QUICPort int `json:"quic_port,omitempty"`
+	// Metadata labels the sending node, within the topology.MaxMetadata*
+	// limits; peers ignore metadata beyond them
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Listeners lists every port the sender accepts connections on.
+	// ListenPort repeats the first one that may be passed on, for peers
+	// that do not know Listeners.
+	Listeners []HelloListener `json:"listeners,omitempty"`
+	// ObservedHost is the host the sender sees the receiver's connection
+	// come from, which the receiver signs its peer record with
+	ObservedHost string `json:"observed_host,omitempty"`
+}
+
+// HelloListener is a port a node accepts connections on. A private port is
+// for the receiver to dial and not to pass on in PEER_LIST.
+type HelloListener struct {
+	Port    int  `json:"port"`
+	Private bool `json:"private,omitempty"`
 }
 
 // PeerListPayload contains data for PEER_LIST messages
 type PeerListPayload struct {
 	Peers []PeerInfo `json:"peers"`
+	// HasMore is set when the sender knows more peers than the list holds.
+	// NextCursor, if set, asks for the rest in a PEER_LIST_REQUEST.
+	HasMore    bool   `json:"has_more,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Sender is the sender's own signed record
+	Sender *crypto.SignedPeerRecord `json:"sender,omitempty"`
 }
 
-// PeerInfo represents information about a peer
+// validate rejects lists longer than any sender may send
+func (p *PeerListPayload) validate() error {
+	if len(p.Peers) > MaxPeerListSize {
+		return fmt.Errorf("peer list holds %d peers, more than %d", len(p.Peers), MaxPeerListSize)
+	}
+	for _, info := range p.Peers {
+		if len(info.Addresses) > MaxPeerAddresses {
+			return fmt.Errorf("peer %s listed with %d addresses, more than %d", info.ID, len(info.Addresses), MaxPeerAddresses)
+		}
+		if info.Record != nil && len(info.Record.Addresses) > MaxPeerAddresses {
+			return fmt.Errorf("record of %s holds %d addresses, more than %d", info.ID, len(info.Record.Addresses), MaxPeerAddresses)
+		}
+	}
+	if p.Sender != nil && len(p.Sender.Addresses) > MaxPeerAddresses {
+		return fmt.Errorf("record of the sender holds %d addresses, more than %d", len(p.Sender.Addresses), MaxPeerAddresses)
+	}
+	return nil
+}
+
+// PeerListRequestPayload asks for a page of a peer's peer list in peer ID
+// order, starting after Cursor. An empty cursor asks for the first page,
+// and Limit, if set, for fewer than MaxPeerListSize peers.
+type PeerListRequestPayload struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// PeerInfo represents information about a peer. LastSeen is when the
+// sender last heard from the peer, in Unix seconds by the sender's clock, so
+// receivers only report it and never judge the peer's liveness by it.
 type PeerInfo struct {
 	ID       string `json:"id"`
 	Address  string `json:"address"`
 	Version  string `json:"version"`
 	LastSeen int64  `json:"last_seen"`
+	// Addresses lists further addresses the peer may be reached at, up to
+	// MaxPeerAddresses
+	Addresses []string `json:"addresses,omitempty"`
+	// Record is the peer's own signed record, if the sender holds one.
+	// Receivers go by its addresses and ignore Address and Addresses,
+	// which are kept for peers that predate signed records.
+	Record *crypto.SignedPeerRecord `json:"record,omitempty"`
 }
 
 // DataSyncPayload contains data for DATA_SYNC messages
@@ -51,25 +152,290 @@ type DataSyncPayload struct {
 	Content   interface{} `json:"content"`
 	Version   int64       `json:"version"`
 	Timestamp int64       `json:"timestamp"`
+	Origin    string      `json:"origin,omitempty"`
+	Deleted   bool        `json:"deleted,omitempty"`
 }
 
-// HeartbeatPayload contains data for HEARTBEAT messages
+// HeartbeatPayload contains data for HEARTBEAT messages. TS is the sender's
+// clock in Unix seconds, for information; liveness goes by when we receive
+// the heartbeat.
 type HeartbeatPayload struct {
 	NodeID string `json:"node_id"`
 	TS     int64  `json:"timestamp"`
+
+	// Load hints; peers that predate them leave them out
+	Connections int  `json:"connections,omitempty"`
+	QueueDepth  int  `json:"queue_depth,omitempty"`
+	Full        bool `json:"full,omitempty"`       // no room for more peers
+	Overloaded  bool `json:"overloaded,omitempty"` // message queue backing up
+
+	// Alive names peers the sender recently heard from; see LivenessRumor
+	Alive []LivenessRumor `json:"alive,omitempty"`
+
+	// Topics are the topics the sender is subscribed to, so publishers can
+	// gossip to it first
+	Topics []string `json:"topics,omitempty"`
+}
+
+// validate rejects heartbeats advertising more topics than we keep
+func (p *HeartbeatPayload) validate() error {
+	if len(p.Topics) > MaxAdvertisedTopics {
+		return fmt.Errorf("heartbeat advertises %d topics, more than %d", len(p.Topics), MaxAdvertisedTopics)
+	}
+	return nil
+}
+
+// GoodbyePayload contains data for GOODBYE messages
+type GoodbyePayload struct {
+	Reason string `json:"reason"`
+}
+
+// TopologyReportPayload contains data for TOPOLOGY_REPORT messages. A report
+// with Reply unset asks the receiver to answer with its own report.
+type TopologyReportPayload struct {
+	Peers []string `json:"peers"`
+	Reply bool     `json:"reply"`
+}
+
+// SyncRequestPayload contains data for SYNC_REQUEST messages
+type SyncRequestPayload struct {
+	Keys  []string `json:"keys"`
+	Since int64    `json:"since"`
+}
+
+// SyncResponsePayload contains data for SYNC_RESPONSE messages. Watermark is
+// the responder's position to resume from; More means entries were held back.
+type SyncResponsePayload struct {
+	Entries   []DataSyncPayload `json:"entries"`
+	Watermark int64             `json:"watermark"`
+	More      bool              `json:"more,omitempty"`
+}
+
+// AITurn is one turn of the conversation history in an AI_REQUEST
+type AITurn struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// AIRequestPayload contains data for AI_REQUEST messages. With Stream set,
+// a peer advertising CapabilityAIStream sends the answer as it is generated,
+// in AI_RESPONSE_CHUNKs, before the AI_RESPONSE. NoCache asks the peer not
+// to answer from its cache.
+type AIRequestPayload struct {
+	Message string   `json:"message"`
+	History []AITurn `json:"history,omitempty"`
+	Stream  bool     `json:"stream,omitempty"`
+	NoCache bool     `json:"no_cache,omitempty"`
+}
+
+// AIResponsePayload contains data for AI_RESPONSE messages, the whole answer
+// to an AI_REQUEST. Chunks is the number of AI_RESPONSE_CHUNKs streamed
+// ahead of it, which the requester waits for.
+type AIResponsePayload struct {
+	Text      string `json:"response"`
+	Model     string `json:"model,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+	Chunks    int    `json:"chunks,omitempty"`
+}
+
+// AIResponseChunkPayload contains data for AI_RESPONSE_CHUNK messages: the
+// Index'th piece, counting from 0, of the answer to the AI_REQUEST RequestID
+type AIResponseChunkPayload struct {
+	RequestID string `json:"request_id"`
+	Index     int    `json:"index"`
+	Text      string `json:"text"`
+}
+
+// validate rejects chunks that could not have been sent
+func (p *AIResponseChunkPayload) validate() error {
+	if p.RequestID == "" {
+		return fmt.Errorf("AI response chunk without a request")
+	}
+	if p.Index < 0 {
+		return fmt.Errorf("AI response chunk with negative index %d", p.Index)
+	}
+	return nil
+}
+
+// AICancelPayload contains data for AI_CANCEL messages, which stop the
+// answer to the AI_REQUEST RequestID being generated
+type AICancelPayload struct {
+	RequestID string `json:"request_id"`
+}
+
+// TaskSubmitPayload contains data for TASK_SUBMIT messages, which ask a
+// peer to run the task Name on Input within TimeoutMs. The peer answers with
+// a TASK_RESULT, or an ERROR if it will not run the task.
+type TaskSubmitPayload struct {
+	TaskID    string `json:"task_id"`
+	Name      string `json:"name"`
+	Input     []byte `json:"input,omitempty"`
+	TimeoutMs int64  `json:"timeout_ms"`
+}
+
+// validate rejects submissions that could not be run
+func (p *TaskSubmitPayload) validate() error {
+	if p.TaskID == "" || p.Name == "" {
+		return fmt.Errorf("task submission without an ID or name")
+	}
+	if p.TimeoutMs <= 0 {
+		return fmt.Errorf("task submission with timeout %dms", p.TimeoutMs)
+	}
+	return nil
+}
+
+// TaskResultPayload contains data for TASK_RESULT messages, the outcome of
+// a TASK_SUBMIT: its output, or the error the task failed with. Running and
+// Capacity tell the submitter how busy the executor is.
+type TaskResultPayload struct {
+	TaskID     string `json:"task_id"`
+	Output     []byte `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Running    int    `json:"running"`
+	Capacity   int    `json:"capacity"`
+}
+
+// TaskStatusPayload contains data for TASK_STATUS messages. A request names
+// TaskID; the reply gives its State and how busy the executor is.
+type TaskStatusPayload struct {
+	TaskID   string `json:"task_id"`
+	State    string `json:"state,omitempty"`
+	Running  int    `json:"running"`
+	Capacity int    `json:"capacity"`
+}
+
+// BlobAnnouncePayload contains data for BLOB_ANNOUNCE messages: the hex
+// SHA-256 hashes of blobs the announcing node holds
+type BlobAnnouncePayload struct {
+	Hashes []string `json:"hashes"`
+}
+
+// BlobRequestPayload contains data for BLOB_REQUEST messages, which ask for
+// at most Length bytes of a blob from Offset on
+type BlobRequestPayload struct {
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// validate rejects requests for no bytes or from before the start
+func (p *BlobRequestPayload) validate() error {
+	if p.Hash == "" {
+		return fmt.Errorf("blob request without a hash")
+	}
+	if p.Offset < 0 || p.Length <= 0 {
+		return fmt.Errorf("blob request for %d bytes at offset %d", p.Length, p.Offset)
+	}
+	return nil
+}
+
+// BlobChunkPayload contains data for BLOB_CHUNK messages: the bytes of a
+// blob from Offset on, and the size of the whole blob
+type BlobChunkPayload struct {
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// FragmentPayload contains data for FRAGMENT messages. The fragments of a
+// group carry, in order, the bytes of one message encoded in Codec; Checksum
+// is the hex SHA-256 of all of them.
+type FragmentPayload struct {
+	GroupID   string `json:"group_id"`
+	MessageID string `json:"message_id"`
+	Index     int    `json:"index"`
+	Total     int    `json:"total"`
+	Checksum  string `json:"checksum"`
+	Codec     string `json:"codec"`
+	Data      []byte `json:"data"`
+}
+
+// BatchPayload contains data for BATCH messages: the bytes of several
+// messages, each encoded in Codec, in the order they were sent
+type BatchPayload struct {
+	Codec    string   `json:"codec"`
+	Messages [][]byte `json:"messages"`
+}
+
+// validate rejects batches that could not have been sent
+func (p *BatchPayload) validate() error {
+	if _, known := CodecByName(p.Codec); !known {
+		return fmt.Errorf("batch of unknown codec %q", p.Codec)
+	}
+	if len(p.Messages) == 0 {
+		return fmt.Errorf("empty batch")
+	}
+	return nil
+}
+
+// HopInfo is one node a TRACE passed through: the node, the round trip time
+// of the link the TRACE reached it over, and, if the node shares it, the
+// address it was reached at
+type HopInfo struct {
+	NodeID  string        `json:"node_id"`
+	Latency time.Duration `json:"latency"`
+	Address string        `json:"address,omitempty"`
+}
+
+// TracePayload contains data for TRACE and TRACE_REPLY messages: the hops
+// from Origin towards Destination so far and, for a trace that stopped
+// short of Destination, why
+type TracePayload struct {
+	Origin      string    `json:"origin"`
+	Destination string    `json:"destination"`
+	Hops        []HopInfo `json:"hops,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// validate rejects traces that could not have been sent
+func (p *TracePayload) validate() error {
+	if p.Origin == "" || p.Destination == "" {
+		return fmt.Errorf("trace without origin or destination")
+	}
+	if len(p.Hops) > MaxTraceHops {
+		return fmt.Errorf("trace of %d hops, more than %d", len(p.Hops), MaxTraceHops)
+	}
+	return nil
+}
+
+// TopicPayload contains data for TOPIC messages: what was published and on
+// which topic
+type TopicPayload struct {
+	Topic string `json:"topic"`
+	Data  []byte `json:"data"`
+}
+
+// validate rejects topic messages without a topic or with one too long
+func (p *TopicPayload) validate() error {
+	if p.Topic == "" {
+		return fmt.Errorf("topic message without a topic")
+	}
+	if len(p.Topic) > MaxTopicLength {
+		return fmt.Errorf("topic of %d bytes, more than %d", len(p.Topic), MaxTopicLength)
+	}
+	return nil
 }
 
 // ErrorPayload contains data for ERROR messages
 type ErrorPayload struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// Error lets a received ErrorPayload be returned as an error
+func (e *ErrorPayload) Error() string {
+	return fmt.Sprintf("peer error %s: %s", e.Code, e.Message)
 }
 
-// NewMessage creates a new message with the given type and payload
+// NewMessage creates a new message with the given type and payload. The ID
+// is a random UUID, so it neither collides nor reveals the sender's clock.
 func NewMessage(msgType string, sender string, payload interface{}) Message {
 	return Message{
 		Type:      msgType,
-		ID:        fmt.Sprintf("%s-%d", msgType, time.Now().UnixNano()),
+		ID:        uuid.NewString(),
 		Sender:    sender,
 		Timestamp: time.Now(),
 		Payload:   payload,
@@ -78,16 +444,221 @@ func NewMessage(msgType string, sender string, payload interface{}) Message {
 
 // Serialize converts a message to JSON bytes
 func (m *Message) Serialize() ([]byte, error) {
-	return json.Marshal(m)
+	return m.SerializeWith(CodecJSON)
+}
+
+// SerializeWith encodes a message in codec
+func (m *Message) SerializeWith(codec Codec) ([]byte, error) {
+	return codec.Marshal(m)
 }
 
 // DeserializeMessage converts JSON bytes to a message
 func DeserializeMessage(data []byte) (*Message, error) {
-	var msg Message
-	if err := json.Unmarshal(data, &msg); err != nil {
+	return DeserializeMessageWith(CodecJSON, data)
+}
+
+// DeserializeMessageWith decodes a message encoded in codec. The payload of a
+// type with a registered payload struct is decoded straight into a pointer to
+// that struct; other payloads are kept as json.RawMessage for their handlers
+// to decode, whatever codec they arrived in. A registered payload that does
+// not decode is also kept raw, and reported by ValidatePayload.
+func DeserializeMessageWith(codec Codec, data []byte) (*Message, error) {
+	// The message is returned from within its envelope, saving a copy, with
+	// the raw payload cleared so the frame is not referenced
+	envelope := &struct {
+		Message
+		Payload rawPayload `json:"payload"`
+	}{}
+	if err := codec.Unmarshal(data, envelope); err != nil {
 		return nil, err
 	}
-	return &msg, nil
+
+	msg := &envelope.Message
+	msg.Payload = nil
+	raw := envelope.Payload
+	envelope.Payload = nil
+	if len(raw) > 0 {
+		if newPayload, typed := lookupPayloadType(msg.Type); typed {
+			payload := newPayload()
+			if err := codec.Unmarshal(raw, payload); err == nil {
+				msg.Payload = payload
+				return msg, nil
+			}
+		}
+
+		payload, err := raw.toJSON(codec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s payload: %w", msg.Type, err)
+		}
+		msg.Payload = payload
+	}
+	return msg, nil
+}
+
+// SetTTL has the message expire ttl after its timestamp, rounded up to the
+// millisecond; 0 or less never expires it
+func (m *Message) SetTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		m.TTLMs = 0
+		return
+	}
+	m.TTLMs = int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+// TTL returns how long after its timestamp the message expires, or 0 if it
+// never does
+func (m *Message) TTL() time.Duration {
+	return time.Duration(m.TTLMs) * time.Millisecond
+}
+
+// expiredAt reports whether the message has expired at now, by the clock
+// that stamped it
+func (m *Message) expiredAt(now time.Time) bool {
+	return m.TTLMs > 0 && now.Sub(m.Timestamp) > m.TTL()
+}
+
+// IsGossip reports whether the message is being propagated via gossip
+func (m *Message) IsGossip() bool {
+	return m.Origin != ""
+}
+
+// payloadTypes maps message types to a constructor for the struct their
+// payload decodes into
+var (
+	payloadTypes = map[string]func() interface{}{
+		MessageTypeHello:           func() interface{} { return &HelloPayload{} },
+		MessageTypePeerList:        func() interface{} { return &PeerListPayload{} },
+		MessageTypePeerListRequest: func() interface{} { return &PeerListRequestPayload{} },
+		MessageTypeDataSync:        func() interface{} { return &DataSyncPayload{} },
+		MessageTypeHeartbeat:       func() interface{} { return &HeartbeatPayload{} },
+		MessageTypeError:           func() interface{} { return &ErrorPayload{} },
+		MessageTypeGoodbye:         func() interface{} { return &GoodbyePayload{} },
+		MessageTypeTopologyReport:  func() interface{} { return &TopologyReportPayload{} },
+		MessageTypeSyncRequest:     func() interface{} { return &SyncRequestPayload{} },
+		MessageTypeSyncResponse:    func() interface{} { return &SyncResponsePayload{} },
+		MessageTypeAIRequest:       func() interface{} { return &AIRequestPayload{} },
+		MessageTypeAIResponse:      func() interface{} { return &AIResponsePayload{} },
+		MessageTypeAIResponseChunk: func() interface{} { return &AIResponseChunkPayload{} },
+		MessageTypeAICancel:        func() interface{} { return &AICancelPayload{} },
+		MessageTypeFragment:        func() interface{} { return &FragmentPayload{} },
+		MessageTypeKeyRotation:     func() interface{} { return &KeyRotationPayload{} },
+		MessageTypeBatch:           func() interface{} { return &BatchPayload{} },
+		MessageTypeTrace:           func() interface{} { return &TracePayload{} },
+		MessageTypeTraceReply:      func() interface{} { return &TracePayload{} },
+		MessageTypeTaskSubmit:      func() interface{} { return &TaskSubmitPayload{} },
+		MessageTypeTaskResult:      func() interface{} { return &TaskResultPayload{} },
+		MessageTypeTaskStatus:      func() interface{} { return &TaskStatusPayload{} },
+		MessageTypeBlobAnnounce:    func() interface{} { return &BlobAnnouncePayload{} },
+		MessageTypeBlobRequest:     func() interface{} { return &BlobRequestPayload{} },
+		MessageTypeBlobChunk:       func() interface{} { return &BlobChunkPayload{} },
+		MessageTypeTopic:           func() interface{} { return &TopicPayload{} },
+	}
+	// payloadStructs holds the type newPayload returns for each registered
+	// message type, by which payloads decoded on receipt are recognised
+	payloadStructs = make(map[string]reflect.Type)
+	payloadTypesMu sync.RWMutex
+)
+
+func init() {
+	for msgType, newPayload := range payloadTypes {
+		payloadStructs[msgType] = reflect.TypeOf(newPayload())
+	}
+}
+
+// RegisterPayloadType makes received messages of msgType carry their payload
+// decoded into the struct newPayload returns a pointer to. Messages of a
+// registered type must have a payload that decodes.
+func RegisterPayloadType(msgType string, newPayload func() interface{}) {
+	payloadTypesMu.Lock()
+	defer payloadTypesMu.Unlock()
+	payloadTypes[msgType] = newPayload
+	payloadStructs[msgType] = reflect.TypeOf(newPayload())
+}
+
+// lookupPayloadType returns the payload constructor registered for msgType
+func lookupPayloadType(msgType string) (func() interface{}, bool) {
+	payloadTypesMu.RLock()
+	defer payloadTypesMu.RUnlock()
+	newPayload, typed := payloadTypes[msgType]
+	return newPayload, typed
+}
+
+// isDecodedPayload reports whether payload is of the type registered for
+// msgType, as payloads decoded by DeserializeMessageWith are
+func isDecodedPayload(msgType string, payload interface{}) bool {
+	payloadTypesMu.RLock()
+	defer payloadTypesMu.RUnlock()
+	return reflect.TypeOf(payload) == payloadStructs[msgType]
+}
+
+// DecodePayload stores the payload in target, a pointer to a payload struct.
+// A payload already of target's type is copied without re-encoding; raw
+// payloads are decoded directly.
+func (m *Message) DecodePayload(target interface{}) error {
+	if assignPayload(target, m.Payload) {
+		return nil
+	}
+
+	payloadBytes, isRaw := m.Payload.(json.RawMessage)
+	if !isRaw {
+		var err error
+		if payloadBytes, err = json.Marshal(m.Payload); err != nil {
+			return fmt.Errorf("failed to marshal %s payload: %w", m.Type, err)
+		}
+	}
+	if err := json.Unmarshal(payloadBytes, target); err != nil {
+		return fmt.Errorf("malformed %s payload: %w", m.Type, err)
+	}
+	return nil
+}
+
+// assignPayload copies payload into target if payload is a value of, or a
+// pointer to, the type target points to
+func assignPayload(target, payload interface{}) bool {
+	if payload == nil {
+		return false
+	}
+	dst := reflect.ValueOf(target)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return false
+	}
+
+	src := reflect.ValueOf(payload)
+	if src.Kind() == reflect.Ptr {
+		if src.IsNil() {
+			return false
+		}
+		src = src.Elem()
+	}
+	if src.Type() != dst.Elem().Type() {
+		return false
+	}
+	dst.Elem().Set(src)
+	return true
+}
+
+// ValidatePayload checks that the payload of a typed message is well formed
+func (m *Message) ValidatePayload() error {
+	newPayload, typed := lookupPayloadType(m.Type)
+	if !typed {
+		return nil
+	}
+	if m.Payload == nil {
+		return fmt.Errorf("%s payload is required", m.Type)
+	}
+	// Payloads decoded on receipt are checked where they are; others, such
+	// as raw forwarded ones, must decode first
+	payload := m.Payload
+	if !isDecodedPayload(m.Type, payload) {
+		payload = newPayload()
+		if err := m.DecodePayload(payload); err != nil {
+			return err
+		}
+	}
+	if checked, ok := payload.(interface{ validate() error }); ok {
+		return checked.validate()
+	}
+	return nil
 }
 
 // Validate checks if a message is valid
@@ -98,8 +669,20 @@ func (m *Message) Validate() error {
 	if m.ID == "" {
 		return fmt.Errorf("message ID cannot be empty")
 	}
+	if len(m.ID) > MaxMessageIDLength {
+		return fmt.Errorf("message ID exceeds %d bytes", MaxMessageIDLength)
+	}
 	if m.Sender == "" {
 		return fmt.Errorf("message sender cannot be empty")
 	}
+	if m.HopLimit < 0 {
+		return fmt.Errorf("message hop limit cannot be negative")
+	}
+	if m.TTLMs < 0 {
+		return fmt.Errorf("message TTL cannot be negative")
+	}
+	if len(m.TraceID) > MaxTraceIDLength {
+		return fmt.Errorf("message trace ID exceeds %d bytes", MaxTraceIDLength)
+	}
 	return nil
 }
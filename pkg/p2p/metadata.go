@@ -0,0 +1,105 @@
+package p2p
+
+import (
+	"fmt"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// SetPeerMetadata labels a peer locally, e.g. {"datacenter": "a"} or
+// {"trusted-partner": ""}. The labels replace any set before, take
+// precedence over what the peer advertises for the same keys and are kept
+// across reconnects. Empty metadata clears them.
+func (n *Network) SetPeerMetadata(peerID string, metadata map[string]string) error {
+	if err := topology.ValidateMetadata(metadata); err != nil {
+		return err
+	}
+	metadata = copyMetadata(metadata)
+
+	n.labelsMu.Lock()
+	if metadata == nil {
+		delete(n.labels, peerID)
+	} else {
+		if n.labels == nil {
+			n.labels = make(map[string]map[string]string)
+		}
+		n.labels[peerID] = metadata
+	}
+	n.labelsMu.Unlock()
+
+	peer, exists := n.peers.Get(peerID)
+	if exists {
+		peer.setLocalMetadata(metadata)
+		n.topologyMgr.SetPeerMetadata(peerID, peer.Metadata())
+	}
+	return nil
+}
+
+// PeerMetadata returns a connected peer's metadata, or the labels set on a
+// peer we are not connected to. It returns false if there is neither.
+func (n *Network) PeerMetadata(peerID string) (map[string]string, bool) {
+	peer, exists := n.peers.Get(peerID)
+	if exists {
+		return peer.Metadata(), true
+	}
+
+	n.labelsMu.RLock()
+	defer n.labelsMu.RUnlock()
+	metadata, labelled := n.labels[peerID]
+	return copyMetadata(metadata), labelled
+}
+
+// PeersWithTag returns the connected peers whose metadata carries a tag.
+// A tag is a key ("edge"), matching whatever its value, or key=value
+// ("datacenter=a").
+func (n *Network) PeersWithTag(tag string) []PeerSnapshot {
+	var peers []PeerSnapshot
+	for _, peer := range n.ConnectedPeers() {
+		if peer.HasTag(tag) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// applyLocalMetadata gives a newly registered peer the labels set on it
+func (n *Network) applyLocalMetadata(peer *Peer) {
+	n.labelsMu.RLock()
+	metadata := n.labels[peer.ID]
+	n.labelsMu.RUnlock()
+
+	peer.setLocalMetadata(metadata)
+	n.topologyMgr.SetPeerMetadata(peer.ID, peer.Metadata())
+}
+
+// applyAdvertisedMetadata records the metadata a peer sent in its HELLO.
+// Metadata beyond the size limits is dropped as a whole.
+func (n *Network) applyAdvertisedMetadata(peer *Peer, metadata map[string]string) {
+	if err := topology.ValidateMetadata(metadata); err != nil {
+		n.logger.Warnf("ignoring metadata advertised by %s: %v", peer.ID, err)
+		n.reputation.RecordEvent(peer.ID, topology.EventInvalidMessage)
+		metadata = nil
+	}
+	peer.setAdvertisedMetadata(copyMetadata(metadata))
+	n.topologyMgr.SetPeerMetadata(peer.ID, peer.Metadata())
+}
+
+// copyMetadata returns a copy of metadata, or nil if it is empty
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
+
+// validateLocalMetadata checks the metadata we advertise about ourselves
+func validateLocalMetadata(metadata map[string]string) error {
+	if err := topology.ValidateMetadata(metadata); err != nil {
+		return fmt.Errorf("invalid p2p metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tagWith makes a network advertise metadata in its HELLO
+func tagWith(metadata map[string]string) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.P2P.Metadata = metadata
+	}
+}
+
+func TestPeerMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := startLocalNetwork(t, ctx, "hub-node")
+	edgeA := startLocalNetworkWith(t, ctx, "edge-a", tagWith(map[string]string{"datacenter": "a", "edge": ""}))
+	edgeB := startLocalNetworkWith(t, ctx, "edge-b", tagWith(map[string]string{"datacenter": "b", "edge": ""}))
+	core := startLocalNetwork(t, ctx, "core-node")
+
+	// Labels set before a peer connects apply once it does
+	require.NoError(t, hub.SetPeerMetadata("edge-b", map[string]string{"datacenter": "b-2", "trusted-partner": ""}))
+	for _, n := range []*Network{edgeA, edgeB, core} {
+		_, err := hub.Connect(ctx, localAddr(n))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return len(hub.PeersWithTag("edge")) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Local labels win over advertised ones
+	metadata, exists := hub.PeerMetadata("edge-b")
+	require.True(t, exists)
+	assert.Equal(t, map[string]string{"datacenter": "b-2", "edge": "", "trusted-partner": ""}, metadata)
+	assert.Empty(t, hub.PeersWithTag("datacenter=b"))
+	require.Len(t, hub.PeersWithTag("datacenter=a"), 1)
+	assert.Equal(t, "edge-a", hub.PeersWithTag("datacenter=a")[0].ID)
+	assert.ElementsMatch(t, []string{"edge-b"}, hub.topologyMgr.GetPeersWithTags("trusted-partner"))
+
+	// Labels can change while connected
+	require.NoError(t, hub.SetPeerMetadata("core-node", map[string]string{"datacenter": "a"}))
+	assert.ElementsMatch(t, []string{"edge-a", "core-node"}, hub.topologyMgr.GetPeersWithTags("datacenter=a"))
+	assert.ElementsMatch(t, []string{"edge-a"}, hub.topologyMgr.GetOptimalPeersForBroadcast("", 10, "datacenter=a", "edge"))
+	assert.ErrorIs(t, hub.SetPeerMetadata("core-node", map[string]string{"": "x"}), topology.ErrInvalidMetadata)
+
+	_, exists = hub.PeerMetadata("unknown-node")
+	assert.False(t, exists)
+}
+
+func TestBroadcastToTag(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := startLocalNetwork(t, ctx, "hub-node")
+	edge := startLocalNetworkWith(t, ctx, "edge-node", tagWith(map[string]string{"edge": ""}))
+	core := startLocalNetwork(t, ctx, "core-node")
+	for _, n := range []*Network{edge, core} {
+		_, err := hub.Connect(ctx, localAddr(n))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return len(hub.PeersWithTag("edge")) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	result, err := hub.Broadcast(ctx, NewMessage("NOTE", hub.nodeID, nil), "edge")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"edge-node"}, result.Succeeded)
+
+	result, err = hub.Broadcast(ctx, NewMessage("NOTE", hub.nodeID, nil))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"edge-node", "core-node"}, result.Succeeded)
+}
+
+func TestOversizedMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	oversized := make(map[string]string)
+	for i := 0; i <= topology.MaxMetadataEntries; i++ {
+		oversized[fmt.Sprintf("tag-%d", i)] = ""
+	}
+
+	// We refuse to advertise it
+	cfg := config.Default()
+	cfg.P2P.Metadata = oversized
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+	_, err = New(cfg, log, "oversized-node")
+	assert.ErrorIs(t, err, topology.ErrInvalidMetadata)
+
+	// and ignore it from peers that do
+	receiver := startLocalNetwork(t, ctx, "receiver-node")
+	sender := startLocalNetwork(t, ctx, "sender-node")
+	sender.config.P2P.Metadata = oversized
+	_, err = sender.Connect(ctx, localAddr(receiver))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(receiver.PeersWithCapability(CapabilityEncryption)) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	metadata, exists := receiver.PeerMetadata("sender-node")
+	require.True(t, exists)
+	assert.Empty(t, metadata)
+}
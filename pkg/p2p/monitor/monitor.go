@@ -2,86 +2,435 @@ package monitor
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
 )
 
-// Stats holds network statistics
-type Stats struct {
+// StatsSnapshot is a copy of the network statistics at one moment
+type StatsSnapshot struct {
 	TotalMessagesSent     uint64
 	TotalMessagesReceived uint64
 	TotalBytesSent        uint64
 	TotalBytesReceived    uint64
 	ConnectionCount       int
 	ActiveConnections     int
+	PeersPruned           uint64
+	DuplicateMessages     uint64
+	MessagesFragmented    uint64
+	MessagesReassembled   uint64
+	FragmentFailures      uint64
+	ConnectionsAccepted   uint64
+	ConnectionsRejected   uint64
+	HandshakeFailures     uint64
+	ConnectionsDenied     uint64
+	DialsDenied           uint64
+	MessagesInvalid       uint64
+	DecodeFailures        uint64
+	ReadPanics            uint64
+	HandlerPanics         uint64
+	MessagesReordered     uint64
+	MessagesLate          uint64
+	SequenceGaps          uint64
+	PeersDamped           uint64
+	DialsQueued           int
+	DialsInFlight         int
+	DialsDeduplicated     uint64
+	DialsCooledDown       uint64
+	WriteTimeouts         uint64
+	SlowPeerDisconnects   uint64
+	HandshakesResumed     uint64
+	ResumptionsRefused    uint64
+	ForeignPeersRejected  uint64
+	MessagesRateLimited   uint64
+	RateLimitDisconnects  uint64
+	BatchesSent           uint64
+	MessagesBatched       uint64
+	SendsExpired          uint64
+	PeerRecordsRejected   uint64
+	UnsignedPeersIgnored  uint64
+	// QueueDrops counts, per message type, the messages the full message
+	// queue dropped
+	QueueDrops            map[string]uint64
+	// MessagesExpired counts, per message type, the received messages
+	// dropped for outliving their TTL, or the age their handlers take
+	MessagesExpired       map[string]uint64
 	Uptime                time.Duration
 	StartTime             time.Time
-	mu                    sync.RWMutex
+}
+
+// Stats holds network statistics. Its counters are updated atomically, so
+// the per-message paths never wait on each other to count.
+type Stats struct {
+	totalMessagesSent     atomic.Uint64
+	totalMessagesReceived atomic.Uint64
+	totalBytesSent        atomic.Uint64
+	totalBytesReceived    atomic.Uint64
+	connectionCount       atomic.Int64
+	activeConnections     atomic.Int64
+	peersPruned           atomic.Uint64
+	duplicateMessages     atomic.Uint64
+	messagesFragmented    atomic.Uint64
+	messagesReassembled   atomic.Uint64
+	fragmentFailures      atomic.Uint64
+	connectionsAccepted   atomic.Uint64
+	connectionsRejected   atomic.Uint64
+	handshakeFailures     atomic.Uint64
+	connectionsDenied     atomic.Uint64
+	dialsDenied           atomic.Uint64
+	messagesInvalid       atomic.Uint64
+	decodeFailures        atomic.Uint64
+	readPanics            atomic.Uint64
+	handlerPanics         atomic.Uint64
+	messagesReordered     atomic.Uint64
+	messagesLate          atomic.Uint64
+	sequenceGaps          atomic.Uint64
+	peersDamped           atomic.Uint64
+	dialsQueued           atomic.Int64
+	dialsInFlight         atomic.Int64
+	dialsDeduplicated     atomic.Uint64
+	dialsCooledDown       atomic.Uint64
+	writeTimeouts         atomic.Uint64
+	slowPeerDisconnects   atomic.Uint64
+	handshakesResumed     atomic.Uint64
+	resumptionsRefused    atomic.Uint64
+	foreignPeersRejected  atomic.Uint64
+	messagesRateLimited   atomic.Uint64
+	rateLimitDisconnects  atomic.Uint64
+	batchesSent           atomic.Uint64
+	messagesBatched       atomic.Uint64
+	sendsExpired          atomic.Uint64
+	peerRecordsRejected   atomic.Uint64
+	unsignedPeersIgnored  atomic.Uint64
+	queueDrops            sync.Map // message type -> *atomic.Uint64
+	messagesExpired       sync.Map // message type -> *atomic.Uint64
+	startTime             time.Time
 }
 
 // NewStats creates a new statistics instance
 func NewStats() *Stats {
 	return &Stats{
-		StartTime: time.Now(),
+		startTime: time.Now(),
 	}
 }
 
 // IncrementMessagesSent increments the sent message counter
 func (s *Stats) IncrementMessagesSent() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.TotalMessagesSent++
+	s.totalMessagesSent.Add(1)
 }
 
 // IncrementMessagesReceived increments the received message counter
 func (s *Stats) IncrementMessagesReceived() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.TotalMessagesReceived++
+	s.totalMessagesReceived.Add(1)
 }
 
 // AddBytesSent adds to the sent bytes counter
 func (s *Stats) AddBytesSent(bytes uint64) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.TotalBytesSent += bytes
+	s.totalBytesSent.Add(bytes)
 }
 
 // AddBytesReceived adds to the received bytes counter
 func (s *Stats) AddBytesReceived(bytes uint64) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.TotalBytesReceived += bytes
+	s.totalBytesReceived.Add(bytes)
+}
+
+// IncrementPeersPruned increments the counter of peers disconnected by rebalancing
+func (s *Stats) IncrementPeersPruned() {
+	s.peersPruned.Add(1)
+}
+
+// IncrementDuplicateMessages increments the counter of received messages
+// dropped because their ID was already seen
+func (s *Stats) IncrementDuplicateMessages() {
+	s.duplicateMessages.Add(1)
+}
+
+// IncrementMessagesFragmented increments the counter of oversized messages
+// sent as fragments
+func (s *Stats) IncrementMessagesFragmented() {
+	s.messagesFragmented.Add(1)
+}
+
+// IncrementMessagesReassembled increments the counter of fragmented
+// messages received whole
+func (s *Stats) IncrementMessagesReassembled() {
+	s.messagesReassembled.Add(1)
+}
+
+// IncrementFragmentFailures increments the counter of fragmented messages
+// that were dropped before they could be reassembled
+func (s *Stats) IncrementFragmentFailures() {
+	s.fragmentFailures.Add(1)
+}
+
+// IncrementConnectionsAccepted increments the counter of inbound
+// connections admitted for a handshake
+func (s *Stats) IncrementConnectionsAccepted() {
+	s.connectionsAccepted.Add(1)
+}
+
+// IncrementConnectionsRejected increments the counter of inbound
+// connections closed at once because the node was at capacity
+func (s *Stats) IncrementConnectionsRejected() {
+	s.connectionsRejected.Add(1)
+}
+
+// IncrementConnectionsDenied increments the counter of inbound
+// connections closed because their address is outside our policy
+func (s *Stats) IncrementConnectionsDenied() {
+	s.connectionsDenied.Add(1)
+}
+
+// IncrementDialsDenied increments the counter of peers we refused to dial
+// because their address is outside our policy
+func (s *Stats) IncrementDialsDenied() {
+	s.dialsDenied.Add(1)
+}
+
+// IncrementHandshakeFailures increments the counter of connections whose
+// handshake failed
+func (s *Stats) IncrementHandshakeFailures() {
+	s.handshakeFailures.Add(1)
+}
+
+// IncrementMessagesInvalid increments the counter of received messages
+// that decoded but failed validation
+func (s *Stats) IncrementMessagesInvalid() {
+	s.messagesInvalid.Add(1)
+}
+
+// IncrementDecodeFailures increments the counter of received frames that
+// could not be decoded into a message
+func (s *Stats) IncrementDecodeFailures() {
+	s.decodeFailures.Add(1)
+}
+
+// IncrementReadPanics increments the counter of connections closed because
+// handling what the peer sent panicked
+func (s *Stats) IncrementReadPanics() {
+	s.readPanics.Add(1)
+}
+
+// IncrementHandlerPanics increments the counter of message handlers that
+// panicked
+func (s *Stats) IncrementHandlerPanics() {
+	s.handlerPanics.Add(1)
+}
+
+// IncrementMessagesReordered increments the counter of messages held back
+// for ordered delivery until a message sent before them arrived
+func (s *Stats) IncrementMessagesReordered() {
+	s.messagesReordered.Add(1)
+}
+
+// IncrementMessagesLate increments the counter of messages that arrived
+// after ordered delivery gave up waiting for them
+func (s *Stats) IncrementMessagesLate() {
+	s.messagesLate.Add(1)
+}
+
+// IncrementSequenceGaps increments the counter of messages ordered delivery
+// gave up waiting for
+func (s *Stats) IncrementSequenceGaps() {
+	s.sequenceGaps.Add(1)
+}
+
+// IncrementPeersDamped increments the counter of times a flapping peer was
+// damped
+func (s *Stats) IncrementPeersDamped() {
+	s.peersDamped.Add(1)
+}
+
+// AddDialsQueued adjusts the number of dials waiting for a dial slot
+func (s *Stats) AddDialsQueued(delta int) {
+	s.dialsQueued.Add(int64(delta))
+}
+
+// AddDialsInFlight adjusts the number of dials holding a dial slot
+func (s *Stats) AddDialsInFlight(delta int) {
+	s.dialsInFlight.Add(int64(delta))
+}
+
+// IncrementDialsDeduplicated increments the counter of dials that joined
+// one already in flight to the same address
+func (s *Stats) IncrementDialsDeduplicated() {
+	s.dialsDeduplicated.Add(1)
+}
+
+// IncrementDialsCooledDown increments the counter of dials refused because
+// the address failed recently
+func (s *Stats) IncrementDialsCooledDown() {
+	s.dialsCooledDown.Add(1)
+}
+
+// IncrementWriteTimeouts increments the counter of writes to peers that
+// timed out
+func (s *Stats) IncrementWriteTimeouts() {
+	s.writeTimeouts.Add(1)
+}
+
+// IncrementSlowPeerDisconnects increments the counter of peers disconnected
+// for being too slow to read
+func (s *Stats) IncrementSlowPeerDisconnects() {
+	s.slowPeerDisconnects.Add(1)
+}
+
+// IncrementHandshakesResumed increments the counter of handshakes that
+// resumed an earlier session instead of starting a new one
+func (s *Stats) IncrementHandshakesResumed() {
+	s.handshakesResumed.Add(1)
+}
+
+// IncrementResumptionsRefused increments the counter of session
+// resumptions refused for an unknown, expired or invalid ticket
+func (s *Stats) IncrementResumptionsRefused() {
+	s.resumptionsRefused.Add(1)
+}
+
+// IncrementForeignPeersRejected increments the counter of handshakes
+// refused because the peer does not share our network key
+func (s *Stats) IncrementForeignPeersRejected() {
+	s.foreignPeersRejected.Add(1)
+}
+
+// IncrementMessagesRateLimited increments the counter of messages dropped
+// because their peer sent faster than its rate limit
+func (s *Stats) IncrementMessagesRateLimited() {
+	s.messagesRateLimited.Add(1)
+}
+
+// IncrementRateLimitDisconnects increments the counter of peers
+// disconnected for flooding us with messages
+func (s *Stats) IncrementRateLimitDisconnects() {
+	s.rateLimitDisconnects.Add(1)
+}
+
+// AddBatchSent counts a BATCH frame sent and the messages it carried
+func (s *Stats) AddBatchSent(messages int) {
+	s.batchesSent.Add(1)
+	s.messagesBatched.Add(uint64(messages))
+}
+
+// IncrementQueueDrops increments the counter of messages of a type dropped
+// by the full message queue
+func (s *Stats) IncrementQueueDrops(msgType string) {
+	counter, _ := s.queueDrops.LoadOrStore(msgType, new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// IncrementMessagesExpired increments the counter of received messages of
+// a type dropped for their age
+func (s *Stats) IncrementMessagesExpired(msgType string) {
+	counter, _ := s.messagesExpired.LoadOrStore(msgType, new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// IncrementSendsExpired increments the counter of messages not sent for
+// outliving their TTL
+func (s *Stats) IncrementSendsExpired() {
+	s.sendsExpired.Add(1)
+}
+
+// IncrementPeerRecordsRejected increments the counter of peer records
+// dropped for a bad signature, a key other than the node's or a stale
+// sequence number
+func (s *Stats) IncrementPeerRecordsRejected() {
+	s.peerRecordsRejected.Add(1)
+}
+
+// IncrementUnsignedPeersIgnored increments the counter of peers listed to
+// us without a signed record, and so not taken up
+func (s *Stats) IncrementUnsignedPeersIgnored() {
+	s.unsignedPeersIgnored.Add(1)
 }
 
 // SetConnectionCount sets the total connection count
 func (s *Stats) SetConnectionCount(count int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.ConnectionCount = count
+	s.connectionCount.Store(int64(count))
 }
 
 // SetActiveConnections sets the active connection count
 func (s *Stats) SetActiveConnections(count int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.ActiveConnections = count
+	s.activeConnections.Store(int64(count))
+}
+
+// GetStats returns a snapshot of the current statistics. Counters are read
+// one at a time, so a snapshot taken while messages flow may be a message
+// or two apart between counters.
+func (s *Stats) GetStats() StatsSnapshot {
+	queueDrops := make(map[string]uint64)
+	s.queueDrops.Range(func(msgType, counter interface{}) bool {
+		queueDrops[msgType.(string)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	messagesExpired := make(map[string]uint64)
+	s.messagesExpired.Range(func(msgType, counter interface{}) bool {
+		messagesExpired[msgType.(string)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+
+	return StatsSnapshot{
+		TotalMessagesSent:     s.totalMessagesSent.Load(),
+		TotalMessagesReceived: s.totalMessagesReceived.Load(),
+		TotalBytesSent:        s.totalBytesSent.Load(),
+		TotalBytesReceived:    s.totalBytesReceived.Load(),
+		ConnectionCount:       int(s.connectionCount.Load()),
+		ActiveConnections:     int(s.activeConnections.Load()),
+		PeersPruned:           s.peersPruned.Load(),
+		DuplicateMessages:     s.duplicateMessages.Load(),
+		MessagesFragmented:    s.messagesFragmented.Load(),
+		MessagesReassembled:   s.messagesReassembled.Load(),
+		FragmentFailures:      s.fragmentFailures.Load(),
+		ConnectionsAccepted:   s.connectionsAccepted.Load(),
+		ConnectionsRejected:   s.connectionsRejected.Load(),
+		HandshakeFailures:     s.handshakeFailures.Load(),
+		ConnectionsDenied:     s.connectionsDenied.Load(),
+		DialsDenied:           s.dialsDenied.Load(),
+		MessagesInvalid:       s.messagesInvalid.Load(),
+		DecodeFailures:        s.decodeFailures.Load(),
+		ReadPanics:            s.readPanics.Load(),
+		HandlerPanics:         s.handlerPanics.Load(),
+		MessagesReordered:     s.messagesReordered.Load(),
+		MessagesLate:          s.messagesLate.Load(),
+		SequenceGaps:          s.sequenceGaps.Load(),
+		PeersDamped:           s.peersDamped.Load(),
+		DialsQueued:           int(s.dialsQueued.Load()),
+		DialsInFlight:         int(s.dialsInFlight.Load()),
+		DialsDeduplicated:     s.dialsDeduplicated.Load(),
+		DialsCooledDown:       s.dialsCooledDown.Load(),
+		WriteTimeouts:         s.writeTimeouts.Load(),
+		SlowPeerDisconnects:   s.slowPeerDisconnects.Load(),
+		HandshakesResumed:     s.handshakesResumed.Load(),
+		ResumptionsRefused:    s.resumptionsRefused.Load(),
+		ForeignPeersRejected:  s.foreignPeersRejected.Load(),
+		MessagesRateLimited:   s.messagesRateLimited.Load(),
+		RateLimitDisconnects:  s.rateLimitDisconnects.Load(),
+		BatchesSent:           s.batchesSent.Load(),
+		MessagesBatched:       s.messagesBatched.Load(),
+		SendsExpired:          s.sendsExpired.Load(),
+		PeerRecordsRejected:   s.peerRecordsRejected.Load(),
+		UnsignedPeersIgnored:  s.unsignedPeersIgnored.Load(),
+		QueueDrops:            queueDrops,
+		MessagesExpired:       messagesExpired,
+		Uptime:                time.Since(s.startTime),
+		StartTime:             s.startTime,
+	}
 }
 
-// GetStats returns a copy of the current statistics
-func (s *Stats) GetStats() Stats {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	
-	stats := *s
-	stats.Uptime = time.Since(s.StartTime)
-	return stats
+// PeerLoad is how busy a peer reports being in its heartbeats
+type PeerLoad struct {
+	Connections int       `json:"connections"`
+	QueueDepth  int       `json:"queue_depth"`
+	Full        bool      `json:"full"`
+	Overloaded  bool      `json:"overloaded"`
+	ReportedAt  time.Time `json:"reported_at"`
 }
 
 // QualityMonitor monitors connection quality
 type QualityMonitor struct {
 	peers      map[string]*topology.ConnectionQuality
+	loads      map[string]PeerLoad
 	mu         sync.RWMutex
 	updateFunc func(string) (topology.ConnectionQuality, error)
 }
@@ -90,9 +439,36 @@ type QualityMonitor struct {
 func NewQualityMonitor() *QualityMonitor {
 	return &QualityMonitor{
 		peers: make(map[string]*topology.ConnectionQuality),
+		loads: make(map[string]PeerLoad),
 	}
 }
 
+// UpdatePeerLoad records the load a peer last reported
+func (q *QualityMonitor) UpdatePeerLoad(peerID string, load PeerLoad) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.loads[peerID] = load
+}
+
+// GetPeerLoad returns the load a peer last reported
+func (q *QualityMonitor) GetPeerLoad(peerID string) (PeerLoad, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	load, exists := q.loads[peerID]
+	return load, exists
+}
+
+// RemovePeer forgets a peer's quality and load
+func (q *QualityMonitor) RemovePeer(peerID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.peers, peerID)
+	delete(q.loads, peerID)
+}
+
 // SetUpdateFunc sets the function to update connection quality
 func (q *QualityMonitor) SetUpdateFunc(updateFunc func(string) (topology.ConnectionQuality, error)) {
 	q.updateFunc = updateFunc
@@ -148,7 +524,6 @@ func NewHealthChecker(interval time.Duration) *HealthChecker {
 	return &HealthChecker{
 		peers:    make(map[string]time.Time),
 		interval: interval,
-		stopCh:   make(chan struct{}),
 	}
 }
 
@@ -179,8 +554,18 @@ func (h *HealthChecker) CheckPeerHealth(peerID string) bool {
 	return h.healthCheck(peerID)
 }
 
-// Start begins periodic health checks
+// Start begins periodic health checks. A stopped health checker may be
+// started again.
 func (h *HealthChecker) Start() {
+	h.mu.Lock()
+	if h.stopCh != nil {
+		h.mu.Unlock()
+		return
+	}
+	stopCh := make(chan struct{})
+	h.stopCh = stopCh
+	h.mu.Unlock()
+
 	h.wg.Add(1)
 	go func() {
 		defer h.wg.Done()
@@ -190,7 +575,7 @@ func (h *HealthChecker) Start() {
 		
 		for {
 			select {
-			case <-h.stopCh:
+			case <-stopCh:
 				return
 			case <-ticker.C:
 				h.performHealthChecks()
@@ -199,9 +584,14 @@ func (h *HealthChecker) Start() {
 	}()
 }
 
-// Stop stops the health checker
+// Stop stops the health checker and waits for it to exit
 func (h *HealthChecker) Stop() {
-	close(h.stopCh)
+	h.mu.Lock()
+	if h.stopCh != nil {
+		close(h.stopCh)
+		h.stopCh = nil
+	}
+	h.mu.Unlock()
 	h.wg.Wait()
 }
 
@@ -317,6 +707,9 @@ type NetworkMonitor struct {
 	Health        *HealthChecker
 	Bandwidth     *BandwidthLimiter
 	Topology      *topology.Manager
+	Connections   *ConnectionTimings
+
+	services serviceRegistry
 }
 
 // NewNetworkMonitor creates a new network monitor
@@ -327,9 +720,15 @@ func NewNetworkMonitor(topologyManager *topology.Manager) *NetworkMonitor {
 		Health:   NewHealthChecker(30 * time.Second),
 		Bandwidth: NewBandwidthLimiter(10.0, 10.0), // 10 Mbps default
 		Topology: topologyManager,
+		Connections: &ConnectionTimings{},
 	}
 }
 
+// Service returns the metrics of a named external service, e.g. "ai"
+func (n *NetworkMonitor) Service(name string) *ServiceMetrics {
+	return n.services.get(name)
+}
+
 // Start begins all monitoring services
 func (n *NetworkMonitor) Start() {
 	n.Health.Start()
@@ -340,24 +739,46 @@ func (n *NetworkMonitor) Stop() {
 	n.Health.Stop()
 }
 
+// BandwidthUsage is the current speed and the limit in one direction, in Mbps
+type BandwidthUsage struct {
+	Current float64 `json:"current"`
+	Limit   float64 `json:"limit"`
+	Limited bool    `json:"limited"`
+}
+
+// BandwidthReport is the bandwidth usage in both directions
+type BandwidthReport struct {
+	Upload   BandwidthUsage `json:"upload"`
+	Download BandwidthUsage `json:"download"`
+}
+
+// Report is a snapshot of what the network monitor tracks
+type Report struct {
+	Stats             StatsSnapshot           `json:"stats"`
+	UnhealthyPeers    []string                `json:"unhealthy_peers"`
+	Bandwidth         BandwidthReport         `json:"bandwidth"`
+	Services          map[string]ServiceStats `json:"services"`
+	ConnectionTimings ConnectionTimingsReport `json:"connection_timings"`
+}
+
 // GetNetworkReport returns a comprehensive network report
-func (n *NetworkMonitor) GetNetworkReport() map[string]interface{} {
-	return map[string]interface{}{
-		"stats":          n.Stats.GetStats(),
-		"peer_qualities": n.Quality.GetAllPeerQualities(),
-		"unhealthy_peers": n.Health.GetUnhealthyPeers(),
-		"bandwidth": map[string]interface{}{
-			"upload": map[string]interface{}{
-				"current": n.Bandwidth.GetUploadSpeed(),
-				"limit":   n.Bandwidth.GetUploadLimit(),
-				"limited": n.Bandwidth.IsUploadLimited(),
+func (n *NetworkMonitor) GetNetworkReport() Report {
+	return Report{
+		Stats:          n.Stats.GetStats(),
+		UnhealthyPeers: n.Health.GetUnhealthyPeers(),
+		Bandwidth: BandwidthReport{
+			Upload: BandwidthUsage{
+				Current: n.Bandwidth.GetUploadSpeed(),
+				Limit:   n.Bandwidth.GetUploadLimit(),
+				Limited: n.Bandwidth.IsUploadLimited(),
 			},
-			"download": map[string]interface{}{
-				"current": n.Bandwidth.GetDownloadSpeed(),
-				"limit":   n.Bandwidth.GetDownloadLimit(),
-				"limited": n.Bandwidth.IsDownloadLimited(),
+			Download: BandwidthUsage{
+				Current: n.Bandwidth.GetDownloadSpeed(),
+				Limit:   n.Bandwidth.GetDownloadLimit(),
+				Limited: n.Bandwidth.IsDownloadLimited(),
 			},
 		},
-		"topology_metrics": n.Topology.GetNetworkMetrics(),
+		Services:          n.services.snapshot(),
+		ConnectionTimings: n.Connections.Snapshot(),
 	}
 }
@@ -0,0 +1,134 @@
+package monitor
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsConcurrentUpdates(t *testing.T) {
+	stats := NewStats()
+
+	const senders, perSender = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				stats.IncrementMessagesSent()
+				stats.AddBytesSent(10)
+				stats.IncrementMessagesReceived()
+				_ = stats.GetStats()
+			}
+		}()
+	}
+	wg.Wait()
+	stats.SetConnectionCount(3)
+	stats.SetActiveConnections(2)
+
+	snapshot := stats.GetStats()
+	assert.Equal(t, uint64(senders*perSender), snapshot.TotalMessagesSent)
+	assert.Equal(t, uint64(senders*perSender*10), snapshot.TotalBytesSent)
+	assert.Equal(t, uint64(senders*perSender), snapshot.TotalMessagesReceived)
+	assert.Equal(t, 3, snapshot.ConnectionCount)
+	assert.Equal(t, 2, snapshot.ActiveConnections)
+	assert.False(t, snapshot.StartTime.IsZero())
+	assert.Positive(t, snapshot.Uptime)
+
+	// A snapshot does not change with the stats it was taken from
+	stats.IncrementMessagesSent()
+	assert.Equal(t, uint64(senders*perSender), snapshot.TotalMessagesSent)
+}
+
+// lockedStats counts the way Stats used to, behind one mutex, to compare
+// against in BenchmarkStatsSend
+type lockedStats struct {
+	messages uint64
+	bytes    uint64
+	mu       sync.Mutex
+}
+
+func (s *lockedStats) send(bytes uint64) {
+	s.mu.Lock()
+	s.bytes += bytes
+	s.mu.Unlock()
+	s.mu.Lock()
+	s.messages++
+	s.mu.Unlock()
+}
+
+// BenchmarkStatsSend counts sent messages from many goroutines at once, as
+// sendMessageToConn does for every peer; senders is goroutines per CPU. Run
+// with -cpu=1,4,8 to see the atomic counters hold their pace as senders are
+// added while the mutex falls behind.
+func BenchmarkStatsSend(b *testing.B) {
+	for _, senders := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("atomic/senders=%d", senders), func(b *testing.B) {
+			stats := NewStats()
+			b.SetParallelism(senders)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					stats.AddBytesSent(512)
+					stats.IncrementMessagesSent()
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("mutex/senders=%d", senders), func(b *testing.B) {
+			stats := &lockedStats{}
+			b.SetParallelism(senders)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					stats.send(512)
+				}
+			})
+		})
+	}
+}
+
+func TestDurationHistogram(t *testing.T) {
+	var histogram DurationHistogram
+	assert.Equal(t, DurationSummary{}, histogram.Snapshot())
+
+	for i := 1; i <= 100; i++ {
+		histogram.Observe(time.Duration(i) * time.Millisecond)
+	}
+	summary := histogram.Snapshot()
+	assert.Equal(t, uint64(100), summary.Count)
+	assert.Equal(t, 5050*time.Millisecond, summary.Sum)
+	assert.Equal(t, 51*time.Millisecond, summary.P50)
+	assert.Equal(t, 95*time.Millisecond, summary.P95)
+	assert.Equal(t, 99*time.Millisecond, summary.P99)
+	assert.Equal(t, 100*time.Millisecond, summary.Max)
+
+	// Percentiles follow the latest observations, the totals all of them
+	for i := 0; i < histogramSamples; i++ {
+		histogram.Observe(time.Millisecond)
+	}
+	summary = histogram.Snapshot()
+	assert.Equal(t, uint64(100+histogramSamples), summary.Count)
+	assert.Equal(t, time.Millisecond, summary.P99)
+	assert.Equal(t, 100*time.Millisecond, summary.Max)
+}
+
+func TestConnectionTimingsPrometheus(t *testing.T) {
+	var timings ConnectionTimings
+	timings.Dial.Observe(20 * time.Millisecond)
+	timings.Handshake.Observe(5 * time.Millisecond)
+	timings.Handshake.Observe(15 * time.Millisecond)
+
+	var out strings.Builder
+	require.NoError(t, timings.Snapshot().WritePrometheus(&out))
+	text := out.String()
+	assert.Contains(t, text, "# TYPE synapse_connection_dial_seconds summary\n")
+	assert.Contains(t, text, "synapse_connection_dial_seconds{quantile=\"0.5\"} 0.02\n")
+	assert.Contains(t, text, "synapse_connection_dial_seconds_count 1\n")
+	assert.Contains(t, text, "synapse_connection_handshake_seconds_sum 0.02\n")
+	assert.Contains(t, text, "synapse_connection_handshake_seconds_count 2\n")
+	assert.Contains(t, text, "synapse_connection_lifetime_seconds_count 0\n")
+}
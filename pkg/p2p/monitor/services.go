@@ -0,0 +1,101 @@
+package monitor
+
+import (
+	"sync"
+	"time"
+)
+
+// ServiceStats is a snapshot of the calls made to an external service
+type ServiceStats struct {
+	Requests       uint64        `json:"requests"`
+	Failures       uint64        `json:"failures"`
+	LastLatency    time.Duration `json:"last_latency"`
+	AverageLatency time.Duration `json:"average_latency"`
+	MaxLatency     time.Duration `json:"max_latency"`
+	LastError      string        `json:"last_error,omitempty"`
+	LastRequest    time.Time     `json:"last_request"`
+}
+
+// ServiceMetrics records latency and failures of calls to an external service
+type ServiceMetrics struct {
+	requests     uint64
+	failures     uint64
+	totalLatency time.Duration
+	lastLatency  time.Duration
+	maxLatency   time.Duration
+	lastError    string
+	lastRequest  time.Time
+	mu           sync.Mutex
+}
+
+// Observe records one completed call and its outcome
+func (s *ServiceMetrics) Observe(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.totalLatency += latency
+	s.lastLatency = latency
+	if latency > s.maxLatency {
+		s.maxLatency = latency
+	}
+	s.lastRequest = time.Now()
+
+	if err != nil {
+		s.failures++
+		s.lastError = err.Error()
+	}
+}
+
+// Snapshot returns the current counters
+func (s *ServiceMetrics) Snapshot() ServiceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := ServiceStats{
+		Requests:    s.requests,
+		Failures:    s.failures,
+		LastLatency: s.lastLatency,
+		MaxLatency:  s.maxLatency,
+		LastError:   s.lastError,
+		LastRequest: s.lastRequest,
+	}
+	if s.requests > 0 {
+		stats.AverageLatency = s.totalLatency / time.Duration(s.requests)
+	}
+	return stats
+}
+
+// serviceRegistry holds the metrics of every named service
+type serviceRegistry struct {
+	services map[string]*ServiceMetrics
+	mu       sync.Mutex
+}
+
+// get returns the metrics for a service, creating them on first use
+func (r *serviceRegistry) get(name string) *ServiceMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.services == nil {
+		r.services = make(map[string]*ServiceMetrics)
+	}
+	metrics, exists := r.services[name]
+	if !exists {
+		metrics = &ServiceMetrics{}
+		r.services[name] = metrics
+	}
+	return metrics
+}
+
+// snapshot returns the stats of every service
+func (r *serviceRegistry) snapshot() map[string]ServiceStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make(map[string]ServiceStats, len(r.services))
+	for name, metrics := range r.services {
+		stats[name] = metrics.Snapshot()
+	}
+	return stats
+}
@@ -0,0 +1,122 @@
+package monitor
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// histogramSamples is how many of the latest observations a
+// DurationHistogram keeps to estimate its percentiles from
+const histogramSamples = 1024
+
+// DurationSummary describes the durations a DurationHistogram observed.
+// Count, Sum and Max cover every observation; the percentiles cover the
+// latest ones.
+type DurationSummary struct {
+	Count uint64        `json:"count"`
+	Sum   time.Duration `json:"sum"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// DurationHistogram records durations, keeping the latest histogramSamples
+// of them for percentiles
+type DurationHistogram struct {
+	samples []time.Duration
+	next    int
+	count   uint64
+	sum     time.Duration
+	max     time.Duration
+	mu      sync.Mutex
+}
+
+// Observe records one duration
+func (h *DurationHistogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.samples) < histogramSamples {
+		h.samples = append(h.samples, d)
+	} else {
+		h.samples[h.next] = d
+		h.next = (h.next + 1) % histogramSamples
+	}
+	h.count++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+// Snapshot summarizes the durations observed so far
+func (h *DurationHistogram) Snapshot() DurationSummary {
+	h.mu.Lock()
+	sorted := slices.Clone(h.samples)
+	summary := DurationSummary{Count: h.count, Sum: h.sum, Max: h.max}
+	h.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return summary
+	}
+	slices.Sort(sorted)
+	percentile := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1)+0.5)]
+	}
+	summary.P50 = percentile(0.50)
+	summary.P95 = percentile(0.95)
+	summary.P99 = percentile(0.99)
+	return summary
+}
+
+// ConnectionTimings records how long connections take to dial and to
+// complete the handshake, and how long they last
+type ConnectionTimings struct {
+	// Dial only covers the connections we dialed
+	Dial      DurationHistogram
+	Handshake DurationHistogram
+	Lifetime  DurationHistogram
+}
+
+// ConnectionTimingsReport summarizes ConnectionTimings
+type ConnectionTimingsReport struct {
+	Dial      DurationSummary `json:"dial"`
+	Handshake DurationSummary `json:"handshake"`
+	Lifetime  DurationSummary `json:"lifetime"`
+}
+
+// Snapshot summarizes every timing
+func (t *ConnectionTimings) Snapshot() ConnectionTimingsReport {
+	return ConnectionTimingsReport{
+		Dial:      t.Dial.Snapshot(),
+		Handshake: t.Handshake.Snapshot(),
+		Lifetime:  t.Lifetime.Snapshot(),
+	}
+}
+
+// WritePrometheus writes the timings as Prometheus summaries in the text
+// exposition format
+func (r ConnectionTimingsReport) WritePrometheus(w io.Writer) error {
+	metrics := []struct {
+		name    string
+		help    string
+		summary DurationSummary
+	}{
+		{"synapse_connection_dial_seconds", "Time taken to dial a peer.", r.Dial},
+		{"synapse_connection_handshake_seconds", "Time taken by the handshake on a new connection.", r.Handshake},
+		{"synapse_connection_lifetime_seconds", "How long a connection lasted until it was closed.", r.Lifetime},
+	}
+	for _, metric := range metrics {
+		s := metric.summary
+		_, err := fmt.Fprintf(w, "# HELP %[1]s %[2]s\n# TYPE %[1]s summary\n"+
+			"%[1]s{quantile=\"0.5\"} %[3]g\n%[1]s{quantile=\"0.95\"} %[4]g\n%[1]s{quantile=\"0.99\"} %[5]g\n"+
+			"%[1]s_sum %[6]g\n%[1]s_count %[7]d\n",
+			metric.name, metric.help, s.P50.Seconds(), s.P95.Seconds(), s.P99.Seconds(), s.Sum.Seconds(), s.Count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
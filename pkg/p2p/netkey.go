@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+)
+
+// ErrNetworkKeyMismatch is returned when a peer does not share our network
+// key, or has one while we have none
+var ErrNetworkKeyMismatch = errors.New("peer is not part of our network")
+
+// sealHandshake attaches the network MAC over the transcript to its last
+// message, our own, if we belong to a private network
+func (n *Network) sealHandshake(transcript ...*crypto.HandshakeMessage) error {
+	if len(n.networkKey) == 0 {
+		return nil
+	}
+	mac, err := crypto.NetworkMAC(n.networkKey, transcript...)
+	if err != nil {
+		return err
+	}
+	transcript[len(transcript)-1].NetworkMAC = mac
+	return nil
+}
+
+// checkNetworkKey checks the network MAC on the last message of the
+// transcript, the peer's
+func (n *Network) checkNetworkKey(transcript ...*crypto.HandshakeMessage) error {
+	if err := crypto.VerifyNetworkMAC(n.networkKey, transcript...); err != nil {
+		n.monitor.Stats.IncrementForeignPeersRejected()
+		peer := transcript[len(transcript)-1]
+		return fmt.Errorf("%w: %s: %w", ErrNetworkKeyMismatch, peer.NodeID, err)
+	}
+	return nil
+}
+
+// rejectForeignPeer tells a peer dialing us that it is not part of our
+// network, in place of our handshake response
+func (n *Network) rejectForeignPeer(connection *Connection, err error) {
+	reject := NewMessage(MessageTypeError, n.nodeID, ErrorPayload{
+		Code:    ErrorCodeNetworkKeyMismatch,
+		Message: err.Error(),
+	})
+	if sendErr := n.sendMessageToConn(connection.Conn, reject); sendErr != nil {
+		n.logger.Debugf("failed to send network key rejection: %v", sendErr)
+	}
+}
+
+// checkAdvertisedNetwork tells whether a peer found over mDNS advertises
+// the network we belong to, so nodes of other networks are never dialed
+func (n *Network) checkAdvertisedNetwork(peer discovery.Peer) error {
+	if peer.NetworkID != n.networkID {
+		return fmt.Errorf("%w: it advertises network %q", ErrNetworkKeyMismatch, peer.NetworkID)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// joinNetwork makes a network belong to the private network of key, or to
+// the open network if key is empty
+func joinNetwork(key string) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.P2P.NetworkKey = key
+	}
+}
+
+func TestNetworkKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const key = "correct horse battery staple"
+	member := startLocalNetworkWith(t, ctx, "netkey-member", joinNetwork(key))
+
+	// A node knowing the key joins
+	other := startLocalNetworkWith(t, ctx, "netkey-other", joinNetwork(key))
+	peerID, err := other.Connect(ctx, localAddr(member))
+	require.NoError(t, err)
+	assert.Equal(t, "netkey-member", peerID)
+	require.Eventually(t, func() bool {
+		return len(member.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// while one with another key, or none, is turned away in either direction
+	cases := []struct {
+		name string
+		key  string
+	}{
+		{name: "other key", key: "tr0ub4dor&3 is not it"},
+		{name: "no key"},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stranger := startLocalNetworkWith(t, ctx, "netkey-stranger-"+tc.name, joinNetwork(tc.key))
+
+			// The side refusing the other counts it
+			_, err := stranger.Connect(ctx, localAddr(member))
+			assert.ErrorIs(t, err, ErrNetworkKeyMismatch)
+			assert.Equal(t, uint64(i+1), member.monitor.Stats.GetStats().ForeignPeersRejected)
+
+			_, err = member.Connect(ctx, localAddr(stranger))
+			assert.ErrorIs(t, err, ErrNetworkKeyMismatch)
+			assert.Equal(t, uint64(1), stranger.monitor.Stats.GetStats().ForeignPeersRejected)
+
+			assert.Empty(t, stranger.Peers())
+			assert.Len(t, member.Peers(), 1)
+		})
+	}
+}
+
+func TestCheckAdvertisedNetwork(t *testing.T) {
+	open, _, cancel := createTestNetwork(t)
+	defer cancel()
+
+	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.P2P.NetworkKey = "correct horse battery staple"
+	private := newLocalNetwork(t, cfg, "private-node")
+
+	networkID := crypto.NetworkID([]byte(cfg.P2P.NetworkKey))
+	assert.Len(t, networkID, 16)
+	assert.NotContains(t, networkID, cfg.P2P.NetworkKey)
+
+	member := discovery.Peer{ID: "member", Version: ProtocolVersion, NetworkID: networkID}
+	stranger := discovery.Peer{ID: "stranger", Version: ProtocolVersion, NetworkID: crypto.NetworkID([]byte("tr0ub4dor&3 is not it"))}
+	openPeer := discovery.Peer{ID: "open", Version: ProtocolVersion}
+
+	assert.NoError(t, private.checkAdvertisedPeer(member))
+	assert.ErrorIs(t, private.checkAdvertisedPeer(stranger), ErrNetworkKeyMismatch)
+	assert.ErrorIs(t, private.checkAdvertisedPeer(openPeer), ErrNetworkKeyMismatch)
+
+	assert.NoError(t, open.checkAdvertisedPeer(openPeer))
+	assert.ErrorIs(t, open.checkAdvertisedPeer(member), ErrNetworkKeyMismatch)
+}
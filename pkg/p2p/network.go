@@ -1,21 +1,29 @@
 package p2p
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
-	"strings"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/princetheprogrammer/synapse/internal/config"
 	"github.com/princetheprogrammer/synapse/internal/logger"
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/audit"
 	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
 	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/faults"
 	"github.com/princetheprogrammer/synapse/pkg/p2p/monitor"
 	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/quic-go/quic-go"
 )
 
 // Network represents the P2P network implementation
@@ -24,20 +32,183 @@ type Network struct {
 	logger       *logger.Logger
 	nodeID       string
 	nodeName     string
-	listener     net.Listener
+	listeners    []*networkListener
+	transport    Transport
 	pool         *ConnectionPool
-	peers        map[string]*Peer
-	peersMu      sync.RWMutex
+	peers        *PeerRegistry
 	ctx          context.Context
 	cancel       context.CancelFunc
+	running      bool
 	started      time.Time
-	messageChan  chan Message
-	shutdownOnce sync.Once
+	queue        *messageQueue
 	mu           sync.Mutex
 
+	// Background goroutines, which Stop waits for
+	workers  sync.WaitGroup
+	stopping bool
+	workerMu sync.Mutex
+
+	// Subsystems that died while the network was running
+	errs chan error
+
+	// Application message handlers keyed by message type
+	handlers   map[string][]registeredHandler
+	handlersMu sync.RWMutex
+
+	// Capabilities offered by other subsystems, advertised while available
+	advertised   map[string]func() bool
+	advertisedMu sync.RWMutex
+
+	// Peers kept connected at all times, and the first delay before
+	// redialing one that cannot be reached
+	staticPeers      []StaticPeer
+	staticRetryDelay time.Duration
+
+	// Slots for inbound connections, taken before one is handled and held
+	// until it closes, and how long a peer has to complete the handshake
+	admission        chan struct{}
+	handshakeTimeout time.Duration
+
+	// Address ranges we accept connections from and dial
+	filter *addressFilter
+
+	// Metadata we labelled peers with, kept across reconnects
+	labels   map[string]map[string]string
+	labelsMu sync.RWMutex
+
+	// Callers of Request and SendMessageReliable awaiting a reply
+	pending *pendingReplies
+
+	// Gossip duplicate suppression
+	seen             *seenCache
+	gossipDuplicates uint64
+
+	// Recently received message IDs, to drop retransmits and echoes
+	received *idLRU
+
+	// Local subscribers of the topics published through the mesh
+	topics *topicSubscriptions
+
+	// Partly received fragmented messages
+	fragments *reassembler
+
+	// Peer count rebalancing, and the peers being pruned
+	pruneMargin int
+	pruning     map[string]bool
+	pruneMu     sync.Mutex
+
+	// How often we tell our peers we are alive
+	heartbeatInterval time.Duration
+
+	// Periodic discovery of new peers while below the target peer count,
+	// and early cycles when peers are lost below the discovery floor
+	discoveryInterval  time.Duration
+	discoveryCooldown  time.Duration
+	discoveryTriggered time.Time
+	discoveryStats     DiscoveryStats
+	discovering        *discoveryCycle
+	discoveryMu        sync.Mutex
+
+	// How far message timestamps may be from our clock
+	maxClockSkew time.Duration
+
+	// How long writes may block, and how many timeouts in a row make a peer
+	// slow or get it disconnected
+	writeTimeout       time.Duration
+	slowPeerThreshold  int
+	slowPeerDisconnect int
+
+	// How many messages per second, in bursts of how many, a peer may send,
+	// and how many seconds in a row it may go over before it is disconnected
+	messageRate         float64
+	messageBurst        float64
+	rateLimitDisconnect int
+
+	// How long messages wait to share a BATCH frame, and how many bytes of
+	// them fill one; no batching if zero
+	batchWindow time.Duration
+	batchBytes  int
+
+	// How many messages a peer sent after a missing one are held back for
+	// ordered delivery, how long the missing one is waited for and what
+	// happens then; no ordering if the window is zero
+	orderWindow     int
+	orderGapTimeout time.Duration
+	orderGapPolicy  GapPolicy
+
+	// Codec we prefer for peers that support it
+	codec Codec
+
+	// Protocol version range we advertise and accept
+	protocolVersion    string
+	minProtocolVersion string
+
+	// Outbound dials of every subsystem, and how the hostnames they name
+	// are resolved
+	dialer *Dialer
+	lookup discovery.LookupFunc
+
+	// Lifecycle events, remembered peers and partition detection
+	events     *eventBus
+	peerStore  *PeerStore
+	isolation  *isolationDetector
+	recovering int32
+	dial       func(address string) error
+	// Connection history of each peer, damping those that flap
+	flaps *flapTracker
+	// Peers we disconnected on purpose and must not redial for a while
+	holds *reconnectHolds
+	// How liveness rumors spared pinging idle connections
+	liveness livenessCounters
+
+	// Quota accounting for files under the data directory, if configured
+	storage *storage.Manager
+
+	// State storage of the peer, key and record stores, and whether the network
+	// opened it itself and so closes it on stop
+	kv     kvstorage.KV
+	ownsKV bool
+
+	// Journal of reliable messages awaiting acknowledgement, nil when disabled
+	outbox *outbox
+
+	// Audit trail of peer lifecycle events, nil when disabled
+	audit *audit.Log
+
+	// Report sections contributed by other node subsystems
+	reports   map[string]func() interface{}
+	reportsMu sync.RWMutex
+
 	// Crypto components for Phase 3
 	encryptor       *crypto.Encryptor
 	handshakeMgr    *crypto.HandshakeManager
+	sessions        *sessionCache
+
+	// Key of the private network we belong to and the ID it is advertised
+	// by, empty for the open network
+	networkKey []byte
+	networkID  string
+
+	// Identity key on disk, the last rotation of it, and the keys pinned
+	// for peers
+	keyPath  string
+	keySaved bool
+	keyMu    sync.Mutex
+	keyGrace time.Duration
+	rotation atomic.Pointer[crypto.KeyRotation]
+	keys     *KeyStore
+
+	// Our own signed peer record and the newest of each peer we heard of
+	localRecord localRecord
+	peerRecords *PeerRecordStore
+
+	// Fault injection on our connections, nil unless enabled for tests
+	faults *faults.Injector
+
+	// QUIC transport, nil when disabled or unavailable
+	quicTransport *quic.Transport
+	quicListener  *quic.Listener
+	quicCert      atomic.Pointer[tls.Certificate]
 
 	// Discovery components for Phase 3
 	bootstrapMgr    *discovery.BootstrapManager
@@ -46,6 +217,7 @@ type Network struct {
 
 	// Topology components for Phase 3
 	topologyMgr     *topology.Manager
+	reputation      *topology.ReputationSystem
 
 	// Monitor components for Phase 3
 	monitor         *monitor.NetworkMonitor
@@ -63,10 +235,16 @@ func New(cfg *config.Config, logger *logger.Logger, nodeID string) (*Network, er
 		return nil, fmt.Errorf("nodeID cannot be empty")
 	}
 
+	if err := validateLocalMetadata(cfg.P2P.Metadata); err != nil {
+		return nil, err
+	}
+
 	networkLogger := logger.With("component", "p2p")
 	
-	// Create encryptor for message encryption
-	encryptor, err := crypto.NewEncryptor()
+	// Create encryptor for message encryption, with the identity key kept
+	// in the data directory
+	keyPath := filepath.Join(cfg.Storage.DataDir, KeyFile)
+	encryptor, rotation, keySaved, err := loadNodeKey(keyPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create encryptor: %w", err)
 	}
@@ -76,96 +254,366 @@ func New(cfg *config.Config, logger *logger.Logger, nodeID string) (*Network, er
 		logger:      networkLogger,
 		nodeID:      nodeID,
 		nodeName:    cfg.Node.Name,
-		peers:       make(map[string]*Peer),
-		messageChan: make(chan Message, DefaultMessageQueueSize),
+		peers:       NewPeerRegistry(),
+		queue:       newMessageQueue(cfg.P2P.Queue.Size, OverflowPolicy(cfg.P2P.Queue.Overflow), time.Duration(cfg.P2P.Queue.BlockTimeoutMS)*time.Millisecond, cfg.P2P.Queue.PerType),
+		errs:        make(chan error, 1),
 		encryptor:   encryptor,
+		handlers:    make(map[string][]registeredHandler),
+		pending:     newPendingReplies(),
+		seen:        newSeenCache(DefaultSeenCacheTTL),
+		topics:      newTopicSubscriptions(),
+		received:    newIDLRU(DefaultReceivedIDCacheSize),
+		fragments:   newReassembler(DefaultFragmentMemory, DefaultFragmentTimeout),
+		pruneMargin: DefaultPruneMargin,
+		events:      newEventBus(),
+		peerStore:   NewPeerStore(nil),
+		keys:        NewKeyStore(nil),
+		peerRecords: NewPeerRecordStore(nil),
+		keyPath:     keyPath,
+		keySaved:    keySaved,
+		audit:       newAuditLog(cfg),
+		isolation:   newIsolationDetector(cfg.P2P.MinPeers, time.Duration(cfg.P2P.IsolationThreshold)*time.Second),
+		flaps:       newFlapTracker(cfg.P2P.FlapDamping),
+		holds:       newReconnectHolds(),
+	}
+	n.dial = func(address string) error {
+		// A remembered peer is dialed at every address it may be reached at
+		nodeID, addresses := n.peerStore.AddressesOf(address)
+		if err := n.checkRedial(nodeID); err != nil {
+			return err
+		}
+		_, err := n.connectAny(n.ctx, addresses, "")
+		return err
+	}
+	n.heartbeatInterval = DefaultHeartbeatInterval
+	n.localRecord.interval = DefaultPeerRecordInterval
+	n.discoveryInterval = time.Duration(cfg.P2P.DiscoveryInterval) * time.Second
+	if n.discoveryInterval <= 0 {
+		n.discoveryInterval = DefaultPeerDiscoveryInterval
+	}
+	n.discoveryCooldown = DefaultDiscoveryTriggerCooldown
+	n.maxClockSkew = time.Duration(cfg.P2P.MaxClockSkew) * time.Second
+	if n.maxClockSkew <= 0 {
+		n.maxClockSkew = DefaultMaxClockSkew
+	}
+	n.writeTimeout = time.Duration(cfg.P2P.WriteTimeout) * time.Second
+	if n.writeTimeout <= 0 {
+		n.writeTimeout = DefaultWriteTimeout
+	}
+	n.slowPeerThreshold = cfg.P2P.SlowPeerThreshold
+	if n.slowPeerThreshold <= 0 {
+		n.slowPeerThreshold = DefaultSlowPeerThreshold
+	}
+	n.slowPeerDisconnect = cfg.P2P.SlowPeerDisconnect
+	n.messageRate = float64(cfg.P2P.PeerMessageRate)
+	if n.messageRate <= 0 {
+		n.messageRate = DefaultPeerMessageRate
+	}
+	n.messageBurst = float64(cfg.P2P.PeerMessageBurst)
+	if n.messageBurst <= 0 {
+		n.messageBurst = DefaultPeerMessageBurst
+	}
+	n.rateLimitDisconnect = cfg.P2P.RateLimitDisconnect
+	if cfg.P2P.Batching.Enabled {
+		n.batchWindow = time.Duration(cfg.P2P.Batching.WindowMS) * time.Millisecond
+		if n.batchWindow <= 0 {
+			n.batchWindow = DefaultBatchWindow
+		}
+		n.batchBytes = cfg.P2P.Batching.MaxBytes
+		if n.batchBytes <= 0 {
+			n.batchBytes = DefaultBatchBytes
+		}
+		if n.batchBytes > MaxBatchBytes {
+			n.batchBytes = MaxBatchBytes
+		}
+	}
+	if cfg.P2P.OrderedDelivery.Enabled {
+		n.orderWindow = cfg.P2P.OrderedDelivery.Window
+		if n.orderWindow <= 0 {
+			n.orderWindow = DefaultOrderWindow
+		}
+		n.orderGapTimeout = time.Duration(cfg.P2P.OrderedDelivery.GapTimeoutMS) * time.Millisecond
+		if n.orderGapTimeout <= 0 {
+			n.orderGapTimeout = DefaultGapTimeout
+		}
+		n.orderGapPolicy = GapPolicy(cfg.P2P.OrderedDelivery.OnGap)
+		if n.orderGapPolicy != GapDisconnect {
+			n.orderGapPolicy = GapSkip
+		}
+	}
+	n.sessions = newSessionCache(cfg.P2P.SessionCacheSize, time.Duration(cfg.P2P.SessionTicketTTL)*time.Second)
+	n.keyGrace = time.Duration(cfg.P2P.KeyRotationGrace) * time.Second
+	if cfg.P2P.NetworkKey != "" {
+		n.networkKey = []byte(cfg.P2P.NetworkKey)
+		n.networkID = crypto.NetworkID(n.networkKey)
+	}
+	if cfg.P2P.FaultInjection.Enabled {
+		n.faults = faults.New(cfg.P2P.FaultInjection.Seed)
+	}
+	n.rotation.Store(rotation)
+	n.codec = CodecJSON
+	if codec, known := CodecByName(cfg.P2P.WireCodec); known {
+		n.codec = codec
+	}
+	n.staticPeers, err = parseStaticPeers(cfg.P2P.StaticPeers, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	n.staticRetryDelay = DefaultRetryDelay
+	n.filter, err = newAddressFilter(cfg.P2P.AllowedCIDRs, cfg.P2P.DeniedCIDRs)
+	if err != nil {
+		return nil, err
 	}
 
 	// Initialize components
 	n.handshakeMgr = crypto.NewHandshakeManager(encryptor, nodeID)
+	n.setProtocolVersions(ProtocolVersion, MinProtocolVersion)
 	n.bootstrapMgr = discovery.NewBootstrapManager(cfg.P2P.BootstrapPeers)
-	n.topologyMgr = topology.NewManager(cfg.P2P.MaxPeers)
+	n.topologyMgr, err = topology.NewManagerWithConfig(cfg.P2P.MaxPeers, cfg.Topology.Scoring())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create topology manager: %w", err)
+	}
+	n.topologyMgr.SetLocalID(nodeID)
+	n.peers.Observe(topologyObserver{network: n})
+	if n.audit != nil {
+		n.topologyMgr.WatchReputation(cfg.Audit.ReputationThreshold, n.auditReputation)
+	}
+	n.reputation, err = topology.NewReputationSystemWithConfig(n.topologyMgr, decayConfigFrom(cfg.Topology))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reputation system: %w", err)
+	}
 	n.monitor = monitor.NewNetworkMonitor(n.topologyMgr)
+	n.dialer = NewDialer(cfg.P2P.MaxConcurrentDials, time.Duration(cfg.P2P.DialCooldown)*time.Second, n.monitor.Stats)
+	if delay := time.Duration(cfg.P2P.DialAttemptDelayMS) * time.Millisecond; delay > 0 {
+		n.dialer.attemptDelay = delay
+	}
+	n.lookup = lookupIP
 	n.peerExchange = discovery.NewPeerExchange(cfg.P2P.MaxPeers)
+	n.peerExchange.SetDiscoveryFunc(n.discoveryCandidates)
+	n.peerExchange.SetConnectFunc(n.dialCandidate)
 
 	// Initialize connection pool
-	n.pool = NewConnectionPool(networkLogger, cfg.P2P.MaxPeers, DefaultConnectionTimeout)
+	maxConnections := cfg.P2P.MaxPeers + DefaultConnectionHeadroom
+	n.pool = NewConnectionPool(networkLogger, maxConnections, DefaultConnectionTimeout)
+	if interval := time.Duration(cfg.P2P.CleanupInterval) * time.Second; interval > 0 {
+		n.pool.interval = interval
+	}
+	if grace := time.Duration(cfg.P2P.CleanupGrace) * time.Second; grace > 0 {
+		n.pool.grace = grace
+	}
+	n.pool.probe = n.probeConnection
+	n.pool.vouched = n.vouchedFor
+	n.admission = make(chan struct{}, maxConnections+DefaultPendingHandshakes)
+	n.handshakeTimeout = DefaultHandshakeTimeout
 
 	return n, nil
 }
 
-// Start begins listening for incoming connections and starts network operations
+// decayConfigFrom converts the topology config section into a reputation decay schedule
+func decayConfigFrom(cfg config.TopologyConfig) topology.DecayConfig {
+	return topology.DecayConfig{
+		Interval:      time.Duration(cfg.ReputationDecayInterval) * time.Second,
+		Rate:          cfg.ReputationDecayRate,
+		InactiveAfter: time.Duration(cfg.ReputationInactiveAfter) * time.Second,
+	}
+}
+
+// Start begins listening for incoming connections and starts network
+// operations. A stopped network may be started again.
 func (n *Network) Start(ctx context.Context) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	if n.listener != nil {
+	if n.running {
 		return fmt.Errorf("network already started")
 	}
 
-	n.logger.Infof("starting P2P network on port %d", n.config.P2P.ListenPort)
+	n.workerMu.Lock()
+	n.stopping = false
+	n.workerMu.Unlock()
+
+	// A failure left over from the last run is dealt with by this restart
+	select {
+	case <-n.errs:
+	default:
+	}
+
+	n.logger.Info("starting P2P network")
+	if n.faults != nil {
+		n.logger.Warn("fault injection is enabled; frames to peers may be dropped, delayed or corrupted")
+	}
+
+	if err := n.saveNodeKey(); err != nil {
+		return err
+	}
+	if err := n.openState(); err != nil {
+		return err
+	}
 
 	// Create context for network operations
 	n.ctx, n.cancel = context.WithCancel(ctx)
 
-	// Start the listener
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", n.config.P2P.ListenPort))
-	if err != nil {
-		return fmt.Errorf("failed to start TCP listener on port %d: %w", n.config.P2P.ListenPort, err)
+	// Start the listeners, unless peers can only be reached by dialing out
+	var listeners []*networkListener
+	if n.config.P2P.ListenEnabled {
+		var err error
+		if listeners, err = n.openListeners(); err != nil {
+			n.closeState()
+			return err
+		}
+		for _, l := range listeners {
+			n.logger.Infof("P2P network listening on %s", l.listener.Addr())
+		}
+	} else {
+		n.logger.Info("listening disabled, P2P network relies on outbound connections")
 	}
-	n.listener = listener
+	n.listeners = listeners
+	n.running = true
 	n.started = time.Now()
 
-	n.logger.Infof("P2P network listening on port %d", n.config.P2P.ListenPort)
+	// Listeners bound to a specific address go into our record at once;
+	// the rest wait for peers to tell us where they see us
+	n.refreshPeerRecord(false)
+
+	// The QUIC listener must exist before the first HELLO advertises it.
+	// Injected faults only reach stream connections, so they are not
+	// upgraded.
+	if n.config.P2P.EnableQUIC && n.config.P2P.ListenEnabled && n.transport == nil && n.faults == nil {
+		if err := n.startQUIC(); err != nil {
+			n.logger.Warnf("QUIC transport unavailable, using TCP only: %v", err)
+		}
+	}
+
+	// Advertise ourselves to local discovery, along with the capabilities
+	// started so far. Other transports are not reachable through it.
+	if n.config.P2P.EnableDiscovery && n.transport == nil {
+		if err := n.startMDNS(); err != nil {
+			n.cancel()
+			n.closeQUIC()
+			closeListeners(listeners)
+			n.waitForWorkers(DefaultShutdownTimeout)
+			n.listeners = nil
+			n.running = false
+			n.quicTransport = nil
+			n.quicListener = nil
+			n.closeState()
+			return err
+		}
+	}
 
-	// Start accepting connections in a goroutine
-	go n.acceptConnections()
+	// Start accepting connections on each listener
+	for _, l := range listeners {
+		n.background(func() { n.acceptConnections(l) })
+	}
 
 	// Start connection pool cleanup
-	go n.pool.CleanInactive(n.ctx)
+	n.background(func() { n.pool.CleanInactive(n.ctx) })
 
 	// Start message processing
-	go n.processMessages()
+	n.background(n.processMessages)
 
 	// Start heartbeat service if enabled
 	if n.config.P2P.EnableDiscovery {
-		go n.heartbeatService()
-	}
-
-	// Initialize mDNS discoverer
-	n.mdnsDiscoverer = discovery.NewMDNSDiscoverer(n.nodeName, n.config.P2P.ListenPort, []string{fmt.Sprintf("node_id=%s", n.nodeID)})
-	if err := n.mdnsDiscoverer.Start(ctx); err != nil {
-		n.logger.Errorf("failed to start mDNS discovery: %v", err)
-		// Don't fail startup for mDNS issues
+		n.background(n.heartbeatService)
 	}
 
 	// Start bootstrap connections
-	go n.connectToBootstrapNodes()
+	n.background(n.connectToBootstrapNodes)
+
+	// Keep static peers connected
+	n.maintainStaticPeers()
 
 	// Start monitoring
 	n.monitor.Start()
 
+	// Start reputation decay
+	n.reputation.Start(n.ctx)
+
 	// Start periodic peer discovery
-	go n.periodicPeerDiscovery()
+	n.background(n.periodicPeerDiscovery)
+
+	// Watch for loss of all peers
+	n.background(n.monitorIsolation)
+
+	// Drop fragmented messages that never complete
+	n.background(n.expireFragments)
 
 	return nil
 }
 
-// acceptConnections handles incoming TCP connections
-func (n *Network) acceptConnections() {
+// background runs fn in a goroutine that Stop waits for. Work started once
+// Stop is waiting still runs, but is not waited for; it sees the network's
+// context cancelled.
+func (n *Network) background(fn func()) {
+	n.workerMu.Lock()
+	defer n.workerMu.Unlock()
+
+	if n.stopping {
+		go fn()
+		return
+	}
+	n.workers.Add(1)
+	go func() {
+		defer n.workers.Done()
+		fn()
+	}()
+}
+
+// Errors reports subsystems that died while the network was running, such
+// as a listener closed underneath it. The network is of no use until it is
+// stopped and started again.
+func (n *Network) Errors() <-chan error {
+	return n.errs
+}
+
+// fail reports a subsystem that died. Only the first failure is kept until
+// it is read.
+func (n *Network) fail(err error) {
+	select {
+	case n.errs <- err:
+	default:
+	}
+}
+
+// waitForWorkers waits up to timeout for the background goroutines to
+// finish and reports whether they did
+func (n *Network) waitForWorkers(timeout time.Duration) bool {
+	n.workerMu.Lock()
+	n.stopping = true
+	n.workerMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.workers.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// acceptConnections handles incoming TCP connections on l
+func (n *Network) acceptConnections(l *networkListener) {
 	defer func() {
 		if r := recover(); r != nil {
 			n.logger.Errorf("panic in acceptConnections: %v", r)
 		}
 	}()
 
+	listener := l.listener
 	for {
 		select {
 		case <-n.ctx.Done():
 			n.logger.Info("P2P network context cancelled, stopping connection acceptor")
 			return
 		default:
-			conn, err := n.listener.Accept()
+			conn, err := listener.Accept()
 			if err != nil {
 				select {
 				case <-n.ctx.Done():
@@ -173,202 +621,240 @@ func (n *Network) acceptConnections() {
 					n.logger.Info("P2P network stopped, exiting accept loop")
 					return
 				default:
-					n.logger.Errorf("error accepting connection: %v", err)
-					continue
 				}
-			}
-
-			// Handle the connection in a separate goroutine
-			go n.handleConnectionWithEncryption(conn, true) // incoming connection
-		}
-	}
-}
-
-// handleConnection processes a TCP connection (incoming or outgoing)
-func (n *Network) handleConnection(conn net.Conn, incoming bool) {
-	connID := fmt.Sprintf("conn_%s_%d", conn.RemoteAddr().String(), time.Now().UnixNano())
-	
-	connection := &Connection{
-		ID:        connID,
-		Address:   conn.RemoteAddr().String(),
-		Conn:      conn,
-		CreatedAt: time.Now(),
-		LastSeen:  time.Now(),
-	}
-
-	n.logger.Infof("handling connection %s (incoming: %t) from %s", connID, incoming, conn.RemoteAddr())
-
-	// Add to connection pool
-	if err := n.pool.AddConnection(connection); err != nil {
-		n.logger.Errorf("failed to add connection to pool: %v", err)
-		conn.Close()
-		return
-	}
-
-	defer func() {
-		n.pool.RemoveConnection(connID)
-		conn.Close()
-	}()
-
-	// Perform handshake if this is an incoming connection
-	if incoming {
-		if err := n.performHandshake(conn, true); err != nil {
-			n.logger.Errorf("handshake failed for incoming connection: %v", err)
-			return
-		}
-	}
-
-	// Start reading messages from the connection
-	reader := bufio.NewReader(conn)
-	for {
-		select {
-		case <-n.ctx.Done():
-			n.logger.Info("network context cancelled, closing connection")
-			return
-		default:
-			// Set read deadline to detect dead connections
-			conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-			
-			data, err := reader.ReadBytes('\n')
-			if err != nil {
-				if !strings.Contains(err.Error(), "use of closed network connection") {
-					n.logger.Errorf("error reading from connection %s: %v", connID, err)
+				if errors.Is(err, net.ErrClosed) {
+					// Nothing can reach us there until the network is
+					// restarted
+					n.logger.Errorf("listener on %s closed while running: %v", l.config.Address, err)
+					l.fail(err)
+					n.fail(fmt.Errorf("listener on %s closed: %w", l.config.Address, err))
+					return
 				}
-				return
-			}
-
-			// Update last seen time
-			connection.UpdateLastSeen()
-
-			// Deserialize the message
-			msg, err := DeserializeMessage(data)
-			if err != nil {
-				n.logger.Errorf("failed to deserialize message from %s: %v", conn.RemoteAddr(), err)
+				n.logger.Errorf("error accepting connection: %v", err)
 				continue
 			}
 
-			// Validate the message
-			if err := msg.Validate(); err != nil {
-				n.logger.Errorf("invalid message from %s: %v", conn.RemoteAddr(), err)
+			// Refuse addresses outside our policy before the handshake
+			if err := n.filter.check(conn.RemoteAddr().String()); err != nil {
+				n.logger.Debugf("refused connection: %v", err)
+				n.monitor.Stats.IncrementConnectionsDenied()
+				conn.Close()
 				continue
 			}
 
-			// Process the message based on type
-			if err := n.processMessage(msg, connection); err != nil {
-				n.logger.Errorf("error processing message from %s: %v", conn.RemoteAddr(), err)
+			// Refuse connections beyond capacity before they cost a
+			// goroutine; a flood of idle sockets must stay cheap
+			select {
+			case n.admission <- struct{}{}:
+			default:
+				conn.Close()
+				n.monitor.Stats.IncrementConnectionsRejected()
 				continue
 			}
+			n.monitor.Stats.IncrementConnectionsAccepted()
+
+			n.background(func() {
+				defer func() { <-n.admission }()
+				n.handleConnectionWithEncryption(conn, true)
+			})
 		}
 	}
 }
 
-// performHandshake performs the initial handshake with a peer
-func (n *Network) performHandshake(conn net.Conn, incoming bool) error {
-	// This method is deprecated. Use performSecureHandshake instead.
-	// For backward compatibility, we'll call the secure handshake.
-	connID := fmt.Sprintf("conn_%s_%d", conn.RemoteAddr().String(), time.Now().UnixNano())
-	
-	connection := &Connection{
-		ID:        connID,
-		Address:   conn.RemoteAddr().String(),
-		Conn:      conn,
-		CreatedAt: time.Now(),
-		LastSeen:  time.Now(),
+// processMessage processes an incoming message
+func (n *Network) processMessage(msg *Message, conn *Connection) error {
+	n.messageLogger(msg).Debugf("received %s message %s from %s", msg.Type, msg.ID, conn.PeerID)
+
+	// Key rotations are checked before they are gossiped on
+	if msg.Type == MessageTypeKeyRotation {
+		return n.handleKeyRotationMessage(msg, conn)
 	}
 
-	// Perform handshake with encryption
-	return n.performSecureHandshake(conn, incoming, connection)
-}
+	if msg.IsGossip() && !n.handleGossipMessage(msg) {
+		return nil
+	}
 
-// processMessage processes an incoming message
-func (n *Network) processMessage(msg *Message, conn *Connection) error {
+	if n.handleReply(msg, conn) {
+		return nil
+	}
+
+	var err error
 	switch msg.Type {
 	case MessageTypeHello:
-		return n.handleHelloMessage(msg, conn)
+		err = n.handleHelloMessage(msg, conn)
 	case MessageTypeHeartbeat:
-		return n.handleHeartbeatMessage(msg, conn)
+		err = n.handleHeartbeatMessage(msg, conn)
 	case MessageTypePeerList:
-		return n.handlePeerListMessage(msg, conn)
+		err = n.handlePeerListMessage(msg, conn)
+	case MessageTypePeerListRequest:
+		err = n.handlePeerListRequestMessage(msg, conn)
 	case MessageTypePing:
-		return n.handlePingMessage(msg, conn)
+		err = n.handlePingMessage(msg, conn)
 	case MessageTypePong:
-		return n.handlePongMessage(msg, conn)
+		err = n.handlePongMessage(msg, conn)
+	case MessageTypeGoodbye:
+		err = n.handleGoodbyeMessage(msg, conn)
+	case MessageTypeTopologyReport:
+		err = n.handleTopologyReportMessage(msg, conn)
+	case MessageTypeError:
+		err = n.handleErrorMessage(msg, conn)
+	case MessageTypeFragment:
+		err = n.handleFragmentMessage(msg, conn)
+	case MessageTypeBatch:
+		err = n.handleBatchMessage(msg, conn)
+	case MessageTypeTrace:
+		err = n.handleTraceMessage(msg, conn)
+	case MessageTypeTraceReply:
+		err = n.handleTraceReplyMessage(msg, conn)
+	case MessageTypeTopic:
+		err = n.handleTopicMessage(msg)
+	case MessageTypeAck:
+		n.messageLogger(msg).Debugf("ignoring late ack for %s from %s", msg.ReplyTo, msg.Sender)
 	default:
-		// Add message to the processing channel
-		select {
-		case n.messageChan <- *msg:
-			n.logger.Debugf("queued message %s from %s", msg.ID, msg.Sender)
-		default:
-			n.logger.Warnf("message queue full, dropping message %s", msg.ID)
+		// A sender waiting on us must hear that nobody handles this type
+		if (msg.ExpectReply || msg.RequireAck) && !n.hasHandler(msg.Type) {
+			n.rejectMessage(conn, msg.ID, ErrorCodeNotImplemented, fmt.Sprintf("unsupported message type %s", msg.Type), topology.EventInvalidMessage)
+			return nil
+		}
+
+		if msg.Seq != 0 && conn.order != nil {
+			n.deliverInOrder(msg, conn)
+			break
+		}
+
+		// Nobody would handle the message once it is through the queue
+		if !n.hasHandler(msg.Type) {
+			n.messageLogger(msg).Debugf("no handler registered for message type %s", msg.Type)
+			break
+		}
+		if !n.enqueue(*msg) {
+			return nil
 		}
 	}
 
-	return nil
+	if err == nil && msg.RequireAck {
+		n.acknowledge(msg, conn)
+	}
+	return err
+}
+
+// enqueue queues a message for its handlers. It reports false if the
+// message was dropped for want of room.
+func (n *Network) enqueue(msg Message) bool {
+	if drop, dropped := n.queue.Push(n.ctx, msg); dropped {
+		n.monitor.Stats.IncrementQueueDrops(drop.Type)
+		n.logger.Warnf("message queue full, dropping message %s of type %s", drop.ID, drop.Type)
+		if drop.ID == msg.ID {
+			return false
+		}
+	}
+	n.messageLogger(&msg).Debugf("queued message %s from %s", msg.ID, msg.Sender)
+	return true
 }
 
 // handleHelloMessage handles HELLO messages
 func (n *Network) handleHelloMessage(msg *Message, conn *Connection) error {
-	// Convert the payload to the proper type
-	payloadBytes, _ := json.Marshal(msg.Payload)
 	var helloPayload HelloPayload
-	if err := json.Unmarshal(payloadBytes, &helloPayload); err != nil {
-		return fmt.Errorf("failed to unmarshal hello payload: %w", err)
+	if err := msg.DecodePayload(&helloPayload); err != nil {
+		return err
 	}
 
-	// Create or update peer information
-	peer := NewPeer(helloPayload.NodeID, conn.Address, helloPayload.Version)
-	peer.SetConnection(conn)
-	n.peersMu.Lock()
-	n.peers[helloPayload.NodeID] = peer
-	n.peersMu.Unlock()
-	
-	n.pool.AddPeer(peer)
-	
-	n.logger.Infof("registered new peer: %s at %s", helloPayload.NodeID, conn.Address)
-	
+	if _, err := negotiateVersion(n.protocolVersion, n.minProtocolVersion, helloPayload.Version, helloPayload.MinVersion); err != nil {
+		n.rejectIncompatiblePeer(conn, err)
+		conn.closeWith("incompatible protocol version")
+		return fmt.Errorf("rejected hello from %s: %w", helloPayload.NodeID, err)
+	}
+
+	// Peers registered by the handshake only need their capabilities filled in
+	peer, exists := n.peers.Get(conn.PeerID)
+	if !exists {
+		peer = NewPeer(helloPayload.NodeID, conn.Address, helloPayload.Version)
+		peer.SetConnection(conn)
+		conn.markEstablished()
+		n.peers.Add(peer, nil)
+
+		n.logger.Infof("registered new peer: %s at %s", helloPayload.NodeID, conn.Address)
+	}
+	peer.SetCapabilities(helloPayload.Capabilities)
+	n.logger.Debugf("peer %s advertises capabilities %v", peer.ID, helloPayload.Capabilities)
+	n.applyAdvertisedMetadata(peer, helloPayload.Metadata)
+	conn.setCodec(n.negotiateCodec(peer))
+	n.startBatching(conn, peer)
+
+	// An inbound connection comes from an ephemeral port; the HELLO tells us
+	// where the peer actually accepts connections
+	if !conn.Outbound {
+		if host, _, err := net.SplitHostPort(conn.Address); err == nil {
+			n.learnListeners(peer, host, helloPayload)
+		}
+	}
+
+	// The dialing side upgrades, so a pair of peers opens one QUIC session
+	if conn.Outbound && helloPayload.QUICPort > 0 && peer.HasCapability(CapabilityQUIC) && n.quicListener != nil {
+		if host, _, err := net.SplitHostPort(conn.Address); err == nil {
+			address := net.JoinHostPort(host, strconv.Itoa(helloPayload.QUICPort))
+			n.background(func() { n.upgradeToQUIC(conn, address) })
+		}
+	}
+	n.events.Publish(Event{
+		Type:   EventPeerConnected,
+		PeerID: peer.ID,
+		Data:   map[string]interface{}{"capabilities": helloPayload.Capabilities},
+	})
+	n.background(func() { n.redeliver(peer.ID) })
+
+	// Where the peer sees us goes into the record our peer list carries
+	n.observeHost(peer.ID, helloPayload.ObservedHost, conn.Outbound)
+
 	// Send our peer list to the new peer
-	if err := n.sendPeerList(conn.Conn); err != nil {
+	if err := n.sendPeerList(conn); err != nil {
 		n.logger.Errorf("failed to send peer list to %s: %v", helloPayload.NodeID, err)
 	}
 
 	return nil
 }
 
-// handleHeartbeatMessage handles HEARTBEAT messages
+// handleHeartbeatMessage handles HEARTBEAT messages. Heartbeats are one-way:
+// each side sends its own every interval and none is answered, as round
+// trips are measured with PING and PONG.
 func (n *Network) handleHeartbeatMessage(msg *Message, conn *Connection) error {
-	// Convert the payload to the proper type
-	payloadBytes, _ := json.Marshal(msg.Payload)
 	var heartbeatPayload HeartbeatPayload
-	if err := json.Unmarshal(payloadBytes, &heartbeatPayload); err != nil {
-		return fmt.Errorf("failed to unmarshal heartbeat payload: %w", err)
+	if err := msg.DecodePayload(&heartbeatPayload); err != nil {
+		return err
 	}
 
 	conn.UpdateLastSeen()
-	
-	n.logger.Debugf("received heartbeat from %s", msg.Sender)
-	
-	// Send response heartbeat
-	response := NewMessage(MessageTypeHeartbeat, n.nodeID, HeartbeatPayload{
-		NodeID: n.nodeID,
-		TS:     time.Now().Unix(),
-	})
-	
-	if err := n.sendMessageToConn(conn.Conn, response); err != nil {
-		n.logger.Errorf("failed to send heartbeat response: %v", err)
+	n.reputation.RecordEvent(conn.PeerID, topology.EventHeartbeat)
+	n.sampleClockSkew(msg, conn)
+	n.recordPeerLoad(conn.PeerID, heartbeatPayload)
+	n.hearRumors(conn.PeerID, heartbeatPayload.Alive)
+	if peer, exists := n.peers.Get(conn.PeerID); exists {
+		peer.setTopics(heartbeatPayload.Topics)
 	}
-
+	
+	n.messageLogger(msg).Debugf("received heartbeat from %s", msg.Sender)
 	return nil
 }
 
 // handlePingMessage handles PING messages
 func (n *Network) handlePingMessage(msg *Message, conn *Connection) error {
+	var ping livenessPayload
+	if msg.Payload != nil && msg.DecodePayload(&ping) == nil {
+		n.hearRumors(conn.PeerID, ping.Alive)
+	}
+
 	// Send PONG response
-	pongMsg := NewMessage(MessageTypePong, n.nodeID, map[string]interface{}{
+	pong := map[string]interface{}{
 		"timestamp": time.Now().Unix(),
 		"request_id": msg.ID,
-	})
+	}
+	if digest := n.livenessDigest(); len(digest) > 0 {
+		pong["alive"] = digest
+	}
+	pongMsg := NewMessage(MessageTypePong, n.nodeID, pong)
+	pongMsg.answer(msg)
 	
-	if err := n.sendMessageToConn(conn.Conn, pongMsg); err != nil {
+	if err := n.send(conn, pongMsg); err != nil {
 		return fmt.Errorf("failed to send pong: %w", err)
 	}
 
@@ -377,187 +863,567 @@ func (n *Network) handlePingMessage(msg *Message, conn *Connection) error {
 
 // handlePongMessage handles PONG messages
 func (n *Network) handlePongMessage(msg *Message, conn *Connection) error {
-	n.logger.Debugf("received pong from %s", msg.Sender)
+	n.messageLogger(msg).Debugf("received pong from %s", msg.Sender)
+	n.reputation.RecordEvent(conn.PeerID, topology.EventSuccessfulExchange)
 	return nil
 }
 
 // handlePeerListMessage handles PEER_LIST messages
 func (n *Network) handlePeerListMessage(msg *Message, conn *Connection) error {
-	// Convert the payload to the proper type
-	payloadBytes, _ := json.Marshal(msg.Payload)
 	var peerListPayload PeerListPayload
-	if err := json.Unmarshal(payloadBytes, &peerListPayload); err != nil {
-		return fmt.Errorf("failed to unmarshal peer list payload: %w", err)
+	if err := msg.DecodePayload(&peerListPayload); err != nil {
+		return err
 	}
 
-	n.logger.Debugf("received peer list with %d peers from %s", len(peerListPayload.Peers), msg.Sender)
+	n.messageLogger(msg).Debugf("received peer list with %d peers from %s", len(peerListPayload.Peers), msg.Sender)
 
-	// Add received peers to our known peers (but don't connect automatically)
-	for _, peerInfo := range peerListPayload.Peers {
-		if peerInfo.ID != n.nodeID { // Don't add ourselves
-			n.logger.Debugf("learned about peer %s at %s", peerInfo.ID, peerInfo.Address)
-		}
+	// Only signed records are taken from the list, unless configured
+	// otherwise; we do not connect to the peers in it
+	peers := n.acceptPeerList(peerListPayload, conn.PeerID)
+	for _, peerInfo := range peers {
+		n.logger.Debugf("learned about peer %s at %s", peerInfo.ID, peerInfo.Address)
+	}
+
+	// A PEER_LIST that expects a reply asks for our own list
+	if msg.ExpectReply {
+		return n.Reply(*msg, MessageTypePeerList, n.peerListPayload())
 	}
 
 	return nil
 }
 
-// Connect establishes a connection to a peer at the given address
-func (n *Network) Connect(address string) error {
+var (
+	// ErrConnectionRefused is returned by Connect when the peer could not be
+	// dialed
+	ErrConnectionRefused = errors.New("connection refused")
+	// ErrHandshakeRejected is returned by Connect when the connection was
+	// made but the secure handshake failed or the peer refused it
+	ErrHandshakeRejected = errors.New("handshake rejected")
+	// ErrDuplicatePeer is returned by Connect when we already have a live
+	// connection to the peer reached
+	ErrDuplicatePeer = errors.New("already connected to peer")
+	// ErrDialCooldown is returned by Connect for an address whose last dial
+	// failed less than the dial cooldown ago
+	ErrDialCooldown = errors.New("address failed recently")
+	// ErrPeerNotFound is returned when sending to, or pinging, a peer we are
+	// not connected to
+	ErrPeerNotFound = errors.New("not connected to peer")
+)
+
+// errReadPanic wraps a panic raised handling data a peer sent
+var errReadPanic = errors.New("panic handling received data")
+
+// Connect dials a peer and completes the secure handshake with it, returning
+// the ID the peer proved. The peer is registered before Connect returns.
+// Failures wrap ErrConnectionRefused, ErrAddressNotAllowed,
+// ErrHandshakeRejected, ErrDialCooldown or, together with the ID of the peer, ErrDuplicatePeer. ctx bounds the dial and the handshake, as does
+// stopping the network; the connection keeps running once Connect returns.
+// IPv6 literals must be bracketed when a port is given, e.g. [::1]:8080; a
+// bare IP address is dialed on the default port. Dials wait their turn in
+// the network's Dialer; as an explicit request, Connect dials an address
+// even during its cooldown.
+func (n *Network) Connect(ctx context.Context, address string) (string, error) {
+	return n.connect(ctx, address, "", true)
+}
+
+// connect dials a peer and, if expectedPeerID is set, refuses it unless it
+// proves to be that node. Only explicit dials are made to an address in its
+// dial cooldown.
+func (n *Network) connect(ctx context.Context, address, expectedPeerID string, explicit bool) (string, error) {
+	address, err := n.dialableAddress(ctx, address)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if n.ctx != nil {
+		stop := context.AfterFunc(n.ctx, cancel)
+		defer stop()
+	}
+
+	dial := n.dialer.Dial
+	if explicit {
+		dial = n.dialer.DialNow
+	}
+	peerID, err := dial(ctx, address, func(ctx context.Context, address string) (string, error) {
+		return n.dialPeer(ctx, address, expectedPeerID)
+	})
+	// The dial may have been started by a caller expecting no node in particular
+	if err == nil && expectedPeerID != "" && peerID != expectedPeerID {
+		return "", fmt.Errorf("failed to connect to peer %s: %w: expected %s, got %s", address, ErrPeerIDMismatch, expectedPeerID, peerID)
+	}
+	return peerID, err
+}
+
+// connectAny dials a peer at whichever of its addresses connects first, as
+// Dialer.DialAny does, and, if expectedPeerID is set, refuses it unless it
+// proves to be that node. Addresses that cannot be dialed are skipped.
+func (n *Network) connectAny(ctx context.Context, addresses []PeerAddress, expectedPeerID string) (string, error) {
+	var dialable []PeerAddress
+	var errs []error
+	for _, address := range addresses {
+		resolved, err := n.dialableAddress(ctx, address.Address)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		address.Address = resolved
+		dialable = append(dialable, address)
+	}
+	if len(dialable) == 0 {
+		return "", errors.Join(errs...)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if n.ctx != nil {
+		stop := context.AfterFunc(n.ctx, cancel)
+		defer stop()
+	}
+
+	peerID, address, err := n.dialer.DialAny(ctx, dialable, func(ctx context.Context, address string) (string, error) {
+		return n.dialPeer(ctx, address, expectedPeerID)
+	})
+	if err != nil {
+		return peerID, err
+	}
+	if expectedPeerID != "" && peerID != expectedPeerID {
+		return "", fmt.Errorf("failed to connect to peer %s: %w: expected %s, got %s", address, ErrPeerIDMismatch, expectedPeerID, peerID)
+	}
+	if len(dialable) > 1 {
+		n.logger.Debugf("reached peer %s at %s of its %d addresses", peerID, address, len(dialable))
+	}
+	return peerID, nil
+}
+
+// dialableAddress normalizes and resolves an address, and checks that we
+// may dial it
+func (n *Network) dialableAddress(ctx context.Context, address string) (string, error) {
+	address, err := discovery.NormalizeAddress(address, DefaultListenPort)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to peer: %w", err)
+	}
+	if address, err = n.resolveAddress(ctx, address); err != nil {
+		return "", fmt.Errorf("failed to connect to peer: %w: %w", ErrConnectionRefused, err)
+	}
+	// Hosts other transports know by name are checked once dialed
+	if isIPLiteral(address) {
+		if err := n.filter.check(address); err != nil {
+			n.monitor.Stats.IncrementDialsDenied()
+			return "", fmt.Errorf("failed to connect to peer %s: %w", address, err)
+		}
+	}
+	return address, nil
+}
+
+// resolveAddress replaces the hostname of a normalized address with one of
+// its IP addresses, so a node is dialed once however it is named, within
+// DefaultConnectTimeout. Transports other than TCP get hostnames as given.
+func (n *Network) resolveAddress(ctx context.Context, address string) (string, error) {
+	if n.transport != nil {
+		return address, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultConnectTimeout)
+	defer cancel()
+	return n.addressPolicy().ResolveAddress(ctx, address, DefaultListenPort, n.lookup)
+}
+
+// lookupIP resolves a hostname with the system resolver
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// dialPeer dials a normalized address and completes the handshake, within
+// DefaultConnectTimeout
+func (n *Network) dialPeer(ctx context.Context, address, expectedPeerID string) (string, error) {
 	n.logger.Infof("attempting to connect to peer: %s", address)
 
-	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, DefaultConnectTimeout)
+	defer cancel()
+
+	dialStarted := time.Now()
+	conn, err := n.streamTransport().Dial(ctx, address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("failed to connect to peer %s: %w", address, ctx.Err())
+		}
+		return "", fmt.Errorf("failed to connect to peer %s: %w: %w", address, ErrConnectionRefused, err)
+	}
+	if err := n.filter.check(conn.RemoteAddr().String()); err != nil {
+		conn.Close()
+		n.monitor.Stats.IncrementDialsDenied()
+		return "", fmt.Errorf("failed to connect to peer %s: %w", address, err)
+	}
+
+	// Closing the connection is the only way to interrupt a handshake
+	// waiting on the peer
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	connection, err := n.setupConnection(conn, false, expectedPeerID, dialStarted)
+	if !stop() {
+		if err == nil {
+			n.closeConnection(connection)
+		}
+		return "", fmt.Errorf("failed to connect to peer %s: %w", address, ctx.Err())
+	}
 	if err != nil {
-		return fmt.Errorf("failed to connect to peer %s: %w", address, err)
+		var duplicate *duplicatePeerError
+		if errors.As(err, &duplicate) {
+			return duplicate.peerID, fmt.Errorf("failed to connect to peer %s: %w", address, err)
+		}
+		return "", fmt.Errorf("failed to connect to peer %s: %w", address, err)
 	}
 
-	// Handle the connection (this will perform secure handshake)
-	go n.handleConnectionWithEncryption(conn, false) // outgoing connection
+	n.background(func() { n.serveConnection(connection) })
+	return connection.PeerID, nil
+}
 
-	return nil
+// ConnectBackground dials a peer without a context.
+//
+// Deprecated: use Connect, which can be cancelled and reports the peer reached.
+func (n *Network) ConnectBackground(address string) error {
+	_, err := n.Connect(context.Background(), address)
+	return err
 }
 
-// SendMessage sends a message to a specific peer
-func (n *Network) SendMessage(peerID string, msg Message) error {
+// SendMessage sends a message to a specific peer. It returns ctx's error if
+// ctx ends before the message is written; the write itself then still
+// completes or fails in the background, so the stream is never left with
+// half a frame.
+func (n *Network) SendMessage(ctx context.Context, peerID string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	traceMessage(ctx, &msg)
+
 	// Find the peer
-	n.peersMu.RLock()
-	peer, exists := n.peers[peerID]
-	n.peersMu.RUnlock()
+	peer, exists := n.peers.Get(peerID)
 
 	if !exists {
-		return fmt.Errorf("peer %s not found", peerID)
+		return fmt.Errorf("%w %s", ErrPeerNotFound, peerID)
 	}
 
 	conn := peer.GetConnection()
 	if conn == nil {
-		return fmt.Errorf("no active connection to peer %s", peerID)
+		return fmt.Errorf("%w %s", ErrPeerNotFound, peerID)
+	}
+
+	if err := checkCapability(peer, msg.Type); err != nil {
+		return err
+	}
+
+	if ctx.Done() == nil {
+		return n.send(conn, msg)
 	}
+	done := make(chan error, 1)
+	n.background(func() { done <- n.send(conn, msg) })
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	return n.sendMessageToConn(conn.Conn, msg)
+// SendMessageBackground sends a message to a specific peer without a context.
+//
+// Deprecated: use SendMessage, which can be cancelled.
+func (n *Network) SendMessageBackground(peerID string, msg Message) error {
+	return n.SendMessage(context.Background(), peerID, msg)
 }
 
-// sendMessageToConn sends a message to a specific connection
+// sendMessageToConn sends a message to a specific connection as JSON
 func (n *Network) sendMessageToConn(conn net.Conn, msg Message) error {
-	data, err := msg.Serialize()
+	return n.writeMessage(conn, CodecJSON, msg)
+}
+
+// writeMessage writes one framed message to a TCP connection or QUIC stream
+func (n *Network) writeMessage(conn frameWriter, codec Codec, msg Message) error {
+	frame, err := encodePooledFrame(frameCodec(codec, msg), msg)
 	if err != nil {
 		return fmt.Errorf("failed to serialize message: %w", err)
 	}
-
-	// Add newline for message framing
-	data = append(data, '\n')
+	defer releaseFrame(frame)
 
 	// Set write deadline
-	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	conn.SetWriteDeadline(time.Now().Add(n.writeTimeout))
 
-	_, err = conn.Write(data)
+	_, err = conn.Write(frame.Bytes())
 	if err != nil {
 		return fmt.Errorf("failed to write message to connection: %w", err)
 	}
 
 	// Update monitoring stats
-	n.monitor.Stats.AddBytesSent(uint64(len(data)))
+	n.monitor.Stats.AddBytesSent(uint64(frame.Len()))
 	n.monitor.Stats.IncrementMessagesSent()
 
 	return nil
 }
 
-// Broadcast sends a message to all connected peers
-func (n *Network) Broadcast(msg Message) error {
-	peers := n.pool.GetPeers()
-	var lastErr error
+// NodeID returns the ID this network identifies itself with
+func (n *Network) NodeID() string {
+	return n.nodeID
+}
 
-	for _, peer := range peers {
-		conn := peer.GetConnection()
-		if conn == nil {
-			continue
-		}
+// ListenAddr returns the address of the first listener, or nil while the
+// network is not started. ListenAddrs returns all of them.
+func (n *Network) ListenAddr() net.Addr {
+	if len(n.listeners) == 0 {
+		return nil
+	}
+	return n.listeners[0].listener.Addr()
+}
 
-		if err := n.sendMessageToConn(conn.Conn, msg); err != nil {
-			lastErr = err
-			n.logger.Errorf("failed to broadcast message to peer %s: %v", peer.ID, err)
-		}
+// Peers returns a snapshot of each known peer, connected or not
+func (n *Network) Peers() []PeerSnapshot {
+	return n.snapshotPeers(n.peers.All())
+}
+
+// KnownPeers is Peers under the name that sets it apart from ConnectedPeers
+func (n *Network) KnownPeers() []PeerSnapshot {
+	return n.Peers()
+}
+
+// ConnectedPeers returns a snapshot of each peer we have a connection to
+func (n *Network) ConnectedPeers() []PeerSnapshot {
+	return n.snapshotPeers(n.peers.Connected())
+}
+
+// snapshotPeers snapshots each of peers
+func (n *Network) snapshotPeers(peers []*Peer) []PeerSnapshot {
+	snapshots := make([]PeerSnapshot, 0, len(peers))
+	for _, peer := range peers {
+		snapshots = append(snapshots, n.snapshotPeer(peer))
 	}
+	return snapshots
+}
 
-	return lastErr
+// Peer returns a snapshot of a known peer
+func (n *Network) Peer(peerID string) (PeerSnapshot, bool) {
+	peer, exists := n.peers.Get(peerID)
+	if !exists {
+		return PeerSnapshot{}, false
+	}
+	return n.snapshotPeer(peer), true
 }
 
-// Peers returns a list of connected peers
-func (n *Network) Peers() []*Peer {
-	return n.pool.GetPeers()
+// snapshotPeer copies a peer's state along with its reputation
+func (n *Network) snapshotPeer(peer *Peer) PeerSnapshot {
+	snapshot := peer.snapshot()
+	snapshot.Reputation = n.PeerReputation(peer.ID)
+	snapshot.Flaps = n.flaps.State(peer.ID)
+	return snapshot
 }
 
 // Status returns the current network status
 func (n *Network) Status() NetworkStatus {
-	n.peersMu.RLock()
-	defer n.peersMu.RUnlock()
-
-	connectedPeers := make([]string, 0, len(n.peers))
-	for id := range n.peers {
-		connectedPeers = append(connectedPeers, id)
+	status := NetworkStatus{
+		TotalPeers:     n.peers.Count(),
+		ConnectedPeers: n.peers.ConnectedCount(),
+		Listening:      len(n.listeners) > 0,
+		OutboundOnly:   n.running && !n.config.P2P.ListenEnabled,
+		NodeID:         n.nodeID,
+		StaticPeers:    n.staticPeerStatus(),
+		Listeners:      n.listenerStatus(),
 	}
-
-	return NetworkStatus{
-		ActiveConnections: n.pool.ConnectionCount(),
-		TotalPeers:       n.pool.PeerCount(),
-		Listening:        n.listener != nil,
-		NodeID:          n.nodeID,
-		Uptime:          time.Since(n.started).Seconds(),
+	for _, connection := range n.pool.GetConnections() {
+		if connection.active() {
+			status.ActiveConnections++
+		}
+	}
+	if n.running {
+		status.Uptime = time.Since(n.started)
 	}
+	if len(n.listeners) > 0 {
+		status.ListenPort = n.listeners[0].port()
+	}
+	return status
 }
 
-// Stop shuts down the P2P network
+// Stop shuts down the P2P network, closing every connection. The network
+// can be started again afterwards: message handlers, advertised
+// capabilities, peer labels, static and persistent peers, event subscribers
+// and the reputation and topology history are kept, while connected peers
+// have to reconnect.
 func (n *Network) Stop() error {
-	var err error
-	n.shutdownOnce.Do(func() {
-		n.logger.Info("stopping P2P network")
-		
-		if n.cancel != nil {
-			n.cancel()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.running {
+		return fmt.Errorf("network not started")
+	}
+
+	n.logger.Info("stopping P2P network")
+
+	n.cancel()
+	n.reputation.Stop()
+
+	// A listener that failed while running is already closed
+	err := closeListeners(n.listeners)
+
+	n.closeQUIC()
+
+	// Close all connections
+	connections := n.pool.GetConnections()
+	for _, conn := range connections {
+		if session := conn.QUIC(); session != nil {
+			session.close("node shutting down")
 		}
+		conn.closeWith("network stopped")
+	}
 
-		if n.listener != nil {
-			if closeErr := n.listener.Close(); closeErr != nil {
-				err = fmt.Errorf("failed to close listener: %w", closeErr)
-			}
-		} else {
-			err = fmt.Errorf("network not started")
+	if n.mdnsDiscoverer != nil {
+		n.mdnsDiscoverer.Stop()
+	}
+	n.monitor.Stop()
+
+	if !n.waitForWorkers(DefaultShutdownTimeout) {
+		n.logger.Warnf("background goroutines still running %v after shutdown", DefaultShutdownTimeout)
+		if err == nil {
+			err = fmt.Errorf("timed out after %v waiting for background goroutines", DefaultShutdownTimeout)
 		}
+	}
+
+	// Clear peers
+	n.peers.Reset()
 
-		// Close all connections
-		connections := n.pool.GetConnections()
-		for _, conn := range connections {
-			conn.Conn.Close()
+	if n.audit != nil {
+		if closeErr := n.audit.Close(); closeErr != nil {
+			n.logger.Errorf("failed to close audit log: %v", closeErr)
 		}
+	}
 
-		// Clear peers
-		n.peersMu.Lock()
-		n.peers = make(map[string]*Peer)
-		n.peersMu.Unlock()
+	if saveErr := n.peerStore.Save(); saveErr != nil {
+		n.logger.Errorf("failed to save peer store: %v", saveErr)
+	}
+	if saveErr := n.keys.Save(); saveErr != nil {
+		n.logger.Errorf("failed to save key store: %v", saveErr)
+	}
+	if saveErr := n.peerRecords.Save(); saveErr != nil {
+		n.logger.Errorf("failed to save peer records: %v", saveErr)
+	}
+	n.closeState()
 
-		n.logger.Info("P2P network stopped")
-	})
+	n.listeners = nil
+	n.running = false
+	n.quicTransport = nil
+	n.quicListener = nil
+	n.mdnsDiscoverer = nil
 
+	n.logger.Info("P2P network stopped")
 	return err
 }
 
 // processMessages processes messages from the message channel
 func (n *Network) processMessages() {
 	for {
-		select {
-		case <-n.ctx.Done():
+		msg, ok := n.queue.Pop(n.ctx)
+		if !ok {
 			n.logger.Info("stopping message processor")
 			return
-		case msg := <-n.messageChan:
-			n.logger.Debugf("processing message %s of type %s from %s", msg.ID, msg.Type, msg.Sender)
-			// In a real implementation, we would route messages to appropriate handlers
-			// based on the message type and content
 		}
+		n.messageLogger(&msg).Debugf("processing message %s of type %s from %s", msg.ID, msg.Type, msg.Sender)
+		n.dispatchMessage(msg)
+	}
+}
+
+// RegisterHandler registers a handler for application messages of the given
+// type. Under ordered delivery it sees each peer's messages in the order the
+// peer sent them, unless registered Unordered.
+func (n *Network) RegisterHandler(msgType string, handler MessageHandler, opts ...HandlerOption) {
+	registered := registeredHandler{handle: handler}
+	for _, opt := range opts {
+		opt(&registered)
+	}
+
+	n.handlersMu.Lock()
+	defer n.handlersMu.Unlock()
+	n.handlers[msgType] = append(n.handlers[msgType], registered)
+}
+
+// dispatchMessage delivers a message to the handlers registered for its
+// type, unless it expired waiting in the queue, skipping the handlers it is
+// too old for
+func (n *Network) dispatchMessage(msg Message) {
+	n.handlersMu.RLock()
+	handlers := n.handlers[msg.Type]
+	n.handlersMu.RUnlock()
+
+	if len(handlers) == 0 {
+		n.messageLogger(&msg).Debugf("no handler registered for message type %s", msg.Type)
+		return
+	}
+
+	age := n.messageAge(msg, time.Now())
+	if msg.TTLMs > 0 && age > msg.TTL() {
+		n.dropExpired(msg, age)
+		return
+	}
+
+	delivery := msg.delivery
+	msg.delivery = deliverAll
+	called, stale := 0, 0
+	for _, handler := range handlers {
+		if !handler.wants(delivery) {
+			continue
+		}
+		if handler.maxAge > 0 && age > handler.maxAge {
+			stale++
+			continue
+		}
+		called++
+		n.invokeHandler(handler.handle, msg)
+	}
+	if called == 0 && stale > 0 {
+		n.dropExpired(msg, age)
+	}
+}
+
+// invokeHandler runs a handler on a message. A handler that panics is
+// logged with its stack and the connection the message came on is closed,
+// but the node and the other handlers carry on.
+func (n *Network) invokeHandler(handler MessageHandler, msg Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			n.monitor.Stats.IncrementHandlerPanics()
+			n.messageLogger(&msg).Errorf("panic in handler for %s message %s from %s: %v\n%s", msg.Type, msg.ID, msg.Sender, r, debug.Stack())
+			if connection := n.liveConnection(msg.Sender); connection != nil {
+				connection.closeFor(&msg, fmt.Sprintf("handler for %s panicked: %v", msg.Type, r))
+			}
+		}
+	}()
+	handler(msg)
+}
+
+// startMDNS advertises us over mDNS under a name unique to our node ID
+func (n *Network) startMDNS() error {
+	port := n.mdnsPort()
+	if port == 0 {
+		n.logger.Info("no listener is advertised over mDNS, not taking part in local discovery")
+		return nil
+	}
+	instance := discovery.InstanceName(n.nodeName, n.nodeID)
+	mdns := discovery.NewMDNSDiscoverer(instance, port, discovery.TXTRecords(discovery.Peer{
+		ID:           n.nodeID,
+		Port:         port,
+		Version:      n.protocolVersion,
+		MinVersion:   n.minProtocolVersion,
+		Capabilities: n.localCapabilities(),
+		NetworkID:    n.networkID,
+	}))
+	mdns.SetService(n.mdnsService())
+	mdns.SetAddressPolicy(n.addressPolicy())
+	if err := mdns.Start(n.ctx); err != nil {
+		return fmt.Errorf("failed to start mDNS discovery: %w", err)
 	}
+	n.mdnsDiscoverer = mdns
+	return nil
 }
 
 // heartbeatService sends periodic heartbeat messages to maintain connections
 func (n *Network) heartbeatService() {
-	ticker := time.NewTicker(DefaultHeartbeatInterval)
+	ticker := time.NewTicker(n.heartbeatInterval)
 	defer ticker.Stop()
 
 	for {
@@ -566,242 +1432,237 @@ func (n *Network) heartbeatService() {
 			n.logger.Info("stopping heartbeat service")
 			return
 		case <-ticker.C:
-			heartbeatMsg := NewMessage(MessageTypeHeartbeat, n.nodeID, HeartbeatPayload{
-				NodeID: n.nodeID,
-				TS:     time.Now().Unix(),
-			})
+			heartbeatMsg := NewMessage(MessageTypeHeartbeat, n.nodeID, n.heartbeatPayload())
 			
-			if err := n.Broadcast(heartbeatMsg); err != nil {
+			if _, err := n.Broadcast(n.ctx, heartbeatMsg); err != nil {
 				n.logger.Errorf("failed to broadcast heartbeat: %v", err)
 			}
 		}
 	}
 }
 
-// sendPeerList sends the current list of known peers to a connection
-func (n *Network) sendPeerList(conn net.Conn) error {
-	peers := n.Peers()
-	
-	peerInfos := make([]PeerInfo, 0, len(peers))
-	for _, peer := range peers {
-		peerInfos = append(peerInfos, PeerInfo{
-			ID:       peer.ID,
-			Address:  peer.Address,
-			Version:  peer.Version,
-			LastSeen: peer.LastSeen.Unix(),
-		})
-	}
-
-	peerListPayload := PeerListPayload{
-		Peers: peerInfos,
+// heartbeatPayload describes us and how busy we are
+func (n *Network) heartbeatPayload() HeartbeatPayload {
+	return HeartbeatPayload{
+		NodeID:      n.nodeID,
+		TS:          time.Now().Unix(),
+		Connections: n.pool.ConnectionCount(),
+		QueueDepth:  n.queue.Len(),
+		Full:        n.peers.ConnectedCount() >= n.config.P2P.MaxPeers,
+		Overloaded:  n.queue.Overloaded(),
+		Alive:       n.livenessDigest(),
+		Topics:      n.topics.Topics(),
 	}
-
-	peerListMsg := NewMessage(MessageTypePeerList, n.nodeID, peerListPayload)
-	
-	return n.sendMessageToConn(conn, peerListMsg)
 }
 
-// performSecureHandshake performs the secure handshake with encryption
-func (n *Network) performSecureHandshake(conn net.Conn, incoming bool, connection *Connection) error {
-	if incoming {
-		// For incoming connections, receive their handshake message
-		handshakeMsg, err := n.receiveHandshakeMessage(conn)
-		if err != nil {
-			return fmt.Errorf("failed to receive handshake: %w", err)
-		}
-
-		// Verify the handshake message
-		if err := n.handshakeMgr.VerifyHandshakeMessage(handshakeMsg); err != nil {
-			return fmt.Errorf("handshake verification failed: %w", err)
-		}
+// recordPeerLoad keeps the load hints of a peer's heartbeat for topology
+// decisions and monitoring
+func (n *Network) recordPeerLoad(peerID string, heartbeat HeartbeatPayload) {
+	n.topologyMgr.UpdatePeerLoad(peerID, heartbeat.Connections)
+	n.topologyMgr.SetPeerOverloaded(peerID, heartbeat.Overloaded)
+	n.monitor.Quality.UpdatePeerLoad(peerID, monitor.PeerLoad{
+		Connections: heartbeat.Connections,
+		QueueDepth:  heartbeat.QueueDepth,
+		Full:        heartbeat.Full,
+		Overloaded:  heartbeat.Overloaded,
+		ReportedAt:  time.Now(),
+	})
+}
 
-		// Register the peer
-		n.registerPeer(handshakeMsg.NodeID, connection)
+// setProtocolVersions sets the version range advertised in handshakes and HELLO
+func (n *Network) setProtocolVersions(version, minVersion string) {
+	n.protocolVersion = version
+	n.minProtocolVersion = minVersion
+	n.handshakeMgr.SetProtocolVersions(version, minVersion)
+}
 
-		// Send our handshake message in response
-		responseMsg, err := n.handshakeMgr.CreateHandshakeMessage()
-		if err != nil {
-			return fmt.Errorf("failed to create response handshake: %w", err)
-		}
+// preferredDialer reports whether a connection to peerID that we dialed
+// (outbound) or that it dialed is the one to keep when both exist
+func (n *Network) preferredDialer(peerID string, outbound bool) bool {
+	if outbound {
+		return n.nodeID < peerID
+	}
+	return peerID < n.nodeID
+}
 
-		if err := n.sendHandshakeMessage(conn, responseMsg); err != nil {
-			return fmt.Errorf("failed to send response handshake: %w", err)
-		}
-	} else {
-		// For outgoing connections, send our handshake message first
-		handshakeMsg, err := n.handshakeMgr.CreateHandshakeMessage()
-		if err != nil {
-			return fmt.Errorf("failed to create handshake: %w", err)
-		}
+// superseded reports whether the peer on a connection has since been
+// registered on another one
+func (n *Network) superseded(connection *Connection) bool {
+	peer, exists := n.peers.Get(connection.PeerID)
+	if !exists {
+		return false
+	}
+	current := peer.GetConnection()
+	return current != nil && current != connection
+}
 
-		if err := n.sendHandshakeMessage(conn, handshakeMsg); err != nil {
-			return fmt.Errorf("failed to send handshake: %w", err)
+// registerPeer registers a peer in our network. It refuses a peer that is
+// still connected over another connection, unless both peers dialed each
+// other at once: then both keep the connection dialed by the lower node ID.
+func (n *Network) registerPeer(peerID string, connection *Connection, version string) error {
+	peer := NewPeer(peerID, connection.Address, version)
+	peer.SetConnection(connection)
+	// The address we dialed is one the peer listens on; a peer that dialed
+	// us tells us its listen port in its HELLO
+	if connection.Outbound {
+		peer.SetListenAddress(connection.Address)
+	}
+	
+	var superseded *Connection
+	err := n.peers.Add(peer, func(existing *Peer) error {
+		if existing != nil {
+			if current := existing.GetConnection(); current != nil && current != connection {
+				if _, live := n.pool.GetConnection(current.ID); live {
+					if current.Outbound == connection.Outbound || n.preferredDialer(peerID, current.Outbound) {
+						return &duplicatePeerError{peerID: peerID}
+					}
+					superseded = current
+				}
+			}
 		}
-
-		// Receive their response
-		responseMsg, err := n.receiveHandshakeMessage(conn)
-		if err != nil {
-			return fmt.Errorf("failed to receive response handshake: %w", err)
+		if err := n.pool.AddConnection(connection); err != nil {
+			return fmt.Errorf("failed to add connection to pool: %w", err)
 		}
+		connection.PeerID = peerID
+		connection.markEstablished()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		// Verify the response
-		if err := n.handshakeMgr.VerifyHandshakeMessage(responseMsg); err != nil {
-			return fmt.Errorf("response handshake verification failed: %w", err)
+	// The side that dialed the connection we drop closes it, so the other
+	// side's handshake on it is not cut short
+	if superseded != nil {
+		n.logger.Debugf("replacing connection %s to %s with %s dialed at the same time", superseded.ID, peerID, connection.ID)
+		if superseded.Outbound {
+			superseded.closeWith("replaced by a simultaneous connection")
 		}
+	}
 
-		// Register the peer
-		n.registerPeer(responseMsg.NodeID, connection)
+	// Only outgoing connections are to an address the peer listens on
+	if connection.Outbound {
+		n.peerStore.Record(peerID, connection.Address)
+	} else {
+		n.peerStore.Touch(peerID)
 	}
+	
+	n.applyLocalMetadata(peer)
+	if n.isStaticPeer(peerID) {
+		n.topologyMgr.SetPeerPersistent(peerID, true)
+	}
+	
+	n.flaps.Connected(peerID)
+	n.logger.Infof("registered new peer: %s at %s", peerID, connection.Address)
 
+	n.rebalancePeers()
 	return nil
 }
 
-// sendHandshakeMessage sends an encrypted handshake message
-func (n *Network) sendHandshakeMessage(conn net.Conn, msg *crypto.HandshakeMessage) error {
-	// For now, send unencrypted for testing. In real implementation, we'd need their public key
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal handshake message: %w", err)
+// processFrame decodes, validates and handles one message frame in codec
+// received on any of a connection's transports
+func (n *Network) processFrame(codec Codec, data []byte, connection *Connection) {
+	// Update last seen time
+	connection.UpdateLastSeen()
+	if connection.PeerID != "" {
+		n.topologyMgr.MarkPeerActive(connection.PeerID)
 	}
+	n.monitor.Stats.AddBytesReceived(uint64(len(data)))
 
-	// Add newline for message framing
-	data = append(data, '\n')
-
-	// Set write deadline
-	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if !n.allowFrame(codec, data, connection) {
+		return
+	}
 
-	_, err = conn.Write(data)
+	// Deserialize the message
+	msg, err := DeserializeMessageWith(codec, data)
 	if err != nil {
-		return fmt.Errorf("failed to write handshake message: %w", err)
+		n.monitor.Stats.IncrementDecodeFailures()
+		n.logger.Errorf("failed to deserialize message from %s: %v", connection.Address, err)
+		n.rejectMessage(connection, messageID(codec, data), ErrorCodeInvalidMessage, "message could not be decoded", topology.EventDeserializeFailure)
+		return
 	}
-
-	return nil
+	// Counted per frame, as sent messages are
+	n.monitor.Stats.IncrementMessagesReceived()
+	n.processDecoded(msg, connection)
 }
 
-// receiveHandshakeMessage receives and parses a handshake message
-func (n *Network) receiveHandshakeMessage(conn net.Conn) (*crypto.HandshakeMessage, error) {
-	reader := bufio.NewReader(conn)
-	data, err := reader.ReadBytes('\n')
+// processDecoded validates and handles a message received in one frame or
+// reassembled from fragments
+func (n *Network) processDecoded(msg *Message, connection *Connection) {
+	defer n.settleSequence(msg, connection)
+
+	// Validate the message
+	err := msg.Validate()
+	if err == nil {
+		err = msg.ValidatePayload()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read handshake message: %w", err)
+		n.monitor.Stats.IncrementMessagesInvalid()
+		n.messageLogger(msg).Errorf("invalid message from %s: %v", connection.Address, err)
+		if msg.Type == MessageTypeError {
+			// Never answer an ERROR with an ERROR
+			n.reputation.RecordEvent(connection.PeerID, topology.EventInvalidMessage)
+		} else {
+			n.rejectMessage(connection, msg.ID, ErrorCodeInvalidMessage, err.Error(), topology.EventInvalidMessage)
+		}
+		return
 	}
 
-	// Remove newline
-	if len(data) > 0 && data[len(data)-1] == '\n' {
-		data = data[:len(data)-1]
+	if !n.checkClockSkew(msg, connection) {
+		return
 	}
 
-	var msg crypto.HandshakeMessage
-	if err := json.Unmarshal(data, &msg); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal handshake message: %w", err)
+	// Retransmits and gossip echoes carry an ID we already processed
+	if !n.received.Add(msg.ID) {
+		n.handleDuplicate(msg, connection)
+		return
 	}
 
-	return &msg, nil
-}
-
-// registerPeer registers a peer in our network
-func (n *Network) registerPeer(peerID string, connection *Connection) {
-	peer := NewPeer(peerID, connection.Address, "1.0.0")
-	peer.SetConnection(connection)
-	
-	n.peersMu.Lock()
-	n.peers[peerID] = peer
-	n.peersMu.Unlock()
-	
-	n.pool.AddPeer(peer)
-	
-	// Create topology peer from our peer
-	topologyPeer := topology.Peer{
-		ID:       peer.ID,
-		Address:  peer.Address,
-		Version:  peer.Version,
-		LastSeen: peer.LastSeen,
-	}
-	n.topologyMgr.AddPeer(topologyPeer)
-	
-	n.logger.Infof("registered new peer: %s at %s", peerID, connection.Address)
+	// Process the message based on type
+	if err := n.processMessage(msg, connection); err != nil {
+		n.messageLogger(msg).Errorf("error processing message from %s: %v", connection.Address, err)
+	}
 }
 
-// handleConnectionWithEncryption processes a TCP connection with encryption (incoming or outgoing)
-func (n *Network) handleConnectionWithEncryption(conn net.Conn, incoming bool) {
-	connID := fmt.Sprintf("conn_%s_%d", conn.RemoteAddr().String(), time.Now().UnixNano())
-	
-	connection := &Connection{
-		ID:        connID,
-		Address:   conn.RemoteAddr().String(),
-		Conn:      conn,
-		CreatedAt: time.Now(),
-		LastSeen:  time.Now(),
+// handleDuplicate counts and drops a message whose ID was already received.
+// A duplicate that wants an ack is acked again, as the sender may have
+// retransmitted because our first ack was lost.
+func (n *Network) handleDuplicate(msg *Message, connection *Connection) {
+	n.monitor.Stats.IncrementDuplicateMessages()
+	if msg.IsGossip() {
+		atomic.AddUint64(&n.gossipDuplicates, 1)
 	}
+	n.messageLogger(msg).Debugf("dropped duplicate message %s from %s", msg.ID, msg.Sender)
 
-	n.logger.Infof("handling connection %s (incoming: %t) from %s", connID, incoming, conn.RemoteAddr())
-
-	// Add to connection pool
-	if err := n.pool.AddConnection(connection); err != nil {
-		n.logger.Errorf("failed to add connection to pool: %v", err)
-		conn.Close()
-		return
+	if msg.RequireAck {
+		n.acknowledge(msg, connection)
 	}
+}
 
-	defer func() {
-		n.pool.RemoveConnection(connID)
-		conn.Close()
-	}()
-
-	// Perform handshake with encryption
-	if err := n.performSecureHandshake(conn, incoming, connection); err != nil {
-		n.logger.Errorf("secure handshake failed for connection %s: %v", connID, err)
-		return
+// connectBootstrapNode dials a bootstrap node for the bootstrap manager. A
+// node we are already connected to counts as reached.
+func (n *Network) connectBootstrapNode(ctx context.Context, address string) (string, error) {
+	peerID, err := n.connect(ctx, address, "", false)
+	if errors.Is(err, ErrDuplicatePeer) {
+		return peerID, nil
 	}
+	return peerID, err
+}
 
-	// Start reading messages from the connection
-	if err := n.readMessages(conn, connection); err != nil {
-		n.logger.Errorf("error reading messages from connection %s: %v", connID, err)
+// connectToBootstrapNodes dials the configured bootstrap peers
+func (n *Network) connectToBootstrapNodes() {
+	if err := n.bootstrapMgr.ConnectToBootstrapNodes(n.ctx, n.connectBootstrapNode); err != nil {
+		n.logger.Warnf("bootstrap connection incomplete: %v", err)
 	}
 }
 
-// readMessages reads and processes messages from a connection
-func (n *Network) readMessages(conn net.Conn, connection *Connection) error {
-	reader := bufio.NewReader(conn)
-	for {
-		select {
-		case <-n.ctx.Done():
-			n.logger.Info("network context cancelled, closing connection")
-			return nil
-		default:
-			// Set read deadline to detect dead connections
-			conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-			
-			data, err := reader.ReadBytes('\n')
-			if err != nil {
-				if !strings.Contains(err.Error(), "use of closed network connection") {
-					n.logger.Errorf("error reading from connection: %v", err)
-				}
-				return err
-			}
-
-			// Update last seen time
-			connection.UpdateLastSeen()
-			n.monitor.Stats.AddBytesReceived(uint64(len(data)))
-
-			// Deserialize the message
-			msg, err := DeserializeMessage(data)
-			if err != nil {
-				n.logger.Errorf("failed to deserialize message from %s: %v", conn.RemoteAddr(), err)
-				continue
-			}
-
-			// Validate the message
-			if err := msg.Validate(); err != nil {
-				n.logger.Errorf("invalid message from %s: %v", conn.RemoteAddr(), err)
-				continue
-			}
+// ServiceMetrics returns the monitor's metrics for a named external service,
+// which then appear under "services" in the network report
+func (n *Network) ServiceMetrics(name string) *monitor.ServiceMetrics {
+	return n.monitor.Service(name)
+}
 
-			// Process the message based on type
-			if err := n.processMessage(msg, connection); err != nil {
-				n.logger.Errorf("error processing message from %s: %v", conn.RemoteAddr(), err)
-				continue
-			}
-		}
-	}
-}
\ No newline at end of file
+// ExportTopology renders the known mesh as Graphviz DOT or a JSON adjacency structure
+func (n *Network) ExportTopology(format string) ([]byte, error) {
+	return n.topologyMgr.ExportGraph(format)
+}
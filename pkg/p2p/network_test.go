@@ -2,9 +2,16 @@ package p2p
 
 import (
 	"context"
+	"encoding/json"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/princetheprogrammer/synapse/internal/config"
 	"github.com/princetheprogrammer/synapse/internal/logger"
 	"github.com/stretchr/testify/assert"
@@ -13,6 +20,7 @@ import (
 
 func createTestNetwork(t *testing.T) (*Network, context.Context, context.CancelFunc) {
 	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
 	log, err := logger.New("debug", "json", "")
 	require.NoError(t, err)
 
@@ -95,7 +103,7 @@ func TestNetworkStartStop(t *testing.T) {
 	status := network.Status()
 	assert.True(t, status.Listening)
 	assert.Equal(t, "test-node-id", status.NodeID)
-	assert.Greater(t, status.Uptime, float64(0))
+	assert.Greater(t, status.Uptime, time.Duration(0))
 
 	err = network.Stop()
 	assert.NoError(t, err)
@@ -125,6 +133,109 @@ func TestNetworkStopWithoutStart(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestStopWaitsForGoroutines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 3; i++ {
+		a, b := connectPair(t, ctx, "node-a", "node-b")
+		require.NoError(t, a.SendMessage(ctx, "node-b", NewMessage("NOTE", a.nodeID, nil)))
+		_, err := a.Broadcast(ctx, NewMessage("NOTE", a.nodeID, nil))
+		require.NoError(t, err)
+
+		// An idle socket stuck in the handshake is cut off too
+		idle, err := dialLocal(b)
+		require.NoError(t, err)
+		defer idle.Close()
+
+		start := time.Now()
+		require.NoError(t, a.Stop())
+		require.NoError(t, b.Stop())
+		assert.Less(t, time.Since(start), DefaultShutdownTimeout)
+	}
+
+	// Only goroutines outside the networks' control may linger briefly
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= baseline+2
+	}, 5*time.Second, 50*time.Millisecond, "goroutines before: %d, after: %d", baseline, runtime.NumGoroutine())
+}
+
+func TestNetworkRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	baseline := runtime.NumGoroutine()
+
+	b := startLocalNetwork(t, ctx, "node-b")
+	a := startLocalNetwork(t, ctx, "node-a")
+	delivered := make(chan Message, 1)
+	a.RegisterHandler("NOTE", func(msg Message) { delivered <- msg })
+
+	_, port, err := net.SplitHostPort(localAddr(a))
+	require.NoError(t, err)
+	a.config.P2P.ListenPort, err = strconv.Atoi(port)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := b.Connect(ctx, localAddr(a))
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return a.liveConnection("node-b") != nil && b.liveConnection("node-a") != nil
+		}, 5*time.Second, 20*time.Millisecond)
+
+		// Handlers survive the restart
+		require.NoError(t, b.SendMessage(ctx, "node-a", NewMessage("NOTE", b.nodeID, nil)))
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not delivered")
+		}
+
+		require.NoError(t, a.Stop())
+		assert.Nil(t, a.ListenAddr())
+		assert.Empty(t, a.Peers())
+		assert.Error(t, a.Stop())
+
+		// The listener is rebound on the same port
+		require.NoError(t, a.Start(ctx))
+		_, rebound, err := net.SplitHostPort(localAddr(a))
+		require.NoError(t, err)
+		assert.Equal(t, port, rebound)
+		require.Eventually(t, func() bool {
+			return b.liveConnection("node-a") == nil
+		}, 5*time.Second, 20*time.Millisecond)
+	}
+
+	require.NoError(t, a.Stop())
+	require.NoError(t, b.Stop())
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= baseline+2
+	}, 5*time.Second, 50*time.Millisecond, "goroutines before: %d, after: %d", baseline, runtime.NumGoroutine())
+}
+
+func TestListenerFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetwork(t, ctx, "node-a")
+	require.NoError(t, network.listeners[0].listener.Close())
+
+	select {
+	case err := <-network.Errors():
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener failure not reported")
+	}
+
+	// A restart recovers
+	require.NoError(t, network.Stop())
+	require.NoError(t, network.Start(ctx))
+	peer := startLocalNetwork(t, ctx, "node-b")
+	_, err := peer.Connect(ctx, localAddr(network))
+	require.NoError(t, err)
+	assert.Empty(t, network.Errors())
+}
+
 func TestNetworkStatus(t *testing.T) {
 	network, ctx, cancel := createTestNetwork(t)
 	defer cancel()
@@ -132,6 +243,7 @@ func TestNetworkStatus(t *testing.T) {
 	// Initially not listening
 	status := network.Status()
 	assert.False(t, status.Listening)
+	assert.Zero(t, status.Uptime)
 
 	err := network.Start(ctx)
 	require.NoError(t, err)
@@ -141,9 +253,12 @@ func TestNetworkStatus(t *testing.T) {
 	status = network.Status()
 	assert.True(t, status.Listening)
 	assert.Equal(t, "test-node-id", status.NodeID)
+	assert.GreaterOrEqual(t, status.Uptime, 100*time.Millisecond)
+	assert.Greater(t, network.Status().Uptime, status.Uptime)
 
 	err = network.Stop()
 	assert.NoError(t, err)
+	assert.Zero(t, network.Status().Uptime, "a stopped network has no uptime")
 }
 
 func TestMessageSerialization(t *testing.T) {
@@ -202,6 +317,15 @@ func TestMessageValidation(t *testing.T) {
 			},
 			expectValid: false,
 		},
+		{
+			name: "oversized ID",
+			message: Message{
+				Type:   "TEST",
+				ID:     strings.Repeat("x", MaxMessageIDLength+1),
+				Sender: "sender-id",
+			},
+			expectValid: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -224,36 +348,190 @@ func TestNewMessage(t *testing.T) {
 	assert.NotEmpty(t, msg.ID)
 	assert.Equal(t, map[string]interface{}{"data": "value"}, msg.Payload)
 	assert.WithinDuration(t, time.Now(), msg.Timestamp, 1*time.Second)
+
+	_, err := uuid.Parse(msg.ID)
+	assert.NoError(t, err)
+	assert.NotContains(t, msg.ID, "TEST_TYPE")
+}
+
+func TestDeserializeTypedPayload(t *testing.T) {
+	hello := NewMessage(MessageTypeHello, "sender-id", HelloPayload{NodeID: "sender-id", Version: ProtocolVersion, ListenPort: 9000})
+	data, err := hello.Serialize()
+	require.NoError(t, err)
+
+	msg, err := DeserializeMessage(data)
+	require.NoError(t, err)
+	payload, ok := msg.Payload.(*HelloPayload)
+	require.True(t, ok, "payload is %T", msg.Payload)
+	assert.Equal(t, 9000, payload.ListenPort)
+	assert.NoError(t, msg.ValidatePayload())
+
+	// Unregistered types keep the raw bytes for their handlers
+	custom := NewMessage("CUSTOM", "sender-id", map[string]int{"count": 3})
+	data, err = custom.Serialize()
+	require.NoError(t, err)
+	msg, err = DeserializeMessage(data)
+	require.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`{"count":3}`), msg.Payload)
+
+	// A registered payload that does not decode is kept raw and fails validation
+	msg, err = DeserializeMessage([]byte(`{"type":"HELLO","id":"x","sender":"s","payload":"not a hello"}`))
+	require.NoError(t, err)
+	assert.IsType(t, json.RawMessage{}, msg.Payload)
+	assert.Error(t, msg.ValidatePayload())
+
+	msg, err = DeserializeMessage([]byte(`{"type":"HELLO","id":"x","sender":"s","payload":null}`))
+	require.NoError(t, err)
+	assert.Nil(t, msg.Payload)
+	assert.Error(t, msg.ValidatePayload())
+}
+
+func TestRegisterPayloadType(t *testing.T) {
+	type pricePayload struct {
+		Symbol string  `json:"symbol"`
+		Price  float64 `json:"price"`
+	}
+	RegisterPayloadType("PRICE_TICK", func() interface{} { return &pricePayload{} })
+
+	tick := NewMessage("PRICE_TICK", "sender-id", pricePayload{Symbol: "SYN", Price: 1.5})
+	data, err := tick.Serialize()
+	require.NoError(t, err)
+	msg, err := DeserializeMessage(data)
+	require.NoError(t, err)
+	assert.Equal(t, &pricePayload{Symbol: "SYN", Price: 1.5}, msg.Payload)
+}
+
+func TestDecodePayload(t *testing.T) {
+	want := GoodbyePayload{Reason: "shutdown"}
+	sources := map[string]interface{}{
+		"value":   want,
+		"pointer": &want,
+		"raw":     json.RawMessage(`{"reason":"shutdown"}`),
+		"generic": map[string]interface{}{"reason": "shutdown"},
+	}
+
+	for name, payload := range sources {
+		t.Run(name, func(t *testing.T) {
+			msg := NewMessage(MessageTypeGoodbye, "sender-id", payload)
+			var got GoodbyePayload
+			require.NoError(t, msg.DecodePayload(&got))
+			assert.Equal(t, want, got)
+		})
+	}
+
+	msg := NewMessage(MessageTypeGoodbye, "sender-id", json.RawMessage(`[1, 2]`))
+	var got GoodbyePayload
+	assert.Error(t, msg.DecodePayload(&got))
+}
+
+// BenchmarkDecodeHelloPayload compares decoding a received HELLO through the
+// payload registry with the old approach of decoding into a generic payload
+// and re-encoding it into the typed struct
+func BenchmarkDecodeHelloPayload(b *testing.B) {
+	hello := NewMessage(MessageTypeHello, "sender-id", HelloPayload{
+		NodeID:       "sender-id",
+		Version:      ProtocolVersion,
+		ListenPort:   9000,
+		Capabilities: []string{CapabilityEncryption, CapabilityRelay, CapabilitySync},
+	})
+	data, err := hello.Serialize()
+	require.NoError(b, err)
+
+	b.Run("registry", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			msg, err := DeserializeMessage(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var payload HelloPayload
+			if err := msg.DecodePayload(&payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("double-marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				b.Fatal(err)
+			}
+			payloadBytes, err := json.Marshal(msg.Payload)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var payload HelloPayload
+			if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestMessageIDsDoNotCollide(t *testing.T) {
+	// IDs used to be type plus UnixNano, which collided for messages of the
+	// same type created within one clock tick
+	workers := runtime.GOMAXPROCS(0)
+	perWorker := 2_000_000 / workers
+	if testing.Short() {
+		perWorker = 100_000 / workers
+	}
+
+	results := make([][][16]byte, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			ids := make([][16]byte, perWorker)
+			for i := range ids {
+				ids[i] = uuid.MustParse(NewMessage("TEST", "sender-id", nil).ID)
+			}
+			results[w] = ids
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[[16]byte]struct{}, workers*perWorker)
+	for _, ids := range results {
+		for _, id := range ids {
+			if _, exists := seen[id]; exists {
+				t.Fatalf("message ID %x generated twice", id)
+			}
+			seen[id] = struct{}{}
+		}
+	}
+	assert.Len(t, seen, workers*perWorker)
 }
 
 func TestConnectionPool(t *testing.T) {
 	log, err := logger.New("debug", "json", "")
 	require.NoError(t, err)
 
-	pool := NewConnectionPool(log, 10, 30*time.Second)
+	pool := NewConnectionPool(log, 1, 30*time.Second)
 
-	assert.Equal(t, 0, pool.PeerCount())
 	assert.Equal(t, 0, pool.ConnectionCount())
 	assert.False(t, pool.IsFull())
 
-	// Test adding a peer
-	peer := NewPeer("peer-id", "127.0.0.1:8080", "1.0.0")
-	pool.AddPeer(peer)
-	assert.Equal(t, 1, pool.PeerCount())
-
-	// Test getting peer
-	gotPeer, exists := pool.GetPeer("peer-id")
+	// Test adding a connection
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &Connection{ID: "conn-id", Conn: local, CreatedAt: time.Now(), LastSeen: time.Now()}
+	require.NoError(t, pool.AddConnection(conn))
+	assert.Equal(t, 1, pool.ConnectionCount())
+	assert.True(t, pool.IsFull())
+	assert.Error(t, pool.AddConnection(&Connection{ID: "other-id"}))
+
+	// Test getting connection
+	gotConn, exists := pool.GetConnection("conn-id")
 	assert.True(t, exists)
-	assert.Equal(t, "peer-id", gotPeer.ID)
+	assert.Equal(t, conn, gotConn)
 
-	// Test getting all peers
-	peers := pool.GetPeers()
-	assert.Equal(t, 1, len(peers))
-	assert.Equal(t, "peer-id", peers[0].ID)
-
-	// Test removing peer
-	pool.RemovePeer("peer-id")
-	assert.Equal(t, 0, pool.PeerCount())
+	// Test removing connection
+	pool.RemoveConnection("conn-id")
+	assert.Equal(t, 0, pool.ConnectionCount())
 }
 
 func TestPeer(t *testing.T) {
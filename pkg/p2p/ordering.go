@@ -0,0 +1,372 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// GapPolicy says what ordered delivery does once a message a peer sent has
+// not arrived within the gap timeout, or the window filled up behind it
+type GapPolicy string
+
+// Gap policies of ordered delivery
+const (
+	// GapSkip hands on the messages held back without the missing one
+	GapSkip GapPolicy = "skip"
+	// GapDisconnect closes the connection to the peer
+	GapDisconnect GapPolicy = "disconnect"
+)
+
+// HandlerOption changes how a handler passed to RegisterHandler is called
+type HandlerOption func(*registeredHandler)
+
+// Unordered has a handler called with each message as soon as it arrives,
+// even under ordered delivery, for handlers that would rather not wait on a
+// peer's earlier messages
+func Unordered() HandlerOption {
+	return func(h *registeredHandler) {
+		h.unordered = true
+	}
+}
+
+// registeredHandler is a handler and how it is called
+type registeredHandler struct {
+	handle    MessageHandler
+	unordered bool
+	// maxAge is how old a message the handler is still called with; 0 is
+	// any age
+	maxAge time.Duration
+}
+
+// handlerDelivery says which handlers of its type a queued message is for
+type handlerDelivery uint8
+
+const (
+	// deliverAll is for every handler of the message's type
+	deliverAll handlerDelivery = iota
+	// deliverOrdered is for the handlers that see messages in order
+	deliverOrdered
+	// deliverUnordered is for the handlers registered Unordered
+	deliverUnordered
+)
+
+// wants reports whether the handler is called for a message queued for
+// delivery
+func (h registeredHandler) wants(delivery handlerDelivery) bool {
+	switch delivery {
+	case deliverOrdered:
+		return !h.unordered
+	case deliverUnordered:
+		return h.unordered
+	default:
+		return true
+	}
+}
+
+// protocolMessageTypes are the types processMessage handles itself rather
+// than queueing for handlers
+var protocolMessageTypes = map[string]bool{
+	MessageTypeHello:           true,
+	MessageTypeHeartbeat:       true,
+	MessageTypePeerList:        true,
+	MessageTypePeerListRequest: true,
+	MessageTypePing:            true,
+	MessageTypePong:            true,
+	MessageTypeGoodbye:         true,
+	MessageTypeTopologyReport:  true,
+	MessageTypeError:           true,
+	MessageTypeFragment:        true,
+	MessageTypeBatch:           true,
+	MessageTypeTrace:           true,
+	MessageTypeTraceReply:      true,
+	MessageTypeAck:             true,
+	MessageTypeKeyRotation:     true,
+	MessageTypeTopic:           true,
+}
+
+// sequenced reports whether a message is numbered for ordered delivery:
+// those queued for handlers, except replies, which go to whoever awaits them
+func sequenced(msg *Message) bool {
+	return msg.ReplyTo == "" && !protocolMessageTypes[msg.Type]
+}
+
+// sequence numbers a message about to be sent on the connection, replacing
+// any number a forwarded message arrived with
+func (c *Connection) sequence(msg *Message) {
+	msg.Seq = 0
+	if sequenced(msg) {
+		msg.Seq = c.sent.Add(1)
+	}
+}
+
+// orderResult is what a reorder buffer did with a message
+type orderResult int
+
+const (
+	// orderDelivered means the message was handed on at once
+	orderDelivered orderResult = iota
+	// orderHeld means it waits for a message the peer sent before it
+	orderHeld
+	// orderLate means its place in the sequence was given up or taken, so
+	// it is not handed on
+	orderLate
+)
+
+// reorderBuffer puts the application messages a peer sends on a connection
+// back in the order it numbered them. Messages after one that has not
+// arrived are held back, up to window of them, for at most timeout; then
+// the missing one is given up on. Unless skipGaps is set, the buffer hands
+// on nothing more after that, as the peer is being disconnected.
+type reorderBuffer struct {
+	window   int
+	timeout  time.Duration
+	skipGaps bool
+	// deliver hands on a message in sequence; onGap is told the number of
+	// each message given up on
+	deliver func(*Message)
+	onGap   func(missing uint64)
+
+	next uint64
+	// pending holds the messages held back by number, nil for numbers that
+	// were settled without a message to hand on
+	pending map[uint64]*Message
+	timer   *time.Timer
+	// waiting is the number of the message the timer waits for, and timers
+	// counts the timers started, telling a stopped one that fires anyway
+	// from the current one
+	waiting uint64
+	timers  uint64
+	closed  bool
+	// mu is held across deliveries, so messages are handed on in sequence
+	mu sync.Mutex
+}
+
+// newReorderBuffer creates a buffer expecting message 1 first
+func newReorderBuffer(window int, timeout time.Duration, skipGaps bool, deliver func(*Message), onGap func(missing uint64)) *reorderBuffer {
+	return &reorderBuffer{
+		window:   window,
+		timeout:  timeout,
+		skipGaps: skipGaps,
+		deliver:  deliver,
+		onGap:    onGap,
+		next:     1,
+		pending:  make(map[uint64]*Message),
+	}
+}
+
+// add hands on a numbered message, with those held back that were waiting
+// for it, or holds it back until the messages before it arrived
+func (b *reorderBuffer) add(msg *Message) orderResult {
+	b.mu.Lock()
+	if _, held := b.pending[msg.Seq]; held || msg.Seq < b.next || b.closed {
+		b.mu.Unlock()
+		return orderLate
+	}
+
+	result := orderHeld
+	if msg.Seq == b.next {
+		result = orderDelivered
+		b.next++
+		b.deliver(msg)
+		b.drainLocked()
+	} else {
+		held := *msg
+		b.pending[msg.Seq] = &held
+	}
+	missing := b.settleLocked()
+	b.mu.Unlock()
+
+	if missing != 0 {
+		b.onGap(missing)
+	}
+	return result
+}
+
+// skip settles a number the peer gave a message that is not handed on, such
+// as a duplicate, so it does not hold up the messages after it. Numbers
+// already settled are left alone.
+func (b *reorderBuffer) skip(seq uint64) {
+	b.mu.Lock()
+	if _, held := b.pending[seq]; held || seq < b.next || b.closed {
+		b.mu.Unlock()
+		return
+	}
+
+	if seq == b.next {
+		b.next++
+		b.drainLocked()
+	} else {
+		b.pending[seq] = nil
+	}
+	missing := b.settleLocked()
+	b.mu.Unlock()
+
+	if missing != 0 {
+		b.onGap(missing)
+	}
+}
+
+// close stops waiting for missing messages
+func (b *reorderBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+// drainLocked hands on the held back messages that are next in sequence.
+// b.mu must be held.
+func (b *reorderBuffer) drainLocked() {
+	for {
+		msg, held := b.pending[b.next]
+		if !held {
+			return
+		}
+		delete(b.pending, b.next)
+		b.next++
+		if msg != nil {
+			b.deliver(msg)
+		}
+	}
+}
+
+// settleLocked gives up on the missing message if the window is full, and
+// has the timer wait for whichever message is missing now. It returns the
+// number of the message given up on, or 0. b.mu must be held.
+func (b *reorderBuffer) settleLocked() uint64 {
+	var missing uint64
+	if len(b.pending) > b.window {
+		missing = b.giveUpLocked()
+	}
+
+	if len(b.pending) == 0 || b.closed {
+		if b.timer != nil {
+			b.timer.Stop()
+			b.timer = nil
+		}
+		return missing
+	}
+	// Each missing message gets the whole timeout from when the one before
+	// it arrived
+	if b.timer != nil && b.waiting == b.next {
+		return missing
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.timers++
+	started := b.timers
+	b.timer = time.AfterFunc(b.timeout, func() { b.expire(started) })
+	b.waiting = b.next
+	return missing
+}
+
+// giveUpLocked gives up on the missing message. If gaps are skipped the
+// messages held back after it are handed on, otherwise the buffer closes.
+// It returns the number given up on. b.mu must be held.
+func (b *reorderBuffer) giveUpLocked() uint64 {
+	missing := b.next
+	if !b.skipGaps {
+		b.closed = true
+		b.pending = nil
+		return missing
+	}
+
+	var lowest uint64
+	for seq := range b.pending {
+		if lowest == 0 || seq < lowest {
+			lowest = seq
+		}
+	}
+	b.next = lowest
+	b.drainLocked()
+	return missing
+}
+
+// expire gives up on the message the timer numbered started was waiting
+// for, unless it arrived in the meantime
+func (b *reorderBuffer) expire(started uint64) {
+	b.mu.Lock()
+	if b.timer == nil || b.timers != started || b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.timer = nil
+	missing := b.giveUpLocked()
+	b.settleLocked()
+	b.mu.Unlock()
+
+	b.onGap(missing)
+}
+
+// newReorderBuffer creates the buffer putting what the peer sends on a
+// connection back in order, under ordered delivery
+func (n *Network) newReorderBuffer(connection *Connection) *reorderBuffer {
+	return newReorderBuffer(n.orderWindow, n.orderGapTimeout, n.orderGapPolicy == GapSkip,
+		func(msg *Message) {
+			if n.hasHandlerFor(msg.Type, deliverOrdered) {
+				ordered := *msg
+				ordered.delivery = deliverOrdered
+				n.enqueue(ordered)
+			}
+		},
+		func(missing uint64) { n.sequenceGap(connection, missing) },
+	)
+}
+
+// deliverInOrder queues a numbered message for the handlers registered
+// Unordered at once, and for the others once the messages the peer sent
+// before it were
+func (n *Network) deliverInOrder(msg *Message, connection *Connection) {
+	if n.hasHandlerFor(msg.Type, deliverUnordered) {
+		unordered := *msg
+		unordered.delivery = deliverUnordered
+		n.enqueue(unordered)
+	}
+
+	switch connection.order.add(msg) {
+	case orderHeld:
+		n.monitor.Stats.IncrementMessagesReordered()
+	case orderLate:
+		n.monitor.Stats.IncrementMessagesLate()
+		n.messageLogger(msg).Debugf("message %s from %s arrived after ordered delivery gave up on it", msg.ID, msg.Sender)
+	}
+}
+
+// settleSequence makes sure a numbered message that is not handed on, e.g.
+// as a duplicate, does not hold up the messages the peer sent after it
+func (n *Network) settleSequence(msg *Message, connection *Connection) {
+	if msg.Seq != 0 && connection.order != nil {
+		connection.order.skip(msg.Seq)
+	}
+}
+
+// sequenceGap counts a message ordered delivery gave up waiting for, and
+// disconnects its peer unless gaps are skipped
+func (n *Network) sequenceGap(connection *Connection, missing uint64) {
+	n.monitor.Stats.IncrementSequenceGaps()
+	if n.orderGapPolicy == GapSkip {
+		n.logger.Debugf("message %d from %s did not arrive in time, delivering those after it", missing, connection.PeerID)
+		return
+	}
+	n.logger.Warnf("message %d from %s did not arrive in time, disconnecting", missing, connection.PeerID)
+	connection.closeWith(fmt.Sprintf("message %d missing from sequence", missing))
+}
+
+// hasHandlerFor reports whether a handler is registered for messages of a
+// type queued for delivery
+func (n *Network) hasHandlerFor(msgType string, delivery handlerDelivery) bool {
+	n.handlersMu.RLock()
+	defer n.handlersMu.RUnlock()
+	for _, handler := range n.handlers[msgType] {
+		if handler.wants(delivery) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	var delivered []uint64
+	var gaps []uint64
+	buffer := newReorderBuffer(2, time.Hour, true,
+		func(msg *Message) { delivered = append(delivered, msg.Seq) },
+		func(missing uint64) { gaps = append(gaps, missing) },
+	)
+	defer buffer.close()
+	numbered := func(seq uint64) *Message {
+		msg := NewMessage("NOTE", "peer", seq)
+		msg.Seq = seq
+		return &msg
+	}
+
+	assert.Equal(t, orderDelivered, buffer.add(numbered(1)))
+	assert.Equal(t, orderHeld, buffer.add(numbered(3)))
+	assert.Equal(t, orderLate, buffer.add(numbered(3)), "a number is handed on once")
+	buffer.skip(2)
+	assert.Equal(t, []uint64{1, 3}, delivered)
+
+	// A full window gives up on the missing message
+	assert.Equal(t, orderHeld, buffer.add(numbered(5)))
+	assert.Equal(t, orderHeld, buffer.add(numbered(6)))
+	assert.Empty(t, gaps)
+	assert.Equal(t, orderHeld, buffer.add(numbered(7)))
+	assert.Equal(t, []uint64{4}, gaps)
+	assert.Equal(t, []uint64{1, 3, 5, 6, 7}, delivered)
+	assert.Equal(t, orderLate, buffer.add(numbered(4)))
+
+	// Settled numbers are passed over
+	buffer.skip(9)
+	assert.Equal(t, orderDelivered, buffer.add(numbered(8)))
+	assert.Equal(t, orderDelivered, buffer.add(numbered(10)))
+	assert.Equal(t, []uint64{1, 3, 5, 6, 7, 8, 10}, delivered)
+}
+
+func TestReorderBufferGapTimeout(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []uint64
+	gaps := make(chan uint64, 2)
+	buffer := newReorderBuffer(16, 50*time.Millisecond, true,
+		func(msg *Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, msg.Seq)
+		},
+		func(missing uint64) { gaps <- missing },
+	)
+	defer buffer.close()
+
+	for _, seq := range []uint64{2, 4} {
+		msg := NewMessage("NOTE", "peer", seq)
+		msg.Seq = seq
+		buffer.add(&msg)
+	}
+	select {
+	case missing := <-gaps:
+		assert.Equal(t, uint64(1), missing)
+	case <-time.After(5 * time.Second):
+		t.Fatal("gap never timed out")
+	}
+	select {
+	case missing := <-gaps:
+		assert.Equal(t, uint64(3), missing, "the next gap gets a timeout of its own")
+	case <-time.After(5 * time.Second):
+		t.Fatal("second gap never timed out")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []uint64{2, 4}, delivered)
+}
+
+// startMemoryNetwork starts a network on the in-memory network as host,
+// whatever transport the other tests use, so what it sends can be reordered
+func startMemoryNetwork(t *testing.T, ctx context.Context, cfg *config.Config, nodeID, host string) *Network {
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+	cfg.P2P.ListenPort = 0
+	cfg.Storage.DataDir = t.TempDir()
+
+	network, err := New(cfg, log, nodeID)
+	require.NoError(t, err)
+	network.SetTransport(memoryNetwork.Host(host))
+	require.NoError(t, network.Start(ctx))
+	t.Cleanup(func() { network.Stop() })
+	return network
+}
+
+// frameSeq returns the sequence number of the message in a written frame,
+// or 0 if it has none
+func frameSeq(t *testing.T, frame []byte) uint64 {
+	codec, data, err := readCodecFrame(bufio.NewReader(bytes.NewReader(frame)), MaxMessageSize)
+	require.NoError(t, err)
+	msg, err := DeserializeMessageWith(codec, data)
+	require.NoError(t, err)
+	return msg.Seq
+}
+
+// orderedPair starts a sender and a receiver handing the sender's messages
+// to handlers in order, connected over the in-memory network
+func orderedPair(t *testing.T, ctx context.Context, onGap string) (sender, receiver *Network) {
+	cfg := config.Default()
+	cfg.P2P.OrderedDelivery.Enabled = true
+	cfg.P2P.OrderedDelivery.GapTimeoutMS = 100
+	cfg.P2P.OrderedDelivery.OnGap = onGap
+	receiver = startMemoryNetwork(t, ctx, cfg, "order-receiver", "order-receiver-host")
+	sender = startMemoryNetwork(t, ctx, config.Default(), "order-sender", "order-sender-host")
+
+	_, err := sender.Connect(ctx, localAddr(receiver))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(receiver.ConnectedPeers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	return sender, receiver
+}
+
+// noteRecorder records the numbers in the NOTE messages a handler is given
+type noteRecorder struct {
+	mu    sync.Mutex
+	notes []int
+}
+
+// handle is the recording handler
+func (r *noteRecorder) handle(msg Message) {
+	var note int
+	if msg.DecodePayload(&note) != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notes = append(r.notes, note)
+}
+
+// seen returns the numbers recorded so far
+func (r *noteRecorder) seen() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.notes...)
+}
+
+// sendNotes sends NOTE messages numbered 1 to count while the in-memory
+// network holds them back, then lets them through as reorder says
+func sendNotes(t *testing.T, ctx context.Context, sender *Network, count int, reorder func([][]byte) [][]byte) {
+	memoryNetwork.Hold("order-sender-host", "order-receiver-host")
+	for i := 1; i <= count; i++ {
+		require.NoError(t, sender.SendMessage(ctx, "order-receiver", NewMessage("NOTE", sender.nodeID, i)))
+	}
+	memoryNetwork.Release("order-sender-host", "order-receiver-host", reorder)
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sender, receiver := orderedPair(t, ctx, "skip")
+
+	var ordered, unordered noteRecorder
+	receiver.RegisterHandler("NOTE", ordered.handle)
+	receiver.RegisterHandler("NOTE", unordered.handle, Unordered())
+
+	// The frames arrive last sent first
+	sendNotes(t, ctx, sender, 5, func(writes [][]byte) [][]byte {
+		reversed := make([][]byte, 0, len(writes))
+		for i := len(writes) - 1; i >= 0; i-- {
+			reversed = append(reversed, writes[i])
+		}
+		return reversed
+	})
+
+	require.Eventually(t, func() bool {
+		return len(ordered.seen()) == 5
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, ordered.seen())
+	assert.Equal(t, []int{5, 4, 3, 2, 1}, unordered.seen(), "unordered handlers get messages as they arrive")
+
+	stats := receiver.monitor.Stats.GetStats()
+	assert.Equal(t, uint64(4), stats.MessagesReordered)
+	assert.Zero(t, stats.SequenceGaps)
+}
+
+func TestOrderedDeliverySkipsGaps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sender, receiver := orderedPair(t, ctx, "skip")
+
+	var ordered noteRecorder
+	receiver.RegisterHandler("NOTE", ordered.handle)
+
+	// The second message is lost
+	sendNotes(t, ctx, sender, 3, func(writes [][]byte) [][]byte {
+		var kept [][]byte
+		for _, write := range writes {
+			if frameSeq(t, write) != 2 {
+				kept = append(kept, write)
+			}
+		}
+		return kept
+	})
+
+	require.Eventually(t, func() bool {
+		return len(ordered.seen()) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []int{1, 3}, ordered.seen())
+	assert.Equal(t, uint64(1), receiver.monitor.Stats.GetStats().SequenceGaps)
+	assert.Len(t, receiver.ConnectedPeers(), 1)
+}
+
+func TestOrderedDeliveryDisconnectsOnGaps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sender, receiver := orderedPair(t, ctx, "disconnect")
+
+	var ordered noteRecorder
+	receiver.RegisterHandler("NOTE", ordered.handle)
+
+	sendNotes(t, ctx, sender, 3, func(writes [][]byte) [][]byte {
+		var kept [][]byte
+		for _, write := range writes {
+			if frameSeq(t, write) != 1 {
+				kept = append(kept, write)
+			}
+		}
+		return kept
+	})
+
+	require.Eventually(t, func() bool {
+		return len(sender.ConnectedPeers()) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Empty(t, ordered.seen(), "nothing after the gap is handed on")
+	assert.Equal(t, uint64(1), receiver.monitor.Stats.GetStats().SequenceGaps)
+}
@@ -0,0 +1,419 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+)
+
+const (
+	// OutboxFile is the journal under the data directory that holds reliable
+	// messages until their peer acknowledges them
+	OutboxFile = "outbox.journal"
+
+	// outboxCompactEvery is how many acknowledgements accumulate before the
+	// journal is rewritten with only the messages still pending
+	outboxCompactEvery = 256
+)
+
+var (
+	// ErrOutboxFull is returned for a reliable send while as many messages
+	// as the journal holds are waiting for acknowledgements
+	ErrOutboxFull = errors.New("reliable message journal is full")
+
+	// ErrDeliveryPending is returned for a reliable send that was not
+	// acknowledged but stays in the journal, to be sent again once the peer
+	// reconnects. Sending the message anew would deliver it twice.
+	ErrDeliveryPending = errors.New("message kept for delivery when the peer reconnects")
+)
+
+// OutboxStats describes the reliable message journal
+type OutboxStats struct {
+	Pending     int    `json:"pending"`
+	Journaled   uint64 `json:"journaled"`
+	Delivered   uint64 `json:"delivered"`
+	Redelivered uint64 `json:"redelivered"`
+	Corrupt     uint64 `json:"corrupt_records"`
+}
+
+// outboxRecord is one line of the journal: a message about to be sent, or
+// the acknowledgement that completed it
+type outboxRecord struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id"`
+	PeerID  string          `json:"peer_id,omitempty"`
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+const (
+	outboxSend = "send"
+	outboxDone = "done"
+)
+
+// outboxEntry is a message waiting for its acknowledgement
+type outboxEntry struct {
+	peerID string
+	data   json.RawMessage
+	// sending is set while a send of the message waits for its ACK, so it
+	// is not sent again alongside
+	sending bool
+}
+
+// outbox is a write-ahead journal of reliable messages. Each message is
+// appended, checksummed, before it is sent and marked done once the peer
+// acknowledges it; torn or corrupt lines are skipped on load. Completed
+// messages are dropped from the journal by rewriting it with the pending
+// ones.
+type outbox struct {
+	path       string
+	files      *storage.Manager
+	maxPending int
+
+	mu        sync.Mutex
+	entries   map[string]*outboxEntry
+	order     []string
+	journal   io.WriteCloser
+	completed int
+	stats     OutboxStats
+}
+
+// openOutbox opens the journal at path, recovering the messages the last
+// run did not see acknowledged. Files are written through files, or directly
+// if it is nil.
+func openOutbox(path string, files *storage.Manager, maxPending int) (*outbox, error) {
+	if maxPending < 1 {
+		return nil, fmt.Errorf("outbox must hold at least one message")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+
+	o := &outbox{
+		path:       path,
+		files:      files,
+		maxPending: maxPending,
+		entries:    make(map[string]*outboxEntry),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+
+	// Start from a compact journal so corrupt lines are not read again
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.compactLocked(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Add journals a message to peerID before it is sent
+func (o *outbox) Add(peerID string, msg Message) error {
+	data, err := msg.Serialize()
+	if err != nil {
+		return fmt.Errorf("failed to marshal message %s: %w", msg.ID, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.journal == nil {
+		return fmt.Errorf("outbox is closed")
+	}
+	if _, exists := o.entries[msg.ID]; exists {
+		return fmt.Errorf("message %s is already waiting for an acknowledgement", msg.ID)
+	}
+	if len(o.entries) >= o.maxPending {
+		return fmt.Errorf("%d messages await acknowledgement: %w", len(o.entries), ErrOutboxFull)
+	}
+
+	if err := o.appendLocked(outboxRecord{Op: outboxSend, ID: msg.ID, PeerID: peerID, Message: data}); err != nil {
+		return err
+	}
+	o.entries[msg.ID] = &outboxEntry{peerID: peerID, data: data, sending: true}
+	o.order = append(o.order, msg.ID)
+	o.stats.Journaled++
+	return nil
+}
+
+// Complete marks a message acknowledged, so it is never sent again
+func (o *outbox) Complete(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, exists := o.entries[id]; !exists {
+		return nil
+	}
+	o.removeLocked(id)
+	o.stats.Delivered++
+	if o.journal == nil {
+		return nil
+	}
+	if err := o.appendLocked(outboxRecord{Op: outboxDone, ID: id}); err != nil {
+		return err
+	}
+
+	// The completion is durable in the journal; a failed compaction is
+	// retried after the next one
+	o.completed++
+	if o.completed >= outboxCompactEvery {
+		o.compactLocked()
+	}
+	return nil
+}
+
+// Release makes a message whose send failed available to Take again
+func (o *outbox) Release(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if entry, exists := o.entries[id]; exists {
+		entry.sending = false
+	}
+}
+
+// Take returns the messages to peerID awaiting acknowledgement that are not
+// being sent, oldest first, and marks them as being sent
+func (o *outbox) Take(peerID string) []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var messages []Message
+	for _, id := range o.order {
+		entry := o.entries[id]
+		if entry.peerID != peerID || entry.sending {
+			continue
+		}
+		msg, err := DeserializeMessage(entry.data)
+		if err != nil {
+			// Checked on load, so this cannot happen
+			continue
+		}
+		entry.sending = true
+		messages = append(messages, *msg)
+	}
+	return messages
+}
+
+// Redelivered counts a message sent again after a restart or reconnection
+func (o *outbox) Redelivered() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stats.Redelivered++
+}
+
+// Stats returns the journal's counters
+func (o *outbox) Stats() OutboxStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stats := o.stats
+	stats.Pending = len(o.entries)
+	return stats
+}
+
+// Close compacts and closes the journal. Pending messages stay in it for
+// the next run.
+func (o *outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.journal == nil {
+		return nil
+	}
+	err := o.compactLocked()
+	if o.journal != nil {
+		o.journal.Close()
+		o.journal = nil
+	}
+	return err
+}
+
+// appendLocked writes one checksummed journal line; callers must hold o.mu
+func (o *outbox) appendLocked(record outboxRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox record: %w", err)
+	}
+
+	line := fmt.Appendf(nil, "%08x %s\n", crc32.ChecksumIEEE(data), data)
+	if _, err := o.journal.Write(line); err != nil {
+		return fmt.Errorf("failed to append to outbox journal: %w", err)
+	}
+	return nil
+}
+
+// compactLocked replaces the journal with one holding only the pending
+// messages; callers must hold o.mu. The new journal is written next to the
+// old one and renamed over it, so a crash leaves one or the other.
+func (o *outbox) compactLocked() error {
+	var data []byte
+	for _, id := range o.order {
+		entry := o.entries[id]
+		record, err := json.Marshal(outboxRecord{Op: outboxSend, ID: id, PeerID: entry.peerID, Message: entry.data})
+		if err != nil {
+			return fmt.Errorf("failed to marshal outbox record: %w", err)
+		}
+		data = fmt.Appendf(data, "%08x %s\n", crc32.ChecksumIEEE(record), record)
+	}
+
+	if o.journal != nil {
+		o.journal.Close()
+		o.journal = nil
+	}
+	var err error
+	if o.files != nil {
+		err = o.files.WriteFile(o.path, data, 0600)
+	} else {
+		err = storage.WriteFileAtomic(o.path, data, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compact outbox journal: %w", err)
+	}
+
+	if o.files != nil {
+		o.journal, err = o.files.OpenAppend(o.path, 0600)
+	} else {
+		o.journal, err = os.OpenFile(o.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open outbox journal: %w", err)
+	}
+	o.completed = 0
+	return nil
+}
+
+// load replays the journal
+func (o *outbox) load() error {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open outbox journal: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			o.replay(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read outbox journal: %w", err)
+		}
+	}
+}
+
+// replay applies one journal line, counting it as corrupt if it is torn,
+// fails its checksum or holds a message that does not decode
+func (o *outbox) replay(line []byte) {
+	var record outboxRecord
+	if !parseOutboxLine(line, &record) || record.ID == "" {
+		o.stats.Corrupt++
+		return
+	}
+
+	switch record.Op {
+	case outboxSend:
+		if _, err := DeserializeMessage(record.Message); err != nil || record.PeerID == "" {
+			o.stats.Corrupt++
+			return
+		}
+		if _, exists := o.entries[record.ID]; !exists {
+			o.entries[record.ID] = &outboxEntry{peerID: record.PeerID, data: record.Message}
+			o.order = append(o.order, record.ID)
+		}
+	case outboxDone:
+		o.removeLocked(record.ID)
+	default:
+		o.stats.Corrupt++
+	}
+}
+
+// removeLocked forgets a message; callers must hold o.mu
+func (o *outbox) removeLocked(id string) {
+	if _, exists := o.entries[id]; !exists {
+		return
+	}
+	delete(o.entries, id)
+	for i, pending := range o.order {
+		if pending == id {
+			o.order = append(o.order[:i], o.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// parseOutboxLine verifies and decodes a "<crc32> <json>\n" line
+func parseOutboxLine(line []byte, record *outboxRecord) bool {
+	line, complete := bytes.CutSuffix(line, []byte("\n"))
+	if !complete {
+		return false
+	}
+	sum, payload, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return false
+	}
+
+	var expected uint32
+	if _, err := fmt.Sscanf(string(sum), "%08x", &expected); err != nil {
+		return false
+	}
+	if crc32.ChecksumIEEE(payload) != expected {
+		return false
+	}
+	return json.Unmarshal(payload, record) == nil
+}
+
+// redeliver sends a peer that just connected the reliable messages it has
+// not acknowledged, oldest first, stopping at the first that fails
+func (n *Network) redeliver(peerID string) {
+	if n.outbox == nil {
+		return
+	}
+
+	messages := n.outbox.Take(peerID)
+	for i, msg := range messages {
+		// The message keeps its ID, which the peer recognises if it received
+		// it before, but is dated now so it is not refused as skewed. What
+		// is left of its TTL goes with it.
+		if !refreshTTL(&msg, time.Now()) {
+			n.monitor.Stats.IncrementSendsExpired()
+			n.messageLogger(&msg).Debugf("not redelivering %s to %s: expired", msg.ID, peerID)
+			if err := n.outbox.Complete(msg.ID); err != nil {
+				n.messageLogger(&msg).Errorf("failed to journal expiry of %s: %v", msg.ID, err)
+			}
+			continue
+		}
+		msg.RequireAck = true
+		_, err := n.awaitReply(n.ctx, peerID, msg)
+
+		var rejected *ErrorPayload
+		if err != nil && !errors.As(err, &rejected) {
+			n.messageLogger(&msg).Debugf("failed to redeliver %s to %s: %v", msg.ID, peerID, err)
+			for _, unsent := range messages[i:] {
+				n.outbox.Release(unsent.ID)
+			}
+			return
+		}
+		n.outbox.Redelivered()
+		if err := n.outbox.Complete(msg.ID); err != nil {
+			n.messageLogger(&msg).Errorf("failed to journal delivery of %s: %v", msg.ID, err)
+		}
+	}
+}
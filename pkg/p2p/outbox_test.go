@@ -0,0 +1,175 @@
+package p2p
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxRecovers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), OutboxFile)
+	box, err := openOutbox(path, nil, 2)
+	require.NoError(t, err)
+
+	first := NewMessage("NOTE", "journal-node", "first")
+	second := NewMessage("NOTE", "journal-node", "second")
+	require.NoError(t, box.Add("peer-b", first))
+	require.NoError(t, box.Add("peer-b", second))
+	assert.Error(t, box.Add("peer-b", first), "a message is journaled once")
+	assert.ErrorIs(t, box.Add("peer-c", NewMessage("NOTE", "journal-node", "third")), ErrOutboxFull)
+
+	// Messages being sent are not handed out again until released
+	assert.Empty(t, box.Take("peer-b"))
+	require.NoError(t, box.Complete(first.ID))
+	box.Release(second.ID)
+
+	// The process dies halfway through writing a record
+	journal, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = journal.WriteString(`0badc0de {"op":"send","id":"torn"`)
+	require.NoError(t, err)
+	require.NoError(t, journal.Close())
+
+	reopened, err := openOutbox(path, nil, 2)
+	require.NoError(t, err)
+	defer reopened.Close()
+	stats := reopened.Stats()
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, uint64(1), stats.Corrupt)
+	assert.Empty(t, reopened.Take("peer-c"))
+	pending := reopened.Take("peer-b")
+	require.Len(t, pending, 1)
+	assert.Equal(t, second.ID, pending[0].ID)
+	var note string
+	require.NoError(t, pending[0].DecodePayload(&note))
+	assert.Equal(t, "second", note)
+
+	// Opening compacts the journal down to the pending message
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, countLines(data))
+}
+
+func TestOutboxCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), OutboxFile)
+	box, err := openOutbox(path, nil, 4)
+	require.NoError(t, err)
+	defer box.Close()
+
+	kept := NewMessage("NOTE", "journal-node", "kept")
+	require.NoError(t, box.Add("peer-b", kept))
+	for i := 0; i < outboxCompactEvery; i++ {
+		msg := NewMessage("NOTE", "journal-node", i)
+		require.NoError(t, box.Add("peer-b", msg))
+		require.NoError(t, box.Complete(msg.ID))
+	}
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, countLines(data), "acknowledged messages are dropped from the journal")
+	stats := box.Stats()
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, uint64(outboxCompactEvery+1), stats.Journaled)
+	assert.Equal(t, uint64(outboxCompactEvery), stats.Delivered)
+}
+
+// countLines returns the number of newline-terminated lines in data
+func countLines(data []byte) int {
+	lines := 0
+	for _, b := range data {
+		if b == '\n' {
+			lines++
+		}
+	}
+	return lines
+}
+
+// journalIn makes a network journal reliable messages in dataDir, so a
+// network restarted on it resends what was not acknowledged
+func journalIn(dataDir string) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.Storage.DataDir = dataDir
+		cfg.P2P.ReliableJournal.Enabled = true
+	}
+}
+
+func TestReliableMessagesSurviveRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dirA := t.TempDir()
+	a := startLocalNetworkWith(t, ctx, "journal-a", journalIn(dirA))
+	b := startLocalNetwork(t, ctx, "journal-b")
+
+	var mu sync.Mutex
+	delivered := make(map[string]int)
+	b.RegisterHandler("NOTE", func(msg Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[msg.ID]++
+	})
+	deliveries := func(id string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return delivered[id]
+	}
+
+	// A message to a peer that is not connected stays journaled
+	offline := NewMessage("NOTE", "journal-a", "while offline")
+	err := a.SendMessageReliable(ctx, "journal-b", offline)
+	require.ErrorIs(t, err, ErrDeliveryPending)
+	assert.Equal(t, 1, a.outbox.Stats().Pending)
+
+	// b gets a message whose acknowledgement a never records, as if a died
+	// between sending it and reading the ACK
+	_, err = a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return deliveries(offline.ID) == 1 && a.outbox.Stats().Pending == 0
+	}, 5*time.Second, 20*time.Millisecond)
+	unacked := NewMessage("NOTE", "journal-a", "ack lost")
+	require.NoError(t, a.SendMessageReliable(ctx, "journal-b", unacked))
+	require.Eventually(t, func() bool {
+		return deliveries(unacked.ID) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, a.Stop())
+
+	crashed, err := openOutbox(filepath.Join(dirA, OutboxFile), nil, 8)
+	require.NoError(t, err)
+	require.NoError(t, crashed.Add("journal-b", unacked))
+	unsent := NewMessage("NOTE", "journal-a", "never sent")
+	require.NoError(t, crashed.Add("journal-b", unsent))
+	require.NoError(t, crashed.journal.Close())
+
+	// After the restart both are sent again; b drops the one it already has
+	// but acknowledges it, so neither stays journaled
+	require.Eventually(t, func() bool {
+		return len(b.ConnectedPeers()) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+	a = startLocalNetworkWith(t, ctx, "journal-a", journalIn(dirA))
+	assert.Equal(t, 2, a.outbox.Stats().Pending)
+	_, err = a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return a.outbox.Stats().Pending == 0
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		return deliveries(unsent.ID) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, 1, deliveries(offline.ID))
+	assert.Equal(t, 1, deliveries(unacked.ID), "the redelivered message is suppressed as a duplicate")
+	assert.Equal(t, uint64(1), b.GetNetworkReport().Stats.DuplicateMessages)
+
+	report := a.GetNetworkReport()
+	require.NotNil(t, report.Outbox)
+	assert.Equal(t, uint64(2), report.Outbox.Redelivered)
+	assert.Zero(t, report.Outbox.Pending)
+}
@@ -0,0 +1,208 @@
+// Package p2ptest runs clusters of p2p networks in memory, for tests that need
+// many nodes and control over the links between them, and starts single
+// nodes on loopback for tests of the services built on a network.
+package p2ptest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/p2ptest/memnet"
+)
+
+// DefaultWaitTimeout bounds how long cluster helpers wait for the nodes to
+// notice a link coming up or going down
+const DefaultWaitTimeout = 5 * time.Second
+
+// Cluster is a set of started networks talking over an in-memory network.
+// Node i is named "node-i", which is also its host name on the network.
+type Cluster struct {
+	// Net is the in-memory network the nodes are attached to
+	Net *memnet.Network
+
+	t     testing.TB
+	nodes []*p2p.Network
+
+	mu        sync.Mutex
+	connected []map[string]bool
+}
+
+// NewCluster starts size networks without any links between them. configure,
+// if given, adjusts each node's config before it starts. The networks are
+// stopped when the test ends.
+func NewCluster(t testing.TB, size int, configure ...func(i int, cfg *config.Config)) *Cluster {
+	t.Helper()
+
+	log, err := logger.New("error", "json", "")
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	c := &Cluster{
+		Net:       memnet.New(),
+		t:         t,
+		nodes:     make([]*p2p.Network, size),
+		connected: make([]map[string]bool, size),
+	}
+	for i := range c.nodes {
+		cfg := config.Default()
+		cfg.P2P.ListenPort = 0
+		cfg.Storage.DataDir = t.TempDir()
+		for _, fn := range configure {
+			fn(i, cfg)
+		}
+
+		node, err := p2p.New(cfg, log, c.Host(i))
+		if err != nil {
+			t.Fatalf("failed to create node %d: %v", i, err)
+		}
+		node.SetTransport(c.Net.Host(c.Host(i)))
+		c.connected[i] = make(map[string]bool)
+		c.track(i, node)
+
+		if err := node.Start(context.Background()); err != nil {
+			t.Fatalf("failed to start node %d: %v", i, err)
+		}
+		t.Cleanup(func() { node.Stop() })
+		c.nodes[i] = node
+	}
+	return c
+}
+
+// track follows the peer events of node i to know which links are up
+func (c *Cluster) track(i int, node *p2p.Network) {
+	events, unsubscribe := node.Subscribe(64)
+	c.t.Cleanup(unsubscribe)
+
+	go func() {
+		for evt := range events {
+			c.mu.Lock()
+			switch evt.Type {
+			case p2p.EventPeerConnected:
+				c.connected[i][evt.PeerID] = true
+			case p2p.EventPeerDisconnected:
+				delete(c.connected[i], evt.PeerID)
+			}
+			c.mu.Unlock()
+		}
+	}()
+}
+
+// Size returns the number of nodes
+func (c *Cluster) Size() int {
+	return len(c.nodes)
+}
+
+// Node returns node i
+func (c *Cluster) Node(i int) *p2p.Network {
+	return c.nodes[i]
+}
+
+// Nodes returns all nodes in order
+func (c *Cluster) Nodes() []*p2p.Network {
+	return append([]*p2p.Network(nil), c.nodes...)
+}
+
+// Host returns the node ID and host name of node i
+func (c *Cluster) Host(i int) string {
+	return fmt.Sprintf("node-%d", i)
+}
+
+// Addr returns the address node i accepts connections on
+func (c *Cluster) Addr(i int) string {
+	return c.nodes[i].ListenAddr().String()
+}
+
+// Connected reports whether node i currently has a connection to node j
+func (c *Cluster) Connected(i, j int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected[i][c.Host(j)]
+}
+
+// Connect dials node j from node i and waits until both have exchanged HELLOs
+func (c *Cluster) Connect(i, j int) {
+	c.t.Helper()
+	if _, err := c.nodes[i].Connect(context.Background(), c.Addr(j)); err != nil {
+		c.t.Fatalf("node %d failed to dial node %d: %v", i, j, err)
+	}
+	c.waitFor(func() bool { return c.Connected(i, j) && c.Connected(j, i) },
+		"nodes %d and %d did not connect", i, j)
+}
+
+// ConnectAll links every pair of nodes
+func (c *Cluster) ConnectAll() {
+	c.t.Helper()
+	for i := range c.nodes {
+		for j := i + 1; j < len(c.nodes); j++ {
+			c.Connect(i, j)
+		}
+	}
+}
+
+// ConnectLine links each node to the next, so messages from node 0 need
+// Size()-1 hops to reach the last node
+func (c *Cluster) ConnectLine() {
+	c.t.Helper()
+	for i := 0; i+1 < len(c.nodes); i++ {
+		c.Connect(i, i+1)
+	}
+}
+
+// Cut drops the link between nodes i and j and waits until both notice.
+// Dials between them fail until the link is healed.
+func (c *Cluster) Cut(i, j int) {
+	c.t.Helper()
+	c.Net.Cut(c.Host(i), c.Host(j))
+	c.waitFor(func() bool { return !c.Connected(i, j) && !c.Connected(j, i) },
+		"nodes %d and %d did not notice the cut link", i, j)
+}
+
+// Heal lets nodes i and j reach each other again. It does not reconnect them.
+func (c *Cluster) Heal(i, j int) {
+	c.Net.Heal(c.Host(i), c.Host(j))
+}
+
+// SetLatency delays traffic between nodes i and j by d in both directions
+func (c *Cluster) SetLatency(i, j int, d time.Duration) {
+	c.Net.SetLatency(c.Host(i), c.Host(j), d)
+}
+
+// Partition splits the cluster into groups of node indexes that cannot
+// reach each other, and waits until every node noticed its lost links
+func (c *Cluster) Partition(groups ...[]int) {
+	c.t.Helper()
+	for g, group := range groups {
+		for _, other := range groups[g+1:] {
+			for _, i := range group {
+				for _, j := range other {
+					c.Cut(i, j)
+				}
+			}
+		}
+	}
+}
+
+// HealAll lets every node reach every other again. Links are not
+// reconnected.
+func (c *Cluster) HealAll() {
+	c.Net.HealAll()
+}
+
+// waitFor polls cond until it holds or DefaultWaitTimeout passes
+func (c *Cluster) waitFor(cond func() bool, format string, args ...interface{}) {
+	c.t.Helper()
+	deadline := time.Now().Add(DefaultWaitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,113 @@
+package p2ptest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordRumors counts the RUMOR messages each node receives
+func recordRumors(c *Cluster) func() map[string]int {
+	var mu sync.Mutex
+	deliveries := make(map[string]int)
+	for _, node := range c.Nodes() {
+		id := node.NodeID()
+		node.RegisterHandler("RUMOR", func(msg p2p.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			deliveries[id]++
+		})
+	}
+	return func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		snapshot := make(map[string]int, len(deliveries))
+		for id, count := range deliveries {
+			snapshot[id] = count
+		}
+		return snapshot
+	}
+}
+
+func TestClusterGossipOverLine(t *testing.T) {
+	cluster := NewCluster(t, 5)
+	cluster.ConnectLine()
+	deliveries := recordRumors(cluster)
+
+	msg := p2p.NewMessage("RUMOR", cluster.Host(0), nil)
+	require.NoError(t, cluster.Node(0).Gossip(msg, 2))
+
+	require.Eventually(t, func() bool {
+		return len(deliveries()) == cluster.Size()-1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.NotContains(t, deliveries(), cluster.Host(0))
+}
+
+func TestClusterPartitionAndHeal(t *testing.T) {
+	cluster := NewCluster(t, 4)
+	cluster.ConnectAll()
+	deliveries := recordRumors(cluster)
+
+	cluster.Partition([]int{0, 1}, []int{2, 3})
+	assert.True(t, cluster.Connected(0, 1))
+	assert.True(t, cluster.Connected(2, 3))
+	assert.False(t, cluster.Connected(1, 2))
+
+	// Gossip stays on its side of the partition
+	require.NoError(t, cluster.Node(0).Gossip(p2p.NewMessage("RUMOR", cluster.Host(0), nil), 3))
+	require.Eventually(t, func() bool {
+		return deliveries()[cluster.Host(1)] == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	assert.NotContains(t, deliveries(), cluster.Host(2))
+	assert.NotContains(t, deliveries(), cluster.Host(3))
+
+	// Dials across the partition fail until it heals
+	_, err := cluster.Node(1).Connect(context.Background(), cluster.Addr(2))
+	assert.Error(t, err)
+	cluster.HealAll()
+	cluster.Connect(1, 2)
+
+	require.NoError(t, cluster.Node(0).Gossip(p2p.NewMessage("RUMOR", cluster.Host(0), nil), 3))
+	require.Eventually(t, func() bool {
+		got := deliveries()
+		return got[cluster.Host(2)] == 1 && got[cluster.Host(3)] == 1
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestClusterLatency(t *testing.T) {
+	cluster := NewCluster(t, 2)
+	cluster.Connect(0, 1)
+
+	const delay = 150 * time.Millisecond
+	cluster.SetLatency(0, 1, delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := cluster.Node(0).Request(ctx, cluster.Host(1), p2p.NewMessage(p2p.MessageTypePing, cluster.Host(0), nil))
+	require.NoError(t, err)
+
+	// The ping and its pong each cross the slow link once
+	assert.GreaterOrEqual(t, time.Since(start), 2*delay)
+}
+
+func TestClusterCutLink(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	cluster.ConnectAll()
+
+	cluster.Cut(0, 1)
+	assert.False(t, cluster.Connected(0, 1))
+	assert.True(t, cluster.Connected(0, 2))
+	assert.True(t, cluster.Connected(1, 2))
+	_, err := cluster.Node(0).Connect(context.Background(), cluster.Addr(1))
+	assert.Error(t, err)
+
+	cluster.Heal(0, 1)
+	cluster.Connect(0, 1)
+}
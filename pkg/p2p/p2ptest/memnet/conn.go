@@ -0,0 +1,265 @@
+package memnet
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// chunk is written data that becomes readable once the link latency passed
+type chunk struct {
+	data  []byte
+	ready time.Time
+}
+
+// stream is one direction of a connection. Writes are buffered so both ends
+// can write at once without waiting for each other, unlike net.Pipe.
+type stream struct {
+	mu     sync.Mutex
+	chunks []chunk
+	eof    bool // the writing end closed
+	gone   bool // the reading end closed
+	broken bool // the link was cut
+	signal chan struct{}
+	// holding keeps writes in held rather than chunks, until released
+	holding bool
+	held    [][]byte
+}
+
+// newStream returns an empty stream
+func newStream() *stream {
+	return &stream{signal: make(chan struct{}, 1)}
+}
+
+// wake tells a blocked reader the stream changed
+func (s *stream) wake() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// conn is one end of an in-memory connection
+type conn struct {
+	network *Network
+	link    link
+	local   Addr
+	remote  Addr
+	in      *stream
+	out     *stream
+
+	mu            sync.Mutex
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// newPipe connects a client and a server end over link l
+func newPipe(n *Network, l link, client, server Addr) (*conn, *conn) {
+	up, down := newStream(), newStream()
+	return &conn{network: n, link: l, local: client, remote: server, in: down, out: up},
+		&conn{network: n, link: l, local: server, remote: client, in: up, out: down}
+}
+
+// Read reads data that has arrived, waiting for it if there is none yet
+func (c *conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		closed, deadline := c.closed, c.readDeadline
+		c.mu.Unlock()
+		if closed {
+			return 0, c.opError("read", net.ErrClosed)
+		}
+
+		now := time.Now()
+		s := c.in
+		s.mu.Lock()
+		if s.broken {
+			s.mu.Unlock()
+			return 0, c.opError("read", ErrLinkDown)
+		}
+		if len(s.chunks) > 0 && !s.chunks[0].ready.After(now) {
+			read := copy(p, s.chunks[0].data)
+			s.chunks[0].data = s.chunks[0].data[read:]
+			if len(s.chunks[0].data) == 0 {
+				s.chunks = s.chunks[1:]
+			}
+			s.mu.Unlock()
+			return read, nil
+		}
+		if len(s.chunks) == 0 && s.eof {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		wait := time.Duration(-1)
+		if len(s.chunks) > 0 {
+			wait = s.chunks[0].ready.Sub(now)
+		}
+		s.mu.Unlock()
+
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(now)
+			if remaining <= 0 {
+				return 0, c.opError("read", os.ErrDeadlineExceeded)
+			}
+			if wait < 0 || remaining < wait {
+				wait = remaining
+			}
+		}
+
+		if wait < 0 {
+			<-s.signal
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.signal:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Write queues p for the other end, readable after the link latency
+func (c *conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.mu.Unlock()
+	if closed {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	}
+
+	ready := time.Now().Add(c.network.linkLatency(c.link))
+	s := c.out
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.broken:
+		return 0, c.opError("write", ErrLinkDown)
+	case s.gone:
+		return 0, c.opError("write", io.ErrClosedPipe)
+	}
+	if s.holding {
+		s.held = append(s.held, append([]byte(nil), p...))
+		return len(p), nil
+	}
+	s.appendChunk(append([]byte(nil), p...), ready)
+	return len(p), nil
+}
+
+// appendChunk makes data readable at ready, or after the data written before
+// it if that is later, so data never overtakes earlier writes even if the
+// latency dropped. s.mu must be held.
+func (s *stream) appendChunk(data []byte, ready time.Time) {
+	if last := len(s.chunks) - 1; last >= 0 && s.chunks[last].ready.After(ready) {
+		ready = s.chunks[last].ready
+	}
+	s.chunks = append(s.chunks, chunk{data: data, ready: ready})
+	s.wake()
+}
+
+// release makes the held writes readable in the order reorder returns them
+// in, and stops holding writes back
+func (s *stream) release(ready time.Time, reorder func(writes [][]byte) [][]byte) {
+	s.mu.Lock()
+	writes := s.held
+	s.held = nil
+	s.mu.Unlock()
+
+	// Writes made while reorder runs are still held, and follow
+	if reorder != nil {
+		writes = reorder(writes)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writes = append(writes, s.held...)
+	s.held, s.holding = nil, false
+	if s.broken || s.gone {
+		return
+	}
+	for _, data := range writes {
+		s.appendChunk(data, ready)
+	}
+}
+
+// Close closes this end. The other end reads what was already written and
+// then EOF.
+func (c *conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.out.mu.Lock()
+	c.out.eof = true
+	c.out.wake()
+	c.out.mu.Unlock()
+
+	c.in.mu.Lock()
+	c.in.gone = true
+	c.in.chunks = nil
+	c.in.wake()
+	c.in.mu.Unlock()
+
+	c.network.forget(c)
+	return nil
+}
+
+// reset breaks both directions, dropping data in flight, as when a link is cut
+func (c *conn) reset() {
+	for _, s := range []*stream{c.in, c.out} {
+		s.mu.Lock()
+		s.broken = true
+		s.chunks = nil
+		s.wake()
+		s.mu.Unlock()
+	}
+}
+
+// LocalAddr returns this end's address
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the other end's address
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets when blocked and future reads time out
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.in.wake()
+	return nil
+}
+
+// SetWriteDeadline sets when future writes time out. Writes never block, so
+// only a deadline already passed has an effect.
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// opError wraps err the way net connections report failures
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "memnet", Source: c.local, Addr: c.remote, Err: err}
+}
@@ -0,0 +1,351 @@
+// Package memnet is an in-memory network of named hosts exchanging byte
+// streams, with hooks to cut links, add latency, partition hosts, reorder
+// writes and inject faults. It lets tests run many p2p nodes without opening
+// sockets.
+package memnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/faults"
+)
+
+// firstEphemeralPort is the first port handed to listeners asking for port 0
+// and to the dialing end of connections
+const firstEphemeralPort = 49152
+
+var (
+	// ErrConnectionRefused is returned when dialing an address nobody listens on
+	ErrConnectionRefused = errors.New("memnet: connection refused")
+	// ErrLinkDown is returned when the link between two hosts is cut
+	ErrLinkDown = errors.New("memnet: link down")
+	// ErrAddressInUse is returned when listening on a taken port. It
+	// matches syscall.EADDRINUSE, as binding a taken TCP port does.
+	ErrAddressInUse = fmt.Errorf("memnet: %w", syscall.EADDRINUSE)
+)
+
+// link identifies the connection between two hosts regardless of direction
+type link struct {
+	a, b string
+}
+
+// newLink returns the link between hosts a and b
+func newLink(a, b string) link {
+	if b < a {
+		a, b = b, a
+	}
+	return link{a: a, b: b}
+}
+
+// Network is a set of hosts that can reach each other in memory
+type Network struct {
+	mu        sync.Mutex
+	listeners map[string]*listener
+	conns     map[*conn]link
+	ports     map[string]int
+	down      map[link]bool
+	latency   map[link]time.Duration
+	injectors map[string]*faults.Injector
+}
+
+// New creates an empty in-memory network
+func New() *Network {
+	return &Network{
+		listeners: make(map[string]*listener),
+		conns:     make(map[*conn]link),
+		ports:     make(map[string]int),
+		down:      make(map[link]bool),
+		latency:   make(map[link]time.Duration),
+		injectors: make(map[string]*faults.Injector),
+	}
+}
+
+// Host returns the endpoint for the host called name. Hosts need no setup;
+// any name can listen and dial.
+func (n *Network) Host(name string) *Host {
+	return &Host{network: n, name: name}
+}
+
+// Cut takes the link between hosts a and b down. Open connections between
+// them are reset and new dials fail until the link is healed.
+func (n *Network) Cut(a, b string) {
+	n.mu.Lock()
+	l := newLink(a, b)
+	n.down[l] = true
+	var reset []*conn
+	for c, cl := range n.conns {
+		if cl == l {
+			reset = append(reset, c)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, c := range reset {
+		c.reset()
+	}
+}
+
+// Heal brings the link between hosts a and b back up
+func (n *Network) Heal(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.down, newLink(a, b))
+}
+
+// Partition cuts every link between hosts in different groups. Links within
+// a group, and to hosts in no group, are left alone.
+func (n *Network) Partition(groups ...[]string) {
+	for i, group := range groups {
+		for _, other := range groups[i+1:] {
+			for _, a := range group {
+				for _, b := range other {
+					n.Cut(a, b)
+				}
+			}
+		}
+	}
+}
+
+// HealAll brings every cut link back up
+func (n *Network) HealAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down = make(map[link]bool)
+}
+
+// SetLatency delays every write between hosts a and b by d, in both
+// directions. Zero removes the delay.
+func (n *Network) SetLatency(a, b string, d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if d <= 0 {
+		delete(n.latency, newLink(a, b))
+		return
+	}
+	n.latency[newLink(a, b)] = d
+}
+
+// Hold holds back what host from writes to host to on the connections open
+// between them, as if it were stuck in the network, until Release
+func (n *Network) Hold(from, to string) {
+	for _, c := range n.writers(from, to) {
+		c.out.mu.Lock()
+		c.out.holding = true
+		c.out.mu.Unlock()
+	}
+}
+
+// Release lets host to read what host from wrote to it since Hold. If
+// reorder is not nil it gets the writes held on each connection in the
+// order they were made and returns them in the order they arrive in, so
+// tests can reorder, drop or repeat them; each write arrives whole.
+func (n *Network) Release(from, to string, reorder func(writes [][]byte) [][]byte) {
+	for _, c := range n.writers(from, to) {
+		c.out.release(time.Now().Add(n.linkLatency(c.link)), reorder)
+	}
+}
+
+// Faults returns the injector of the frames host writes, e.g.
+// Faults("a").Set("b", faults.Faults{Drop: 0.2}) loses a fifth of what host
+// a writes to host b. Every connection of the host, open or yet to come,
+// goes through it. Its seed is the host's name, so a test sees the same
+// faults each run.
+func (n *Network) Faults(host string) *faults.Injector {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	injector := n.injectors[host]
+	if injector == nil {
+		seed := fnv.New64a()
+		seed.Write([]byte(host))
+		injector = faults.New(int64(seed.Sum64()))
+		n.injectors[host] = injector
+	}
+	return injector
+}
+
+// writers returns the ends of open connections host from writes to host to on
+func (n *Network) writers(from, to string) []*conn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var ends []*conn
+	for c := range n.conns {
+		if c.local.host() == from && c.remote.host() == to {
+			ends = append(ends, c)
+		}
+	}
+	return ends
+}
+
+// linkLatency returns the current delay of a link
+func (n *Network) linkLatency(l link) time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latency[l]
+}
+
+// allocatePort returns an unused port on host. Callers hold n.mu.
+func (n *Network) allocatePort(host string) int {
+	port := n.ports[host]
+	if port == 0 {
+		port = firstEphemeralPort
+	}
+	for n.listeners[net.JoinHostPort(host, strconv.Itoa(port))] != nil {
+		port++
+	}
+	n.ports[host] = port + 1
+	return port
+}
+
+// forget drops a closed connection
+func (n *Network) forget(c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.conns, c)
+}
+
+// Host is one named endpoint of a Network
+type Host struct {
+	network *Network
+	name    string
+}
+
+// Name returns the host's name, the host part of its addresses
+func (h *Host) Name() string {
+	return h.name
+}
+
+// Listen accepts connections on a port of this host. The host part of
+// address is ignored, so ":0" picks a free port like it does for TCP.
+func (h *Host) Listen(address string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("memnet: invalid listen address %q: %w", address, err)
+	}
+	portNum := 0
+	if port != "" {
+		if portNum, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("memnet: invalid port %q: %w", port, err)
+		}
+	}
+
+	n := h.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if portNum == 0 {
+		portNum = n.allocatePort(h.name)
+	}
+	local := net.JoinHostPort(h.name, strconv.Itoa(portNum))
+	if n.listeners[local] != nil {
+		return nil, fmt.Errorf("listen %s: %w", local, ErrAddressInUse)
+	}
+
+	l := &listener{
+		network: n,
+		addr:    Addr(local),
+		accept:  make(chan *conn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[local] = l
+	return l, nil
+}
+
+// Dial connects to a host:port address on the same network
+func (h *Host) Dial(ctx context.Context, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("memnet: invalid address %q: %w", address, err)
+	}
+
+	n := h.network
+	n.mu.Lock()
+	l := newLink(h.name, host)
+	if n.down[l] {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("dial %s: %w", address, ErrLinkDown)
+	}
+	target := n.listeners[address]
+	if target == nil {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("dial %s: %w", address, ErrConnectionRefused)
+	}
+	local := Addr(net.JoinHostPort(h.name, strconv.Itoa(n.allocatePort(h.name))))
+	client, server := newPipe(n, l, local, Addr(address))
+	n.conns[client] = l
+	n.conns[server] = l
+	n.mu.Unlock()
+
+	select {
+	case target.accept <- server:
+		return n.Faults(h.name).Wrap(client), nil
+	case <-target.done:
+		err = ErrConnectionRefused
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	client.Close()
+	server.Close()
+	return nil, fmt.Errorf("dial %s: %w", address, err)
+}
+
+// Addr is a host:port address on a memnet Network
+type Addr string
+
+// Network returns the address's network name
+func (a Addr) Network() string {
+	return "memnet"
+}
+
+// String returns the address as host:port
+func (a Addr) String() string {
+	return string(a)
+}
+
+// host returns the name of the host the address is on
+func (a Addr) host() string {
+	host, _, _ := net.SplitHostPort(string(a))
+	return host
+}
+
+// listener accepts connections on one host port
+type listener struct {
+	network *Network
+	addr    Addr
+	accept  chan *conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Accept waits for the next connection
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return l.network.Faults(l.addr.host()).Wrap(c), nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "memnet", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting and frees the port
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+// Addr returns the address the listener accepts on
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,239 @@
+package memnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/faults"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connect dials from host a to a listener on host b and returns both ends
+func connect(t *testing.T, network *Network, a, b string) (net.Conn, net.Conn) {
+	listener, err := network.Host(b).Listen(":0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	client, err := network.Host(a).Dial(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case server := <-accepted:
+		t.Cleanup(func() { server.Close() })
+		return client, server
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+		return nil, nil
+	}
+}
+
+func TestDialAndExchange(t *testing.T) {
+	network := New()
+	client, server := connect(t, network, "alpha", "beta")
+
+	host, _, err := net.SplitHostPort(client.LocalAddr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "alpha", host)
+	assert.Equal(t, client.LocalAddr().String(), server.RemoteAddr().String())
+
+	// Both ends can write before either reads
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = server.Write([]byte("pong"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buf))
+
+	// Closing one end delivers EOF to the other
+	require.NoError(t, client.Close())
+	_, err = server.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	_, err = client.Read(buf)
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestDialWithoutListener(t *testing.T) {
+	network := New()
+	_, err := network.Host("alpha").Dial(context.Background(), "beta:9000")
+	assert.ErrorIs(t, err, ErrConnectionRefused)
+
+	listener, err := network.Host("beta").Listen(":9000")
+	require.NoError(t, err)
+	assert.Equal(t, "beta:9000", listener.Addr().String())
+	_, err = network.Host("beta").Listen(":9000")
+	assert.ErrorIs(t, err, ErrAddressInUse)
+
+	require.NoError(t, listener.Close())
+	_, err = listener.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestReadDeadline(t *testing.T) {
+	network := New()
+	client, _ := connect(t, network, "alpha", "beta")
+
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	start := time.Now()
+	_, err := client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestLatency(t *testing.T) {
+	network := New()
+	client, server := connect(t, network, "alpha", "beta")
+
+	const delay = 100 * time.Millisecond
+	network.SetLatency("beta", "alpha", delay)
+
+	start := time.Now()
+	_, err := client.Write([]byte("slow"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), delay)
+
+	// Lowering the latency never reorders data already in flight
+	_, err = client.Write([]byte("a"))
+	require.NoError(t, err)
+	network.SetLatency("alpha", "beta", 0)
+	_, err = client.Write([]byte("b"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(server, buf[:2])
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(buf[:2]))
+}
+
+func TestHoldAndRelease(t *testing.T) {
+	network := New()
+	client, server := connect(t, network, "alpha", "beta")
+
+	network.Hold("alpha", "beta")
+	for _, write := range []string{"one", "two", "three"} {
+		_, err := client.Write([]byte(write))
+		require.NoError(t, err)
+	}
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := server.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded, "held writes are not readable")
+
+	// The other direction is not held
+	_, err = server.Write([]byte("back"))
+	require.NoError(t, err)
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(client, buf[:4])
+	require.NoError(t, err)
+	assert.Equal(t, "back", string(buf[:4]))
+
+	network.Release("alpha", "beta", func(writes [][]byte) [][]byte {
+		for i, j := 0, len(writes)-1; i < j; i, j = i+1, j-1 {
+			writes[i], writes[j] = writes[j], writes[i]
+		}
+		return writes
+	})
+	_, err = client.Write([]byte("!"))
+	require.NoError(t, err)
+	require.NoError(t, server.SetReadDeadline(time.Time{}))
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "threetwoone", string(buf))
+	_, err = io.ReadFull(server, buf[:1])
+	require.NoError(t, err)
+	assert.Equal(t, "!", string(buf[:1]))
+}
+
+func TestCutAndHeal(t *testing.T) {
+	network := New()
+	client, server := connect(t, network, "alpha", "beta")
+
+	network.Cut("alpha", "beta")
+	_, err := server.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrLinkDown)
+	_, err = client.Write([]byte("lost"))
+	assert.ErrorIs(t, err, ErrLinkDown)
+
+	listener, err := network.Host("beta").Listen(":0")
+	require.NoError(t, err)
+	defer listener.Close()
+	_, err = network.Host("alpha").Dial(context.Background(), listener.Addr().String())
+	assert.ErrorIs(t, err, ErrLinkDown)
+
+	network.Heal("beta", "alpha")
+	connect(t, network, "alpha", "beta")
+}
+
+func TestPartition(t *testing.T) {
+	network := New()
+	network.Partition([]string{"a", "b"}, []string{"c"})
+
+	listener, err := network.Host("c").Listen(":0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	for _, host := range []string{"a", "b"} {
+		_, err := network.Host(host).Dial(context.Background(), listener.Addr().String())
+		assert.ErrorIs(t, err, ErrLinkDown, "host %s crossed the partition", host)
+	}
+
+	// Hosts on the same side, and outside any group, still connect
+	connect(t, network, "a", "b")
+	connect(t, network, "d", "c")
+
+	network.HealAll()
+	connect(t, network, "a", "c")
+}
+
+func TestFaults(t *testing.T) {
+	network := New()
+	client, server := connect(t, network, "alpha", "beta")
+
+	// Faults set for a host hit what it writes, not what it reads
+	network.Faults("alpha").Set("beta", faults.Faults{Corrupt: 1})
+	_, err := client.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = server.Write([]byte("pong"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	assert.NotEqual(t, "ping", string(buf))
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buf))
+	assert.Equal(t, uint64(1), network.Faults("alpha").Stats().Corrupted)
+
+	// Connections of the host opened later go through the same injector
+	network.Faults("alpha").Set("beta", faults.Faults{Drop: 1})
+	client, server = connect(t, network, "alpha", "beta")
+	_, err = client.Write([]byte("lost"))
+	require.NoError(t, err)
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = server.Read(buf)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
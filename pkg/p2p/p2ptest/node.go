@@ -0,0 +1,83 @@
+package p2ptest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+)
+
+// Node is a network started by StartNode, with the config and logger it was
+// created with, for the services a test builds on it
+type Node struct {
+	Network *p2p.Network
+	Config  *config.Config
+	Logger  *logger.Logger
+}
+
+// NodeOption adjusts how StartNode creates and starts a node
+type NodeOption func(*nodeOptions)
+
+type nodeOptions struct {
+	configure   []func(cfg *config.Config)
+	beforeStart []func(node *Node)
+}
+
+// WithConfig lets fn adjust the node's config before its network is created
+func WithConfig(fn func(cfg *config.Config)) NodeOption {
+	return func(o *nodeOptions) { o.configure = append(o.configure, fn) }
+}
+
+// WithDataDir keeps the node's state in dir rather than a new temporary
+// directory, so a node restarted on it keeps its key and data
+func WithDataDir(dir string) NodeOption {
+	return WithConfig(func(cfg *config.Config) { cfg.Storage.DataDir = dir })
+}
+
+// BeforeStart runs fn once the node's network is created, before it starts,
+// to attach storage and the services under test. Cleanups fn registers run
+// before the network is stopped.
+func BeforeStart(fn func(node *Node)) NodeOption {
+	return func(o *nodeOptions) { o.beforeStart = append(o.beforeStart, fn) }
+}
+
+// StartNode starts a network on an ephemeral loopback port, with mDNS off so
+// it only meets the peers a test connects it to. The network is stopped when
+// the test ends.
+func StartNode(t testing.TB, ctx context.Context, nodeID string, opts ...NodeOption) *Node {
+	t.Helper()
+
+	var options nodeOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.P2P.EnableDiscovery = false
+	cfg.Storage.DataDir = t.TempDir()
+	for _, fn := range options.configure {
+		fn(cfg)
+	}
+
+	log, err := logger.New("error", "json", "")
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+	network, err := p2p.New(cfg, log, nodeID)
+	if err != nil {
+		t.Fatalf("failed to create node %s: %v", nodeID, err)
+	}
+	t.Cleanup(func() { network.Stop() })
+
+	node := &Node{Network: network, Config: cfg, Logger: log}
+	for _, fn := range options.beforeStart {
+		fn(node)
+	}
+	if err := network.Start(ctx); err != nil {
+		t.Fatalf("failed to start node %s: %v", nodeID, err)
+	}
+	return node
+}
@@ -0,0 +1,33 @@
+package p2ptest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartNode(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	var listening bool
+	node := StartNode(t, ctx, "started-node",
+		WithDataDir(dir),
+		WithConfig(func(cfg *config.Config) { cfg.P2P.MaxPeers = 7 }),
+		BeforeStart(func(node *Node) { listening = node.Network.ListenAddr() != nil }))
+	assert.False(t, listening, "BeforeStart ran after the network started")
+	assert.Equal(t, dir, node.Config.Storage.DataDir)
+	assert.Equal(t, 7, node.Config.P2P.MaxPeers)
+	assert.False(t, node.Config.P2P.EnableDiscovery)
+
+	other := StartNode(t, ctx, "other-node")
+	_, err := other.Network.Connect(ctx, node.Network.ListenAddr().String())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(node.Network.ConnectedPeers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+}
@@ -1,12 +1,20 @@
 package p2p
 
 import (
+	"bufio"
+	"crypto/rsa"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/session"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
 )
 
-// Connection represents a connection to a peer
+// Connection represents a connection to a peer. LastSeen is when we last
+// received a message over it, by our clock; timestamps the peer puts in its
+// messages never move it.
 type Connection struct {
 	ID        string
 	PeerID    string
@@ -14,7 +22,204 @@ type Connection struct {
 	Conn      net.Conn
 	CreatedAt time.Time
 	LastSeen  time.Time
-	mu        sync.RWMutex
+	Outbound  bool
+	// session runs the handshake and the read loop over Conn
+	session *session.Session
+	// identity is the key the peer proved in the handshake
+	identity *rsa.PublicKey
+	// quic carries the peer's messages once the connection is upgraded
+	quic *quicSession
+	// codec encodes messages to the peer once HELLOs are exchanged
+	codec Codec
+	// expectedPeerID, if set, is the only node an outgoing handshake accepts
+	expectedPeerID string
+	// closeReason says why the connection was closed, once it is, and
+	// closeTraceID is the trace of the message that closed it, if one did
+	closeReason  string
+	closeTraceID string
+	// established is set once the handshake registered the peer on the
+	// connection, and closed once the connection is closed
+	established bool
+	closed      bool
+	// writeTimeouts counts the writes in a row that timed out; slow is set
+	// once there were enough of them, until a write succeeds
+	writeTimeouts int
+	slow          bool
+	// lastWrite is when a message other than a heartbeat or ping was last
+	// written to the peer
+	lastWrite time.Time
+	// rate meters the messages the peer sends us
+	rate peerRate
+	// batcher coalesces messages to the peer, if it unpacks batches
+	batcher *batcher
+	// sent numbers the application messages sent to the peer, and order
+	// puts those it sends us back in sequence under ordered delivery
+	sent  atomic.Uint64
+	order *reorderBuffer
+	// inflight counts the reliable sends over the connection that are
+	// waiting for the peer's acknowledgement
+	inflight inflightSends
+	// dialStarted is when we started dialing the peer, zero if the peer
+	// dialed us; handshakeDone and tornDown are when the handshake completed
+	// and when the connection was torn down
+	dialStarted   time.Time
+	handshakeDone time.Time
+	tornDown      time.Time
+	mu            sync.RWMutex
+}
+
+// Reader returns the buffered reader for the connection. The handshake and
+// the message loop share it so bytes buffered during one are not lost to the other.
+func (c *Connection) Reader() *bufio.Reader {
+	return c.Session().Reader()
+}
+
+// Session returns the session running the connection, starting one with
+// no timeouts if the network did not set one up
+func (c *Connection) Session() *session.Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == nil {
+		c.session = session.New(c.Conn, session.Config{Decode: parseHandshakeMessage})
+	}
+	return c.session
+}
+
+// Transport returns the transport messages to the peer currently use
+func (c *Connection) Transport() string {
+	if c.QUIC() != nil {
+		return TransportQUIC
+	}
+	return TransportTCP
+}
+
+// QUIC returns the connection's QUIC session, or nil while it uses TCP only
+func (c *Connection) QUIC() *quicSession {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.quic
+}
+
+// setQUIC routes the connection's messages over session
+func (c *Connection) setQUIC(session *quicSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quic = session
+}
+
+// clearQUIC falls back to TCP if session is still the one in use
+func (c *Connection) clearQUIC(session *quicSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.quic == session {
+		c.quic = nil
+	}
+}
+
+// Codec returns the codec messages to the peer are encoded in
+func (c *Connection) Codec() Codec {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.codec == nil {
+		return CodecJSON
+	}
+	return c.codec
+}
+
+// setCodec switches the codec messages to the peer are encoded in
+func (c *Connection) setCodec(codec Codec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codec = codec
+}
+
+// Identity returns the key the peer proved, or announced rotating to since
+func (c *Connection) Identity() *rsa.PublicKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.identity
+}
+
+// setIdentity replaces the key the peer is known by
+func (c *Connection) setIdentity(key *rsa.PublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.identity = key
+}
+
+// closeWith closes the connection, recording reason as why unless an
+// earlier reason was recorded
+func (c *Connection) closeWith(reason string) {
+	c.setCloseReason(reason)
+	c.markClosed()
+	c.Conn.Close()
+}
+
+// closeFor closes the connection on account of msg, recording reason as
+// why unless an earlier reason was recorded
+func (c *Connection) closeFor(msg *Message, reason string) {
+	c.mu.Lock()
+	if c.closeReason == "" {
+		c.closeTraceID = msg.TraceID
+	}
+	c.mu.Unlock()
+	c.closeWith(reason)
+}
+
+// markEstablished records that the handshake on the connection completed
+func (c *Connection) markEstablished() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.established = true
+}
+
+// markClosed records that the connection is closed, or about to be, so it
+// no longer counts as active
+func (c *Connection) markClosed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+// isClosed reports whether the connection was closed
+func (c *Connection) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+// active reports whether the handshake on the connection completed and it
+// was not closed since, so messages can still be read from it
+func (c *Connection) active() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.established && !c.closed
+}
+
+// setCloseReason records why the connection is closing; the first reason
+// recorded is kept
+func (c *Connection) setCloseReason(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+}
+
+// CloseReason returns why the connection was closed, or "" if no reason
+// was recorded
+func (c *Connection) CloseReason() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closeReason
+}
+
+// closeTrace returns the trace ID of the message the connection was closed
+// on account of, or ""
+func (c *Connection) closeTrace() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closeTraceID
 }
 
 // UpdateLastSeen updates the last seen timestamp
@@ -24,14 +229,30 @@ func (c *Connection) UpdateLastSeen() {
 	c.LastSeen = time.Now()
 }
 
-// IsActive checks if the connection is still active based on timeout
+// markWritten records that a message was written to the peer
+func (c *Connection) markWritten() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastWrite = time.Now()
+}
+
+// lastSeen returns when the connection last carried a message
+func (c *Connection) lastSeen() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.LastSeen
+}
+
+// IsActive reports whether a message was received from the peer within
+// timeout, or one other than a heartbeat or ping written to it
 func (c *Connection) IsActive(timeout time.Duration) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return time.Since(c.LastSeen) < timeout
+	return time.Since(c.LastSeen) < timeout || time.Since(c.lastWrite) < timeout
 }
 
-// Peer represents a peer in the network
+// Peer represents a peer in the network. LastSeen, like its connection's,
+// is by our clock; liveness goes by the later of the two.
 type Peer struct {
 	ID          string
 	Address     string
@@ -39,7 +260,70 @@ type Peer struct {
 	LastSeen    time.Time
 	ConnectedAt time.Time
 	Connection  *Connection
-	mu          sync.RWMutex
+	// Capabilities advertised by the peer in its HELLO; nil until received
+	Capabilities []string
+	// listenAddress is where the peer accepts connections: the address we
+	// dialed, or for a peer that dialed us, the port its HELLO advertises
+	// on the host it connected from
+	listenAddress string
+	errorCount    uint64
+
+	// advertisedMetadata is what the peer says about itself in its HELLO;
+	// localMetadata is what we label it with and takes precedence
+	advertisedMetadata map[string]string
+	localMetadata      map[string]string
+
+	// clockSkew estimates how far the peer's clock is ahead of ours, from
+	// the timestamps of its heartbeats
+	clockSkew      time.Duration
+	clockSamples   int
+	skewViolations uint64
+
+	// rumoredAt is the latest time other peers vouch they heard from the
+	// peer, as weighed by hearRumor
+	rumoredAt time.Time
+
+	// topics are the topics the peer's last heartbeat said it subscribes to
+	topics map[string]bool
+	mu     sync.RWMutex
+}
+
+// PeerSnapshot is a copy of a peer's state at one moment, safe to keep and
+// read while the peer itself changes
+type PeerSnapshot struct {
+	ID string
+	// Address is the address the peer is connected from or was dialed at;
+	// DialAddress is where other nodes can connect to it
+	Address     string
+	DialAddress string
+	Version     string
+	LastSeen    time.Time
+	ConnectedAt time.Time
+	// Connected is false once the peer's connection is gone
+	Connected bool
+	// Reputation is on the -1.0 to 1.0 scale
+	Reputation   float64
+	Capabilities []string
+	Metadata     map[string]string
+	// Flaps is the peer's recent connection history and whether it is
+	// damped for flapping
+	Flaps FlapState
+}
+
+// HasCapability reports whether the peer advertised the named capability
+func (s PeerSnapshot) HasCapability(name string) bool {
+	for _, capability := range s.Capabilities {
+		if capability == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTag reports whether the peer's metadata carried a tag, either a key or
+// key=value
+func (s PeerSnapshot) HasTag(tag string) bool {
+	return topology.MatchesTags(s.Metadata, []string{tag})
 }
 
 // NewPeer creates a new peer instance
@@ -53,6 +337,54 @@ func NewPeer(id, address, version string) *Peer {
 	}
 }
 
+// snapshot copies the peer's state; the caller fills in its reputation
+func (p *Peer) snapshot() PeerSnapshot {
+	address, _ := p.shareableAddress()
+	capabilities := p.GetCapabilities()
+	metadata := p.Metadata()
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return PeerSnapshot{
+		ID:           p.ID,
+		Address:      p.Address,
+		DialAddress:  address,
+		Version:      p.Version,
+		LastSeen:     p.lastSeenLocked(),
+		ConnectedAt:  p.ConnectedAt,
+		Connected:    p.Connection != nil,
+		Capabilities: capabilities,
+		Metadata:     metadata,
+	}
+}
+
+// lastSeen returns when we last heard from the peer
+func (p *Peer) lastSeen() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lastSeenLocked()
+}
+
+// lastSeenLocked returns when we or, going by their rumors, other peers
+// last heard from the peer; callers must hold p.mu
+func (p *Peer) lastSeenLocked() time.Time {
+	if heard := p.heardLocked(); heard.After(p.rumoredAt) {
+		return heard
+	}
+	return p.rumoredAt
+}
+
+// heardLocked returns when we last heard from the peer ourselves, over its
+// connection or otherwise; callers must hold p.mu
+func (p *Peer) heardLocked() time.Time {
+	if p.Connection != nil {
+		if seen := p.Connection.lastSeen(); seen.After(p.LastSeen) {
+			return seen
+		}
+	}
+	return p.LastSeen
+}
+
 // UpdateLastSeen updates the last seen timestamp
 func (p *Peer) UpdateLastSeen() {
 	p.mu.Lock()
@@ -60,11 +392,27 @@ func (p *Peer) UpdateLastSeen() {
 	p.LastSeen = time.Now()
 }
 
-// IsAlive checks if the peer is still alive based on timeout
+// IsAlive checks if we heard from the peer, over its connection or
+// otherwise, within timeout
 func (p *Peer) IsAlive(timeout time.Duration) bool {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return time.Since(p.LastSeen) < timeout
+	return time.Since(p.lastSeenLocked()) < timeout
+}
+
+// clearConnection forgets conn, which has closed, unless the peer has
+// another connection by now. When we last heard from the peer is kept.
+func (p *Peer) clearConnection(conn *Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Connection != conn {
+		return
+	}
+	if seen := conn.lastSeen(); seen.After(p.LastSeen) {
+		p.LastSeen = seen
+	}
+	p.Connection = nil
 }
 
 // GetConnection returns the peer's connection
@@ -80,3 +428,139 @@ func (p *Peer) SetConnection(conn *Connection) {
 	defer p.mu.Unlock()
 	p.Connection = conn
 }
+
+// AtLeastVersion reports whether the negotiated protocol version is at least version
+func (p *Peer) AtLeastVersion(version string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	cmp, err := compareVersions(p.Version, version)
+	return err == nil && cmp >= 0
+}
+
+// IncrementErrorCount counts a message from this peer that we rejected
+func (p *Peer) IncrementErrorCount() {
+	atomic.AddUint64(&p.errorCount, 1)
+}
+
+// ErrorCount returns the number of messages from this peer that we rejected
+func (p *Peer) ErrorCount() uint64 {
+	return atomic.LoadUint64(&p.errorCount)
+}
+
+// RecordSkewViolation counts a message from this peer dated too far from
+// our clock and returns the total so far
+func (p *Peer) RecordSkewViolation() uint64 {
+	return atomic.AddUint64(&p.skewViolations, 1)
+}
+
+// AddClockSample folds one observation of how far the peer's clock is ahead
+// of ours into the smoothed skew estimate
+func (p *Peer) AddClockSample(offset time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.clockSamples == 0 {
+		p.clockSkew = offset
+	} else {
+		p.clockSkew += time.Duration(clockSkewSmoothing * float64(offset-p.clockSkew))
+	}
+	p.clockSamples++
+}
+
+// ClockSkew returns the estimated offset of the peer's clock from ours,
+// positive when it runs ahead, and false before any sample was taken
+func (p *Peer) ClockSkew() (time.Duration, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.clockSkew, p.clockSamples > 0
+}
+
+// SetCapabilities records the capabilities the peer advertised
+func (p *Peer) SetCapabilities(capabilities []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Capabilities = append([]string(nil), capabilities...)
+}
+
+// GetCapabilities returns a copy of the capabilities the peer advertised
+func (p *Peer) GetCapabilities() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string(nil), p.Capabilities...)
+}
+
+// HasCapability reports whether the peer advertised the named capability
+func (p *Peer) HasCapability(name string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, capability := range p.Capabilities {
+		if capability == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetListenAddress records the address the peer accepts connections on
+func (p *Peer) SetListenAddress(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listenAddress = address
+}
+
+// DialAddress returns an address other nodes can connect to the peer on
+func (p *Peer) DialAddress() string {
+	address, _ := p.shareableAddress()
+	return address
+}
+
+// shareableAddress returns the address to tell other nodes to dial the peer
+// on. ok is false for a peer that dialed us and has not sent its HELLO yet,
+// as all we know of it then is the ephemeral port it connected from.
+func (p *Peer) shareableAddress() (address string, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.listenAddress != "" {
+		return p.listenAddress, true
+	}
+	return p.Address, p.Connection == nil || p.Connection.Outbound
+}
+
+// Metadata returns a copy of the peer's metadata: the labels it advertised,
+// overridden by the ones we set locally
+func (p *Peer) Metadata() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	metadata := make(map[string]string, len(p.advertisedMetadata)+len(p.localMetadata))
+	for key, value := range p.advertisedMetadata {
+		metadata[key] = value
+	}
+	for key, value := range p.localMetadata {
+		metadata[key] = value
+	}
+	return metadata
+}
+
+// HasTag reports whether the peer's metadata carries a tag, either a key or
+// key=value
+func (p *Peer) HasTag(tag string) bool {
+	return topology.MatchesTags(p.Metadata(), []string{tag})
+}
+
+// setAdvertisedMetadata records the metadata the peer advertised
+func (p *Peer) setAdvertisedMetadata(metadata map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.advertisedMetadata = metadata
+}
+
+// setLocalMetadata records the labels we set on the peer
+func (p *Peer) setLocalMetadata(metadata map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.localMetadata = metadata
+}
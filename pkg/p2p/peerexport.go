@@ -0,0 +1,439 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+)
+
+// PeerListVersion is the version of the peer list file format written by
+// ExportPeers. ParsePeerList refuses files of any other version.
+const PeerListVersion = 1
+
+// PeerList is a node's remembered peers in a form another node can import,
+// e.g. to seed a node in a new region with the peers of an existing one:
+//
+//	{
+//	  "version": 1,
+//	  "exported_by": "node-a",
+//	  "exported_at": "2026-10-18T09:00:00Z",
+//	  "peers": [
+//	    {
+//	      "node_id": "node-b",
+//	      "addresses": ["10.0.0.2:8080"],
+//	      "key_fingerprint": "sha256:3f9a...",
+//	      "last_seen": "2026-10-18T08:59:12Z",
+//	      "reputation": 0.4
+//	    }
+//	  ]
+//	}
+type PeerList struct {
+	Version    int             `json:"version"`
+	ExportedBy string          `json:"exported_by,omitempty"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Peers      []PeerListEntry `json:"peers"`
+}
+
+// PeerListEntry is one peer of a peer list
+type PeerListEntry struct {
+	NodeID string `json:"node_id"`
+	// Addresses the peer may be reached at, best first
+	Addresses []string `json:"addresses"`
+	// KeyFingerprint is the fingerprint of the key the exporting node
+	// pinned for the peer, if it pinned one
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	LastSeen       time.Time `json:"last_seen"`
+	// Reputation is the exporting node's view of the peer, from -1 to 1.
+	// It is informational: importing nodes judge peers for themselves.
+	Reputation float64 `json:"reputation"`
+	// Record is the peer's own signed record, if the exporting node holds
+	// one. Importing nodes take the addresses it signs over Addresses.
+	Record *crypto.SignedPeerRecord `json:"record,omitempty"`
+}
+
+// validate checks the entry is one a node could import
+func (e *PeerListEntry) validate() error {
+	if e.NodeID == "" {
+		return fmt.Errorf("node_id is required")
+	}
+	if len(e.Addresses) == 0 {
+		return fmt.Errorf("peer %s has no addresses", e.NodeID)
+	}
+	for _, address := range e.Addresses {
+		if _, err := discovery.NormalizeAddress(address, DefaultListenPort); err != nil {
+			return fmt.Errorf("peer %s has an invalid address %q: %w", e.NodeID, address, err)
+		}
+	}
+	if e.KeyFingerprint != "" && !validFingerprint(e.KeyFingerprint) {
+		return fmt.Errorf("peer %s has an invalid key_fingerprint %q, expected sha256: and 64 hex digits", e.NodeID, e.KeyFingerprint)
+	}
+	if e.Reputation < -1 || e.Reputation > 1 {
+		return fmt.Errorf("peer %s has reputation %v outside -1 to 1", e.NodeID, e.Reputation)
+	}
+	if e.Record != nil && e.Record.NodeID != e.NodeID {
+		return fmt.Errorf("peer %s has the record of %q", e.NodeID, e.Record.NodeID)
+	}
+	return nil
+}
+
+// validFingerprint reports whether s is a key fingerprint as
+// crypto.KeyFingerprint writes them
+func validFingerprint(s string) bool {
+	digest, ok := strings.CutPrefix(s, "sha256:")
+	if !ok || len(digest) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+// Validate checks the list is of a version we read and every entry in it
+// is one a node could import
+func (l *PeerList) Validate() error {
+	if l.Version != PeerListVersion {
+		return fmt.Errorf("unsupported peer list version %d, expected %d", l.Version, PeerListVersion)
+	}
+	seen := make(map[string]bool, len(l.Peers))
+	for i := range l.Peers {
+		if err := l.Peers[i].validate(); err != nil {
+			return fmt.Errorf("peer %d: %w", i+1, err)
+		}
+		if seen[l.Peers[i].NodeID] {
+			return fmt.Errorf("peer %d: peer %s is listed twice", i+1, l.Peers[i].NodeID)
+		}
+		seen[l.Peers[i].NodeID] = true
+	}
+	return nil
+}
+
+// PeerListError is a peer list that failed to parse or validate, with where
+// in the file the problem is
+type PeerListError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *PeerListError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *PeerListError) Unwrap() error {
+	return e.Err
+}
+
+// ParsePeerList reads and validates a peer list file. Any problem is
+// returned as a *PeerListError locating it: at the offending JSON for
+// malformed files, or at the start of the offending entry.
+func ParsePeerList(data []byte) (*PeerList, error) {
+	p := &peerListParser{data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	p.dec.DisallowUnknownFields()
+	return p.parse()
+}
+
+// peerListParser walks a peer list file a field at a time, so problems can
+// be traced back to where they are in it
+type peerListParser struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+func (p *peerListParser) parse() (*PeerList, error) {
+	var list PeerList
+	if err := p.delim('{'); err != nil {
+		return nil, err
+	}
+	var hasVersion, hasPeers bool
+	for p.dec.More() {
+		fieldAt := p.dec.InputOffset()
+		token, err := p.dec.Token()
+		if err != nil {
+			return nil, p.decodeError(err, fieldAt)
+		}
+		field, _ := token.(string)
+		at := p.dec.InputOffset()
+		switch field {
+		case "version":
+			hasVersion = true
+			err = p.dec.Decode(&list.Version)
+		case "exported_by":
+			err = p.dec.Decode(&list.ExportedBy)
+		case "exported_at":
+			err = p.dec.Decode(&list.ExportedAt)
+		case "peers":
+			hasPeers = true
+			list.Peers, err = p.peers()
+		default:
+			return nil, p.errorAt(fieldAt, fmt.Errorf("unknown field %q", field))
+		}
+		if err != nil {
+			return nil, p.decodeError(fmt.Errorf("%s: %w", field, err), at)
+		}
+		if field == "version" && list.Version != PeerListVersion {
+			return nil, p.errorAt(at, fmt.Errorf("unsupported peer list version %d, expected %d", list.Version, PeerListVersion))
+		}
+	}
+	if err := p.delim('}'); err != nil {
+		return nil, err
+	}
+	if end := p.dec.InputOffset(); !errors.Is(p.nextError(), io.EOF) {
+		return nil, p.errorAt(end, fmt.Errorf("unexpected data after the peer list"))
+	}
+
+	end := int64(len(p.data))
+	if !hasVersion {
+		return nil, p.errorAt(end, fmt.Errorf("version is required"))
+	}
+	if !hasPeers {
+		return nil, p.errorAt(end, fmt.Errorf("peers is required"))
+	}
+	return &list, nil
+}
+
+// nextError reads the next token, returning only the error reading it
+func (p *peerListParser) nextError() error {
+	_, err := p.dec.Token()
+	return err
+}
+
+// peers reads the peers array, validating each entry where it starts
+func (p *peerListParser) peers() ([]PeerListEntry, error) {
+	if err := p.delim('['); err != nil {
+		return nil, err
+	}
+	peers := []PeerListEntry{}
+	seen := make(map[string]bool)
+	for p.dec.More() {
+		start := p.dec.InputOffset()
+		var entry PeerListEntry
+		if err := p.dec.Decode(&entry); err != nil {
+			return nil, p.decodeError(fmt.Errorf("peer %d: %w", len(peers)+1, err), start)
+		}
+		if err := entry.validate(); err != nil {
+			return nil, p.errorAt(start, fmt.Errorf("peer %d: %w", len(peers)+1, err))
+		}
+		if seen[entry.NodeID] {
+			return nil, p.errorAt(start, fmt.Errorf("peer %d: peer %s is listed twice", len(peers)+1, entry.NodeID))
+		}
+		seen[entry.NodeID] = true
+		peers = append(peers, entry)
+	}
+	return peers, p.delim(']')
+}
+
+// delim reads the delimiter want
+func (p *peerListParser) delim(want json.Delim) error {
+	at := p.dec.InputOffset()
+	token, err := p.dec.Token()
+	if err != nil {
+		return p.decodeError(err, at)
+	}
+	if token != want {
+		return p.errorAt(at, fmt.Errorf("expected %q", string(want)))
+	}
+	return nil
+}
+
+// decodeError locates an error the decoder returned: a syntax error where
+// the decoder found it, anything else at the value it was reading from at
+func (p *peerListParser) decodeError(err error, at int64) error {
+	var located *PeerListError
+	if errors.As(err, &located) {
+		return located
+	}
+	offset := at
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// The decoder reports the offset past the byte it choked on
+		offset = max(syntaxErr.Offset-1, 0)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		offset = int64(len(p.data))
+		err = fmt.Errorf("unexpected end of file")
+	}
+	return p.errorAt(offset, err)
+}
+
+// errorAt locates err at the first thing in the file from offset on, past
+// the whitespace and separators the decoder stops before
+func (p *peerListParser) errorAt(offset int64, err error) error {
+	if offset > int64(len(p.data)) {
+		offset = int64(len(p.data))
+	}
+	for offset < int64(len(p.data)) && strings.IndexByte(" \t\r\n,:", p.data[offset]) >= 0 {
+		offset++
+	}
+	line, column := 1, 1
+	for _, b := range p.data[:offset] {
+		if b == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return &PeerListError{Line: line, Column: column, Err: err}
+}
+
+// PeerImportResult is how a peer list was merged into the peer store
+type PeerImportResult struct {
+	// Added counts the peers we did not know of before
+	Added int `json:"added"`
+	// Updated counts the known peers the list gave new addresses for
+	Updated int `json:"updated"`
+	// Unchanged counts the known peers the list told us nothing new of
+	Unchanged int           `json:"unchanged"`
+	Skipped   []SkippedPeer `json:"skipped,omitempty"`
+}
+
+// SkippedPeer is an entry of a peer list that was not imported, and why
+type SkippedPeer struct {
+	NodeID string `json:"node_id"`
+	Reason string `json:"reason"`
+}
+
+// ExportPeers lists the remembered peers at the addresses they gave us
+// themselves, for another node to import. Addresses a peer asked us not to
+// pass on are left out, as are peers left without any.
+func (n *Network) ExportPeers() *PeerList {
+	list := &PeerList{
+		Version:    PeerListVersion,
+		ExportedBy: n.nodeID,
+		ExportedAt: time.Now().UTC(),
+		Peers:      []PeerListEntry{},
+	}
+	for _, record := range n.peerStore.All() {
+		if record.NodeID == n.nodeID {
+			continue
+		}
+		entry := PeerListEntry{NodeID: record.NodeID, LastSeen: record.LastSeen.UTC()}
+		for _, address := range record.Addresses {
+			if address.trusted() && address.Source != AddressSourcePrivate {
+				entry.Addresses = append(entry.Addresses, address.Address)
+			}
+		}
+		if len(entry.Addresses) == 0 {
+			continue
+		}
+		if pinned, ok := n.keys.Get(record.NodeID); ok {
+			entry.KeyFingerprint = pinned.Fingerprint
+		}
+		if info, ok := n.topologyMgr.GetPeerInfo(record.NodeID); ok {
+			entry.Reputation = info.Reputation
+		}
+		if signed, ok := n.peerRecords.Get(record.NodeID); ok {
+			entry.Record = signed
+		}
+		list.Peers = append(list.Peers, entry)
+	}
+	return list
+}
+
+// ImportPeers merges a peer list into the peer store, where isolation
+// recovery finds peers to dial, and saves it. The key fingerprint of a peer
+// nothing is pinned for yet is pinned. Peers are taken at the addresses of
+// their signed record, which is accepted as if gossiped to us; peers
+// without one only with AcceptUnsignedPeers. We skip ourselves, peers held
+// off from reconnecting, peers listed with a key other than the one we
+// pinned, records we reject and addresses our address policy denies.
+func (n *Network) ImportPeers(list *PeerList) (*PeerImportResult, error) {
+	if err := list.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid peer list: %w", err)
+	}
+
+	result := &PeerImportResult{}
+	skip := func(nodeID, reason string) {
+		result.Skipped = append(result.Skipped, SkippedPeer{NodeID: nodeID, Reason: reason})
+	}
+	for _, entry := range list.Peers {
+		if entry.NodeID == n.nodeID {
+			skip(entry.NodeID, "this node")
+			continue
+		}
+		if wait := n.holds.remaining(entry.NodeID); wait > 0 {
+			skip(entry.NodeID, fmt.Sprintf("held off from reconnecting for %v", wait.Round(time.Second)))
+			continue
+		}
+		if pinned, ok := n.keys.Get(entry.NodeID); ok && entry.KeyFingerprint != "" && entry.KeyFingerprint != pinned.Fingerprint {
+			skip(entry.NodeID, fmt.Sprintf("key %s does not match the pinned key %s", entry.KeyFingerprint, pinned.Fingerprint))
+			continue
+		}
+
+		addresses, err := n.importedAddresses(entry)
+		if err != nil {
+			skip(entry.NodeID, err.Error())
+			continue
+		}
+		var allowed []string
+		for _, address := range addresses {
+			if err := n.filter.check(address); err == nil {
+				allowed = append(allowed, address)
+			}
+		}
+		if len(allowed) == 0 {
+			skip(entry.NodeID, "no address allowed by policy")
+			continue
+		}
+
+		known, changed := n.peerStore.Import(entry.NodeID, allowed, entry.LastSeen)
+		switch {
+		case !known:
+			result.Added++
+		case changed:
+			result.Updated++
+		default:
+			result.Unchanged++
+		}
+		if entry.KeyFingerprint != "" {
+			n.keys.Pin(entry.NodeID, entry.KeyFingerprint)
+		}
+	}
+
+	n.logger.Infof("imported peer list from %s: %d added, %d updated, %d skipped",
+		list.ExportedBy, result.Added, result.Updated, len(result.Skipped))
+	if err := n.SavePeerStore(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// importedAddresses returns the addresses to import a peer list entry at:
+// those of its signed record if we accept it, or with AcceptUnsignedPeers
+// those it lists
+func (n *Network) importedAddresses(entry PeerListEntry) ([]string, error) {
+	if entry.Record == nil {
+		if !n.config.P2P.AcceptUnsignedPeers {
+			n.monitor.Stats.IncrementUnsignedPeersIgnored()
+			return nil, fmt.Errorf("no signed peer record")
+		}
+		return entry.Addresses, nil
+	}
+
+	if entry.KeyFingerprint != "" {
+		fingerprint, err := recordFingerprint(entry.Record)
+		if err != nil {
+			n.monitor.Stats.IncrementPeerRecordsRejected()
+			return nil, err
+		}
+		if fingerprint != entry.KeyFingerprint {
+			n.monitor.Stats.IncrementPeerRecordsRejected()
+			return nil, fmt.Errorf("record is signed by %s, listed with key %s", fingerprint, entry.KeyFingerprint)
+		}
+	}
+	held, err := n.acceptPeerRecord(entry.Record)
+	if err != nil {
+		n.monitor.Stats.IncrementPeerRecordsRejected()
+		if held == nil {
+			return nil, err
+		}
+		// A stale record leaves us with the newer one we hold
+	}
+	return held.Addresses, nil
+}
@@ -0,0 +1,270 @@
+package p2p
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFingerprint returns a well-formed key fingerprint made of digit
+func testFingerprint(digit string) string {
+	return "sha256:" + strings.Repeat(digit, 64)
+}
+
+func TestPeerListRoundTrip(t *testing.T) {
+	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	exporter := newLocalNetwork(t, cfg, "export-node")
+
+	// A peer we reached, which also listens on a port it keeps private and
+	// was listed by others at an address it never confirmed
+	exporter.peerStore.Record("peer-a", "10.0.0.1:9000")
+	exporter.peerStore.Learn("peer-a", "10.0.0.1:9001", AddressSourcePrivate)
+	exporter.peerStore.Learn("peer-a", "10.0.0.9:9000", AddressSourcePeerExchange)
+	exporter.keys.Pin("peer-a", testFingerprint("a"))
+	exporter.peerStore.Record("peer-b", "10.0.0.2:9000")
+	exporter.peerStore.Record("import-node", "10.0.0.3:9000")
+	exporter.peerStore.Record("held-node", "10.0.0.4:9000")
+	exporter.peerStore.Learn("rumored-node", "10.0.0.5:9000", AddressSourcePeerExchange)
+
+	list := exporter.ExportPeers()
+	assert.Equal(t, PeerListVersion, list.Version)
+	assert.Equal(t, "export-node", list.ExportedBy)
+	entries := make(map[string]PeerListEntry)
+	for _, entry := range list.Peers {
+		entries[entry.NodeID] = entry
+	}
+	require.Len(t, entries, 4, "the peer only rumored to be somewhere is left out")
+	assert.Equal(t, []string{"10.0.0.1:9000"}, entries["peer-a"].Addresses)
+	assert.Equal(t, testFingerprint("a"), entries["peer-a"].KeyFingerprint)
+	assert.Empty(t, entries["peer-b"].KeyFingerprint)
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	require.NoError(t, err)
+	parsed, err := ParsePeerList(data)
+	require.NoError(t, err)
+	assert.Equal(t, list.Peers, parsed.Peers)
+	assert.True(t, list.ExportedAt.Equal(parsed.ExportedAt))
+
+	// The importer already knows peer-b elsewhere and holds off held-node.
+	// The peers listed have no signed records, as from an older release.
+	cfg = config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.P2P.AcceptUnsignedPeers = true
+	importer := newLocalNetwork(t, cfg, "import-node")
+	importer.peerStore.Record("peer-b", "10.0.1.2:9000")
+	importer.holds.hold("held-node", time.Hour)
+
+	result, err := importer.ImportPeers(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Added)
+	assert.Equal(t, 1, result.Updated)
+	skipped := make(map[string]string)
+	for _, peer := range result.Skipped {
+		skipped[peer.NodeID] = peer.Reason
+	}
+	assert.Equal(t, "this node", skipped["import-node"])
+	assert.Contains(t, skipped["held-node"], "held off")
+	assert.Len(t, skipped, 2)
+
+	record, ok := importer.peerStore.Get("peer-a")
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.1:9000", record.Address)
+	assert.Equal(t, AddressSourceImport, record.Addresses[0].Source)
+	pinned, ok := importer.keys.Get("peer-a")
+	require.True(t, ok)
+	assert.Equal(t, testFingerprint("a"), pinned.Fingerprint)
+
+	// The address we reached peer-b at ourselves stays first
+	record, ok = importer.peerStore.Get("peer-b")
+	require.True(t, ok)
+	assert.Equal(t, "10.0.1.2:9000", record.Address)
+	assert.Len(t, record.Addresses, 2)
+
+	// Importing the same list again tells us nothing new
+	result, err = importer.ImportPeers(parsed)
+	require.NoError(t, err)
+	assert.Zero(t, result.Added)
+	assert.Zero(t, result.Updated)
+	assert.Equal(t, 2, result.Unchanged)
+}
+
+func TestImportPeersPolicy(t *testing.T) {
+	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.P2P.DeniedCIDRs = []string{"192.168.0.0/16"}
+	cfg.P2P.AcceptUnsignedPeers = true
+	network := newLocalNetwork(t, cfg, "policy-node")
+	network.keys.Pin("pinned-peer", testFingerprint("b"))
+
+	result, err := network.ImportPeers(&PeerList{
+		Version: PeerListVersion,
+		Peers: []PeerListEntry{
+			{NodeID: "pinned-peer", Addresses: []string{"10.0.0.1:9000"}, KeyFingerprint: testFingerprint("c")},
+			{NodeID: "denied-peer", Addresses: []string{"192.168.1.1:9000"}},
+			{NodeID: "mixed-peer", Addresses: []string{"192.168.1.2:9000", "10.0.0.2:9000"}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Added)
+	require.Len(t, result.Skipped, 2)
+	assert.Equal(t, "pinned-peer", result.Skipped[0].NodeID)
+	assert.Contains(t, result.Skipped[0].Reason, "does not match the pinned key")
+	assert.Equal(t, "denied-peer", result.Skipped[1].NodeID)
+
+	record, ok := network.peerStore.Get("mixed-peer")
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.2:9000", record.Address)
+	assert.Len(t, record.Addresses, 1)
+
+	// A list that never went through ParsePeerList is still validated
+	_, err = network.ImportPeers(&PeerList{Version: 2})
+	assert.ErrorContains(t, err, "unsupported peer list version 2")
+}
+
+func TestPeerStoreImport(t *testing.T) {
+	store := NewPeerStore(nil)
+	store.Record("peer", "10.0.0.1:9000")
+	before, _ := store.Get("peer")
+
+	// An address we know already keeps what we saw of it
+	known, changed := store.Import("peer", []string{"10.0.0.1:9000"}, time.Now().Add(-time.Hour))
+	assert.True(t, known)
+	assert.False(t, changed)
+
+	known, changed = store.Import("peer", []string{"10.0.0.1:9000", "10.0.0.2"}, time.Now().Add(-time.Hour))
+	assert.True(t, known)
+	assert.True(t, changed)
+	after, _ := store.Get("peer")
+	assert.Equal(t, before.LastSeen, after.LastSeen)
+	require.Len(t, after.Addresses, 2)
+	assert.Equal(t, before.Addresses[0], after.Addresses[0])
+	assert.Equal(t, "10.0.0.2:8080", after.Addresses[1].Address)
+
+	// A last seen time ahead of our clock is not believed
+	known, changed = store.Import("other", []string{"10.0.0.3:9000"}, time.Now().Add(time.Hour))
+	assert.False(t, known)
+	assert.True(t, changed)
+	other, _ := store.Get("other")
+	assert.False(t, other.LastSeen.After(time.Now()))
+	_, trusted := store.NodeAt("10.0.0.3:9000")
+	assert.False(t, trusted, "an imported address is not the peer's word")
+}
+
+func TestParsePeerListErrors(t *testing.T) {
+	const fingerprint = `"sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"`
+	tests := []struct {
+		name   string
+		file   string
+		line   int
+		column int
+		err    string
+	}{
+		{
+			name: "not JSON",
+			file: "{\n  \"version\": 1,\n  \"peers\": [}\n",
+			line: 3, column: 13,
+			err: "invalid character",
+		},
+		{
+			name: "cut short",
+			file: "{\n  \"version\": 1,\n  \"peers\": [\n",
+			line: 4, column: 1,
+			err: "unexpected end of JSON input",
+		},
+		{
+			name: "not an object",
+			file: "[]",
+			line: 1, column: 1,
+			err: `expected "{"`,
+		},
+		{
+			name: "unsupported version",
+			file: "{\n  \"version\": 3,\n  \"peers\": []\n}",
+			line: 2, column: 14,
+			err: "unsupported peer list version 3",
+		},
+		{
+			name: "version missing",
+			file: "{\n  \"peers\": []\n}",
+			line: 3, column: 2,
+			err: "version is required",
+		},
+		{
+			name: "unknown field",
+			file: "{\n  \"version\": 1,\n  \"nodes\": []\n}",
+			line: 3, column: 3,
+			err: `unknown field "nodes"`,
+		},
+		{
+			name: "wrong type",
+			file: "{\n  \"version\": \"1\",\n  \"peers\": []\n}",
+			line: 2, column: 14,
+			err: "version: json: cannot unmarshal string",
+		},
+		{
+			name: "peers not a list",
+			file: "{\n  \"version\": 1,\n  \"peers\": {}\n}",
+			line: 3, column: 12,
+			err: `expected "["`,
+		},
+		{
+			name: "entry without addresses",
+			file: "{\n  \"version\": 1,\n  \"peers\": [\n    {\"node_id\": \"a\", \"addresses\": [\"10.0.0.1:9000\"]},\n    {\"node_id\": \"b\", \"addresses\": []}\n  ]\n}",
+			line: 5, column: 5,
+			err: "peer 2: peer b has no addresses",
+		},
+		{
+			name: "invalid address",
+			file: "{\"version\": 1, \"peers\": [{\"node_id\": \"a\", \"addresses\": [\"10.0.0.1:http\"]}]}",
+			line: 1, column: 26,
+			err: `peer 1: peer a has an invalid address "10.0.0.1:http"`,
+		},
+		{
+			name: "invalid fingerprint",
+			file: "{\"version\": 1, \"peers\": [\n{\"node_id\": \"a\", \"addresses\": [\"10.0.0.1\"], \"key_fingerprint\": \"md5:00\"}]}",
+			line: 2, column: 1,
+			err: "invalid key_fingerprint",
+		},
+		{
+			name: "reputation out of range",
+			file: "{\"version\": 1, \"peers\": [\n{\"node_id\": \"a\", \"addresses\": [\"10.0.0.1\"], \"key_fingerprint\": " + fingerprint + ", \"reputation\": 2}]}",
+			line: 2, column: 1,
+			err: "reputation 2 outside -1 to 1",
+		},
+		{
+			name: "unknown entry field",
+			file: "{\"version\": 1, \"peers\": [\n{\"node_id\": \"a\", \"address\": \"10.0.0.1\"}]}",
+			line: 2, column: 1,
+			err: `peer 1: json: unknown field "address"`,
+		},
+		{
+			name: "listed twice",
+			file: "{\"version\": 1, \"peers\": [\n{\"node_id\": \"a\", \"addresses\": [\"10.0.0.1\"]},\n{\"node_id\": \"a\", \"addresses\": [\"10.0.0.2\"]}]}",
+			line: 3, column: 1,
+			err: "peer 2: peer a is listed twice",
+		},
+		{
+			name: "trailing data",
+			file: "{\"version\": 1, \"peers\": []}\n{}",
+			line: 2, column: 1,
+			err: "unexpected data after the peer list",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePeerList([]byte(tt.file))
+			var listErr *PeerListError
+			require.ErrorAs(t, err, &listErr)
+			assert.Equal(t, tt.line, listErr.Line, "line")
+			assert.Equal(t, tt.column, listErr.Column, "column")
+			assert.Contains(t, listErr.Err.Error(), tt.err)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+)
+
+// sendPeerList sends our most relevant peers to a connection
+func (n *Network) sendPeerList(conn *Connection) error {
+	peerListMsg := NewMessage(MessageTypePeerList, n.nodeID, n.peerListPayload())
+	return n.send(conn, peerListMsg)
+}
+
+// peerInfos lists our peers at addresses others can dial, with the signed
+// record we hold for each
+func (n *Network) peerInfos() []PeerInfo {
+	peers := n.peers.All()
+
+	peerInfos := make([]PeerInfo, 0, len(peers))
+	for _, peer := range peers {
+		address, ok := peer.shareableAddress()
+		if !ok {
+			continue
+		}
+		if normalized, err := discovery.NormalizeAddress(address, DefaultListenPort); err == nil {
+			address = normalized
+		}
+		others := n.otherAddresses(peer.ID, address)
+		// We may have dialed the peer on a port it keeps private
+		if n.privateAddress(peer.ID, address) {
+			if len(others) == 0 {
+				continue
+			}
+			address, others = others[0], others[1:]
+		}
+		info := PeerInfo{
+			ID:        peer.ID,
+			Address:   address,
+			Version:   peer.Version,
+			LastSeen:  peer.lastSeen().Unix(),
+			Addresses: others,
+		}
+		if record, ok := n.peerRecords.Get(peer.ID); ok {
+			info.Record = record
+		}
+		peerInfos = append(peerInfos, info)
+	}
+	return peerInfos
+}
+
+// otherAddresses lists the addresses a peer gave us besides address, for
+// others to try if address fails them. Ports the peer keeps private are
+// left out.
+func (n *Network) otherAddresses(peerID, address string) []string {
+	record, ok := n.peerStore.Get(peerID)
+	if !ok {
+		return nil
+	}
+	var others []string
+	for _, entry := range record.Addresses {
+		if entry.Address != address && entry.trusted() && entry.Source != AddressSourcePrivate {
+			others = append(others, entry.Address)
+		}
+	}
+	return others
+}
+
+// privateAddress reports whether the peer asked us not to pass address on
+func (n *Network) privateAddress(peerID, address string) bool {
+	record, ok := n.peerStore.Get(peerID)
+	if !ok {
+		return false
+	}
+	entry, known := record.address(address)
+	return known && entry.Source == AddressSourcePrivate
+}
+
+// peerListPayload lists up to MaxPeerListSize of our peers, most relevant
+// first: the best scored by topology, then the most recently seen. HasMore
+// tells the receiver a PEER_LIST_REQUEST would find the rest.
+func (n *Network) peerListPayload() PeerListPayload {
+	infos := n.peerInfos()
+
+	scores := make(map[string]float64, len(infos))
+	for _, info := range infos {
+		// Peers topology does not know yet sort after those it has scored
+		score, known := n.topologyMgr.PeerScore(info.ID)
+		if !known {
+			score = math.Inf(-1)
+		}
+		scores[info.ID] = score
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if si, sj := scores[infos[i].ID], scores[infos[j].ID]; si != sj {
+			return si > sj
+		}
+		if infos[i].LastSeen != infos[j].LastSeen {
+			return infos[i].LastSeen > infos[j].LastSeen
+		}
+		return infos[i].ID < infos[j].ID
+	})
+
+	if len(infos) > MaxPeerListSize {
+		return PeerListPayload{Peers: infos[:MaxPeerListSize], HasMore: true, Sender: n.PeerRecord()}
+	}
+	return PeerListPayload{Peers: infos, Sender: n.PeerRecord()}
+}
+
+// peerListPage returns up to limit of our peers in ID order, starting after
+// cursor. Ordering by ID keeps pages stable while peers come and go.
+func (n *Network) peerListPage(cursor string, limit int) PeerListPayload {
+	if limit <= 0 || limit > MaxPeerListSize {
+		limit = MaxPeerListSize
+	}
+
+	infos := n.peerInfos()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	start := sort.Search(len(infos), func(i int) bool { return infos[i].ID > cursor })
+	infos = infos[start:]
+
+	if len(infos) > limit {
+		return PeerListPayload{
+			Peers:      infos[:limit],
+			HasMore:    true,
+			NextCursor: infos[limit-1].ID,
+			Sender:     n.PeerRecord(),
+		}
+	}
+	return PeerListPayload{Peers: infos, Sender: n.PeerRecord()}
+}
+
+// handlePeerListRequestMessage answers a PEER_LIST_REQUEST with a page of
+// our peer list
+func (n *Network) handlePeerListRequestMessage(msg *Message, conn *Connection) error {
+	var request PeerListRequestPayload
+	if err := msg.DecodePayload(&request); err != nil {
+		return err
+	}
+	return n.Reply(*msg, MessageTypePeerList, n.peerListPage(request.Cursor, request.Limit))
+}
+
+// FetchPeerList pulls a peer's whole peer list a page at a time. The list
+// is returned as sent, records and unsigned entries alike, for the caller
+// to judge; discovery only goes by the records it accepts.
+func (n *Network) FetchPeerList(ctx context.Context, peerID string) ([]PeerInfo, error) {
+	var peers []PeerInfo
+	cursor := ""
+	for {
+		msg := NewMessage(MessageTypePeerListRequest, n.nodeID, PeerListRequestPayload{Cursor: cursor})
+		reply, err := n.Request(ctx, peerID, msg)
+		if err != nil {
+			return peers, fmt.Errorf("failed to fetch peer list from %s: %w", peerID, err)
+		}
+
+		var page PeerListPayload
+		if err := reply.DecodePayload(&page); err != nil {
+			return peers, fmt.Errorf("invalid peer list from %s: %w", peerID, err)
+		}
+		peers = append(peers, page.Peers...)
+		if !page.HasMore {
+			return peers, nil
+		}
+		// A cursor that does not move on would have us asking forever
+		if page.NextCursor <= cursor {
+			return peers, fmt.Errorf("peer list from %s did not advance past %q", peerID, cursor)
+		}
+		cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,165 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addPeers registers count peers with a network without connecting them
+func addPeers(network *Network, count int) {
+	for i := 0; i < count; i++ {
+		peer := NewPeer(fmt.Sprintf("listed-peer-%03d", i), fmt.Sprintf("10.0.%d.%d:8080", i/250, i%250+1), ProtocolVersion)
+		peer.LastSeen = time.Unix(int64(1000+i), 0)
+		network.peers.Add(peer, nil)
+	}
+}
+
+func TestPeerListPayloadCapped(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+	addPeers(network, 500)
+
+	// A well reputed peer beats the most recently seen ones
+	network.topologyMgr.UpdatePeerReputation("listed-peer-007", 1.0)
+
+	payload := network.peerListPayload()
+	require.Len(t, payload.Peers, MaxPeerListSize)
+	assert.True(t, payload.HasMore)
+	assert.Equal(t, "listed-peer-007", payload.Peers[0].ID)
+	assert.Equal(t, "listed-peer-499", payload.Peers[1].ID)
+	assert.Equal(t, "listed-peer-498", payload.Peers[2].ID)
+
+	msg := NewMessage(MessageTypePeerList, network.nodeID, payload)
+	assert.NoError(t, msg.ValidatePayload())
+}
+
+func TestPeerListPages(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+	addPeers(network, 500)
+
+	seen := make(map[string]bool)
+	cursor := ""
+	pages := 0
+	for {
+		page := network.peerListPage(cursor, 0)
+		pages++
+		require.LessOrEqual(t, len(page.Peers), MaxPeerListSize)
+		for _, info := range page.Peers {
+			assert.False(t, seen[info.ID], "%s listed twice", info.ID)
+			seen[info.ID] = true
+		}
+		if !page.HasMore {
+			break
+		}
+		require.Greater(t, page.NextCursor, cursor)
+		cursor = page.NextCursor
+	}
+	assert.Len(t, seen, 500)
+	assert.Equal(t, 5, pages)
+
+	// Limits above the cap are clamped, smaller ones honoured
+	assert.Len(t, network.peerListPage("", 1000).Peers, MaxPeerListSize)
+	assert.Len(t, network.peerListPage("", 10).Peers, 10)
+}
+
+func TestFetchPeerList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, server := connectPair(t, ctx, "fetch-client", "fetch-server")
+	addPeers(server, 500)
+	require.Eventually(t, func() bool {
+		return len(client.PeersWithCapability(CapabilityPeerListPaging)) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	peers, err := client.FetchPeerList(ctx, "fetch-server")
+	require.NoError(t, err)
+	// The server also lists the client it is connected to
+	assert.Len(t, peers, 501)
+}
+
+func TestOversizedPeerListRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "peerlist-node")
+
+	peer, remote, codes := attachPipePeer(t, network, "flooding-peer")
+	initial := network.PeerReputation(peer.ID)
+
+	infos := make([]PeerInfo, MaxPeerListSize+1)
+	for i := range infos {
+		infos[i] = PeerInfo{ID: fmt.Sprintf("fake-peer-%03d", i), Address: "10.0.0.1:8080"}
+	}
+	writeFrame(t, remote, NewMessage(MessageTypePeerList, peer.ID, PeerListPayload{Peers: infos}))
+
+	select {
+	case code := <-codes:
+		assert.Equal(t, ErrorCodeInvalidMessage, code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("oversized peer list not rejected")
+	}
+	assert.Less(t, network.PeerReputation(peer.ID), initial)
+	assert.Equal(t, uint64(1), peer.ErrorCount())
+}
+
+func TestPeerListAddressesAreDialable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := startLocalNetwork(t, ctx, "dialable-a")
+	b := startLocalNetwork(t, ctx, "dialable-b")
+	c := startLocalNetwork(t, ctx, "dialable-c")
+	for _, network := range []*Network{a, b} {
+		_, err := network.Connect(ctx, localAddr(c))
+		require.NoError(t, err)
+	}
+
+	// C only knows the ephemeral port A dialed from until A's HELLO arrives
+	var learned string
+	require.Eventually(t, func() bool {
+		// B can ask once it has C's HELLO, too
+		peers, err := b.FetchPeerList(ctx, "dialable-c")
+		if err != nil {
+			return false
+		}
+		for _, info := range peers {
+			if info.ID == "dialable-a" {
+				learned = info.Address
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 20*time.Millisecond)
+
+	_, port, err := net.SplitHostPort(learned)
+	require.NoError(t, err)
+	_, listenPort, err := net.SplitHostPort(localAddr(a))
+	require.NoError(t, err)
+	assert.Equal(t, listenPort, port)
+
+	peerID, err := b.Connect(ctx, learned)
+	require.NoError(t, err)
+	assert.Equal(t, "dialable-a", peerID)
+}
+
+func TestInboundPeerListedAfterHello(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+
+	peer := NewPeer("inbound-peer", "10.0.0.1:54321", ProtocolVersion)
+	peer.SetConnection(&Connection{ID: "inbound", Address: peer.Address})
+	network.peers.Add(peer, nil)
+	assert.Empty(t, network.peerInfos(), "an ephemeral port must not be shared")
+
+	peer.SetListenAddress("10.0.0.1:8080")
+	infos := network.peerInfos()
+	require.Len(t, infos, 1)
+	assert.Equal(t, "10.0.0.1:8080", infos[0].Address)
+}
@@ -0,0 +1,484 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// PeerRecordBucket is the bucket of the node's state that holds the signed
+// records of peers, by node ID
+const PeerRecordBucket = "peer_records"
+
+// MaxPeerRecords bounds the signed records kept. The longest unchanged
+// records make way for new ones beyond it.
+const MaxPeerRecords = 4096
+
+var (
+	// ErrInvalidPeerRecord is returned for a peer record whose signature
+	// does not verify
+	ErrInvalidPeerRecord = errors.New("invalid peer record")
+	// ErrStalePeerRecord is returned for a peer record older than the one
+	// we hold for its node
+	ErrStalePeerRecord = errors.New("stale peer record")
+)
+
+// storedRecord is a verified peer record and the fingerprint of the key
+// that signed it
+type storedRecord struct {
+	record      *crypto.SignedPeerRecord
+	fingerprint string
+	storedAt    time.Time
+}
+
+// PeerRecordStore keeps the newest signed record of each peer, which is
+// what we pass on in PEER_LIST and dial peers we heard of at. A node we
+// pinned no key for is held to the key of the first record we took from
+// it; one we pinned a key for, to that key.
+type PeerRecordStore struct {
+	kv      kvstorage.KV
+	records map[string]storedRecord
+	dirty   bool
+	mu      sync.Mutex
+}
+
+// NewPeerRecordStore creates a record store kept in kv. A nil kv keeps the
+// store in memory only.
+func NewPeerRecordStore(kv kvstorage.KV) *PeerRecordStore {
+	return &PeerRecordStore{
+		kv:      kv,
+		records: make(map[string]storedRecord),
+	}
+}
+
+// SetKV moves the store to kv, which Load then reads and Save writes
+func (s *PeerRecordStore) SetKV(kv kvstorage.KV) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv = kv
+}
+
+// Load reads previously saved records. A record that cannot be parsed or
+// whose signature fails is skipped.
+func (s *PeerRecordStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.kv == nil {
+		return nil
+	}
+	now := time.Now()
+	err := s.kv.Iterate(PeerRecordBucket, func(nodeID string, value []byte) error {
+		var record crypto.SignedPeerRecord
+		if err := json.Unmarshal(value, &record); err != nil || record.NodeID != nodeID {
+			return nil
+		}
+		if fingerprint, err := verifyPeerRecord(&record); err == nil {
+			s.records[nodeID] = storedRecord{record: &record, fingerprint: fingerprint, storedAt: now}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read peer records: %w", err)
+	}
+	return nil
+}
+
+// Save writes the records to storage if they changed since the last save,
+// replacing those saved before
+func (s *PeerRecordStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.kv == nil || !s.dirty {
+		return nil
+	}
+
+	err := s.kv.Update(func(tx kvstorage.Tx) error {
+		if err := tx.DeleteBucket(PeerRecordBucket); err != nil {
+			return err
+		}
+		for nodeID, stored := range s.records {
+			data, err := json.Marshal(stored.record)
+			if err != nil {
+				return fmt.Errorf("failed to marshal record of %s: %w", nodeID, err)
+			}
+			if err := tx.Put(PeerRecordBucket, nodeID, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write peer records: %w", err)
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// Get returns the record held for a peer
+func (s *PeerRecordStore) Get(nodeID string) (*crypto.SignedPeerRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.records[nodeID]
+	return stored.record, exists
+}
+
+// accept stores record, signed by the key with fingerprint, unless it is
+// older than the record held for its node. With keyPinned the key was
+// already checked against the pinned one; otherwise it must be the key of
+// the record held. It returns the record now held, and reports whether it
+// is the one given.
+func (s *PeerRecordStore) accept(record *crypto.SignedPeerRecord, fingerprint string, keyPinned bool) (*crypto.SignedPeerRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held, exists := s.records[record.NodeID]
+	if exists {
+		if !keyPinned && held.fingerprint != fingerprint {
+			return held.record, false, fmt.Errorf("%w: record of %s is signed by %s, first seen %s", ErrKeyMismatch, record.NodeID, fingerprint, held.fingerprint)
+		}
+		// A record with a pinned key replaces one signed by another key,
+		// whatever its sequence number
+		sameKey := held.fingerprint == fingerprint
+		if sameKey && record.Seq < held.record.Seq {
+			return held.record, false, fmt.Errorf("%w: record %d of %s, holding %d", ErrStalePeerRecord, record.Seq, record.NodeID, held.record.Seq)
+		}
+		if sameKey && record.Seq == held.record.Seq {
+			return held.record, false, nil
+		}
+	}
+
+	if !exists && len(s.records) >= MaxPeerRecords {
+		s.evictOldest()
+	}
+	s.records[record.NodeID] = storedRecord{record: record, fingerprint: fingerprint, storedAt: time.Now()}
+	s.dirty = true
+	return record, true, nil
+}
+
+// evictOldest drops the record stored longest ago. The caller holds s.mu.
+func (s *PeerRecordStore) evictOldest() {
+	oldest := ""
+	var oldestAt time.Time
+	for nodeID, stored := range s.records {
+		if oldest == "" || stored.storedAt.Before(oldestAt) {
+			oldest, oldestAt = nodeID, stored.storedAt
+		}
+	}
+	delete(s.records, oldest)
+}
+
+// verifyPeerRecord checks the signature of a record and returns the
+// fingerprint of the key that made it
+func verifyPeerRecord(record *crypto.SignedPeerRecord) (string, error) {
+	key, err := record.Verify()
+	if err != nil {
+		return "", fmt.Errorf("%w of %s: %v", ErrInvalidPeerRecord, record.NodeID, err)
+	}
+	return crypto.KeyFingerprint(key)
+}
+
+// acceptPeerRecord stores a peer's record if its signature verifies, its
+// key is the one we pinned for the peer, or first saw it sign with, and it
+// is newer than the record we hold. It returns the record held for the
+// peer afterwards, which for a stale record is the newer one we had.
+func (n *Network) acceptPeerRecord(record *crypto.SignedPeerRecord) (*crypto.SignedPeerRecord, error) {
+	fingerprint, err := verifyPeerRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	pinned, matches := n.keys.Matches(record.NodeID, fingerprint)
+	if pinned && !matches {
+		key, _ := n.keys.Get(record.NodeID)
+		return nil, fmt.Errorf("%w: record of %s is signed by %s, pinned %s", ErrKeyMismatch, record.NodeID, fingerprint, key.Fingerprint)
+	}
+
+	held, stored, err := n.peerRecords.accept(record, fingerprint, pinned)
+	if err != nil {
+		if errors.Is(err, ErrStalePeerRecord) {
+			return held, err
+		}
+		return nil, err
+	}
+	if stored {
+		n.logger.Debugf("peer %s signed record %d at %v", record.NodeID, record.Seq, record.Addresses)
+	}
+	return held, nil
+}
+
+// acceptPeerList takes the signed records out of a peer list sent by from:
+// the sender's own and those of the peers listed. It returns the peers
+// listed with a record we hold, at the addresses the record signs, and,
+// only with AcceptUnsignedPeers, those listed without one. A record whose
+// signature fails costs the sender reputation, as it should have checked
+// the record before passing it on.
+func (n *Network) acceptPeerList(payload PeerListPayload, from string) []PeerInfo {
+	reject := func(nodeID string, err error) {
+		n.monitor.Stats.IncrementPeerRecordsRejected()
+		if errors.Is(err, ErrInvalidPeerRecord) && from != "" {
+			n.reputation.RecordEvent(from, topology.EventInvalidMessage)
+		}
+		n.logger.Debugf("rejected record of %s from %s: %v", nodeID, from, err)
+	}
+
+	if sender := payload.Sender; sender != nil {
+		if sender.NodeID != from {
+			reject(sender.NodeID, fmt.Errorf("%w: sent as the record of %s", ErrInvalidPeerRecord, from))
+		} else if _, err := n.acceptPeerRecord(sender); err != nil {
+			reject(sender.NodeID, err)
+		}
+	}
+
+	var infos []PeerInfo
+	for _, info := range payload.Peers {
+		if info.ID == n.nodeID {
+			continue
+		}
+		if info.Record == nil {
+			if !n.config.P2P.AcceptUnsignedPeers {
+				n.monitor.Stats.IncrementUnsignedPeersIgnored()
+				continue
+			}
+			infos = append(infos, info)
+			continue
+		}
+		if info.Record.NodeID != info.ID {
+			reject(info.ID, fmt.Errorf("%w: listed with the record of %s", ErrInvalidPeerRecord, info.Record.NodeID))
+			continue
+		}
+		held, err := n.acceptPeerRecord(info.Record)
+		if err != nil {
+			reject(info.ID, err)
+		}
+		if held == nil || len(held.Addresses) == 0 {
+			continue
+		}
+		info.Address, info.Addresses, info.Record = held.Addresses[0], held.Addresses[1:], held
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// localRecord is our own signed record and the hosts peers saw us connect
+// from, most recent first, which it lists our ports at
+type localRecord struct {
+	hosts  []string
+	record *crypto.SignedPeerRecord
+	// vouches is the host each connected peer that dialed us sees us at,
+	// until enough of them agree on one
+	vouches map[string]string
+	// signedAt is when record was signed, interval the least time before
+	// the next, and deferred set while a refresh waits for it
+	signedAt time.Time
+	interval time.Duration
+	deferred bool
+	mu       sync.Mutex
+}
+
+// PeerRecord returns our own signed record, or nil until a peer told us
+// where it sees us or a listener is bound to a specific address
+func (n *Network) PeerRecord() *crypto.SignedPeerRecord {
+	n.localRecord.mu.Lock()
+	defer n.localRecord.mu.Unlock()
+	return n.localRecord.record
+}
+
+// observeHost weighs a peer's word on the host it sees us at, and signs a
+// new record if that adds to our addresses. A peer we dialed is taken at
+// its word, as we chose it, and so is any peer naming an address of one of
+// our interfaces; peers that dialed us could be anyone, so another host
+// they name is only taken once DefaultObservedHostQuorum of those connected
+// agree on it. Hosts that are not valid addresses are ignored.
+func (n *Network) observeHost(peerID, host string, outbound bool) {
+	if host == "" {
+		return
+	}
+	normalized, err := discovery.NormalizeAddress(net.JoinHostPort(host, "1"), DefaultListenPort)
+	if err != nil {
+		return
+	}
+	host, _, _ = net.SplitHostPort(normalized)
+
+	n.localRecord.mu.Lock()
+	if !outbound && !interfaceHost(host) && !n.vouchForHostLocked(peerID, host) {
+		n.localRecord.mu.Unlock()
+		return
+	}
+	hosts := slices.DeleteFunc(n.localRecord.hosts, func(h string) bool { return h == host })
+	hosts = append([]string{host}, hosts...)
+	if len(hosts) > MaxPeerAddresses {
+		hosts = hosts[:MaxPeerAddresses]
+	}
+	n.localRecord.hosts = hosts
+	n.localRecord.mu.Unlock()
+
+	n.refreshPeerRecord(false)
+}
+
+// vouchForHostLocked records that a peer that dialed us sees us at host and
+// reports whether enough connected peers now agree on it. Vouches of peers
+// no longer connected are forgotten.
+func (n *Network) vouchForHostLocked(peerID, host string) bool {
+	if n.localRecord.vouches == nil {
+		n.localRecord.vouches = make(map[string]string)
+	}
+	n.localRecord.vouches[peerID] = host
+
+	agree := 0
+	for id, vouched := range n.localRecord.vouches {
+		if _, connected := n.peers.Get(id); !connected {
+			delete(n.localRecord.vouches, id)
+			continue
+		}
+		if vouched == host {
+			agree++
+		}
+	}
+	return agree >= DefaultObservedHostQuorum
+}
+
+// interfaceHost reports whether host is the address of one of our network
+// interfaces
+func interfaceHost(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordAddresses lists the addresses our record signs: those of listeners
+// passed on in PEER_LIST that are bound to a specific address, then the
+// ports of the others at each host peers saw us at, up to MaxPeerAddresses.
+// Observed hosts only fill the room bound listeners leave.
+func (n *Network) recordAddresses(hosts []string) []string {
+	var addresses, ports []string
+	seen := make(map[string]bool)
+	add := func(address string) {
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	for _, l := range n.listeners {
+		if !l.config.Advertises(AdvertisePeerList) {
+			continue
+		}
+		host, port, err := net.SplitHostPort(l.listener.Addr().String())
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			ports = append(ports, port)
+			continue
+		}
+		add(net.JoinHostPort(host, port))
+	}
+	for _, host := range hosts {
+		for _, port := range ports {
+			add(net.JoinHostPort(host, port))
+		}
+	}
+
+	if len(addresses) > MaxPeerAddresses {
+		addresses = addresses[:MaxPeerAddresses]
+	}
+	return addresses
+}
+
+// refreshPeerRecord signs a new record of our addresses if they changed,
+// or with rekeyed, because our identity key did. Its sequence number is
+// the time in milliseconds, so records signed after a restart still
+// supersede those peers hold. Changed addresses are signed at most once a
+// record interval; a change within it is signed when it is up.
+func (n *Network) refreshPeerRecord(rekeyed bool) {
+	n.localRecord.mu.Lock()
+	defer n.localRecord.mu.Unlock()
+
+	addresses := n.recordAddresses(n.localRecord.hosts)
+	current := n.localRecord.record
+	if len(addresses) == 0 || !rekeyed && current != nil && slices.Equal(current.Addresses, addresses) {
+		return
+	}
+	if wait := time.Until(n.localRecord.signedAt.Add(n.localRecord.interval)); !rekeyed && current != nil && wait > 0 {
+		if !n.localRecord.deferred {
+			n.localRecord.deferred = true
+			n.background(func() { n.deferPeerRecord(wait) })
+		}
+		return
+	}
+
+	seq := uint64(time.Now().UnixMilli())
+	if current != nil && current.Seq >= seq {
+		seq = current.Seq + 1
+	}
+	record, err := crypto.NewSignedPeerRecord(n.nodeID, addresses, seq, n.encryptor.PrivateKey())
+	if err != nil {
+		n.logger.Warnf("failed to sign peer record: %v", err)
+		return
+	}
+	n.localRecord.record = record
+	n.localRecord.signedAt = time.Now()
+	n.logger.Debugf("signed peer record %d at %v", seq, addresses)
+}
+
+// deferPeerRecord refreshes our record once wait is over, unless the
+// network stops first
+func (n *Network) deferPeerRecord(wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-n.ctx.Done():
+		return
+	}
+
+	n.localRecord.mu.Lock()
+	n.localRecord.deferred = false
+	n.localRecord.mu.Unlock()
+	n.refreshPeerRecord(false)
+}
+
+// observedHost returns the host of the address a connection comes from,
+// for the peer to learn where it is seen
+func observedHost(conn net.Conn) string {
+	if conn == nil || conn.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// recordFingerprint returns the fingerprint of the key a record carries,
+// without checking its signature
+func recordFingerprint(record *crypto.SignedPeerRecord) (string, error) {
+	key, err := crypto.UnmarshalPublicKey(record.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("%w of %s: %v", ErrInvalidPeerRecord, record.NodeID, err)
+	}
+	return crypto.KeyFingerprint(key)
+}
@@ -0,0 +1,302 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRecordKey returns a new identity key for signing peer records
+func testRecordKey(t *testing.T) *rsa.PrivateKey {
+	key, _, err := crypto.GenerateKeyPair()
+	require.NoError(t, err)
+	return key
+}
+
+// signRecord returns the record of nodeID at addresses, signed with key
+func signRecord(t *testing.T, nodeID string, seq uint64, key *rsa.PrivateKey, addresses ...string) *crypto.SignedPeerRecord {
+	record, err := crypto.NewSignedPeerRecord(nodeID, addresses, seq, key)
+	require.NoError(t, err)
+	return record
+}
+
+// newRecordNetwork creates a network, not started, to hand records to
+func newRecordNetwork(t *testing.T, nodeID string, acceptUnsigned bool) *Network {
+	cfg := config.Default()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.P2P.AcceptUnsignedPeers = acceptUnsigned
+	return newLocalNetwork(t, cfg, nodeID)
+}
+
+func TestForgedPeerRecords(t *testing.T) {
+	network := newRecordNetwork(t, "record-node", false)
+	victimKey, attackerKey := testRecordKey(t), testRecordKey(t)
+
+	// Addresses changed after signing
+	tampered := signRecord(t, "victim", 1, victimKey, "10.0.0.1:9000")
+	tampered.Addresses = []string{"10.6.6.6:9000"}
+	_, err := network.acceptPeerRecord(tampered)
+	assert.ErrorIs(t, err, ErrInvalidPeerRecord)
+
+	// The first key a node signs with is the one it is held to
+	_, err = network.acceptPeerRecord(signRecord(t, "victim", 1, victimKey, "10.0.0.1:9000"))
+	require.NoError(t, err)
+	_, err = network.acceptPeerRecord(signRecord(t, "victim", 2, attackerKey, "10.6.6.6:9000"))
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+
+	// A pinned key wins over the first one seen
+	fingerprint, err := crypto.KeyFingerprint(&attackerKey.PublicKey)
+	require.NoError(t, err)
+	network.keys.Pin("pinned", fingerprint)
+	_, err = network.acceptPeerRecord(signRecord(t, "pinned", 1, victimKey, "10.6.6.6:9000"))
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+	_, err = network.acceptPeerRecord(signRecord(t, "pinned", 1, attackerKey, "10.0.0.2:9000"))
+	assert.NoError(t, err)
+
+	// A relay passing on forged records, or another node's record as its
+	// own, gets none of them taken up
+	impostor := signRecord(t, "victim", 3, victimKey, "10.0.0.3:9000")
+	peers := network.acceptPeerList(PeerListPayload{
+		Sender: impostor,
+		Peers: []PeerInfo{
+			{ID: "victim", Address: "10.6.6.6:9000", Record: tampered},
+			{ID: "other", Address: "10.6.6.6:9000", Record: signRecord(t, "victim", 4, victimKey, "10.6.6.6:9000")},
+		},
+	}, "relay")
+	assert.Empty(t, peers)
+	assert.Equal(t, uint64(3), network.monitor.Stats.GetStats().PeerRecordsRejected)
+
+	record, ok := network.peerRecords.Get("victim")
+	require.True(t, ok)
+	assert.Equal(t, []string{"10.0.0.1:9000"}, record.Addresses)
+}
+
+func TestStalePeerRecordReplay(t *testing.T) {
+	network := newRecordNetwork(t, "record-node", false)
+	key := testRecordKey(t)
+
+	old := signRecord(t, "moved", 5, key, "10.0.0.1:9000")
+	current := signRecord(t, "moved", 10, key, "10.0.0.2:9000", "10.0.0.3:9000")
+	_, err := network.acceptPeerRecord(current)
+	require.NoError(t, err)
+
+	held, err := network.acceptPeerRecord(old)
+	assert.ErrorIs(t, err, ErrStalePeerRecord)
+	assert.Equal(t, current, held)
+
+	// A relay still listing the old record has the peer at the addresses
+	// of the newer one
+	peers := network.acceptPeerList(PeerListPayload{
+		Peers: []PeerInfo{{ID: "moved", Address: "10.0.0.1:9000", Record: old}},
+	}, "relay")
+	require.Len(t, peers, 1)
+	assert.Equal(t, "10.0.0.2:9000", peers[0].Address)
+	assert.Equal(t, []string{"10.0.0.3:9000"}, peers[0].Addresses)
+
+	// The same record again is nothing new
+	held, err = network.acceptPeerRecord(current)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), held.Seq)
+}
+
+func TestUnsignedPeersNeedOptIn(t *testing.T) {
+	list := PeerListPayload{
+		Peers: []PeerInfo{{ID: "legacy", Address: "10.0.0.1:9000", Addresses: []string{"10.0.0.2:9000"}}},
+	}
+
+	strict := newRecordNetwork(t, "strict-node", false)
+	assert.Empty(t, strict.acceptPeerList(list, "old-peer"))
+	assert.Equal(t, uint64(1), strict.monitor.Stats.GetStats().UnsignedPeersIgnored)
+
+	migrating := newRecordNetwork(t, "migrating-node", true)
+	peers := migrating.acceptPeerList(list, "old-peer")
+	require.Len(t, peers, 1)
+	assert.Equal(t, list.Peers[0], peers[0])
+
+	// Peer list files follow the same rule
+	file := &PeerList{
+		Version: PeerListVersion,
+		Peers:   []PeerListEntry{{NodeID: "legacy", Addresses: []string{"10.0.0.1:9000"}}},
+	}
+	result, err := strict.ImportPeers(file)
+	require.NoError(t, err)
+	require.Len(t, result.Skipped, 1)
+	assert.Equal(t, "no signed peer record", result.Skipped[0].Reason)
+	result, err = migrating.ImportPeers(file)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Added)
+}
+
+func TestImportSignedPeerRecords(t *testing.T) {
+	network := newRecordNetwork(t, "import-node", false)
+	key, otherKey := testRecordKey(t), testRecordKey(t)
+	fingerprint, err := crypto.KeyFingerprint(&key.PublicKey)
+	require.NoError(t, err)
+
+	result, err := network.ImportPeers(&PeerList{
+		Version: PeerListVersion,
+		Peers: []PeerListEntry{
+			{
+				NodeID:         "signed",
+				Addresses:      []string{"10.6.6.6:9000"},
+				KeyFingerprint: fingerprint,
+				Record:         signRecord(t, "signed", 1, key, "10.0.0.1:9000"),
+			},
+			{
+				NodeID:         "wrong-key",
+				Addresses:      []string{"10.0.0.2:9000"},
+				KeyFingerprint: fingerprint,
+				Record:         signRecord(t, "wrong-key", 1, otherKey, "10.0.0.2:9000"),
+			},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Added)
+	require.Len(t, result.Skipped, 1)
+	assert.Equal(t, "wrong-key", result.Skipped[0].NodeID)
+	assert.Contains(t, result.Skipped[0].Reason, "listed with key")
+
+	// The address the record signs is taken, not the one listed beside it
+	record, ok := network.peerStore.Get("signed")
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.1:9000", record.Address)
+	assert.Len(t, record.Addresses, 1)
+
+	// A record for another node fails validation
+	_, err = network.ImportPeers(&PeerList{
+		Version: PeerListVersion,
+		Peers:   []PeerListEntry{{NodeID: "a", Addresses: []string{"10.0.0.1:9000"}, Record: signRecord(t, "b", 1, key, "10.0.0.1:9000")}},
+	})
+	assert.ErrorContains(t, err, `peer a has the record of "b"`)
+}
+
+func TestPeerRecordGossip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := connectPair(t, ctx, "record-a", "record-b")
+	c := startLocalNetwork(t, ctx, "record-c")
+	_, err := c.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+
+	// c signs where b sees it and hands b the record in its peer list
+	require.Eventually(t, func() bool {
+		_, ok := b.peerRecords.Get("record-c")
+		return ok
+	}, 5*time.Second, 20*time.Millisecond)
+	own := c.PeerRecord()
+	require.NotNil(t, own)
+	held, _ := b.peerRecords.Get("record-c")
+	assert.Equal(t, own.Seq, held.Seq)
+
+	// a hears of c from b, signed by c, and can dial it there
+	var found *PeerInfo
+	require.Eventually(t, func() bool {
+		for _, info := range a.collectPeerLists() {
+			if info.ID == "record-c" {
+				found = &info
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NotNil(t, found.Record)
+	assert.Equal(t, own.Addresses[0], found.Address)
+
+	peerID, err := a.Connect(ctx, found.Address)
+	require.NoError(t, err)
+	assert.Equal(t, "record-c", peerID)
+
+	// A rotated key signs a newer record that replaces the old one
+	_, err = c.RotateKey()
+	require.NoError(t, err)
+	assert.Greater(t, c.PeerRecord().Seq, own.Seq)
+}
+
+func TestPeerRecordStorePersists(t *testing.T) {
+	network := newRecordNetwork(t, "persist-node", false)
+	require.NoError(t, network.openState())
+	defer network.closeState()
+
+	key := testRecordKey(t)
+	_, err := network.acceptPeerRecord(signRecord(t, "kept", 7, key, "10.0.0.1:9000"))
+	require.NoError(t, err)
+	require.NoError(t, network.SavePeerStore())
+
+	reloaded := NewPeerRecordStore(network.kv)
+	require.NoError(t, reloaded.Load())
+	record, ok := reloaded.Get("kept")
+	require.True(t, ok)
+	assert.Equal(t, uint64(7), record.Seq)
+
+	// A record held on disk still holds later ones to its key
+	_, _, err = reloaded.accept(signRecord(t, "kept", 8, testRecordKey(t), "10.6.6.6:9000"), testFingerprint("f"), false)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+}
+
+// observedHosts returns the hosts our record lists our ports at
+func observedHosts(n *Network) []string {
+	n.localRecord.mu.Lock()
+	defer n.localRecord.mu.Unlock()
+	return append([]string(nil), n.localRecord.hosts...)
+}
+
+func TestObservedHostQuorum(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "observed-node")
+	for _, peerID := range []string{"liar", "honest-1", "honest-2"} {
+		attachPipePeer(t, network, peerID)
+	}
+
+	// One peer that dialed us cannot place us anywhere on its own, nor with
+	// the help of a peer no longer connected
+	network.observeHost("liar", "203.0.113.9", false)
+	network.observeHost("gone", "203.0.113.9", false)
+	assert.Empty(t, observedHosts(network))
+	network.observeHost("honest-1", "198.51.100.7", false)
+	assert.Empty(t, observedHosts(network))
+
+	// Two agreeing can
+	network.observeHost("honest-2", "198.51.100.7", false)
+	assert.Equal(t, []string{"198.51.100.7"}, observedHosts(network))
+
+	// As is one naming an address of ours
+	network.observeHost("liar", "127.0.0.1", false)
+	assert.Equal(t, []string{"127.0.0.1", "198.51.100.7"}, observedHosts(network))
+
+	// A peer we dialed is taken at its word
+	network.observeHost("dialed", "192.0.2.1", true)
+	assert.Equal(t, []string{"192.0.2.1", "127.0.0.1", "198.51.100.7"}, observedHosts(network))
+}
+
+func TestPeerRecordSigningHeldBack(t *testing.T) {
+	requireTCP(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "held-back-node")
+	network.localRecord.mu.Lock()
+	network.localRecord.interval = 200 * time.Millisecond
+	network.localRecord.mu.Unlock()
+
+	network.observeHost("dialed", "192.0.2.1", true)
+	first := network.PeerRecord()
+	require.NotNil(t, first)
+	assert.Contains(t, first.Addresses[0], "192.0.2.1")
+
+	// A change soon after is signed only once the interval is up
+	network.observeHost("dialed", "192.0.2.2", true)
+	assert.Equal(t, first, network.PeerRecord())
+	require.Eventually(t, func() bool {
+		record := network.PeerRecord()
+		return record != first && strings.Contains(record.Addresses[0], "192.0.2.2")
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Len(t, network.PeerRecord().Addresses, 2)
+}
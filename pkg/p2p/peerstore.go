@@ -0,0 +1,515 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+)
+
+// PeerStoreBucket is the bucket of the node's state that holds remembered
+// peers, by node ID
+const PeerStoreBucket = "peers"
+
+// PeerStoreFile is the file under the data directory that releases before
+// the state storage kept remembered peers in. It is migrated into
+// PeerStoreBucket when the network starts.
+const PeerStoreFile = "peers.json"
+
+// Where a remembered address of a peer came from
+const (
+	// AddressSourceDialed is an address we connected to the peer at
+	AddressSourceDialed = "dialed"
+	// AddressSourceHello is the address a peer that connected to us said it
+	// listens at
+	AddressSourceHello = "hello"
+	// AddressSourcePrivate is an address a peer that connected to us said
+	// it listens at but asked us not to pass on
+	AddressSourcePrivate = "private"
+	// AddressSourceMDNS is an address the peer advertised over mDNS
+	AddressSourceMDNS = "mdns"
+	// AddressSourcePeerExchange is an address another peer listed the peer
+	// at
+	AddressSourcePeerExchange = "peer_exchange"
+	// AddressSourceImport is an address read from a peer list exported by
+	// another node
+	AddressSourceImport = "import"
+)
+
+// PeerAddress is one address a peer may be reached at, where we learnt it
+// and how fresh it is
+type PeerAddress struct {
+	Address  string    `json:"address"`
+	Source   string    `json:"source"`
+	LastSeen time.Time `json:"last_seen"`
+	// LastConnected is when we last connected to the peer at the address;
+	// zero if we never have
+	LastConnected time.Time `json:"last_connected,omitempty"`
+}
+
+// trusted reports whether the peer itself gave us the address: we
+// connected to it there, or it told us it listens there
+func (a PeerAddress) trusted() bool {
+	return !a.LastConnected.IsZero() || a.Source == AddressSourceHello || a.Source == AddressSourcePrivate
+}
+
+// PeerRecord is a remembered peer, the address we last reached it on and
+// every address it may be reached at
+type PeerRecord struct {
+	NodeID    string        `json:"node_id"`
+	Address   string        `json:"address"`
+	LastSeen  time.Time     `json:"last_seen"`
+	Addresses []PeerAddress `json:"addresses,omitempty"`
+}
+
+// address returns the entry for address, if the record holds one
+func (r *PeerRecord) address(address string) (*PeerAddress, bool) {
+	for i := range r.Addresses {
+		if r.Addresses[i].Address == address {
+			return &r.Addresses[i], true
+		}
+	}
+	return nil, false
+}
+
+// learn adds address to the record, or refreshes it, and points Address at
+// the address last connected to. The stalest addresses, those never
+// connected to first, are dropped beyond MaxPeerAddresses. An address the
+// peer keeps private stays so until the peer says otherwise.
+func (r *PeerRecord) learn(address, source string, now time.Time, connected bool) {
+	entry, known := r.address(address)
+	if !known {
+		r.Addresses = append(r.Addresses, PeerAddress{Address: address, Source: source})
+		entry = &r.Addresses[len(r.Addresses)-1]
+	}
+	entry.LastSeen = now
+	switch {
+	case source == AddressSourcePrivate || (source == AddressSourceHello && entry.Source == AddressSourcePrivate):
+		// Only the peer itself says whether the address may be passed on
+		entry.Source = source
+	case connected && entry.Source != AddressSourcePrivate:
+		entry.Source = source
+	}
+	if connected {
+		entry.LastConnected = now
+	}
+	r.prune()
+}
+
+// prune orders the addresses, those connected to last first, then those
+// seen last, drops the stalest beyond MaxPeerAddresses and points Address
+// at the first
+func (r *PeerRecord) prune() {
+	sort.SliceStable(r.Addresses, func(i, j int) bool {
+		a, b := r.Addresses[i], r.Addresses[j]
+		if !a.LastConnected.Equal(b.LastConnected) {
+			return a.LastConnected.After(b.LastConnected)
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	if len(r.Addresses) > MaxPeerAddresses {
+		r.Addresses = r.Addresses[:MaxPeerAddresses]
+	}
+	r.Address = r.Addresses[0].Address
+}
+
+// forget drops address from the record
+func (r *PeerRecord) forget(address string) {
+	kept := r.Addresses[:0]
+	for _, entry := range r.Addresses {
+		if entry.Address != address {
+			kept = append(kept, entry)
+		}
+	}
+	r.Addresses = kept
+	if r.Address == address {
+		r.Address = ""
+		if len(kept) > 0 {
+			r.Address = kept[0].Address
+		}
+	}
+}
+
+// PeerStore remembers dialable addresses of peers across restarts
+type PeerStore struct {
+	kv      kvstorage.KV
+	records map[string]PeerRecord
+	dirty   bool
+	mu      sync.RWMutex
+}
+
+// NewPeerStore creates a peer store kept in kv. A nil kv keeps the store in
+// memory only.
+func NewPeerStore(kv kvstorage.KV) *PeerStore {
+	return &PeerStore{
+		kv:      kv,
+		records: make(map[string]PeerRecord),
+	}
+}
+
+// SetKV moves the store to kv, which Load then reads and Save writes
+func (s *PeerStore) SetKV(kv kvstorage.KV) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kv = kv
+}
+
+// Load reads previously saved records. A record that cannot be parsed is
+// skipped.
+func (s *PeerStore) Load() error {
+	s.mu.RLock()
+	kv := s.kv
+	s.mu.RUnlock()
+	if kv == nil {
+		return nil
+	}
+
+	var records []PeerRecord
+	err := kv.Iterate(PeerStoreBucket, func(nodeID string, value []byte) error {
+		var record PeerRecord
+		if err := json.Unmarshal(value, &record); err == nil && record.NodeID == nodeID {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read peer store: %w", err)
+	}
+
+	// Oldest first, so the newest record for an address wins
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].LastSeen.Before(records[j].LastSeen)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, record := range records {
+		address, err := discovery.NormalizeAddress(record.Address, DefaultListenPort)
+		if record.NodeID == "" || err != nil {
+			continue
+		}
+		record.Address = address
+		record.LastSeen = notAfter(record.LastSeen, now)
+		s.forgetAddressLocked(address, record.NodeID)
+
+		// Records saved before peers had several addresses hold only the
+		// one they were reached at
+		if len(record.Addresses) == 0 {
+			record.Addresses = []PeerAddress{{Address: address, Source: AddressSourceDialed, LastSeen: record.LastSeen, LastConnected: record.LastSeen}}
+		}
+		addresses := record.Addresses
+		record.Addresses = nil
+		for _, entry := range addresses {
+			if entry.Address, err = discovery.NormalizeAddress(entry.Address, DefaultListenPort); err == nil {
+				entry.LastSeen = notAfter(entry.LastSeen, now)
+				entry.LastConnected = notAfter(entry.LastConnected, now)
+				record.Addresses = append(record.Addresses, entry)
+			}
+		}
+		if len(record.Addresses) > MaxPeerAddresses {
+			record.Addresses = record.Addresses[:MaxPeerAddresses]
+		}
+		s.records[record.NodeID] = record
+	}
+
+	return nil
+}
+
+// notAfter caps a saved time at now. Times are saved by our wall clock, so
+// one still ahead of it means the clock was set back since, and left alone
+// the peer would look fresh until the clock caught up.
+func notAfter(t, now time.Time) time.Time {
+	if t.After(now) {
+		return now
+	}
+	return t
+}
+
+// Save writes the records to storage if they changed since the last save,
+// replacing those saved before
+func (s *PeerStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.kv == nil || !s.dirty {
+		return nil
+	}
+
+	err := s.kv.Update(func(tx kvstorage.Tx) error {
+		if err := tx.DeleteBucket(PeerStoreBucket); err != nil {
+			return err
+		}
+		for nodeID, record := range s.records {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return fmt.Errorf("failed to marshal peer %s: %w", nodeID, err)
+			}
+			if err := tx.Put(PeerStoreBucket, nodeID, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write peer store: %w", err)
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// migratePeerStore moves the peers saved in path by an earlier release into
+// kv
+func migratePeerStore(kv kvstorage.KV, path string) error {
+	return kvstorage.Migrate(kv, PeerStoreBucket, path, func(data []byte) (map[string][]byte, error) {
+		var records []PeerRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, err
+		}
+		values := make(map[string][]byte)
+		for _, record := range records {
+			if record.NodeID == "" {
+				continue
+			}
+			value, err := json.Marshal(record)
+			if err != nil {
+				return nil, err
+			}
+			values[record.NodeID] = value
+		}
+		return values, nil
+	})
+}
+
+// Record remembers the address a peer was reached on, which is preferred
+// when the peer is dialed again. A node remembered at the same address
+// before, e.g. under an ID it has since replaced, loses it.
+func (s *PeerStore) Record(nodeID, address string) {
+	address, err := discovery.NormalizeAddress(address, DefaultListenPort)
+	if nodeID == "" || err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forgetAddressLocked(address, nodeID)
+	now := time.Now()
+	record := s.records[nodeID]
+	record.NodeID = nodeID
+	record.LastSeen = now
+	record.learn(address, AddressSourceDialed, now, true)
+	s.records[nodeID] = record
+	s.dirty = true
+}
+
+// Learn remembers another address a peer may be reached at, found from
+// source. Only an address the peer told us itself is taken from another
+// node remembered at it, as Record does; others are yet to be proven the
+// peer's.
+func (s *PeerStore) Learn(nodeID, address, source string) {
+	address, err := discovery.NormalizeAddress(address, DefaultListenPort)
+	if nodeID == "" || err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if source == AddressSourceHello || source == AddressSourcePrivate {
+		s.forgetAddressLocked(address, nodeID)
+	}
+	record := s.records[nodeID]
+	record.NodeID = nodeID
+	record.learn(address, source, time.Now(), false)
+	s.records[nodeID] = record
+	s.dirty = true
+}
+
+// Import merges addresses of a peer read from another node's peer list,
+// seen there last at lastSeen. Addresses already known are left as they
+// are: what we saw ourselves is fresher. As with Learn, the addresses are
+// not taken from other nodes remembered at them. It reports whether the
+// peer was known before and whether anything was added.
+func (s *PeerStore) Import(nodeID string, addresses []string, lastSeen time.Time) (known, changed bool) {
+	if nodeID == "" {
+		return false, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastSeen = notAfter(lastSeen, time.Now())
+	record, known := s.records[nodeID]
+	record.Addresses = append([]PeerAddress(nil), record.Addresses...)
+	added := make(map[string]bool)
+	for _, address := range addresses {
+		address, err := discovery.NormalizeAddress(address, DefaultListenPort)
+		if err != nil {
+			continue
+		}
+		if _, ok := record.address(address); ok {
+			continue
+		}
+		record.Addresses = append(record.Addresses, PeerAddress{Address: address, Source: AddressSourceImport, LastSeen: lastSeen})
+		added[address] = true
+	}
+	if len(added) == 0 {
+		return known, false
+	}
+
+	// Addresses staler than every one we know may not make the cut
+	record.prune()
+	for _, entry := range record.Addresses {
+		changed = changed || added[entry.Address]
+	}
+	if !changed {
+		return known, false
+	}
+	record.NodeID = nodeID
+	if !known {
+		record.LastSeen = lastSeen
+	}
+	s.records[nodeID] = record
+	s.dirty = true
+	return known, true
+}
+
+// Touch refreshes the last seen time of a known peer
+func (s *PeerStore) Touch(nodeID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, exists := s.records[nodeID]; exists {
+		record.LastSeen = time.Now()
+		s.records[nodeID] = record
+		s.dirty = true
+	}
+}
+
+// Get returns the record for a peer
+func (s *PeerStore) Get(nodeID string) (PeerRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, exists := s.records[nodeID]
+	record.Addresses = append([]PeerAddress(nil), record.Addresses...)
+	return record, exists
+}
+
+// AddressesOf returns the peer remembered at address and every address it
+// may be reached at, or address alone if no peer is remembered there
+func (s *PeerStore) AddressesOf(address string) (string, []PeerAddress) {
+	normalized, err := discovery.NormalizeAddress(address, DefaultListenPort)
+	if err != nil {
+		return "", []PeerAddress{{Address: address}}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// The peer that gave us the address before any only said to be there
+	var nodeID string
+	for id, record := range s.records {
+		if entry, ok := record.address(normalized); ok && (nodeID == "" || entry.trusted()) {
+			nodeID = id
+		}
+	}
+	if nodeID == "" {
+		return "", []PeerAddress{{Address: normalized}}
+	}
+	return nodeID, append([]PeerAddress(nil), s.records[nodeID].Addresses...)
+}
+
+// NodeAt returns the ID of the peer reached at, or listening at, address
+func (s *PeerStore) NodeAt(address string) (string, bool) {
+	address, err := discovery.NormalizeAddress(address, DefaultListenPort)
+	if err != nil {
+		return "", false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for nodeID, record := range s.records {
+		if entry, ok := record.address(address); ok && entry.trusted() {
+			return nodeID, true
+		}
+	}
+	return "", false
+}
+
+// Recent returns peers seen within maxAge, most recently seen first
+func (s *PeerStore) Recent(maxAge time.Duration) []PeerRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cutoff := time.Now().Add(-maxAge)
+	var recent []PeerRecord
+	for _, record := range s.sortedLocked() {
+		if record.LastSeen.After(cutoff) {
+			record.Addresses = append([]PeerAddress(nil), record.Addresses...)
+			recent = append(recent, record)
+		}
+	}
+	return recent
+}
+
+// All returns every remembered peer, most recently seen first
+func (s *PeerStore) All() []PeerRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := s.sortedLocked()
+	for i := range records {
+		records[i].Addresses = append([]PeerAddress(nil), records[i].Addresses...)
+	}
+	return records
+}
+
+// Len returns the number of remembered peers
+func (s *PeerStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.records)
+}
+
+// forgetAddressLocked takes address from every record but that of except,
+// dropping records left without an address; callers must hold s.mu
+func (s *PeerStore) forgetAddressLocked(address, except string) {
+	for nodeID, record := range s.records {
+		if nodeID == except {
+			continue
+		}
+		if _, ok := record.address(address); !ok && record.Address != address {
+			continue
+		}
+		record.forget(address)
+		if record.Address == "" {
+			delete(s.records, nodeID)
+		} else {
+			s.records[nodeID] = record
+		}
+	}
+}
+
+// sortedLocked returns all records ordered by last seen, newest first;
+// callers must hold s.mu
+func (s *PeerStore) sortedLocked() []PeerRecord {
+	records := make([]PeerRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].LastSeen.Equal(records[j].LastSeen) {
+			return records[i].NodeID < records[j].NodeID
+		}
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+	return records
+}
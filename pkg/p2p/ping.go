@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// pingSmoothing is the weight a new round trip time, or a lost ping,
+	// gets in a peer's latency and packet loss
+	pingSmoothing = 1.0 / 8
+	// pingVarianceSmoothing is the weight a new deviation from the latency
+	// gets in a peer's jitter
+	pingVarianceSmoothing = 1.0 / 4
+)
+
+// Ping measures the round trip time to a connected peer: it sends a PING
+// and waits for the correlated PONG, until ctx or DefaultRequestTimeout ends
+// the wait. Each answer, and each PING that timed out, is folded into the
+// peer's connection quality. A peer we are not connected to is
+// ErrPeerNotFound.
+func (n *Network) Ping(ctx context.Context, peerID string) (time.Duration, error) {
+	start := time.Now()
+	reply, err := n.Request(ctx, peerID, NewMessage(MessageTypePing, n.nodeID, n.pingPayload()))
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			n.recordPing(peerID, 0, false)
+		}
+		return 0, fmt.Errorf("failed to ping %s: %w", peerID, err)
+	}
+
+	rtt := time.Since(start)
+	n.recordPing(peerID, rtt, true)
+	var pong livenessPayload
+	if reply.DecodePayload(&pong) == nil {
+		n.hearRumors(peerID, pong.Alive)
+	}
+	return rtt, nil
+}
+
+// probeConnection pings the peer of an idle connection, so the connection
+// pool keeps connections to peers that answer though they send us nothing
+func (n *Network) probeConnection(ctx context.Context, connection *Connection) error {
+	if connection.PeerID == "" || n.peerConnection(connection.PeerID) != connection {
+		return fmt.Errorf("%w on connection %s", ErrPeerNotFound, connection.ID)
+	}
+	n.liveness.probes.Add(1)
+	_, err := n.Ping(ctx, connection.PeerID)
+	return err
+}
+
+// recordPing updates a peer's latency, jitter and packet loss with the
+// outcome of a ping, smoothed the way TCP smooths its round trip time
+// (RFC 6298). The first answer replaces the defaults peers start with; a
+// ping lost before then says nothing of the latency and is not recorded.
+func (n *Network) recordPing(peerID string, rtt time.Duration, answered bool) {
+	info, known := n.topologyMgr.GetPeerInfo(peerID)
+	if !known {
+		return
+	}
+
+	quality := info.Quality
+	switch {
+	case !quality.Measured() && !answered:
+		return
+	case !quality.Measured():
+		quality.Latency = rtt
+		quality.Jitter = rtt / 2
+		quality.PacketLoss = 0
+	case !answered:
+		quality.PacketLoss += (100 - quality.PacketLoss) * pingSmoothing
+	default:
+		deviation := rtt - quality.Latency
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		quality.Jitter += time.Duration(pingVarianceSmoothing * float64(deviation-quality.Jitter))
+		quality.Latency += time.Duration(pingSmoothing * float64(rtt-quality.Latency))
+		quality.PacketLoss -= quality.PacketLoss * pingSmoothing
+	}
+	quality.LastUpdate = time.Now()
+	n.topologyMgr.UpdatePeerQuality(peerID, quality)
+}
@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, _ := connectPair(t, ctx, "ping-a", "ping-b")
+	quality, ok := a.GetConnectionQuality("ping-b")
+	require.True(t, ok)
+	assert.False(t, quality.Measured)
+
+	for i := 0; i < 3; i++ {
+		rtt, err := a.Ping(ctx, "ping-b")
+		require.NoError(t, err)
+		assert.Positive(t, rtt)
+		assert.Less(t, rtt, time.Second)
+	}
+
+	// The answers measure the connection
+	quality, ok = a.GetConnectionQuality("ping-b")
+	require.True(t, ok)
+	assert.True(t, quality.Measured)
+	assert.Positive(t, quality.Latency)
+	assert.Less(t, quality.Latency, time.Second)
+	assert.Zero(t, quality.PacketLoss)
+
+	_, err := a.Ping(ctx, "ping-c")
+	assert.ErrorIs(t, err, ErrPeerNotFound)
+}
+
+func TestPingTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "ping-node")
+
+	// The pipe peer reads the PING but never answers it
+	attachPipePeer(t, network, "silent")
+	pingCtx, cancelPing := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelPing()
+	_, err := network.Ping(pingCtx, "silent")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Lost pings count against a measured connection
+	network.recordPing("silent", 10*time.Millisecond, true)
+	network.recordPing("silent", 0, false)
+	info, ok := network.topologyMgr.GetPeerInfo("silent")
+	require.True(t, ok)
+	assert.Equal(t, 10*time.Millisecond, info.Quality.Latency)
+	assert.InDelta(t, 100*pingSmoothing, info.Quality.PacketLoss, 0.001)
+}
@@ -11,12 +11,20 @@ const (
 	DefaultMaxConnections = 50
 )
 
-// ConnectionPool manages a pool of connections to peers
+// ConnectionPool manages a pool of connections to peers. The peers
+// themselves are kept in the network's PeerRegistry.
 type ConnectionPool struct {
 	maxConnections int
 	timeout        time.Duration
+	// interval is how often idle connections are looked for. probe, if
+	// set, asks the peer of an idle connection whether it is still there,
+	// giving it grace to answer. An idle connection vouched reports true
+	// for is kept without asking.
+	interval       time.Duration
+	grace          time.Duration
+	probe          func(ctx context.Context, conn *Connection) error
+	vouched        func(conn *Connection) bool
 	connections    map[string]*Connection
-	peers          map[string]*Peer
 	mu             sync.RWMutex
 	logger         Logger
 }
@@ -45,8 +53,9 @@ func NewConnectionPool(logger Logger, maxConnections int, timeout time.Duration)
 	return &ConnectionPool{
 		maxConnections: maxConnections,
 		timeout:        timeout,
+		interval:       DefaultCleanupInterval,
+		grace:          DefaultCleanupGrace,
 		connections:    make(map[string]*Connection),
-		peers:          make(map[string]*Peer),
 		logger:         logger,
 	}
 }
@@ -86,45 +95,6 @@ func (cp *ConnectionPool) GetConnection(connID string) (*Connection, bool) {
 	return conn, exists
 }
 
-// AddPeer adds a peer to the pool
-func (cp *ConnectionPool) AddPeer(peer *Peer) {
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
-
-	cp.peers[peer.ID] = peer
-	cp.logger.Debugf("added peer %s to pool", peer.ID)
-}
-
-// RemovePeer removes a peer from the pool
-func (cp *ConnectionPool) RemovePeer(peerID string) {
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
-
-	delete(cp.peers, peerID)
-	cp.logger.Debugf("removed peer %s from pool", peerID)
-}
-
-// GetPeer retrieves a peer by ID
-func (cp *ConnectionPool) GetPeer(peerID string) (*Peer, bool) {
-	cp.mu.RLock()
-	defer cp.mu.RUnlock()
-
-	peer, exists := cp.peers[peerID]
-	return peer, exists
-}
-
-// GetPeers returns all peers in the pool
-func (cp *ConnectionPool) GetPeers() []*Peer {
-	cp.mu.RLock()
-	defer cp.mu.RUnlock()
-
-	peers := make([]*Peer, 0, len(cp.peers))
-	for _, peer := range cp.peers {
-		peers = append(peers, peer)
-	}
-	return peers
-}
-
 // GetConnections returns all connections in the pool
 func (cp *ConnectionPool) GetConnections() []*Connection {
 	cp.mu.RLock()
@@ -137,9 +107,10 @@ func (cp *ConnectionPool) GetConnections() []*Connection {
 	return conns
 }
 
-// CleanInactive removes inactive connections from the pool
+// CleanInactive removes inactive connections from the pool every interval
+// until ctx ends
 func (cp *ConnectionPool) CleanInactive(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(cp.interval)
 	defer ticker.Stop()
 
 	for {
@@ -148,40 +119,75 @@ func (cp *ConnectionPool) CleanInactive(ctx context.Context) {
 			cp.logger.Info("stopping connection pool cleanup")
 			return
 		case <-ticker.C:
-			cp.cleanInactiveConnections()
+			cp.cleanInactiveConnections(ctx)
 		}
 	}
 }
 
-// cleanInactiveConnections removes connections that have been inactive
-func (cp *ConnectionPool) cleanInactiveConnections() {
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
-
-	inactive := []string{}
-	for id, conn := range cp.connections {
+// cleanInactiveConnections removes connections that carried nothing either
+// way for longer than the timeout. With a probe, the peer of each is asked
+// first and its connection kept if it answers within the grace period,
+// unless others vouch for the peer.
+func (cp *ConnectionPool) cleanInactiveConnections(ctx context.Context) {
+	cp.mu.RLock()
+	idle := []*Connection{}
+	for _, conn := range cp.connections {
 		if !conn.IsActive(cp.timeout) {
-			inactive = append(inactive, id)
+			idle = append(idle, conn)
 		}
 	}
+	cp.mu.RUnlock()
+	if len(idle) == 0 {
+		return
+	}
 
-	for _, id := range inactive {
-		conn := cp.connections[id]
-		conn.Conn.Close()
-		delete(cp.connections, id)
-		cp.logger.Infof("removed inactive connection %s", id)
+	inactive := make([]bool, len(idle))
+	var wg sync.WaitGroup
+	for i, conn := range idle {
+		if cp.probe == nil {
+			inactive[i] = true
+			continue
+		}
+		if cp.vouched != nil && cp.vouched(conn) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, cp.grace)
+			defer cancel()
+			if err := cp.probe(probeCtx, conn); err != nil {
+				cp.logger.Debugf("idle connection %s did not answer: %v", conn.ID, err)
+				inactive[i] = true
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
 	}
 
-	if len(inactive) > 0 {
-		cp.logger.Debugf("cleaned %d inactive connections", len(inactive))
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cleaned := 0
+	for i, conn := range idle {
+		// A connection that answered, or carried anything meanwhile, stays
+		if !inactive[i] || conn.IsActive(cp.timeout) {
+			continue
+		}
+		if _, exists := cp.connections[conn.ID]; !exists {
+			continue
+		}
+		conn.closeWith("inactive")
+		delete(cp.connections, conn.ID)
+		cp.logger.Infof("removed inactive connection %s", conn.ID)
+		cleaned++
 	}
-}
 
-// PeerCount returns the number of peers in the pool
-func (cp *ConnectionPool) PeerCount() int {
-	cp.mu.RLock()
-	defer cp.mu.RUnlock()
-	return len(cp.peers)
+	if cleaned > 0 {
+		cp.logger.Debugf("cleaned %d inactive connections", cleaned)
+	}
 }
 
 // ConnectionCount returns the number of connections in the pool
@@ -0,0 +1,74 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startCleaningNetwork starts a network on the in-memory network as host
+// whose pool looks for connections idle for idle every 50ms, giving their
+// peers 200ms to answer a PING, and that dials nothing by itself
+func startCleaningNetwork(t *testing.T, ctx context.Context, nodeID, host string, idle time.Duration) *Network {
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.P2P.MinPeers = 0
+	cfg.P2P.TargetPeers = 0
+	cfg.P2P.DiscoveryFloor = 0
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+
+	network, err := New(cfg, log, nodeID)
+	require.NoError(t, err)
+	network.SetTransport(memoryNetwork.Host(host))
+	network.pool.timeout = idle
+	network.pool.interval = 50 * time.Millisecond
+	network.pool.grace = 200 * time.Millisecond
+	require.NoError(t, network.Start(ctx))
+	t.Cleanup(func() { network.Stop() })
+	return network
+}
+
+func TestCleanInactivePingsBeforeEvicting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Only the publisher's connection goes idle
+	subscriber := startCleaningNetwork(t, ctx, "clean-subscriber", "clean-subscriber-host", time.Minute)
+	publisher := startCleaningNetwork(t, ctx, "clean-publisher", "clean-publisher-host", 150*time.Millisecond)
+	subscriber.RegisterHandler("NOTE", func(msg Message) {})
+	_, err := publisher.Connect(ctx, localAddr(subscriber))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return publisher.liveConnection("clean-subscriber") != nil && subscriber.liveConnection("clean-publisher") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	connection := publisher.liveConnection("clean-subscriber")
+
+	// The subscriber sends nothing back, but the publisher's writes keep the
+	// connection over several cleanups
+	for deadline := time.Now().Add(500 * time.Millisecond); time.Now().Before(deadline); {
+		require.NoError(t, publisher.SendMessage(ctx, "clean-subscriber", NewMessage("NOTE", publisher.nodeID, "news")))
+		time.Sleep(25 * time.Millisecond)
+	}
+	assert.Same(t, connection, publisher.liveConnection("clean-subscriber"))
+
+	// Idle both ways, the connection stays while the subscriber answers
+	// pings
+	time.Sleep(500 * time.Millisecond)
+	assert.Same(t, connection, publisher.liveConnection("clean-subscriber"))
+	assert.Equal(t, 1, publisher.pool.ConnectionCount())
+
+	// Once the answers stop arriving it is closed
+	memoryNetwork.Hold("clean-subscriber-host", "clean-publisher-host")
+	require.Eventually(t, func() bool {
+		return publisher.liveConnection("clean-subscriber") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "inactive", connection.CloseReason())
+	assert.Zero(t, publisher.pool.ConnectionCount())
+}
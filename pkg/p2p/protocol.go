@@ -7,6 +7,9 @@ const (
 	// ProtocolVersion represents the current version of the P2P protocol
 	ProtocolVersion = "1.0.0"
 	
+	// MinProtocolVersion is the oldest protocol version we still talk to
+	MinProtocolVersion = "1.0.0"
+	
 	// MaxMessageSize is the maximum size of a single message in bytes (1MB)
 	MaxMessageSize = 1024 * 1024
 	
@@ -21,6 +24,14 @@ const (
 	
 	// DefaultConnectionTimeout is the default timeout for connections
 	DefaultConnectionTimeout = 30 * time.Second
+
+	// DefaultCleanupInterval is how often idle connections are looked for,
+	// and DefaultCleanupGrace how long their peers have to answer a PING
+	DefaultCleanupInterval = 30 * time.Second
+	DefaultCleanupGrace    = 5 * time.Second
+	
+	// DefaultConnectTimeout bounds dialing a peer and completing the handshake
+	DefaultConnectTimeout = 10 * time.Second
 	
 	// DefaultHeartbeatInterval is the interval for sending heartbeat messages
 	DefaultHeartbeatInterval = 10 * time.Second
@@ -30,12 +41,201 @@ const (
 	
 	// DefaultMessageQueueSize is the size of the message queue for each connection
 	DefaultMessageQueueSize = 100
+
+	// DefaultQueueBlockTimeout is how long a full message queue holds up a
+	// peer's reads under the block overflow policy
+	DefaultQueueBlockTimeout = 100 * time.Millisecond
+
+	// OverloadedQueuePercent is how full, in percent, a message queue must be
+	// for us to tell peers in our heartbeats that we are overloaded
+	OverloadedQueuePercent = 75
 	
 	// DefaultMaxRetries is the maximum number of retries for failed operations
 	DefaultMaxRetries = 3
 	
 	// DefaultRetryDelay is the delay between retries
 	DefaultRetryDelay = 1 * time.Second
+	
+	// DefaultStaticPeerCheckInterval is how often a connected static peer is
+	// checked on, in case its disconnect went unnoticed
+	DefaultStaticPeerCheckInterval = 30 * time.Second
+	
+	// DefaultStaticPeerMaxRetryDelay caps the backoff between failed dials of
+	// a static peer
+	DefaultStaticPeerMaxRetryDelay = time.Minute
+	
+	// DefaultPruneMargin is how far below MaxPeers rebalancing prunes to
+	DefaultPruneMargin = 2
+	
+	// DefaultConnectionHeadroom is the number of connection slots above MaxPeers
+	// kept free so better peers can join before rebalancing prunes worse ones
+	DefaultConnectionHeadroom = 8
+	
+	// DefaultShutdownTimeout is how long Stop waits for background work
+	DefaultShutdownTimeout = 5 * time.Second
+
+	// DefaultDrainTimeout is how long draining a peer waits for the reliable
+	// sends to it to be acknowledged
+	DefaultDrainTimeout = 5 * time.Second
+
+	// DefaultPendingHandshakes is how many inbound connections may be
+	// handshaking on top of a full connection pool
+	DefaultPendingHandshakes = 16
+	
+	// DefaultHandshakeTimeout is how long a peer has to complete the handshake
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// DefaultWriteTimeout is how long a write to a peer may block
+	DefaultWriteTimeout = 10 * time.Second
+
+	// DefaultSlowPeerThreshold is how many writes in a row must time out
+	// before a peer is considered slow
+	DefaultSlowPeerThreshold = 3
+
+	// DefaultPeerMessageRate is how many messages per second a peer may send
+	DefaultPeerMessageRate = 200
+
+	// DefaultPeerMessageBurst is how many messages a peer may send at once
+	DefaultPeerMessageBurst = 400
+
+	// ControlMessageRate and ControlMessageBurst are the allowance of
+	// heartbeats and pings a peer has on top of its rate limit, so they
+	// still get through while its other messages are dropped
+	ControlMessageRate  = 5
+	ControlMessageBurst = 10
+	
+	// DefaultBroadcastConcurrency is how many peers a broadcast writes to at once
+	DefaultBroadcastConcurrency = 16
+	
+	// DefaultGossipFanout is the number of peers a gossiped message is forwarded to
+	DefaultGossipFanout = 3
+	
+	// DefaultGossipHopLimit is the maximum number of hops a gossiped message travels
+	DefaultGossipHopLimit = 6
+	
+	// DefaultSeenCacheTTL is how long message IDs are remembered for duplicate suppression
+	DefaultSeenCacheTTL = 2 * time.Minute
+	
+	// DefaultReceivedIDCacheSize is how many recently received message IDs are
+	// remembered to drop retransmitted and echoed duplicates
+	DefaultReceivedIDCacheSize = 16384
+	
+	// MaxMessageIDLength is the longest message ID accepted from peers
+	MaxMessageIDLength = 128
+	
+	// MaxTraceIDLength is the longest trace ID accepted from peers
+	MaxTraceIDLength = 64
+	
+	// DefaultMaxClockSkew is how far a message timestamp may be from our
+	// clock, matching the handshake's tolerance
+	DefaultMaxClockSkew = 5 * time.Minute
+	
+	// DefaultClockSkewStrikes is how many skewed messages a peer may send
+	// before each further one costs it reputation
+	DefaultClockSkewStrikes = 3
+	
+	// DefaultIsolationThreshold is how long the node may stay below its minimum
+	// peer count before it is considered isolated
+	DefaultIsolationThreshold = 60 * time.Second
+	
+	// DefaultRecentPeerWindow is how recently a stored peer must have been seen
+	// to be redialed when recovering from isolation
+	DefaultRecentPeerWindow = 24 * time.Hour
+	
+	// DefaultMDNSScanTimeout is how long an mDNS re-scan listens for answers
+	DefaultMDNSScanTimeout = 5 * time.Second
+	
+	// DefaultDiscoveryDialLimit caps the new peers dialed per discovery cycle
+	DefaultDiscoveryDialLimit = 8
+	
+	// DefaultDiscoveryTriggerCooldown is how long after a discovery cycle
+	// started by losing peers another may be started that way
+	DefaultDiscoveryTriggerCooldown = 5 * time.Second
+
+	// DefaultDialAttemptDelay is how long a dial to one of a peer's
+	// addresses gets before the next address is tried alongside it, the
+	// Connection Attempt Delay of RFC 8305
+	DefaultDialAttemptDelay = 250 * time.Millisecond
+
+	// MaxPeerAddresses caps the addresses remembered, and exchanged, for one
+	// peer
+	MaxPeerAddresses = 8
+	
+	// DefaultPeerListTimeout bounds how long a discovery cycle waits for a
+	// peer to answer a peer list request
+	DefaultPeerListTimeout = 5 * time.Second
+	
+	// DefaultQUICDialTimeout bounds upgrading a connection to QUIC
+	DefaultQUICDialTimeout = 10 * time.Second
+	
+	// DefaultQUICIdleTimeout closes a QUIC session that has been silent this
+	// long; keep-alives are sent at half of it
+	DefaultQUICIdleTimeout = 30 * time.Second
+	
+	// DefaultRequestTimeout bounds Request and SendMessageReliable when the
+	// caller's context has no deadline
+	DefaultRequestTimeout = 10 * time.Second
+	
+	// DefaultFragmentSize is how many bytes of an oversized message each
+	// FRAGMENT carries, leaving room for encoding overhead under MaxMessageSize
+	DefaultFragmentSize = MaxMessageSize / 2
+	
+	// MaxFragments caps the fragments one message may be split into
+	MaxFragments = 1024
+	
+	// DefaultFragmentTimeout is how long a partly received message is kept
+	// waiting for its remaining fragments
+	DefaultFragmentTimeout = 30 * time.Second
+	
+	// DefaultFragmentMemory caps the bytes buffered for partly received
+	// messages across all peers
+	DefaultFragmentMemory = 64 * 1024 * 1024
+
+	// DefaultBatchWindow is how long a message waits for others to share
+	// its BATCH frame
+	DefaultBatchWindow = 5 * time.Millisecond
+
+	// DefaultBatchBytes is how many bytes of messages fill a BATCH frame
+	DefaultBatchBytes = 16 * 1024
+
+	// MaxBatchBytes caps the bytes of messages in a BATCH frame, leaving
+	// room for their encoding in the frame under MaxMessageSize
+	MaxBatchBytes = MaxMessageSize / 2
+
+	// DefaultOrderWindow is how many messages a peer sent after a missing
+	// one are held back for ordered delivery
+	DefaultOrderWindow = 256
+
+	// DefaultGapTimeout is how long ordered delivery waits for a missing
+	// message
+	DefaultGapTimeout = 2 * time.Second
+
+	// MaxTraceHops caps the hops a TRACE passes through, and so the hops
+	// listed in its reply
+	MaxTraceHops = 16
+
+	// DefaultTraceProbeTimeout bounds the ping a hop sends to time the link
+	// a TRACE came over, when that link has not been measured yet
+	DefaultTraceProbeTimeout = 2 * time.Second
+
+	// MaxTopicLength caps the bytes of a topic name
+	MaxTopicLength = 256
+
+	// MaxAdvertisedTopics caps the topics a heartbeat says its sender is
+	// subscribed to
+	MaxAdvertisedTopics = 128
+
+	// DefaultTopicBuffer is how many messages a topic subscription holds
+	// before further ones are dropped for it
+	DefaultTopicBuffer = 64
+
+	// DefaultObservedHostQuorum is how many peers that dialed us must agree
+	// on the host they see us at before our peer record lists it
+	DefaultObservedHostQuorum = 2
+
+	// DefaultPeerRecordInterval is the least time between signing records
+	// of our changed addresses
+	DefaultPeerRecordInterval = 10 * time.Second
 )
 
 // Additional message types (beyond those defined elsewhere)
@@ -46,11 +246,60 @@ const (
 	// MessageTypePong is used as response to ping
 	MessageTypePong = "PONG"
 	
+	// MessageTypeFragment carries one piece of a message above MaxMessageSize
+	MessageTypeFragment = "FRAGMENT"
+	
 	// MessageTypeSyncRequest is used to request specific data
 	MessageTypeSyncRequest = "SYNC_REQUEST"
 	
 	// MessageTypeSyncResponse is used to respond to sync requests
 	MessageTypeSyncResponse = "SYNC_RESPONSE"
+	
+	// MessageTypeAIRequest delegates an AI query to a peer that can reach the endpoint
+	MessageTypeAIRequest = "AI_REQUEST"
+	
+	// MessageTypeAIResponse carries the answer to an AI_REQUEST
+	MessageTypeAIResponse = "AI_RESPONSE"
+	
+	// MessageTypeAIResponseChunk carries a piece of a streamed AI_RESPONSE
+	MessageTypeAIResponseChunk = "AI_RESPONSE_CHUNK"
+	
+	// MessageTypeAICancel stops a streamed AI_REQUEST being answered
+	MessageTypeAICancel = "AI_CANCEL"
+	
+	// MessageTypeKeyRotation announces that a node replaced its identity key
+	MessageTypeKeyRotation = "KEY_ROTATION"
+	
+	// MessageTypeBatch carries several small messages in one frame
+	MessageTypeBatch = "BATCH"
+	
+	// MessageTypeTrace probes the route to a peer, each hop adding itself
+	MessageTypeTrace = "TRACE"
+	
+	// MessageTypeTraceReply carries a TRACE's hops back to its origin
+	MessageTypeTraceReply = "TRACE_REPLY"
+	
+	// MessageTypeTaskSubmit asks a peer to run a named task
+	MessageTypeTaskSubmit = "TASK_SUBMIT"
+	
+	// MessageTypeTaskResult carries the outcome of a TASK_SUBMIT
+	MessageTypeTaskResult = "TASK_RESULT"
+	
+	// MessageTypeTaskStatus asks a peer about a task it runs, and carries its answer
+	MessageTypeTaskStatus = "TASK_STATUS"
+	
+	// MessageTypeBlobAnnounce tells peers which blobs a node holds
+	MessageTypeBlobAnnounce = "BLOB_ANNOUNCE"
+	
+	// MessageTypeBlobRequest asks a peer for part of a blob
+	MessageTypeBlobRequest = "BLOB_REQUEST"
+	
+	// MessageTypeBlobChunk carries the part of a blob a BLOB_REQUEST asked for
+	MessageTypeBlobChunk = "BLOB_CHUNK"
+	
+	// MessageTypeTopic carries data published on a topic, gossiped to the
+	// topic's subscribers
+	MessageTypeTopic = "TOPIC"
 )
 
 // Capability flags for peer capabilities
@@ -66,6 +315,42 @@ const (
 	
 	// CapabilityRelay indicates the peer supports message relaying
 	CapabilityRelay = "relay"
+	
+	// CapabilityAI indicates the peer can answer AI queries on behalf of others
+	CapabilityAI = "ai"
+	
+	// CapabilityAIStream indicates the peer sends and receives AI answers in chunks
+	CapabilityAIStream = "ai_stream"
+	
+	// CapabilityQUIC indicates the peer accepts QUIC connections on its HELLO's QUIC port
+	CapabilityQUIC = "quic"
+	
+	// CapabilityCBOR indicates the peer prefers messages encoded with CodecCBOR
+	CapabilityCBOR = "cbor"
+	
+	// CapabilityPeerListPaging indicates the peer answers PEER_LIST_REQUEST with pages of its peer list
+	CapabilityPeerListPaging = "peer_list_paging"
+	
+	// CapabilityBatch indicates the peer unpacks BATCH frames
+	CapabilityBatch = "batch"
+	
+	// CapabilityTrace indicates the peer passes on and answers TRACE messages
+	CapabilityTrace = "trace"
+	
+	// CapabilityTask indicates the peer runs tasks submitted in TASK_SUBMIT messages
+	CapabilityTask = "task"
+	
+	// CapabilityBlob indicates the peer serves the blobs it holds in BLOB_CHUNK messages
+	CapabilityBlob = "blob"
+)
+
+// Transports a connection's messages can travel over
+const (
+	// TransportTCP is the newline-framed TCP connection every peer starts on
+	TransportTCP = "tcp"
+	
+	// TransportQUIC is a QUIC session with separate control and bulk streams
+	TransportQUIC = "quic"
 )
 
 // Error codes for P2P protocol
@@ -87,4 +372,29 @@ const (
 	
 	// ErrorCodeNotImplemented indicates a feature is not implemented
 	ErrorCodeNotImplemented = "NOT_IMPLEMENTED"
+	
+	// ErrorCodeMessageTooLarge indicates a frame exceeded MaxMessageSize
+	ErrorCodeMessageTooLarge = "MESSAGE_TOO_LARGE"
+	
+	// ErrorCodeBusy indicates the peer is at its concurrency limit for the sender
+	ErrorCodeBusy = "BUSY"
+	
+	// ErrorCodeUpstreamFailed indicates a service the peer relies on failed
+	ErrorCodeUpstreamFailed = "UPSTREAM_FAILED"
+	
+	// ErrorCodeClockSkew indicates the message timestamp is too far from the receiver's clock
+	ErrorCodeClockSkew = "CLOCK_SKEW"
+	
+	// ErrorCodeFragmentFailed indicates a fragmented message could not be reassembled
+	ErrorCodeFragmentFailed = "FRAGMENT_FAILED"
+	
+	// ErrorCodeDuplicatePeer indicates the dialing peer is already connected
+	ErrorCodeDuplicatePeer = "DUPLICATE_PEER"
+	
+	// ErrorCodeNetworkKeyMismatch indicates the dialing peer does not share
+	// the receiver's network key
+	ErrorCodeNetworkKeyMismatch = "NETWORK_KEY_MISMATCH"
+	
+	// ErrorCodeNotFound indicates the peer does not hold what was requested
+	ErrorCodeNotFound = "NOT_FOUND"
 )
\ No newline at end of file
@@ -0,0 +1,63 @@
+package p2p
+
+// rebalancePeers disconnects the lowest-value peers once more than MaxPeers
+// are connected. Persistent peers are never selected. Pruned peers are
+// drained in the background, so registering the peer that took us over
+// the limit does not wait on them; a peer being pruned is not selected
+// again meanwhile.
+func (n *Network) rebalancePeers() {
+	for _, peerID := range n.topologyMgr.SelectPeersToPrune(n.pruneMargin) {
+		if !n.startPruning(peerID) {
+			continue
+		}
+		n.logger.Infof("pruning low-value peer %s (above max peers %d)", peerID, n.config.P2P.MaxPeers)
+		n.monitor.Stats.IncrementPeersPruned()
+		n.background(func() {
+			defer n.finishPruning(peerID)
+			n.DisconnectPeer(peerID, DisconnectOptions{Reason: "pruned: peer limit reached", Drain: true})
+		})
+	}
+}
+
+// startPruning marks a peer as being pruned, reporting false if it already
+// was
+func (n *Network) startPruning(peerID string) bool {
+	n.pruneMu.Lock()
+	defer n.pruneMu.Unlock()
+	if n.pruning[peerID] {
+		return false
+	}
+	if n.pruning == nil {
+		n.pruning = make(map[string]bool)
+	}
+	n.pruning[peerID] = true
+	return true
+}
+
+// finishPruning clears the mark startPruning set
+func (n *Network) finishPruning(peerID string) {
+	n.pruneMu.Lock()
+	defer n.pruneMu.Unlock()
+	delete(n.pruning, peerID)
+}
+
+// removePeer forgets a peer; the registry's observers follow
+func (n *Network) removePeer(peerID string) {
+	n.peers.Remove(peerID)
+}
+
+// handleGoodbyeMessage handles GOODBYE messages
+func (n *Network) handleGoodbyeMessage(msg *Message, conn *Connection) error {
+	var goodbye GoodbyePayload
+	if err := msg.DecodePayload(&goodbye); err != nil {
+		return err
+	}
+
+	n.messageLogger(msg).Infof("peer %s said goodbye: %s", msg.Sender, goodbye.Reason)
+
+	if conn.PeerID != "" {
+		n.removePeer(conn.PeerID)
+	}
+	conn.closeFor(msg, "peer said goodbye: "+goodbye.Reason)
+	return nil
+}
@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebalancePrunesWorstPeers(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+	network.config.P2P.MaxPeers = 10
+	network.topologyMgr = topology.NewManager(10)
+	network.pruneMargin = 0
+
+	goodbyes := make(chan string, 15)
+	for i := 0; i < 15; i++ {
+		id := fmt.Sprintf("peer-%d", i)
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+
+		go func(id string, remote net.Conn) {
+			line, err := bufio.NewReader(remote).ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			if msg, err := DeserializeMessage(line); err == nil && msg.Type == MessageTypeGoodbye {
+				goodbyes <- id
+			}
+		}(id, remote)
+
+		peer := NewPeer(id, "pipe", ProtocolVersion)
+		peer.SetConnection(&Connection{ID: "conn-" + id, PeerID: id, Conn: local, CreatedAt: time.Now(), LastSeen: time.Now()})
+		require.NoError(t, network.peers.Add(peer, nil))
+		network.topologyMgr.UpdatePeerReputation(id, -1.0+float64(i)*0.1)
+	}
+
+	network.rebalancePeers()
+
+	pruned := make([]string, 0, 5)
+	for len(pruned) < 5 {
+		select {
+		case id := <-goodbyes:
+			pruned = append(pruned, id)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d goodbyes received", len(pruned))
+		}
+	}
+
+	assert.ElementsMatch(t, []string{"peer-0", "peer-1", "peer-2", "peer-3", "peer-4"}, pruned)
+	require.Eventually(t, func() bool {
+		return network.topologyMgr.GetPeerCount() == 10 && network.peers.Count() == 10
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, uint64(5), network.monitor.Stats.GetStats().PeersPruned)
+
+	// Already at the limit, so another pass is a no-op
+	network.rebalancePeers()
+	require.Equal(t, 10, network.topologyMgr.GetPeerCount())
+}
+
+func TestPruneDrainsInBackground(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+	network.config.P2P.MaxPeers = 1
+	network.topologyMgr = topology.NewManager(1)
+	network.pruneMargin = 0
+
+	var stuck *Connection
+	for i, id := range []string{"stuck-peer", "kept-peer"} {
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		go io.Copy(io.Discard, remote)
+		conn := &Connection{ID: "conn-" + id, PeerID: id, Conn: local, CreatedAt: time.Now(), LastSeen: time.Now()}
+		peer := NewPeer(id, "pipe", ProtocolVersion)
+		peer.SetConnection(conn)
+		require.NoError(t, network.peers.Add(peer, nil))
+		network.topologyMgr.UpdatePeerReputation(id, float64(i))
+		if stuck == nil {
+			stuck = conn
+		}
+	}
+
+	// A reliable send to the pruned peer is unacknowledged, so draining it
+	// waits; rebalancing does not, nor prunes it twice meanwhile
+	stuck.inflight.add()
+	start := time.Now()
+	network.rebalancePeers()
+	network.rebalancePeers()
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, uint64(1), network.monitor.Stats.GetStats().PeersPruned)
+	_, draining := network.peers.Get("stuck-peer")
+	assert.True(t, draining)
+
+	stuck.inflight.done()
+	require.Eventually(t, func() bool {
+		_, exists := network.peers.Get("stuck-peer")
+		return !exists
+	}, 5*time.Second, 20*time.Millisecond)
+	_, kept := network.peers.Get("kept-peer")
+	assert.True(t, kept)
+}
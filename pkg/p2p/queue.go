@@ -0,0 +1,195 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy says what a full message queue does with an arriving message
+type OverflowPolicy string
+
+// Overflow policies of the message queue
+const (
+	// OverflowDropNewest drops the arriving message
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDropOldest drops the longest waiting message to make room
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowBlock waits for room up to a timeout, then drops the arriving
+	// message. The wait holds up reads from the sending peer.
+	OverflowBlock OverflowPolicy = "block"
+)
+
+// messageQueue holds application messages until the processor hands them to
+// their handlers. Messages wait in one queue, or in one per message type
+// taken from in turn, each bounded to size.
+type messageQueue struct {
+	size         int
+	overflow     OverflowPolicy
+	blockTimeout time.Duration
+	perType      bool
+
+	queues map[string][]Message
+	// turns lists the keys of the non-empty queues in the order they are
+	// taken from
+	turns []string
+	count int
+	// ready is signalled when a message is pushed; room is closed and
+	// replaced when one is popped
+	ready chan struct{}
+	room  chan struct{}
+	mu    sync.Mutex
+}
+
+// newMessageQueue creates a message queue; non-positive sizes and timeouts
+// take their defaults
+func newMessageQueue(size int, overflow OverflowPolicy, blockTimeout time.Duration, perType bool) *messageQueue {
+	if size <= 0 {
+		size = DefaultMessageQueueSize
+	}
+	if blockTimeout <= 0 {
+		blockTimeout = DefaultQueueBlockTimeout
+	}
+	switch overflow {
+	case OverflowDropOldest, OverflowBlock:
+	default:
+		overflow = OverflowDropNewest
+	}
+	return &messageQueue{
+		size:         size,
+		overflow:     overflow,
+		blockTimeout: blockTimeout,
+		perType:      perType,
+		queues:       make(map[string][]Message),
+		ready:        make(chan struct{}, 1),
+		room:         make(chan struct{}),
+	}
+}
+
+// key names the queue messages of a type wait in
+func (q *messageQueue) key(msgType string) string {
+	if q.perType {
+		return msgType
+	}
+	return ""
+}
+
+// Push queues a message. If its queue is full the overflow policy picks a
+// message to drop, which is returned with dropped set; it is msg itself
+// unless the oldest waiting message was dropped for it. Blocking gives up
+// early when ctx is done.
+func (q *messageQueue) Push(ctx context.Context, msg Message) (drop Message, dropped bool) {
+	key := q.key(msg.Type)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.queues[key]) >= q.size {
+		switch q.overflow {
+		case OverflowDropOldest:
+			drop, dropped = q.queues[key][0], true
+			q.queues[key] = q.queues[key][1:]
+			q.count--
+		case OverflowBlock:
+			if !q.waitForRoom(ctx, key) {
+				return msg, true
+			}
+		default:
+			return msg, true
+		}
+	}
+
+	if _, waiting := q.queues[key]; !waiting {
+		q.turns = append(q.turns, key)
+	}
+	q.queues[key] = append(q.queues[key], msg)
+	q.count++
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return drop, dropped
+}
+
+// waitForRoom waits, with q.mu held on entry and return, until the queue of
+// key has room. It reports false if the block timeout passed or ctx ended
+// first.
+func (q *messageQueue) waitForRoom(ctx context.Context, key string) bool {
+	timer := time.NewTimer(q.blockTimeout)
+	defer timer.Stop()
+
+	for len(q.queues[key]) >= q.size {
+		room := q.room
+		q.mu.Unlock()
+		select {
+		case <-room:
+		case <-timer.C:
+			q.mu.Lock()
+			return false
+		case <-ctx.Done():
+			q.mu.Lock()
+			return false
+		}
+		q.mu.Lock()
+	}
+	return true
+}
+
+// Pop takes the next message, waiting for one until ctx is done
+func (q *messageQueue) Pop(ctx context.Context) (Message, bool) {
+	for {
+		if msg, ok := q.tryPop(); ok {
+			return msg, true
+		}
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return Message{}, false
+		}
+	}
+}
+
+// tryPop takes the oldest message of the queue whose turn it is, if any
+func (q *messageQueue) tryPop() (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count == 0 {
+		return Message{}, false
+	}
+	key := q.turns[0]
+	q.turns = q.turns[1:]
+	msg := q.queues[key][0]
+	if rest := q.queues[key][1:]; len(rest) > 0 {
+		q.queues[key] = rest
+		q.turns = append(q.turns, key)
+	} else {
+		delete(q.queues, key)
+	}
+	q.count--
+
+	close(q.room)
+	q.room = make(chan struct{})
+	return msg, true
+}
+
+// Len returns how many messages are waiting
+func (q *messageQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Overloaded reports whether some queue is filled to OverloadedQueuePercent
+// of its size
+func (q *messageQueue) Overloaded() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, messages := range q.queues {
+		if len(messages)*100 >= q.size*OverloadedQueuePercent {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fillQueue pushes count messages of msgType named by their index, and
+// requires none of them to be dropped
+func fillQueue(t *testing.T, queue *messageQueue, msgType string, count int) {
+	for i := 0; i < count; i++ {
+		msg := NewMessage(msgType, "peer", nil)
+		msg.ID = fmt.Sprintf("%s-%d", msgType, i)
+		_, dropped := queue.Push(context.Background(), msg)
+		require.False(t, dropped)
+	}
+}
+
+// drainQueue pops every waiting message and returns their IDs
+func drainQueue(queue *messageQueue) []string {
+	var ids []string
+	for {
+		msg, ok := queue.tryPop()
+		if !ok {
+			return ids
+		}
+		ids = append(ids, msg.ID)
+	}
+}
+
+func TestMessageQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow OverflowPolicy
+		dropped  string
+		kept     []string
+	}{
+		{name: "drop newest", overflow: OverflowDropNewest, dropped: "NOTE-new", kept: []string{"NOTE-0", "NOTE-1", "NOTE-2"}},
+		{name: "drop oldest", overflow: OverflowDropOldest, dropped: "NOTE-0", kept: []string{"NOTE-1", "NOTE-2", "NOTE-new"}},
+		{name: "block", overflow: OverflowBlock, dropped: "NOTE-new", kept: []string{"NOTE-0", "NOTE-1", "NOTE-2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := newMessageQueue(3, tt.overflow, 50*time.Millisecond, false)
+			fillQueue(t, queue, "NOTE", 3)
+
+			msg := NewMessage("NOTE", "peer", nil)
+			msg.ID = "NOTE-new"
+			drop, dropped := queue.Push(context.Background(), msg)
+			require.True(t, dropped)
+			assert.Equal(t, tt.dropped, drop.ID)
+			assert.Equal(t, tt.kept, drainQueue(queue))
+		})
+	}
+}
+
+func TestMessageQueueBlocksForRoom(t *testing.T) {
+	queue := newMessageQueue(1, OverflowBlock, time.Second, false)
+	fillQueue(t, queue, "NOTE", 1)
+
+	// A push into the full queue waits until the processor makes room
+	pushed := make(chan bool, 1)
+	go func() {
+		_, dropped := queue.Push(context.Background(), NewMessage("NOTE", "peer", nil))
+		pushed <- dropped
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push into a full queue did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	msg, ok := queue.Pop(context.Background())
+	require.True(t, ok)
+	assert.Equal(t, "NOTE-0", msg.ID)
+	select {
+	case dropped := <-pushed:
+		assert.False(t, dropped)
+	case <-time.After(time.Second):
+		t.Fatal("blocked push not let in once there was room")
+	}
+	assert.Equal(t, 1, queue.Len())
+
+	// and gives up at the block timeout, or when the network stops
+	queue = newMessageQueue(1, OverflowBlock, 50*time.Millisecond, false)
+	fillQueue(t, queue, "NOTE", 1)
+	start := time.Now()
+	_, dropped := queue.Push(context.Background(), NewMessage("NOTE", "peer", nil))
+	assert.True(t, dropped)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queue = newMessageQueue(1, OverflowBlock, time.Minute, false)
+	fillQueue(t, queue, "NOTE", 1)
+	_, dropped = queue.Push(ctx, NewMessage("NOTE", "peer", nil))
+	assert.True(t, dropped)
+}
+
+func TestMessageQueuePerType(t *testing.T) {
+	// In a shared queue a flood of one type crowds out the others
+	shared := newMessageQueue(3, OverflowDropNewest, 0, false)
+	fillQueue(t, shared, "FLOOD", 3)
+	_, dropped := shared.Push(context.Background(), NewMessage("NOTE", "peer", nil))
+	assert.True(t, dropped)
+
+	// while with a queue per type it only overflows its own, and the types
+	// are taken from in turn
+	perType := newMessageQueue(3, OverflowDropNewest, 0, true)
+	fillQueue(t, perType, "FLOOD", 3)
+	_, dropped = perType.Push(context.Background(), NewMessage("FLOOD", "peer", nil))
+	assert.True(t, dropped)
+	fillQueue(t, perType, "NOTE", 2)
+
+	assert.Equal(t, 5, perType.Len())
+	assert.True(t, perType.Overloaded())
+	assert.Equal(t, []string{"FLOOD-0", "NOTE-0", "FLOOD-1", "NOTE-1", "FLOOD-2"}, drainQueue(perType))
+	assert.False(t, perType.Overloaded())
+}
+
+func TestQueueDropsCountedPerType(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetworkWith(t, ctx, "queue-node", func(cfg *config.Config) {
+		cfg.P2P.Queue.Size = 2
+	})
+
+	// The handler holds up the processor on the first message
+	handling := make(chan struct{}, 1)
+	release := make(chan struct{})
+	network.RegisterHandler("NOTE", func(msg Message) {
+		select {
+		case handling <- struct{}{}:
+			<-release
+		default:
+		}
+	})
+	peer, remote, _ := attachPipePeer(t, network, "busy-peer")
+	writeFrame(t, remote, NewMessage("NOTE", peer.ID, nil))
+	select {
+	case <-handling:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first message not handled")
+	}
+
+	// so of the next four two fit the queue and two are dropped
+	for i := 0; i < 4; i++ {
+		writeFrame(t, remote, NewMessage("NOTE", peer.ID, nil))
+	}
+	require.Eventually(t, func() bool {
+		return network.monitor.Stats.GetStats().QueueDrops["NOTE"] == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, network.heartbeatPayload().QueueDepth)
+
+	// Messages nobody handles are not queued at all
+	writeFrame(t, remote, NewMessage("UNHANDLED", peer.ID, nil))
+	require.Eventually(t, func() bool {
+		return network.monitor.Stats.GetStats().TotalMessagesReceived == 6
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, network.queue.Len())
+	close(release)
+	require.Eventually(t, func() bool {
+		return network.queue.Len() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, network.monitor.Stats.GetStats().QueueDrops, "UNHANDLED")
+}
@@ -0,0 +1,455 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is the application protocol negotiated on QUIC connections
+const quicALPN = "synapse"
+
+// Every QUIC stream starts with one byte saying what it carries
+const (
+	// streamKindControl is the bidirectional stream for heartbeats and pings,
+	// opened by the dialing side
+	streamKindControl byte = 'c'
+	// streamKindMessages is each side's ordered stream for ordinary messages
+	streamKindMessages byte = 'm'
+	// streamKindBulk is a stream carrying a single sync message
+	streamKindBulk byte = 'b'
+)
+
+// quicCloseNormal is the application error code sent when we close a session
+const quicCloseNormal quic.ApplicationErrorCode = 0
+
+// frameWriter is a TCP connection or QUIC stream messages are written to
+type frameWriter interface {
+	io.Writer
+	SetWriteDeadline(t time.Time) error
+}
+
+// streamKind picks the stream a message type travels on, so that heartbeats
+// are never queued behind a large sync transfer
+func streamKind(msgType string) byte {
+	switch msgType {
+	case MessageTypeHeartbeat, MessageTypePing, MessageTypePong:
+		return streamKindControl
+	case MessageTypeDataSync, MessageTypeSyncResponse, MessageTypeFragment:
+		return streamKindBulk
+	default:
+		return streamKindMessages
+	}
+}
+
+// quicStream serialises writes to a long-lived stream
+type quicStream struct {
+	stream frameWriter
+	mu     sync.Mutex
+}
+
+// quicSession is a connection's QUIC transport
+type quicSession struct {
+	conn     *quic.Conn
+	control  *quicStream
+	messages *quicStream
+
+	// Frames sent per stream kind
+	controlFrames atomic.Uint64
+	messageFrames atomic.Uint64
+	bulkStreams   atomic.Uint64
+}
+
+// close ends the session; the connection falls back to TCP
+func (s *quicSession) close(reason string) {
+	s.conn.CloseWithError(quicCloseNormal, reason)
+}
+
+// identityKey parses the key a verified handshake message was signed with
+func identityKey(msg *crypto.HandshakeMessage) *rsa.PublicKey {
+	pubKey, err := crypto.UnmarshalPublicKey(msg.PublicKey)
+	if err != nil {
+		return nil
+	}
+	return pubKey
+}
+
+// startQUIC listens for QUIC connections, on the TCP listener's port number
+// if that UDP port is free
+func (n *Network) startQUIC() error {
+	cert, err := n.encryptor.TLSCertificate(n.nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to create TLS certificate: %w", err)
+	}
+
+	n.quicCert.Store(&cert)
+
+	tlsConf := &tls.Config{
+		// The certificate follows key rotations
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return n.quicCert.Load(), nil
+		},
+		NextProtos: []string{quicALPN},
+		MinVersion: tls.VersionTLS13,
+		ClientAuth: tls.RequireAnyClientCert,
+		// Only peers that completed the TCP handshake may upgrade, and only
+		// with the key they proved there
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			nodeID, _, err := crypto.CertificateIdentity(rawCerts)
+			if err != nil {
+				return err
+			}
+			connection := n.peerConnection(nodeID)
+			if connection == nil {
+				return fmt.Errorf("no connection to peer %s", nodeID)
+			}
+			return crypto.VerifyIdentity(rawCerts, nodeID, connection.Identity())
+		},
+	}
+
+	// One socket both accepts and dials, so upgrades work over IPv4 and IPv6
+	network := n.addressPolicy().Network("udp")
+	udpConn, err := net.ListenUDP(network, &net.UDPAddr{Port: n.listenPort()})
+	if err != nil {
+		udpConn, err = net.ListenUDP(network, &net.UDPAddr{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+
+	transport := &quic.Transport{Conn: udpConn}
+	listener, err := transport.Listen(tlsConf, quicConfig())
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("failed to start QUIC listener: %w", err)
+	}
+	n.quicTransport = transport
+	n.quicListener = listener
+
+	n.logger.Infof("QUIC transport listening on UDP port %d", n.quicPort())
+	n.background(n.acceptQUIC)
+	return nil
+}
+
+// closeQUIC closes the QUIC listener and its socket, ending acceptQUIC
+func (n *Network) closeQUIC() {
+	if n.quicTransport != nil {
+		n.quicListener.Close()
+		n.quicTransport.Close()
+		n.quicTransport.Conn.Close()
+	}
+}
+
+// quicConfig returns the QUIC settings shared by both ends
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  DefaultQUICIdleTimeout,
+		KeepAlivePeriod: DefaultQUICIdleTimeout / 2,
+	}
+}
+
+// quicPort returns the UDP port we accept QUIC connections on, or 0
+func (n *Network) quicPort() int {
+	if n.quicListener == nil {
+		return 0
+	}
+	if addr, ok := n.quicTransport.Conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// peerConnection returns the connection registered for a peer, or nil
+func (n *Network) peerConnection(peerID string) *Connection {
+	peer, exists := n.peers.Get(peerID)
+	if !exists {
+		return nil
+	}
+	return peer.GetConnection()
+}
+
+// liveConnection returns the connection to a peer if it is still open, or nil
+func (n *Network) liveConnection(peerID string) *Connection {
+	connection := n.peerConnection(peerID)
+	if connection == nil {
+		return nil
+	}
+	if _, live := n.pool.GetConnection(connection.ID); !live {
+		return nil
+	}
+	return connection
+}
+
+// acceptQUIC accepts QUIC sessions from peers upgrading their connection
+func (n *Network) acceptQUIC() {
+	listener := n.quicListener
+	for {
+		qconn, err := listener.Accept(n.ctx)
+		if err != nil {
+			if n.ctx.Err() == nil && !errors.Is(err, quic.ErrServerClosed) {
+				n.logger.Errorf("error accepting QUIC connection: %v", err)
+			}
+			return
+		}
+		n.background(func() { n.handleInboundQUIC(qconn) })
+	}
+}
+
+// handleInboundQUIC attaches an accepted session to the peer's connection
+// once the dialer has opened the control stream
+func (n *Network) handleInboundQUIC(qconn *quic.Conn) {
+	// The certificate was checked against the peer's handshake key on accept
+	peerID := qconn.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName
+	connection := n.peerConnection(peerID)
+	if connection == nil {
+		qconn.CloseWithError(quicCloseNormal, "unknown peer")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, DefaultQUICDialTimeout)
+	defer cancel()
+
+	stream, err := qconn.AcceptStream(ctx)
+	if err != nil {
+		n.logger.Debugf("peer %s opened no QUIC control stream: %v", peerID, err)
+		qconn.CloseWithError(quicCloseNormal, "no control stream")
+		return
+	}
+	reader := bufio.NewReader(stream)
+	if kind, err := reader.ReadByte(); err != nil || kind != streamKindControl {
+		qconn.CloseWithError(quicCloseNormal, "expected control stream")
+		return
+	}
+
+	if err := n.runQUICSession(qconn, stream, reader, connection); err != nil {
+		n.logger.Debugf("failed to accept QUIC session from %s: %v", peerID, err)
+	}
+}
+
+// upgradeToQUIC dials the peer's QUIC port and moves the connection's
+// messages onto the session. The connection keeps using TCP if this fails.
+func (n *Network) upgradeToQUIC(connection *Connection, address string) {
+	peerID := connection.PeerID
+
+	tlsConf := &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return n.quicCert.Load(), nil
+		},
+		NextProtos: []string{quicALPN},
+		MinVersion: tls.VersionTLS13,
+		// Self-signed certificates are checked against the handshake key instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return crypto.VerifyIdentity(rawCerts, peerID, connection.Identity())
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, DefaultQUICDialTimeout)
+	defer cancel()
+
+	udpAddr, err := net.ResolveUDPAddr(n.addressPolicy().Network("udp"), address)
+	if err != nil {
+		n.logger.Debugf("invalid QUIC address %s for %s: %v", address, peerID, err)
+		return
+	}
+
+	qconn, err := n.quicTransport.Dial(ctx, udpAddr, tlsConf, quicConfig())
+	if err != nil {
+		n.logger.Debugf("QUIC upgrade to %s at %s failed, staying on TCP: %v", peerID, address, err)
+		return
+	}
+
+	stream, err := qconn.OpenStreamSync(ctx)
+	if err == nil {
+		_, err = stream.Write([]byte{streamKindControl})
+	}
+	if err != nil {
+		n.logger.Debugf("failed to open QUIC control stream to %s: %v", peerID, err)
+		qconn.CloseWithError(quicCloseNormal, "control stream failed")
+		return
+	}
+
+	if err := n.runQUICSession(qconn, stream, bufio.NewReader(stream), connection); err != nil {
+		n.logger.Debugf("QUIC upgrade to %s failed, staying on TCP: %v", peerID, err)
+		return
+	}
+	n.logger.Infof("connection to %s upgraded to QUIC", peerID)
+}
+
+// runQUICSession opens our message stream, routes the connection's messages
+// over the session and reads what the peer sends until the session ends
+func (n *Network) runQUICSession(qconn *quic.Conn, control *quic.Stream, controlReader *bufio.Reader, connection *Connection) error {
+	ctx, cancel := context.WithTimeout(n.ctx, DefaultQUICDialTimeout)
+	defer cancel()
+
+	messages, err := qconn.OpenUniStreamSync(ctx)
+	if err == nil {
+		_, err = messages.Write([]byte{streamKindMessages})
+	}
+	if err != nil {
+		qconn.CloseWithError(quicCloseNormal, "message stream failed")
+		return fmt.Errorf("failed to open message stream: %w", err)
+	}
+
+	session := &quicSession{
+		conn:     qconn,
+		control:  &quicStream{stream: control},
+		messages: &quicStream{stream: messages},
+	}
+	connection.setQUIC(session)
+
+	n.background(func() { n.readQUICStream(controlReader, connection) })
+	n.background(func() { n.acceptQUICStreams(session, connection) })
+	n.background(func() {
+		<-qconn.Context().Done()
+		connection.clearQUIC(session)
+		n.logger.Debugf("QUIC session with %s closed", connection.PeerID)
+	})
+	return nil
+}
+
+// acceptQUICStreams reads every stream the peer opens towards us
+func (n *Network) acceptQUICStreams(session *quicSession, connection *Connection) {
+	for {
+		stream, err := session.conn.AcceptUniStream(n.ctx)
+		if err != nil {
+			return
+		}
+
+		n.background(func() {
+			reader := bufio.NewReader(stream)
+			kind, err := reader.ReadByte()
+			if err != nil {
+				return
+			}
+			if kind != streamKindMessages && kind != streamKindBulk {
+				stream.CancelRead(0)
+				return
+			}
+			n.readQUICStream(reader, connection)
+		})
+	}
+}
+
+// readQUICStream processes the frames of one stream until it ends. A panic
+// while handling them closes the connection, as on TCP.
+func (n *Network) readQUICStream(reader *bufio.Reader, connection *Connection) {
+	defer func() {
+		if r := recover(); r != nil {
+			n.recoverReadPanic(connection, r)
+		}
+	}()
+
+	for {
+		codec, data, err := readCodecFrame(reader, MaxMessageSize)
+		if err == errFrameTooLarge {
+			n.logger.Warnf("dropping oversize frame from %s", connection.Address)
+			n.rejectMessage(connection, "", ErrorCodeMessageTooLarge, fmt.Sprintf("frame exceeds %d bytes", MaxMessageSize), topology.EventOversizeFrame)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		n.processFrame(codec, data, connection)
+	}
+}
+
+// send numbers an application message and delivers it over the connection's
+// QUIC session if it has one, falling back to TCP if the session fails. Messages too large for one frame
+// are sent as fragments, and small ones to peers that unpack batches may
+// share a BATCH frame. A message past its TTL is not sent.
+func (n *Network) send(connection *Connection, msg Message) error {
+	// Once numbered the message goes out expired or not, as dropping it
+	// would leave a gap in the peer's sequence
+	if msg.expiredAt(time.Now()) {
+		n.monitor.Stats.IncrementSendsExpired()
+		return fmt.Errorf("message %s of type %s: %w", msg.ID, msg.Type, ErrMessageExpired)
+	}
+	connection.sequence(&msg)
+	if b := connection.Batcher(); b != nil {
+		if batched, err := n.sendBatched(b, msg); batched {
+			return err
+		}
+	}
+	err := n.sendFrame(connection, msg)
+	if errors.Is(err, ErrMessageTooLarge) && msg.Type != MessageTypeFragment {
+		return n.sendFragments(connection, msg)
+	}
+	n.recordWrite(connection, err)
+	// Sending to a peer that never answers is use enough to keep the
+	// connection, but heartbeats and pings go to every peer
+	if err == nil && !isControlMessage(msg.Type) {
+		connection.markWritten()
+	}
+	return err
+}
+
+// sendFrame delivers a message in a single frame
+func (n *Network) sendFrame(connection *Connection, msg Message) error {
+	if session := connection.QUIC(); session != nil {
+		err := n.sendQUIC(session, connection.Codec(), msg)
+		if err == nil || errors.Is(err, ErrMessageTooLarge) {
+			return err
+		}
+		n.logger.Debugf("QUIC send to %s failed, falling back to TCP: %v", connection.PeerID, err)
+		connection.clearQUIC(session)
+		session.close("send failed")
+	}
+	return n.writeMessage(connection.Conn, connection.Codec(), msg)
+}
+
+// sendQUIC writes a message to the stream its type belongs on
+func (n *Network) sendQUIC(session *quicSession, codec Codec, msg Message) error {
+	switch streamKind(msg.Type) {
+	case streamKindControl:
+		session.controlFrames.Add(1)
+		return n.writeStream(session.control, codec, msg)
+	case streamKindBulk:
+		session.bulkStreams.Add(1)
+		return n.writeBulk(session, codec, msg)
+	default:
+		session.messageFrames.Add(1)
+		return n.writeStream(session.messages, codec, msg)
+	}
+}
+
+// writeStream writes a message to a long-lived stream
+func (n *Network) writeStream(s *quicStream, codec Codec, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return n.writeMessage(s.stream, codec, msg)
+}
+
+// writeBulk sends a message on a stream of its own, so a large transfer does
+// not hold up anything behind it
+func (n *Network) writeBulk(session *quicSession, codec Codec, msg Message) error {
+	ctx, cancel := context.WithTimeout(n.ctx, DefaultConnectionTimeout)
+	defer cancel()
+
+	stream, err := session.conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open bulk stream: %w", err)
+	}
+	if _, err := stream.Write([]byte{streamKindBulk}); err != nil {
+		stream.CancelWrite(0)
+		return fmt.Errorf("failed to write bulk stream header: %w", err)
+	}
+	if err := n.writeMessage(stream, codec, msg); err != nil {
+		stream.CancelWrite(0)
+		return err
+	}
+	return stream.Close()
+}
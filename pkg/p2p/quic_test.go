@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// peerTransport returns the transport of the connection to peerID, or ""
+func peerTransport(n *Network, peerID string) string {
+	connection := n.peerConnection(peerID)
+	if connection == nil {
+		return ""
+	}
+	return connection.Transport()
+}
+
+func TestStreamKind(t *testing.T) {
+	assert.Equal(t, streamKindControl, streamKind(MessageTypeHeartbeat))
+	assert.Equal(t, streamKindControl, streamKind(MessageTypePing))
+	assert.Equal(t, streamKindControl, streamKind(MessageTypePong))
+	assert.Equal(t, streamKindBulk, streamKind(MessageTypeDataSync))
+	assert.Equal(t, streamKindBulk, streamKind(MessageTypeSyncResponse))
+	assert.Equal(t, streamKindMessages, streamKind(MessageTypePeerList))
+	assert.Equal(t, streamKindMessages, streamKind(MessageTypeAIRequest))
+}
+
+func TestQUICUpgradeSeparatesStreams(t *testing.T) {
+	requireTCP(t)
+	ctx := context.Background()
+	server := startLocalNetwork(t, ctx, "quic-server")
+	client := startLocalNetwork(t, ctx, "quic-client")
+
+	received := make(chan Message, 4)
+	server.RegisterHandler(MessageTypeDataSync, func(msg Message) { received <- msg })
+	server.RegisterHandler("QUIC_TEST", func(msg Message) { received <- msg })
+
+	_, err := client.Connect(ctx, localAddr(server))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return peerTransport(client, "quic-server") == TransportQUIC &&
+			peerTransport(server, "quic-client") == TransportQUIC
+	}, 5*time.Second, 20*time.Millisecond)
+
+	clientSession := client.peerConnection("quic-server").QUIC()
+	serverSession := server.peerConnection("quic-client").QUIC()
+
+	// A ping travels on the control stream and is answered on it
+	ctxPing, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err = client.Request(ctxPing, "quic-server", NewMessage(MessageTypePing, client.nodeID, nil))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), clientSession.controlFrames.Load())
+	assert.Equal(t, uint64(1), serverSession.controlFrames.Load())
+
+	// Sync data gets a stream of its own, other messages share one
+	sync := NewMessage(MessageTypeDataSync, client.nodeID, DataSyncPayload{DataID: "doc-1", Type: "note", Content: "hello", Version: 1})
+	require.NoError(t, client.SendMessage(ctx, "quic-server", sync))
+	require.NoError(t, client.SendMessage(ctx, "quic-server", NewMessage("QUIC_TEST", client.nodeID, nil)))
+
+	types := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			types[msg.Type] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not delivered over QUIC")
+		}
+	}
+	assert.True(t, types[MessageTypeDataSync])
+	assert.True(t, types["QUIC_TEST"])
+	assert.Equal(t, uint64(1), clientSession.bulkStreams.Load())
+	assert.Equal(t, uint64(1), clientSession.messageFrames.Load())
+
+	// Losing the session falls back to TCP without losing the peer
+	clientSession.close("test")
+	require.Eventually(t, func() bool {
+		return peerTransport(client, "quic-server") == TransportTCP
+	}, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, client.SendMessage(ctx, "quic-server", NewMessage("QUIC_TEST", client.nodeID, nil)))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "QUIC_TEST", msg.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered over TCP after the QUIC session closed")
+	}
+}
+
+func TestQUICFallsBackToTCP(t *testing.T) {
+	requireTCP(t)
+	ctx := context.Background()
+	modern := startLocalNetwork(t, ctx, "quic-modern")
+
+	cfg := config.Default()
+	cfg.P2P.ListenPort = 0
+	cfg.P2P.EnableQUIC = false
+	cfg.Storage.DataDir = t.TempDir()
+	log, err := logger.New("error", "json", "")
+	require.NoError(t, err)
+	legacy, err := New(cfg, log, "quic-legacy")
+	require.NoError(t, err)
+	require.NoError(t, legacy.Start(ctx))
+	defer legacy.Stop()
+
+	received := make(chan Message, 1)
+	legacy.RegisterHandler("QUIC_TEST", func(msg Message) { received <- msg })
+
+	_, err = modern.Connect(ctx, localAddr(legacy))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(modern.PeersWithCapability(CapabilityEncryption)) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Empty(t, modern.PeersWithCapability(CapabilityQUIC))
+	assert.Equal(t, TransportTCP, peerTransport(modern, "quic-legacy"))
+
+	require.NoError(t, modern.SendMessage(ctx, "quic-legacy", NewMessage("QUIC_TEST", modern.nodeID, nil)))
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered over TCP")
+	}
+	assert.Equal(t, TransportTCP, peerTransport(modern, "quic-legacy"))
+}
+
+func TestQUICRejectsUnprovenIdentity(t *testing.T) {
+	requireTCP(t)
+	ctx := context.Background()
+	server := startLocalNetwork(t, ctx, "quic-server")
+	client := startLocalNetwork(t, ctx, "quic-client")
+
+	_, err := client.Connect(ctx, localAddr(server))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return peerTransport(server, "quic-client") == TransportQUIC
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// An impostor claiming the connected node's ID with its own key, and a
+	// node that never completed the TCP handshake, are both refused
+	impostor, err := crypto.NewEncryptor()
+	require.NoError(t, err)
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(server.quicPort()))
+	for _, nodeID := range []string{"quic-client", "quic-stranger"} {
+		cert, err := impostor.TLSCertificate(nodeID)
+		require.NoError(t, err)
+
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		qconn, err := quic.DialAddr(dialCtx, address, &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			NextProtos:         []string{quicALPN},
+			InsecureSkipVerify: true,
+		}, quicConfig())
+		if err == nil {
+			// TLS 1.3 clients may finish before the server rejects them
+			_, err = qconn.AcceptStream(dialCtx)
+		}
+		cancel()
+		assert.Error(t, err, "QUIC session for %s must be refused", nodeID)
+	}
+
+	assert.Equal(t, TransportQUIC, peerTransport(server, "quic-client"))
+}
@@ -0,0 +1,117 @@
+package p2p
+
+import (
+	"fmt"
+	"path/filepath"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+)
+
+// SetStorage routes the network's persistent files through a storage manager
+// so they count against the quota, and turns high-water warnings into events.
+// It must be called before Start.
+func (n *Network) SetStorage(manager *storage.Manager) {
+	n.storage = manager
+
+	manager.OnHighWater(func(usage storage.Usage) {
+		n.logger.Warnf("storage usage at %.1f%% of quota (%d of %d bytes)", usage.Percent, usage.UsedBytes, usage.QuotaBytes)
+		n.events.Publish(Event{
+			Type: EventStorageHighWater,
+			Data: map[string]interface{}{
+				"used_bytes":  usage.UsedBytes,
+				"quota_bytes": usage.QuotaBytes,
+				"percent":     usage.Percent,
+			},
+		})
+	})
+}
+
+// SetKV keeps the network's remembered peers and pinned keys in kv, shared
+// with the node's other state. It must be called before Start; without it
+// the network opens the backend in its configuration itself.
+func (n *Network) SetKV(kv kvstorage.KV) {
+	n.kv = kv
+	n.ownsKV = false
+}
+
+// openState opens the reliable message journal if enabled and the
+// network's state storage unless it was handed one, moves files of earlier
+// releases into it and loads the peer, key and record stores
+func (n *Network) openState() error {
+	if n.config.P2P.ReliableJournal.Enabled {
+		outbox, err := openOutbox(filepath.Join(n.config.Storage.DataDir, OutboxFile), n.storage, n.config.P2P.ReliableJournal.MaxPending)
+		if err != nil {
+			return fmt.Errorf("failed to open reliable message journal: %w", err)
+		}
+		n.outbox = outbox
+	}
+
+	if n.kv == nil {
+		var files kvstorage.Files = storage.Direct
+		if n.storage != nil {
+			files = n.storage
+		}
+		kv, err := kvstorage.Open(n.config.Storage.Backend, n.config.Storage.DataDir, files)
+		if err != nil {
+			return fmt.Errorf("failed to open state storage: %w", err)
+		}
+		n.kv, n.ownsKV = kv, true
+	}
+
+	dir := n.config.Storage.DataDir
+	if err := migratePeerStore(n.kv, filepath.Join(dir, PeerStoreFile)); err != nil {
+		n.logger.Warnf("failed to migrate peer store: %v", err)
+	}
+	if err := migrateKeyStore(n.kv, filepath.Join(dir, KeyStoreFile)); err != nil {
+		n.logger.Warnf("failed to migrate key store: %v", err)
+	}
+
+	n.peerStore.SetKV(n.kv)
+	n.keys.SetKV(n.kv)
+	n.peerRecords.SetKV(n.kv)
+	if err := n.peerStore.Load(); err != nil {
+		n.logger.Warnf("ignoring unreadable peer store: %v", err)
+	}
+	if err := n.keys.Load(); err != nil {
+		n.logger.Warnf("ignoring unreadable key store: %v", err)
+	}
+	if err := n.peerRecords.Load(); err != nil {
+		n.logger.Warnf("ignoring unreadable peer records: %v", err)
+	}
+	return nil
+}
+
+// closeState closes the reliable message journal, and the state storage if
+// the network opened it
+func (n *Network) closeState() {
+	if n.outbox != nil {
+		if err := n.outbox.Close(); err != nil {
+			n.logger.Errorf("failed to close reliable message journal: %v", err)
+		}
+	}
+	if !n.ownsKV {
+		return
+	}
+	if err := n.kv.Close(); err != nil {
+		n.logger.Errorf("failed to close state storage: %v", err)
+	}
+	n.kv, n.ownsKV = nil, false
+}
+
+// Storage returns the storage manager, or nil if none was set
+func (n *Network) Storage() *storage.Manager {
+	return n.storage
+}
+
+// SavePeerStore writes remembered peers, the keys pinned for them and
+// their signed records to disk, e.g. before a backup
+func (n *Network) SavePeerStore() error {
+	if err := n.peerStore.Save(); err != nil {
+		return err
+	}
+	if err := n.keys.Save(); err != nil {
+		return err
+	}
+	return n.peerRecords.Save()
+}
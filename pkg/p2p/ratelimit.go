@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// tokenBucket allows events at a steady rate, in bursts of up to its size.
+// The zero value starts full on first use.
+type tokenBucket struct {
+	tokens float64
+	refill time.Time
+}
+
+// allow takes a token from the bucket if one is left, refilling it at rate
+// tokens per second up to burst
+func (b *tokenBucket) allow(now time.Time, rate, burst float64) bool {
+	if b.refill.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.refill).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.refill = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// peerRate meters the messages a peer sends us. Every second in which some
+// were dropped is a violation; violations counts them while they run on
+// from one second into the next.
+type peerRate struct {
+	messages   tokenBucket
+	control    tokenBucket
+	violation  time.Time
+	violations int
+}
+
+// isControlMessage reports whether messages of a type draw on the control
+// allowance once a peer is over its rate limit
+func isControlMessage(msgType string) bool {
+	switch msgType {
+	case MessageTypeHeartbeat, MessageTypePing, MessageTypePong:
+		return true
+	default:
+		return false
+	}
+}
+
+// allowMessage meters a message from the peer. Messages within the rate
+// limit are allowed without looking at them; past it, control tells whether
+// the message may use the control allowance. A dropped message reports how
+// many violations in a row the peer is at, and whether it began a new one.
+func (c *Connection) allowMessage(now time.Time, rate, burst float64, control func() bool) (allowed bool, violations int, newViolation bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.rate.messages.allow(now, rate, burst) {
+		return true, 0, false
+	}
+	if control() && c.rate.control.allow(now, ControlMessageRate, ControlMessageBurst) {
+		return true, 0, false
+	}
+
+	if since := now.Sub(c.rate.violation); c.rate.violation.IsZero() || since >= time.Second {
+		if !c.rate.violation.IsZero() && since < 2*time.Second {
+			c.rate.violations++
+		} else {
+			c.rate.violations = 1
+		}
+		c.rate.violation = now
+		newViolation = true
+	}
+	return false, c.rate.violations, newViolation
+}
+
+// allowFrame applies the rate limit policy to a frame before it is decoded.
+// Frames past the peer's limit are dropped, as decoding and handling them
+// would starve the other peers. A peer flooding us for longer than a second
+// loses reputation every further second, and at rateLimitDisconnect seconds
+// in a row it is disconnected.
+func (n *Network) allowFrame(codec Codec, data []byte, connection *Connection) bool {
+	allowed, violations, newViolation := connection.allowMessage(time.Now(), n.messageRate, n.messageBurst, func() bool {
+		return isControlMessage(messageType(codec, data))
+	})
+	if allowed {
+		return true
+	}
+
+	n.monitor.Stats.IncrementMessagesRateLimited()
+	if !newViolation {
+		return false
+	}
+	if violations == 1 {
+		n.logger.Warnf("peer %s exceeds its rate limit of %.0f messages per second", connection.PeerID, n.messageRate)
+	}
+	if violations > 1 {
+		n.reputation.RecordEvent(connection.PeerID, topology.EventRateLimited)
+	}
+
+	if n.rateLimitDisconnect > 0 && violations == n.rateLimitDisconnect {
+		reason := fmt.Sprintf("flooding: over the rate limit for %d seconds in a row", violations)
+		n.logger.Warnf("disconnecting peer %s: %s", connection.PeerID, reason)
+		n.monitor.Stats.IncrementRateLimitDisconnects()
+		n.background(func() {
+			if peer, exists := n.peers.Get(connection.PeerID); exists && peer.GetConnection() == connection {
+				n.DisconnectPeer(connection.PeerID, DisconnectOptions{Reason: reason, Drain: true})
+			}
+		})
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionRateLimit(t *testing.T) {
+	connection := &Connection{}
+	start := time.Now()
+	data := func() bool { return false }
+	control := func() bool { return true }
+
+	// A full burst is allowed at once, the next message is not
+	for i := 0; i < 5; i++ {
+		allowed, _, _ := connection.allowMessage(start, 5, 5, data)
+		require.True(t, allowed, "message %d", i+1)
+	}
+	allowed, violations, newViolation := connection.allowMessage(start, 5, 5, data)
+	assert.False(t, allowed)
+	assert.Equal(t, 1, violations)
+	assert.True(t, newViolation)
+
+	// Control messages have an allowance of their own
+	for i := 0; i < ControlMessageBurst; i++ {
+		allowed, _, _ := connection.allowMessage(start, 5, 5, control)
+		require.True(t, allowed, "control message %d", i+1)
+	}
+	allowed, _, newViolation = connection.allowMessage(start, 5, 5, control)
+	assert.False(t, allowed)
+	assert.False(t, newViolation, "one violation per second")
+
+	// Tokens come back at the rate
+	allowed, _, _ = connection.allowMessage(start.Add(200*time.Millisecond), 5, 5, data)
+	assert.True(t, allowed)
+
+	// Flooding on into the next second is another violation in a row
+	now := start.Add(1200 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		connection.allowMessage(now, 5, 5, data)
+	}
+	allowed, violations, newViolation = connection.allowMessage(now, 5, 5, data)
+	assert.False(t, allowed)
+	assert.Equal(t, 2, violations)
+	assert.True(t, newViolation)
+
+	// while a quiet second ends the run
+	now = now.Add(5 * time.Second)
+	for i := 0; i < 5; i++ {
+		connection.allowMessage(now, 5, 5, data)
+	}
+	_, violations, _ = connection.allowMessage(now, 5, 5, data)
+	assert.Equal(t, 1, violations)
+}
+
+func TestFloodingPeerRateLimited(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetworkWith(t, ctx, "rate-node", func(cfg *config.Config) {
+		cfg.P2P.PeerMessageRate = 20
+		cfg.P2P.PeerMessageBurst = 20
+		cfg.P2P.RateLimitDisconnect = 3
+	})
+
+	steadyDelivered := make(chan Message, 16)
+	network.RegisterHandler("NOTE", func(msg Message) {
+		if msg.Sender == "steady" {
+			steadyDelivered <- msg
+		}
+	})
+
+	flooder, flood, _ := attachPipePeer(t, network, "flooder")
+	_, steady, _ := attachPipePeer(t, network, "steady")
+	initial := network.PeerReputation(flooder.ID)
+
+	flooding := make(chan struct{})
+	go func() {
+		defer close(flooding)
+		for ctx.Err() == nil {
+			msg := NewMessage("NOTE", flooder.ID, nil)
+			data, err := msg.Serialize()
+			if err != nil {
+				return
+			}
+			if _, err := flood.Write(append(data, '\n')); err != nil {
+				return
+			}
+		}
+	}()
+	require.Eventually(t, func() bool {
+		return network.monitor.Stats.GetStats().MessagesRateLimited > 100
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The other peer's messages are handled promptly all the same
+	for i := 0; i < 10; i++ {
+		writeFrame(t, steady, NewMessage("NOTE", "steady", nil))
+		select {
+		case <-steadyDelivered:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("message %d of the steady peer not handled while another floods", i+1)
+		}
+	}
+
+	// and the flooder's heartbeats still get through
+	heartbeat := NewMessage(MessageTypeHeartbeat, flooder.ID, HeartbeatPayload{NodeID: flooder.ID, TS: time.Now().Unix()})
+	heartbeat.Timestamp = time.Now().Add(30 * time.Second)
+	writeFrame(t, flood, heartbeat)
+	require.Eventually(t, func() bool {
+		_, ok := flooder.ClockSkew()
+		return ok
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Flooding on costs the flooder reputation and then its connection
+	require.Eventually(t, func() bool {
+		return network.PeerReputation(flooder.ID) < initial
+	}, 5*time.Second, 20*time.Millisecond)
+	select {
+	case <-flooding:
+	case <-time.After(10 * time.Second):
+		t.Fatal("flooding peer not disconnected")
+	}
+	assert.Equal(t, uint64(1), network.monitor.Stats.GetStats().RateLimitDisconnects)
+	require.Eventually(t, func() bool {
+		_, exists := network.peers.Get(flooder.ID)
+		return !exists
+	}, 5*time.Second, 20*time.Millisecond)
+}
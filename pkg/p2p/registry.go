@@ -0,0 +1,159 @@
+package p2p
+
+import (
+	"sync"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// PeerObserver is told when peers join or leave a PeerRegistry. Calls are
+// made after the registry has changed, outside its lock.
+type PeerObserver interface {
+	PeerAdded(peer *Peer)
+	PeerRemoved(peerID string)
+}
+
+// PeerRegistry is the one table of the peers a network knows. Everything
+// else that tracks peers observes it rather than keeping its own copy.
+type PeerRegistry struct {
+	peers     map[string]*Peer
+	observers []PeerObserver
+	mu        sync.RWMutex
+}
+
+// NewPeerRegistry creates an empty peer registry
+func NewPeerRegistry() *PeerRegistry {
+	return &PeerRegistry{
+		peers: make(map[string]*Peer),
+	}
+}
+
+// Observe adds an observer told about every later change
+func (r *PeerRegistry) Observe(observer PeerObserver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers = append(r.observers, observer)
+}
+
+// Add registers a peer, replacing any peer with the same ID. Unless nil,
+// admit is first called with that peer, or nil if there is none, while the
+// registry is locked; an error from admit leaves the registry unchanged.
+func (r *PeerRegistry) Add(peer *Peer, admit func(existing *Peer) error) error {
+	r.mu.Lock()
+	if admit != nil {
+		if err := admit(r.peers[peer.ID]); err != nil {
+			r.mu.Unlock()
+			return err
+		}
+	}
+	r.peers[peer.ID] = peer
+	observers := r.observers
+	r.mu.Unlock()
+
+	for _, observer := range observers {
+		observer.PeerAdded(peer)
+	}
+	return nil
+}
+
+// Remove forgets a peer and reports whether it was known
+func (r *PeerRegistry) Remove(peerID string) bool {
+	r.mu.Lock()
+	_, exists := r.peers[peerID]
+	delete(r.peers, peerID)
+	observers := r.observers
+	r.mu.Unlock()
+
+	if exists {
+		for _, observer := range observers {
+			observer.PeerRemoved(peerID)
+		}
+	}
+	return exists
+}
+
+// Reset forgets every peer without telling the observers, which keep what
+// they learned about them, as a stopped network keeps its topology history
+func (r *PeerRegistry) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = make(map[string]*Peer)
+}
+
+// Get returns a peer by ID
+func (r *PeerRegistry) Get(peerID string) (*Peer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	peer, exists := r.peers[peerID]
+	return peer, exists
+}
+
+// All returns every registered peer: the known peers, connected or not
+func (r *PeerRegistry) All() []*Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	peers := make([]*Peer, 0, len(r.peers))
+	for _, peer := range r.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Connected returns the registered peers we have a connection to, leaving
+// out those known peers whose connection closed or is closing
+func (r *PeerRegistry) Connected() []*Peer {
+	var connected []*Peer
+	for _, peer := range r.All() {
+		if conn := peer.GetConnection(); conn != nil && !conn.isClosed() {
+			connected = append(connected, peer)
+		}
+	}
+	return connected
+}
+
+// ConnectedCount returns the number of registered peers we have a
+// connection to
+func (r *PeerRegistry) ConnectedCount() int {
+	return len(r.Connected())
+}
+
+// IDs returns the ID of every registered peer
+func (r *PeerRegistry) IDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.peers))
+	for peerID := range r.peers {
+		ids = append(ids, peerID)
+	}
+	return ids
+}
+
+// Count returns the number of registered peers, connected or not
+func (r *PeerRegistry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.peers)
+}
+
+// topologyObserver keeps the network's topology in step with its registry
+type topologyObserver struct {
+	network *Network
+}
+
+// PeerAdded adds the peer to the topology
+func (o topologyObserver) PeerAdded(peer *Peer) {
+	o.network.topologyMgr.AddPeer(topology.Peer{
+		ID:       peer.ID,
+		Address:  peer.Address,
+		Version:  peer.Version,
+		LastSeen: peer.lastSeen(),
+	})
+}
+
+// PeerRemoved removes the peer from the topology
+func (o topologyObserver) PeerRemoved(peerID string) {
+	o.network.topologyMgr.RemovePeer(peerID)
+}
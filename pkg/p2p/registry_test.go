@@ -0,0 +1,219 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingObserver remembers the peers it was told about
+type recordingObserver struct {
+	added   []string
+	removed []string
+}
+
+func (o *recordingObserver) PeerAdded(peer *Peer)      { o.added = append(o.added, peer.ID) }
+func (o *recordingObserver) PeerRemoved(peerID string) { o.removed = append(o.removed, peerID) }
+
+func TestPeerRegistry(t *testing.T) {
+	registry := NewPeerRegistry()
+	observer := &recordingObserver{}
+	registry.Observe(observer)
+	assert.Zero(t, registry.Count())
+
+	peer := NewPeer("peer-id", "127.0.0.1:8080", "1.0.0")
+	require.NoError(t, registry.Add(peer, nil))
+	assert.Equal(t, 1, registry.Count())
+	assert.Equal(t, []string{"peer-id"}, registry.IDs())
+	assert.Equal(t, []*Peer{peer}, registry.All())
+
+	gotPeer, exists := registry.Get("peer-id")
+	assert.True(t, exists)
+	assert.Same(t, peer, gotPeer)
+
+	// A refused peer leaves the registry as it was
+	refused := errors.New("refused")
+	replacement := NewPeer("peer-id", "127.0.0.1:9090", "1.0.0")
+	err := registry.Add(replacement, func(existing *Peer) error {
+		assert.Same(t, peer, existing)
+		return refused
+	})
+	assert.ErrorIs(t, err, refused)
+	gotPeer, _ = registry.Get("peer-id")
+	assert.Same(t, peer, gotPeer)
+
+	require.NoError(t, registry.Add(replacement, func(existing *Peer) error { return nil }))
+	gotPeer, _ = registry.Get("peer-id")
+	assert.Same(t, replacement, gotPeer)
+
+	assert.True(t, registry.Remove("peer-id"))
+	assert.False(t, registry.Remove("peer-id"))
+	assert.Zero(t, registry.Count())
+
+	// Reset is not passed on to the observers
+	require.NoError(t, registry.Add(NewPeer("other-id", "", "1.0.0"), nil))
+	registry.Reset()
+	assert.Zero(t, registry.Count())
+
+	assert.Equal(t, []string{"peer-id", "peer-id", "other-id"}, observer.added)
+	assert.Equal(t, []string{"peer-id"}, observer.removed)
+}
+
+// assertPeerTablesAgree checks that status, the registry and the topology
+// count the same peers
+func assertPeerTablesAgree(t *testing.T, network *Network, expected int) {
+	t.Helper()
+	assert.Equal(t, expected, network.peers.Count())
+	assert.Equal(t, expected, network.Status().TotalPeers)
+	assert.Len(t, network.Peers(), expected)
+	assert.Equal(t, expected, network.topologyMgr.GetPeerCount())
+}
+
+func TestPeerTablesAgree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := connectPair(t, ctx, "registry-a", "registry-b")
+	assertPeerTablesAgree(t, a, 1)
+	assertPeerTablesAgree(t, b, 1)
+	assert.Equal(t, 1, a.Status().ConnectedPeers)
+	assert.Len(t, a.ConnectedPeers(), 1)
+
+	// Every peer reported can be sent to
+	for _, peer := range a.Peers() {
+		assert.NoError(t, a.SendMessage(ctx, peer.ID, NewMessage("NOTE", a.nodeID, nil)))
+	}
+
+	// A stopped network forgets its peers but keeps their topology history
+	require.NoError(t, b.Stop())
+	assert.Zero(t, b.peers.Count())
+	assert.Zero(t, b.Status().TotalPeers)
+	assert.Equal(t, 1, b.topologyMgr.GetPeerCount())
+
+	// A peer that went away stays known until it is removed
+	require.Eventually(t, func() bool {
+		info, known := a.topologyMgr.GetPeerInfo("registry-b")
+		return known && !info.Connected
+	}, 5*time.Second, 20*time.Millisecond)
+	assertPeerTablesAgree(t, a, 1)
+	assert.Zero(t, a.Status().ConnectedPeers)
+	assert.Empty(t, a.ConnectedPeers())
+	require.NoError(t, a.DisconnectPeer("registry-b", DisconnectOptions{Reason: "test", Drain: true}))
+	assertPeerTablesAgree(t, a, 0)
+}
+
+func TestPeerSnapshots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, _ := connectPair(t, ctx, "snapshot-a", "snapshot-b")
+	require.Eventually(t, func() bool {
+		peer, ok := a.Peer("snapshot-b")
+		return ok && peer.HasCapability(CapabilityEncryption)
+	}, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, a.SetPeerMetadata("snapshot-b", map[string]string{"datacenter": "a"}))
+
+	peer, ok := a.Peer("snapshot-b")
+	require.True(t, ok)
+	assert.Equal(t, "snapshot-b", peer.ID)
+	assert.Equal(t, ProtocolVersion, peer.Version)
+	internal, _ := a.peers.Get("snapshot-b")
+	assert.Equal(t, internal.DialAddress(), peer.DialAddress)
+	assert.True(t, peer.Connected)
+	assert.False(t, peer.ConnectedAt.IsZero())
+	assert.False(t, peer.LastSeen.Before(peer.ConnectedAt))
+	assert.InDelta(t, a.PeerReputation("snapshot-b"), peer.Reputation, 0.05)
+	assert.True(t, peer.HasTag("datacenter=a"))
+	require.Len(t, a.Peers(), 1)
+	assert.Equal(t, "snapshot-b", a.Peers()[0].ID)
+
+	// A snapshot is a copy: changing it, or the peer, leaves the other be
+	peer.Capabilities[0] = "changed"
+	peer.Metadata["datacenter"] = "b"
+	again, _ := a.Peer("snapshot-b")
+	assert.NotEqual(t, "changed", again.Capabilities[0])
+	assert.True(t, again.HasTag("datacenter=a"))
+
+	require.NoError(t, a.SetPeerMetadata("snapshot-b", nil))
+	assert.True(t, peer.HasTag("datacenter=b"))
+
+	_, ok = a.Peer("snapshot-c")
+	assert.False(t, ok)
+}
+
+// assertStatusMatches waits for network to count connected of its known
+// peers as connected, then checks that its status agrees with what it
+// reports about them
+func assertStatusMatches(t *testing.T, network *Network, connected, known int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		status := network.Status()
+		return status.ConnectedPeers == connected && status.TotalPeers == known
+	}, 5*time.Second, 20*time.Millisecond, "%s: %+v", network.nodeID, network.Status())
+
+	status := network.Status()
+	assert.Equal(t, connected, status.ActiveConnections, "one active connection per connected peer")
+	assert.Len(t, network.ConnectedPeers(), status.ConnectedPeers)
+	assert.Len(t, network.Peers(), status.TotalPeers)
+	for _, peer := range network.ConnectedPeers() {
+		assert.NotNil(t, network.liveConnection(peer.ID), "connected peer %s has a live connection", peer.ID)
+	}
+}
+
+func TestStatusTracksConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := startLocalNetworkWith(t, ctx, "status-hub", dialNothing)
+	spokes := []*Network{
+		startLocalNetworkWith(t, ctx, "status-spoke-1", dialNothing),
+		startLocalNetworkWith(t, ctx, "status-spoke-2", dialNothing),
+		startLocalNetworkWith(t, ctx, "status-spoke-3", dialNothing),
+	}
+	assertStatusMatches(t, hub, 0, 0)
+
+	for round := 0; round < 3; round++ {
+		for i, spoke := range spokes {
+			_, err := spoke.Connect(ctx, localAddr(hub))
+			require.NoError(t, err)
+			assertStatusMatches(t, hub, i+1, i+1)
+			assertStatusMatches(t, spoke, 1, 1)
+		}
+
+		// A peer the hub drops is forgotten at once, and stops counting as
+		// connected straight away
+		require.NoError(t, hub.DisconnectPeer("status-spoke-1", DisconnectOptions{Reason: "test", Drain: true}))
+		status := hub.Status()
+		assert.Equal(t, 2, status.ConnectedPeers)
+		assert.Equal(t, 2, status.TotalPeers)
+		assert.Equal(t, 2, status.ActiveConnections)
+		assertStatusMatches(t, hub, 2, 2)
+		assertStatusMatches(t, spokes[0], 0, 0)
+
+		// A peer whose connection closed stays known
+		connection := hub.liveConnection("status-spoke-2")
+		require.NotNil(t, connection)
+		connection.closeWith("test")
+		assert.Equal(t, 1, hub.Status().ActiveConnections)
+		assertStatusMatches(t, hub, 1, 2)
+
+		// A peer that stops goes the same way
+		require.NoError(t, spokes[2].Stop())
+		assertStatusMatches(t, hub, 0, 2)
+		assertStatusMatches(t, spokes[2], 0, 0)
+		require.NoError(t, spokes[2].Start(ctx))
+
+		for _, spoke := range spokes[1:] {
+			if _, known := spoke.peers.Get("status-hub"); known {
+				spoke.DisconnectPeer("status-hub", DisconnectOptions{Reason: "test", Drain: true})
+			}
+		}
+		hub.DisconnectPeer("status-spoke-2", DisconnectOptions{Reason: "test", Drain: true})
+		hub.DisconnectPeer("status-spoke-3", DisconnectOptions{Reason: "test", Drain: true})
+		assertStatusMatches(t, hub, 0, 0)
+	}
+}
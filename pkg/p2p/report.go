@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/monitor"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+)
+
+// ConnectionQuality describes the live connection to a peer.
+//
+// A connection has no quality measurement when it is first made. Until one
+// exists, Measured is false and Latency, Bandwidth, PacketLoss and Jitter
+// are zero; they do not describe a perfect link. The connection fields are
+// always current. Load is what the peer last reported about how busy it
+// is, or nil before its first heartbeat.
+type ConnectionQuality struct {
+	PeerID         string    `json:"peer_id"`
+	Transport      string    `json:"transport"`
+	Outbound       bool      `json:"outbound"`
+	ConnectedSince time.Time `json:"connected_since"`
+	LastSeen       time.Time `json:"last_seen"`
+
+	Measured   bool          `json:"measured"`
+	MeasuredAt time.Time     `json:"measured_at,omitempty"`
+	Latency    time.Duration `json:"latency"`
+	Bandwidth  float64       `json:"bandwidth"`   // in Mbps
+	PacketLoss float64       `json:"packet_loss"` // percentage
+	Jitter     time.Duration `json:"jitter"`
+
+	Load *monitor.PeerLoad `json:"load,omitempty"`
+}
+
+// NetworkReport is a snapshot of the network's health for operators. Each
+// call builds a new one; nothing in it changes afterwards.
+type NetworkReport struct {
+	monitor.Report
+
+	// PeerQualities holds the quality of every connected peer
+	PeerQualities map[string]ConnectionQuality `json:"peer_qualities"`
+	Topology      topology.Metrics             `json:"topology_metrics"`
+	Isolation     IsolationReport              `json:"isolation"`
+	Discovery     DiscoveryStats               `json:"discovery"`
+	// ClockSkew holds, in seconds, how far each peer's clock is estimated to
+	// be ahead of ours, for the peers we have samples from
+	ClockSkew map[string]float64 `json:"clock_skew"`
+	// Storage is nil unless the network was given a storage manager
+	Storage *storage.Usage `json:"storage,omitempty"`
+	// Outbox is nil unless the reliable message journal is enabled
+	Outbox *OutboxStats `json:"outbox,omitempty"`
+	// Flapping describes the peers that disconnected within the flap
+	// damping window or are damped
+	Flapping []FlapState `json:"flapping,omitempty"`
+	// Sections holds the output of the functions added with
+	// AddReportSection, by name
+	Sections map[string]interface{} `json:"sections,omitempty"`
+}
+
+// GetNetworkReport returns a comprehensive report on the network
+func (n *Network) GetNetworkReport() NetworkReport {
+	qualities := make(map[string]ConnectionQuality)
+	for _, peerID := range n.topologyMgr.GetConnectedPeers() {
+		if quality, ok := n.GetConnectionQuality(peerID); ok {
+			qualities[peerID] = quality
+		}
+	}
+
+	var usage *storage.Usage
+	if n.storage != nil {
+		u := n.storage.Usage()
+		usage = &u
+	}
+
+	var outbox *OutboxStats
+	if n.outbox != nil {
+		stats := n.outbox.Stats()
+		outbox = &stats
+	}
+
+	n.reportsMu.RLock()
+	sections := make(map[string]interface{}, len(n.reports))
+	for name, section := range n.reports {
+		sections[name] = section()
+	}
+	n.reportsMu.RUnlock()
+
+	return NetworkReport{
+		Report:        n.monitor.GetNetworkReport(),
+		PeerQualities: qualities,
+		Topology:      n.GetTopologyMetrics(),
+		Isolation:     n.isolation.report(),
+		Discovery:     n.DiscoveryStats(),
+		ClockSkew:     n.clockSkewReport(),
+		Storage:       usage,
+		Outbox:        outbox,
+		Flapping:      n.FlappingPeers(),
+		Sections:      sections,
+	}
+}
+
+// AddReportSection includes the output of fn under name in the Sections of
+// every network report, so subsystems outside the p2p layer can surface
+// their state
+func (n *Network) AddReportSection(name string, fn func() interface{}) {
+	n.reportsMu.Lock()
+	defer n.reportsMu.Unlock()
+
+	if n.reports == nil {
+		n.reports = make(map[string]func() interface{})
+	}
+	n.reports[name] = fn
+}
+
+// GetTopologyMetrics summarizes the peers the topology manager knows about.
+// Average latency and bandwidth cover only connected peers whose connection
+// has been measured.
+func (n *Network) GetTopologyMetrics() topology.Metrics {
+	return n.topologyMgr.GetNetworkMetrics()
+}
+
+// GetConnectionQuality returns the quality of the connection to a peer as of
+// now. ok is false if we have no live connection to the peer.
+func (n *Network) GetConnectionQuality(peerID string) (ConnectionQuality, bool) {
+	connection := n.liveConnection(peerID)
+	if connection == nil {
+		return ConnectionQuality{}, false
+	}
+	info, known := n.topologyMgr.GetPeerInfo(peerID)
+	if !known || !info.Connected {
+		return ConnectionQuality{}, false
+	}
+
+	connection.mu.RLock()
+	lastSeen := connection.LastSeen
+	connection.mu.RUnlock()
+
+	quality := ConnectionQuality{
+		PeerID:         peerID,
+		Transport:      connection.Transport(),
+		Outbound:       connection.Outbound,
+		ConnectedSince: connection.CreatedAt,
+		LastSeen:       lastSeen,
+	}
+	if measured := info.Quality; measured.Measured() {
+		quality.Measured = true
+		quality.MeasuredAt = measured.LastUpdate
+		quality.Latency = measured.Latency
+		quality.Bandwidth = measured.Bandwidth
+		quality.PacketLoss = measured.PacketLoss
+		quality.Jitter = measured.Jitter
+	}
+	if load, ok := n.monitor.Quality.GetPeerLoad(peerID); ok {
+		quality.Load = &load
+	}
+	return quality, true
+}
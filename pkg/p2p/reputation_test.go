@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFrame(t *testing.T) {
+	input := "small\n" + strings.Repeat("x", 64) + "\nafter\n"
+	reader := bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	frame, err := readFrame(reader, 32)
+	require.NoError(t, err)
+	assert.Equal(t, "small\n", string(frame))
+
+	_, err = readFrame(reader, 32)
+	assert.ErrorIs(t, err, errFrameTooLarge)
+
+	// The stream stays aligned after an oversize frame
+	frame, err = readFrame(reader, 32)
+	require.NoError(t, err)
+	assert.Equal(t, "after\n", string(frame))
+}
+
+func TestBadInputLowersReputation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "reputation-node")
+
+	network.topologyMgr.AddPeer(topology.Peer{ID: "bad-peer"})
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	connection := &Connection{ID: "pipe", PeerID: "bad-peer", Conn: local, CreatedAt: time.Now(), LastSeen: time.Now()}
+	go network.readMessages(local, connection)
+
+	// Collect the ERROR replies sent back for each bad frame
+	codes := make(chan string, 3)
+	go func() {
+		reader := bufio.NewReader(remote)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			if msg, err := DeserializeMessage(line); err == nil && msg.Type == MessageTypeError {
+				var payload ErrorPayload
+				if msg.DecodePayload(&payload) == nil {
+					codes <- payload.Code
+				}
+			}
+		}
+	}()
+
+	frames := []string{
+		"not json at all\n",
+		`{"type":"","id":"x","sender":"bad-peer"}` + "\n",
+		strings.Repeat("a", MaxMessageSize+10) + "\n",
+	}
+	for _, frame := range frames {
+		_, err := remote.Write([]byte(frame))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		info, _ := network.topologyMgr.GetPeerInfo("bad-peer")
+		return info.Reputation < -0.4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	var received []string
+	for len(received) < len(frames) {
+		select {
+		case code := <-codes:
+			received = append(received, code)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only received error codes %v", received)
+		}
+	}
+	assert.Equal(t, []string{ErrorCodeInvalidMessage, ErrorCodeInvalidMessage, ErrorCodeMessageTooLarge}, received)
+
+	// Undecodable and invalid frames are counted apart from good messages
+	stats := network.monitor.Stats.GetStats()
+	assert.Equal(t, uint64(1), stats.DecodeFailures)
+	assert.Equal(t, uint64(1), stats.MessagesInvalid)
+	assert.Equal(t, uint64(1), stats.TotalMessagesReceived)
+}
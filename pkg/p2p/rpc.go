@@ -0,0 +1,236 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// pendingReplies tracks callers waiting for a reply to a message they sent
+type pendingReplies struct {
+	waiters map[string]replyWaiter
+	mu      sync.Mutex
+}
+
+// replyWaiter is a caller waiting for a reply from the peer it sent to
+type replyWaiter struct {
+	peerID  string
+	replies chan Message
+}
+
+// newPendingReplies creates an empty reply tracker
+func newPendingReplies() *pendingReplies {
+	return &pendingReplies{
+		waiters: make(map[string]replyWaiter),
+	}
+}
+
+// register starts waiting for peerID's reply to the message with the given
+// ID
+func (p *pendingReplies) register(id, peerID string) chan Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch := make(chan Message, 1)
+	p.waiters[id] = replyWaiter{peerID: peerID, replies: ch}
+	return ch
+}
+
+// cancel stops waiting for a reply
+func (p *pendingReplies) cancel(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiters, id)
+}
+
+// resolve hands a reply that arrived from fromPeerID to its waiter and
+// reports whether anyone was waiting for it. A reply from any other peer than
+// the one the message was sent to, by its sender or the connection it came
+// over, is left to the normal handlers.
+func (p *pendingReplies) resolve(msg Message, fromPeerID string) bool {
+	p.mu.Lock()
+	waiter, exists := p.waiters[msg.ReplyTo]
+	if exists && (msg.Sender != waiter.peerID || fromPeerID != waiter.peerID) {
+		exists = false
+	}
+	if exists {
+		delete(p.waiters, msg.ReplyTo)
+	}
+	p.mu.Unlock()
+
+	if exists {
+		waiter.replies <- msg
+	}
+	return exists
+}
+
+// Request sends a message to a peer and waits for the reply correlated with
+// it. If the peer answers with an ERROR, it is returned as an *ErrorPayload.
+func (n *Network) Request(ctx context.Context, peerID string, msg Message) (Message, error) {
+	msg.ExpectReply = true
+	return n.awaitReply(ctx, peerID, msg)
+}
+
+// Reply answers a request received from a peer
+func (n *Network) Reply(req Message, msgType string, payload interface{}) error {
+	reply := NewMessage(msgType, n.nodeID, payload)
+	reply.answer(&req)
+	return n.SendMessage(context.Background(), req.Sender, reply)
+}
+
+// SendMessageReliable sends a message and waits until the peer acknowledges
+// that it accepted it. If the peer rejects it, the ERROR is returned as an
+// *ErrorPayload. With the reliable journal enabled the message is journaled
+// first, and one that is not acknowledged fails with ErrDeliveryPending: it
+// is sent again when the peer next connects, even after a restart, unless
+// its TTL ran out by then. One that expires before it is sent fails with
+// ErrMessageExpired and is not journaled any longer.
+func (n *Network) SendMessageReliable(ctx context.Context, peerID string, msg Message) error {
+	msg.RequireAck = true
+	traceMessage(ctx, &msg)
+	if n.outbox == nil {
+		_, err := n.awaitReply(ctx, peerID, msg)
+		return err
+	}
+
+	if err := n.outbox.Add(peerID, msg); err != nil {
+		return err
+	}
+	_, err := n.awaitReply(ctx, peerID, msg)
+	var rejected *ErrorPayload
+	if err != nil && !errors.As(err, &rejected) && !errors.Is(err, ErrMessageExpired) {
+		n.outbox.Release(msg.ID)
+		return fmt.Errorf("%w: %w", ErrDeliveryPending, err)
+	}
+	if journalErr := n.outbox.Complete(msg.ID); journalErr != nil {
+		n.messageLogger(&msg).Errorf("failed to journal delivery of %s: %v", msg.ID, journalErr)
+	}
+	return err
+}
+
+// awaitReply sends msg and blocks until a correlated reply, the context or
+// DefaultRequestTimeout ends the wait
+func (n *Network) awaitReply(ctx context.Context, peerID string, msg Message) (Message, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	traceMessage(ctx, &msg)
+	replies := n.pending.register(msg.ID, peerID)
+	defer n.pending.cancel(msg.ID)
+
+	// Draining the peer waits for reliable sends to be acknowledged
+	if msg.RequireAck {
+		if connection := n.liveConnection(peerID); connection != nil {
+			connection.inflight.add()
+			defer connection.inflight.done()
+		}
+	}
+
+	if err := n.SendMessage(ctx, peerID, msg); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case reply := <-replies:
+		if reply.Type == MessageTypeError {
+			return reply, decodeErrorPayload(reply)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return Message{}, fmt.Errorf("no reply from %s to %s: %w", peerID, msg.ID, ctx.Err())
+	}
+}
+
+// handleReply routes a correlated reply to its waiter. It reports whether the
+// message was consumed.
+func (n *Network) handleReply(msg *Message, conn *Connection) bool {
+	if msg.ReplyTo == "" || !n.pending.resolve(*msg, conn.PeerID) {
+		return false
+	}
+	if msg.Type != MessageTypeError {
+		n.reputation.RecordEvent(conn.PeerID, topology.EventSuccessfulExchange)
+	}
+	return true
+}
+
+// handleErrorMessage logs an ERROR nobody was waiting for
+func (n *Network) handleErrorMessage(msg *Message, conn *Connection) error {
+	err := decodeErrorPayload(*msg)
+	n.messageLogger(msg).Warnf("peer %s rejected message %s: %v", msg.Sender, msg.ReplyTo, err)
+	return nil
+}
+
+// decodeErrorPayload extracts the ErrorPayload of an ERROR message as an error
+func decodeErrorPayload(msg Message) error {
+	var payload ErrorPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		return err
+	}
+	return &payload
+}
+
+// rejectMessage tells the peer its message was refused, counts the error
+// against the peer and feeds it into the reputation system
+func (n *Network) rejectMessage(connection *Connection, msgID, code, reason string, event topology.BehaviorEvent) {
+	if connection.PeerID != "" {
+		peer, exists := n.peers.Get(connection.PeerID)
+		if exists {
+			peer.IncrementErrorCount()
+		}
+	}
+	n.reputation.RecordEvent(connection.PeerID, event)
+	n.sendError(connection, msgID, code, reason)
+}
+
+// sendError answers msgID with an ERROR without holding it against the peer
+func (n *Network) sendError(connection *Connection, msgID, code, reason string) {
+	reject := NewMessage(MessageTypeError, n.nodeID, ErrorPayload{
+		Code:      code,
+		Message:   reason,
+		MessageID: msgID,
+	})
+	reject.ReplyTo = msgID
+	if err := n.send(connection, reject); err != nil {
+		n.logger.Debugf("failed to send error for %s: %v", msgID, err)
+	}
+}
+
+// acknowledge confirms receipt of a message that asked for an ACK
+func (n *Network) acknowledge(msg *Message, connection *Connection) {
+	ack := NewMessage(MessageTypeAck, n.nodeID, nil)
+	ack.answer(msg)
+	if err := n.send(connection, ack); err != nil {
+		n.messageLogger(msg).Debugf("failed to acknowledge %s: %v", msg.ID, err)
+	}
+}
+
+// hasHandler reports whether an application handler is registered for a type
+func (n *Network) hasHandler(msgType string) bool {
+	n.handlersMu.RLock()
+	defer n.handlersMu.RUnlock()
+	return len(n.handlers[msgType]) > 0
+}
+
+// messageID extracts the ID of a message that could not be fully decoded
+func messageID(codec Codec, data []byte) string {
+	var probe struct {
+		ID string `json:"id"`
+	}
+	codec.Unmarshal(data, &probe)
+	return probe.ID
+}
+
+// messageType extracts the type of a message without decoding the rest
+func messageType(codec Codec, data []byte) string {
+	var probe struct {
+		Type string `json:"type"`
+	}
+	codec.Unmarshal(data, &probe)
+	return probe.Type
+}
@@ -0,0 +1,181 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectPair starts two networks and connects a to b
+func connectPair(t *testing.T, ctx context.Context, aID, bID string) (*Network, *Network) {
+	a := startLocalNetwork(t, ctx, aID)
+	b := startLocalNetwork(t, ctx, bID)
+
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	return a, b
+}
+
+func TestRequestReply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, server := connectPair(t, ctx, "client-node", "server-node")
+	server.RegisterHandler("ECHO", func(msg Message) {
+		server.Reply(msg, "ECHO_REPLY", msg.Payload)
+	})
+
+	reply, err := client.Request(ctx, "server-node", NewMessage("ECHO", client.nodeID, "hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "ECHO_REPLY", reply.Type)
+	var echoed string
+	require.NoError(t, reply.DecodePayload(&echoed))
+	assert.Equal(t, "hello", echoed)
+
+	// Nobody handles this type, so the request fails fast instead of timing out
+	_, err = client.Request(ctx, "server-node", NewMessage("UNKNOWN", client.nodeID, nil))
+	var remoteErr *ErrorPayload
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, ErrorCodeNotImplemented, remoteErr.Code)
+
+	// A request nobody answers times out with the caller's context
+	server.RegisterHandler("SILENT", func(msg Message) {})
+	shortCtx, shortCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer shortCancel()
+	_, err = client.Request(shortCtx, "server-node", NewMessage("SILENT", client.nodeID, nil))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestReplyOnlyFromAskedPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "asking-node")
+	_, asked, _ := attachPipePeer(t, network, "asked-peer")
+	_, other, _ := attachPipePeer(t, network, "other-peer")
+
+	// Replies that do not come from the peer asked go to the normal handlers
+	handled := make(chan string, 2)
+	network.RegisterHandler("ECHO_REPLY", func(msg Message) { handled <- msg.Sender })
+
+	request := NewMessage("ECHO", network.nodeID, "hello")
+	replies := make(chan Message, 1)
+	go func() {
+		reply, err := network.Request(ctx, "asked-peer", request)
+		if err == nil {
+			replies <- reply
+		}
+	}()
+	require.Eventually(t, func() bool {
+		network.pending.mu.Lock()
+		defer network.pending.mu.Unlock()
+		_, waiting := network.pending.waiters[request.ID]
+		return waiting
+	}, 5*time.Second, 10*time.Millisecond)
+
+	answer := func(sender string) Message {
+		reply := NewMessage("ECHO_REPLY", sender, "hello")
+		reply.answer(&request)
+		return reply
+	}
+	writeFrame(t, other, answer("other-peer"))
+	writeFrame(t, other, answer("asked-peer"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("misdirected reply not handled")
+		}
+	}
+	assert.Empty(t, replies)
+
+	writeFrame(t, asked, answer("asked-peer"))
+	select {
+	case reply := <-replies:
+		assert.Equal(t, "asked-peer", reply.Sender)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply from the asked peer not delivered")
+	}
+}
+
+func TestSendMessageReliable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sender, receiver := connectPair(t, ctx, "sender-node", "receiver-node")
+	delivered := make(chan Message, 1)
+	receiver.RegisterHandler("NOTE", func(msg Message) { delivered <- msg })
+
+	require.NoError(t, sender.SendMessageReliable(ctx, "receiver-node", NewMessage("NOTE", sender.nodeID, "remember")))
+	select {
+	case msg := <-delivered:
+		var note string
+		require.NoError(t, msg.DecodePayload(&note))
+		assert.Equal(t, "remember", note)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reliable message not delivered")
+	}
+}
+
+func TestDuplicateMessagesDropped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sender, receiver := connectPair(t, ctx, "sender-node", "receiver-node")
+	delivered := make(chan Message, 4)
+	receiver.RegisterHandler("NOTE", func(msg Message) { delivered <- msg })
+
+	// A retransmitted message is delivered once but acknowledged every time
+	msg := NewMessage("NOTE", sender.nodeID, "once")
+	require.NoError(t, sender.SendMessageReliable(ctx, "receiver-node", msg))
+	require.NoError(t, sender.SendMessageReliable(ctx, "receiver-node", msg))
+	require.NoError(t, sender.SendMessage(ctx, "receiver-node", msg))
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	require.Eventually(t, func() bool {
+		return receiver.monitor.Stats.GetStats().DuplicateMessages == 2
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Empty(t, delivered)
+
+	assert.Equal(t, uint64(2), receiver.GetNetworkReport().Stats.DuplicateMessages)
+}
+
+func TestMalformedSyncRequestProducesError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sender := startLocalNetwork(t, ctx, "sync-client")
+	receiver := startLocalNetwork(t, ctx, "sync-server")
+	receiver.RegisterHandler(MessageTypeSyncRequest, func(msg Message) {
+		t.Error("malformed sync request reached the handler")
+	})
+	_, err := sender.Connect(ctx, localAddr(receiver))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(sender.PeersWithCapability(CapabilitySync)) == 1 && len(receiver.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	malformed := NewMessage(MessageTypeSyncRequest, sender.nodeID, "not a sync request")
+	_, err = sender.Request(ctx, "sync-server", malformed)
+
+	var remoteErr *ErrorPayload
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, ErrorCodeInvalidMessage, remoteErr.Code)
+	assert.Equal(t, malformed.ID, remoteErr.MessageID)
+
+	assert.Equal(t, uint64(1), receiver.peers.All()[0].ErrorCount())
+
+	// A well-formed request is accepted
+	valid := NewMessage(MessageTypeSyncRequest, sender.nodeID, SyncRequestPayload{Keys: []string{"a"}})
+	assert.NoError(t, valid.ValidatePayload())
+}
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// seenCache remembers message IDs for a bounded amount of time
+type seenCache struct {
+	ttl       time.Duration
+	entries   map[string]time.Time
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// newSeenCache creates a seen-message cache with the given TTL
+func newSeenCache(ttl time.Duration) *seenCache {
+	if ttl <= 0 {
+		ttl = DefaultSeenCacheTTL
+	}
+
+	return &seenCache{
+		ttl:       ttl,
+		entries:   make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Add records a message ID and reports whether it was not seen before
+func (s *seenCache) Add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > s.ttl/2 {
+		s.sweep(now)
+	}
+
+	if seenAt, exists := s.entries[id]; exists && now.Sub(seenAt) < s.ttl {
+		return false
+	}
+
+	s.entries[id] = now
+	return true
+}
+
+// Contains reports whether a message ID is currently remembered
+func (s *seenCache) Contains(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seenAt, exists := s.entries[id]
+	return exists && time.Since(seenAt) < s.ttl
+}
+
+// Len returns the number of remembered message IDs
+func (s *seenCache) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// sweep drops expired entries; callers must hold s.mu
+func (s *seenCache) sweep(now time.Time) {
+	for id, seenAt := range s.entries {
+		if now.Sub(seenAt) >= s.ttl {
+			delete(s.entries, id)
+		}
+	}
+	s.lastSweep = now
+}
+
+// idLRU remembers a fixed number of the most recently seen message IDs
+type idLRU struct {
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+	mu       sync.Mutex
+}
+
+// newIDLRU creates an LRU holding up to capacity message IDs
+func newIDLRU(capacity int) *idLRU {
+	if capacity <= 0 {
+		capacity = DefaultReceivedIDCacheSize
+	}
+
+	return &idLRU{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Add records a message ID as the most recent and reports whether it was not
+// already remembered. The least recent ID is evicted when the LRU is full.
+func (l *idLRU) Add(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, exists := l.entries[id]; exists {
+		l.order.MoveToFront(elem)
+		return false
+	}
+
+	l.entries[id] = l.order.PushFront(id)
+	if l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(string))
+	}
+	return true
+}
+
+// Len returns the number of remembered message IDs
+func (l *idLRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
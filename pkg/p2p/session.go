@@ -0,0 +1,267 @@
+package p2p
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/session"
+)
+
+// ticket is what we keep of a handshake with a peer to resume it later
+type ticket struct {
+	peerID   string
+	secret   []byte
+	ticketID string
+	// The peer's key, proven in the full handshake the session started with
+	identity *rsa.PublicKey
+	// Fingerprint of our key when the session started; tickets do not
+	// outlive the key they were issued under
+	localKey string
+	expires  time.Time
+}
+
+// sessionCache keeps the session tickets of a bounded number of peers for
+// a bounded amount of time. A peer has at most one ticket, and every ticket
+// is used once: resuming a session replaces it.
+type sessionCache struct {
+	size     int
+	ttl      time.Duration
+	now      func() time.Time
+	byPeer   map[string]*ticket
+	byTicket map[string]*ticket
+	mu       sync.Mutex
+}
+
+// newSessionCache creates a cache of at most size tickets that expire after
+// ttl. A size of 0 keeps no tickets.
+func newSessionCache(size int, ttl time.Duration) *sessionCache {
+	return &sessionCache{
+		size:     size,
+		ttl:      ttl,
+		now:      time.Now,
+		byPeer:   make(map[string]*ticket),
+		byTicket: make(map[string]*ticket),
+	}
+}
+
+// put stores a ticket for peerID, replacing any it had. When the cache is
+// full the ticket expiring first makes room.
+func (c *sessionCache) put(peerID string, secret []byte, identity *rsa.PublicKey, localKey string) {
+	if c.size <= 0 || identity == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(peerID)
+	if len(c.byPeer) >= c.size {
+		var oldest *ticket
+		for _, s := range c.byPeer {
+			if oldest == nil || s.expires.Before(oldest.expires) {
+				oldest = s
+			}
+		}
+		c.removeLocked(oldest.peerID)
+	}
+
+	s := &ticket{
+		peerID:   peerID,
+		secret:   secret,
+		ticketID: string(crypto.TicketID(secret)),
+		identity: identity,
+		localKey: localKey,
+		expires:  c.now().Add(c.ttl),
+	}
+	c.byPeer[peerID] = s
+	c.byTicket[s.ticketID] = s
+}
+
+// forPeer returns the ticket to resume a session with peerID, if it has
+// one that is unexpired and was issued under localKey
+func (c *sessionCache) forPeer(peerID, localKey string) *ticket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, exists := c.byPeer[peerID]
+	if !exists || !c.usableLocked(s, localKey) {
+		return nil
+	}
+	return s
+}
+
+// redeem takes the ticket with the given ID out of the cache if it is
+// unexpired, was issued under localKey and passes verify. A ticket that
+// fails verify stays, so a forged request cannot spend it.
+func (c *sessionCache) redeem(ticketID []byte, localKey string, verify func(*ticket) error) (*ticket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, exists := c.byTicket[string(ticketID)]
+	if !exists || !c.usableLocked(s, localKey) {
+		return nil, fmt.Errorf("unknown or expired session ticket")
+	}
+	if err := verify(s); err != nil {
+		return nil, err
+	}
+	c.removeLocked(s.peerID)
+	return s, nil
+}
+
+// remove forgets the ticket of peerID
+func (c *sessionCache) remove(peerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(peerID)
+}
+
+// Len returns the number of tickets kept, expired ones included
+func (c *sessionCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.byPeer)
+}
+
+// usableLocked reports whether s may be resumed, forgetting it if it may
+// never be; callers must hold c.mu
+func (c *sessionCache) usableLocked(s *ticket, localKey string) bool {
+	if !c.now().Before(s.expires) || s.localKey != localKey {
+		c.removeLocked(s.peerID)
+		return false
+	}
+	return true
+}
+
+// removeLocked forgets the ticket of peerID; callers must hold c.mu
+func (c *sessionCache) removeLocked(peerID string) {
+	if s, exists := c.byPeer[peerID]; exists {
+		delete(c.byPeer, peerID)
+		delete(c.byTicket, s.ticketID)
+	}
+}
+
+// localKey returns the fingerprint of our key, which session tickets are
+// bound to
+func (n *Network) localKey() string {
+	fingerprint, err := crypto.KeyFingerprint(n.encryptor.PublicKey())
+	if err != nil {
+		return ""
+	}
+	return fingerprint
+}
+
+// rememberSession keeps a ticket for the session a full handshake with
+// peerID started. ours and theirs are the handshake messages exchanged.
+func (n *Network) rememberSession(peerID string, connection *Connection, ours, theirs *crypto.HandshakeMessage) {
+	secret, err := crypto.SessionSecret(ours, theirs, connection.Outbound)
+	if err != nil {
+		n.logger.Debugf("no session ticket for peer %s: %v", peerID, err)
+		return
+	}
+	if secret != nil {
+		n.sessions.put(peerID, secret, connection.identity, n.localKey())
+	}
+}
+
+// resumeSession tries to resume the session of a ticket on a connection we
+// dialed. It reports false, and no error, if the peer refuses the ticket:
+// the full handshake then follows on the same connection.
+func (n *Network) resumeSession(s *session.Session, connection *Connection, t *ticket) (bool, error) {
+	request, err := n.handshakeMgr.CreateResumeRequest(t.secret)
+	if err != nil {
+		return false, fmt.Errorf("failed to create resume request: %w", err)
+	}
+	// Whatever the answer, this ticket is spent
+	n.sessions.remove(t.peerID)
+
+	if err := s.Send(request); err != nil {
+		return false, fmt.Errorf("failed to send resume request: %w", err)
+	}
+
+	response, err := s.Receive()
+	if err != nil {
+		return false, fmt.Errorf("failed to receive resume response: %w", err)
+	}
+	if response.Resume == nil {
+		return false, &handshakeError{peerID: response.NodeID, err: fmt.Errorf("peer answered a resume request with a full handshake")}
+	}
+	if !response.Resume.Accepted {
+		n.logger.Debugf("peer %s refused to resume our session, falling back to a full handshake", t.peerID)
+		n.monitor.Stats.IncrementResumptionsRefused()
+		return false, nil
+	}
+
+	if response.NodeID != t.peerID {
+		return false, &handshakeError{peerID: response.NodeID, err: fmt.Errorf("resumed session of %s with %s", t.peerID, response.NodeID)}
+	}
+	if err := crypto.VerifyResumeResponse(response, request, t.secret); err != nil {
+		return false, &handshakeError{peerID: response.NodeID, err: fmt.Errorf("resume response verification failed: %w", err)}
+	}
+
+	version, err := negotiateVersion(n.protocolVersion, n.minProtocolVersion, response.ProtocolVersion, response.MinProtocolVersion)
+	if err != nil {
+		n.rejectIncompatiblePeer(connection, err)
+		return false, fmt.Errorf("rejected peer %s: %w", response.NodeID, err)
+	}
+
+	connection.identity = t.identity
+	if err := n.registerPeer(t.peerID, connection, version); err != nil {
+		return false, err
+	}
+
+	n.sessions.put(t.peerID, crypto.ResumedSecret(t.secret, request, response), t.identity, t.localKey)
+	n.monitor.Stats.IncrementHandshakesResumed()
+	return true, nil
+}
+
+// acceptResumption answers a request to resume a session on a connection
+// dialed by the peer. It reports false, and no error, if it refused the
+// request: the peer then goes on with a full handshake.
+func (n *Network) acceptResumption(s *session.Session, connection *Connection, request *crypto.HandshakeMessage) (bool, error) {
+	t, err := n.sessions.redeem(request.Resume.TicketID, n.localKey(), func(t *ticket) error {
+		if t.peerID != request.NodeID {
+			return fmt.Errorf("ticket of %s presented by %s", t.peerID, request.NodeID)
+		}
+		return crypto.VerifyResumeRequest(request, t.secret)
+	})
+	if err != nil {
+		n.logger.Debugf("refusing to resume session of peer %s: %v", request.NodeID, err)
+		n.monitor.Stats.IncrementResumptionsRefused()
+
+		refusal, err := n.handshakeMgr.CreateResumeResponse(request, nil)
+		if err != nil {
+			return false, fmt.Errorf("failed to create resume response: %w", err)
+		}
+		if err := s.Send(refusal); err != nil {
+			return false, fmt.Errorf("failed to send resume response: %w", err)
+		}
+		return false, nil
+	}
+
+	version, err := negotiateVersion(n.protocolVersion, n.minProtocolVersion, request.ProtocolVersion, request.MinProtocolVersion)
+	if err != nil {
+		n.rejectIncompatiblePeer(connection, err)
+		return false, fmt.Errorf("rejected peer %s: %w", request.NodeID, err)
+	}
+
+	connection.identity = t.identity
+	if err := n.registerPeer(t.peerID, connection, version); err != nil {
+		n.rejectDuplicatePeer(connection, err)
+		return false, err
+	}
+
+	response, err := n.handshakeMgr.CreateResumeResponse(request, t.secret)
+	if err != nil {
+		return false, fmt.Errorf("failed to create resume response: %w", err)
+	}
+	if err := s.Send(response); err != nil {
+		return false, fmt.Errorf("failed to send resume response: %w", err)
+	}
+
+	n.sessions.put(t.peerID, crypto.ResumedSecret(t.secret, request, response), t.identity, t.localKey)
+	n.monitor.Stats.IncrementHandshakesResumed()
+	return true, nil
+}
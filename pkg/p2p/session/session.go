@@ -0,0 +1,240 @@
+// Package session runs one peer connection below the level of messages: the
+// handshake that tells who is on the other end, and the loop reading what
+// follows it. What a handshake accepts is up to a Policy, which the network
+// implements; a Session knows nothing of peers beyond the handshake messages
+// it exchanges.
+package session
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+)
+
+// Policy decides what a handshake accepts, and takes the peer on once it
+// does
+type Policy interface {
+	// Hello returns our handshake message. Answering a peer, theirs is its
+	// verified message; opening a handshake, it is nil.
+	Hello(theirs *crypto.HandshakeMessage) (*crypto.HandshakeMessage, error)
+	// Verify checks the peer's handshake message and registers the peer.
+	// ours is the message we opened with, or nil when the peer opened.
+	Verify(ours, theirs *crypto.HandshakeMessage) error
+	// Resume tries to resume an earlier session with the peer before we
+	// open a full handshake, and reports whether it did. If not, the full
+	// handshake follows.
+	Resume(s *Session) (bool, error)
+	// AcceptResumption answers the peer's request to resume a session, and
+	// reports whether it did. If not, the peer's full handshake follows.
+	AcceptResumption(s *Session, request *crypto.HandshakeMessage) (bool, error)
+	// Established is told the messages of a completed full handshake
+	Established(ours, theirs *crypto.HandshakeMessage)
+}
+
+// Config tunes a session
+type Config struct {
+	// WriteTimeout bounds each handshake message written; 0 waits forever
+	WriteTimeout time.Duration
+	// HandshakeTimeout bounds the whole handshake, so a peer that never
+	// completes it is dropped rather than waited on; 0 waits forever
+	HandshakeTimeout time.Duration
+	// Decode parses a handshake frame without its newline. A peer refusing
+	// us may send something else in place of its handshake message, which
+	// Decode turns into an error. Nil decodes the frame as JSON.
+	Decode func(frame []byte) (*crypto.HandshakeMessage, error)
+}
+
+// Session is one connection to a peer. The handshake and the read loop
+// share its buffered reader, so bytes buffered during one are not lost to
+// the other.
+type Session struct {
+	conn   net.Conn
+	config Config
+	reader *bufio.Reader
+	// peer is the peer's handshake message, once a full handshake
+	// completed; resumed is set once a session was resumed instead
+	peer    *crypto.HandshakeMessage
+	resumed bool
+	mu      sync.Mutex
+}
+
+// New starts a session over conn
+func New(conn net.Conn, config Config) *Session {
+	return &Session{conn: conn, config: config}
+}
+
+// Conn returns the connection the session runs over
+func (s *Session) Conn() net.Conn {
+	return s.conn
+}
+
+// Reader returns the buffered reader of the connection
+func (s *Session) Reader() *bufio.Reader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reader == nil {
+		s.reader = bufio.NewReader(s.conn)
+	}
+	return s.reader
+}
+
+// Peer returns the handshake message the peer proved itself with, or nil
+// if no full handshake completed
+func (s *Session) Peer() *crypto.HandshakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peer
+}
+
+// Resumed reports whether the handshake resumed an earlier session
+func (s *Session) Resumed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resumed
+}
+
+// Open runs the handshake on a connection we dialed: it resumes an earlier
+// session if policy can, and sends our handshake message first otherwise
+func (s *Session) Open(policy Policy) error {
+	s.startHandshake()
+
+	resumed, err := policy.Resume(s)
+	if err != nil || resumed {
+		s.finish(nil, resumed)
+		return err
+	}
+
+	ours, err := policy.Hello(nil)
+	if err != nil {
+		return err
+	}
+	if err := s.Send(ours); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
+	}
+
+	theirs, err := s.Receive()
+	if err != nil {
+		return fmt.Errorf("failed to receive response handshake: %w", err)
+	}
+	if err := policy.Verify(ours, theirs); err != nil {
+		return err
+	}
+	s.finish(theirs, false)
+	policy.Established(ours, theirs)
+	return nil
+}
+
+// Answer runs the handshake on a connection the peer dialed: the peer
+// resumes an earlier session or sends its handshake message first, which
+// ours answers once policy verified it
+func (s *Session) Answer(policy Policy) error {
+	s.startHandshake()
+
+	theirs, err := s.Receive()
+	if err != nil {
+		return fmt.Errorf("failed to receive handshake: %w", err)
+	}
+	if theirs.Resume != nil {
+		resumed, err := policy.AcceptResumption(s, theirs)
+		if err != nil || resumed {
+			s.finish(nil, resumed)
+			return err
+		}
+		theirs, err = s.Receive()
+		if err != nil {
+			return fmt.Errorf("failed to receive handshake: %w", err)
+		}
+	}
+
+	if err := policy.Verify(nil, theirs); err != nil {
+		return err
+	}
+	ours, err := policy.Hello(theirs)
+	if err != nil {
+		return err
+	}
+	if err := s.Send(ours); err != nil {
+		return fmt.Errorf("failed to send response handshake: %w", err)
+	}
+	s.finish(theirs, false)
+	policy.Established(ours, theirs)
+	return nil
+}
+
+// startHandshake gives the handshake its deadline. The read loop sets its
+// own deadlines afterwards.
+func (s *Session) startHandshake() {
+	if s.config.HandshakeTimeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	}
+}
+
+// finish records how the handshake completed
+func (s *Session) finish(peer *crypto.HandshakeMessage, resumed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peer = peer
+	s.resumed = resumed
+}
+
+// Send writes a handshake message as one newline-terminated JSON frame
+func (s *Session) Send(msg *crypto.HandshakeMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal handshake message: %w", err)
+	}
+	data = append(data, '\n')
+
+	if s.config.WriteTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	}
+	if _, err := s.conn.Write(data); err != nil {
+		return fmt.Errorf("failed to write handshake message: %w", err)
+	}
+	return nil
+}
+
+// Receive reads the peer's next handshake message
+func (s *Session) Receive() (*crypto.HandshakeMessage, error) {
+	data, err := s.Reader().ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handshake message: %w", err)
+	}
+	data = data[:len(data)-1]
+	if s.config.Decode != nil {
+		return s.config.Decode(data)
+	}
+
+	var msg crypto.HandshakeMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal handshake message: %w", err)
+	}
+	return &msg, nil
+}
+
+// Serve reads from the session until read fails or ctx ends, when it
+// returns ctx.Err(). Each call of read, which consumes one frame or
+// whatever else the peer sends next from the reader, is given idle to
+// start receiving it. An error read returns ends the loop unless retry
+// approves of it.
+func (s *Session) Serve(ctx context.Context, idle time.Duration, read func(*bufio.Reader) error, retry func(error) bool) error {
+	reader := s.Reader()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.conn.SetReadDeadline(time.Now().Add(idle))
+		if err := read(reader); err != nil {
+			if retry != nil && retry(err) {
+				continue
+			}
+			return err
+		}
+	}
+}
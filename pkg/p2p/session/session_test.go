@@ -0,0 +1,275 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPolicy accepts any peer but the ones verifyErr refuses, and resumes
+// sessions as resume and acceptResumption say
+type testPolicy struct {
+	name             string
+	helloErr         error
+	verifyErr        error
+	resume           func(s *Session) (bool, error)
+	acceptResumption func(s *Session, request *crypto.HandshakeMessage) (bool, error)
+
+	verified    []*crypto.HandshakeMessage
+	established bool
+}
+
+func (p *testPolicy) Hello(theirs *crypto.HandshakeMessage) (*crypto.HandshakeMessage, error) {
+	if p.helloErr != nil {
+		return nil, p.helloErr
+	}
+	return &crypto.HandshakeMessage{NodeID: p.name}, nil
+}
+
+func (p *testPolicy) Verify(ours, theirs *crypto.HandshakeMessage) error {
+	p.verified = append(p.verified, theirs)
+	return p.verifyErr
+}
+
+func (p *testPolicy) Resume(s *Session) (bool, error) {
+	if p.resume == nil {
+		return false, nil
+	}
+	return p.resume(s)
+}
+
+func (p *testPolicy) AcceptResumption(s *Session, request *crypto.HandshakeMessage) (bool, error) {
+	if p.acceptResumption == nil {
+		return false, nil
+	}
+	return p.acceptResumption(s, request)
+}
+
+func (p *testPolicy) Established(ours, theirs *crypto.HandshakeMessage) {
+	p.established = true
+}
+
+// handshake runs a handshake between opener, on the dialing side, and
+// answerer over an in-memory pipe, closing each side's end once its
+// handshake is over
+func handshake(t *testing.T, opener, answerer Policy, config Config) (open, answer *Session, openErr, answerErr error) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	open, answer = New(local, config), New(remote, config)
+
+	errs := make(chan error, 1)
+	go func() {
+		err := answer.Answer(answerer)
+		remote.Close()
+		errs <- err
+	}()
+	openErr = open.Open(opener)
+	local.Close()
+	return open, answer, openErr, <-errs
+}
+
+func TestHandshake(t *testing.T) {
+	opener, answerer := &testPolicy{name: "a"}, &testPolicy{name: "b"}
+	open, answer, openErr, answerErr := handshake(t, opener, answerer, Config{})
+	require.NoError(t, openErr)
+	require.NoError(t, answerErr)
+
+	assert.Equal(t, "b", open.Peer().NodeID)
+	assert.Equal(t, "a", answer.Peer().NodeID)
+	assert.False(t, open.Resumed())
+	assert.True(t, opener.established)
+	assert.True(t, answerer.established)
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	// The answering side refuses the opener before saying who it is
+	refused := errors.New("refused")
+	opener, answerer := &testPolicy{name: "a"}, &testPolicy{name: "b", verifyErr: refused}
+	open, answer, openErr, answerErr := handshake(t, opener, answerer, Config{})
+	assert.ErrorIs(t, answerErr, refused)
+	assert.ErrorIs(t, openErr, io.EOF)
+	assert.Empty(t, opener.verified)
+	assert.Nil(t, open.Peer())
+	assert.Nil(t, answer.Peer())
+	assert.False(t, answerer.established)
+
+	// The opening side refuses the answer
+	opener, answerer = &testPolicy{name: "a", verifyErr: refused}, &testPolicy{name: "b"}
+	_, _, openErr, answerErr = handshake(t, opener, answerer, Config{})
+	assert.ErrorIs(t, openErr, refused)
+	assert.NoError(t, answerErr)
+	assert.False(t, opener.established)
+
+	// Neither side can create its message
+	broken := errors.New("no key")
+	_, _, openErr, answerErr = handshake(t, &testPolicy{name: "a", helloErr: broken}, &testPolicy{name: "b"}, Config{})
+	assert.ErrorIs(t, openErr, broken)
+	assert.ErrorIs(t, answerErr, io.EOF)
+	_, _, openErr, answerErr = handshake(t, &testPolicy{name: "a"}, &testPolicy{name: "b", helloErr: broken}, Config{})
+	assert.ErrorIs(t, openErr, io.EOF)
+	assert.ErrorIs(t, answerErr, broken)
+}
+
+func TestHandshakeMalformed(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go func() {
+		bufio.NewReader(remote).ReadBytes('\n')
+		remote.Write([]byte("not a handshake\n"))
+	}()
+
+	policy := &testPolicy{name: "a"}
+	err := New(local, Config{}).Open(policy)
+	assert.ErrorContains(t, err, "failed to unmarshal handshake message")
+	assert.Empty(t, policy.verified)
+}
+
+func TestHandshakeDecodesRejections(t *testing.T) {
+	// A peer refusing us answers with something Decode makes an error of
+	rejected := errors.New("rejected")
+	config := Config{Decode: func(frame []byte) (*crypto.HandshakeMessage, error) {
+		if string(frame) == "go away" {
+			return nil, rejected
+		}
+		return &crypto.HandshakeMessage{NodeID: string(frame)}, nil
+	}}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go func() {
+		bufio.NewReader(remote).ReadBytes('\n')
+		remote.Write([]byte("go away\n"))
+	}()
+	err := New(local, config).Open(&testPolicy{name: "a"})
+	assert.ErrorIs(t, err, rejected)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// A peer that connects and says nothing is not waited on
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	start := time.Now()
+	err := New(remote, Config{HandshakeTimeout: 50 * time.Millisecond}).Answer(&testPolicy{name: "b"})
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// resumingPolicies returns policies for two peers that resume their session
+// if the answering side accepts
+func resumingPolicies(accept bool) (opener, answerer *testPolicy) {
+	opener = &testPolicy{name: "a", resume: func(s *Session) (bool, error) {
+		request := &crypto.HandshakeMessage{NodeID: "a", Resume: &crypto.ResumeMessage{TicketID: []byte("ticket")}}
+		if err := s.Send(request); err != nil {
+			return false, err
+		}
+		response, err := s.Receive()
+		if err != nil {
+			return false, err
+		}
+		return response.Resume.Accepted, nil
+	}}
+	answerer = &testPolicy{name: "b", acceptResumption: func(s *Session, request *crypto.HandshakeMessage) (bool, error) {
+		if string(request.Resume.TicketID) != "ticket" {
+			return false, errors.New("unknown ticket")
+		}
+		response := &crypto.HandshakeMessage{NodeID: "b", Resume: &crypto.ResumeMessage{Accepted: accept}}
+		return accept, s.Send(response)
+	}}
+	return opener, answerer
+}
+
+func TestHandshakeResumed(t *testing.T) {
+	opener, answerer := resumingPolicies(true)
+	open, answer, openErr, answerErr := handshake(t, opener, answerer, Config{})
+	require.NoError(t, openErr)
+	require.NoError(t, answerErr)
+
+	// No full handshake follows
+	assert.True(t, open.Resumed())
+	assert.True(t, answer.Resumed())
+	assert.Nil(t, open.Peer())
+	assert.Empty(t, opener.verified)
+	assert.Empty(t, answerer.verified)
+	assert.False(t, opener.established)
+}
+
+func TestHandshakeResumptionRefused(t *testing.T) {
+	// A refused resumption falls back to a full handshake on the same
+	// connection
+	opener, answerer := resumingPolicies(false)
+	open, answer, openErr, answerErr := handshake(t, opener, answerer, Config{})
+	require.NoError(t, openErr)
+	require.NoError(t, answerErr)
+	assert.False(t, open.Resumed())
+	assert.Equal(t, "b", open.Peer().NodeID)
+	assert.Equal(t, "a", answer.Peer().NodeID)
+	assert.True(t, opener.established)
+	assert.True(t, answerer.established)
+}
+
+func TestServe(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	s := New(local, Config{})
+
+	// Frames are read until the peer hangs up
+	go func() {
+		remote.Write([]byte("one\ntwo\n"))
+		remote.Close()
+	}()
+	var frames []string
+	err := s.Serve(context.Background(), time.Second, func(reader *bufio.Reader) error {
+		frame, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		frames = append(frames, frame)
+		return nil
+	}, nil)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, []string{"one\n", "two\n"}, frames)
+}
+
+func TestServeRetries(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	s := New(local, Config{})
+
+	// Timeouts retry approves of keep the loop going until ctx ends it
+	ctx, cancel := context.WithCancel(context.Background())
+	timeouts := 0
+	err := s.Serve(ctx, 10*time.Millisecond, func(reader *bufio.Reader) error {
+		_, err := reader.ReadByte()
+		return err
+	}, func(err error) bool {
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return false
+		}
+		if timeouts++; timeouts == 3 {
+			cancel()
+		}
+		return true
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 3, timeouts)
+}
@@ -0,0 +1,223 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// disconnectPair drops the connection between a and b once both have had
+// the other's HELLO, which would otherwise register the peer again
+func disconnectPair(t *testing.T, a, b *Network) {
+	helloed := func(n *Network, peerID string) bool {
+		peer, exists := n.peers.Get(peerID)
+		return exists && len(peer.GetCapabilities()) > 0
+	}
+	require.Eventually(t, func() bool {
+		return helloed(a, b.nodeID) && helloed(b, a.nodeID)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, a.DisconnectPeer(b.nodeID, DisconnectOptions{Reason: "reconnecting", Drain: true}))
+	require.Eventually(t, func() bool {
+		return len(a.Peers()) == 0 && len(b.Peers()) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+// reconnect drops the connection between a and b and has a dial b again
+func reconnect(t *testing.T, ctx context.Context, a, b *Network) {
+	disconnectPair(t, a, b)
+
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestSessionResumedOnReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := connectPair(t, ctx, "resume-a", "resume-b")
+	require.Eventually(t, func() bool {
+		return a.sessions.Len() == 1 && b.sessions.Len() == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	first := a.sessions.forPeer("resume-b", a.localKey())
+	require.NotNil(t, first)
+
+	for round := uint64(1); round <= 2; round++ {
+		reconnect(t, ctx, a, b)
+		assert.Equal(t, round, a.monitor.Stats.GetStats().HandshakesResumed)
+		assert.Equal(t, round, b.monitor.Stats.GetStats().HandshakesResumed)
+	}
+	assert.Zero(t, a.monitor.Stats.GetStats().ResumptionsRefused)
+
+	// The resumed connections carry the keys proven in the full handshake
+	toB := a.peerConnection("resume-b")
+	require.NotNil(t, toB)
+	assert.True(t, b.encryptor.PublicKey().Equal(toB.identity))
+	toA := b.peerConnection("resume-a")
+	require.NotNil(t, toA)
+	assert.True(t, a.encryptor.PublicKey().Equal(toA.identity))
+
+	// and every resumption leaves a fresh ticket behind
+	require.Eventually(t, func() bool {
+		return b.sessions.Len() == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	latest := a.sessions.forPeer("resume-b", a.localKey())
+	require.NotNil(t, latest)
+	assert.NotEqual(t, first.ticketID, latest.ticketID)
+}
+
+func TestSessionFallsBackToFullHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := connectPair(t, ctx, "fallback-a", "fallback-b")
+	require.Eventually(t, func() bool {
+		return a.sessions.Len() == 1 && b.sessions.Len() == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// b no longer knows the ticket a presents
+	b.sessions.remove("fallback-a")
+	reconnect(t, ctx, a, b)
+	assert.Equal(t, uint64(1), a.monitor.Stats.GetStats().ResumptionsRefused)
+	assert.Equal(t, uint64(1), b.monitor.Stats.GetStats().ResumptionsRefused)
+	assert.Zero(t, a.monitor.Stats.GetStats().HandshakesResumed)
+
+	// b's copy of the new ticket expires
+	require.Eventually(t, func() bool {
+		return b.sessions.Len() == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	b.sessions.mu.Lock()
+	b.sessions.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	b.sessions.mu.Unlock()
+	reconnect(t, ctx, a, b)
+	assert.Equal(t, uint64(2), a.monitor.Stats.GetStats().ResumptionsRefused)
+	assert.Zero(t, b.monitor.Stats.GetStats().HandshakesResumed)
+
+	toB := a.peerConnection("fallback-b")
+	require.NotNil(t, toB)
+	assert.True(t, b.encryptor.PublicKey().Equal(toB.identity))
+}
+
+func TestSessionCache(t *testing.T) {
+	cache := newSessionCache(2, time.Minute)
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+	identity := &rsa.PublicKey{}
+	secret := func(b byte) []byte { return []byte{b, b, b, b} }
+
+	cache.put("peer-a", secret(1), identity, "key-1")
+	now = now.Add(time.Second)
+	cache.put("peer-b", secret(2), identity, "key-1")
+	require.NotNil(t, cache.forPeer("peer-a", "key-1"))
+
+	// A full cache makes room by dropping the ticket expiring first
+	now = now.Add(time.Second)
+	cache.put("peer-c", secret(3), identity, "key-1")
+	assert.Equal(t, 2, cache.Len())
+	assert.Nil(t, cache.forPeer("peer-a", "key-1"))
+	assert.NotNil(t, cache.forPeer("peer-c", "key-1"))
+
+	// Tickets do not outlive the key they were issued under
+	assert.Nil(t, cache.forPeer("peer-c", "key-2"))
+	assert.Equal(t, 1, cache.Len())
+
+	// A ticket that fails verification is kept, one that passes is spent
+	ticketID := cache.forPeer("peer-b", "key-1").ticketID
+	_, err := cache.redeem([]byte(ticketID), "key-1", func(*ticket) error { return errors.New("forged") })
+	assert.Error(t, err)
+	s, err := cache.redeem([]byte(ticketID), "key-1", func(*ticket) error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, "peer-b", s.peerID)
+	_, err = cache.redeem([]byte(ticketID), "key-1", func(*ticket) error { return nil })
+	assert.Error(t, err)
+
+	// and tickets expire
+	cache.put("peer-d", secret(4), identity, "key-1")
+	now = now.Add(time.Minute)
+	assert.Nil(t, cache.forPeer("peer-d", "key-1"))
+	assert.Zero(t, cache.Len())
+
+	// A cache of size 0 keeps nothing
+	disabled := newSessionCache(0, time.Minute)
+	disabled.put("peer-a", secret(1), identity, "key-1")
+	assert.Zero(t, disabled.Len())
+}
+
+// newBenchNetwork creates an unstarted network for handshake benchmarks
+func newBenchNetwork(b *testing.B, nodeID string) *Network {
+	cfg := config.Default()
+	cfg.Storage.DataDir = b.TempDir()
+	log, err := logger.New("error", "json", "")
+	require.NoError(b, err)
+
+	network, err := New(cfg, log, nodeID)
+	require.NoError(b, err)
+	return network
+}
+
+// pipeHandshake runs a handshake between dialer and dialed over an
+// in-memory connection, then forgets the peers again
+func pipeHandshake(dialer, dialed *Network, address string) error {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	outbound := &Connection{ID: uuid.New().String(), Address: address, Conn: local, Outbound: true}
+	inbound := &Connection{ID: uuid.New().String(), Address: "pipe", Conn: remote}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- dialed.performSecureHandshake(remote, true, inbound)
+	}()
+	err := dialer.performSecureHandshake(local, false, outbound)
+	if inErr := <-errs; err == nil {
+		err = inErr
+	}
+
+	dialer.removePeer(dialed.nodeID)
+	dialer.pool.RemoveConnection(outbound.ID)
+	dialed.removePeer(dialer.nodeID)
+	dialed.pool.RemoveConnection(inbound.ID)
+	return err
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	const address = "192.0.2.1:8080"
+
+	b.Run("full", func(b *testing.B) {
+		dialer := newBenchNetwork(b, "bench-dialer")
+		dialed := newBenchNetwork(b, "bench-dialed")
+		dialer.sessions = newSessionCache(0, 0)
+		dialed.sessions = newSessionCache(0, 0)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, pipeHandshake(dialer, dialed, address))
+		}
+	})
+
+	b.Run("resumed", func(b *testing.B) {
+		dialer := newBenchNetwork(b, "bench-dialer")
+		dialed := newBenchNetwork(b, "bench-dialed")
+		require.NoError(b, pipeHandshake(dialer, dialed, address))
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, pipeHandshake(dialer, dialed, address))
+		}
+		b.StopTimer()
+		assert.Equal(b, uint64(b.N), dialer.monitor.Stats.GetStats().HandshakesResumed)
+	})
+}
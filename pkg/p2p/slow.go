@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/topology"
+)
+
+// Slow reports whether writes to the peer keep timing out
+func (c *Connection) Slow() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slow
+}
+
+// recordWriteTimeout counts a write that timed out and returns how many in a
+// row have, and whether this one made the connection slow
+func (c *Connection) recordWriteTimeout(threshold int) (timeouts int, becameSlow bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeTimeouts++
+	if c.writeTimeouts >= threshold && !c.slow {
+		c.slow = true
+		becameSlow = true
+	}
+	return c.writeTimeouts, becameSlow
+}
+
+// recordWriteSuccess ends a run of write timeouts
+func (c *Connection) recordWriteSuccess() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeTimeouts = 0
+	c.slow = false
+}
+
+// recordWrite applies the slow peer policy to the outcome of a send. A peer
+// that keeps us waiting for writes to time out holds up every broadcast, so
+// once slowPeerThreshold writes in a row have, it is broadcast to last and
+// each further timeout costs it reputation. At slowPeerDisconnect timeouts
+// in a row it is disconnected.
+func (n *Network) recordWrite(connection *Connection, err error) {
+	if err == nil {
+		connection.recordWriteSuccess()
+		return
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return
+	}
+
+	n.monitor.Stats.IncrementWriteTimeouts()
+	timeouts, becameSlow := connection.recordWriteTimeout(n.slowPeerThreshold)
+	if becameSlow {
+		n.logger.Warnf("peer %s is slow: %d writes in a row timed out", connection.PeerID, timeouts)
+	}
+	if timeouts >= n.slowPeerThreshold {
+		n.reputation.RecordEvent(connection.PeerID, topology.EventSlowPeer)
+	}
+
+	if n.slowPeerDisconnect > 0 && timeouts == n.slowPeerDisconnect {
+		reason := fmt.Sprintf("too slow: %d writes in a row timed out", timeouts)
+		n.logger.Warnf("disconnecting peer %s: %s", connection.PeerID, reason)
+		n.monitor.Stats.IncrementSlowPeerDisconnects()
+		// A goodbye would time out too, so the connection is just closed
+		n.background(func() {
+			if peer, exists := n.peers.Get(connection.PeerID); exists && peer.GetConnection() == connection {
+				n.DisconnectPeer(connection.PeerID, DisconnectOptions{Reason: reason})
+			}
+		})
+	}
+}
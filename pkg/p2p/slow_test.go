@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowPeerPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "slow-policy-node")
+	network.writeTimeout = 50 * time.Millisecond
+	network.slowPeerThreshold = 2
+	network.slowPeerDisconnect = 4
+
+	stalled := attachStalledPeer(t, network, "stalled-peer").GetConnection()
+	attachPipePeer(t, network, "healthy-peer")
+	initial := network.PeerReputation("stalled-peer")
+
+	broadcast := func() *BroadcastResult {
+		result, _ := network.Broadcast(context.Background(), NewMessage("NOTE", network.nodeID, nil))
+		assert.Equal(t, []string{"healthy-peer"}, result.Succeeded)
+		return result
+	}
+
+	// One timeout is bad luck, not a slow peer
+	result := broadcast()
+	require.Contains(t, result.Failed, "stalled-peer")
+	var netErr net.Error
+	require.ErrorAs(t, result.Failed["stalled-peer"], &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.False(t, stalled.Slow())
+	assert.Equal(t, initial, network.PeerReputation("stalled-peer"))
+
+	broadcast()
+	assert.True(t, stalled.Slow())
+	assert.Less(t, network.PeerReputation("stalled-peer"), initial)
+	assert.False(t, network.peerConnection("healthy-peer").Slow())
+
+	// Still connected until the disconnect threshold
+	broadcast()
+	_, exists := network.peers.Get("stalled-peer")
+	assert.True(t, exists)
+	broadcast()
+	require.Eventually(t, func() bool {
+		_, exists := network.peers.Get("stalled-peer")
+		return !exists
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "too slow: 4 writes in a row timed out", stalled.CloseReason())
+
+	stats := network.monitor.Stats.GetStats()
+	assert.Equal(t, uint64(4), stats.WriteTimeouts)
+	assert.Equal(t, uint64(1), stats.SlowPeerDisconnects)
+	_, exists = network.peers.Get("healthy-peer")
+	assert.True(t, exists)
+}
+
+func TestSlowPeerRecovers(t *testing.T) {
+	network, _, cancel := createTestNetwork(t)
+	defer cancel()
+	network.writeTimeout = 50 * time.Millisecond
+	network.slowPeerThreshold = 1
+	network.slowPeerDisconnect = 0
+
+	stalled := attachStalledPeer(t, network, "stalled-peer").GetConnection()
+	msg := NewMessage("NOTE", network.nodeID, nil)
+	for i := 0; i < 3; i++ {
+		assert.Error(t, network.SendMessage(context.Background(), "stalled-peer", msg))
+	}
+	assert.True(t, stalled.Slow())
+	_, exists := network.peers.Get("stalled-peer")
+	assert.True(t, exists, "slow peers stay connected without a disconnect threshold")
+
+	// A write that goes through ends the run
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	go io.Copy(io.Discard, remote)
+	stalled.Conn = local
+	require.NoError(t, network.SendMessage(context.Background(), "stalled-peer", msg))
+	assert.False(t, stalled.Slow())
+}
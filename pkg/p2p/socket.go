@@ -0,0 +1,54 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+)
+
+// tuneSocket applies the socket options to a TCP connection. Connections of
+// other transports are left alone.
+//
+// Keep-alive probes start after the period of idleness and repeat every
+// period; how many unanswered probes drop the connection is left to the
+// operating system (9 on Linux, 10 on Windows, 8 on macOS). Linux doubles
+// the buffer sizes asked for, to leave room for its bookkeeping, and caps
+// them at net.core.rmem_max and net.core.wmem_max.
+func tuneSocket(conn net.Conn, cfg config.SocketConfig) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	keepAlive := net.KeepAliveConfig{Enable: cfg.KeepAlive, Idle: -1, Interval: -1, Count: -1}
+	if cfg.KeepAlive {
+		period := time.Duration(cfg.KeepAlivePeriod) * time.Second
+		keepAlive.Idle = period
+		keepAlive.Interval = period
+	}
+
+	var errs []error
+	if err := tcpConn.SetKeepAliveConfig(keepAlive); err != nil {
+		errs = append(errs, fmt.Errorf("keep-alive: %w", err))
+	}
+	if err := tcpConn.SetNoDelay(cfg.NoDelay); err != nil {
+		errs = append(errs, fmt.Errorf("no delay: %w", err))
+	}
+	if cfg.ReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(cfg.ReadBuffer); err != nil {
+			errs = append(errs, fmt.Errorf("read buffer: %w", err))
+		}
+	}
+	if cfg.WriteBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(cfg.WriteBuffer); err != nil {
+			errs = append(errs, fmt.Errorf("write buffer: %w", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to tune socket: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package p2p
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sockopt reads an integer socket option of a TCP connection
+func sockopt(t *testing.T, conn net.Conn, level, option int) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+
+	var value int
+	var optErr error
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, option)
+	}))
+	require.NoError(t, optErr)
+	return value
+}
+
+func TestSocketOptionsApplied(t *testing.T) {
+	requireTCP(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := func(nodeID string) *Network {
+		return startLocalNetworkWith(t, ctx, nodeID, func(cfg *config.Config) {
+			cfg.P2P.Socket = config.SocketConfig{
+				KeepAlive:       true,
+				KeepAlivePeriod: 37,
+				NoDelay:         true,
+				ReadBuffer:      64 << 10,
+				WriteBuffer:     64 << 10,
+			}
+		})
+	}
+	a, b := start("socket-a"), start("socket-b")
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return a.peerConnection("socket-b") != nil && b.peerConnection("socket-a") != nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Dialed and accepted connections alike
+	for _, conn := range []net.Conn{a.peerConnection("socket-b").Conn, b.peerConnection("socket-a").Conn} {
+		assert.Equal(t, 1, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+		assert.Equal(t, 37, sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+		assert.Equal(t, 37, sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+		assert.Equal(t, 1, sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+		// Linux reports twice the size asked for
+		assert.GreaterOrEqual(t, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF), 64<<10)
+		assert.GreaterOrEqual(t, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF), 64<<10)
+	}
+}
+
+func TestSocketOptionsDisabled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, tuneSocket(conn, config.SocketConfig{}))
+	assert.Equal(t, 0, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	assert.Equal(t, 0, sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+
+	// Other transports are left alone
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	assert.NoError(t, tuneSocket(local, config.SocketConfig{KeepAlive: true, KeepAlivePeriod: 1}))
+}
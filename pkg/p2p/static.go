@@ -0,0 +1,147 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/discovery"
+)
+
+// ErrPeerIDMismatch is returned when a peer dialed as a static peer
+// presents a different node ID than the one configured for it
+var ErrPeerIDMismatch = errors.New("peer ID does not match the configured static peer")
+
+// StaticPeer is a peer that is kept connected at all times
+type StaticPeer struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// StaticPeerStatus reports whether a static peer is currently connected
+type StaticPeerStatus struct {
+	StaticPeer
+	Connected bool `json:"connected"`
+}
+
+// ParseStaticPeer parses a static peer entry of the form nodeID@host:port
+func ParseStaticPeer(entry string) (StaticPeer, error) {
+	nodeID, address, found := strings.Cut(entry, "@")
+	if !found || nodeID == "" {
+		return StaticPeer{}, fmt.Errorf("static peer %q must be of the form nodeID@host:port", entry)
+	}
+	address, err := discovery.NormalizeAddress(address, DefaultListenPort)
+	if err != nil {
+		return StaticPeer{}, fmt.Errorf("static peer %q: %w", entry, err)
+	}
+	return StaticPeer{ID: nodeID, Address: address}, nil
+}
+
+// parseStaticPeers parses the configured static peers, leaving out our own
+// node so one list can be shared by a whole cluster
+func parseStaticPeers(entries []string, nodeID string) ([]StaticPeer, error) {
+	var peers []StaticPeer
+	for _, entry := range entries {
+		peer, err := ParseStaticPeer(entry)
+		if err != nil {
+			return nil, err
+		}
+		if peer.ID != nodeID {
+			peers = append(peers, peer)
+		}
+	}
+	return peers, nil
+}
+
+// isStaticPeer reports whether peerID is one of the configured static peers
+func (n *Network) isStaticPeer(peerID string) bool {
+	for _, peer := range n.staticPeers {
+		if peer.ID == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// staticPeerStatus reports which static peers are connected
+func (n *Network) staticPeerStatus() []StaticPeerStatus {
+	statuses := make([]StaticPeerStatus, 0, len(n.staticPeers))
+	for _, peer := range n.staticPeers {
+		statuses = append(statuses, StaticPeerStatus{
+			StaticPeer: peer,
+			Connected:  n.liveConnection(peer.ID) != nil,
+		})
+	}
+	return statuses
+}
+
+// maintainStaticPeers keeps every static peer connected until the network
+// stops
+func (n *Network) maintainStaticPeers() {
+	for _, peer := range n.staticPeers {
+		n.background(func() { n.maintainStaticPeer(peer) })
+	}
+}
+
+// maintainStaticPeer dials a static peer whenever it is not connected. Failed
+// dials are retried forever, backing off up to DefaultStaticPeerMaxRetryDelay;
+// a dropped connection is redialed at once, unless the peer is damped for
+// flapping or held off from reconnecting, when it is redialed once that ends.
+func (n *Network) maintainStaticPeer(peer StaticPeer) {
+	events, unsubscribe := n.events.Subscribe(16)
+	defer unsubscribe()
+
+	delay := n.staticRetryDelay
+	for {
+		wait := DefaultStaticPeerCheckInterval
+		live := n.liveConnection(peer.ID) != nil
+		if held := n.redialDelay(peer.ID); held > 0 && !live {
+			// A flapping peer is redialed once its damping ends, one we
+			// disconnected once it may reconnect
+			n.logger.Debugf("static peer %s may not be redialed yet, redialing in %v", peer.ID, held)
+			wait = held
+		} else if !live {
+			_, err := n.connect(n.ctx, peer.Address, peer.ID, false)
+			switch {
+			case err == nil:
+				delay = n.staticRetryDelay
+			case n.ctx.Err() != nil:
+				return
+			case errors.Is(err, ErrDuplicatePeer) && n.liveConnection(peer.ID) != nil:
+				// The peer dialed us at the same time and its connection won
+				delay = n.staticRetryDelay
+			default:
+				// A duplicate without a connection of our own means the peer
+				// has not noticed the old one closing yet
+				n.logger.Warnf("failed to connect to static peer %s at %s, retrying in %v: %v", peer.ID, peer.Address, delay, err)
+				wait = delay
+				delay = min(2*delay, DefaultStaticPeerMaxRetryDelay)
+			}
+		}
+
+		if !n.waitForStaticPeerDrop(peer.ID, events, wait) {
+			return
+		}
+	}
+}
+
+// waitForStaticPeerDrop waits until peerID disconnects or wait elapses. It
+// returns false once the network stops.
+func (n *Network) waitForStaticPeerDrop(peerID string, events <-chan Event, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case evt := <-events:
+			if evt.Type == EventPeerDisconnected && evt.PeerID == peerID {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticPeersOf gives a network static peers
+func staticPeersOf(staticPeers ...string) func(cfg *config.Config) {
+	return func(cfg *config.Config) {
+		cfg.P2P.StaticPeers = staticPeers
+	}
+}
+
+// redialQuickly makes a network redial its static peers every 20ms
+func redialQuickly(n *Network) {
+	n.staticRetryDelay = 20 * time.Millisecond
+}
+
+func TestParseStaticPeer(t *testing.T) {
+	peer, err := ParseStaticPeer("node-a@10.0.0.1:9000")
+	require.NoError(t, err)
+	assert.Equal(t, StaticPeer{ID: "node-a", Address: "10.0.0.1:9000"}, peer)
+
+	peer, err = ParseStaticPeer("node-b@[::1]:9000")
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:9000", peer.Address)
+
+	for _, entry := range []string{"10.0.0.1:9000", "@10.0.0.1:9000", "node-a@"} {
+		_, err := ParseStaticPeer(entry)
+		assert.Error(t, err, entry)
+	}
+
+	// A shared list leaves out the node reading it
+	peers, err := parseStaticPeers([]string{"node-a@10.0.0.1:9000", "node-b@10.0.0.2:9000"}, "node-a")
+	require.NoError(t, err)
+	assert.Equal(t, []StaticPeer{{ID: "node-b", Address: "10.0.0.2:9000"}}, peers)
+}
+
+func TestStaticPeerReconnects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := startLocalNetwork(t, ctx, "node-b")
+	a := startLocalNetworkWith(t, ctx, "node-a", staticPeersOf("node-b@"+localAddr(b)), redialQuickly)
+
+	require.Eventually(t, func() bool {
+		return a.liveConnection("node-b") != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	status := a.Status()
+	require.Len(t, status.StaticPeers, 1)
+	assert.Equal(t, "node-b", status.StaticPeers[0].ID)
+	assert.True(t, status.StaticPeers[0].Connected)
+
+	// Static peers are never pruned
+	info, exists := a.topologyMgr.GetPeerInfo("node-b")
+	require.True(t, exists)
+	assert.True(t, info.Persistent)
+
+	// Dropping the connection gets it redialed
+	dropped := a.liveConnection("node-b")
+	dropped.Conn.Close()
+	require.Eventually(t, func() bool {
+		connection := a.liveConnection("node-b")
+		return connection != nil && connection != dropped
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.True(t, a.Status().StaticPeers[0].Connected)
+}
+
+func TestStaticPeerIDMismatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	impostor := startLocalNetwork(t, ctx, "impostor-node")
+	dialer := startLocalNetwork(t, ctx, "dialer-node")
+
+	_, err := dialer.connect(ctx, localAddr(impostor), "node-b", true)
+	assert.ErrorIs(t, err, ErrPeerIDMismatch)
+	assert.ErrorIs(t, err, ErrHandshakeRejected)
+	assert.Nil(t, dialer.liveConnection("impostor-node"))
+
+	// A network configured with the wrong node at a static address keeps
+	// refusing it
+	a := startLocalNetworkWith(t, ctx, "node-a", staticPeersOf("node-b@"+localAddr(impostor)), redialQuickly)
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, a.liveConnection("impostor-node"))
+	assert.False(t, a.Status().StaticPeers[0].Connected)
+	assert.Empty(t, a.topologyMgr.GetConnectedPeers())
+}
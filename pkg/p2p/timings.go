@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/monitor"
+)
+
+// ConnectionTimings summarizes how long connections took to dial and to
+// complete the handshake, and how long they lasted. GetNetworkReport
+// includes the same summary.
+func (n *Network) ConnectionTimings() monitor.ConnectionTimingsReport {
+	return n.monitor.Connections.Snapshot()
+}
+
+// markHandshakeDone records that the handshake on the connection completed
+// and returns how long it took
+func (c *Connection) markHandshakeDone() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handshakeDone = time.Now()
+	return c.handshakeDone.Sub(c.CreatedAt)
+}
+
+// markTornDown records that the connection was torn down and returns how
+// long it lasted. ok is false if it was torn down before.
+func (c *Connection) markTornDown() (lifetime time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tornDown.IsZero() {
+		return 0, false
+	}
+	c.tornDown = time.Now()
+	return c.tornDown.Sub(c.CreatedAt), true
+}
+
+// slowConnectThreshold returns how long a dial or handshake may take before
+// it is logged, or 0 if none is
+func (n *Network) slowConnectThreshold() time.Duration {
+	return time.Duration(n.config.P2P.SlowConnectMs) * time.Millisecond
+}
+
+// observeDial records how long dialing the peer of a new outbound connection
+// took
+func (n *Network) observeDial(connection *Connection) {
+	took := connection.CreatedAt.Sub(connection.dialStarted)
+	n.monitor.Connections.Dial.Observe(took)
+	if threshold := n.slowConnectThreshold(); threshold > 0 && took > threshold {
+		peer := connection.expectedPeerID
+		if peer == "" {
+			peer = "unknown peer"
+		}
+		n.logger.Warnf("dialing %s at %s took %v, over the %v threshold", peer, connection.Address, took.Round(time.Millisecond), threshold)
+	}
+}
+
+// observeHandshake records how long the handshake on a connection took
+func (n *Network) observeHandshake(connection *Connection, took time.Duration) {
+	n.monitor.Connections.Handshake.Observe(took)
+	if threshold := n.slowConnectThreshold(); threshold > 0 && took > threshold {
+		direction := "inbound"
+		if connection.Outbound {
+			direction = "outbound"
+		}
+		n.logger.Warnf("handshake with %s at %s (%s) took %v, over the %v threshold", connection.PeerID, connection.Address, direction, took.Round(time.Millisecond), threshold)
+	}
+}
+
+// observeLifetime records how long a connection lasted, once, when it is
+// torn down, whether or not its handshake completed
+func (n *Network) observeLifetime(connection *Connection) {
+	if lifetime, ok := connection.markTornDown(); ok {
+		n.monitor.Connections.Lifetime.Observe(lifetime)
+	}
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionTimingsRecorded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dialer := startLocalNetworkWith(t, ctx, "timing-dialer", dialNothing)
+	listener := startLocalNetworkWith(t, ctx, "timing-listener", dialNothing)
+	_, err := dialer.Connect(ctx, localAddr(listener))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return listener.liveConnection("timing-dialer") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Only the dialing side dials; both shake hands
+	timings := dialer.ConnectionTimings()
+	assert.Equal(t, uint64(1), timings.Dial.Count)
+	assert.Positive(t, timings.Dial.Max)
+	assert.Equal(t, uint64(1), timings.Handshake.Count)
+	assert.Positive(t, timings.Handshake.P50)
+	assert.Zero(t, timings.Lifetime.Count)
+	timings = listener.ConnectionTimings()
+	assert.Zero(t, timings.Dial.Count)
+	assert.Equal(t, uint64(1), timings.Handshake.Count)
+
+	// Both sides record the lifetime once the connection is gone
+	require.NoError(t, dialer.DisconnectPeer("timing-listener", DisconnectOptions{Reason: "test", Drain: true}))
+	require.Eventually(t, func() bool {
+		return dialer.ConnectionTimings().Lifetime.Count == 1 && listener.ConnectionTimings().Lifetime.Count == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Positive(t, dialer.ConnectionTimings().Lifetime.P99)
+	assert.Equal(t, dialer.GetNetworkReport().ConnectionTimings, dialer.ConnectionTimings())
+
+	// A connection that never completes the handshake still has a lifetime
+	conn, err := dialLocal(listener)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		return listener.ConnectionTimings().Lifetime.Count == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(1), listener.ConnectionTimings().Handshake.Count)
+}
@@ -0,0 +1,220 @@
+package p2p
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TopicMessage is a message published on a topic, as handed to the
+// topic's subscribers
+type TopicMessage struct {
+	Topic string
+	Data  []byte
+	// ID is the published message's ID and From the node that published it
+	ID          string
+	From        string
+	PublishedAt time.Time
+}
+
+// topicSubscriptions are the local subscribers of each topic. Every topic
+// subscribed to remembers the IDs of the messages it delivered, so each
+// reaches its subscribers once however many paths it arrives by.
+type topicSubscriptions struct {
+	nextID int
+	topics map[string]*topicSubscribers
+	mu     sync.RWMutex
+}
+
+// topicSubscribers are the subscriptions to one topic
+type topicSubscribers struct {
+	channels map[int]chan TopicMessage
+	seen     *seenCache
+}
+
+// newTopicSubscriptions creates a registry without subscribers
+func newTopicSubscriptions() *topicSubscriptions {
+	return &topicSubscriptions{topics: make(map[string]*topicSubscribers)}
+}
+
+// Subscribe adds a subscriber to topic, returning its channel and the
+// function that ends the subscription and closes the channel
+func (t *topicSubscriptions) Subscribe(topic string, buffer int) (<-chan TopicMessage, func()) {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	subscribers, exists := t.topics[topic]
+	if !exists {
+		subscribers = &topicSubscribers{
+			channels: make(map[int]chan TopicMessage),
+			seen:     newSeenCache(DefaultSeenCacheTTL),
+		}
+		t.topics[topic] = subscribers
+	}
+	id := t.nextID
+	t.nextID++
+	ch := make(chan TopicMessage, buffer)
+	subscribers.channels[id] = ch
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			delete(subscribers.channels, id)
+			if len(subscribers.channels) == 0 {
+				delete(t.topics, topic)
+			}
+			close(ch)
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+// Deliver hands msg to every subscriber of its topic that has room for it,
+// unless the topic delivered a message with its ID before. It returns how
+// many subscribers got it and how many had no room.
+func (t *topicSubscriptions) Deliver(msg TopicMessage) (delivered, dropped int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	subscribers, exists := t.topics[msg.Topic]
+	if !exists || !subscribers.seen.Add(msg.ID) {
+		return 0, 0
+	}
+	for _, ch := range subscribers.channels {
+		select {
+		case ch <- msg:
+			delivered++
+		default:
+			dropped++
+		}
+	}
+	return delivered, dropped
+}
+
+// Topics returns the topics subscribed to, in order, at most
+// MaxAdvertisedTopics of them
+func (t *topicSubscriptions) Topics() []string {
+	t.mu.RLock()
+	topics := make([]string, 0, len(t.topics))
+	for topic := range t.topics {
+		topics = append(topics, topic)
+	}
+	t.mu.RUnlock()
+
+	sort.Strings(topics)
+	if len(topics) > MaxAdvertisedTopics {
+		topics = topics[:MaxAdvertisedTopics]
+	}
+	return topics
+}
+
+// Publish sends data to the subscribers of topic throughout the mesh, ours
+// included. The TOPIC message carrying it is gossiped, first to the peers
+// whose heartbeats say they subscribe to the topic, and passed on by every
+// node relaying gossip whether or not it subscribes itself.
+func (n *Network) Publish(topic string, data []byte) error {
+	payload := TopicPayload{Topic: topic, Data: data}
+	if err := payload.validate(); err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+
+	msg := NewMessage(MessageTypeTopic, n.nodeID, payload)
+	n.deliverTopic(&msg, payload)
+	if err := n.Gossip(msg, DefaultGossipFanout); err != nil {
+		return fmt.Errorf("failed to publish on %s: %w", topic, err)
+	}
+	return nil
+}
+
+// SubscribeTopic returns a channel receiving the messages published on
+// topic from now on, and the function that ends the subscription. Messages
+// arriving while the channel's DefaultTopicBuffer messages are unread are
+// dropped for it. Peers learn of the subscription from our next heartbeat.
+func (n *Network) SubscribeTopic(topic string) (<-chan TopicMessage, func()) {
+	return n.topics.Subscribe(topic, DefaultTopicBuffer)
+}
+
+// handleTopicMessage hands a received TOPIC message to our subscribers; the
+// gossip layer has already passed it on
+func (n *Network) handleTopicMessage(msg *Message) error {
+	var payload TopicPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		return err
+	}
+	n.deliverTopic(msg, payload)
+	return nil
+}
+
+// deliverTopic hands a TOPIC message to our subscribers of its topic
+func (n *Network) deliverTopic(msg *Message, payload TopicPayload) {
+	from := msg.Origin
+	if from == "" {
+		from = msg.Sender
+	}
+	delivered, dropped := n.topics.Deliver(TopicMessage{
+		Topic:       payload.Topic,
+		Data:        payload.Data,
+		ID:          msg.ID,
+		From:        from,
+		PublishedAt: msg.Timestamp,
+	})
+	if dropped > 0 {
+		n.messageLogger(msg).Warnf("%d subscribers of topic %s are full, dropping message %s for them", dropped, payload.Topic, msg.ID)
+	}
+	if delivered > 0 {
+		n.messageLogger(msg).Debugf("delivered message %s on topic %s to %d subscribers", msg.ID, payload.Topic, delivered)
+	}
+}
+
+// preferSubscribers puts the connected peers that subscribe to the topic of
+// a TOPIC message ahead of the other gossip candidates, leaving out the peer
+// it came from
+func (n *Network) preferSubscribers(msg *Message, fromPeerID string, candidates []string) []string {
+	var payload TopicPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		return candidates
+	}
+
+	var preferred []string
+	included := make(map[string]bool)
+	for _, peer := range n.peers.Connected() {
+		if peer.ID != fromPeerID && peer.subscribesTo(payload.Topic) {
+			preferred = append(preferred, peer.ID)
+			included[peer.ID] = true
+		}
+	}
+	sort.Strings(preferred)
+	for _, peerID := range candidates {
+		if !included[peerID] {
+			preferred = append(preferred, peerID)
+		}
+	}
+	return preferred
+}
+
+// setTopics records the topics the peer says it subscribes to
+func (p *Peer) setTopics(topics []string) {
+	subscribed := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		subscribed[topic] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.topics = subscribed
+}
+
+// subscribesTo reports whether the peer's last heartbeat listed topic
+func (p *Peer) subscribesTo(topic string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.topics[topic]
+}
@@ -0,0 +1,169 @@
+package p2p
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveTopic waits for the next message on a subscription
+func receiveTopic(t *testing.T, messages <-chan TopicMessage) TopicMessage {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message published on the topic arrived")
+		return TopicMessage{}
+	}
+}
+
+// assertNoTopic checks no message arrives on a subscription for a while
+func assertNoTopic(t *testing.T, messages <-chan TopicMessage, wait time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		t.Fatalf("unexpected message %q on topic %s", msg.Data, msg.Topic)
+	case <-time.After(wait):
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const interval = 50 * time.Millisecond
+	start := func(nodeID string) *Network {
+		return startLocalNetworkWith(t, ctx, nodeID, func(cfg *config.Config) {
+			cfg.P2P.EnableDiscovery = true
+		}, func(n *Network) {
+			n.heartbeatInterval = interval
+		})
+	}
+
+	// A chain: the publisher reaches second only through first
+	publisher := start("topic-publisher")
+	first := start("topic-first")
+	second := start("topic-second")
+	_, err := publisher.Connect(ctx, localAddr(first))
+	require.NoError(t, err)
+	_, err = first.Connect(ctx, localAddr(second))
+	require.NoError(t, err)
+
+	firstNews, stopFirstNews := first.SubscribeTopic("news")
+	defer stopFirstNews()
+	secondNews, stopSecondNews := second.SubscribeTopic("news")
+	defer stopSecondNews()
+	secondSports, stopSecondSports := second.SubscribeTopic("sports")
+	defer stopSecondSports()
+	assert.Equal(t, []string{"news", "sports"}, second.heartbeatPayload().Topics)
+
+	// Heartbeats tell the publisher what its peer subscribes to
+	require.Eventually(t, func() bool {
+		peer, exists := publisher.peers.Get("topic-first")
+		return exists && peer.subscribesTo("news")
+	}, 5*time.Second, 20*time.Millisecond)
+	peer, _ := publisher.peers.Get("topic-first")
+	assert.False(t, peer.subscribesTo("sports"))
+
+	// Both subscribers hear the news, the second relayed through the first
+	require.NoError(t, publisher.Publish("news", []byte("extra")))
+	for _, messages := range []<-chan TopicMessage{firstNews, secondNews} {
+		msg := receiveTopic(t, messages)
+		assert.Equal(t, "news", msg.Topic)
+		assert.Equal(t, []byte("extra"), msg.Data)
+		assert.Equal(t, "topic-publisher", msg.From)
+	}
+
+	// Sports reach only the node subscribing to them, and nobody subscribes
+	// to the weather
+	require.NoError(t, publisher.Publish("weather", []byte("rain")))
+	require.NoError(t, publisher.Publish("sports", []byte("goal")))
+	assert.Equal(t, []byte("goal"), receiveTopic(t, secondSports).Data)
+	assertNoTopic(t, firstNews, 4*interval)
+	assertNoTopic(t, secondNews, 0)
+
+	// Once the first stops subscribing, it still relays the news
+	stopFirstNews()
+	_, open := <-firstNews
+	assert.False(t, open)
+	require.Eventually(t, func() bool {
+		return !peer.subscribesTo("news")
+	}, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, publisher.Publish("news", []byte("late")))
+	assert.Equal(t, []byte("late"), receiveTopic(t, secondNews).Data)
+}
+
+func TestTopicDeliveredOnce(t *testing.T) {
+	topics := newTopicSubscriptions()
+	news, stopNews := topics.Subscribe("news", 1)
+	defer stopNews()
+	sports, stopSports := topics.Subscribe("sports", 1)
+	defer stopSports()
+
+	// A message arriving twice on a topic is delivered once
+	delivered, dropped := topics.Deliver(TopicMessage{Topic: "news", ID: "m1", Data: []byte("a")})
+	assert.Equal(t, 1, delivered)
+	assert.Zero(t, dropped)
+	delivered, _ = topics.Deliver(TopicMessage{Topic: "news", ID: "m1", Data: []byte("a")})
+	assert.Zero(t, delivered)
+	assert.Equal(t, []byte("a"), (<-news).Data)
+
+	// Deduplication is per topic
+	delivered, _ = topics.Deliver(TopicMessage{Topic: "sports", ID: "m1", Data: []byte("b")})
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, []byte("b"), (<-sports).Data)
+
+	// A subscriber without room misses messages rather than holding up others
+	topics.Deliver(TopicMessage{Topic: "news", ID: "m2"})
+	delivered, dropped = topics.Deliver(TopicMessage{Topic: "news", ID: "m3"})
+	assert.Zero(t, delivered)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, "m2", (<-news).ID)
+
+	// Topics nobody subscribes to are not advertised
+	stopSports()
+	assert.Equal(t, []string{"news"}, topics.Topics())
+	delivered, _ = topics.Deliver(TopicMessage{Topic: "sports", ID: "m4"})
+	assert.Zero(t, delivered)
+}
+
+func TestPublishedLocally(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "topic-local")
+
+	messages, stop := network.SubscribeTopic("news")
+	defer stop()
+	require.NoError(t, network.Publish("news", []byte("here")))
+	msg := receiveTopic(t, messages)
+	assert.Equal(t, "topic-local", msg.From)
+	assert.Equal(t, []byte("here"), msg.Data)
+
+	assert.ErrorContains(t, network.Publish("", nil), "without a topic")
+	assert.ErrorContains(t, network.Publish(strings.Repeat("x", MaxTopicLength+1), nil), "more than")
+}
+
+func TestGossipPrefersSubscribers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := startLocalNetwork(t, ctx, "topic-prefer")
+	attachPipePeer(t, network, "plain-peer")
+	interested, _, _ := attachPipePeer(t, network, "interested-peer")
+	interested.setTopics([]string{"news"})
+
+	news := NewMessage(MessageTypeTopic, network.nodeID, TopicPayload{Topic: "news"})
+	candidates := []string{"plain-peer", "interested-peer"}
+	assert.Equal(t, []string{"interested-peer", "plain-peer"}, network.preferSubscribers(&news, "", candidates))
+
+	// The subscriber a message came from is not put first again
+	assert.Equal(t, []string{"plain-peer", "interested-peer"}, network.preferSubscribers(&news, "interested-peer", candidates))
+
+	sports := NewMessage(MessageTypeTopic, network.nodeID, TopicPayload{Topic: "sports"})
+	assert.Equal(t, candidates, network.preferSubscribers(&sports, "", candidates))
+}
@@ -0,0 +1,72 @@
+package topology
+
+// BehaviorEvent identifies an observed peer behavior that affects reputation
+type BehaviorEvent int
+
+const (
+	// EventDeserializeFailure is a frame that could not be decoded
+	EventDeserializeFailure BehaviorEvent = iota
+	// EventInvalidMessage is a decoded message that failed validation
+	EventInvalidMessage
+	// EventHandshakeFailure is a handshake that could not be completed
+	EventHandshakeFailure
+	// EventOversizeFrame is a frame larger than the protocol allows
+	EventOversizeFrame
+	// EventSuccessfulExchange is a completed request/response round trip
+	EventSuccessfulExchange
+	// EventHeartbeat is a heartbeat received on schedule
+	EventHeartbeat
+	// EventClockSkew is a repeated message dated too far from our clock
+	EventClockSkew
+	// EventSlowPeer is a write to a slow peer that timed out
+	EventSlowPeer
+	// EventRateLimited is another second of a peer sending faster than its
+	// rate limit
+	EventRateLimited
+)
+
+// String returns a readable name for the event
+func (e BehaviorEvent) String() string {
+	switch e {
+	case EventDeserializeFailure:
+		return "deserialize_failure"
+	case EventInvalidMessage:
+		return "invalid_message"
+	case EventHandshakeFailure:
+		return "handshake_failure"
+	case EventOversizeFrame:
+		return "oversize_frame"
+	case EventSuccessfulExchange:
+		return "successful_exchange"
+	case EventHeartbeat:
+		return "heartbeat"
+	case EventClockSkew:
+		return "clock_skew"
+	case EventSlowPeer:
+		return "slow_peer"
+	case EventRateLimited:
+		return "rate_limited"
+	default:
+		return "unknown"
+	}
+}
+
+// BehaviorScores maps behavior events to the behavior score (-1.0 to 1.0)
+// fed into UpdateReputationBasedOnBehavior
+type BehaviorScores map[BehaviorEvent]float64
+
+// DefaultBehaviorScores returns the default event to score mapping. Protocol
+// violations pull reputation down hard, good behavior nudges it up slowly.
+func DefaultBehaviorScores() BehaviorScores {
+	return BehaviorScores{
+		EventDeserializeFailure: -0.5,
+		EventInvalidMessage:     -0.3,
+		EventHandshakeFailure:   -0.8,
+		EventOversizeFrame:      -1.0,
+		EventSuccessfulExchange: 0.5,
+		EventHeartbeat:          0.2,
+		EventClockSkew:          -0.3,
+		EventSlowPeer:           -0.2,
+		EventRateLimited:        -0.5,
+	}
+}
@@ -0,0 +1,205 @@
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Graph export formats
+const (
+	GraphFormatDOT  = "dot"
+	GraphFormatJSON = "json"
+)
+
+// GraphNode is a node in the exported topology graph
+type GraphNode struct {
+	ID         string  `json:"id"`
+	Address    string  `json:"address,omitempty"`
+	Reputation float64 `json:"reputation"`
+	Connected  bool    `json:"connected"`
+	Local      bool    `json:"local,omitempty"`
+}
+
+// GraphEdge is a directed link in the exported topology graph. Links from
+// the local node carry a quality score; links learned from a peer's
+// topology report do not.
+type GraphEdge struct {
+	To       string   `json:"to"`
+	Score    *float64 `json:"score,omitempty"`
+	Reported bool     `json:"reported,omitempty"`
+}
+
+// Graph is the JSON adjacency structure of the known topology
+type Graph struct {
+	Local     string                 `json:"local"`
+	Nodes     []GraphNode            `json:"nodes"`
+	Adjacency map[string][]GraphEdge `json:"adjacency"`
+}
+
+// SetPeerNeighbors records the peer IDs a peer reports being connected to
+func (t *Manager) SetPeerNeighbors(peerID string, neighbors []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if peer, exists := t.peers[peerID]; exists {
+		peer.Neighbors = append([]string(nil), neighbors...)
+	}
+}
+
+// PeersReporting lists the connected peers that report neighbor among their
+// neighbors, best scored first: the peers through which neighbor can be
+// reached
+func (t *Manager) PeersReporting(neighbor string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	cfg := t.ScoringConfig()
+	var peers []string
+	scores := make(map[string]float64)
+	for id, info := range t.peers {
+		if !info.Connected || id == neighbor {
+			continue
+		}
+		for _, reported := range info.Neighbors {
+			if reported == neighbor {
+				peers = append(peers, id)
+				scores[id] = scorePeer(info, cfg)
+				break
+			}
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if scores[peers[i]] != scores[peers[j]] {
+			return scores[peers[i]] > scores[peers[j]]
+		}
+		return peers[i] < peers[j]
+	})
+	return peers
+}
+
+// Graph builds a snapshot of the known topology. Nodes and edges are sorted
+// by ID so the output is stable.
+func (t *Manager) Graph() Graph {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	cfg := t.ScoringConfig()
+	graph := Graph{
+		Local:     t.localID,
+		Adjacency: make(map[string][]GraphEdge),
+	}
+
+	nodes := make(map[string]GraphNode)
+	if t.localID != "" {
+		nodes[t.localID] = GraphNode{ID: t.localID, Connected: true, Local: true}
+	}
+
+	for id, info := range t.peers {
+		nodes[id] = GraphNode{
+			ID:         id,
+			Address:    info.Address,
+			Reputation: info.Reputation,
+			Connected:  info.Connected,
+		}
+
+		if info.Connected && t.localID != "" {
+			// Rounded so exports are stable across platforms
+			score := math.Round(scorePeer(info, cfg)*1e4) / 1e4
+			graph.Adjacency[t.localID] = append(graph.Adjacency[t.localID], GraphEdge{To: id, Score: &score})
+		}
+
+		for _, neighbor := range info.Neighbors {
+			if neighbor == id {
+				continue
+			}
+			graph.Adjacency[id] = append(graph.Adjacency[id], GraphEdge{To: neighbor, Reported: true})
+			if _, known := nodes[neighbor]; !known {
+				if _, direct := t.peers[neighbor]; !direct && neighbor != t.localID {
+					nodes[neighbor] = GraphNode{ID: neighbor}
+				}
+			}
+		}
+	}
+
+	for _, node := range nodes {
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].ID < graph.Nodes[j].ID
+	})
+	for from := range graph.Adjacency {
+		edges := graph.Adjacency[from]
+		sort.Slice(edges, func(i, j int) bool {
+			return edges[i].To < edges[j].To
+		})
+	}
+
+	return graph
+}
+
+// ExportGraph renders the known topology as Graphviz DOT or as a JSON
+// adjacency structure
+func (t *Manager) ExportGraph(format string) ([]byte, error) {
+	graph := t.Graph()
+
+	switch format {
+	case GraphFormatJSON:
+		data, err := json.MarshalIndent(graph, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal topology graph: %w", err)
+		}
+		return append(data, '\n'), nil
+	case GraphFormatDOT:
+		return graph.dot(), nil
+	default:
+		return nil, fmt.Errorf("unsupported graph format: %q", format)
+	}
+}
+
+// dot renders the graph in Graphviz DOT syntax
+func (g Graph) dot() []byte {
+	var b strings.Builder
+	b.WriteString("digraph topology {\n")
+
+	for _, node := range g.Nodes {
+		lines := []string{node.ID}
+		if node.Address != "" {
+			lines = append(lines, node.Address)
+		}
+		attrs := ""
+		if node.Local {
+			attrs = ", shape=doublecircle"
+		} else {
+			lines = append(lines, fmt.Sprintf("rep %.2f", node.Reputation))
+			if !node.Connected {
+				attrs = ", style=dashed"
+			}
+		}
+		fmt.Fprintf(&b, "  %s [label=%s%s];\n", dotQuote(node.ID), dotQuote(lines...), attrs)
+	}
+
+	for _, node := range g.Nodes {
+		for _, edge := range g.Adjacency[node.ID] {
+			if edge.Score != nil {
+				fmt.Fprintf(&b, "  %s -> %s [label=\"%.2f\"];\n", dotQuote(node.ID), dotQuote(edge.To), *edge.Score)
+			} else {
+				fmt.Fprintf(&b, "  %s -> %s [style=dashed];\n", dotQuote(node.ID), dotQuote(edge.To))
+			}
+		}
+	}
+
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+// dotQuote quotes a DOT identifier, joining multiple lines with DOT line breaks
+func dotQuote(lines ...string) string {
+	escaped := make([]string, len(lines))
+	for i, line := range lines {
+		escaped[i] = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(line)
+	}
+	return `"` + strings.Join(escaped, `\n`) + `"`
+}
@@ -1,13 +1,17 @@
 package topology
 
 import (
+	"fmt"
 	"math"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// ConnectionQuality represents the quality of a connection
+// ConnectionQuality represents the quality of a connection. LastUpdate is
+// zero until the connection has been measured; until then the other fields
+// hold the conservative defaults peers are ranked with.
 type ConnectionQuality struct {
 	Latency    time.Duration
 	Bandwidth  float64 // in Mbps
@@ -16,6 +20,24 @@ type ConnectionQuality struct {
 	LastUpdate time.Time
 }
 
+// Measured reports whether the quality comes from a measurement
+func (q ConnectionQuality) Measured() bool {
+	return !q.LastUpdate.IsZero()
+}
+
+// Metrics summarizes the peers the topology manager knows about
+type Metrics struct {
+	TotalPeers     int    `json:"total_peers"`
+	ConnectedPeers int    `json:"connected_peers"`
+	TopologyType   string `json:"topology_type"`
+	MaxPeers       int    `json:"max_peers"`
+	// MeasuredPeers is the number of connected peers whose connection has
+	// been measured. The averages cover only those and are zero without any.
+	MeasuredPeers int           `json:"measured_peers"`
+	AvgLatency    time.Duration `json:"avg_latency"`
+	AvgBandwidth  float64       `json:"avg_bandwidth"`
+}
+
 // PeerInfo contains information about a peer for topology decisions
 type PeerInfo struct {
 	ID         string
@@ -25,23 +47,118 @@ type PeerInfo struct {
 	Connected  bool
 	Reputation float64 // -1.0 to 1.0 scale
 	Load       int     // number of active connections through this peer
+	Overloaded bool    // peer reports it is falling behind; broadcast to it last
+	Persistent bool    // exempt from pruning
+	Neighbors  []string // peer IDs this peer reports being connected to
+	// Metadata labels the peer, e.g. {"datacenter": "a", "edge": ""}; see
+	// MatchesTags
+	Metadata map[string]string
 }
 
 // Manager handles network topology management and routing decisions
 type Manager struct {
+	localID       string
 	maxPeers      int
-	meshThreshold int
+	scoring       atomic.Pointer[ScoringConfig]
 	peers         map[string]*PeerInfo
 	mu            sync.RWMutex
 	qualityUpdate func(string) ConnectionQuality
+
+	// Reputation threshold watch, see WatchReputation
+	watchThreshold float64
+	watchFn        func(ReputationCrossing)
 }
 
-// NewManager creates a new topology manager
+// ReputationCrossing describes a peer's reputation moving across the
+// threshold given to WatchReputation
+type ReputationCrossing struct {
+	PeerID     string
+	Reputation float64
+	// Below is true when the reputation fell below the threshold and false
+	// when it climbed back to it
+	Below bool
+}
+
+// NewManager creates a new topology manager with the default scoring config
 func NewManager(maxPeers int) *Manager {
-	return &Manager{
-		maxPeers:      maxPeers,
-		meshThreshold: 10, // Switch to partial mesh after 10 peers
-		peers:         make(map[string]*PeerInfo),
+	t, _ := NewManagerWithConfig(maxPeers, DefaultScoringConfig())
+	return t
+}
+
+// NewManagerWithConfig creates a new topology manager with custom scoring weights
+func NewManagerWithConfig(maxPeers int, scoring ScoringConfig) (*Manager, error) {
+	t := &Manager{
+		maxPeers: maxPeers,
+		peers:    make(map[string]*PeerInfo),
+	}
+	if err := t.SetScoringConfig(scoring); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// SetScoringConfig validates and atomically replaces the scoring config
+func (t *Manager) SetScoringConfig(scoring ScoringConfig) error {
+	if err := scoring.Validate(); err != nil {
+		return fmt.Errorf("invalid scoring config: %w", err)
+	}
+	normalized := scoring.Normalized()
+	t.scoring.Store(&normalized)
+	return nil
+}
+
+// ScoringConfig returns the normalized scoring config currently in effect
+func (t *Manager) ScoringConfig() ScoringConfig {
+	return *t.scoring.Load()
+}
+
+// SetLocalID sets the ID of the node this manager runs on, used when exporting the graph
+func (t *Manager) SetLocalID(nodeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.localID = nodeID
+}
+
+// WatchReputation calls fn whenever a peer's reputation falls below
+// threshold or climbs back to it. fn is called without the manager lock
+// held; a nil fn stops watching.
+func (t *Manager) WatchReputation(threshold float64, fn func(ReputationCrossing)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.watchThreshold = threshold
+	t.watchFn = fn
+}
+
+// setReputationLocked sets a peer's reputation and appends to crossings if it
+// moved across the watched threshold. Must be called with t.mu held.
+func (t *Manager) setReputationLocked(peer *PeerInfo, reputation float64, crossings []ReputationCrossing) []ReputationCrossing {
+	old := peer.Reputation
+	peer.Reputation = reputation
+	if t.watchFn == nil {
+		return crossings
+	}
+
+	wasBelow, below := old < t.watchThreshold, reputation < t.watchThreshold
+	if wasBelow == below {
+		return crossings
+	}
+	return append(crossings, ReputationCrossing{PeerID: peer.ID, Reputation: reputation, Below: below})
+}
+
+// notifyReputation passes crossings to the reputation watcher
+func (t *Manager) notifyReputation(crossings []ReputationCrossing) {
+	if len(crossings) == 0 {
+		return
+	}
+	t.mu.RLock()
+	fn := t.watchFn
+	t.mu.RUnlock()
+
+	if fn == nil {
+		return
+	}
+	for _, crossing := range crossings {
+		fn(crossing)
 	}
 }
 
@@ -72,13 +189,12 @@ func (t *Manager) AddPeer(peer Peer) {
 		Load:       0,
 	}
 
-	// Initialize with default quality
+	// Initialize with default quality until the connection is measured
 	info.Quality = ConnectionQuality{
 		Latency:    time.Second,
 		Bandwidth:  1.0,
 		PacketLoss: 0.0,
 		Jitter:     time.Millisecond * 10,
-		LastUpdate: time.Now(),
 	}
 
 	t.peers[peer.ID] = info
@@ -98,39 +214,92 @@ func (t *Manager) UpdatePeerQuality(peerID string, quality ConnectionQuality) {
 	defer t.mu.Unlock()
 
 	if peer, exists := t.peers[peerID]; exists {
+		if quality.LastUpdate.IsZero() {
+			quality.LastUpdate = time.Now()
+		}
 		peer.Quality = quality
 		peer.LastSeen = time.Now()
 	}
 }
 
-// UpdatePeerReputation updates the reputation of a peer
-func (t *Manager) UpdatePeerReputation(peerID string, reputation float64) {
+// SetPeerConnected marks whether we currently hold a connection to a peer
+func (t *Manager) SetPeerConnected(peerID string, connected bool) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	if peer, exists := t.peers[peerID]; exists {
-		peer.Reputation = reputation
+		peer.Connected = connected
+		if connected {
+			peer.LastSeen = time.Now()
+		}
 	}
 }
 
+// MarkPeerActive records activity from a peer without changing its quality
+func (t *Manager) MarkPeerActive(peerID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if peer, exists := t.peers[peerID]; exists {
+		peer.LastSeen = time.Now()
+	}
+}
+
+// SetPeerPersistent marks a peer as exempt from pruning
+func (t *Manager) SetPeerPersistent(peerID string, persistent bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if peer, exists := t.peers[peerID]; exists {
+		peer.Persistent = persistent
+	}
+}
+
+// UpdatePeerReputation updates the reputation of a peer
+func (t *Manager) UpdatePeerReputation(peerID string, reputation float64) {
+	t.mu.Lock()
+	var crossings []ReputationCrossing
+	if peer, exists := t.peers[peerID]; exists {
+		crossings = t.setReputationLocked(peer, reputation, crossings)
+	}
+	t.mu.Unlock()
+
+	t.notifyReputation(crossings)
+}
+
 // GetBestPeers returns the top N peers based on quality and reputation
 func (t *Manager) GetBestPeers(n int) []string {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
+	return t.getBestPeersLocked(n)
+}
+
+// PeerScore returns the score GetBestPeers ranks a peer by
+func (t *Manager) PeerScore(peerID string) (float64, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 
+	peer, exists := t.peers[peerID]
+	if !exists {
+		return 0, false
+	}
+	return scorePeer(peer, t.ScoringConfig()), true
+}
+
+// getBestPeersLocked ranks peers by score; callers must hold t.mu
+func (t *Manager) getBestPeersLocked(n int) []string {
 	// Create a slice of all peers with their scores
 	type peerScore struct {
 		id    string
 		score float64
 	}
 	
+	scoring := t.ScoringConfig()
 	peerScores := make([]peerScore, 0, len(t.peers))
 	
 	for id, info := range t.peers {
 		// Calculate score based on quality and reputation
-		qualityScore := t.calculateQualityScore(info.Quality)
-		score := qualityScore*0.7 + info.Reputation*0.3 // Weight quality more than reputation
-		peerScores = append(peerScores, peerScore{id: id, score: score})
+		peerScores = append(peerScores, peerScore{id: id, score: scorePeer(info, scoring)})
 	}
 	
 	// Sort by score (descending)
@@ -149,14 +318,18 @@ func (t *Manager) GetBestPeers(n int) []string {
 
 // calculateQualityScore calculates a normalized quality score from connection metrics
 func (t *Manager) calculateQualityScore(quality ConnectionQuality) float64 {
-	// Normalize metrics to 0-1 scale
-	latencyScore := 1.0 / (1.0 + float64(quality.Latency)/float64(time.Second)) // Lower latency is better
-	bandwidthScore := math.Min(quality.Bandwidth/100.0, 1.0) // Cap at 1.0
-	packetLossScore := 1.0 - math.Min(quality.PacketLoss/100.0, 1.0) // Lower packet loss is better
-	jitterScore := 1.0 / (1.0 + float64(quality.Jitter)/float64(time.Second)) // Lower jitter is better
-	
-	// Weighted average
-	totalScore := latencyScore*0.3 + bandwidthScore*0.3 + packetLossScore*0.2 + jitterScore*0.2
+	scoring := t.ScoringConfig()
+	qualityWeight := scoring.qualityWeight()
+	if qualityWeight == 0 {
+		return 0
+	}
+
+	// Weighted average of the quality metrics only, ignoring reputation
+	latencyScore, bandwidthScore, packetLossScore, jitterScore := qualityComponents(quality)
+	totalScore := (latencyScore*scoring.LatencyWeight +
+		bandwidthScore*scoring.BandwidthWeight +
+		packetLossScore*scoring.PacketLossWeight +
+		jitterScore*scoring.JitterWeight) / qualityWeight
 	return math.Min(totalScore, 1.0) // Cap at 1.0
 }
 
@@ -164,12 +337,16 @@ func (t *Manager) calculateQualityScore(quality ConnectionQuality) float64 {
 func (t *Manager) GetTopologyType() string {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
-	
+	return t.getTopologyTypeLocked()
+}
+
+// getTopologyTypeLocked classifies the topology; callers must hold t.mu
+func (t *Manager) getTopologyTypeLocked() string {
 	peerCount := len(t.peers)
 	
 	if peerCount <= 3 {
 		return "star" // Small network
-	} else if peerCount <= t.meshThreshold {
+	} else if peerCount <= t.ScoringConfig().MeshThreshold {
 		return "full-mesh" // Medium network
 	} else {
 		return "partial-mesh" // Large network
@@ -203,6 +380,7 @@ func (t *Manager) GetPeerInfo(peerID string) (*PeerInfo, bool) {
 	
 	// Return a copy to prevent external modification
 	info := *peer
+	info.Metadata = copyMetadata(peer.Metadata)
 	return &info, true
 }
 
@@ -228,40 +406,35 @@ func (t *Manager) GetPeerCount() int {
 }
 
 // GetNetworkMetrics returns overall network metrics
-func (t *Manager) GetNetworkMetrics() map[string]interface{} {
+func (t *Manager) GetNetworkMetrics() Metrics {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 	
-	totalPeers := len(t.peers)
-	connectedPeers := 0
-	avgLatency := time.Duration(0)
+	metrics := Metrics{
+		TotalPeers:   len(t.peers),
+		TopologyType: t.getTopologyTypeLocked(),
+		MaxPeers:     t.maxPeers,
+	}
+	totalLatency := time.Duration(0)
 	totalBandwidth := 0.0
 	
 	for _, info := range t.peers {
-		if info.Connected {
-			connectedPeers++
+		if !info.Connected {
+			continue
+		}
+		metrics.ConnectedPeers++
+		if info.Quality.Measured() {
+			metrics.MeasuredPeers++
+			totalLatency += info.Quality.Latency
+			totalBandwidth += info.Quality.Bandwidth
 		}
-		avgLatency += info.Quality.Latency
-		totalBandwidth += info.Quality.Bandwidth
-	}
-	
-	if totalPeers > 0 {
-		avgLatency = avgLatency / time.Duration(totalPeers)
-	}
-	
-	avgBandwidth := 0.0
-	if connectedPeers > 0 {
-		avgBandwidth = totalBandwidth / float64(connectedPeers)
 	}
 	
-	return map[string]interface{}{
-		"total_peers":      totalPeers,
-		"connected_peers":  connectedPeers,
-		"topology_type":    t.GetTopologyType(),
-		"avg_latency":      avgLatency,
-		"avg_bandwidth":    avgBandwidth,
-		"max_peers":        t.maxPeers,
+	if metrics.MeasuredPeers > 0 {
+		metrics.AvgLatency = totalLatency / time.Duration(metrics.MeasuredPeers)
+		metrics.AvgBandwidth = totalBandwidth / float64(metrics.MeasuredPeers)
 	}
+	return metrics
 }
 
 // UpdatePeerLoad updates the load metric for a peer
@@ -274,19 +447,129 @@ func (t *Manager) UpdatePeerLoad(peerID string, load int) {
 	}
 }
 
-// GetOptimalPeersForBroadcast returns the optimal set of peers for message broadcasting
-func (t *Manager) GetOptimalPeersForBroadcast(excludePeerID string, maxPeers int) []string {
+// SetPeerOverloaded records whether a peer reports being overloaded
+func (t *Manager) SetPeerOverloaded(peerID string, overloaded bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if peer, exists := t.peers[peerID]; exists {
+		peer.Overloaded = overloaded
+	}
+}
+
+// adjustPeerReputation atomically replaces a peer's reputation with fn(current),
+// clamped to the -1.0 to 1.0 range
+func (t *Manager) adjustPeerReputation(peerID string, fn func(current float64) float64) {
+	t.mu.Lock()
+	peer, exists := t.peers[peerID]
+	if !exists {
+		t.mu.Unlock()
+		return
+	}
+
+	reputation := math.Max(-1.0, math.Min(1.0, fn(peer.Reputation)))
+	crossings := t.setReputationLocked(peer, reputation, nil)
+	t.mu.Unlock()
+
+	t.notifyReputation(crossings)
+}
+
+// getPeersWithReputation returns peers whose reputation is at least threshold, best first
+func (t *Manager) getPeersWithReputation(threshold float64) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make([]string, 0)
+	for _, peerID := range t.getBestPeersLocked(len(t.peers)) {
+		if t.peers[peerID].Reputation >= threshold {
+			result = append(result, peerID)
+		}
+	}
+	return result
+}
+
+// decayInactivePeers moves the reputation of idle peers toward neutral in a
+// single critical section, so concurrent reputation updates are never lost.
+// Peers that are connected and were seen within inactiveAfter are skipped.
+func (t *Manager) decayInactivePeers(now time.Time, inactiveAfter time.Duration, rate float64) int {
+	t.mu.Lock()
+	decayed := 0
+	var crossings []ReputationCrossing
+	for _, peer := range t.peers {
+		if peer.Connected && now.Sub(peer.LastSeen) < inactiveAfter {
+			continue
+		}
+		if peer.Reputation == 0 {
+			continue
+		}
+
+		reputation := peer.Reputation * (1 - rate)
+		if math.Abs(reputation) < 1e-6 {
+			reputation = 0
+		}
+		crossings = t.setReputationLocked(peer, reputation, crossings)
+		decayed++
+	}
+	t.mu.Unlock()
+
+	t.notifyReputation(crossings)
+	return decayed
+}
+
+// SelectPeersToPrune returns the lowest-scoring non-persistent connected peers
+// to disconnect when more than maxPeers are connected. Pruning goes down to
+// maxPeers minus margin so the count doesn't flap around the limit.
+func (t *Manager) SelectPeersToPrune(margin int) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	connected := 0
+	for _, info := range t.peers {
+		if info.Connected {
+			connected++
+		}
+	}
+	if connected <= t.maxPeers {
+		return nil
+	}
+
+	target := t.maxPeers - margin
+	if target < 0 {
+		target = 0
+	}
+	excess := connected - target
+
+	// Walk the ranking from the worst peer upwards
+	ranked := t.getBestPeersLocked(len(t.peers))
+	result := make([]string, 0, excess)
+	for i := len(ranked) - 1; i >= 0 && len(result) < excess; i-- {
+		info := t.peers[ranked[i]]
+		if info.Connected && !info.Persistent {
+			result = append(result, ranked[i])
+		}
+	}
+	return result
+}
+
+// GetOptimalPeersForBroadcast returns the optimal set of peers for message
+// broadcasting. With tags, only peers whose metadata carries all of them
+// are considered. Overloaded peers come after all others.
+func (t *Manager) GetOptimalPeersForBroadcast(excludePeerID string, maxPeers int, tags ...string) []string {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 	
 	// Get best peers excluding the sender
-	bestPeers := t.GetBestPeers(len(t.peers))
+	bestPeers := t.getBestPeersLocked(len(t.peers))
 	
+	// Overloaded peers are only picked when there are not enough others
 	result := make([]string, 0, maxPeers)
-	for _, peerID := range bestPeers {
-		if peerID != excludePeerID && len(result) < maxPeers {
-			if peer, exists := t.peers[peerID]; exists && peer.Connected {
-				result = append(result, peerID)
+	for _, overloaded := range []bool{false, true} {
+		for _, peerID := range bestPeers {
+			if peerID != excludePeerID && len(result) < maxPeers {
+				peer, exists := t.peers[peerID]
+				if exists && peer.Connected && peer.Overloaded == overloaded && MatchesTags(peer.Metadata, tags) {
+					result = append(result, peerID)
+				}
 			}
 		}
 	}
@@ -0,0 +1,89 @@
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// MaxMetadataEntries is the most metadata entries a peer may carry
+	MaxMetadataEntries = 16
+	// MaxMetadataKeyLength is the longest metadata key, in bytes
+	MaxMetadataKeyLength = 64
+	// MaxMetadataValueLength is the longest metadata value, in bytes
+	MaxMetadataValueLength = 256
+)
+
+// ErrInvalidMetadata is returned for metadata that is too large or has an
+// unusable key
+var ErrInvalidMetadata = errors.New("invalid peer metadata")
+
+// ValidateMetadata checks metadata against the size limits. Keys must be
+// non-empty and may not contain '=', which separates key and value in tags.
+func ValidateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataEntries {
+		return fmt.Errorf("%w: %d entries, at most %d allowed", ErrInvalidMetadata, len(metadata), MaxMetadataEntries)
+	}
+	for key, value := range metadata {
+		switch {
+		case key == "" || strings.Contains(key, "="):
+			return fmt.Errorf("%w: bad key %q", ErrInvalidMetadata, key)
+		case len(key) > MaxMetadataKeyLength:
+			return fmt.Errorf("%w: key %.16q... longer than %d bytes", ErrInvalidMetadata, key, MaxMetadataKeyLength)
+		case len(value) > MaxMetadataValueLength:
+			return fmt.Errorf("%w: value of %q longer than %d bytes", ErrInvalidMetadata, key, MaxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+// MatchesTags reports whether metadata carries every tag. A tag is either a
+// key, which matches whatever its value ("edge"), or key=value, which
+// matches that value only ("datacenter=a"). No tags match everything.
+func MatchesTags(metadata map[string]string, tags []string) bool {
+	for _, tag := range tags {
+		key, value, hasValue := strings.Cut(tag, "=")
+		got, exists := metadata[key]
+		if !exists || (hasValue && got != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetPeerMetadata replaces the metadata of a peer
+func (t *Manager) SetPeerMetadata(peerID string, metadata map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if peer, exists := t.peers[peerID]; exists {
+		peer.Metadata = copyMetadata(metadata)
+	}
+}
+
+// GetPeersWithTags returns the connected peers whose metadata carries every tag
+func (t *Manager) GetPeersWithTags(tags ...string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var peers []string
+	for id, info := range t.peers {
+		if info.Connected && MatchesTags(info.Metadata, tags) {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// copyMetadata returns a copy of metadata, or nil if it is empty
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
@@ -1,21 +1,123 @@
 package topology
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 )
 
+// DecayConfig controls the background reputation decay scheduler
+type DecayConfig struct {
+	// Interval is how often decay is applied
+	Interval time.Duration
+	// Rate is the fraction of reputation removed per interval (0.0 to 1.0)
+	Rate float64
+	// InactiveAfter is how long a connected peer may be silent before it decays
+	InactiveAfter time.Duration
+}
+
+// DefaultDecayConfig returns the default decay schedule
+func DefaultDecayConfig() DecayConfig {
+	return DecayConfig{
+		Interval:      5 * time.Minute,
+		Rate:          0.1,
+		InactiveAfter: 10 * time.Minute,
+	}
+}
+
+// Validate checks that the decay schedule is usable
+func (c DecayConfig) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("decay interval must be positive")
+	}
+	if c.Rate < 0 || c.Rate > 1 {
+		return fmt.Errorf("decay rate must be between 0 and 1")
+	}
+	if c.InactiveAfter < 0 {
+		return fmt.Errorf("inactivity threshold cannot be negative")
+	}
+	return nil
+}
+
 // ReputationSystem manages peer reputation based on various factors
 type ReputationSystem struct {
 	manager *Manager
 	mu      sync.RWMutex
+
+	scores   BehaviorScores
+	decay    DecayConfig
+	now      func() time.Time
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
 }
 
 // NewReputationSystem creates a new reputation system
 func NewReputationSystem(manager *Manager) *ReputationSystem {
+	rs, _ := NewReputationSystemWithConfig(manager, DefaultDecayConfig())
+	return rs
+}
+
+// NewReputationSystemWithConfig creates a reputation system with a custom decay schedule
+func NewReputationSystemWithConfig(manager *Manager, decay DecayConfig) (*ReputationSystem, error) {
+	if err := decay.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid decay config: %w", err)
+	}
+
 	return &ReputationSystem{
 		manager: manager,
+		scores:  DefaultBehaviorScores(),
+		decay:   decay,
+		now:     time.Now,
+	}, nil
+}
+
+// Start begins periodically decaying the reputation of inactive peers. A
+// stopped reputation system may be started again; scores are kept.
+func (rs *ReputationSystem) Start(ctx context.Context) {
+	rs.mu.Lock()
+	if rs.stopCh != nil {
+		rs.mu.Unlock()
+		return
+	}
+	stopCh := make(chan struct{})
+	rs.stopCh = stopCh
+	rs.mu.Unlock()
+
+	rs.wg.Add(1)
+	go func() {
+		defer rs.wg.Done()
+
+		ticker := time.NewTicker(rs.decay.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				rs.applyDecay()
+			}
+		}
+	}()
+}
+
+// Stop stops the decay scheduler and waits for it to exit
+func (rs *ReputationSystem) Stop() {
+	rs.mu.Lock()
+	if rs.stopCh != nil {
+		close(rs.stopCh)
+		rs.stopCh = nil
 	}
+	rs.mu.Unlock()
+	rs.wg.Wait()
+}
+
+// applyDecay runs one decay round and returns the number of peers affected
+func (rs *ReputationSystem) applyDecay() int {
+	return rs.manager.decayInactivePeers(rs.now(), rs.decay.InactiveAfter, rs.decay.Rate)
 }
 
 // UpdateReputationBasedOnBehavior updates peer reputation based on observed behavior
@@ -27,23 +129,33 @@ func (rs *ReputationSystem) UpdateReputationBasedOnBehavior(peerID string, behav
 		behaviorScore = 1.0
 	}
 
-	// Get current reputation and update it gradually
-	currentInfo, exists := rs.manager.GetPeerInfo(peerID)
-	if !exists {
+	// Weighted update: 70% current reputation, 30% new behavior
+	rs.manager.adjustPeerReputation(peerID, func(current float64) float64 {
+		return current*0.7 + behaviorScore*0.3
+	})
+}
+
+// RecordEvent applies the configured score for an observed behavior event
+func (rs *ReputationSystem) RecordEvent(peerID string, event BehaviorEvent) {
+	rs.mu.RLock()
+	score, exists := rs.scores[event]
+	rs.mu.RUnlock()
+
+	if !exists || peerID == "" {
 		return
 	}
+	rs.UpdateReputationBasedOnBehavior(peerID, score)
+}
 
-	// Weighted update: 70% current reputation, 30% new behavior
-	newReputation := currentInfo.Reputation*0.7 + behaviorScore*0.3
-	
-	// Keep reputation within bounds
-	if newReputation < -1.0 {
-		newReputation = -1.0
-	} else if newReputation > 1.0 {
-		newReputation = 1.0
-	}
+// SetBehaviorScores replaces the event to score mapping
+func (rs *ReputationSystem) SetBehaviorScores(scores BehaviorScores) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
 
-	rs.manager.UpdatePeerReputation(peerID, newReputation)
+	rs.scores = make(BehaviorScores, len(scores))
+	for event, score := range scores {
+		rs.scores[event] = score
+	}
 }
 
 // UpdateReputationBasedOnPerformance updates peer reputation based on performance metrics
@@ -93,30 +205,17 @@ func (rs *ReputationSystem) UpdateReputationBasedOnReliability(peerID string, up
 	rs.UpdateReputationBasedOnBehavior(peerID, scaledScore)
 }
 
-// GetTrustedPeers returns peers with reputation above a threshold
+// GetTrustedPeers returns peers with reputation at or above a threshold, best first
 func (rs *ReputationSystem) GetTrustedPeers(threshold float64) []string {
-	// For now, return the best peers from the topology manager
-	return rs.manager.GetBestPeers(10) // Return top 10 peers
+	return rs.manager.getPeersWithReputation(threshold)
 }
 
 // DecayReputation gradually reduces reputation of inactive peers
 func (rs *ReputationSystem) DecayReputation(peerID string, decayRate float64) {
-	currentInfo, exists := rs.manager.GetPeerInfo(peerID)
-	if !exists {
-		return
-	}
-
 	// Apply decay to move reputation toward neutral (0.0)
-	newReputation := currentInfo.Reputation * (1 - decayRate)
-	
-	// Ensure it stays within bounds
-	if newReputation < -1.0 {
-		newReputation = -1.0
-	} else if newReputation > 1.0 {
-		newReputation = 1.0
-	}
-
-	rs.manager.UpdatePeerReputation(peerID, newReputation)
+	rs.manager.adjustPeerReputation(peerID, func(current float64) float64 {
+		return current * (1 - decayRate)
+	})
 }
 
 // GetPeerRank returns a rank (1-10) for a peer based on reputation
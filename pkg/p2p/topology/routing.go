@@ -111,16 +111,9 @@ func (r *Router) UpdateRouteCache() {
 // UpdatePeerMetrics updates metrics for routing decisions
 func (r *Router) UpdatePeerMetrics(peerID string, latency float64, bandwidth float64) {
 	quality := ConnectionQuality{
-		Latency:    fromFloat64(latency),
+		Latency:    time.Duration(latency * float64(time.Millisecond)),
 		Bandwidth:  bandwidth,
 		PacketLoss: math.Min(latency*10, 100), // Higher latency may indicate higher packet loss
 	}
 	r.manager.UpdatePeerQuality(peerID, quality)
 }
-
-// fromFloat64 converts a float64 to time.Duration (for testing purposes)
-func fromFloat64(f float64) ConnectionQuality {
-	return ConnectionQuality{
-		Latency: time.Duration(f * float64(time.Millisecond)),
-	}
-}
\ No newline at end of file
@@ -0,0 +1,104 @@
+package topology
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// DefaultMeshThreshold is the peer count above which the topology switches to partial mesh
+const DefaultMeshThreshold = 10
+
+// ScoringConfig controls how peers are ranked and how the topology is classified.
+// The five weights are relative; they are normalized to sum to 1 when applied.
+type ScoringConfig struct {
+	LatencyWeight    float64
+	BandwidthWeight  float64
+	PacketLossWeight float64
+	JitterWeight     float64
+	ReputationWeight float64
+	MeshThreshold    int
+}
+
+// DefaultScoringConfig returns the weights historically used by the manager:
+// 70% connection quality (split 30/30/20/20) and 30% reputation
+func DefaultScoringConfig() ScoringConfig {
+	return ScoringConfig{
+		LatencyWeight:    0.21,
+		BandwidthWeight:  0.21,
+		PacketLossWeight: 0.14,
+		JitterWeight:     0.14,
+		ReputationWeight: 0.30,
+		MeshThreshold:    DefaultMeshThreshold,
+	}
+}
+
+// Validate checks that the weights are usable
+func (c ScoringConfig) Validate() error {
+	weights := map[string]float64{
+		"latency":     c.LatencyWeight,
+		"bandwidth":   c.BandwidthWeight,
+		"packet loss": c.PacketLossWeight,
+		"jitter":      c.JitterWeight,
+		"reputation":  c.ReputationWeight,
+	}
+	for name, weight := range weights {
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return fmt.Errorf("%s weight must be a non-negative number", name)
+		}
+	}
+
+	if c.totalWeight() == 0 {
+		return fmt.Errorf("at least one scoring weight must be positive")
+	}
+
+	if c.MeshThreshold < 1 {
+		return fmt.Errorf("mesh threshold must be at least 1")
+	}
+
+	return nil
+}
+
+// Normalized returns a copy of the config whose weights sum to 1
+func (c ScoringConfig) Normalized() ScoringConfig {
+	total := c.totalWeight()
+	if total == 0 {
+		return c
+	}
+
+	c.LatencyWeight /= total
+	c.BandwidthWeight /= total
+	c.PacketLossWeight /= total
+	c.JitterWeight /= total
+	c.ReputationWeight /= total
+	return c
+}
+
+// totalWeight returns the sum of all weights
+func (c ScoringConfig) totalWeight() float64 {
+	return c.LatencyWeight + c.BandwidthWeight + c.PacketLossWeight + c.JitterWeight + c.ReputationWeight
+}
+
+// qualityWeight returns the sum of the connection quality weights
+func (c ScoringConfig) qualityWeight() float64 {
+	return c.LatencyWeight + c.BandwidthWeight + c.PacketLossWeight + c.JitterWeight
+}
+
+// qualityComponents normalizes connection metrics to a 0-1 scale where higher is better
+func qualityComponents(quality ConnectionQuality) (latency, bandwidth, packetLoss, jitter float64) {
+	latency = 1.0 / (1.0 + float64(quality.Latency)/float64(time.Second))
+	bandwidth = math.Min(quality.Bandwidth/100.0, 1.0)
+	packetLoss = 1.0 - math.Min(quality.PacketLoss/100.0, 1.0)
+	jitter = 1.0 / (1.0 + float64(quality.Jitter)/float64(time.Second))
+	return latency, bandwidth, packetLoss, jitter
+}
+
+// scorePeer combines connection quality and reputation using normalized weights
+func scorePeer(info *PeerInfo, cfg ScoringConfig) float64 {
+	latency, bandwidth, packetLoss, jitter := qualityComponents(info.Quality)
+	return latency*cfg.LatencyWeight +
+		bandwidth*cfg.BandwidthWeight +
+		packetLoss*cfg.PacketLossWeight +
+		jitter*cfg.JitterWeight +
+		info.Reputation*cfg.ReputationWeight
+}
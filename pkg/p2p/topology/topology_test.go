@@ -1,6 +1,13 @@
 package topology
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -8,12 +15,14 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
 func TestTopologyManager(t *testing.T) {
 	manager := NewManager(10)
 
 	// Test basic creation
 	assert.Equal(t, 10, manager.maxPeers)
-	assert.Equal(t, 10, manager.meshThreshold)
+	assert.Equal(t, 10, manager.ScoringConfig().MeshThreshold)
 
 	// Test adding a peer
 	peer := Peer{
@@ -134,9 +143,25 @@ func TestNetworkMetrics(t *testing.T) {
 	manager.AddPeer(peer)
 
 	metrics := manager.GetNetworkMetrics()
-	assert.Equal(t, 1, metrics["total_peers"])
-	assert.Equal(t, 0, metrics["connected_peers"]) // Peer is not marked as connected by default
-	assert.Equal(t, "star", metrics["topology_type"])
+	assert.Equal(t, 1, metrics.TotalPeers)
+	assert.Equal(t, 1, metrics.ConnectedPeers) // AddPeer registers a connected peer
+	assert.Equal(t, "star", metrics.TopologyType)
+
+	// Unmeasured peers do not drag the averages towards their defaults
+	assert.Zero(t, metrics.MeasuredPeers)
+	assert.Zero(t, metrics.AvgLatency)
+
+	manager.AddPeer(Peer{ID: "other-peer", Address: "127.0.0.1:8081"})
+	manager.UpdatePeerQuality("test-peer", ConnectionQuality{Latency: 40 * time.Millisecond, Bandwidth: 8})
+	manager.UpdatePeerQuality("other-peer", ConnectionQuality{Latency: 20 * time.Millisecond, Bandwidth: 4})
+	manager.SetPeerConnected("other-peer", false)
+
+	metrics = manager.GetNetworkMetrics()
+	assert.Equal(t, 2, metrics.TotalPeers)
+	assert.Equal(t, 1, metrics.ConnectedPeers)
+	assert.Equal(t, 1, metrics.MeasuredPeers)
+	assert.Equal(t, 40*time.Millisecond, metrics.AvgLatency)
+	assert.Equal(t, 8.0, metrics.AvgBandwidth)
 }
 
 func TestGetOptimalPeersForBroadcast(t *testing.T) {
@@ -159,4 +184,432 @@ func TestGetOptimalPeersForBroadcast(t *testing.T) {
 	for _, peerID := range peers {
 		assert.NotEqual(t, "peer0", peerID)
 	}
-}
\ No newline at end of file
+}
+
+func TestOverloadedPeersBroadcastLast(t *testing.T) {
+	manager := NewManager(10)
+	manager.AddPeer(Peer{ID: "fast", Address: "127.0.0.1:8081"})
+	manager.AddPeer(Peer{ID: "slow", Address: "127.0.0.1:8082"})
+	manager.UpdatePeerQuality("fast", ConnectionQuality{Latency: 10 * time.Millisecond, Bandwidth: 50.0})
+	manager.UpdatePeerQuality("slow", ConnectionQuality{Latency: 300 * time.Millisecond, Bandwidth: 1.0, PacketLoss: 5.0})
+	assert.Equal(t, []string{"fast"}, manager.GetOptimalPeersForBroadcast("", 1))
+
+	// The better peer falls behind the worse one once it reports overload
+	manager.SetPeerOverloaded("fast", true)
+	assert.Equal(t, []string{"slow"}, manager.GetOptimalPeersForBroadcast("", 1))
+	assert.Equal(t, []string{"slow", "fast"}, manager.GetOptimalPeersForBroadcast("", 2))
+
+	manager.SetPeerOverloaded("fast", false)
+	assert.Equal(t, []string{"fast", "slow"}, manager.GetOptimalPeersForBroadcast("", 2))
+}
+
+func TestPeerTags(t *testing.T) {
+	manager := NewManager(10)
+	for id, metadata := range map[string]map[string]string{
+		"peer-a": {"datacenter": "a", "edge": ""},
+		"peer-b": {"datacenter": "b", "edge": ""},
+		"peer-c": {"datacenter": "a"},
+		"peer-d": nil,
+	} {
+		manager.AddPeer(Peer{ID: id})
+		manager.SetPeerMetadata(id, metadata)
+	}
+	manager.AddPeer(Peer{ID: "peer-e"})
+	manager.SetPeerMetadata("peer-e", map[string]string{"edge": ""})
+	manager.SetPeerConnected("peer-e", false)
+
+	assert.ElementsMatch(t, []string{"peer-a", "peer-b"}, manager.GetPeersWithTags("edge"))
+	assert.ElementsMatch(t, []string{"peer-a", "peer-c"}, manager.GetPeersWithTags("datacenter=a"))
+	assert.ElementsMatch(t, []string{"peer-a"}, manager.GetPeersWithTags("edge", "datacenter=a"))
+	assert.Empty(t, manager.GetPeersWithTags("datacenter=c"))
+	assert.Len(t, manager.GetPeersWithTags(), 4)
+
+	peers := manager.GetOptimalPeersForBroadcast("peer-a", 10, "datacenter=a")
+	assert.Equal(t, []string{"peer-c"}, peers)
+	assert.Len(t, manager.GetOptimalPeersForBroadcast("", 10), 4)
+
+	// Callers get a copy of the metadata
+	info, exists := manager.GetPeerInfo("peer-a")
+	require.True(t, exists)
+	info.Metadata["datacenter"] = "b"
+	assert.ElementsMatch(t, []string{"peer-a", "peer-c"}, manager.GetPeersWithTags("datacenter=a"))
+}
+
+func TestValidateMetadata(t *testing.T) {
+	assert.NoError(t, ValidateMetadata(nil))
+	assert.NoError(t, ValidateMetadata(map[string]string{"edge": "", "datacenter": "a"}))
+
+	tooMany := make(map[string]string)
+	for i := 0; i <= MaxMetadataEntries; i++ {
+		tooMany[fmt.Sprintf("tag-%d", i)] = ""
+	}
+	for name, metadata := range map[string]map[string]string{
+		"too many entries": tooMany,
+		"empty key":        {"": "x"},
+		"key with equals":  {"a=b": ""},
+		"long key":         {strings.Repeat("k", MaxMetadataKeyLength+1): ""},
+		"long value":       {"k": strings.Repeat("v", MaxMetadataValueLength+1)},
+	} {
+		assert.ErrorIs(t, ValidateMetadata(metadata), ErrInvalidMetadata, name)
+	}
+}
+
+func TestManagerConcurrentAccess(t *testing.T) {
+	manager := NewManager(50)
+	for i := 0; i < 20; i++ {
+		manager.AddPeer(Peer{ID: fmt.Sprintf("peer-%d", i)})
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// Readers exercise every public path that previously nested RLock calls
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					manager.GetOptimalPeersForBroadcast("peer-0", 5)
+					manager.GetNetworkMetrics()
+					manager.GetBestPeers(3)
+					manager.GetTopologyType()
+				}
+			}
+		}()
+	}
+
+	// A writer keeps queueing behind the readers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				id := fmt.Sprintf("churn-%d", i%10)
+				manager.AddPeer(Peer{ID: id})
+				manager.UpdatePeerQuality(id, ConnectionQuality{Latency: time.Duration(i%100) * time.Millisecond})
+				manager.UpdatePeerReputation(id, 0.5)
+				manager.RemovePeer(id)
+			}
+		}
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("topology manager deadlocked under concurrent reads and writes")
+	}
+}
+
+func TestScoringWeightsChangeRanking(t *testing.T) {
+	// fast has low latency but little bandwidth, wide the opposite
+	addPeers := func(manager *Manager) {
+		manager.AddPeer(Peer{ID: "fast"})
+		manager.AddPeer(Peer{ID: "wide"})
+		manager.UpdatePeerQuality("fast", ConnectionQuality{
+			Latency:   5 * time.Millisecond,
+			Bandwidth: 1.0,
+		})
+		manager.UpdatePeerQuality("wide", ConnectionQuality{
+			Latency:   800 * time.Millisecond,
+			Bandwidth: 100.0,
+		})
+	}
+
+	latencyBiased, err := NewManagerWithConfig(10, ScoringConfig{LatencyWeight: 1, MeshThreshold: 10})
+	require.NoError(t, err)
+	addPeers(latencyBiased)
+	assert.Equal(t, []string{"fast", "wide"}, latencyBiased.GetBestPeers(2))
+
+	bandwidthBiased, err := NewManagerWithConfig(10, ScoringConfig{BandwidthWeight: 1, MeshThreshold: 10})
+	require.NoError(t, err)
+	addPeers(bandwidthBiased)
+	assert.Equal(t, []string{"wide", "fast"}, bandwidthBiased.GetBestPeers(2))
+
+	// Swapping weights at runtime re-ranks the same peers
+	require.NoError(t, bandwidthBiased.SetScoringConfig(ScoringConfig{LatencyWeight: 3, ReputationWeight: 1, MeshThreshold: 10}))
+	assert.Equal(t, []string{"fast", "wide"}, bandwidthBiased.GetBestPeers(2))
+}
+
+func TestScoringConfigValidation(t *testing.T) {
+	assert.NoError(t, DefaultScoringConfig().Validate())
+
+	negative := DefaultScoringConfig()
+	negative.JitterWeight = -1
+	assert.Error(t, negative.Validate())
+
+	assert.Error(t, ScoringConfig{MeshThreshold: 10}.Validate())
+
+	noThreshold := DefaultScoringConfig()
+	noThreshold.MeshThreshold = 0
+	_, err := NewManagerWithConfig(10, noThreshold)
+	assert.Error(t, err)
+
+	normalized := ScoringConfig{LatencyWeight: 2, ReputationWeight: 2, MeshThreshold: 10}.Normalized()
+	assert.InDelta(t, 0.5, normalized.LatencyWeight, 1e-9)
+	assert.InDelta(t, 0.5, normalized.ReputationWeight, 1e-9)
+}
+
+func TestMeshThresholdFromConfig(t *testing.T) {
+	scoring := DefaultScoringConfig()
+	scoring.MeshThreshold = 4
+	manager, err := NewManagerWithConfig(10, scoring)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		manager.AddPeer(Peer{ID: fmt.Sprintf("peer-%d", i)})
+	}
+	assert.Equal(t, "partial-mesh", manager.GetTopologyType())
+}
+
+func TestReputationDecayWithFakeClock(t *testing.T) {
+	manager := NewManager(10)
+	rs, err := NewReputationSystemWithConfig(manager, DecayConfig{
+		Interval:      time.Minute,
+		Rate:          0.5,
+		InactiveAfter: 5 * time.Minute,
+	})
+	require.NoError(t, err)
+
+	clock := time.Now()
+	rs.now = func() time.Time { return clock }
+
+	manager.AddPeer(Peer{ID: "good-absent"})
+	manager.AddPeer(Peer{ID: "bad-absent"})
+	manager.AddPeer(Peer{ID: "active"})
+	manager.UpdatePeerReputation("good-absent", 0.8)
+	manager.UpdatePeerReputation("bad-absent", -0.6)
+	manager.UpdatePeerReputation("active", 0.9)
+	manager.SetPeerConnected("good-absent", false)
+	manager.SetPeerConnected("bad-absent", false)
+
+	reputation := func(id string) float64 {
+		info, exists := manager.GetPeerInfo(id)
+		require.True(t, exists)
+		return info.Reputation
+	}
+
+	// A minute later only the disconnected peers decay
+	clock = clock.Add(time.Minute)
+	assert.Equal(t, 2, rs.applyDecay())
+	assert.InDelta(t, 0.4, reputation("good-absent"), 1e-9)
+	assert.InDelta(t, -0.3, reputation("bad-absent"), 1e-9)
+	assert.Equal(t, 0.9, reputation("active"))
+
+	// Once the connected peer has been silent past the threshold it decays too
+	clock = clock.Add(time.Hour)
+	for i := 0; i < 30; i++ {
+		rs.applyDecay()
+	}
+	assert.InDelta(t, 0.0, reputation("good-absent"), 1e-6)
+	assert.InDelta(t, 0.0, reputation("bad-absent"), 1e-6)
+	assert.InDelta(t, 0.0, reputation("active"), 1e-6)
+}
+
+func TestReputationDecayScheduler(t *testing.T) {
+	manager := NewManager(10)
+	rs, err := NewReputationSystemWithConfig(manager, DecayConfig{
+		Interval: 10 * time.Millisecond,
+		Rate:     0.5,
+	})
+	require.NoError(t, err)
+
+	manager.AddPeer(Peer{ID: "gone"})
+	manager.UpdatePeerReputation("gone", 0.8)
+	manager.SetPeerConnected("gone", false)
+
+	rs.Start(context.Background())
+	defer rs.Stop()
+
+	assert.Eventually(t, func() bool {
+		info, _ := manager.GetPeerInfo("gone")
+		return info.Reputation < 0.1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	_, err = NewReputationSystemWithConfig(manager, DecayConfig{Interval: 0, Rate: 0.5})
+	assert.Error(t, err)
+}
+
+func TestReputationFromBehaviorEvents(t *testing.T) {
+	manager := NewManager(10)
+	rs := NewReputationSystem(manager)
+	manager.AddPeer(Peer{ID: "noisy"})
+	manager.AddPeer(Peer{ID: "steady"})
+
+	for i := 0; i < 5; i++ {
+		rs.RecordEvent("noisy", EventDeserializeFailure)
+		rs.RecordEvent("steady", EventHeartbeat)
+		rs.RecordEvent("steady", EventSuccessfulExchange)
+	}
+
+	noisy, _ := manager.GetPeerInfo("noisy")
+	steady, _ := manager.GetPeerInfo("steady")
+	assert.Less(t, noisy.Reputation, -0.3)
+	assert.Greater(t, steady.Reputation, 0.2)
+
+	// Events for unknown peers are ignored
+	rs.RecordEvent("stranger", EventOversizeFrame)
+	_, exists := manager.GetPeerInfo("stranger")
+	assert.False(t, exists)
+
+	// Magnitudes are configurable
+	rs.SetBehaviorScores(BehaviorScores{EventHeartbeat: -1.0})
+	before, _ := manager.GetPeerInfo("steady")
+	rs.RecordEvent("steady", EventHeartbeat)
+	rs.RecordEvent("steady", EventSuccessfulExchange) // no longer mapped
+	after, _ := manager.GetPeerInfo("steady")
+	assert.InDelta(t, before.Reputation*0.7-0.3, after.Reputation, 1e-9)
+}
+
+func TestGetTrustedPeersHonoursThreshold(t *testing.T) {
+	manager := NewManager(10)
+	rs := NewReputationSystem(manager)
+
+	reputations := map[string]float64{"trusted": 0.9, "neutral": 0.0, "shady": -0.4}
+	for id, reputation := range reputations {
+		manager.AddPeer(Peer{ID: id})
+		manager.UpdatePeerReputation(id, reputation)
+	}
+
+	assert.Equal(t, []string{"trusted"}, rs.GetTrustedPeers(0.5))
+	assert.Equal(t, []string{"trusted", "neutral"}, rs.GetTrustedPeers(0.0))
+	assert.Len(t, rs.GetTrustedPeers(-1.0), 3)
+}
+
+func TestWatchReputationCrossings(t *testing.T) {
+	manager := NewManager(10)
+	rs, err := NewReputationSystemWithConfig(manager, DecayConfig{Interval: time.Minute, Rate: 0.5})
+	require.NoError(t, err)
+	manager.AddPeer(Peer{ID: "peer"})
+
+	var crossings []ReputationCrossing
+	manager.WatchReputation(-0.5, func(crossing ReputationCrossing) {
+		// The watcher may read the manager it is called from
+		_, exists := manager.GetPeerInfo(crossing.PeerID)
+		assert.True(t, exists)
+		crossings = append(crossings, crossing)
+	})
+
+	// Moving about on one side of the threshold is not reported
+	manager.UpdatePeerReputation("peer", -0.4)
+	rs.UpdateReputationBasedOnBehavior("peer", 1.0)
+	assert.Empty(t, crossings)
+
+	manager.UpdatePeerReputation("peer", -0.8)
+	rs.UpdateReputationBasedOnBehavior("peer", -1.0)
+	require.Len(t, crossings, 1)
+	assert.Equal(t, ReputationCrossing{PeerID: "peer", Reputation: -0.8, Below: true}, crossings[0])
+
+	// Decay brings the peer back to the threshold
+	manager.SetPeerConnected("peer", false)
+	rs.applyDecay()
+	require.Len(t, crossings, 2)
+	assert.False(t, crossings[1].Below)
+	assert.InDelta(t, -0.43, crossings[1].Reputation, 1e-9)
+
+	manager.WatchReputation(-0.5, nil)
+	manager.UpdatePeerReputation("peer", -0.9)
+	assert.Len(t, crossings, 2)
+}
+
+func TestSelectPeersToPrune(t *testing.T) {
+	manager := NewManager(10)
+
+	// peer-0 is the worst, peer-14 the best
+	for i := 0; i < 15; i++ {
+		id := fmt.Sprintf("peer-%d", i)
+		manager.AddPeer(Peer{ID: id})
+		manager.UpdatePeerReputation(id, -1.0+float64(i)*0.1)
+	}
+
+	pruned := manager.SelectPeersToPrune(0)
+	assert.ElementsMatch(t, []string{"peer-0", "peer-1", "peer-2", "peer-3", "peer-4"}, pruned)
+
+	// Persistent peers are skipped in favour of the next worst
+	manager.SetPeerPersistent("peer-0", true)
+	pruned = manager.SelectPeersToPrune(0)
+	assert.ElementsMatch(t, []string{"peer-1", "peer-2", "peer-3", "peer-4", "peer-5"}, pruned)
+
+	// Hysteresis prunes below the limit
+	assert.Len(t, manager.SelectPeersToPrune(2), 7)
+
+	// Nothing to do at or below the limit
+	for _, id := range pruned {
+		manager.RemovePeer(id)
+	}
+	assert.Empty(t, manager.SelectPeersToPrune(2))
+}
+
+func TestExportGraphGolden(t *testing.T) {
+	manager := NewManager(10)
+	manager.SetLocalID("node-a")
+
+	quality := ConnectionQuality{
+		Latency:    50 * time.Millisecond,
+		Bandwidth:  80,
+		PacketLoss: 1,
+		Jitter:     5 * time.Millisecond,
+	}
+	manager.AddPeer(Peer{ID: "node-b", Address: "10.0.0.2:8080"})
+	manager.UpdatePeerQuality("node-b", quality)
+	manager.UpdatePeerReputation("node-b", 0.5)
+
+	manager.AddPeer(Peer{ID: "node-c", Address: "10.0.0.3:8080"})
+	manager.UpdatePeerQuality("node-c", quality)
+	manager.SetPeerNeighbors("node-c", []string{"node-a", "node-b", "node-d"})
+
+	manager.AddPeer(Peer{ID: "node-e", Address: "10.0.0.5:8080"})
+	manager.SetPeerConnected("node-e", false)
+
+	for _, format := range []string{GraphFormatDOT, GraphFormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			got, err := manager.ExportGraph(format)
+			require.NoError(t, err)
+
+			golden := filepath.Join("testdata", "topology."+format)
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(golden, got, 0644))
+			}
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), string(got))
+		})
+	}
+
+	_, err := manager.ExportGraph("svg")
+	assert.Error(t, err)
+}
+
+func TestPeersReporting(t *testing.T) {
+	manager := NewManager(10)
+	manager.SetLocalID("node-a")
+
+	manager.AddPeer(Peer{ID: "node-b", Address: "10.0.0.2:8080"})
+	manager.SetPeerNeighbors("node-b", []string{"node-a", "node-d"})
+	manager.AddPeer(Peer{ID: "node-c", Address: "10.0.0.3:8080"})
+	manager.SetPeerNeighbors("node-c", []string{"node-a", "node-d"})
+	manager.UpdatePeerReputation("node-c", 0.9)
+	manager.UpdatePeerReputation("node-b", 0.1)
+	manager.AddPeer(Peer{ID: "node-e", Address: "10.0.0.5:8080"})
+	manager.SetPeerNeighbors("node-e", []string{"node-d"})
+	manager.SetPeerConnected("node-e", false)
+
+	// Disconnected peers are no way through; better scored peers come first
+	assert.Equal(t, []string{"node-c", "node-b"}, manager.PeersReporting("node-d"))
+	assert.Empty(t, manager.PeersReporting("node-f"))
+}
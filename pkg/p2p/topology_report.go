@@ -0,0 +1,45 @@
+package p2p
+
+import "context"
+
+// RequestTopologyReports asks every connected peer for its neighbor list so
+// the exported topology can show more than the local node's own links. Our
+// own neighbor list is included so each exchange informs both sides.
+func (n *Network) RequestTopologyReports() {
+	peers := n.topologyMgr.GetConnectedPeers()
+	for _, peerID := range peers {
+		msg := NewMessage(MessageTypeTopologyReport, n.nodeID, TopologyReportPayload{Peers: peers})
+		if err := n.SendMessage(context.Background(), peerID, msg); err != nil {
+			n.logger.Debugf("failed to request topology report from %s: %v", peerID, err)
+		}
+	}
+}
+
+// handleTopologyReportMessage records a peer's reported neighbors and answers
+// report requests with our own
+func (n *Network) handleTopologyReportMessage(msg *Message, conn *Connection) error {
+	var report TopologyReportPayload
+	if err := msg.DecodePayload(&report); err != nil {
+		return err
+	}
+
+	if len(report.Peers) > MaxPeerListSize {
+		report.Peers = report.Peers[:MaxPeerListSize]
+	}
+	peerID := conn.PeerID
+	if peerID == "" {
+		peerID = msg.Sender
+	}
+	n.topologyMgr.SetPeerNeighbors(peerID, report.Peers)
+
+	if report.Reply {
+		return nil
+	}
+
+	reply := NewMessage(MessageTypeTopologyReport, n.nodeID, TopologyReportPayload{
+		Peers: n.topologyMgr.GetConnectedPeers(),
+		Reply: true,
+	})
+	reply.TraceID = msg.TraceID
+	return n.send(conn, reply)
+}
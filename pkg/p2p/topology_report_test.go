@@ -0,0 +1,49 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopologyReportRevealsRemoteLinks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := startLocalNetwork(t, ctx, "node-a")
+	b := startLocalNetwork(t, ctx, "node-b")
+	c := startLocalNetwork(t, ctx, "node-c")
+
+	// A line: a - b - c
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	_, err = b.Connect(ctx, localAddr(c))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(b.topologyMgr.GetConnectedPeers()) == 2 && len(a.topologyMgr.GetConnectedPeers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	a.RequestTopologyReports()
+
+	require.Eventually(t, func() bool {
+		graph := a.topologyMgr.Graph()
+		for _, edge := range graph.Adjacency["node-b"] {
+			if edge.To == "node-c" && edge.Reported {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// The request carried a's neighbors, so b learned them too
+	require.Eventually(t, func() bool {
+		return len(b.topologyMgr.Graph().Adjacency["node-a"]) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	dot, err := a.ExportTopology("dot")
+	require.NoError(t, err)
+	assert.Contains(t, string(dot), `"node-b" -> "node-c" [style=dashed];`)
+}
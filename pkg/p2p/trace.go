@@ -0,0 +1,213 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reasons a trace stopped short of its destination, as carried in
+// TracePayload.Error
+const (
+	TraceErrorNoRoute  = "no_route"
+	TraceErrorHopLimit = "hop_limit"
+)
+
+var (
+	// ErrNoRoute is returned when no peer we know of leads to a node
+	ErrNoRoute = errors.New("no route to peer")
+	// ErrTraceHopLimit is returned for a trace that ran out of hops before
+	// reaching its destination
+	ErrTraceHopLimit = errors.New("trace exceeded the hop limit")
+)
+
+// TraceRoute probes the route to a node like traceroute(8): it sends a
+// TRACE that every node passing it on adds itself to, and returns the hops
+// the destination, or the node that gave up on it, sends back, in order.
+// The destination is the last hop of a complete trace. Hops pass a TRACE to
+// the destination if they are connected to it, and otherwise to the best
+// scored peer that reports being connected to it. A trace that stops short
+// returns the hops so far with ErrNoRoute or ErrTraceHopLimit.
+func (n *Network) TraceRoute(ctx context.Context, peerID string) ([]HopInfo, error) {
+	if peerID == n.nodeID {
+		return nil, fmt.Errorf("cannot trace a route to ourselves")
+	}
+
+	next := n.nextTraceHop(peerID, map[string]bool{n.nodeID: true})
+	if next == "" {
+		return nil, fmt.Errorf("failed to trace %s: %w", peerID, ErrNoRoute)
+	}
+
+	msg := NewMessage(MessageTypeTrace, n.nodeID, TracePayload{Origin: n.nodeID, Destination: peerID})
+	reply, err := n.Request(ctx, next, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to trace %s: %w", peerID, err)
+	}
+
+	var trace TracePayload
+	if err := reply.DecodePayload(&trace); err != nil {
+		return nil, fmt.Errorf("invalid trace of %s: %w", peerID, err)
+	}
+	switch trace.Error {
+	case "":
+		return trace.Hops, nil
+	case TraceErrorNoRoute:
+		return trace.Hops, fmt.Errorf("trace of %s stopped after %d hops: %w", peerID, len(trace.Hops), ErrNoRoute)
+	case TraceErrorHopLimit:
+		return trace.Hops, fmt.Errorf("trace of %s stopped after %d hops: %w", peerID, len(trace.Hops), ErrTraceHopLimit)
+	default:
+		return trace.Hops, fmt.Errorf("trace of %s stopped after %d hops: %s", peerID, len(trace.Hops), trace.Error)
+	}
+}
+
+// nextTraceHop picks the peer to pass a TRACE for destination to: the
+// destination itself if we are connected to it, otherwise the best scored
+// peer reporting it as a neighbor. Nodes in visited, and peers that do not
+// handle TRACE, are passed over; "" means we know no way on.
+func (n *Network) nextTraceHop(destination string, visited map[string]bool) string {
+	candidates := append([]string{destination}, n.topologyMgr.PeersReporting(destination)...)
+	for _, peerID := range candidates {
+		if visited[peerID] {
+			continue
+		}
+		peer, connected := n.peers.Get(peerID)
+		if connected && peer.GetConnection() != nil && peer.HasCapability(CapabilityTrace) {
+			return peerID
+		}
+	}
+	return ""
+}
+
+// handleTraceMessage adds us to a TRACE and passes it on, or returns it to
+// its origin if we are its destination or cannot take it further
+func (n *Network) handleTraceMessage(msg *Message, conn *Connection) error {
+	var trace TracePayload
+	if err := msg.DecodePayload(&trace); err != nil {
+		return err
+	}
+
+	// A TRACE comes from the last node it lists, and never passes us twice
+	previous := trace.Origin
+	if len(trace.Hops) > 0 {
+		previous = trace.Hops[len(trace.Hops)-1].NodeID
+	}
+	if previous != conn.PeerID {
+		return fmt.Errorf("trace %s from %s claims to come from %s", msg.ID, conn.PeerID, previous)
+	}
+	if trace.Origin == n.nodeID || traceIndex(trace, n.nodeID) >= 0 {
+		return fmt.Errorf("trace %s looped back to us", msg.ID)
+	}
+
+	// Timing the link may need a ping answered over this connection, whose
+	// reads wait on us
+	request := *msg
+	n.background(func() {
+		n.forwardTrace(request, trace, conn)
+	})
+	return nil
+}
+
+// forwardTrace adds our hop to a TRACE that reached us over from and sends
+// it to the next hop, or back the way it came if it ends here
+func (n *Network) forwardTrace(msg Message, trace TracePayload, from *Connection) {
+	hop := HopInfo{NodeID: n.nodeID, Latency: n.linkLatency(from.PeerID)}
+	if n.config.P2P.TraceAddresses && from.Conn != nil {
+		hop.Address = from.Conn.LocalAddr().String()
+	}
+	trace.Hops = append(trace.Hops, hop)
+
+	switch {
+	case trace.Destination == n.nodeID:
+	case len(trace.Hops) >= MaxTraceHops:
+		trace.Error = TraceErrorHopLimit
+	default:
+		visited := map[string]bool{trace.Origin: true}
+		for _, hop := range trace.Hops {
+			visited[hop.NodeID] = true
+		}
+		next := n.nextTraceHop(trace.Destination, visited)
+		if next == "" {
+			trace.Error = TraceErrorNoRoute
+			break
+		}
+
+		// The message keeps its ID so the reply finds the origin's request
+		forward := msg
+		forward.Sender = n.nodeID
+		forward.Payload = trace
+		err := n.SendMessage(n.ctx, next, forward)
+		if err == nil {
+			return
+		}
+		n.messageLogger(&msg).Debugf("failed to pass trace %s on to %s: %v", msg.ID, next, err)
+		trace.Error = TraceErrorNoRoute
+	}
+
+	n.returnTrace(msg.ID, msg.TraceID, trace, len(trace.Hops)-1)
+}
+
+// handleTraceReplyMessage passes a TRACE_REPLY on towards the trace's
+// origin. The origin itself resolves it as the reply to its request.
+func (n *Network) handleTraceReplyMessage(msg *Message, conn *Connection) error {
+	var trace TracePayload
+	if err := msg.DecodePayload(&trace); err != nil {
+		return err
+	}
+
+	index := traceIndex(trace, n.nodeID)
+	if index < 0 {
+		// Ours, once TraceRoute has stopped waiting, or not ours to pass on
+		n.messageLogger(msg).Debugf("dropping trace reply %s from %s", msg.ReplyTo, conn.PeerID)
+		return nil
+	}
+	if index+1 >= len(trace.Hops) || trace.Hops[index+1].NodeID != conn.PeerID {
+		return fmt.Errorf("trace reply %s from %s did not come back the way it went", msg.ReplyTo, conn.PeerID)
+	}
+
+	n.returnTrace(msg.ReplyTo, msg.TraceID, trace, index)
+	return nil
+}
+
+// returnTrace sends a trace back to the node before hop index on its path,
+// as the reply to the TRACE with ID requestID
+func (n *Network) returnTrace(requestID, traceID string, trace TracePayload, index int) {
+	previous := trace.Origin
+	if index > 0 {
+		previous = trace.Hops[index-1].NodeID
+	}
+
+	reply := NewMessage(MessageTypeTraceReply, n.nodeID, trace)
+	reply.ReplyTo = requestID
+	reply.TraceID = traceID
+	if err := n.SendMessage(n.ctx, previous, reply); err != nil {
+		n.messageLogger(&reply).Debugf("failed to return trace %s to %s: %v", requestID, previous, err)
+	}
+}
+
+// linkLatency returns the round trip time to a peer: the smoothed one if the
+// link was measured, otherwise that of a ping
+func (n *Network) linkLatency(peerID string) time.Duration {
+	if info, known := n.topologyMgr.GetPeerInfo(peerID); known && info.Quality.Measured() {
+		return info.Quality.Latency
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, DefaultTraceProbeTimeout)
+	defer cancel()
+	rtt, err := n.Ping(ctx, peerID)
+	if err != nil {
+		n.logger.Debugf("could not time the link to %s: %v", peerID, err)
+		return 0
+	}
+	return rtt
+}
+
+// traceIndex returns the position of a node among a trace's hops, or -1
+func traceIndex(trace TracePayload, nodeID string) int {
+	for i, hop := range trace.Hops {
+		if hop.NodeID == nodeID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,89 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceRoute(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A chain: a knows c only through b
+	a, b := connectPair(t, ctx, "trace-a", "trace-b")
+	c := startLocalNetwork(t, ctx, "trace-c")
+	_, err := b.Connect(ctx, localAddr(c))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(a.PeersWithCapability(CapabilityTrace)) == 1 &&
+			len(b.PeersWithCapability(CapabilityTrace)) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	_, err = a.TraceRoute(ctx, "trace-c")
+	assert.ErrorIs(t, err, ErrNoRoute)
+
+	a.RequestTopologyReports()
+	require.Eventually(t, func() bool {
+		return len(a.topologyMgr.PeersReporting("trace-c")) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	hops, err := a.TraceRoute(ctx, "trace-c")
+	require.NoError(t, err)
+	require.Len(t, hops, 2)
+	assert.Equal(t, "trace-b", hops[0].NodeID)
+	assert.Equal(t, "trace-c", hops[1].NodeID)
+	for _, hop := range hops {
+		assert.Positive(t, hop.Latency)
+		// Hops keep their addresses to themselves unless configured not to
+		assert.Empty(t, hop.Address)
+	}
+
+	// A direct peer is one hop away
+	hops, err = a.TraceRoute(ctx, "trace-b")
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.Equal(t, "trace-b", hops[0].NodeID)
+}
+
+func TestTraceRouteAddresses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := startLocalNetworkWith(t, ctx, "trace-b", func(cfg *config.Config) {
+		cfg.P2P.TraceAddresses = true
+	})
+
+	a := startLocalNetwork(t, ctx, "trace-a")
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(a.PeersWithCapability(CapabilityTrace)) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	hops, err := a.TraceRoute(ctx, "trace-b")
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.NotEmpty(t, hops[0].Address)
+}
+
+func TestTracePayloadValidation(t *testing.T) {
+	trace := TracePayload{Origin: "a", Destination: "c"}
+	for i := 0; i <= MaxTraceHops; i++ {
+		trace.Hops = append(trace.Hops, HopInfo{NodeID: "hop"})
+	}
+	tooLong := NewMessage(MessageTypeTrace, "a", trace)
+	assert.Error(t, tooLong.ValidatePayload())
+	headless := NewMessage(MessageTypeTrace, "a", TracePayload{Origin: "a"})
+	assert.Error(t, headless.ValidatePayload())
+	trace.Hops = trace.Hops[:MaxTraceHops]
+	valid := NewMessage(MessageTypeTrace, "a", trace)
+	assert.NoError(t, valid.ValidatePayload())
+
+	assert.Equal(t, 1, traceIndex(TracePayload{Hops: []HopInfo{{NodeID: "b"}, {NodeID: "c"}}}, "c"))
+	assert.Equal(t, -1, traceIndex(TracePayload{}, "c"))
+}
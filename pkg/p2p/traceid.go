@@ -0,0 +1,61 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/princetheprogrammer/synapse/internal/logger"
+)
+
+// traceIDKey is the context key of the trace ID messages are sent with
+type traceIDKey struct{}
+
+// NewTraceID returns a random trace ID: 16 bytes in hex, as W3C trace
+// context writes them
+func NewTraceID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// WithTraceID returns ctx carrying traceID. Messages sent with the context
+// that do not have a trace ID yet take this one, so a caller can log or
+// report the ID before anything is sent.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceIDFromContext returns the trace ID ctx carries, or "" if none
+func TraceIDFromContext(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+// traceMessage gives a message we originate its trace ID: the one ctx
+// carries, or a new one. A message that already has one, such as one we
+// relay or retransmit, keeps it.
+func traceMessage(ctx context.Context, msg *Message) {
+	if msg.TraceID != "" {
+		return
+	}
+	msg.TraceID = TraceIDFromContext(ctx)
+	if msg.TraceID == "" {
+		msg.TraceID = NewTraceID()
+	}
+}
+
+// answer makes m the answer to req: correlated with it, and in its trace
+func (m *Message) answer(req *Message) {
+	m.ReplyTo = req.ID
+	m.TraceID = req.TraceID
+}
+
+// messageLogger returns the logger for lines about msg, which carry its
+// trace ID if it has one
+func (n *Network) messageLogger(msg *Message) *logger.Logger {
+	if msg.TraceID == "" {
+		return n.logger
+	}
+	return n.logger.With("trace_id", msg.TraceID)
+}
@@ -0,0 +1,156 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logBuffer keeps what a network logs
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// traced returns the messages of the lines logged under traceID
+func (b *logBuffer) traced(t *testing.T, traceID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var messages []string
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		var line struct {
+			TraceID string `json:"trace_id"`
+			Message string `json:"message"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		if line.TraceID == traceID {
+			messages = append(messages, line.Message)
+		}
+	}
+	return messages
+}
+
+// logTo has a network, not started yet, log at debug level to a buffer
+func logTo(network *Network) *logBuffer {
+	logs := &logBuffer{}
+	network.logger = logger.NewWithWriter("debug", "json", logs).With("component", "p2p")
+	return logs
+}
+
+func TestTraceIDSurvivesRelayedRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := func(nodeID string) (*Network, *logBuffer) {
+		var logs *logBuffer
+		network := startLocalNetworkWith(t, ctx, nodeID, nil, func(n *Network) {
+			logs = logTo(n)
+		})
+		return network, logs
+	}
+
+	// A chain: a reaches c only through b
+	a, aLogs := start("traced-a")
+	b, bLogs := start("traced-b")
+	c, cLogs := start("traced-c")
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	_, err = b.Connect(ctx, localAddr(c))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(a.PeersWithCapability(CapabilityTrace)) == 1 &&
+			len(b.PeersWithCapability(CapabilityTrace)) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+	a.RequestTopologyReports()
+	require.Eventually(t, func() bool {
+		return len(a.topologyMgr.PeersReporting("traced-c")) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	traceID := NewTraceID()
+	hops, err := a.TraceRoute(WithTraceID(ctx, traceID), "traced-c")
+	require.NoError(t, err)
+	require.Len(t, hops, 2)
+
+	// The TRACE went a, b, c and its reply c, b, a, all under one trace ID
+	assert.True(t, logged(bLogs.traced(t, traceID), "received TRACE message"))
+	assert.True(t, logged(cLogs.traced(t, traceID), "received TRACE message"))
+	assert.True(t, logged(bLogs.traced(t, traceID), "received TRACE_REPLY message"))
+	assert.True(t, logged(aLogs.traced(t, traceID), "received TRACE_REPLY message"))
+}
+
+// logged reports whether one of lines starts with prefix
+func logged(lines []string, prefix string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTraceIDOnReplies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sender, receiver := connectPair(t, ctx, "traced-sender", "traced-receiver")
+	handled := make(chan Message, 1)
+	receiver.RegisterHandler("NOTE", func(msg Message) {
+		handled <- msg
+		receiver.Reply(msg, "NOTE_REPLY", "noted")
+	})
+
+	// A message sent with no trace ID in its context starts a new trace,
+	// which its reply carries back
+	reply, err := sender.Request(ctx, "traced-receiver", NewMessage("NOTE", sender.nodeID, "first"))
+	require.NoError(t, err)
+	request := <-handled
+	assert.Len(t, request.TraceID, 32)
+	assert.Equal(t, request.TraceID, reply.TraceID)
+
+	// One that has a trace ID keeps it
+	msg := NewMessage("NOTE", sender.nodeID, "second")
+	msg.TraceID = "kept"
+	reply, err = sender.Request(WithTraceID(ctx, "ignored"), "traced-receiver", msg)
+	require.NoError(t, err)
+	assert.Equal(t, "kept", (<-handled).TraceID)
+	assert.Equal(t, "kept", reply.TraceID)
+
+	// Peers may not send trace IDs of any length
+	msg.TraceID = strings.Repeat("x", MaxTraceIDLength+1)
+	assert.ErrorContains(t, msg.Validate(), "trace ID")
+}
+
+func TestTraceIDInAudit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := startLocalNetworkWith(t, ctx, "traced-audit-a", enableAudit)
+	b := startLocalNetworkWith(t, ctx, "traced-audit-b", enableAudit)
+	_, err := a.Connect(ctx, localAddr(b))
+	require.NoError(t, err)
+	waitForAudit(t, b, audit.EventHandshakeSucceeded, "traced-audit-a")
+
+	// Both ends audit a drained disconnect under its goodbye's trace
+	require.NoError(t, a.DisconnectPeer("traced-audit-b", DisconnectOptions{Drain: true, Reason: "maintenance"}))
+	ours := waitForAudit(t, a, audit.EventPeerDisconnected, "traced-audit-b")
+	theirs := waitForAudit(t, b, audit.EventPeerDisconnected, "traced-audit-a")
+	assert.NotEmpty(t, ours.TraceID)
+	assert.Equal(t, ours.TraceID, theirs.TraceID)
+}
@@ -0,0 +1,53 @@
+package p2p
+
+import (
+	"context"
+	"net"
+)
+
+// Transport carries the stream connections peers talk over. Networks use
+// TCP unless another transport is set, e.g. the in-memory one in p2ptest.
+type Transport interface {
+	// Listen accepts connections on address, given as ":port" or
+	// "host:port"
+	Listen(address string) (net.Listener, error)
+	// Dial connects to a host:port address
+	Dial(ctx context.Context, address string) (net.Conn, error)
+}
+
+// tcpTransport is the default transport over TCP sockets
+type tcpTransport struct {
+	network string
+}
+
+// Listen opens a TCP listener
+func (t tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen(t.network, address)
+}
+
+// Dial opens a TCP connection
+func (t tcpTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, t.network, address)
+}
+
+// SetTransport replaces TCP with another transport. It must be called before
+// Start. QUIC upgrades need real sockets and are only attempted over TCP.
+func (n *Network) SetTransport(transport Transport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.transport = transport
+}
+
+// streamTransport returns the transport in use, TCP on the allowed IP
+// versions by default, with faults injected when enabled
+func (n *Network) streamTransport() Transport {
+	var transport Transport = tcpTransport{network: n.addressPolicy().Network("tcp")}
+	if n.transport != nil {
+		transport = n.transport
+	}
+	if n.faults != nil {
+		return n.faults.Transport(transport)
+	}
+	return transport
+}
@@ -0,0 +1,100 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrIncompatibleVersion is returned when a peer's protocol version range
+// does not overlap with ours
+var ErrIncompatibleVersion = errors.New("incompatible protocol version")
+
+// legacyProtocolVersion is assumed for peers that do not advertise a version
+const legacyProtocolVersion = "1.0.0"
+
+// parseVersion parses a "major.minor.patch" version; missing parts are zero
+func parseVersion(version string) ([3]int, error) {
+	var parsed [3]int
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) == 0 || len(parts) > 3 || parts[0] == "" {
+		return parsed, fmt.Errorf("invalid protocol version %q", version)
+	}
+
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return parsed, fmt.Errorf("invalid protocol version %q", version)
+		}
+		parsed[i] = number
+	}
+	return parsed, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is lower than, equal to or higher than b
+func compareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range va {
+		switch {
+		case va[i] < vb[i]:
+			return -1, nil
+		case va[i] > vb[i]:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// negotiateVersion picks the protocol version to speak with a peer: the lower
+// of the two advertised versions, provided each side supports it. Peers that
+// advertise nothing are treated as speaking the legacy version.
+func negotiateVersion(localVersion, localMin, remoteVersion, remoteMin string) (string, error) {
+	if remoteVersion == "" {
+		remoteVersion = legacyProtocolVersion
+	}
+	if remoteMin == "" {
+		remoteMin = remoteVersion
+	}
+
+	negotiated := localVersion
+	cmp, err := compareVersions(remoteVersion, localVersion)
+	if err != nil {
+		return "", err
+	}
+	if cmp < 0 {
+		negotiated = remoteVersion
+	}
+
+	if cmp, err := compareVersions(negotiated, localMin); err != nil {
+		return "", err
+	} else if cmp < 0 {
+		return "", fmt.Errorf("peer speaks %s, we require at least %s: %w", remoteVersion, localMin, ErrIncompatibleVersion)
+	}
+	if cmp, err := compareVersions(negotiated, remoteMin); err != nil {
+		return "", err
+	} else if cmp < 0 {
+		return "", fmt.Errorf("peer requires at least %s, we speak %s: %w", remoteMin, localVersion, ErrIncompatibleVersion)
+	}
+
+	return negotiated, nil
+}
+
+// rejectIncompatiblePeer tells a peer why we will not talk to it
+func (n *Network) rejectIncompatiblePeer(connection *Connection, err error) {
+	reject := NewMessage(MessageTypeError, n.nodeID, ErrorPayload{
+		Code:    ErrorCodeNotImplemented,
+		Message: err.Error(),
+	})
+	if sendErr := n.sendMessageToConn(connection.Conn, reject); sendErr != nil {
+		n.logger.Debugf("failed to send version rejection: %v", sendErr)
+	}
+}
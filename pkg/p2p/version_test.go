@@ -0,0 +1,113 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name                     string
+		remoteVersion, remoteMin string
+		expected                 string
+		expectErr                bool
+	}{
+		{name: "same version", remoteVersion: "1.2.0", remoteMin: "1.0.0", expected: "1.2.0"},
+		{name: "newer but compatible", remoteVersion: "1.5.0", remoteMin: "1.1.0", expected: "1.2.0"},
+		{name: "older but supported", remoteVersion: "1.1.3", remoteMin: "1.0.0", expected: "1.1.3"},
+		{name: "legacy peer", expected: "1.0.0"},
+		{name: "peer too old", remoteVersion: "0.9.0", remoteMin: "0.9.0", expectErr: true},
+		{name: "peer requires newer", remoteVersion: "2.0.0", remoteMin: "2.0.0", expectErr: true},
+		{name: "garbage version", remoteVersion: "one", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, err := negotiateVersion("1.2.0", "1.0.0", tt.remoteVersion, tt.remoteMin)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, version)
+		})
+	}
+
+	_, err := negotiateVersion("1.2.0", "1.0.0", "2.0.0", "2.0.0")
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+}
+
+func TestNewerCompatiblePeerNegotiatesDown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	current := startLocalNetwork(t, ctx, "current-node")
+	newer := startLocalNetwork(t, ctx, "newer-node")
+	newer.setProtocolVersions("1.1.0", "1.0.0")
+
+	_, err := newer.Connect(ctx, localAddr(current))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(newer.Peers()) == 1 && len(current.Peers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Equal(t, ProtocolVersion, newer.Peers()[0].Version)
+	assert.Equal(t, ProtocolVersion, current.Peers()[0].Version)
+	assert.True(t, newer.peers.All()[0].AtLeastVersion("1.0.0"))
+	assert.False(t, newer.peers.All()[0].AtLeastVersion("1.1.0"))
+}
+
+func TestIncompatiblePeerIsRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := startLocalNetwork(t, ctx, "current-node")
+
+	encryptor, err := crypto.NewEncryptor()
+	require.NoError(t, err)
+	future := crypto.NewHandshakeManager(encryptor, "future-node")
+	future.SetProtocolVersions("2.0.0", "2.0.0")
+	handshake, err := future.CreateHandshakeMessage()
+	require.NoError(t, err)
+
+	conn, err := dialLocal(network)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	data, err := json.Marshal(handshake)
+	require.NoError(t, err)
+	_, err = conn.Write(append(data, '\n'))
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+
+	var reply struct {
+		Type    string       `json:"type"`
+		Payload ErrorPayload `json:"payload"`
+	}
+	require.NoError(t, json.Unmarshal(line, &reply))
+	assert.Equal(t, MessageTypeError, reply.Type)
+	assert.Equal(t, ErrorCodeNotImplemented, reply.Payload.Code)
+	assert.Empty(t, network.Peers())
+
+	// The dialing side surfaces the rejection as a typed error
+	client := startLocalNetwork(t, ctx, "client-node")
+	client.setProtocolVersions("2.0.0", "2.0.0")
+	clientConn, err := dialLocal(network)
+	require.NoError(t, err)
+	connection := &Connection{Conn: clientConn, Address: clientConn.RemoteAddr().String()}
+	err = client.performSecureHandshake(clientConn, false, connection)
+	var remoteErr *ErrorPayload
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, ErrorCodeNotImplemented, remoteErr.Code)
+	assert.Empty(t, client.Peers())
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/princetheprogrammer/synapse/internal/fileperm"
+)
+
+// Direct writes files without any quota accounting. It is the default for
+// components that have not been handed a Manager.
+var Direct Writer = directWriter{}
+
+type directWriter struct{}
+
+// WriteFile atomically replaces a file
+func (directWriter) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomic(path, data, perm)
+}
+
+// Check always allows the write
+func (directWriter) Check(n int64) error {
+	return nil
+}
+
+// CheckWritable reports whether files can be created in dir by creating and
+// removing one, since mode bits do not tell on every platform: on Windows
+// access goes by ACLs, and root may write where they forbid it
+func CheckWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+	name := file.Name()
+	file.Close()
+	return os.Remove(name)
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it
+// into place, so a crash never leaves a torn file behind. A perm that gives
+// others no access is also enforced where mode bits are ignored, before the
+// data is written.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+
+	tmp := path + ".tmp"
+	if err := writePrivate(tmp, data, perm); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// writePrivate writes data to path, first restricting the file to its owner
+// if perm gives others no access
+func writePrivate(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if perm&0o077 == 0 {
+		if err := fileperm.Restrict(path); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultHighWaterMark is the fraction of the quota at which a warning fires
+const DefaultHighWaterMark = 0.9
+
+// ErrQuotaExceeded is returned when a write would take the data directory
+// past its storage quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Writer persists files on behalf of a component. Check reports whether n
+// more bytes may be stored before the component commits to keeping them.
+type Writer interface {
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	Check(n int64) error
+}
+
+// Usage describes how much of the quota is in use
+type Usage struct {
+	UsedBytes  int64   `json:"used_bytes"`
+	QuotaBytes int64   `json:"quota_bytes"`
+	Percent    float64 `json:"percent"`
+	HighWater  bool    `json:"high_water"`
+}
+
+// Manager accounts for every byte written under the data directory and
+// refuses writes once the quota is reached
+type Manager struct {
+	dir       string
+	quota     int64
+	highWater float64
+	used      int64
+	above     bool
+
+	onHighWater func(Usage)
+	mu          sync.Mutex
+
+	// frozen is held exclusively while a snapshot reads the directory
+	frozen sync.RWMutex
+}
+
+// NewManager creates a manager for dir with a quota in bytes and a high-water
+// mark between 0 and 1. Current usage is measured by walking the directory.
+func NewManager(dir string, quotaBytes int64, highWater float64) (*Manager, error) {
+	if quotaBytes < 1 {
+		return nil, fmt.Errorf("storage quota must be positive")
+	}
+	if highWater <= 0 || highWater > 1 {
+		highWater = DefaultHighWaterMark
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory %s: %w", dir, err)
+	}
+	if err := CheckWritable(dir); err != nil {
+		return nil, fmt.Errorf("data directory %s is not writable: %w", dir, err)
+	}
+
+	m := &Manager{
+		dir:       filepath.Clean(dir),
+		quota:     quotaBytes,
+		highWater: highWater,
+	}
+	if err := m.Recalculate(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Dir returns the managed data directory
+func (m *Manager) Dir() string {
+	return m.dir
+}
+
+// OnHighWater sets a function called whenever usage rises past the
+// high-water mark. It fires again only after usage has dropped back below.
+func (m *Manager) OnHighWater(fn func(Usage)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onHighWater = fn
+}
+
+// Recalculate re-measures usage by walking the data directory, so files
+// deleted or added behind the manager's back are accounted for
+func (m *Manager) Recalculate() error {
+	var total int64
+	err := filepath.WalkDir(m.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to measure data directory: %w", err)
+	}
+
+	m.mu.Lock()
+	m.used = total
+	notify := m.updateHighWaterLocked()
+	m.mu.Unlock()
+
+	notify()
+	return nil
+}
+
+// Usage returns the current usage
+func (m *Manager) Usage() Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usageLocked()
+}
+
+// Check returns ErrQuotaExceeded if n more bytes would not fit in the quota
+func (m *Manager) Check(n int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n > 0 && m.used+n > m.quota {
+		return fmt.Errorf("need %d bytes with %d of %d in use: %w", n, m.used, m.quota, ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// WriteFile atomically replaces a file, charging the change in size against
+// the quota. Files outside the data directory are written without accounting.
+func (m *Manager) WriteFile(path string, data []byte, perm os.FileMode) error {
+	m.frozen.RLock()
+	defer m.frozen.RUnlock()
+
+	if !m.tracks(path) {
+		return WriteFileAtomic(path, data, perm)
+	}
+
+	var previous int64
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+
+	delta := int64(len(data)) - previous
+	if err := m.reserve(delta); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	if err := WriteFileAtomic(path, data, perm); err != nil {
+		m.release(delta)
+		return err
+	}
+	return nil
+}
+
+// Modify runs fn, which changes a file in place, e.g. a database commit, and
+// charges the change in the file's size against the quota. Snapshots are
+// held back meanwhile, as for WriteFile. The change has already happened by
+// the time it is measured, so it is never refused: callers Check first.
+func (m *Manager) Modify(path string, fn func() error) error {
+	m.frozen.RLock()
+	defer m.frozen.RUnlock()
+
+	if !m.tracks(path) {
+		return fn()
+	}
+
+	var previous int64
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+	err := fn()
+	var current int64
+	if info, statErr := os.Stat(path); statErr == nil {
+		current = info.Size()
+	}
+
+	m.release(previous - current)
+	return err
+}
+
+// Remove deletes a file and gives its bytes back to the quota
+func (m *Manager) Remove(path string) error {
+	m.frozen.RLock()
+	defer m.frozen.RUnlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if m.tracks(path) {
+		m.release(info.Size())
+	}
+	return nil
+}
+
+// Rename moves a file, e.g. a finished download into place. Only a file
+// replaced at newpath, or a move across the edge of the data directory,
+// changes usage.
+func (m *Manager) Rename(oldpath, newpath string) error {
+	m.frozen.RLock()
+	defer m.frozen.RUnlock()
+
+	info, err := os.Stat(oldpath)
+	if err != nil {
+		return err
+	}
+	var replaced int64
+	if existing, err := os.Stat(newpath); err == nil {
+		replaced = existing.Size()
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	var delta int64
+	if m.tracks(oldpath) {
+		delta -= info.Size()
+	}
+	if m.tracks(newpath) {
+		delta += info.Size() - replaced
+	}
+	m.release(-delta)
+	return nil
+}
+
+// OpenAppend opens a file for appending, e.g. a log. Each write is charged
+// against the quota and fails with ErrQuotaExceeded once it is full.
+func (m *Manager) OpenAppend(path string, perm os.FileMode) (io.WriteCloser, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, perm)
+	if err != nil {
+		return nil, err
+	}
+	if !m.tracks(path) {
+		return file, nil
+	}
+	return &appendWriter{file: file, manager: m}, nil
+}
+
+// Freeze runs fn while file writes and removals through the manager are held
+// back, so fn sees the node's state at a single point in time. Appends are
+// not held back: logs are not state, and logging must never block on a backup.
+func (m *Manager) Freeze(fn func() error) error {
+	m.frozen.Lock()
+	defer m.frozen.Unlock()
+	return fn()
+}
+
+// tracks reports whether path lies inside the data directory
+func (m *Manager) tracks(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	dir, err := filepath.Abs(m.dir)
+	if err != nil {
+		return false
+	}
+	return abs == dir || strings.HasPrefix(abs, dir+string(filepath.Separator))
+}
+
+// reserve charges delta bytes against the quota; shrinking always succeeds
+func (m *Manager) reserve(delta int64) error {
+	m.mu.Lock()
+	if delta > 0 && m.used+delta > m.quota {
+		used := m.used
+		m.mu.Unlock()
+		return fmt.Errorf("need %d bytes with %d of %d in use: %w", delta, used, m.quota, ErrQuotaExceeded)
+	}
+	m.used += delta
+	notify := m.updateHighWaterLocked()
+	m.mu.Unlock()
+
+	notify()
+	return nil
+}
+
+// release returns bytes to the quota, or charges them if n is negative
+func (m *Manager) release(n int64) {
+	m.mu.Lock()
+	m.used -= n
+	if m.used < 0 {
+		m.used = 0
+	}
+	notify := m.updateHighWaterLocked()
+	m.mu.Unlock()
+
+	notify()
+}
+
+// updateHighWaterLocked tracks crossings of the high-water mark and returns
+// the notification to run once m.mu is released; callers must hold m.mu
+func (m *Manager) updateHighWaterLocked() func() {
+	above := float64(m.used) >= float64(m.quota)*m.highWater
+	crossed := above && !m.above
+	m.above = above
+
+	if !crossed || m.onHighWater == nil {
+		return func() {}
+	}
+	fn, usage := m.onHighWater, m.usageLocked()
+	return func() { fn(usage) }
+}
+
+// usageLocked builds a Usage snapshot; callers must hold m.mu
+func (m *Manager) usageLocked() Usage {
+	return Usage{
+		UsedBytes:  m.used,
+		QuotaBytes: m.quota,
+		Percent:    float64(m.used) / float64(m.quota) * 100,
+		HighWater:  m.above,
+	}
+}
+
+// appendWriter charges appended bytes against the manager's quota
+type appendWriter struct {
+	file    *os.File
+	manager *Manager
+}
+
+// Write appends p if it fits in the quota
+func (w *appendWriter) Write(p []byte) (int, error) {
+	if err := w.manager.reserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := w.file.Write(p)
+	if n < len(p) {
+		w.manager.release(int64(len(p) - n))
+	}
+	return n, err
+}
+
+// Close closes the underlying file
+func (w *appendWriter) Close() error {
+	return w.file.Close()
+}
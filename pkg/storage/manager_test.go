@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaEnforcement(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 1000, 0.9)
+	require.NoError(t, err)
+
+	var warnings []Usage
+	m.OnHighWater(func(usage Usage) {
+		warnings = append(warnings, usage)
+	})
+
+	path := filepath.Join(dir, "state.json")
+	require.NoError(t, m.WriteFile(path, bytes.Repeat([]byte("a"), 600), 0644))
+	assert.Equal(t, int64(600), m.Usage().UsedBytes)
+	assert.Empty(t, warnings)
+
+	// Replacing a file only charges the difference in size
+	require.NoError(t, m.WriteFile(path, bytes.Repeat([]byte("a"), 850), 0644))
+	assert.Equal(t, int64(850), m.Usage().UsedBytes)
+	assert.Empty(t, warnings)
+
+	// Crossing 90% warns once
+	other := filepath.Join(dir, "sub", "other.json")
+	require.NoError(t, m.WriteFile(other, bytes.Repeat([]byte("b"), 100), 0644))
+	require.Len(t, warnings, 1)
+	assert.True(t, warnings[0].HighWater)
+	assert.InDelta(t, 95.0, warnings[0].Percent, 0.01)
+
+	// Going past the quota is refused and leaves the file untouched
+	err = m.WriteFile(other, bytes.Repeat([]byte("b"), 200), 0644)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	data, err := os.ReadFile(other)
+	require.NoError(t, err)
+	assert.Len(t, data, 100)
+	assert.ErrorIs(t, m.Check(51), ErrQuotaExceeded)
+	assert.NoError(t, m.Check(50))
+
+	// Shrinking is always allowed and frees room
+	require.NoError(t, m.WriteFile(path, []byte("small"), 0644))
+	assert.False(t, m.Usage().HighWater)
+	require.NoError(t, m.WriteFile(other, bytes.Repeat([]byte("b"), 200), 0644))
+
+	require.NoError(t, m.Remove(other))
+	assert.Equal(t, int64(5), m.Usage().UsedBytes)
+}
+
+func TestAppendWriter(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 100, 0.9)
+	require.NoError(t, err)
+
+	log, err := m.OpenAppend(filepath.Join(dir, "synapse.log"), 0644)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 9; i++ {
+		_, err := log.Write(bytes.Repeat([]byte("x"), 10))
+		require.NoError(t, err)
+	}
+	_, err = log.Write(bytes.Repeat([]byte("x"), 11))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Equal(t, int64(90), m.Usage().UsedBytes)
+
+	// Files outside the data directory are not accounted
+	outside, err := m.OpenAppend(filepath.Join(t.TempDir(), "other.log"), 0644)
+	require.NoError(t, err)
+	defer outside.Close()
+	_, err = outside.Write(bytes.Repeat([]byte("x"), 500))
+	require.NoError(t, err)
+	assert.Equal(t, int64(90), m.Usage().UsedBytes)
+}
+
+func TestRecalculate(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing"), bytes.Repeat([]byte("a"), 300), 0644))
+
+	// Startup measures what is already on disk
+	m, err := NewManager(dir, 1000, 0.9)
+	require.NoError(t, err)
+	assert.Equal(t, int64(300), m.Usage().UsedBytes)
+
+	tracked := filepath.Join(dir, "tracked")
+	require.NoError(t, m.WriteFile(tracked, bytes.Repeat([]byte("b"), 400), 0644))
+	assert.Equal(t, int64(700), m.Usage().UsedBytes)
+
+	// External deletions are picked up by a recalculation
+	require.NoError(t, os.Remove(tracked))
+	require.NoError(t, m.Recalculate())
+	assert.Equal(t, int64(300), m.Usage().UsedBytes)
+
+	_, err = NewManager(dir, 0, 0.9)
+	assert.Error(t, err)
+}
+
+func TestModify(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 100, 0.5)
+	require.NoError(t, err)
+
+	var warnings []Usage
+	m.OnHighWater(func(usage Usage) {
+		warnings = append(warnings, usage)
+	})
+
+	// A file changed in place is charged for its growth, failed or not
+	path := filepath.Join(dir, "state.db")
+	err = m.Modify(path, func() error {
+		return os.WriteFile(path, bytes.Repeat([]byte("a"), 60), 0600)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(60), m.Usage().UsedBytes)
+	assert.Len(t, warnings, 1)
+
+	err = m.Modify(path, func() error {
+		require.NoError(t, os.Truncate(path, 20))
+		return os.ErrClosed
+	})
+	assert.ErrorIs(t, err, os.ErrClosed)
+	assert.Equal(t, int64(20), m.Usage().UsedBytes)
+
+	// Snapshots wait for a change in progress
+	changing := make(chan struct{})
+	release := make(chan struct{})
+	go m.Modify(path, func() error {
+		close(changing)
+		<-release
+		return nil
+	})
+	<-changing
+	frozen := make(chan struct{})
+	go m.Freeze(func() error {
+		close(frozen)
+		return nil
+	})
+	select {
+	case <-frozen:
+		t.Fatal("snapshot taken while a file was changing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-frozen
+}
+
+func TestRename(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 100, 0.9)
+	require.NoError(t, err)
+
+	part := filepath.Join(dir, "blob.part")
+	require.NoError(t, m.WriteFile(part, bytes.Repeat([]byte("a"), 30), 0600))
+	target := filepath.Join(dir, "blob")
+	require.NoError(t, m.WriteFile(target, bytes.Repeat([]byte("b"), 50), 0600))
+	assert.Equal(t, int64(80), m.Usage().UsedBytes)
+
+	// Replacing a file gives back its bytes
+	require.NoError(t, m.Rename(part, target))
+	assert.Equal(t, int64(30), m.Usage().UsedBytes)
+	assert.NoFileExists(t, part)
+
+	// Moving a file out of the data directory gives back all of it
+	outside := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, m.Rename(target, outside))
+	assert.Equal(t, int64(0), m.Usage().UsedBytes)
+
+	assert.Error(t, m.Rename(part, target))
+}
+
+func TestUnusableDataDir(t *testing.T) {
+	// A data directory that cannot be created says where it was wanted
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	_, err := NewManager(filepath.Join(file, "data"), 1000, 0.9)
+	assert.ErrorContains(t, err, "failed to create data directory "+filepath.Join(file, "data"))
+
+	// Checking a directory can be written to leaves nothing behind
+	dir := t.TempDir()
+	require.NoError(t, CheckWritable(dir))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// One that cannot be written to is refused
+	require.NoError(t, os.Chmod(dir, 0500))
+	t.Cleanup(func() { os.Chmod(dir, 0700) })
+	if CheckWritable(dir) == nil {
+		t.Skip("mode bits do not keep us from writing here, as on Windows or as root")
+	}
+	_, err = NewManager(dir, 1000, 0.9)
+	assert.ErrorContains(t, err, "is not writable")
+}
@@ -0,0 +1,352 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+)
+
+const (
+	// DefaultSyncInterval is how often anti-entropy rounds pull from peers
+	DefaultSyncInterval = 30 * time.Second
+
+	// maxSyncBatch caps the entries in a single SYNC_RESPONSE
+	maxSyncBatch = 500
+
+	// maxSyncBatchBytes keeps a SYNC_RESPONSE well below the frame limit
+	maxSyncBatchBytes = p2p.MaxMessageSize / 2
+)
+
+// Replicator keeps a Store in sync with the rest of the mesh. Local writes
+// are broadcast as DATA_SYNC messages, peers that connect are asked for what
+// we are missing, and a periodic anti-entropy round pulls from every peer
+// that supports sync.
+type Replicator struct {
+	store    *Store
+	network  *p2p.Network
+	logger   *logger.Logger
+	interval time.Duration
+
+	// watermarks holds, per peer, the peer's sequence we have pulled up to
+	watermarks map[string]int64
+	pulling    map[string]bool
+	mu         sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewReplicator creates a replicator for the store over the given network
+func NewReplicator(store *Store, network *p2p.Network, log *logger.Logger, interval time.Duration) (*Replicator, error) {
+	if store == nil {
+		return nil, fmt.Errorf("store cannot be nil")
+	}
+	if network == nil {
+		return nil, fmt.Errorf("network cannot be nil")
+	}
+	if log == nil {
+		return nil, fmt.Errorf("logger cannot be nil")
+	}
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+
+	return &Replicator{
+		store:      store,
+		network:    network,
+		logger:     log.With("component", "store"),
+		interval:   interval,
+		watermarks: make(map[string]int64),
+		pulling:    make(map[string]bool),
+	}, nil
+}
+
+// Start registers the sync handlers and starts anti-entropy. It must run
+// before the network starts so the sync capability is advertised in HELLO.
+func (r *Replicator) Start(ctx context.Context) error {
+	r.ctx, r.cancel = context.WithCancel(ctx)
+
+	r.network.RegisterHandler(p2p.MessageTypeDataSync, r.handleDataSync)
+	r.network.RegisterHandler(p2p.MessageTypeSyncRequest, r.handleSyncRequest)
+
+	events, unsubscribe := r.network.Subscribe(64)
+
+	r.wg.Add(1)
+	go r.run(events, unsubscribe)
+
+	return nil
+}
+
+// Stop ends anti-entropy and saves the store
+func (r *Replicator) Stop() error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+	return r.store.Save()
+}
+
+// Store returns the replicated store
+func (r *Replicator) Store() *Store {
+	return r.store
+}
+
+// Get returns the value of a live key
+func (r *Replicator) Get(key string) (json.RawMessage, error) {
+	return r.store.Get(key)
+}
+
+// Put writes a value locally and broadcasts it to peers
+func (r *Replicator) Put(key string, value interface{}) error {
+	entry, err := r.store.Put(key, value, r.network.NodeID())
+	if err != nil {
+		return err
+	}
+	r.broadcast(entry)
+	return nil
+}
+
+// Delete writes a tombstone locally and broadcasts it to peers
+func (r *Replicator) Delete(key string) error {
+	entry, err := r.store.Delete(key, r.network.NodeID())
+	if err != nil {
+		return err
+	}
+	r.broadcast(entry)
+	return nil
+}
+
+// Sync pulls every change a peer has that we have not seen yet
+func (r *Replicator) Sync(ctx context.Context, peerID string) error {
+	for {
+		r.mu.Lock()
+		since := r.watermarks[peerID]
+		r.mu.Unlock()
+
+		req := p2p.NewMessage(p2p.MessageTypeSyncRequest, r.network.NodeID(), p2p.SyncRequestPayload{Since: since})
+		reply, err := r.network.Request(ctx, peerID, req)
+		if err != nil {
+			return fmt.Errorf("sync request to %s failed: %w", peerID, err)
+		}
+
+		var response p2p.SyncResponsePayload
+		if err := reply.DecodePayload(&response); err != nil {
+			return fmt.Errorf("invalid sync response from %s: %w", peerID, err)
+		}
+
+		applied := 0
+		for _, payload := range response.Entries {
+			if r.apply(payload, peerID) {
+				applied++
+			}
+		}
+		if applied > 0 {
+			r.logger.Debugf("pulled %d entries from %s", applied, peerID)
+		}
+
+		r.mu.Lock()
+		if response.Watermark > r.watermarks[peerID] {
+			r.watermarks[peerID] = response.Watermark
+		}
+		r.mu.Unlock()
+
+		if !response.More {
+			return nil
+		}
+	}
+}
+
+// run drives anti-entropy rounds and pulls from peers as they connect
+func (r *Replicator) run(events <-chan p2p.Event, unsubscribe func()) {
+	defer r.wg.Done()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case evt := <-events:
+			switch evt.Type {
+			case p2p.EventPeerConnected:
+				r.pullFrom(evt.PeerID)
+			case p2p.EventPeerDisconnected:
+				r.mu.Lock()
+				delete(r.watermarks, evt.PeerID)
+				r.mu.Unlock()
+			}
+		case <-ticker.C:
+			r.antiEntropy()
+		}
+	}
+}
+
+// antiEntropy pulls from every connected sync peer and saves the store
+func (r *Replicator) antiEntropy() {
+	for _, peer := range r.network.PeersWithCapability(p2p.CapabilitySync) {
+		r.pullFrom(peer.ID)
+	}
+
+	if err := r.store.Save(); err != nil {
+		r.logger.Errorf("failed to save store: %v", err)
+	}
+}
+
+// pullFrom syncs with a peer in the background unless a pull is already running
+func (r *Replicator) pullFrom(peerID string) {
+	peer, ok := r.network.Peer(peerID)
+	if !ok || !peer.HasCapability(p2p.CapabilitySync) {
+		return
+	}
+
+	r.mu.Lock()
+	if r.pulling[peerID] {
+		r.mu.Unlock()
+		return
+	}
+	r.pulling[peerID] = true
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() {
+			r.mu.Lock()
+			delete(r.pulling, peerID)
+			r.mu.Unlock()
+		}()
+
+		if err := r.Sync(r.ctx, peerID); err != nil {
+			r.logger.Debugf("anti-entropy with %s failed: %v", peerID, err)
+		}
+	}()
+}
+
+// broadcast sends an entry to every peer that supports sync
+func (r *Replicator) broadcast(entry Entry) {
+	msg := p2p.NewMessage(p2p.MessageTypeDataSync, r.network.NodeID(), toPayload(entry))
+	if _, err := r.network.Broadcast(r.ctx, msg); err != nil {
+		r.logger.Debugf("failed to broadcast %s: %v", entry.Key, err)
+	}
+}
+
+// handleDataSync applies a pushed entry and passes it on if it was new to us,
+// so writes spread beyond the writer's direct neighbours
+func (r *Replicator) handleDataSync(msg p2p.Message) {
+	var payload p2p.DataSyncPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		r.logger.Warnf("dropping DATA_SYNC from %s: %v", msg.Sender, err)
+		return
+	}
+
+	if r.apply(payload, msg.Sender) {
+		entry, _ := r.store.Entry(payload.DataID)
+		r.broadcast(entry)
+	}
+}
+
+// handleSyncRequest answers a SYNC_REQUEST with the requested keys or with
+// every change after the requester's watermark
+func (r *Replicator) handleSyncRequest(msg p2p.Message) {
+	var request p2p.SyncRequestPayload
+	if err := msg.DecodePayload(&request); err != nil {
+		r.logger.Warnf("dropping SYNC_REQUEST from %s: %v", msg.Sender, err)
+		return
+	}
+
+	var response p2p.SyncResponsePayload
+	if len(request.Keys) > 0 {
+		for _, entry := range r.store.Lookup(request.Keys) {
+			response.Entries = append(response.Entries, toPayload(entry))
+		}
+		response.Watermark = request.Since
+	} else {
+		response = changesSince(r.store, request.Since)
+	}
+
+	if err := r.network.Reply(msg, p2p.MessageTypeSyncResponse, response); err != nil {
+		r.logger.Debugf("failed to answer sync request from %s: %v", msg.Sender, err)
+	}
+}
+
+// changesSince builds a SYNC_RESPONSE from the store's changes after since,
+// holding entries back once the batch limits are reached
+func changesSince(store *Store, since int64) p2p.SyncResponsePayload {
+	changes, more := store.Changes(since, maxSyncBatch)
+
+	response := p2p.SyncResponsePayload{Watermark: since, More: more}
+	size := 0
+	for _, entry := range changes {
+		size += len(entry.Key) + len(entry.Value)
+		if size > maxSyncBatchBytes && len(response.Entries) > 0 {
+			response.More = true
+			break
+		}
+		response.Entries = append(response.Entries, toPayload(entry))
+		response.Watermark = entry.Updated
+	}
+	return response
+}
+
+// apply merges a received entry into the store
+func (r *Replicator) apply(payload p2p.DataSyncPayload, fromPeerID string) bool {
+	entry, err := fromPayload(payload)
+	if err != nil {
+		r.logger.Warnf("dropping entry from %s: %v", fromPeerID, err)
+		return false
+	}
+	if entry.Origin == "" {
+		entry.Origin = fromPeerID
+	}
+	return r.store.Apply(entry)
+}
+
+// toPayload converts an entry to its wire form
+func toPayload(entry Entry) p2p.DataSyncPayload {
+	payload := p2p.DataSyncPayload{
+		DataID:    entry.Key,
+		Type:      "json",
+		Version:   entry.Version,
+		Timestamp: entry.Timestamp,
+		Origin:    entry.Origin,
+		Deleted:   entry.Deleted,
+	}
+	if !entry.Deleted {
+		payload.Content = entry.Value
+	}
+	return payload
+}
+
+// fromPayload converts a received payload back to an entry
+func fromPayload(payload p2p.DataSyncPayload) (Entry, error) {
+	if payload.DataID == "" {
+		return Entry{}, fmt.Errorf("entry key cannot be empty")
+	}
+	if payload.Version < 1 {
+		return Entry{}, fmt.Errorf("entry %s has invalid version %d", payload.DataID, payload.Version)
+	}
+
+	entry := Entry{
+		Key:       payload.DataID,
+		Version:   payload.Version,
+		Timestamp: payload.Timestamp,
+		Origin:    payload.Origin,
+		Deleted:   payload.Deleted,
+	}
+	if !payload.Deleted {
+		value, err := json.Marshal(payload.Content)
+		if err != nil {
+			return Entry{}, fmt.Errorf("entry %s has invalid content: %w", payload.DataID, err)
+		}
+		entry.Value = value
+	}
+	return entry, nil
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/p2ptest"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replica is a network plus replicator sharing one data directory
+type replica struct {
+	network    *p2p.Network
+	replicator *Replicator
+	state      kvstorage.KV
+	dataDir    string
+}
+
+// startReplica starts a replicating node on an ephemeral loopback port
+func startReplica(t *testing.T, ctx context.Context, nodeID, dataDir string) *replica {
+	r := &replica{dataDir: dataDir}
+	p2ptest.StartNode(t, ctx, nodeID,
+		p2ptest.WithDataDir(dataDir),
+		p2ptest.BeforeStart(func(started *p2ptest.Node) {
+			// The network and the store share the node's state storage
+			state, err := kvstorage.Open(started.Config.Storage.Backend, dataDir, storage.Direct)
+			require.NoError(t, err)
+			started.Network.SetKV(state)
+			kv, err := New(state)
+			require.NoError(t, err)
+			replicator, err := NewReplicator(kv, started.Network, started.Logger, 200*time.Millisecond)
+			require.NoError(t, err)
+			require.NoError(t, replicator.Start(ctx))
+			r.network, r.replicator, r.state = started.Network, replicator, state
+			t.Cleanup(r.stop)
+		}))
+	return r
+}
+
+// stop shuts the replica down; calling it twice is harmless
+func (r *replica) stop() {
+	r.replicator.Stop()
+	r.network.Stop()
+	r.state.Close()
+}
+
+// addr returns the replica's dialable address
+func (r *replica) addr() string {
+	return r.network.ListenAddr().String()
+}
+
+// connect dials another replica and waits until both can exchange sync traffic
+func (r *replica) connect(t *testing.T, other *replica) {
+	_, err := r.network.Connect(context.Background(), other.addr())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(r.network.PeersWithCapability(p2p.CapabilitySync)) > 0 &&
+			len(other.network.PeersWithCapability(p2p.CapabilitySync)) > 0
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+// snapshot returns every entry in the replica's store keyed by key
+func (r *replica) snapshot() map[string]string {
+	state := make(map[string]string)
+	for _, entry := range r.replicator.Store().Lookup(allKeys(r.replicator.Store())) {
+		if entry.Deleted {
+			state[entry.Key] = "<deleted>"
+		} else {
+			state[entry.Key] = string(entry.Value)
+		}
+	}
+	return state
+}
+
+// allKeys returns live keys and tombstones
+func allKeys(s *Store) []string {
+	changes, _ := s.Changes(0, 0)
+	keys := make([]string, 0, len(changes))
+	for _, entry := range changes {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+func TestReplicationConvergesAfterOffline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := startReplica(t, ctx, "store-node-a", t.TempDir())
+	b := startReplica(t, ctx, "store-node-b", t.TempDir())
+	c := startReplica(t, ctx, "store-node-c", t.TempDir())
+
+	// a - b - c line, so a's writes need to travel through b
+	b.connect(t, a)
+	c.connect(t, b)
+
+	require.NoError(t, a.replicator.Put("shared", "from-a"))
+	require.NoError(t, a.replicator.Put("doomed", 1))
+	require.Eventually(t, func() bool {
+		return len(c.replicator.Store().Keys()) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Take c offline and keep writing
+	cDir := c.dataDir
+	c.stop()
+	// b must see c leave, or it refuses c's return as a duplicate
+	require.Eventually(t, func() bool {
+		return b.network.Status().ActiveConnections == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, b.replicator.Put("while-offline", "from-b"))
+	require.NoError(t, a.replicator.Put("shared", "from-a-again"))
+	require.NoError(t, a.replicator.Delete("doomed"))
+
+	// Bring c back with its old data; the join pull fills in what it missed
+	c = startReplica(t, ctx, "store-node-c", cDir)
+	_, err := c.replicator.Get("shared")
+	require.NoError(t, err, "store should survive a restart")
+	c.connect(t, b)
+
+	require.Eventually(t, func() bool {
+		want := a.snapshot()
+		return assert.ObjectsAreEqual(want, b.snapshot()) && assert.ObjectsAreEqual(want, c.snapshot())
+	}, 5*time.Second, 50*time.Millisecond)
+
+	value, err := c.replicator.Get("shared")
+	require.NoError(t, err)
+	assert.JSONEq(t, `"from-a-again"`, string(value))
+	_, err = c.replicator.Get("doomed")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestConcurrentWritesConverge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := startReplica(t, ctx, "store-node-a", t.TempDir())
+	b := startReplica(t, ctx, "store-node-b", t.TempDir())
+
+	// Both sides write version 1 of the same key before they ever talk
+	require.NoError(t, a.replicator.Put("k", "a"))
+	require.NoError(t, b.replicator.Put("k", "b"))
+
+	b.connect(t, a)
+
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(a.snapshot(), b.snapshot())
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Each side noticed the clash once
+	assert.Equal(t, uint64(1), a.replicator.Store().Stats().Conflicts)
+	assert.Equal(t, uint64(1), b.replicator.Store().Stats().Conflicts)
+}
@@ -0,0 +1,353 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+)
+
+// Bucket is the bucket of the node's state that holds the replicated
+// store's entries, by key
+const Bucket = "store"
+
+// StoreFile is the file under the data directory that releases before the
+// state storage kept the replicated store in. MigrateFile moves it into
+// Bucket.
+const StoreFile = "store.json"
+
+// ErrNotFound is returned for keys that were never written or were deleted
+var ErrNotFound = errors.New("key not found")
+
+// Entry is a single versioned key. Deleted entries are kept as tombstones so
+// the delete replicates instead of being undone by a peer's older copy.
+type Entry struct {
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Version   int64           `json:"version"`
+	Timestamp int64           `json:"timestamp"`
+	Origin    string          `json:"origin"`
+	Deleted   bool            `json:"deleted,omitempty"`
+
+	// Updated is the local sequence at which this node stored the entry.
+	// Peers use it as a watermark to pull only what changed.
+	Updated int64 `json:"updated"`
+}
+
+// Wins reports whether e replaces other under last-writer-wins: the higher
+// version wins, then the later timestamp, then the higher origin ID so that
+// every node settles on the same entry
+func (e Entry) Wins(other Entry) bool {
+	if e.Version != other.Version {
+		return e.Version > other.Version
+	}
+	if e.Timestamp != other.Timestamp {
+		return e.Timestamp > other.Timestamp
+	}
+	if e.Origin != other.Origin {
+		return e.Origin > other.Origin
+	}
+	return false
+}
+
+// Stats summarizes the contents and history of a store
+type Stats struct {
+	Keys       int    `json:"keys"`
+	Tombstones int    `json:"tombstones"`
+	Applied    uint64 `json:"applied"`
+	Conflicts  uint64 `json:"conflicts"`
+}
+
+// Store is a versioned key-value store kept in the node's state storage
+type Store struct {
+	kv        kvstorage.KV
+	entries   map[string]Entry
+	sequence  int64
+	applied   uint64
+	conflicts uint64
+	// changed holds the keys stored since the last save
+	changed map[string]bool
+	mu      sync.RWMutex
+}
+
+// New opens the store kept in kv, loading any saved entries. A nil kv keeps
+// the store in memory only.
+func New(kv kvstorage.KV) (*Store, error) {
+	s := &Store{
+		kv:      kv,
+		entries: make(map[string]Entry),
+		changed: make(map[string]bool),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// MigrateFile moves the entries saved in path by an earlier release into kv
+func MigrateFile(kv kvstorage.KV, path string) error {
+	return kvstorage.Migrate(kv, Bucket, path, func(data []byte) (map[string][]byte, error) {
+		var entries []Entry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+		values := make(map[string][]byte)
+		for _, entry := range entries {
+			if entry.Key == "" {
+				continue
+			}
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return nil, err
+			}
+			values[entry.Key] = value
+		}
+		return values, nil
+	})
+}
+
+// load reads previously saved entries
+func (s *Store) load() error {
+	if s.kv == nil {
+		return nil
+	}
+
+	err := s.kv.Iterate(Bucket, func(key string, value []byte) error {
+		var entry Entry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return fmt.Errorf("failed to parse entry %s: %w", key, err)
+		}
+		if entry.Key != key {
+			return nil
+		}
+		s.entries[key] = entry
+		if entry.Updated > s.sequence {
+			s.sequence = entry.Updated
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read store: %w", err)
+	}
+	return nil
+}
+
+// Save writes the entries stored since the last save to storage
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.kv == nil || len(s.changed) == 0 {
+		return nil
+	}
+
+	err := s.kv.Update(func(tx kvstorage.Tx) error {
+		for key := range s.changed {
+			data, err := json.Marshal(s.entries[key])
+			if err != nil {
+				return fmt.Errorf("failed to marshal entry %s: %w", key, err)
+			}
+			if err := tx.Put(Bucket, key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+
+	s.changed = make(map[string]bool)
+	return nil
+}
+
+// Get returns the value of a live key
+func (s *Store) Get(key string) (json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, exists := s.entries[key]
+	if !exists || entry.Deleted {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return entry.Value, nil
+}
+
+// Entry returns the stored entry for a key, including tombstones
+func (s *Store) Entry(key string) (Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, exists := s.entries[key]
+	return entry, exists
+}
+
+// Put writes a value as a new version originating at origin
+func (s *Store) Put(key string, value interface{}, origin string) (Entry, error) {
+	if key == "" {
+		return Entry{}, fmt.Errorf("key cannot be empty")
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to marshal value for %s: %w", key, err)
+	}
+
+	// Refuse new data up front rather than failing the next save
+	if s.kv != nil {
+		if err := s.kv.Check(int64(len(key) + len(data))); err != nil {
+			return Entry{}, fmt.Errorf("failed to put %s: %w", key, err)
+		}
+	}
+
+	return s.write(key, data, false, origin), nil
+}
+
+// Delete replaces a key with a tombstone originating at origin
+func (s *Store) Delete(key, origin string) (Entry, error) {
+	if _, err := s.Get(key); err != nil {
+		return Entry{}, err
+	}
+	return s.write(key, nil, true, origin), nil
+}
+
+// write stores a local change one version above the current entry
+func (s *Store) write(key string, value json.RawMessage, deleted bool, origin string) Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := Entry{
+		Key:       key,
+		Value:     value,
+		Version:   s.entries[key].Version + 1,
+		Timestamp: time.Now().UnixNano(),
+		Origin:    origin,
+		Deleted:   deleted,
+	}
+	return s.storeLocked(entry)
+}
+
+// Apply merges an entry received from a peer and reports whether it replaced
+// the local copy. Two different writes with the same version are concurrent
+// and counted as a conflict before last-writer-wins picks one.
+func (s *Store) Apply(entry Entry) bool {
+	if entry.Key == "" {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists := s.entries[entry.Key]
+	if exists {
+		if current.Version == entry.Version &&
+			(current.Origin != entry.Origin || current.Timestamp != entry.Timestamp) {
+			s.conflicts++
+		}
+		if !entry.Wins(current) {
+			return false
+		}
+	}
+
+	s.storeLocked(entry)
+	s.applied++
+	return true
+}
+
+// storeLocked saves an entry under the next local sequence; callers must hold s.mu
+func (s *Store) storeLocked(entry Entry) Entry {
+	// Sequences follow the clock but never repeat or go backwards
+	s.sequence++
+	if now := time.Now().UnixNano(); now > s.sequence {
+		s.sequence = now
+	}
+	entry.Updated = s.sequence
+	if entry.Deleted {
+		entry.Value = nil
+	}
+
+	s.entries[entry.Key] = entry
+	s.changed[entry.Key] = true
+	return entry
+}
+
+// Changes returns up to limit entries stored after the since sequence, oldest
+// first, and whether more remain. A limit of zero returns everything.
+func (s *Store) Changes(since int64, limit int) ([]Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var changes []Entry
+	for _, entry := range s.entries {
+		if entry.Updated > since {
+			changes = append(changes, entry)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Updated < changes[j].Updated
+	})
+
+	if limit > 0 && len(changes) > limit {
+		return changes[:limit], true
+	}
+	return changes, false
+}
+
+// Lookup returns the stored entries, including tombstones, for the given keys
+func (s *Store) Lookup(keys []string) []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []Entry
+	for _, key := range keys {
+		if entry, exists := s.entries[key]; exists {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Keys returns the live keys in sorted order
+func (s *Store) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.entries))
+	for key, entry := range s.entries {
+		if !entry.Deleted {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Sequence returns the local sequence of the most recent change
+func (s *Store) Sequence() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sequence
+}
+
+// Stats returns counts of keys, tombstones, applied remote entries and conflicts
+func (s *Store) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := Stats{
+		Applied:   s.applied,
+		Conflicts: s.conflicts,
+	}
+	for _, entry := range s.entries {
+		if entry.Deleted {
+			stats.Tombstones++
+		} else {
+			stats.Keys++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,178 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kvstorage "github.com/princetheprogrammer/synapse/internal/storage"
+	"github.com/princetheprogrammer/synapse/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutGetDelete(t *testing.T) {
+	s, err := New(nil)
+	require.NoError(t, err)
+
+	entry, err := s.Put("greeting", "hello", "node-a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), entry.Version)
+
+	value, err := s.Get("greeting")
+	require.NoError(t, err)
+	assert.JSONEq(t, `"hello"`, string(value))
+
+	entry, err = s.Put("greeting", "hi", "node-a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), entry.Version)
+
+	tombstone, err := s.Delete("greeting", "node-a")
+	require.NoError(t, err)
+	assert.True(t, tombstone.Deleted)
+	assert.Equal(t, int64(3), tombstone.Version)
+
+	_, err = s.Get("greeting")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.Delete("greeting", "node-a")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	stats := s.Stats()
+	assert.Equal(t, 0, stats.Keys)
+	assert.Equal(t, 1, stats.Tombstones)
+}
+
+func TestApplyLastWriterWins(t *testing.T) {
+	s, err := New(nil)
+	require.NoError(t, err)
+
+	value := json.RawMessage(`"v"`)
+	assert.True(t, s.Apply(Entry{Key: "k", Value: value, Version: 2, Timestamp: 100, Origin: "node-a"}))
+
+	// Older versions are ignored regardless of timestamp
+	assert.False(t, s.Apply(Entry{Key: "k", Value: value, Version: 1, Timestamp: 900, Origin: "node-b"}))
+
+	// Same version: the later timestamp wins and the clash counts as a conflict
+	assert.True(t, s.Apply(Entry{Key: "k", Value: json.RawMessage(`"b"`), Version: 2, Timestamp: 200, Origin: "node-b"}))
+	assert.False(t, s.Apply(Entry{Key: "k", Value: json.RawMessage(`"c"`), Version: 2, Timestamp: 150, Origin: "node-c"}))
+
+	// Same version and timestamp: the higher origin wins
+	assert.True(t, s.Apply(Entry{Key: "k", Value: json.RawMessage(`"z"`), Version: 2, Timestamp: 200, Origin: "node-z"}))
+
+	got, err := s.Get("k")
+	require.NoError(t, err)
+	assert.JSONEq(t, `"z"`, string(got))
+	assert.Equal(t, uint64(3), s.Stats().Conflicts)
+
+	// Applying the winning entry again changes nothing
+	assert.False(t, s.Apply(Entry{Key: "k", Value: json.RawMessage(`"z"`), Version: 2, Timestamp: 200, Origin: "node-z"}))
+
+	// A newer tombstone removes the key
+	assert.True(t, s.Apply(Entry{Key: "k", Version: 3, Timestamp: 300, Origin: "node-a", Deleted: true}))
+	_, err = s.Get("k")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestChanges(t *testing.T) {
+	s, err := New(nil)
+	require.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := s.Put(key, key, "node-a")
+		require.NoError(t, err)
+	}
+
+	changes, more := s.Changes(0, 2)
+	require.Len(t, changes, 2)
+	assert.True(t, more)
+	assert.Equal(t, "a", changes[0].Key)
+	assert.Equal(t, "b", changes[1].Key)
+
+	changes, more = s.Changes(changes[1].Updated, 2)
+	require.Len(t, changes, 1)
+	assert.False(t, more)
+	assert.Equal(t, "c", changes[0].Key)
+	assert.Equal(t, s.Sequence(), changes[0].Updated)
+
+	changes, _ = s.Changes(s.Sequence(), 0)
+	assert.Empty(t, changes)
+}
+
+func TestStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), kvstorage.BoltFile)
+	kv, err := kvstorage.OpenBolt(path, storage.Direct)
+	require.NoError(t, err)
+
+	s, err := New(kv)
+	require.NoError(t, err)
+	_, err = s.Put("kept", map[string]int{"n": 1}, "node-a")
+	require.NoError(t, err)
+	_, err = s.Put("removed", true, "node-a")
+	require.NoError(t, err)
+	_, err = s.Delete("removed", "node-a")
+	require.NoError(t, err)
+	require.NoError(t, s.Save())
+	require.NoError(t, kv.Close())
+
+	kv, err = kvstorage.OpenBolt(path, storage.Direct)
+	require.NoError(t, err)
+	defer kv.Close()
+	reopened, err := New(kv)
+	require.NoError(t, err)
+
+	value, err := reopened.Get("kept")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"n":1}`, string(value))
+
+	tombstone, exists := reopened.Entry("removed")
+	require.True(t, exists)
+	assert.True(t, tombstone.Deleted)
+	assert.Equal(t, []string{"kept"}, reopened.Keys())
+	assert.Equal(t, s.Sequence(), reopened.Sequence())
+}
+
+func TestMigrateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), StoreFile)
+	data := `[
+  {"key": "kept", "value": {"n": 1}, "version": 2, "origin": "node-a", "updated": 7},
+  {"key": "removed", "version": 3, "origin": "node-b", "deleted": true, "updated": 9},
+  {"key": "", "value": 1}
+]`
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+
+	kv := kvstorage.NewMemory()
+	require.NoError(t, MigrateFile(kv, path))
+	assert.NoFileExists(t, path)
+
+	s, err := New(kv)
+	require.NoError(t, err)
+	value, err := s.Get("kept")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"n":1}`, string(value))
+	tombstone, exists := s.Entry("removed")
+	require.True(t, exists)
+	assert.True(t, tombstone.Deleted)
+	assert.Equal(t, int64(9), s.Sequence())
+}
+
+func TestPutRespectsQuota(t *testing.T) {
+	dir := t.TempDir()
+	manager, err := storage.NewManager(dir, 512, 0.9)
+	require.NoError(t, err)
+
+	kv, err := kvstorage.OpenJSON(filepath.Join(dir, kvstorage.JSONFile), manager)
+	require.NoError(t, err)
+	s, err := New(kv)
+	require.NoError(t, err)
+
+	_, err = s.Put("small", "ok", "node-a")
+	require.NoError(t, err)
+	require.NoError(t, s.Save())
+
+	_, err = s.Put("large", strings.Repeat("x", 512), "node-a")
+	assert.ErrorIs(t, err, storage.ErrQuotaExceeded)
+	_, err = s.Get("large")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,145 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+)
+
+// execution is a task we run for a peer
+type execution struct {
+	submitter string
+	cancel    context.CancelFunc
+}
+
+// executionKey identifies a task we run; task IDs are only trusted to be
+// unique per submitter
+func executionKey(peerID, taskID string) string {
+	return peerID + "/" + taskID
+}
+
+// handleSubmit runs a TASK_SUBMIT from a peer and answers with its
+// TASK_RESULT. A task we do not run, or one that would take us past our
+// limit, is rejected with an ERROR so the submitter tries another peer, as
+// is one that times out or is cancelled.
+func (s *Scheduler) handleSubmit(msg p2p.Message) {
+	var payload p2p.TaskSubmitPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		s.replyError(msg, p2p.ErrorCodeInvalidMessage, err.Error())
+		return
+	}
+	handler, ok := s.registry.Lookup(payload.Name)
+	if !ok {
+		s.reject(msg, p2p.ErrorCodeNotImplemented, fmt.Sprintf("task %s is not run here", payload.Name))
+		return
+	}
+
+	key := executionKey(msg.Sender, payload.TaskID)
+	s.mu.Lock()
+	if _, exists := s.running[key]; exists {
+		s.mu.Unlock()
+		s.reject(msg, p2p.ErrorCodeInvalidMessage, fmt.Sprintf("task %s is already running", payload.TaskID))
+		return
+	}
+	if len(s.running) >= s.capacity {
+		s.mu.Unlock()
+		s.reject(msg, p2p.ErrorCodeBusy, fmt.Sprintf("at most %d tasks run at once", s.capacity))
+		return
+	}
+	timeout := time.Duration(payload.TimeoutMs) * time.Millisecond
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	s.running[key] = &execution{submitter: msg.Sender, cancel: cancel}
+	s.mu.Unlock()
+
+	// Handlers run on the network's message loop, so the task must not block it
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		start := time.Now()
+		output, err := runHandler(ctx, handler, payload.Input)
+
+		s.mu.Lock()
+		delete(s.running, key)
+		s.stats.Executed++
+		result := p2p.TaskResultPayload{
+			TaskID:     payload.TaskID,
+			Output:     output,
+			DurationMs: time.Since(start).Milliseconds(),
+			Running:    len(s.running),
+			Capacity:   s.capacity,
+		}
+		s.mu.Unlock()
+
+		// A task cut short says nothing about the task, so the submitter
+		// may try it elsewhere
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			s.replyError(msg, p2p.ErrorCodeTimeout, fmt.Sprintf("task %s timed out after %v", payload.TaskID, timeout))
+			return
+		}
+		if ctx.Err() != nil {
+			s.replyError(msg, p2p.ErrorCodeBusy, fmt.Sprintf("task %s was cancelled", payload.TaskID))
+			return
+		}
+		if err != nil {
+			result.Output = nil
+			result.Error = err.Error()
+		}
+		if err := s.network.Reply(msg, p2p.MessageTypeTaskResult, result); err != nil {
+			s.logger.Debugf("failed to return result of task %s to %s: %v", payload.TaskID, msg.Sender, err)
+		}
+	}()
+}
+
+// runHandler runs a task, turning a panic into its error
+func runHandler(ctx context.Context, handler Handler, input []byte) (output []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked: %v", r)
+		}
+	}()
+	return handler(ctx, input)
+}
+
+// handleStatus tells a peer whether we are running a task it submitted, and
+// how busy we are
+func (s *Scheduler) handleStatus(msg p2p.Message) {
+	var payload p2p.TaskStatusPayload
+	if err := msg.DecodePayload(&payload); err != nil {
+		s.replyError(msg, p2p.ErrorCodeInvalidMessage, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	status := p2p.TaskStatusPayload{TaskID: payload.TaskID, State: StateUnknown, Running: len(s.running), Capacity: s.capacity}
+	if _, running := s.running[executionKey(msg.Sender, payload.TaskID)]; running {
+		status.State = StateRunning
+	}
+	s.mu.Unlock()
+
+	if err := s.network.Reply(msg, p2p.MessageTypeTaskStatus, status); err != nil {
+		s.logger.Debugf("failed to answer task status request from %s: %v", msg.Sender, err)
+	}
+}
+
+// reject refuses a TASK_SUBMIT and counts it
+func (s *Scheduler) reject(msg p2p.Message, code, reason string) {
+	s.count(func(stats *Stats) { stats.Rejected++ })
+	s.replyError(msg, code, reason)
+}
+
+// replyError answers a task message with an ERROR
+func (s *Scheduler) replyError(msg p2p.Message, code, reason string) {
+	err := s.network.Reply(msg, p2p.MessageTypeError, p2p.ErrorPayload{
+		Code:      code,
+		Message:   reason,
+		MessageID: msg.ID,
+	})
+	if err != nil {
+		s.logger.Debugf("failed to reject task message from %s: %v", msg.Sender, err)
+	}
+}
@@ -0,0 +1,119 @@
+// Package task runs named tasks on capable peers. A node registers the tasks
+// it runs for others in a Registry, and its Scheduler advertises them and
+// submits tasks of its own to the peer best placed to run them, retrying on
+// another when an executor fails.
+package task
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// capabilityPrefix starts the capability a peer advertises for each task it
+// runs
+const capabilityPrefix = "task:"
+
+// validName matches task names and the capabilities tasks declare
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// Handler runs a task on its input and returns the output. ctx ends when the
+// task's timeout passes, its submitter goes away or the node stops.
+type Handler func(ctx context.Context, input []byte) ([]byte, error)
+
+// Capability returns the capability a peer advertises when it runs the task
+// name
+func Capability(name string) string {
+	return capabilityPrefix + name
+}
+
+// registration is a registered task
+type registration struct {
+	handler      Handler
+	capabilities []string
+}
+
+// Registry holds the tasks this node runs for its peers. Peers learn what a
+// node runs from its HELLO, so tasks are registered before the node starts.
+type Registry struct {
+	mu    sync.RWMutex
+	tasks map[string]registration
+}
+
+// NewRegistry creates an empty task registry
+func NewRegistry() *Registry {
+	return &Registry{
+		tasks: make(map[string]registration),
+	}
+}
+
+// Register adds a task run by handler. The capabilities it declares, such as
+// "gpu", are advertised alongside the task so submitters can require them.
+func (r *Registry) Register(name string, handler Handler, capabilities ...string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid task name %q", name)
+	}
+	if handler == nil {
+		return fmt.Errorf("task %s has no handler", name)
+	}
+	for _, capability := range capabilities {
+		if !validName.MatchString(capability) {
+			return fmt.Errorf("task %s declares invalid capability %q", name, capability)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.tasks[name]; exists {
+		return fmt.Errorf("task %s is already registered", name)
+	}
+	r.tasks[name] = registration{handler: handler, capabilities: append([]string(nil), capabilities...)}
+	return nil
+}
+
+// Lookup returns the handler of a registered task
+func (r *Registry) Lookup(name string) (Handler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	task, exists := r.tasks[name]
+	return task.handler, exists
+}
+
+// Names returns the registered tasks in order
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.tasks))
+	for name := range r.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Capabilities returns what a node running the registered tasks advertises:
+// the capability of each task and those the tasks declare, in order
+func (r *Registry) Capabilities() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	for name, task := range r.tasks {
+		seen[Capability(name)] = true
+		for _, capability := range task.capabilities {
+			seen[capability] = true
+		}
+	}
+
+	capabilities := make([]string, 0, len(seen))
+	for capability := range seen {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
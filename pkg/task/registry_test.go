@@ -0,0 +1,36 @@
+package task
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(ctx context.Context, input []byte) ([]byte, error) {
+	return input, nil
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	require.NoError(t, registry.Register("sha256", echo))
+	require.NoError(t, registry.Register("render.frame", echo, "gpu", "gpu-large"))
+
+	assert.Error(t, registry.Register("sha256", echo), "a task is registered once")
+	assert.Error(t, registry.Register("", echo))
+	assert.Error(t, registry.Register("has space", echo))
+	assert.Error(t, registry.Register("resize", nil))
+	assert.Error(t, registry.Register("resize", echo, "gpu,cpu"))
+
+	handler, ok := registry.Lookup("sha256")
+	require.True(t, ok)
+	output, err := handler(context.Background(), []byte("blob"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("blob"), output)
+	_, ok = registry.Lookup("resize")
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{"render.frame", "sha256"}, registry.Names())
+	assert.Equal(t, []string{"gpu", "gpu-large", "task:render.frame", "task:sha256"}, registry.Capabilities())
+}
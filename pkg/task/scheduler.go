@@ -0,0 +1,485 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/internal/logger"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/monitor"
+)
+
+// resultMargin is added to a task's timeout to cover the round trip to its
+// executor
+const resultMargin = 5 * time.Second
+
+// States a TASK_STATUS reports for a task
+const (
+	// StateRunning is a task the executor is running
+	StateRunning = "running"
+
+	// StateUnknown is a task the executor is not running, because it
+	// finished or never arrived
+	StateUnknown = "unknown"
+)
+
+// ErrNoExecutor is returned when no capable peer ran a task
+var ErrNoExecutor = errors.New("no capable peer ran the task")
+
+// errExecutorLost ends an attempt whose executor disconnected
+var errExecutorLost = errors.New("executor disconnected")
+
+// Error is returned for a task that ran and failed at its executor. Unlike a
+// failing executor, it is not retried elsewhere.
+type Error struct {
+	TaskID   string
+	Executor string
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("task %s failed on %s: %s", e.TaskID, e.Executor, e.Message)
+}
+
+// Task is a named task to run on a peer
+type Task struct {
+	Name  string
+	Input []byte
+	// Requires lists capabilities the executor must advertise besides the
+	// task itself
+	Requires []string
+	// Timeout bounds each attempt; zero uses the configured timeout
+	Timeout time.Duration
+}
+
+// Result is the outcome of a task that ran
+type Result struct {
+	TaskID   string
+	Executor string
+	Output   []byte
+	// Attempts counts the executors the task was sent to
+	Attempts int
+	Duration time.Duration
+}
+
+// Status is what an executor reports about a task
+type Status struct {
+	TaskID   string `json:"task_id"`
+	State    string `json:"state"`
+	Running  int    `json:"running"`
+	Capacity int    `json:"capacity"`
+}
+
+// InFlight describes a submitted task waiting for its result
+type InFlight struct {
+	TaskID   string    `json:"task_id"`
+	Name     string    `json:"name"`
+	Executor string    `json:"executor"`
+	Attempt  int       `json:"attempt"`
+	Started  time.Time `json:"started"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// Stats counts the tasks submitted and run for the network report
+type Stats struct {
+	Submitted uint64 `json:"submitted"`
+	Completed uint64 `json:"completed"`
+	Failed    uint64 `json:"failed"`
+	Retries   uint64 `json:"retries"`
+	Executed  uint64 `json:"executed"`
+	Rejected  uint64 `json:"rejected"`
+	Running   int    `json:"running"`
+	InFlight  int    `json:"in_flight"`
+}
+
+// attempt is a submitted task sent to one executor
+type attempt struct {
+	InFlight
+	cancel context.CancelCauseFunc
+}
+
+// peerLoad is how busy an executor last said it was
+type peerLoad struct {
+	running  int
+	capacity int
+}
+
+// Scheduler runs the registered tasks for peers that submit them, and
+// submits tasks to the peers advertising them: the one with the best
+// reputation and the least load first, then, if an executor fails, the next
+// one, up to the configured number of retries.
+type Scheduler struct {
+	registry   *Registry
+	network    *p2p.Network
+	logger     *logger.Logger
+	metrics    *monitor.ServiceMetrics
+	timeout    time.Duration
+	maxRetries int
+	capacity   int
+
+	mu sync.Mutex
+	// inflight are our tasks waiting for a result, by task ID
+	inflight map[string]*attempt
+	// assigned counts our tasks in flight at each executor
+	assigned map[string]int
+	loads    map[string]peerLoad
+	// running are the tasks we run for peers, by submitter and task ID
+	running map[string]*execution
+	stats   Stats
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewScheduler creates the task scheduler for a node, running the tasks in
+// registry for its peers
+func NewScheduler(registry *Registry, network *p2p.Network, log *logger.Logger, cfg config.TaskConfig) (*Scheduler, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("registry cannot be nil")
+	}
+	if network == nil {
+		return nil, fmt.Errorf("network cannot be nil")
+	}
+	if log == nil {
+		return nil, fmt.Errorf("logger cannot be nil")
+	}
+
+	capacity := cfg.MaxConcurrent
+	if capacity < 1 {
+		capacity = 1
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+
+	return &Scheduler{
+		registry:   registry,
+		network:    network,
+		logger:     log.With("component", "tasks"),
+		metrics:    network.ServiceMetrics("tasks"),
+		timeout:    timeout,
+		maxRetries: cfg.MaxRetries,
+		capacity:   capacity,
+		inflight:   make(map[string]*attempt),
+		assigned:   make(map[string]int),
+		loads:      make(map[string]peerLoad),
+		running:    make(map[string]*execution),
+	}, nil
+}
+
+// Start runs submitted tasks and advertises those in the registry. It must
+// be called before the network starts so the tasks are part of our first
+// HELLO.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+
+	s.network.RegisterHandler(p2p.MessageTypeTaskSubmit, s.handleSubmit)
+	s.network.RegisterHandler(p2p.MessageTypeTaskStatus, s.handleStatus)
+	s.network.AdvertiseCapability(p2p.CapabilityTask, func() bool { return len(s.registry.Names()) > 0 })
+	for _, capability := range s.registry.Capabilities() {
+		s.network.AdvertiseCapability(capability, func() bool { return true })
+	}
+	s.network.AddReportSection("tasks", func() interface{} { return s.Stats() })
+
+	events, unsubscribe := s.network.Subscribe(64)
+	s.wg.Add(1)
+	go s.watchPeers(events, unsubscribe)
+}
+
+// Stop cancels the tasks being run for peers and waits for them
+func (s *Scheduler) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+// Registry returns the tasks this node runs for its peers
+func (s *Scheduler) Registry() *Registry {
+	return s.registry
+}
+
+// Submit runs a task on a peer advertising it and every capability it
+// requires, and returns its result. An executor that fails, times out or
+// disconnects is given up on and the task sent to the next, each attempt to
+// a different executor. A task that ran and failed returns an *Error.
+func (s *Scheduler) Submit(ctx context.Context, task Task) (*Result, error) {
+	if !validName.MatchString(task.Name) {
+		return nil, fmt.Errorf("invalid task name %q", task.Name)
+	}
+	if task.Timeout <= 0 {
+		task.Timeout = s.timeout
+	}
+
+	taskID := uuid.New().String()
+	s.mu.Lock()
+	s.stats.Submitted++
+	s.mu.Unlock()
+
+	tried := make(map[string]bool)
+	var lastPeer string
+	var lastErr error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		peerID, ok := s.pick(task, tried)
+		if !ok {
+			break
+		}
+		if attempt > 0 {
+			s.count(func(stats *Stats) { stats.Retries++ })
+			s.logger.Debugf("retrying task %s on %s: %v", taskID, peerID, lastErr)
+		}
+
+		result, err := s.run(ctx, peerID, taskID, attempt, task)
+		if err == nil {
+			result.Attempts = attempt + 1
+			s.count(func(stats *Stats) { stats.Completed++ })
+			return result, nil
+		}
+
+		var taskErr *Error
+		if errors.As(err, &taskErr) || ctx.Err() != nil {
+			s.count(func(stats *Stats) { stats.Failed++ })
+			return nil, err
+		}
+		tried[peerID] = true
+		lastPeer, lastErr = peerID, err
+	}
+
+	s.count(func(stats *Stats) { stats.Failed++ })
+	if lastErr == nil {
+		return nil, fmt.Errorf("%w: no connected peer runs %s", ErrNoExecutor, task.Name)
+	}
+	return nil, fmt.Errorf("%w: task %s tried on %d peers, last error from %s: %w", ErrNoExecutor, taskID, len(tried), lastPeer, lastErr)
+}
+
+// pick returns the executor for a task's next attempt: of the connected
+// peers that advertise the task and its requirements and have not been
+// tried, the one whose reputation less its load is highest
+func (s *Scheduler) pick(task Task, tried map[string]bool) (string, bool) {
+	var candidates []string
+	for _, peer := range s.network.PeersWithCapability(Capability(task.Name)) {
+		if tried[peer.ID] || !peer.HasCapability(p2p.CapabilityTask) {
+			continue
+		}
+		capable := true
+		for _, capability := range task.Requires {
+			capable = capable && peer.HasCapability(capability)
+		}
+		if capable {
+			candidates = append(candidates, peer.ID)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	score := make(map[string]float64, len(candidates))
+	for _, peerID := range candidates {
+		score[peerID] = s.network.PeerReputation(peerID) - s.load(peerID)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if score[candidates[i]] != score[candidates[j]] {
+			return score[candidates[i]] > score[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	return candidates[0], true
+}
+
+// load estimates how busy an executor is, from 0 when idle to 1 when it
+// runs as many tasks as it can, counting what it last reported and our
+// tasks sent to it since. A peer whose heartbeats say it is overloaded
+// counts as full.
+func (s *Scheduler) load(peerID string) float64 {
+	s.mu.Lock()
+	reported, known := s.loads[peerID]
+	assigned := s.assigned[peerID]
+	s.mu.Unlock()
+
+	if !known {
+		reported = peerLoad{capacity: 1}
+	}
+	load := float64(reported.running+assigned) / float64(reported.capacity)
+	if quality, ok := s.network.GetConnectionQuality(peerID); ok && quality.Load != nil && quality.Load.Overloaded {
+		load++
+	}
+	return load
+}
+
+// run sends a task to one executor and waits for its result, until the
+// task's timeout, the executor disconnects or ctx ends
+func (s *Scheduler) run(ctx context.Context, peerID, taskID string, number int, task Task) (*Result, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	ctx, stop := context.WithTimeout(ctx, task.Timeout+resultMargin)
+	defer stop()
+
+	start := time.Now()
+	s.track(&attempt{
+		InFlight: InFlight{
+			TaskID:   taskID,
+			Name:     task.Name,
+			Executor: peerID,
+			Attempt:  number + 1,
+			Started:  start,
+			Deadline: start.Add(task.Timeout),
+		},
+		cancel: cancel,
+	})
+	defer s.untrack(taskID, peerID)
+
+	msg := p2p.NewMessage(p2p.MessageTypeTaskSubmit, s.network.NodeID(), p2p.TaskSubmitPayload{
+		TaskID:    taskID,
+		Name:      task.Name,
+		Input:     task.Input,
+		TimeoutMs: task.Timeout.Milliseconds(),
+	})
+	reply, err := s.network.Request(ctx, peerID, msg)
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, ctx.Err()) {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+		s.metrics.Observe(time.Since(start), err)
+		return nil, err
+	}
+
+	var payload p2p.TaskResultPayload
+	if err := reply.DecodePayload(&payload); err != nil {
+		s.metrics.Observe(time.Since(start), err)
+		return nil, err
+	}
+	s.recordLoad(peerID, payload.Running, payload.Capacity)
+	s.metrics.Observe(time.Since(start), nil)
+
+	if payload.Error != "" {
+		return nil, &Error{TaskID: taskID, Executor: peerID, Message: payload.Error}
+	}
+	return &Result{
+		TaskID:   taskID,
+		Executor: peerID,
+		Output:   payload.Output,
+		Duration: time.Since(start),
+	}, nil
+}
+
+// Status asks an executor about a task, and how busy it is
+func (s *Scheduler) Status(ctx context.Context, peerID, taskID string) (*Status, error) {
+	msg := p2p.NewMessage(p2p.MessageTypeTaskStatus, s.network.NodeID(), p2p.TaskStatusPayload{TaskID: taskID})
+	reply, err := s.network.Request(ctx, peerID, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload p2p.TaskStatusPayload
+	if err := reply.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+	s.recordLoad(peerID, payload.Running, payload.Capacity)
+	return &Status{TaskID: taskID, State: payload.State, Running: payload.Running, Capacity: payload.Capacity}, nil
+}
+
+// InFlight returns our tasks waiting for a result, oldest first
+func (s *Scheduler) InFlight() []InFlight {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks := make([]InFlight, 0, len(s.inflight))
+	for _, attempt := range s.inflight {
+		tasks = append(tasks, attempt.InFlight)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].Started.Before(tasks[j].Started)
+	})
+	return tasks
+}
+
+// Stats returns the scheduler's counters
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.Running = len(s.running)
+	stats.InFlight = len(s.inflight)
+	return stats
+}
+
+// count updates the counters
+func (s *Scheduler) count(update func(stats *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&s.stats)
+}
+
+// track records an attempt in flight
+func (s *Scheduler) track(a *attempt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inflight[a.TaskID] = a
+	s.assigned[a.Executor]++
+}
+
+// untrack forgets an attempt that ended
+func (s *Scheduler) untrack(taskID, peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inflight, taskID)
+	s.assigned[peerID]--
+	if s.assigned[peerID] <= 0 {
+		delete(s.assigned, peerID)
+	}
+}
+
+// recordLoad remembers how busy an executor said it was
+func (s *Scheduler) recordLoad(peerID string, running, capacity int) {
+	if capacity < 1 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loads[peerID] = peerLoad{running: running, capacity: capacity}
+}
+
+// watchPeers gives up on the attempts at an executor that disconnects, so
+// they are retried without waiting out their timeout, and cancels the tasks
+// we run for a submitter that disconnects
+func (s *Scheduler) watchPeers(events <-chan p2p.Event, unsubscribe func()) {
+	defer s.wg.Done()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case evt := <-events:
+			if evt.Type != p2p.EventPeerDisconnected {
+				continue
+			}
+
+			s.mu.Lock()
+			for _, attempt := range s.inflight {
+				if attempt.Executor == evt.PeerID {
+					attempt.cancel(errExecutorLost)
+				}
+			}
+			for _, execution := range s.running {
+				if execution.submitter == evt.PeerID {
+					execution.cancel()
+				}
+			}
+			delete(s.loads, evt.PeerID)
+			s.mu.Unlock()
+		}
+	}
+}
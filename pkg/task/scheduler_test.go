@@ -0,0 +1,206 @@
+package task
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/princetheprogrammer/synapse/internal/config"
+	"github.com/princetheprogrammer/synapse/pkg/p2p"
+	"github.com/princetheprogrammer/synapse/pkg/p2p/p2ptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type taskNode struct {
+	network   *p2p.Network
+	scheduler *Scheduler
+}
+
+// startTaskNode starts a network with a scheduler running the tasks in
+// registry
+func startTaskNode(t *testing.T, ctx context.Context, nodeID string, registry *Registry) *taskNode {
+	node := &taskNode{}
+	p2ptest.StartNode(t, ctx, nodeID,
+		p2ptest.WithConfig(func(cfg *config.Config) { cfg.Tasks.MaxRetries = 2 }),
+		p2ptest.BeforeStart(func(started *p2ptest.Node) {
+			scheduler, err := NewScheduler(registry, started.Network, started.Logger, started.Config.Tasks)
+			require.NoError(t, err)
+			scheduler.Start(ctx)
+			t.Cleanup(scheduler.Stop)
+			node.network, node.scheduler = started.Network, scheduler
+		}))
+	return node
+}
+
+// connect dials other and waits until its capabilities are known
+func (n *taskNode) connect(t *testing.T, other *taskNode) {
+	_, err := n.network.Connect(context.Background(), other.network.ListenAddr().String())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		peer, ok := n.network.Peer(other.network.NodeID())
+		return ok && peer.Capabilities != nil
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+// hashBlob is the "sha256" task: the hex SHA-256 of its input
+func hashBlob(ctx context.Context, input []byte) ([]byte, error) {
+	sum := sha256.Sum256(input)
+	return []byte(hex.EncodeToString(sum[:])), nil
+}
+
+// blockUntilDone is a task that only ends with its context
+func blockUntilDone(ctx context.Context, input []byte) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSubmitRunsTaskOnCapablePeer(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	executors := NewRegistry()
+	require.NoError(t, executors.Register("sha256", hashBlob))
+	require.NoError(t, executors.Register("wait", func(ctx context.Context, input []byte) ([]byte, error) {
+		select {
+		case <-release:
+			return []byte("done"), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}))
+
+	a := startTaskNode(t, ctx, "task-node-a", NewRegistry())
+	b := startTaskNode(t, ctx, "task-node-b", executors)
+	a.connect(t, b)
+
+	assert.Len(t, a.network.PeersWithCapability(Capability("sha256")), 1)
+	require.Eventually(t, func() bool {
+		return len(b.network.ConnectedPeers()) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Empty(t, b.network.PeersWithCapability(p2p.CapabilityTask), "a node without tasks must not advertise any")
+
+	blob := make([]byte, 64*1024)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	result, err := a.scheduler.Submit(ctx, Task{Name: "sha256", Input: blob})
+	require.NoError(t, err)
+	expected, _ := hashBlob(ctx, blob)
+	assert.Equal(t, expected, result.Output)
+	assert.Equal(t, "task-node-b", result.Executor)
+	assert.Equal(t, 1, result.Attempts)
+
+	// A running task is in flight at the submitter and reported by its executor
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.scheduler.Submit(ctx, Task{Name: "wait"})
+		done <- err
+	}()
+	require.Eventually(t, func() bool {
+		return len(a.scheduler.InFlight()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	inflight := a.scheduler.InFlight()[0]
+	assert.Equal(t, "task-node-b", inflight.Executor)
+	assert.Equal(t, "wait", inflight.Name)
+
+	require.Eventually(t, func() bool {
+		status, err := a.scheduler.Status(ctx, "task-node-b", inflight.TaskID)
+		return err == nil && status.State == StateRunning
+	}, 5*time.Second, 20*time.Millisecond)
+	status, err := b.scheduler.Status(ctx, "task-node-a", inflight.TaskID)
+	require.NoError(t, err)
+	assert.Equal(t, StateUnknown, status.State, "the task runs at b, not a")
+
+	close(release)
+	require.NoError(t, <-done)
+	status, err = a.scheduler.Status(ctx, "task-node-b", inflight.TaskID)
+	require.NoError(t, err)
+	assert.Equal(t, StateUnknown, status.State)
+	assert.Equal(t, 0, status.Running)
+	assert.Equal(t, 4, status.Capacity)
+
+	stats := a.scheduler.Stats()
+	assert.Equal(t, uint64(2), stats.Submitted)
+	assert.Equal(t, uint64(2), stats.Completed)
+	assert.Equal(t, 0, stats.InFlight)
+	assert.Equal(t, uint64(2), b.scheduler.Stats().Executed)
+	assert.Contains(t, a.network.GetNetworkReport().Sections, "tasks")
+}
+
+func TestSubmitRetriesOnExecutorFailure(t *testing.T) {
+	ctx := context.Background()
+	var failures atomic.Int32
+	fail := func(ctx context.Context, input []byte) ([]byte, error) {
+		failures.Add(1)
+		return nil, errors.New("bad input")
+	}
+
+	slowTasks := NewRegistry()
+	require.NoError(t, slowTasks.Register("sha256", blockUntilDone))
+	require.NoError(t, slowTasks.Register("fail", fail))
+	fastTasks := NewRegistry()
+	require.NoError(t, fastTasks.Register("sha256", hashBlob))
+	require.NoError(t, fastTasks.Register("fail", fail))
+
+	slow := startTaskNode(t, ctx, "task-a-slow", slowTasks)
+	fast := startTaskNode(t, ctx, "task-b-fast", fastTasks)
+	edge := startTaskNode(t, ctx, "task-edge", NewRegistry())
+	edge.connect(t, slow)
+	edge.connect(t, fast)
+
+	// The slow executor is tried first and times out
+	result, err := edge.scheduler.Submit(ctx, Task{Name: "sha256", Input: []byte("blob"), Timeout: 300 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, "task-b-fast", result.Executor)
+	assert.Equal(t, 2, result.Attempts)
+	expected, _ := hashBlob(ctx, []byte("blob"))
+	assert.Equal(t, expected, result.Output)
+	assert.Equal(t, uint64(1), edge.scheduler.Stats().Retries)
+
+	// A task that fails at its executor is not tried again elsewhere
+	_, err = edge.scheduler.Submit(ctx, Task{Name: "fail"})
+	var taskErr *Error
+	require.ErrorAs(t, err, &taskErr)
+	assert.Contains(t, taskErr.Message, "bad input")
+	assert.Equal(t, int32(1), failures.Load())
+
+	// An executor that disconnects is given up on without waiting out the timeout
+	go func() {
+		require.Eventually(t, func() bool {
+			return len(edge.scheduler.InFlight()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		slow.network.Stop()
+	}()
+	start := time.Now()
+	result, err = edge.scheduler.Submit(ctx, Task{Name: "sha256", Input: []byte("blob"), Timeout: 10 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, "task-b-fast", result.Executor)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestSubmitWithoutExecutor(t *testing.T) {
+	ctx := context.Background()
+	tasks := NewRegistry()
+	require.NoError(t, tasks.Register("sha256", hashBlob, "cpu"))
+	executor := startTaskNode(t, ctx, "task-executor", tasks)
+	edge := startTaskNode(t, ctx, "task-edge", NewRegistry())
+
+	_, err := edge.scheduler.Submit(ctx, Task{Name: "sha256"})
+	assert.ErrorIs(t, err, ErrNoExecutor)
+
+	edge.connect(t, executor)
+	_, err = edge.scheduler.Submit(ctx, Task{Name: "sha256", Requires: []string{"gpu"}})
+	assert.ErrorIs(t, err, ErrNoExecutor)
+	_, err = edge.scheduler.Submit(ctx, Task{Name: "sha256", Requires: []string{"cpu"}})
+	assert.NoError(t, err)
+	_, err = edge.scheduler.Submit(ctx, Task{Name: "resize"})
+	assert.ErrorIs(t, err, ErrNoExecutor)
+	_, err = edge.scheduler.Submit(ctx, Task{Name: ""})
+	assert.Error(t, err)
+
+	assert.Equal(t, uint64(3), edge.scheduler.Stats().Failed)
+}